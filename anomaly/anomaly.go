@@ -0,0 +1,268 @@
+// Package anomaly flags statistical anomalies in a stream of parsed commands, e.g. from P4dFileParser.LogParser(), as
+// candidates for incidents when analysing logs in batch (e.g. a nightly log2sql run):
+//
+//   - lapse - a command taking much longer than usual for its cmd type (z-score of CompletedLapse against all
+//     previous commands of that type)
+//   - errorRate - a sudden rise in the proportion of commands in error in a time window (e.g. a minute) compared with
+//     previous windows
+//   - running - a surge in the number of running commands (max Running of commands starting in a window) compared with
+//     previous windows
+//
+// Statistics are kept separately for each ServerID, and baselines are built up as commands are seen, so no anomalies
+// are reported until enough have been seen (Config.MinSamples commands of a type, Config.MinWindows windows). Times are
+// log times - windows are by command end time (start time if not completed), so are closed as later commands are seen.
+// Anomalous values are included in the baselines, so a sustained change soon stops being reported.
+package anomaly
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Types of anomaly
+const (
+	TypeLapse     = "lapse"     // Command lapse time - Value in secs
+	TypeErrorRate = "errorRate" // Proportion (0-1) of commands in error in a window
+	TypeRunning   = "running"   // Max running commands in a window
+)
+
+// Minimum standard deviations used for scores, so that a baseline with (almost) no variation doesn't make every
+// small change anomalous
+const (
+	minLapseStdDev     = 0.5  // secs
+	minErrorRateStdDev = 0.02 // 2% of commands
+	minRunningStdDev   = 2.0  // commands
+)
+
+// Config - thresholds for detection. Zero values are replaced by those of DefaultConfig().
+type Config struct {
+	ZScore        float64       // Anomalies are values at least this many standard deviations above the mean
+	MinSamples    int64         // Commands of a type seen before their lapse times are scored
+	MinLapse      float64       // Commands taking less than this (secs) are never lapse anomalies
+	Window        time.Duration // Period for error rates and running counts
+	MinWindows    int64         // Windows seen before error rates and running counts are scored
+	MinWindowCmds int64         // Windows with fewer commands are not included in error rates
+}
+
+// DefaultConfig returns the default thresholds
+func DefaultConfig() Config {
+	return Config{ZScore: 3, MinSamples: 30, MinLapse: 1, Window: time.Minute, MinWindows: 10, MinWindowCmds: 10}
+}
+
+// Anomaly - a value which is unusual compared with those seen before. For TypeLapse the command is identified by
+// ProcessKey/LineNo, for the others Time is the start of the window and Commands the number completed in it.
+type Anomaly struct {
+	Type       string    `json:"type"` // One of Type*
+	Time       time.Time `json:"time"`
+	ServerID   string    `json:"serverID,omitempty"`
+	Cmd        string    `json:"cmd,omitempty"`
+	User       string    `json:"user,omitempty"`
+	ProcessKey string    `json:"processKey,omitempty"`
+	LineNo     int64     `json:"lineNo,omitempty"`
+	Commands   int64     `json:"commands,omitempty"`
+	Value      float64   `json:"value"`
+	Mean       float64   `json:"mean"`   // Of the baseline
+	StdDev     float64   `json:"stdDev"` // Ditto
+	Score      float64   `json:"score"`  // Standard deviations above the mean
+}
+
+// String returns the anomaly as JSON
+func (a Anomaly) String() string {
+	j, _ := json.Marshal(a)
+	return string(j)
+}
+
+// Summary returns a one line description of the anomaly
+func (a Anomaly) Summary() string {
+	what := a.Type
+	if a.Cmd != "" {
+		what = fmt.Sprintf("%s %s (%s line %d)", a.Type, a.Cmd, a.User, a.LineNo)
+	}
+	return fmt.Sprintf("%s %s: %.2f (mean %.2f, stddev %.2f, score %.1f)", a.Time.Format("2006/01/02 15:04:05"),
+		what, a.Value, a.Mean, a.StdDev, a.Score)
+}
+
+// stats - running mean and variance (Welford's algorithm)
+type stats struct {
+	n    int64
+	mean float64
+	m2   float64
+}
+
+func (s *stats) add(x float64) {
+	s.n++
+	d := x - s.mean
+	s.mean += d / float64(s.n)
+	s.m2 += d * (x - s.mean)
+}
+
+func (s *stats) stdDev() float64 {
+	if s.n < 2 {
+		return 0
+	}
+	return math.Sqrt(s.m2 / float64(s.n-1))
+}
+
+// score returns the z-score of x, and the standard deviation used (at least minStdDev)
+func (s *stats) score(x, minStdDev float64) (float64, float64) {
+	sd := math.Max(s.stdDev(), minStdDev)
+	return (x - s.mean) / sd, sd
+}
+
+// serverState - statistics of the commands of one server
+type serverState struct {
+	lapses      map[string]*stats // By cmd
+	errorRates  stats
+	running     stats
+	windowStart time.Time
+	cmds        int64
+	errors      int64
+	maxRunning  int64
+}
+
+// Detector flags anomalies in commands passed to Observe. It is not safe for concurrent use.
+type Detector struct {
+	cfg     Config
+	servers map[string]*serverState
+}
+
+// NewDetector returns a detector with thresholds cfg
+func NewDetector(cfg Config) *Detector {
+	def := DefaultConfig()
+	if cfg.ZScore <= 0 {
+		cfg.ZScore = def.ZScore
+	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = def.MinSamples
+	}
+	if cfg.MinLapse <= 0 {
+		cfg.MinLapse = def.MinLapse
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.MinWindows <= 0 {
+		cfg.MinWindows = def.MinWindows
+	}
+	if cfg.MinWindowCmds <= 0 {
+		cfg.MinWindowCmds = def.MinWindowCmds
+	}
+	return &Detector{cfg: cfg, servers: make(map[string]*serverState)}
+}
+
+// Observe adds a command to the statistics, returning any anomalies - of the command itself, or of windows which
+// ended before it
+func (d *Detector) Observe(cmd *p4dlog.Command) []Anomaly {
+	s, ok := d.servers[cmd.ServerID]
+	if !ok {
+		s = &serverState{lapses: make(map[string]*stats)}
+		d.servers[cmd.ServerID] = s
+	}
+	t := cmd.EndTime
+	if t.IsZero() {
+		t = cmd.StartTime
+	}
+	var result []Anomaly
+	if !t.IsZero() {
+		start := t.Truncate(d.cfg.Window)
+		if s.windowStart.IsZero() {
+			s.windowStart = start
+		} else if start.After(s.windowStart) {
+			result = d.closeWindow(cmd.ServerID, s)
+			s.windowStart = start
+		}
+	}
+	s.cmds++
+	if cmd.CmdError {
+		s.errors++
+	}
+	if cmd.Running > s.maxRunning {
+		s.maxRunning = cmd.Running
+	}
+	if cmd.EndTime.IsZero() { // Not completed, so no lapse
+		return result
+	}
+	ls, ok := s.lapses[cmd.Cmd]
+	if !ok {
+		ls = &stats{}
+		s.lapses[cmd.Cmd] = ls
+	}
+	lapse := float64(cmd.CompletedLapse)
+	if ls.n >= d.cfg.MinSamples && lapse >= d.cfg.MinLapse {
+		if z, sd := ls.score(lapse, minLapseStdDev); z >= d.cfg.ZScore {
+			result = append(result, Anomaly{Type: TypeLapse, Time: cmd.StartTime, ServerID: cmd.ServerID,
+				Cmd: cmd.Cmd, User: cmd.User, ProcessKey: cmd.ProcessKey, LineNo: cmd.LineNo,
+				Value: lapse, Mean: ls.mean, StdDev: sd, Score: z})
+		}
+	}
+	ls.add(lapse)
+	return result
+}
+
+// closeWindow scores the error rate and running count of the current window of s, and adds them to the baselines
+func (d *Detector) closeWindow(serverID string, s *serverState) []Anomaly {
+	var result []Anomaly
+	if s.cmds == 0 {
+		return nil
+	}
+	anomaly := func(typ string, value float64, st *stats, minStdDev float64) {
+		if st.n >= d.cfg.MinWindows {
+			if z, sd := st.score(value, minStdDev); z >= d.cfg.ZScore {
+				result = append(result, Anomaly{Type: typ, Time: s.windowStart, ServerID: serverID,
+					Commands: s.cmds, Value: value, Mean: st.mean, StdDev: sd, Score: z})
+			}
+		}
+		st.add(value)
+	}
+	if s.cmds >= d.cfg.MinWindowCmds {
+		anomaly(TypeErrorRate, float64(s.errors)/float64(s.cmds), &s.errorRates, minErrorRateStdDev)
+	}
+	anomaly(TypeRunning, float64(s.maxRunning), &s.running, minRunningStdDev)
+	s.cmds, s.errors, s.maxRunning = 0, 0, 0
+	return result
+}
+
+// Flush scores the current windows (e.g. at the end of a log), returning any anomalies ordered by server
+func (d *Detector) Flush() []Anomaly {
+	ids := make([]string, 0, len(d.servers))
+	for id := range d.servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var result []Anomaly
+	for _, id := range ids {
+		result = append(result, d.closeWindow(id, d.servers[id])...)
+	}
+	return result
+}
+
+// Detect consumes records from cmds (as output by the parser - records other than commands are ignored), and returns
+// a channel of the anomalies found, closed once cmds is closed
+func Detect(cfg Config, cmds <-chan interface{}) <-chan Anomaly {
+	out := make(chan Anomaly, 100)
+	go func() {
+		defer close(out)
+		d := NewDetector(cfg)
+		for rec := range cmds {
+			var anomalies []Anomaly
+			switch cmd := rec.(type) {
+			case p4dlog.Command:
+				anomalies = d.Observe(&cmd)
+			case *p4dlog.Command:
+				anomalies = d.Observe(cmd)
+			}
+			for _, a := range anomalies {
+				out <- a
+			}
+		}
+		for _, a := range d.Flush() {
+			out <- a
+		}
+	}()
+	return out
+}
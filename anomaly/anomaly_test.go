@@ -0,0 +1,149 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+var baseTime = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// testCmd returns a command ending at secs after baseTime
+func testCmd(lineNo int64, cmd string, secs int, lapse float32, running int64, cmdError bool) *p4dlog.Command {
+	end := baseTime.Add(time.Duration(secs) * time.Second)
+	return &p4dlog.Command{ProcessKey: fmt.Sprintf("key%d", lineNo), LineNo: lineNo, Cmd: cmd, User: "fred",
+		StartTime: end.Add(-time.Duration(float64(lapse) * float64(time.Second))), EndTime: end, CompletedLapse: lapse,
+		Running: running, CmdError: cmdError}
+}
+
+func TestLapse(t *testing.T) {
+	d := NewDetector(DefaultConfig())
+	var found []Anomaly
+	// Lapses alternating 1s and 2s, all within a window
+	for i := int64(1); i <= 40; i++ {
+		found = append(found, d.Observe(testCmd(i, "user-sync", 1, float32(1+i%2), 1, false))...)
+	}
+	assert.Equal(t, 0, len(found))
+	found = d.Observe(testCmd(41, "user-sync", 2, 30, 1, false))
+	assert.Equal(t, 1, len(found))
+	a := found[0]
+	assert.Equal(t, TypeLapse, a.Type)
+	assert.Equal(t, "user-sync", a.Cmd)
+	assert.Equal(t, "fred", a.User)
+	assert.Equal(t, int64(41), a.LineNo)
+	assert.Equal(t, "key41", a.ProcessKey)
+	assert.Equal(t, 30.0, a.Value)
+	assert.InDelta(t, 1.5, a.Mean, 0.01)
+	assert.InDelta(t, 0.506, a.StdDev, 0.01)
+	assert.Greater(t, a.Score, 50.0)
+	assert.Equal(t, baseTime.Add(-28*time.Second), a.Time)
+
+	// Other command types have their own baselines, too few samples so far
+	assert.Equal(t, 0, len(d.Observe(testCmd(42, "user-submit", 3, 60, 1, false))))
+	// Short commands are never anomalies
+	for i := int64(43); i < 80; i++ {
+		d.Observe(testCmd(i, "user-info", 4, 0.01, 1, false))
+	}
+	assert.Equal(t, 0, len(d.Observe(testCmd(80, "user-info", 4, 0.9, 1, false))))
+	assert.Equal(t, 0, len(d.Flush()))
+}
+
+func TestErrorRate(t *testing.T) {
+	d := NewDetector(DefaultConfig())
+	var found []Anomaly
+	lineNo := int64(0)
+	// 20 commands per minute, 1 in error
+	for min := 0; min < 15; min++ {
+		for i := 0; i < 20; i++ {
+			lineNo++
+			found = append(found, d.Observe(testCmd(lineNo, "user-fstat", min*60+i, 0.1, 1, i == 0))...)
+		}
+	}
+	// Then half of them
+	for i := 0; i < 20; i++ {
+		lineNo++
+		found = append(found, d.Observe(testCmd(lineNo, "user-fstat", 15*60+i, 0.1, 1, i%2 == 0))...)
+	}
+	assert.Equal(t, 0, len(found))
+	found = d.Flush()
+	assert.Equal(t, 1, len(found))
+	a := found[0]
+	assert.Equal(t, TypeErrorRate, a.Type)
+	assert.Equal(t, baseTime.Add(15*time.Minute), a.Time)
+	assert.Equal(t, int64(20), a.Commands)
+	assert.Equal(t, 0.5, a.Value)
+	assert.InDelta(t, 0.05, a.Mean, 0.001)
+	assert.Equal(t, minErrorRateStdDev, a.StdDev)
+	assert.InDelta(t, 22.5, a.Score, 0.01)
+}
+
+func TestRunning(t *testing.T) {
+	d := NewDetector(DefaultConfig())
+	var found []Anomaly
+	lineNo := int64(0)
+	for min := 0; min < 12; min++ {
+		for i := 0; i < 5; i++ {
+			lineNo++
+			found = append(found, d.Observe(testCmd(lineNo, "user-files", min*60+i, 0.1, int64(10+min%3), false))...)
+		}
+	}
+	assert.Equal(t, 0, len(found))
+	lineNo++
+	found = d.Observe(testCmd(lineNo, "user-files", 12*60, 0.1, 200, false))
+	assert.Equal(t, 0, len(found)) // Window not ended yet
+	lineNo++
+	found = d.Observe(testCmd(lineNo, "user-files", 13*60, 0.1, 10, false))
+	assert.Equal(t, 1, len(found))
+	a := found[0]
+	assert.Equal(t, TypeRunning, a.Type)
+	assert.Equal(t, baseTime.Add(12*time.Minute), a.Time)
+	assert.Equal(t, 200.0, a.Value)
+	assert.InDelta(t, 11.0, a.Mean, 0.01)
+	assert.Equal(t, minRunningStdDev, a.StdDev)
+	assert.Equal(t, int64(1), a.Commands)
+}
+
+func TestServers(t *testing.T) {
+	d := NewDetector(Config{MinSamples: 5})
+	for i := int64(1); i <= 10; i++ {
+		cmd := testCmd(i, "user-sync", 1, 2, 1, false)
+		cmd.ServerID = "edge1"
+		d.Observe(cmd)
+	}
+	cmd := testCmd(11, "user-sync", 2, 20, 1, false)
+	cmd.ServerID = "edge2" // No baseline
+	assert.Equal(t, 0, len(d.Observe(cmd)))
+	cmd = testCmd(12, "user-sync", 2, 20, 1, false)
+	cmd.ServerID = "edge1"
+	found := d.Observe(cmd)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, "edge1", found[0].ServerID)
+}
+
+func TestDetect(t *testing.T) {
+	cmds := make(chan interface{}, 100)
+	for i := int64(1); i <= 10; i++ {
+		cmds <- *testCmd(i, "user-sync", 1, 2, 1, false)
+	}
+	cmds <- p4dlog.ServerEvent{LineNo: 11}
+	cmds <- testCmd(12, "user-sync", 2, 20, 1, false)
+	close(cmds)
+	var found []Anomaly
+	for a := range Detect(Config{MinSamples: 10}, cmds) {
+		found = append(found, a)
+	}
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, int64(12), found[0].LineNo)
+
+	var j map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(found[0].String()), &j))
+	assert.Equal(t, "lapse", j["type"])
+	assert.Equal(t, 20.0, j["value"])
+	assert.Equal(t, "2024/03/01 09:59:42 lapse user-sync (fred line 12): 20.00 (mean 2.00, stddev 0.50, score 36.0)",
+		found[0].Summary())
+}
@@ -0,0 +1,95 @@
+package p4dlog
+
+// Compact binary output of parsed records, for downstream Go tools which would otherwise spend most of their time
+// re-parsing JSON (e.g. log2sql --binary.output). Records are written as a gob stream of binaryRecord values, so
+// zero fields (the majority for most commands) take no space. Only exported fields are preserved, plus whether a
+// command has a duplicate key (so that GetKey is unchanged). Streams written
+// by separate writers can't be concatenated - each starts with the type definitions.
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// binaryRecord - exactly one of Cmd, Event, Proxy and Broker is set
+type binaryRecord struct {
+	Cmd             *Command
+	Event           *ServerEvent
+	Proxy           *ProxyEvent
+	Broker          *BrokerEvent
+	CmdDuplicateKey bool // Command.duplicateKey, which as unexported isn't encoded with Cmd
+}
+
+// BinaryRecordWriter writes records in binary (gob) format
+type BinaryRecordWriter struct {
+	enc *gob.Encoder
+}
+
+// NewBinaryRecordWriter - writes to w, which should be buffered
+func NewBinaryRecordWriter(w io.Writer) *BinaryRecordWriter {
+	return &BinaryRecordWriter{enc: gob.NewEncoder(w)}
+}
+
+// Write writes a Command, ServerEvent, ProxyEvent or BrokerEvent (or a pointer to one) - other records are ignored
+func (bw *BinaryRecordWriter) Write(rec interface{}) error {
+	var r binaryRecord
+	switch v := rec.(type) {
+	case Command:
+		r.Cmd = &v
+	case *Command:
+		r.Cmd = v
+	case ServerEvent:
+		r.Event = &v
+	case *ServerEvent:
+		r.Event = v
+	case ProxyEvent:
+		r.Proxy = &v
+	case *ProxyEvent:
+		r.Proxy = v
+	case BrokerEvent:
+		r.Broker = &v
+	case *BrokerEvent:
+		r.Broker = v
+	default:
+		return nil
+	}
+	if r.Cmd != nil {
+		r.CmdDuplicateKey = r.Cmd.duplicateKey
+	}
+	return bw.enc.Encode(&r)
+}
+
+// BinaryRecordReader reads records written by BinaryRecordWriter
+type BinaryRecordReader struct {
+	dec *gob.Decoder
+}
+
+// NewBinaryRecordReader - reads from r
+func NewBinaryRecordReader(r io.Reader) *BinaryRecordReader {
+	return &BinaryRecordReader{dec: gob.NewDecoder(r)}
+}
+
+// Read returns the next Command, ServerEvent, ProxyEvent or BrokerEvent (as output on the channel returned by
+// LogParser), or io.EOF at the end of the stream
+func (br *BinaryRecordReader) Read() (interface{}, error) {
+	var r binaryRecord
+	if err := br.dec.Decode(&r); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated binary record: %v", err)
+		}
+		return nil, err
+	}
+	switch {
+	case r.Cmd != nil:
+		r.Cmd.duplicateKey = r.CmdDuplicateKey
+		return *r.Cmd, nil
+	case r.Event != nil:
+		return *r.Event, nil
+	case r.Proxy != nil:
+		return *r.Proxy, nil
+	case r.Broker != nil:
+		return *r.Broker, nil
+	}
+	return nil, fmt.Errorf("empty binary record")
+}
@@ -0,0 +1,128 @@
+package p4dlog
+
+// Checkpointing of parser state for incremental parsing of logs which are appended to or rotated.
+// With SetKeepPending the commands still pending when input ends are retained rather than output (as
+// their completion/track records may be in the part of the log not yet written). Checkpoint returns
+// them together with the line number reached, and RestoreCheckpoint loads them into a new parser before
+// it is started on the remainder of the log, so that commands are output exactly once across runs.
+//
+// Commands which never complete (e.g. their completion records were lost) would otherwise be retained by every run,
+// so uncompleted commands not active within KeepPendingTTL of the end of input, and the least recently active beyond
+// KeepPendingMax, are evicted (see pending.go) at the end of input rather than retained.
+
+import (
+	"sort"
+	"time"
+)
+
+// Defaults for Options.KeepPendingMax/KeepPendingTTL
+const (
+	DefaultKeepPendingMax = 100000
+	DefaultKeepPendingTTL = 24 * time.Hour
+)
+
+// PendingCommand - a command not yet output, with the parser state required to resume processing it
+type PendingCommand struct {
+	Cmd              Command
+	Completed        bool
+	HasTrackInfo     bool
+	DuplicateKey     bool
+	CountedInRunning bool
+}
+
+// ParserCheckpoint - parser state at the end of input when SetKeepPending is set
+type ParserCheckpoint struct {
+	LineNo  int64 // Next line number to be read
+	Pending []PendingCommand
+}
+
+// SetKeepPending - retain commands still pending at end of input rather than outputting them, see Checkpoint()
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithKeepPending.
+func (fp *P4dFileParser) SetKeepPending() {
+	fp.keepPending = true
+}
+
+// evictKeptPending evicts uncompleted commands beyond the bounds on those retained, see above
+func (fp *P4dFileParser) evictKeptPending() {
+	candidates := fp.evictionCandidates()
+	evict := 0
+	if fp.keepPendingTTL > 0 {
+		for evict < len(candidates) && fp.lastSeenTime.Sub(candidates[evict].lastActive) >= fp.keepPendingTTL {
+			evict++
+		}
+	}
+	if fp.keepPendingMax > 0 && len(candidates)-evict > fp.keepPendingMax {
+		evict = len(candidates) - fp.keepPendingMax
+	}
+	for _, cmd := range candidates[:evict] {
+		delete(fp.cmds, fp.cmdKey(cmd))
+		fp.evictCmd(cmd)
+	}
+}
+
+// outputFinishedCommands outputs (in order) those commands which have completed and had track output so can't be
+// updated by records in the remainder of the log
+func (fp *P4dFileParser) outputFinishedCommands() {
+	cmds := make([]*Command, 0)
+	for pid, cmd := range fp.cmds {
+		if cmd.completed && cmd.hasTrackInfo {
+			cmds = append(cmds, cmd)
+			delete(fp.cmds, pid)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].LineNo < cmds[j].LineNo })
+	for _, cmd := range cmds {
+		fp.outputCmd(cmd)
+	}
+}
+
+// Checkpoint - returns parser state, to be called after the channel returned by LogParser has been closed
+func (fp *P4dFileParser) Checkpoint() ParserCheckpoint {
+	cp := ParserCheckpoint{LineNo: fp.lineNo, Pending: make([]PendingCommand, 0, len(fp.cmds))}
+	for _, cmd := range fp.cmds {
+		c := *cmd
+		if cmd.countedInRunning {
+			c.RunningPeak = fp.runningPeak(cmd) // So far
+		}
+		cp.Pending = append(cp.Pending, PendingCommand{
+			Cmd:              c,
+			Completed:        cmd.completed,
+			HasTrackInfo:     cmd.hasTrackInfo,
+			DuplicateKey:     cmd.duplicateKey,
+			CountedInRunning: cmd.countedInRunning,
+		})
+	}
+	return cp
+}
+
+// RestoreCheckpoint - restores state saved by Checkpoint, to be called before LogParser
+func (fp *P4dFileParser) RestoreCheckpoint(cp ParserCheckpoint) {
+	fp.resumeLineNo = cp.LineNo
+	running := make([]*Command, 0)
+	for i := range cp.Pending {
+		p := cp.Pending[i]
+		cmd := p.Cmd
+		cmd.completed = p.Completed
+		cmd.hasTrackInfo = p.HasTrackInfo
+		cmd.duplicateKey = p.DuplicateKey
+		cmd.countedInRunning = p.CountedInRunning
+		if cmd.Tables == nil {
+			cmd.Tables = make(map[string]*Table)
+		}
+		if cmd.SerializedLocks == nil {
+			cmd.SerializedLocks = make(map[string]*SerializedLock)
+		}
+		if cmd.countedInRunning {
+			fp.cmdsRunning++
+			running = append(running, &cmd)
+		}
+		fp.cmds[fp.cmdKey(&cmd)] = &cmd
+	}
+	if len(running) > 0 {
+		seq := fp.noteRunning()
+		for _, cmd := range running {
+			cmd.runningSeq = seq
+		}
+	}
+}
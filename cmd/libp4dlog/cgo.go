@@ -0,0 +1,44 @@
+//go:build cgo && !js
+
+package main
+
+// Stable C ABI - all strings returned must be released with P4dlogFree.
+//
+//	char *P4dlogParse(char *input, int options);
+//	void P4dlogFree(char *s);
+//	char *P4dlogVersion();
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/perforce/p4prometheus/version"
+)
+
+// P4dlogParse parses log text and returns newline separated JSON for commands and server events
+//
+//export P4dlogParse
+func P4dlogParse(input *C.char, options C.int) *C.char {
+	return C.CString(parseToJSON(C.GoString(input), int(options)))
+}
+
+// P4dlogFree releases a string returned by this library
+//
+//export P4dlogFree
+func P4dlogFree(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// P4dlogVersion returns version information
+//
+//export P4dlogVersion
+func P4dlogVersion() *C.char {
+	return C.CString(version.Print("libp4dlog"))
+}
+
+// Required for -buildmode=c-shared
+func main() {}
@@ -0,0 +1,13 @@
+//go:build !cgo && !js
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, "libp4dlog must be built with cgo enabled (as a shared library) or for js/wasm - see Makefile")
+	os.Exit(1)
+}
@@ -0,0 +1,62 @@
+/*
+libp4dlog - wraps the parser so it can be used from non-Go tooling (e.g. Python analysis notebooks)
+rather than maintaining parallel regex implementations.
+
+Built either as a C shared library (see cgo.go) or as WASM (see wasm.go) - see Makefile.
+Output is the same JSON as log2sql --json: one line per command or server event.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Options which may be passed by callers as a bitmask
+const (
+	optNoCompletionRecords = 1 << iota // Log was generated with server=1 and thus no completion records expected
+)
+
+// parseToJSON parses the contents of a p4d text log and returns JSON lines for all commands and server events
+func parseToJSON(input string, options int) string {
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	opts := []p4dlog.Option{p4dlog.WithLogger(logger)}
+	if options&optNoCompletionRecords != 0 {
+		opts = append(opts, p4dlog.WithNoCompletionRecords())
+	}
+	fp, _ := p4dlog.NewParser(opts...) // No features set, so can't fail
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	linesChan := make(chan string, 10000)
+	cmdChan := fp.LogParser(ctx, linesChan, nil)
+	go func() {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		scanner.Buffer(make([]byte, 0, 64*1024), 5*1024*1024)
+		for scanner.Scan() {
+			linesChan <- scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Errorf("Failed to read input: %v", err)
+		}
+		close(linesChan)
+	}()
+
+	var b strings.Builder
+	for cmd := range cmdChan {
+		switch cmd := cmd.(type) {
+		case p4dlog.Command:
+			fmt.Fprintf(&b, "%s\n", cmd.String())
+		case p4dlog.ServerEvent:
+			fmt.Fprintf(&b, "%s\n", cmd.String())
+		}
+	}
+	return b.String()
+}
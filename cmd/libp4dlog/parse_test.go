@@ -0,0 +1,43 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseToJSON(t *testing.T) {
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	output := strings.Split(strings.TrimSpace(parseToJSON(input, 0)), "\n")
+	assert.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"cmd":"user-sync","pid":1616`)
+	assert.Contains(t, output[0], `"completedLapse":0.031`)
+
+	assert.Equal(t, "", parseToJSON("", optNoCompletionRecords))
+}
+
+func TestParseToJSONGoroutines(t *testing.T) {
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+`
+	parseToJSON(input, 0)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		parseToJSON(input, 0)
+	}
+	// The parser's goroutines finish once it has output everything
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
@@ -0,0 +1,23 @@
+//go:build js && wasm
+
+package main
+
+// Registers a global JavaScript function: p4dlogParse(input, options) returning JSON lines
+
+import (
+	"syscall/js"
+)
+
+func main() {
+	js.Global().Set("p4dlogParse", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 {
+			return ""
+		}
+		options := 0
+		if len(args) > 1 {
+			options = args[1].Int()
+		}
+		return parseToJSON(args[0].String(), options)
+	}))
+	select {} // Keep running so function remains available
+}
@@ -0,0 +1,141 @@
+package main
+
+// Threshold alerts from historical metrics - see --alert.rule. Alerts from the metrics package (a rule starting to
+// fire, or resolving, in log time) are written as lines of text to --alert.output, and/or posted as JSON to
+// --alert.webhook, so that incident windows can be flagged when analysing logs in batch.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/rcowham/go-libp4dlog/metrics"
+)
+
+// parseAlertRule parses a rule of the form [name:]metric>threshold, e.g. busy:cmds_running>200
+func parseAlertRule(s string) (metrics.AlertRule, error) {
+	var rule metrics.AlertRule
+	expr := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		rule.Name, expr = strings.TrimSpace(s[:i]), s[i+1:]
+	}
+	parts := strings.Split(expr, ">")
+	if len(parts) != 2 {
+		return rule, fmt.Errorf("invalid alert rule '%s': expected [name:]metric>threshold", s)
+	}
+	rule.Metric = strings.TrimSpace(parts[0])
+	v, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return rule, fmt.Errorf("invalid alert rule '%s': threshold: %v", s, err)
+	}
+	rule.Above = v
+	return rule, nil
+}
+
+func parseAlertRules(rules []string) ([]metrics.AlertRule, error) {
+	var result []metrics.AlertRule
+	for _, s := range rules {
+		r, err := parseAlertRule(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// alertWriter writes alerts from one or more metrics parsers (one per file in parallel mode)
+type alertWriter struct {
+	logger  *logrus.Logger
+	mu      sync.Mutex
+	fd      *os.File
+	w       *bufio.Writer // Nil if no --alert.output
+	webhook string
+	client  *http.Client
+	count   int64
+}
+
+// newAlertWriter writes alerts to output ("-" for stdout) and/or posts them to webhook - if neither they are logged
+func newAlertWriter(logger *logrus.Logger, output, webhook string) (*alertWriter, error) {
+	aw := &alertWriter{logger: logger, webhook: webhook, client: &http.Client{Timeout: 30 * time.Second}}
+	if output == "-" {
+		aw.w = bufio.NewWriter(os.Stdout)
+	} else if output != "" {
+		var err error
+		if aw.fd, err = os.Create(output); err != nil {
+			return nil, err
+		}
+		aw.w = bufio.NewWriter(aw.fd)
+	}
+	return aw, nil
+}
+
+// post sends the alert as JSON to the webhook
+func (aw *alertWriter) post(a metrics.Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := aw.client.Post(aw.webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (aw *alertWriter) write(a metrics.Alert) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	aw.count++
+	if aw.w == nil && aw.webhook == "" {
+		aw.logger.Warnf("Alert: %s", a)
+		return
+	}
+	if aw.w != nil {
+		if _, err := fmt.Fprintln(aw.w, a); err != nil {
+			aw.logger.Errorf("Failed to write alert: %v", err)
+		}
+	}
+	if aw.webhook != "" {
+		if err := aw.post(a); err != nil {
+			aw.logger.Errorf("Failed to post alert: %v", err)
+		}
+	}
+}
+
+// consume writes alerts until the channel is closed
+func (aw *alertWriter) consume(alerts <-chan metrics.Alert) {
+	for a := range alerts {
+		aw.write(a)
+	}
+}
+
+func (aw *alertWriter) Close() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if aw.w == nil {
+		return nil
+	}
+	err := aw.w.Flush()
+	if aw.fd != nil {
+		if cerr := aw.fd.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
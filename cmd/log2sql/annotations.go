@@ -0,0 +1,144 @@
+package main
+
+// Grafana annotations of notable events - see --annotations.output. Written as a JSON array of annotations in the
+// format of the Grafana HTTP API (POST /api/annotations), so that incidents can be shown on the dashboards of the
+// historical metrics:
+//
+//   - typed server events, e.g. server restarts/shutdowns (tags "p4d", "event", <eventType>)
+//   - threads removed from the monitor table, e.g. Init() exited unexpectedly (tags "p4d", "thread-removed")
+//   - periods with commands paused due to resource pressure, as regions (tags "p4d", "paused")
+//   - commands taking longer than --annotations.lapse, as regions (tags "p4d", "long-command", <cmd>)
+//   - commands failing with errors of severity error or fatal (tags "p4d", "error", <cmd>)
+//
+// Times are as for the metrics, i.e. log times treated as UTC. With --server.id the tag "server:<id>" is added.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// annotation - as posted to the Grafana HTTP API
+type annotation struct {
+	Time    int64    `json:"time"`              // Epoch ms
+	TimeEnd int64    `json:"timeEnd,omitempty"` // Epoch ms - for regions
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// annotationsWriter writes annotations as a JSON array
+type annotationsWriter struct {
+	w          *bufio.Writer
+	lapse      time.Duration // Commands taking at least this long are annotated
+	serverTag  string
+	count      int
+	pauseStart time.Time // Set while commands are paused
+	pauseEnd   time.Time // Latest event time while paused
+	pausedMax  int64
+	err        error // First write error
+}
+
+func newAnnotationsWriter(w io.Writer, lapse time.Duration, serverID string) *annotationsWriter {
+	aw := &annotationsWriter{w: bufio.NewWriter(w), lapse: lapse}
+	if serverID != "" {
+		aw.serverTag = "server:" + serverID
+	}
+	aw.printf("[")
+	return aw
+}
+
+func (aw *annotationsWriter) printf(format string, args ...interface{}) {
+	if aw.err == nil {
+		_, aw.err = fmt.Fprintf(aw.w, format, args...)
+	}
+}
+
+func epochMS(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (aw *annotationsWriter) write(start, end time.Time, text string, tags ...string) {
+	a := annotation{Time: epochMS(start), Text: text, Tags: append([]string{"p4d"}, tags...)}
+	if end.After(start) {
+		a.TimeEnd = epochMS(end)
+	}
+	if aw.serverTag != "" {
+		a.Tags = append(a.Tags, aw.serverTag)
+	}
+	j, err := json.Marshal(a)
+	if err != nil {
+		aw.err = err
+		return
+	}
+	if aw.count > 0 {
+		aw.printf(",")
+	}
+	aw.printf("\n%s", j)
+	aw.count++
+}
+
+// writeCmd annotates cmd if it took longer than the lapse threshold or failed with an error
+func (aw *annotationsWriter) writeCmd(cmd *p4dlog.Command) {
+	desc := fmt.Sprintf("%s %s (pid %d, user %s, workspace %s)", cmd.Cmd, cmd.Args, cmd.Pid, cmd.User, cmd.Workspace)
+	if aw.lapse > 0 && !cmd.EndTime.IsZero() && cmd.EndTime.Sub(cmd.StartTime) >= aw.lapse {
+		aw.write(cmd.StartTime, cmd.EndTime, fmt.Sprintf("Long command: %s, lapse %.0fs", desc,
+			cmd.EndTime.Sub(cmd.StartTime).Seconds()), "long-command", cmd.Cmd)
+	}
+	if cmd.CmdError && (cmd.ErrorSeverity == p4dlog.ErrorSeverityError || cmd.ErrorSeverity == p4dlog.ErrorSeverityFatal) {
+		t := cmd.EndTime
+		if t.IsZero() {
+			t = cmd.StartTime
+		}
+		aw.write(t, time.Time{}, fmt.Sprintf("Command %s: %s: %s", cmd.ErrorSeverity, desc, cmd.ErrorText), "error", cmd.Cmd)
+	}
+}
+
+// writeEvent annotates typed events and removed threads, and tracks periods with paused commands
+func (aw *annotationsWriter) writeEvent(evt *p4dlog.ServerEvent) {
+	if evt.EventType != "" {
+		aw.write(evt.EventTime, time.Time{}, fmt.Sprintf("Server %s: %s", evt.EventType, evt.Message), "event", evt.EventType)
+		return
+	}
+	if evt.RemovedPid != 0 {
+		aw.write(evt.EventTime, time.Time{}, fmt.Sprintf("Thread removed from monitor table: pid %d, user %s, cmd %s",
+			evt.RemovedPid, evt.RemovedUser, evt.RemovedCmd), "thread-removed")
+		return
+	}
+	if evt.PausedThreads > 0 {
+		if aw.pauseStart.IsZero() {
+			aw.pauseStart = evt.EventTime
+			aw.pausedMax = 0
+		}
+		aw.pauseEnd = evt.EventTime
+		if evt.PausedThreads > aw.pausedMax {
+			aw.pausedMax = evt.PausedThreads
+		}
+		return
+	}
+	if !aw.pauseStart.IsZero() {
+		aw.pauseEnd = evt.EventTime
+		aw.writePause()
+	}
+}
+
+func (aw *annotationsWriter) writePause() {
+	aw.write(aw.pauseStart, aw.pauseEnd, fmt.Sprintf("Commands paused due to resource pressure, max %d", aw.pausedMax),
+		"paused")
+	aw.pauseStart = time.Time{}
+}
+
+// close writes any current pause period and the end of the array
+func (aw *annotationsWriter) close() error {
+	if !aw.pauseStart.IsZero() {
+		aw.writePause()
+	}
+	aw.printf("\n]\n")
+	if aw.err == nil {
+		aw.err = aw.w.Flush()
+	}
+	return aw.err
+}
@@ -0,0 +1,45 @@
+package main
+
+// Anomaly detection - see --anomalies. Commands written are passed to an anomaly.Detector, and the anomalies found
+// (commands taking much longer than usual for their type, spikes in error rates or running commands) are written to
+// the anomalies table (SQLite, SQL and PostgreSQL output - Go schema only) and/or as JSON lines to --anomalies.output,
+// as candidates for incidents from a nightly run.
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rcowham/go-libp4dlog/anomaly"
+)
+
+func getAnomaliesStatement() string {
+	return `INSERT INTO anomalies
+		(anomalyType, anomalyTime, serverID, lineNumber, processkey, cmd, user,
+		commands, value, mean, stdDev, score)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`
+}
+
+// anomalyValues returns values for getAnomaliesStatement()
+func anomalyValues(a *anomaly.Anomaly, dateValue func(time.Time) interface{}) []interface{} {
+	return []interface{}{
+		a.Type, dateValue(a.Time), a.ServerID, a.LineNo, a.ProcessKey, a.Cmd, a.User,
+		a.Commands, a.Value, a.Mean, a.StdDev, a.Score}
+}
+
+func preparedInsertAnomaly(logger *logrus.Logger, stmtAnomalies *sqlite3.Stmt, a *anomaly.Anomaly) int64 {
+	if err := stmtAnomalies.Exec(anomalyValues(a, sqliteDate)...); err != nil {
+		logger.Errorf("Anomalies insert: %v %s %s lineNo %d", err, a.Type, dateStr(a.Time), a.LineNo)
+	}
+	return 1
+}
+
+func writeSQLAnomaly(f io.Writer, a *anomaly.Anomaly) int64 {
+	fmt.Fprintf(f, `INSERT INTO anomalies VALUES ("%s","%s","%s",%d,"%s","%s","%s",%d,%g,%g,%g,%g);`+"\n",
+		a.Type, dateStr(a.Time), a.ServerID, a.LineNo, a.ProcessKey, a.Cmd, a.User,
+		a.Commands, a.Value, a.Mean, a.StdDev, a.Score)
+	return 1
+}
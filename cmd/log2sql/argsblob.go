@@ -0,0 +1,63 @@
+package main
+
+// Storage of complete command args - see --args.full. Normally log lines longer than --max.line.len are truncated as
+// they are read, losing the tail of giant sync/reconcile command lines. With --args.full lines are read complete (up to
+// maxFullLineLen), the process table args are truncated to --max.line.len as before, and the complete args of commands
+// whose args were truncated are written zlib compressed to the argsBlob table. This is the format of SQLite archives,
+// so the sqlite3 shell can decompress them, e.g.
+//
+//	SELECT sqlar_uncompress(args, argsLength) FROM argsBlob WHERE processkey = '...';
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Lines are still truncated beyond this with --args.full, to bound memory
+const maxFullLineLen = 64 * 1024 * 1024
+
+// lineOptions - how log lines are read, see parseLog
+type lineOptions struct {
+	maxLen          int         // --max.line.len, or maxFullLineLen with --args.full
+	truncatedDigest bool        // See --key.mode
+	bench           *benchStats // --bench, else nil
+}
+
+func writeArgsBlobTable(f io.Writer) {
+	fmt.Fprintf(f, `CREATE TABLE IF NOT EXISTS argsBlob -- complete args of commands whose process.args are truncated
+	(processkey CHAR(50) NOT NULL, lineNumber INT NOT NULL, -- primary key - of the command
+	argsLength INT NOT NULL, -- length of the complete args
+	args BLOB NOT NULL, -- zlib compressed, see sqlar_uncompress()
+	PRIMARY KEY (processkey, lineNumber));
+`)
+}
+
+func getArgsBlobStatement() string {
+	return `INSERT INTO argsBlob
+		(processkey, lineNumber, argsLength, args)
+		VALUES (?,?,?,?)`
+}
+
+// truncateArgs returns cmd with args truncated to limit bytes (with "..." appended, and not split within a character)
+// and the values of its argsBlob row, or cmd itself and nil if the args are within limit
+func truncateArgs(cmd *p4dlog.Command, limit int) (*p4dlog.Command, []interface{}) {
+	if limit <= 0 || len(cmd.Args) <= limit {
+		return cmd, nil
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(cmd.Args)) // Writes to a bytes.Buffer don't fail
+	zw.Close()
+	c := *cmd
+	n := limit
+	for n > 0 && !utf8.RuneStart(cmd.Args[n]) {
+		n--
+	}
+	c.Args = cmd.Args[:n] + "..."
+	return &c, []interface{}{cmd.GetKey(), cmd.LineNo, len(cmd.Args), buf.Bytes()}
+}
@@ -0,0 +1,197 @@
+package main
+
+// Throughput measurement - see --bench. Logs are processed as normal, while measuring the rate at which lines are read
+// and the time each stage of the pipeline spends working or waiting on its neighbours:
+//
+//	read (decompress, split lines) -> linesChan -> parse -> cmdChan -> output (JSON/SQL etc) -> dbWriter -> SQLite
+//
+// A stage which is the bottleneck keeps its input channel full, and the stages before it wait to send to it, so the
+// report at the end shows which stage limits throughput at a site - e.g. SQLite inserts (try --schema=minimal or
+// --no.sql) rather than parsing. Waits are only timed when a channel is full (or empty), so the overhead is small.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Interval between samples of channel fill levels
+const benchSampleInterval = 10 * time.Millisecond
+
+// benchStats - counts and times (ns) updated atomically by the stages of the pipeline
+type benchStats struct {
+	started    time.Time
+	lines      int64
+	bytes      int64
+	records    int64
+	readTime   int64 // Reading lines, including readWait
+	readWait   int64 // Waiting to send lines to the parser
+	parseWait  int64 // Output waiting for records from the parser
+	outputWait int64 // Parser waiting for output to take records
+	dbTime     int64 // Inserting records and committing transactions
+	dbWait     int64 // Output waiting to queue records for the database writer
+
+	m       sync.Mutex
+	samples int64
+	fill    map[string]float64 // Sum of fill fractions of channels, by stage reading from them
+	chans   map[string]func() float64
+	done    chan struct{}
+}
+
+func newBenchStats() *benchStats {
+	return &benchStats{started: time.Now(), fill: make(map[string]float64), chans: make(map[string]func() float64),
+		done: make(chan struct{})}
+}
+
+// sendLine sends line to the parser, timing any wait
+func (b *benchStats) sendLine(linesChan chan string, line string) {
+	atomic.AddInt64(&b.lines, 1)
+	atomic.AddInt64(&b.bytes, int64(len(line)+1))
+	select {
+	case linesChan <- line:
+	default:
+		t := time.Now()
+		linesChan <- line
+		atomic.AddInt64(&b.readWait, int64(time.Since(t)))
+	}
+}
+
+// fileRead records the time taken to read a logfile started at start
+func (b *benchStats) fileRead(start time.Time) {
+	atomic.AddInt64(&b.readTime, int64(time.Since(start)))
+}
+
+// relay returns a channel of the records of in (from the parser), timing the waits for records and to pass them on
+func (b *benchStats) relay(in chan interface{}) chan interface{} {
+	out := make(chan interface{}, cap(in))
+	b.sample("output", func() float64 { return fraction(len(out), cap(out)) })
+	go func() {
+		defer close(out)
+		for {
+			var rec interface{}
+			var ok bool
+			select {
+			case rec, ok = <-in:
+			default:
+				t := time.Now()
+				rec, ok = <-in
+				atomic.AddInt64(&b.parseWait, int64(time.Since(t)))
+			}
+			if !ok {
+				return
+			}
+			atomic.AddInt64(&b.records, 1)
+			select {
+			case out <- rec:
+			default:
+				t := time.Now()
+				out <- rec
+				atomic.AddInt64(&b.outputWait, int64(time.Since(t)))
+			}
+		}
+	}()
+	return out
+}
+
+// queueRecord queues rec for the database writer, timing any wait
+func (b *benchStats) queueRecord(queue chan interface{}, rec interface{}) {
+	select {
+	case queue <- rec:
+	default:
+		t := time.Now()
+		queue <- rec
+		atomic.AddInt64(&b.dbWait, int64(time.Since(t)))
+	}
+}
+
+// dbWrite records the time taken to write a record to the database started at start
+func (b *benchStats) dbWrite(start time.Time) {
+	atomic.AddInt64(&b.dbTime, int64(time.Since(start)))
+}
+
+func fraction(n, c int) float64 {
+	if c == 0 {
+		return 0
+	}
+	return float64(n) / float64(c)
+}
+
+// sample adds a channel (read by stage) whose fill level is sampled by start
+func (b *benchStats) sample(stage string, fill func() float64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.chans[stage] = fill
+}
+
+// start samples channel fill levels until stop
+func (b *benchStats) start() {
+	go func() {
+		ticker := time.NewTicker(benchSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+				b.m.Lock()
+				for stage, fill := range b.chans {
+					b.fill[stage] += fill()
+				}
+				b.samples++
+				b.m.Unlock()
+			}
+		}
+	}()
+}
+
+func (b *benchStats) stop() {
+	close(b.done)
+}
+
+// avgFill returns the average fill level (0-1) of the input channel of stage
+func (b *benchStats) avgFill(stage string) float64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.samples == 0 {
+		return 0
+	}
+	return b.fill[stage] / float64(b.samples)
+}
+
+// bottleneck returns the stage limiting throughput - the last whose input channel is mostly full
+func (b *benchStats) bottleneck() string {
+	for _, s := range []struct{ stage, desc string }{
+		{"db", "database writes (SQLite) - try --schema=minimal, or --no.sql if the database is not needed"},
+		{"output", "output of records (JSON, SQL, metrics etc)"},
+		{"parse", "parsing"},
+	} {
+		if b.avgFill(s.stage) > 0.5 {
+			return s.desc
+		}
+	}
+	return "reading log files (disk I/O or decompression)"
+}
+
+func secs(ns int64) float64 {
+	return time.Duration(ns).Seconds()
+}
+
+// report logs the throughput and stage timings
+func (b *benchStats) report(logger *logrus.Logger) {
+	elapsed := time.Since(b.started).Seconds()
+	lines, bytes, records := atomic.LoadInt64(&b.lines), atomic.LoadInt64(&b.bytes), atomic.LoadInt64(&b.records)
+	readTime, readWait := atomic.LoadInt64(&b.readTime), atomic.LoadInt64(&b.readWait)
+	logger.Infof("Benchmark (elapsed %.1fs):", elapsed)
+	logger.Infof("  lines read       %12d %12.0f lines/sec", lines, float64(lines)/elapsed)
+	logger.Infof("  bytes read       %12.1f MB %9.1f MB/sec", float64(bytes)/1e6, float64(bytes)/1e6/elapsed)
+	logger.Infof("  records output   %12d %12.0f records/sec", records, float64(records)/elapsed)
+	logger.Infof("  read             %10.1fs busy, %.1fs waiting for parser (lines channel %.0f%% full)",
+		secs(readTime-readWait), secs(readWait), 100*b.avgFill("parse"))
+	logger.Infof("  parse            %10.1fs output waiting for records, %.1fs parser waiting for output (records channel %.0f%% full)",
+		secs(atomic.LoadInt64(&b.parseWait)), secs(atomic.LoadInt64(&b.outputWait)), 100*b.avgFill("output"))
+	logger.Infof("  db write         %10.1fs busy, %.1fs output waiting for writer (queue %.0f%% full)",
+		secs(atomic.LoadInt64(&b.dbTime)), secs(atomic.LoadInt64(&b.dbWait)), 100*b.avgFill("db"))
+	logger.Infof("  bottleneck: %s", b.bottleneck())
+}
@@ -0,0 +1,57 @@
+package main
+
+// Binary output - see --binary.output. Commands and server events are written with p4dlog.BinaryRecordWriter, which
+// downstream Go tools can read with p4dlog.NewBinaryRecordReader far faster than re-parsing JSON output. The file is
+// truncated rather than appended to, as binary streams can't be concatenated.
+
+import (
+	"bufio"
+	"os"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// binaryWriter writes records to a file or stdout
+type binaryWriter struct {
+	fd  *os.File // Nil for stdout
+	w   *bufio.Writer
+	bw  *p4dlog.BinaryRecordWriter
+	err error // First write error
+}
+
+// newBinaryWriter - output "-" is stdout
+func newBinaryWriter(output string) (*binaryWriter, error) {
+	b := &binaryWriter{}
+	f := os.Stdout
+	if output != "-" {
+		var err error
+		if f, err = os.Create(output); err != nil {
+			return nil, err
+		}
+		b.fd = f
+	}
+	b.w = bufio.NewWriterSize(f, 1024*1024)
+	b.bw = p4dlog.NewBinaryRecordWriter(b.w)
+	return b, nil
+}
+
+// write writes the record - errors are reported by Close
+func (b *binaryWriter) write(rec interface{}) {
+	if b.err != nil {
+		return
+	}
+	b.err = b.bw.Write(rec)
+}
+
+func (b *binaryWriter) Close() error {
+	err := b.w.Flush()
+	if b.err != nil {
+		err = b.err
+	}
+	if b.fd != nil {
+		if cerr := b.fd.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+// Lower cased user/workspace/app names in the process table - see --case.insensitive. On case insensitive servers the
+// same user may be logged as Fred and fred, giving separate groups in queries. With --case.insensitive the process
+// table user, workspace and app (and appProduct/appVersion) columns are lower cased as they are written (by every
+// writer - database, SQL, PostgreSQL, ClickHouse and Parquet), with the values as logged kept in the userRaw,
+// workspaceRaw and appRaw columns (NULL without --case.insensitive), e.g.
+//
+//	SELECT user, count(*), group_concat(DISTINCT userRaw) FROM process GROUP BY user
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// foldCase returns a copy of cmd with user, workspace and app lower cased
+func foldCase(cmd *p4dlog.Command) *p4dlog.Command {
+	c := *cmd
+	c.User, c.Workspace, c.App = strings.ToLower(cmd.User), strings.ToLower(cmd.Workspace), strings.ToLower(cmd.App)
+	return &c
+}
+
+// caseFoldedValues returns processValues for cmd with user, workspace and app lower cased, and the original values in
+// the raw columns (the last of getProcessStatement)
+func caseFoldedValues(cmd *p4dlog.Command, dateValue func(time.Time) interface{}) []interface{} {
+	vals := processValues(foldCase(cmd), dateValue)
+	n := len(vals)
+	vals[n-3], vals[n-2], vals[n-1] = cmd.User, cmd.Workspace, cmd.App
+	return vals
+}
+
+// processValuesFunc returns caseFoldedValues if lowerCase is set, otherwise processValues
+func processValuesFunc(lowerCase bool) func(*p4dlog.Command, func(time.Time) interface{}) []interface{} {
+	if lowerCase {
+		return caseFoldedValues
+	}
+	return processValues
+}
+
+// writeSQLCaseFolded is writeSQL with user, workspace and app lower cased, and the original values in the raw columns
+func writeSQLCaseFolded(f io.Writer, cmd *p4dlog.Command) int64 {
+	raw := fmt.Sprintf(`"%s","%s","%s"`, cmd.User, cmd.Workspace, cmd.App)
+	return writeSQLCmd(f, foldCase(cmd), raw)
+}
@@ -0,0 +1,186 @@
+package main
+
+// Checkpoint (state) files for incremental parsing of logs which are continually appended to and rotated - see --state.file.
+// The state records, for each log file processed, its identity (device/inode), size, a checksum of its first bytes and
+// the offset of the end of the last complete line read, together with the parser state (commands not yet output and
+// the line number reached). On the next run, files already processed are skipped, and those which have since been
+// appended to (including a log which has been rotated/renamed, as it keeps its inode) are read from the saved offset.
+// A file which is smaller, or whose first bytes differ (e.g. a new log reusing the inode of one deleted), is read from
+// the start. Output is appended to the existing database. Compressed (e.g. gzipped) files can't be read from an
+// offset, so are either skipped (if unchanged) or read in full.
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Incremented if the format changes incompatibly
+const checkpointVersion = 2
+
+// Bytes at the start of a file whose checksum is saved. A log's first line alone (e.g. "Perforce server info:") is
+// not distinctive, whereas the following lines include the time.
+const headLen = 4096
+
+// logFileState - position reached in a single log file
+type logFileState struct {
+	Name        string
+	Dev         uint64
+	Inode       uint64
+	Size        int64
+	ModTime     time.Time
+	Offset      int64  // End of last complete line read (uncompressed)
+	Head        uint32 // CRC-32 of the bytes up to Offset (at most headLen) - uncompressed files only
+	Compressed  bool   // Any compressed format, e.g. gzip
+	Lines       int64  // Lines read up to Offset
+	FirstLineNo int64  // Parser line number of line 1 of the file
+}
+
+// checkpointState is saved (gob encoded, as commands have custom JSON marshalling) to the state file
+type checkpointState struct {
+	Version int
+	Files   []logFileState
+	Parser  p4dlog.ParserCheckpoint
+	// Latest completion time of commands in metrics - the default --metrics.since of the next run
+	MetricsSince time.Time
+	files        []logFileState // Files processed this run - replace Files when saved
+}
+
+// loadState reads the state file - a missing file gives an empty state, i.e. parse everything
+func loadState(name string) (*checkpointState, error) {
+	st := &checkpointState{Version: checkpointVersion}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = gob.NewDecoder(bufio.NewReader(f)).Decode(st); err != nil {
+		return nil, fmt.Errorf("reading state file %s: %v", name, err)
+	}
+	if st.Version != checkpointVersion {
+		return nil, fmt.Errorf("state file %s has version %d, expected %d - remove it to re-parse from the start",
+			name, st.Version, checkpointVersion)
+	}
+	return st, nil
+}
+
+// metricsSince returns the time given by --metrics.since (a log time), else that saved in the state (if any)
+func metricsSince(since string, st *checkpointState) (time.Time, error) {
+	if since != "" {
+		t, err := time.Parse(filterTimeFormat, since)
+		if err != nil {
+			return t, fmt.Errorf("invalid --metrics.since, expected format %s: %v", filterTimeFormat, err)
+		}
+		return t, nil
+	}
+	if st != nil {
+		return st.MetricsSince, nil
+	}
+	return time.Time{}, nil
+}
+
+// save writes the state to a temporary file which is then renamed, so that an interrupted save leaves the previous state
+func (st *checkpointState) save(name string) error {
+	st.Files = st.files
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = gob.NewEncoder(w).Encode(st)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// find returns the saved state of the file, matched by identity (so renamed files are found), or by name if
+// identity is not available on this platform
+func (st *checkpointState) find(fi os.FileInfo, name string) *logFileState {
+	dev, ino := fileID(fi)
+	for i := range st.Files {
+		f := &st.Files[i]
+		if ino != 0 && f.Dev == dev && f.Inode == ino {
+			return f
+		}
+		if ino == 0 && f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// headChecksum returns the CRC-32 of the first n bytes (at most headLen) of r
+func headChecksum(r io.ReaderAt, n int64) (uint32, error) {
+	if n > headLen {
+		n = headLen
+	}
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, n)); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// resumeOffset returns the offset from which to read the file (r) and the count of lines before it, or skip if it is
+// unchanged since fully processed. A file smaller than when last processed, or whose first bytes have changed, has
+// been truncated or replaced, so is read from the start.
+func (st *checkpointState) resumeOffset(r io.ReaderAt, fi os.FileInfo, name string) (offset, lines int64, skip bool, err error) {
+	f := st.find(fi, name)
+	if f == nil {
+		return 0, 0, false, nil
+	}
+	if f.Compressed {
+		return 0, 0, f.Size == fi.Size() && f.ModTime.Equal(fi.ModTime()), nil
+	}
+	if fi.Size() < f.Offset || fi.Size() < f.Size {
+		return 0, 0, false, nil
+	}
+	head, err := headChecksum(r, f.Offset)
+	if err != nil || head != f.Head {
+		return 0, 0, false, err
+	}
+	return f.Offset, f.Lines, fi.Size() == f.Offset, nil
+}
+
+// processed records the position reached in a file (r) this run
+func (st *checkpointState) processed(r io.ReaderAt, fi os.FileInfo, name string, offset, lines, firstLineNo int64,
+	compressed bool) error {
+	var head uint32
+	if !compressed {
+		var err error
+		if head, err = headChecksum(r, offset); err != nil {
+			return err
+		}
+	}
+	dev, ino := fileID(fi)
+	st.files = append(st.files, logFileState{Name: name, Dev: dev, Inode: ino, Size: fi.Size(),
+		ModTime: fi.ModTime(), Offset: offset, Head: head, Compressed: compressed, Lines: lines, FirstLineNo: firstLineNo})
+	return nil
+}
+
+// unchanged records the position in a file skipped this run, under its current name
+func (st *checkpointState) unchanged(fi os.FileInfo, name string) {
+	f := *st.find(fi, name)
+	f.Name = name
+	st.files = append(st.files, f)
+}
@@ -0,0 +1,235 @@
+package main
+
+// Asynchronous SQLite database writer. Records are queued (up to dbQueueSize) for a dedicated goroutine which inserts
+// them and commits transactions, so that on multi-core machines parsing continues while the database is written rather
+// than stalling on each commit. SQLite allows only one writer per database, so there is a single writer goroutine
+// (for all databases when split with --split.by).
+//
+// Commands are inserted into the process and tableUse tables with multi-row INSERTs (as many rows as fit within
+// SQLite's limit on bound parameters), which reduces per-statement overhead. If a multi-row insert fails (e.g. a
+// duplicate key with --on.conflict=error) its rows are inserted individually, so that the errors are reported for the
+// rows concerned and the other rows are still written.
+//
+// With a commit interval (see --follow) transactions are also committed at least that often, so that rows written
+// from a live log are visible to queries without waiting for a transaction to fill.
+
+import (
+	"strings"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/anomaly"
+)
+
+// Records queued for the writer before parsing blocks
+const dbQueueSize = 10 * 1000
+
+// Max bound parameters in a statement (SQLITE_MAX_VARIABLE_NUMBER of the bundled SQLite)
+const sqliteMaxVariables = 999
+
+// Rows per multi-row insert into tableUse
+var tableUseBatchRows = sqliteMaxVariables / strings.Count(getTableUseStatement(), "?")
+
+// processBatchRows returns the rows per multi-row insert into process
+func processBatchRows(process *processSchema) int {
+	return sqliteMaxVariables / strings.Count(process.statement(), "?")
+}
+
+// batchStatement returns a multi-row version of a single row insert statement
+func batchStatement(stmt string, rows int) string {
+	i := strings.LastIndex(stmt, "VALUES ")
+	values := stmt[i+len("VALUES "):]
+	return stmt[:i+len("VALUES ")] + strings.TrimSuffix(strings.Repeat(values+",", rows), ",")
+}
+
+// insertBatch - rows waiting to be inserted into a table with a multi-row insert
+type insertBatch struct {
+	table     string
+	stmt      *sqlite3.Stmt // Single row
+	batchStmt *sqlite3.Stmt // batchRows rows
+	batchRows int
+	rows      [][]interface{}
+}
+
+func newInsertBatch(table string, stmt, batchStmt *sqlite3.Stmt, batchRows int) *insertBatch {
+	return &insertBatch{table: table, stmt: stmt, batchStmt: batchStmt, batchRows: batchRows,
+		rows: make([][]interface{}, 0, batchRows)}
+}
+
+// add queues a row, inserting the batch when full
+func (b *insertBatch) add(logger *logrus.Logger, vals []interface{}) {
+	b.rows = append(b.rows, vals)
+	if len(b.rows) >= b.batchRows {
+		b.flush(logger)
+	}
+}
+
+// flush inserts queued rows - with the multi-row statement if the batch is full, else (or if that fails) row by row
+func (b *insertBatch) flush(logger *logrus.Logger) {
+	if len(b.rows) == 0 {
+		return
+	}
+	if len(b.rows) == b.batchRows {
+		vals := make([]interface{}, 0, len(b.rows)*len(b.rows[0]))
+		for _, r := range b.rows {
+			vals = append(vals, r...)
+		}
+		if err := b.batchStmt.Exec(vals...); err == nil {
+			b.rows = b.rows[:0]
+			return
+		}
+	}
+	for _, r := range b.rows {
+		if err := b.stmt.Exec(r...); err != nil {
+			// Rows start with processkey, lineNumber
+			logger.Errorf("%s insert: %v processkey %v, lineNo %v", b.table, err, r[0], r[1])
+		}
+	}
+	b.rows = b.rows[:0]
+}
+
+// insertCmd inserts cmd (process and tableUse rows are batched, see flush) and returns the number of rows
+func (db *sqliteDB) insertCmd(logger *logrus.Logger, cmd *p4dlog.Command) int64 {
+	rows := 1
+	processCmd, argsVals := truncateArgs(cmd, db.argsLimit)
+	db.batchProcess.add(logger, db.process.values(processValuesFunc(db.lowerCase)(processCmd, sqliteDate)))
+	if argsVals != nil {
+		rows++
+		if err := db.stmtArgs.Exec(argsVals...); err != nil {
+			logger.Errorf("ArgsBlob insert: %v pid %d, lineNo %d, %s", err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+		}
+	}
+	for _, tu := range cmdTableUses(cmd) {
+		rows++
+		db.batchTableuse.add(logger, tableUseValues(cmd, tu))
+	}
+	for _, l := range cmd.SerializedLocks {
+		rows++
+		if err := db.stmtLocks.Exec(serializedLockValues(cmd, l)...); err != nil {
+			logger.Errorf("SerializedLocks insert: %v pid %d, lineNo %d, %s, %s, %s",
+				err, cmd.Pid, cmd.LineNo, cmd.GetKey(), string(cmd.Cmd), string(cmd.Args))
+		}
+	}
+	for i := range cmd.Errors {
+		rows++
+		if err := db.stmtErrors.Exec(cmdErrorValues(cmd, &cmd.Errors[i])...); err != nil {
+			logger.Errorf("CmdErrors insert: %v pid %d, lineNo %d, %s, %s, %s",
+				err, cmd.Pid, cmd.LineNo, cmd.GetKey(), string(cmd.Cmd), string(cmd.Args))
+		}
+	}
+	return int64(rows)
+}
+
+// flush inserts any batched rows
+func (db *sqliteDB) flush(logger *logrus.Logger) {
+	for _, b := range []*insertBatch{db.batchProcess, db.batchTableuse} {
+		if b != nil {
+			b.flush(logger)
+		}
+	}
+}
+
+// dbWriter writes records to the database(s) on its own goroutine
+type dbWriter struct {
+	logger         *logrus.Logger
+	dbs            *dbShards
+	pythonSchema   bool
+	commitInterval time.Duration // 0 - commit only when statementsPerTransaction rows written
+	bench          *benchStats   // --bench, else nil
+	queue          chan interface{}
+	done           chan struct{}
+}
+
+func newDBWriter(logger *logrus.Logger, dbs *dbShards, commitInterval time.Duration, bench *benchStats) *dbWriter {
+	w := &dbWriter{logger: logger, dbs: dbs, pythonSchema: dbs.opts.pythonSchema, commitInterval: commitInterval,
+		bench: bench, queue: make(chan interface{}, dbQueueSize), done: make(chan struct{})}
+	if bench != nil {
+		bench.sample("db", func() float64 { return fraction(len(w.queue), cap(w.queue)) })
+	}
+	go w.run()
+	return w
+}
+
+// write queues a record - *p4dlog.Command, *p4dlog.ServerEvent, *p4dlog.ServerEventDay, *p4dlog.ProxyEvent or
+// *p4dlog.BrokerEvent - which must not be modified afterwards
+func (w *dbWriter) write(rec interface{}) {
+	if w.bench != nil {
+		w.bench.queueRecord(w.queue, rec)
+		return
+	}
+	w.queue <- rec
+}
+
+// close waits for queued records to be written and closes the database(s)
+func (w *dbWriter) close() {
+	close(w.queue)
+	<-w.done
+}
+
+func (w *dbWriter) run() {
+	defer close(w.done)
+	rows := int64(0)
+	var tick <-chan time.Time // Nil (never ready) without a commit interval
+	if w.commitInterval > 0 {
+		ticker := time.NewTicker(w.commitInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var rec interface{}
+		select {
+		case <-tick:
+			if rows > 0 {
+				w.dbs.commit()
+				rows = 0
+			}
+			continue
+		case r, ok := <-w.queue:
+			if !ok {
+				w.dbs.close()
+				return
+			}
+			rec = r
+		}
+		var started time.Time
+		if w.bench != nil {
+			started = time.Now()
+		}
+		switch r := rec.(type) {
+		case *p4dlog.Command:
+			db := w.dbs.get(recordTime(r.StartTime, r.EndTime))
+			if w.pythonSchema {
+				rows += preparedInsertPython(w.logger, db.stmtProcess, db.stmtTableuse, r)
+			} else {
+				rows += db.insertCmd(w.logger, r)
+			}
+		case *p4dlog.ServerEvent:
+			// Typed events (e.g. server restarts) are written to serverEvents rather than events
+			if r.EventType != "" {
+				rows += preparedInsertTypedEvent(w.logger, w.dbs.get(r.EventTime).stmtTypedEvents, r)
+			} else {
+				rows += preparedInsertServerEvents(w.logger, w.dbs.get(r.EventTime).stmtEvents, r)
+			}
+		case *p4dlog.ServerEventDay:
+			rows += preparedInsertEventDay(w.logger, w.dbs.get(r.Day).stmtEventsDaily, r)
+		case *p4dlog.ProxyEvent:
+			rows += preparedInsertProxy(w.logger, w.dbs.get(r.StartTime).stmtProxy, r)
+		case *p4dlog.BrokerEvent:
+			rows += preparedInsertBroker(w.logger, w.dbs.get(r.StartTime).stmtBroker, r)
+		case *anomaly.Anomaly:
+			rows += preparedInsertAnomaly(w.logger, w.dbs.get(r.Time).stmtAnomalies, r)
+		default:
+			w.logger.Errorf("dbWriter: unexpected record type %T", rec)
+		}
+		if rows >= statementsPerTransaction {
+			w.dbs.commit()
+			rows = 0
+		}
+		if w.bench != nil {
+			w.bench.dbWrite(started)
+		}
+	}
+}
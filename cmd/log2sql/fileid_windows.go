@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// fileID - file identity is not available from os.FileInfo on Windows, so files are matched by name
+func fileID(fi os.FileInfo) (dev, ino uint64) {
+	return 0, 0
+}
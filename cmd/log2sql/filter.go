@@ -0,0 +1,110 @@
+package main
+
+// Filtering of the commands written to database/SQL/JSON/PostgreSQL/Parquet outputs - see --filter.*.
+// For huge logs it is often only one misbehaving user, or a short time window, which is of interest, and writing
+// everything else makes for long runs and giant databases. Logs are still parsed in full (commands span many lines,
+// and the Running count depends on all commands), and metrics are not filtered.
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Format of --filter.start/end, as for timestamps in the log
+const filterTimeFormat = "2006/01/02 15:04:05"
+
+// cmdFilter - a nil filter, or one with no criteria set, matches everything
+type cmdFilter struct {
+	user  *regexp.Regexp
+	cmd   *regexp.Regexp
+	start time.Time
+	end   time.Time
+}
+
+// newCmdFilter returns nil if no criteria are specified
+func newCmdFilter(user, cmd, start, end string) (*cmdFilter, error) {
+	if user == "" && cmd == "" && start == "" && end == "" {
+		return nil, nil
+	}
+	f := &cmdFilter{}
+	var err error
+	if user != "" {
+		if f.user, err = regexp.Compile(user); err != nil {
+			return nil, fmt.Errorf("invalid --filter.user: %v", err)
+		}
+	}
+	if cmd != "" {
+		if f.cmd, err = regexp.Compile(cmd); err != nil {
+			return nil, fmt.Errorf("invalid --filter.cmd: %v", err)
+		}
+	}
+	if start != "" {
+		if f.start, err = time.Parse(filterTimeFormat, start); err != nil {
+			return nil, fmt.Errorf("invalid --filter.start, expected format %s: %v", filterTimeFormat, err)
+		}
+	}
+	if end != "" {
+		if f.end, err = time.Parse(filterTimeFormat, end); err != nil {
+			return nil, fmt.Errorf("invalid --filter.end, expected format %s: %v", filterTimeFormat, err)
+		}
+	}
+	if !f.start.IsZero() && !f.end.IsZero() && f.end.Before(f.start) {
+		return nil, fmt.Errorf("--filter.end %s is before --filter.start %s", end, start)
+	}
+	return f, nil
+}
+
+// inRange returns true if the period from start to end overlaps the filter time range
+func (f *cmdFilter) inRange(start, end time.Time) bool {
+	if end.IsZero() || end.Before(start) {
+		end = start
+	}
+	if !f.start.IsZero() && end.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && start.After(f.end) {
+		return false
+	}
+	return true
+}
+
+// matchCmd returns true if the command is to be output - i.e. the user and command match, and it was running
+// at some point within the time range
+func (f *cmdFilter) matchCmd(cmd *p4dlog.Command) bool {
+	if f == nil {
+		return true
+	}
+	if f.user != nil && !f.user.MatchString(cmd.User) {
+		return false
+	}
+	if f.cmd != nil && !f.cmd.MatchString(cmd.Cmd) {
+		return false
+	}
+	return f.inRange(cmd.StartTime, cmd.EndTime)
+}
+
+// matchEvent returns true if the server event is within the time range - user/cmd criteria don't apply
+func (f *cmdFilter) matchEvent(evt *p4dlog.ServerEvent) bool {
+	if f == nil {
+		return true
+	}
+	return f.inRange(evt.EventTime, evt.EventTime)
+}
+
+// matchRecord returns true if a proxy/broker record is to be output - the user and command match, and it started
+// within the time range
+func (f *cmdFilter) matchRecord(user, cmd string, start time.Time) bool {
+	if f == nil {
+		return true
+	}
+	if f.user != nil && !f.user.MatchString(user) {
+		return false
+	}
+	if f.cmd != nil && !f.cmd.MatchString(cmd) {
+		return false
+	}
+	return f.inRange(start, start)
+}
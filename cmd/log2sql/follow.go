@@ -0,0 +1,48 @@
+package main
+
+// Follow mode - see --follow. Tails a live log (like tail -F, coping with rotation) and writes commands to the
+// database/metrics etc. as they complete, running as a daemon until interrupted - rather than in batch after the log is
+// rotated. Completed commands are output as the wall clock advances (as for p4dpending --follow), so are written even
+// while the log is quiet. With metrics, they are output (and historical metrics written every --update.interval) as the
+// log time advances, i.e. as later lines are written to the log. Metrics are flushed as they are written, and
+// database rows are committed at least every --follow.commit so that they are visible to queries (use --db.wal so that
+// queries don't block the writer). On SIGINT/SIGTERM the tail stops, and commands still pending are output and the
+// outputs closed as at the end of a batch run.
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/rcowham/go-libp4dlog/internal/logtail"
+)
+
+// followLog sends lines written to logfile to linesChan until interrupted, then closes linesChan. Lines already in
+// the log are read first if fromStart.
+func followLog(logger *logrus.Logger, logfile string, fromStart bool, linesChan chan string, sf *sourceFiles) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		select {
+		case sig := <-sigs:
+			logger.Infof("Received %v, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	if sf != nil {
+		sf.start(logfile, 0)
+	}
+	logger.Infof("Following: %s", logfile)
+	tl := logtail.New(logger, logfile, fromStart)
+	if err := tl.Tail(ctx, linesChan); err != nil { // Closes linesChan
+		logger.Errorf("Error following %s: %v", logfile, err)
+	}
+	logger.Infof("Stopped following %s after %d lines", logfile, tl.LinesRead())
+}
@@ -0,0 +1,139 @@
+package main
+
+// JSON marshalling of commands is a hotspot when JSON output is enabled for large logs (e.g. 100M commands), so
+// records are marshalled by a pool of workers. Records are grouped into batches, with the writer waiting for each
+// batch in turn so that output order is as received - unless unordered, when batches are written as they complete.
+// With a single worker records are marshalled and written directly as before.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Records per batch handed to a worker
+const jsonBatchSize = 256
+
+type jsonBatch struct {
+	recs   []fmt.Stringer
+	result chan *bytes.Buffer // Buffered (1) - set for ordered output
+}
+
+// jsonWriter writes records (commands, server events) as JSON lines
+type jsonWriter struct {
+	w        io.Writer
+	workers  int
+	ordered  bool
+	batch    []fmt.Stringer
+	jobs     chan *jsonBatch
+	results  chan chan *bytes.Buffer // Ordered - in the order batches were queued
+	buffers  chan *bytes.Buffer      // Unordered - as completed
+	bufPool  sync.Pool
+	wg       sync.WaitGroup
+	writerWG sync.WaitGroup
+	err      error // First write error
+}
+
+// newJSONWriter - workers <= 1 marshals synchronously
+func newJSONWriter(w io.Writer, workers int, ordered bool) *jsonWriter {
+	jw := &jsonWriter{w: w, workers: workers, ordered: ordered}
+	jw.bufPool.New = func() interface{} { return new(bytes.Buffer) }
+	if workers <= 1 {
+		return jw
+	}
+	jw.jobs = make(chan *jsonBatch, workers*2)
+	if ordered {
+		jw.results = make(chan chan *bytes.Buffer, workers*2)
+	} else {
+		jw.buffers = make(chan *bytes.Buffer, workers*2)
+	}
+	for i := 0; i < workers; i++ {
+		jw.wg.Add(1)
+		go func() {
+			defer jw.wg.Done()
+			for b := range jw.jobs {
+				buf := jw.marshal(b.recs)
+				if b.result != nil {
+					b.result <- buf
+				} else {
+					jw.buffers <- buf
+				}
+			}
+		}()
+	}
+	jw.writerWG.Add(1)
+	go func() {
+		defer jw.writerWG.Done()
+		if ordered {
+			for r := range jw.results {
+				jw.output(<-r)
+			}
+		} else {
+			for buf := range jw.buffers {
+				jw.output(buf)
+			}
+		}
+	}()
+	return jw
+}
+
+func (jw *jsonWriter) marshal(recs []fmt.Stringer) *bytes.Buffer {
+	buf := jw.bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	for _, r := range recs {
+		buf.WriteString(r.String())
+		buf.WriteByte('\n')
+	}
+	return buf
+}
+
+func (jw *jsonWriter) output(buf *bytes.Buffer) {
+	if _, err := jw.w.Write(buf.Bytes()); err != nil && jw.err == nil {
+		jw.err = err
+	}
+	jw.bufPool.Put(buf)
+}
+
+// write queues a record for output. Records must not be modified afterwards.
+func (jw *jsonWriter) write(rec fmt.Stringer) {
+	if jw.workers <= 1 {
+		if _, err := fmt.Fprintf(jw.w, "%s\n", rec.String()); err != nil && jw.err == nil {
+			jw.err = err
+		}
+		return
+	}
+	jw.batch = append(jw.batch, rec)
+	if len(jw.batch) >= jsonBatchSize {
+		jw.flushBatch()
+	}
+}
+
+func (jw *jsonWriter) flushBatch() {
+	if len(jw.batch) == 0 {
+		return
+	}
+	b := &jsonBatch{recs: jw.batch}
+	if jw.ordered {
+		b.result = make(chan *bytes.Buffer, 1)
+		jw.results <- b.result
+	}
+	jw.jobs <- b
+	jw.batch = make([]fmt.Stringer, 0, jsonBatchSize)
+}
+
+// Close writes any queued records, waiting for completion, and returns the first write error
+func (jw *jsonWriter) Close() error {
+	if jw.workers > 1 {
+		jw.flushBatch()
+		close(jw.jobs)
+		jw.wg.Wait()
+		if jw.ordered {
+			close(jw.results)
+		} else {
+			close(jw.buffers)
+		}
+		jw.writerWG.Wait()
+	}
+	return jw.err
+}
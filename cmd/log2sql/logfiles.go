@@ -0,0 +1,145 @@
+package main
+
+// Expansion of logfile arguments - globs are expanded internally (useful on Windows or when quoted to avoid
+// shell limits), and the resulting files ordered by the first timestamp found within each file rather than by
+// filename, so that rotated logs with awkward naming schemes are still processed chronologically.
+// This matters for Running counts and continuity of historical metrics.
+// Structured logs are not sorted, except that files of errors (e.g. errors.csv) are processed first, as required
+// to combine errors with their commands.
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logreader"
+)
+
+// Max no of lines to search at start of each file for a timestamp
+const maxTimestampSearchLines = 1000
+
+var reLogTimestamp = regexp.MustCompile(`\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}`)
+
+// expandLogfiles expands any glob patterns, removes duplicates and optionally sorts by first timestamp in
+// each file. Files without a timestamp retain their relative order after those with timestamps.
+func expandLogfiles(logger *logrus.Logger, args []string, sortByTime bool) []string {
+	files := make([]string, 0, len(args))
+	seen := make(map[string]bool)
+	add := func(f string) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	for _, arg := range args {
+		if arg == "-" {
+			add(arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			logger.Errorf("Invalid logfile pattern %s: %v", arg, err)
+			add(arg)
+			continue
+		}
+		if len(matches) == 0 {
+			add(arg) // Leave it to the open to report the error
+			continue
+		}
+		for _, m := range matches {
+			add(m)
+		}
+	}
+	if !sortByTime || len(files) < 2 {
+		return files
+	}
+	firstTimes := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if f == "-" {
+			continue
+		}
+		t, err := firstLogTime(f)
+		if err != nil {
+			logger.Warnf("Failed to find timestamp in %s: %v", f, err)
+		}
+		firstTimes[f] = t
+		logger.Debugf("First timestamp in %s: %v", f, t)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		ti, tj := firstTimes[files[i]], firstTimes[files[j]]
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
+	return files
+}
+
+// firstLogTime returns the first timestamp found in the (possibly compressed) logfile, or zero time if none found
+func firstLogTime(logfile string) (time.Time, error) {
+	var t time.Time
+	file, err := os.Open(logfile)
+	if err != nil {
+		return t, err
+	}
+	defer file.Close()
+	reader, _, err := logreader.FromFile(file)
+	if err != nil {
+		return t, err
+	}
+	defer reader.Close()
+	lr := p4dlog.NewLineReader(reader, 5000)
+	for i := 0; i < maxTimestampSearchLines && lr.Scan(); i++ {
+		if m := reLogTimestamp.FindString(lr.Text()); m != "" {
+			return time.Parse("2006/01/02 15:04:05", m)
+		}
+	}
+	return t, lr.Err()
+}
+
+// structuredErrorsFirst moves structured logs whose first event is an error (e.g. errors.csv) before the others,
+// otherwise retaining the order given
+func structuredErrorsFirst(logger *logrus.Logger, files []string) []string {
+	errorFiles := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f == "-" {
+			continue
+		}
+		isErrors, err := firstEventIsError(f)
+		if err != nil {
+			logger.Warnf("Failed to read first event in %s: %v", f, err)
+		}
+		errorFiles[f] = isErrors
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return errorFiles[files[i]] && !errorFiles[files[j]]
+	})
+	return files
+}
+
+// firstEventIsError returns true if the first line of the (possibly compressed) structured log is an error event
+func firstEventIsError(logfile string) (bool, error) {
+	file, err := os.Open(logfile)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	reader, _, err := logreader.FromFile(file)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	lr := p4dlog.NewLineReader(reader, 5000)
+	for i := 0; i < maxTimestampSearchLines && lr.Scan(); i++ {
+		if line := strings.TrimSpace(lr.Text()); line != "" {
+			return p4dlog.StructuredErrorEvent(line), nil
+		}
+	}
+	return false, lr.Err()
+}
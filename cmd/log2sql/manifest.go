@@ -0,0 +1,98 @@
+package main
+
+// Server manifest - see --server.manifest. Lists the logfiles of each server (e.g. commit, edges and replicas) so that
+// they can be loaded into one database and compared, rather than specifying --file.server.id and --skew for each
+// logfile. Logfiles with a serverID are parsed by separate parsers (as with --parallel), with commands, events and
+// metrics tagged with the serverID. For example:
+//
+//	servers:
+//	  - serverID: commit
+//	    logfiles: [commit/log, commit/log.*.gz]
+//	  - serverID: edge1
+//	    logfiles: [edge1/log]
+//	    skew: -2m30s
+//
+// Logfiles may be glob patterns, and relative paths are relative to the directory of the manifest.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type manifestServer struct {
+	ServerID string   `yaml:"serverID"`
+	Logfiles []string `yaml:"logfiles"`
+	Skew     string   `yaml:"skew"` // As for --skew, e.g. -2m30s
+}
+
+type serverManifest struct {
+	Servers []manifestServer `yaml:"servers"`
+}
+
+// readServerManifest reads and validates a manifest
+func readServerManifest(path string) (*serverManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m serverManifest
+	if err = yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid server manifest %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	for i, s := range m.Servers {
+		if s.ServerID == "" {
+			return nil, fmt.Errorf("server manifest %s: server %d: no serverID", path, i+1)
+		}
+		if len(s.Logfiles) == 0 {
+			return nil, fmt.Errorf("server manifest %s: server %s: no logfiles", path, s.ServerID)
+		}
+		if s.Skew != "" {
+			if _, err = time.ParseDuration(s.Skew); err != nil {
+				return nil, fmt.Errorf("server manifest %s: server %s: invalid skew: %v", path, s.ServerID, err)
+			}
+		}
+		for j, f := range s.Logfiles {
+			if !filepath.IsAbs(f) {
+				m.Servers[i].Logfiles[j] = filepath.Join(dir, f)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// apply adds the logfiles of the manifest to logfiles (with glob patterns expanded), and their serverIDs and skews to
+// serverIDs and skewVals unless already specified for the logfile, returning the updated values
+func (m *serverManifest) apply(logfiles []string, serverIDs, skewVals map[string]string) ([]string,
+	map[string]string, map[string]string) {
+	ids := make(map[string]string, len(serverIDs))
+	for k, v := range serverIDs {
+		ids[k] = v
+	}
+	sk := make(map[string]string, len(skewVals))
+	for k, v := range skewVals {
+		sk[k] = v
+	}
+	for _, s := range m.Servers {
+		for _, pattern := range s.Logfiles {
+			files, err := filepath.Glob(pattern)
+			if err != nil || len(files) == 0 {
+				files = []string{pattern} // Leave it to the open to report the error
+			}
+			for _, f := range files {
+				logfiles = append(logfiles, f)
+				if _, ok := ids[f]; !ok {
+					ids[f] = s.ServerID
+				}
+				if _, ok := sk[f]; !ok && s.Skew != "" {
+					sk[f] = s.Skew
+				}
+			}
+		}
+	}
+	return logfiles, ids, sk
+}
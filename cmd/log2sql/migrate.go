@@ -0,0 +1,273 @@
+package main
+
+// Schema versioning of SQLite databases, so that running a newer log2sql against an existing database (e.g. resuming
+// with --state.file, or loading more logs into it) upgrades the database in place, rather than failing on columns
+// which it doesn't have. The version of the schema, and whether it is the Go or python compatible schema (see
+// --schema.compat), are recorded in the schema_version table. When a database is opened:
+//
+//   - databases with a newer schema version than this log2sql, or of the other --schema.compat, are rejected
+//   - columns of the table definitions (writeHeader) missing from existing tables are added, e.g. paused or
+//     fileTotals* in databases written by older versions. They are NULL for existing rows (or ''/0 if NOT NULL).
+//
+//   - steps of migrations for later versions than that of the database are run, for changes which can't be derived
+//     from the table definitions (e.g. a changed primary key)
+//
+// Databases without schema_version (written before it was added) are version 0. schemaVersion must be incremented
+// whenever columns or tables are added. Changes which can't be derived from the table definitions (e.g. renamed
+// columns) need a step in migrations for the new version.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/perforce/p4prometheus/version"
+	"github.com/sirupsen/logrus"
+)
+
+// Version of the tables written - see above
+const schemaVersion = 6
+
+// migrations - steps run (in order) for databases of an older schema version, after missing columns have been added
+var migrations = []struct {
+	version int    // Schema version which made the change
+	compat  string // Schema the step applies to
+	desc    string
+	migrate func(conn *sqlite3.Conn, ddl string) (bool, error) // Returns whether the database was changed
+}{
+	// Compute phase rows (--compute.phase.tables) have the same tableName as those of the command as a whole
+	{5, schemaCompatGo, "tableUse primary key including phase", func(conn *sqlite3.Conn, ddl string) (bool, error) {
+		return rebuildTable(conn, ddl, "tableUse", "phase")
+	}},
+	// submitLatency joined the dm-CommitSubmit of a later command reusing the pid - recreated by the ddl
+	{6, schemaCompatGo, "submitLatency bounded by submit times", func(conn *sqlite3.Conn, ddl string) (bool, error) {
+		return dropView(conn, "submitLatency")
+	}},
+}
+
+// writeSchemaVersion writes the DDL for schema_version, and the statements recording the version of the schema
+func writeSchemaVersion(f io.Writer, compat string) {
+	fmt.Fprintf(f, `CREATE TABLE IF NOT EXISTS schema_version -- version of the schema of this database, see log2sql README
+	(version INT NOT NULL, -- incremented when tables or columns are added
+	schemaCompat TEXT NOT NULL, -- go or python (--schema.compat)
+	log2sqlVersion TEXT NULL, -- version of log2sql which last wrote (or upgraded) the database
+	updated DATETIME NULL);
+DELETE FROM schema_version;
+INSERT INTO schema_version VALUES (%d, '%s', '%s', datetime('now'));
+`, schemaVersion, compat, strings.ReplaceAll(version.Version, "'", "''"))
+}
+
+// dbTableColumns returns the (lower case) column names of a table in the database - none if it doesn't exist
+func dbTableColumns(conn *sqlite3.Conn, table string) (map[string]bool, error) {
+	stmt, err := conn.Prepare(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	cols := make(map[string]bool)
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			return cols, nil
+		}
+		var cid int
+		var name string
+		if err = stmt.Scan(&cid, &name); err != nil {
+			return nil, err
+		}
+		cols[strings.ToLower(name)] = true
+	}
+}
+
+// dbQueryStrings returns the (string) first column of the rows of query
+func dbQueryStrings(conn *sqlite3.Conn, query string) ([]string, error) {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var result []string
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			return result, nil
+		}
+		var s string
+		if err = stmt.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+}
+
+// createTableStmt returns the CREATE TABLE statement of table in ddl
+func createTableStmt(ddl, table string) (string, error) {
+	chunks := reDDLTable.Split(ddl, -1)
+	for i, t := range reDDLTable.FindAllStringSubmatch(ddl, -1) {
+		if t[1] != table {
+			continue
+		}
+		if end := strings.Index(chunks[i+1], ");"); end >= 0 {
+			return t[0] + chunks[i+1][:end+2], nil
+		}
+	}
+	return "", fmt.Errorf("no definition of table %s", table)
+}
+
+// rebuildTable recreates table as defined in ddl (as SQLite can't change the primary key of a table), copying its
+// rows, unless keyCol is already part of its primary key. Views using the table are dropped and recreated.
+func rebuildTable(conn *sqlite3.Conn, ddl, table, keyCol string) (bool, error) {
+	keys, err := dbQueryStrings(conn, fmt.Sprintf("SELECT name FROM pragma_table_info('%s') WHERE pk > 0", table))
+	if err != nil || len(keys) == 0 { // No table, created by ddl
+		return false, err
+	}
+	for _, k := range keys {
+		if strings.EqualFold(k, keyCol) {
+			return false, nil
+		}
+	}
+	create, err := createTableStmt(ddl, table)
+	if err != nil {
+		return false, err
+	}
+	cols, err := dbQueryStrings(conn, fmt.Sprintf("SELECT name FROM pragma_table_info('%s') ORDER BY cid", table))
+	if err != nil {
+		return false, err
+	}
+	viewQuery := fmt.Sprintf("FROM sqlite_master WHERE type = 'view' AND sql LIKE '%%%s%%' ORDER BY rowid", table)
+	views, err := dbQueryStrings(conn, "SELECT name "+viewQuery)
+	if err != nil {
+		return false, err
+	}
+	viewDDL, err := dbQueryStrings(conn, "SELECT sql "+viewQuery)
+	if err != nil {
+		return false, err
+	}
+	newTable := table + "_new"
+	stmts := []string{"BEGIN"}
+	for _, v := range views {
+		stmts = append(stmts, fmt.Sprintf("DROP VIEW %s", v))
+	}
+	colList := strings.Join(cols, ", ")
+	stmts = append(stmts,
+		strings.Replace(create, "CREATE TABLE IF NOT EXISTS "+table, "CREATE TABLE "+newTable, 1),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", newTable, colList, colList, table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", newTable, table))
+	stmts = append(append(stmts, viewDDL...), "COMMIT")
+	for _, stmt := range stmts {
+		if err := conn.Exec(stmt); err != nil {
+			conn.Exec("ROLLBACK")
+			return false, fmt.Errorf("%s: %v", stmt, err)
+		}
+	}
+	return true, nil
+}
+
+// dropView drops view, if it exists, so that it is recreated by the ddl
+func dropView(conn *sqlite3.Conn, view string) (bool, error) {
+	views, err := dbQueryStrings(conn, fmt.Sprintf("SELECT name FROM sqlite_master WHERE type = 'view' AND name = '%s'", view))
+	if err != nil || len(views) == 0 {
+		return false, err
+	}
+	return true, conn.Exec(fmt.Sprintf("DROP VIEW %s", view))
+}
+
+// dbSchemaVersion returns the schema version and compat of the database - version 0 if it has no schema_version
+// (new databases, or those written before it was added)
+func dbSchemaVersion(conn *sqlite3.Conn) (int, string, error) {
+	if cols, err := dbTableColumns(conn, "schema_version"); err != nil || len(cols) == 0 {
+		return 0, "", err
+	}
+	stmt, err := conn.Prepare("SELECT version, schemaCompat FROM schema_version")
+	if err != nil {
+		return 0, "", err
+	}
+	defer stmt.Close()
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return 0, "", err
+	}
+	var version int
+	var compat string
+	err = stmt.Scan(&version, &compat)
+	return version, compat, err
+}
+
+// addColumnDef returns the definition for adding a column of type colType (NOT NULL/NULL) to an existing table
+func addColumnDef(col, colType, null string) string {
+	if null == "NULL" {
+		return fmt.Sprintf("%s %s NULL", col, colType)
+	}
+	def := "0"
+	if strings.Contains(colType, "CHAR") || colType == "TEXT" || colType == "DATETIME" {
+		def = "''"
+	}
+	return fmt.Sprintf("%s %s NOT NULL DEFAULT %s", col, colType, def)
+}
+
+// migrateSQLiteDB upgrades the tables of an existing database (name) to those of ddl, before ddl is executed - see
+// above
+func migrateSQLiteDB(logger *logrus.Logger, conn *sqlite3.Conn, name, ddl, compat string) error {
+	dbVersion, dbCompat, err := dbSchemaVersion(conn)
+	if err != nil {
+		return fmt.Errorf("%s: reading schema version: %v", name, err)
+	}
+	if dbVersion > schemaVersion {
+		return fmt.Errorf("%s: database schema version %d is newer than %d of this log2sql - upgrade log2sql or use a new database",
+			name, dbVersion, schemaVersion)
+	}
+	if dbCompat != "" && dbCompat != compat {
+		return fmt.Errorf("%s: database has the %s schema - can't write the %s schema (--schema.compat) to it",
+			name, dbCompat, compat)
+	}
+	chunks := reDDLTable.Split(ddl, -1)
+	added := 0
+	for i, t := range reDDLTable.FindAllStringSubmatch(ddl, -1) {
+		table := t[1]
+		cols, err := dbTableColumns(conn, table)
+		if err != nil {
+			return fmt.Errorf("%s: reading columns of %s: %v", name, table, err)
+		}
+		if len(cols) == 0 { // New table, created by ddl
+			continue
+		}
+		for _, c := range reDDLColumn.FindAllStringSubmatch(chunks[i+1], -1) {
+			if cols[strings.ToLower(c[1])] {
+				continue
+			}
+			stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, addColumnDef(c[1], c[2], c[3]))
+			if err := conn.Exec(stmt); err != nil {
+				return fmt.Errorf("%s: %s: %v", name, stmt, err)
+			}
+			cols[strings.ToLower(c[1])] = true
+			added++
+		}
+	}
+	migrated := 0
+	for _, m := range migrations {
+		if dbVersion >= m.version || m.compat != compat {
+			continue
+		}
+		changed, err := m.migrate(conn, ddl)
+		if err != nil {
+			return fmt.Errorf("%s: migrating %s: %v", name, m.desc, err)
+		}
+		if changed {
+			logger.Infof("Migrated database %s: %s", name, m.desc)
+			migrated++
+		}
+	}
+	if added > 0 || migrated > 0 || (dbCompat != "" && dbVersion < schemaVersion) {
+		logger.Infof("Upgraded database %s from schema version %d to %d (%d columns added)",
+			name, dbVersion, schemaVersion, added)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+// Parallel parsing of independent log files (e.g. from different edge/replica servers) - see --parallel.
+// Each logfile has its own parser (and historical metrics, labelled with the serverID of the file), with up to N files
+// parsed concurrently. Logfiles given the same serverID (e.g. rotated logs of one server in a --server.manifest) are
+// parsed in sequence by the same parser. Commands and server events are tagged with the serverID of their file and
+// merged onto a single channel for the database/SQL/JSON writers, and metrics onto a single channel for the metrics
+// writer.
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logreader"
+	"github.com/rcowham/go-libp4dlog/metrics"
+)
+
+// logParser - methods of both p4dlog.P4dFileParser and metrics.P4DMetrics used to configure them and report at the end
+type logParser interface {
+	SetDebugMode(level int)
+	SetDebugPID(pid int64, cmdName string)
+	SetNoCompletionRecords()
+	SetFeature(name string, enabled bool) error
+	SetMemoryLimit(limitMB int64)
+	SetDescriptionLimit(limit int)
+	SetKeyMode(mode p4dlog.KeyMode)
+	Stats() p4dlog.ParserStats
+	NoiseLinesCount() int64
+	TableDetailDroppedAt() int64
+	LocksOnlyTrackCount() int64
+	DuplicateOutputCount() int64
+	MonitorRemovedCount() int64
+}
+
+// parallelFile - the logfiles of a server and their parser. Exactly one of fp or mp is set.
+type parallelFile struct {
+	logfiles []string // Parsed in sequence
+	serverID string
+	lineOpts lineOptions
+	fp       *p4dlog.P4dFileParser
+	mp       *metrics.P4DMetrics
+}
+
+func (pf *parallelFile) parser() logParser {
+	if pf.mp != nil {
+		return pf.mp
+	}
+	return pf.fp
+}
+
+// logfileServerID returns the serverID for a logfile - as specified in serverIDs (by path or base name), otherwise
+// its base name without compression (e.g. .gz) and .log suffixes
+// source returns the logfile and line number within it of a parser line number
+func (pf *parallelFile) source(sf *sourceFiles, lineNo int64) (string, int64) {
+	if sf == nil {
+		return pf.logfiles[0], lineNo
+	}
+	return sf.lookup(lineNo)
+}
+
+// newParallelFiles returns a parallelFile per logfile, except that logfiles with the same serverID in serverIDs
+// are combined
+func newParallelFiles(logfiles []string, serverIDs map[string]string, lineOpts lineOptions) []*parallelFile {
+	var files []*parallelFile
+	byServer := make(map[string]*parallelFile)
+	for _, f := range logfiles {
+		id := logfileServerID(f, serverIDs)
+		_, explicit := serverIDs[f]
+		if _, ok := serverIDs[filepath.Base(f)]; ok {
+			explicit = true
+		}
+		if pf, ok := byServer[id]; ok && explicit {
+			pf.logfiles = append(pf.logfiles, f)
+			continue
+		}
+		pf := &parallelFile{logfiles: []string{f}, serverID: id, lineOpts: lineOpts}
+		if explicit {
+			byServer[id] = pf
+		}
+		files = append(files, pf)
+	}
+	return files
+}
+
+func logfileServerID(logfile string, serverIDs map[string]string) string {
+	base := filepath.Base(logfile)
+	if id, ok := serverIDs[logfile]; ok {
+		return id
+	}
+	if id, ok := serverIDs[base]; ok {
+		return id
+	}
+	return strings.TrimSuffix(logreader.TrimSuffix(base), ".log")
+}
+
+// parseParallel parses files, up to n at a time, returning the merged command (nil unless needCmdChan) and metrics
+// channels, which are closed when all files have been processed
+func parseParallel(ctx context.Context, logger *logrus.Logger, files []*parallelFile, n int, pr *progressReporter,
+	needCmdChan bool) (chan interface{}, chan string) {
+	var cmdChan chan interface{}
+	if needCmdChan {
+		cmdChan = make(chan interface{}, 10000)
+	}
+	metricsChan := make(chan string, 1000)
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for _, pf := range files {
+		wg.Add(1)
+		go func(pf *parallelFile) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			linesChan := make(chan string, 10000)
+			var cmds chan interface{}
+			var fileMetrics chan string
+			if pf.mp != nil {
+				cmds, fileMetrics = pf.mp.ProcessEvents(ctx, linesChan, needCmdChan)
+			} else {
+				cmds = pf.fp.LogParser(ctx, linesChan, make(chan time.Time))
+			}
+			var sf *sourceFiles // Maps line numbers back to logfiles if more than one
+			if len(pf.logfiles) > 1 {
+				sf = newSourceFiles(1)
+			}
+			go func() {
+				for _, f := range pf.logfiles {
+					logger.Infof("Processing: %s (serverID %s)", f, pf.serverID)
+					parseLog(logger, f, linesChan, pr, nil, sf, pf.lineOpts)
+				}
+				close(linesChan)
+			}()
+
+			var mwg sync.WaitGroup
+			if fileMetrics != nil {
+				mwg.Add(1)
+				go func() {
+					defer mwg.Done()
+					for m := range fileMetrics {
+						metricsChan <- m
+					}
+				}()
+			}
+			if cmds != nil {
+				for c := range cmds {
+					if !needCmdChan {
+						continue
+					}
+					switch c := c.(type) {
+					case p4dlog.Command:
+						if c.ServerID == "" { // Unless set by --server.prefix
+							c.ServerID = pf.serverID
+						}
+						c.SourceFile, c.SourceLineNo = pf.source(sf, c.LineNo)
+						cmdChan <- c
+					case p4dlog.ServerEvent:
+						c.ServerID = pf.serverID
+						c.SourceFile, c.SourceLineNo = pf.source(sf, c.LineNo)
+						cmdChan <- c
+					case p4dlog.ProxyEvent:
+						c.ServerID = pf.serverID
+						c.SourceFile, c.SourceLineNo = pf.source(sf, c.LineNo)
+						cmdChan <- c
+					case p4dlog.BrokerEvent:
+						c.ServerID = pf.serverID
+						c.SourceFile, c.SourceLineNo = pf.source(sf, c.LineNo)
+						cmdChan <- c
+					}
+				}
+			}
+			mwg.Wait()
+			logger.Infof("Finished: %s", strings.Join(pf.logfiles, ", "))
+		}(pf)
+	}
+	go func() {
+		wg.Wait()
+		if cmdChan != nil {
+			close(cmdChan)
+		}
+		close(metricsChan)
+	}()
+	return cmdChan, metricsChan
+}
@@ -0,0 +1,223 @@
+package main
+
+// Parquet output - one file per table (process, tableUse, serializedLocks, cmdErrors, events, eventsDaily) with columns and types
+// taken from the (Go) database schema, so that very large logs can be queried directly with DuckDB/Spark etc.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/writer"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+var (
+	reDDLTable   = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+	reDDLColumn  = regexp.MustCompile(`(\w+) (CHAR\(\d+\)|VARCHAR\(\d+\)|TEXT|INT|int|FLOAT|DATETIME) (NOT NULL|NULL)`)
+	reInsertCols = regexp.MustCompile(`INSERT INTO (\w+)\s*\(([^)]*)\)`)
+)
+
+// tableDDL returns the column types (type, NOT NULL/NULL) by lower case name, and the DDL, of a table in the schema
+func tableDDL(table string) (map[string][]string, string) {
+	ddl := new(bytes.Buffer)
+	writeTables(ddl)
+	colTypes := make(map[string][]string)
+	chunks := reDDLTable.Split(ddl.String(), -1)
+	for i, t := range reDDLTable.FindAllStringSubmatch(ddl.String(), -1) {
+		if strings.ToLower(t[1]) != strings.ToLower(table) {
+			continue
+		}
+		for _, c := range reDDLColumn.FindAllStringSubmatch(chunks[i+1], -1) {
+			colTypes[strings.ToLower(c[1])] = c[2:]
+		}
+		return colTypes, chunks[i+1]
+	}
+	return colTypes, ""
+}
+
+// parquetSchema returns parquet metadata for the columns of insertStmt (in order), with types from the schema
+func parquetSchema(insertStmt string) ([]string, error) {
+	m := reInsertCols.FindStringSubmatch(insertStmt)
+	if m == nil {
+		return nil, fmt.Errorf("no columns found in: %s", insertStmt)
+	}
+	table := strings.ToLower(m[1])
+	colTypes, _ := tableDDL(table)
+	var md []string
+	for _, col := range strings.Split(m[2], ",") {
+		col = strings.TrimSpace(col)
+		t, ok := colTypes[strings.ToLower(col)]
+		if !ok {
+			return nil, fmt.Errorf("no type found for %s.%s", table, col)
+		}
+		ptype := "type=BYTE_ARRAY, convertedtype=UTF8"
+		switch strings.ToUpper(t[0]) {
+		case "INT":
+			ptype = "type=INT64"
+		case "FLOAT":
+			ptype = "type=DOUBLE"
+		case "DATETIME":
+			ptype = "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+		}
+		rep := "OPTIONAL"
+		if t[1] == "NOT NULL" {
+			rep = "REQUIRED"
+		}
+		md = append(md, fmt.Sprintf("name=%s, %s, repetitiontype=%s", col, ptype, rep))
+	}
+	return md, nil
+}
+
+func parquetDate(t time.Time) interface{} {
+	var blankTime time.Time
+	if t == blankTime {
+		return nil
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// parquetValues converts values to the types required by the parquet writer (INT64/DOUBLE)
+func parquetValues(vals []interface{}) []interface{} {
+	for i, v := range vals {
+		switch v := v.(type) {
+		case int:
+			vals[i] = int64(v)
+		case int32:
+			vals[i] = int64(v)
+		case float32:
+			vals[i] = float64(v)
+		}
+	}
+	return vals
+}
+
+// parquetFile - a parquet file for a single table
+type parquetFile struct {
+	name string
+	fd   *os.File
+	buf  *bufio.Writer
+	pw   *writer.CSVWriter
+}
+
+func newParquetFile(name, insertStmt string) (*parquetFile, error) {
+	md, err := parquetSchema(insertStmt)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	pf := &parquetFile{name: name, fd: fd, buf: bufio.NewWriter(fd)}
+	if pf.pw, err = writer.NewCSVWriterFromWriter(md, pf.buf, 4); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return pf, nil
+}
+
+func (pf *parquetFile) write(vals []interface{}) error {
+	return pf.pw.Write(parquetValues(vals))
+}
+
+func (pf *parquetFile) close() error {
+	err := pf.pw.WriteStop()
+	if ferr := pf.buf.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := pf.fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parquetWriter writes commands and server events to parquet files <prefix>.<table>.parquet
+type parquetWriter struct {
+	logger                           *logrus.Logger
+	process, tableUse, locks, events *parquetFile
+	eventsDaily, cmdErrors           *parquetFile
+	lowerCase                        bool // See casefold.go
+}
+
+func newParquetWriter(logger *logrus.Logger, prefix string) (*parquetWriter, error) {
+	w := &parquetWriter{logger: logger}
+	var err error
+	for _, f := range []struct {
+		pf    **parquetFile
+		table string
+		stmt  string
+	}{
+		{&w.process, "process", getProcessStatement()},
+		{&w.tableUse, "tableUse", getTableUseStatement()},
+		{&w.locks, "serializedLocks", getSerializedLocksStatement()},
+		{&w.cmdErrors, "cmdErrors", getCmdErrorsStatement()},
+		{&w.events, "events", getEventsStatement()},
+		{&w.eventsDaily, "eventsDaily", getEventsDailyStatement("MAX")},
+	} {
+		name := fmt.Sprintf("%s.%s.parquet", prefix, f.table)
+		if *f.pf, err = newParquetFile(name, f.stmt); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("creating %s: %v", name, err)
+		}
+		logger.Infof("Creating Parquet output: %s", name)
+	}
+	return w, nil
+}
+
+func (w *parquetWriter) writeCmd(cmd *p4dlog.Command) {
+	if err := w.process.write(processValuesFunc(w.lowerCase)(cmd, parquetDate)); err != nil {
+		w.logger.Errorf("Parquet process write: %v pid %d, lineNo %d, %s",
+			err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+	}
+	for _, tu := range cmdTableUses(cmd) {
+		if err := w.tableUse.write(tableUseValues(cmd, tu)); err != nil {
+			w.logger.Errorf("Parquet tableUse write: %v pid %d, lineNo %d, %s",
+				err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+		}
+	}
+	for _, l := range cmd.SerializedLocks {
+		if err := w.locks.write(serializedLockValues(cmd, l)); err != nil {
+			w.logger.Errorf("Parquet serializedLocks write: %v pid %d, lineNo %d, %s",
+				err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+		}
+	}
+	for i := range cmd.Errors {
+		if err := w.cmdErrors.write(cmdErrorValues(cmd, &cmd.Errors[i])); err != nil {
+			w.logger.Errorf("Parquet cmdErrors write: %v pid %d, lineNo %d, %s",
+				err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+		}
+	}
+}
+
+func (w *parquetWriter) writeEvent(evt *p4dlog.ServerEvent) {
+	if err := w.events.write(eventValues(evt, parquetDate)); err != nil {
+		w.logger.Errorf("Parquet events write: %v lineNo %d", err, evt.LineNo)
+	}
+}
+
+func (w *parquetWriter) writeEventDay(d *p4dlog.ServerEventDay) {
+	if err := w.eventsDaily.write(eventDayValues(d, parquetDate)); err != nil {
+		w.logger.Errorf("Parquet eventsDaily write: %v %s", err, dateStr(d.Day))
+	}
+}
+
+// Close writes parquet footers and closes all files
+func (w *parquetWriter) Close() error {
+	var err error
+	for _, pf := range []*parquetFile{w.process, w.tableUse, w.locks, w.cmdErrors, w.events, w.eventsDaily} {
+		if pf == nil {
+			continue
+		}
+		if cerr := pf.close(); cerr != nil && err == nil {
+			err = fmt.Errorf("closing %s: %v", pf.name, cerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,297 @@
+package main
+
+// Native PostgreSQL output - writes the same tables/views as the SQLite database (Go schema only)
+// using prepared statements, committing every statementsPerTransaction rows. Rows with the same key as an
+// existing row are not inserted (see pgStatement) but counted, to be reported at the end of the run. If a commit
+// fails no further rows are written, and the error is returned by Close.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/anomaly"
+)
+
+// Latency (secs) between two timestamps in the submitLatency view
+const pgLatency = "EXTRACT(EPOCH FROM c.endTime - s.startTime)"
+
+var (
+	reSQLiteDatetime = regexp.MustCompile(`\bDATETIME\b`)
+	reSQLiteFloat    = regexp.MustCompile(`\bFLOAT\b`)
+	reSQLiteInt      = regexp.MustCompile(`(?i)\bint\b`)
+	reUserColumn     = regexp.MustCompile(`\buser( TEXT|,)`) // user is a reserved word in PostgreSQL
+)
+
+// pgIdentifiers quotes column names which are reserved words in PostgreSQL
+func pgIdentifiers(stmt string) string {
+	return reUserColumn.ReplaceAllString(stmt, `"user"$1`)
+}
+
+// pgSchema returns the Go schema converted to PostgreSQL types - counts may exceed 32 bits
+func pgSchema() string {
+	buf := new(bytes.Buffer)
+	writeTables(buf)
+	s := buf.String()
+	s = reSQLiteDatetime.ReplaceAllString(s, "TIMESTAMP")
+	s = reSQLiteFloat.ReplaceAllString(s, "DOUBLE PRECISION")
+	s = reSQLiteInt.ReplaceAllString(s, "BIGINT")
+	buf.Reset()
+	buf.WriteString(s)
+	writeIndexes(buf)
+	writeViews(buf, "CREATE OR REPLACE VIEW", pgLatency)
+	return pgIdentifiers(buf.String())
+}
+
+// pgStatement converts an insert statement to PostgreSQL placeholders ($1, $2...). Unless the statement is
+// an upsert, duplicate rows are not inserted rather than aborting the transaction (as a failed statement would),
+// and are counted by pgWriter.exec.
+func pgStatement(stmt string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range pgIdentifiers(stmt) {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	if !strings.Contains(stmt, "ON CONFLICT") {
+		b.WriteString(" ON CONFLICT DO NOTHING")
+	}
+	return b.String()
+}
+
+func pgDate(t time.Time) interface{} {
+	var blankTime time.Time
+	if t == blankTime {
+		return nil
+	}
+	return t
+}
+
+// pgWriter writes commands and server events to PostgreSQL
+type pgWriter struct {
+	logger                                           *logrus.Logger
+	db                                               *sql.DB
+	tx                                               *sql.Tx
+	stmtProcess, stmtTableuse, stmtLocks, stmtEvents *sql.Stmt
+	stmtEventsDaily, stmtProxy, stmtBroker           *sql.Stmt
+	stmtTypedEvents, stmtErrors, stmtAnomalies       *sql.Stmt
+	rows                                             int64
+	conflicts                                        int64 // Rows not inserted as their key already exists
+	err                                              error // First commit error, after which nothing is written
+	lowerCase                                        bool  // See casefold.go
+}
+
+// newPGWriter connects to the database specified by dsn, creates tables/views if required and starts a transaction
+func newPGWriter(logger *logrus.Logger, dsn string) (*pgWriter, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to PostgreSQL: %v", err)
+	}
+	w, err := openPGWriter(logger, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// openPGWriter creates tables/views in db if required and starts a transaction
+func openPGWriter(logger *logrus.Logger, db *sql.DB) (*pgWriter, error) {
+	if _, err := db.Exec(pgSchema()); err != nil {
+		return nil, fmt.Errorf("creating PostgreSQL schema: %v", err)
+	}
+	w := &pgWriter{logger: logger, db: db}
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// begin starts a transaction and prepares statements within it
+func (w *pgWriter) begin() error {
+	var err error
+	if w.tx, err = w.db.Begin(); err != nil {
+		return err
+	}
+	for _, s := range []struct {
+		stmt **sql.Stmt
+		sql  string
+	}{
+		{&w.stmtProcess, getProcessStatement()},
+		{&w.stmtTableuse, getTableUseStatement()},
+		{&w.stmtLocks, getSerializedLocksStatement()},
+		{&w.stmtEvents, getEventsStatement()},
+		{&w.stmtEventsDaily, getEventsDailyStatement("GREATEST")},
+		{&w.stmtProxy, getProxyStatement()},
+		{&w.stmtBroker, getBrokerStatement()},
+		{&w.stmtTypedEvents, getTypedEventsStatement()},
+		{&w.stmtErrors, getCmdErrorsStatement()},
+		{&w.stmtAnomalies, getAnomaliesStatement()},
+	} {
+		if *s.stmt, err = w.tx.Prepare(pgStatement(s.sql)); err != nil {
+			return fmt.Errorf("error preparing statement: %v", err)
+		}
+	}
+	return nil
+}
+
+func (w *pgWriter) commit() error {
+	w.rows = 0
+	return w.tx.Commit() // Also closes the statements prepared within it
+}
+
+// commitIfRequired commits and starts a new transaction once enough rows have been written
+func (w *pgWriter) commitIfRequired() error {
+	if w.rows < statementsPerTransaction {
+		return nil
+	}
+	if err := w.commit(); err != nil {
+		return fmt.Errorf("PostgreSQL commit error: %v", err)
+	}
+	if err := w.begin(); err != nil {
+		return fmt.Errorf("PostgreSQL: %v", err)
+	}
+	return nil
+}
+
+// written counts a row written, and commits if required. Once a commit fails nothing more is written.
+func (w *pgWriter) written() {
+	w.rows++
+	if w.err == nil {
+		w.err = w.commitIfRequired()
+	}
+}
+
+// exec inserts a row, counting it as a conflict if not inserted as its key already exists
+func (w *pgWriter) exec(stmt *sql.Stmt, vals []interface{}) error {
+	res, err := stmt.Exec(vals...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		w.conflicts++
+	}
+	return nil
+}
+
+func (w *pgWriter) writeCmd(cmd *p4dlog.Command) {
+	if w.err != nil {
+		return
+	}
+	if err := w.exec(w.stmtProcess, processValuesFunc(w.lowerCase)(cmd, pgDate)); err != nil {
+		w.logger.Errorf("PostgreSQL process insert: %v pid %d, lineNo %d, %s",
+			err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+	}
+	for _, tu := range cmdTableUses(cmd) {
+		w.rows++
+		if err := w.exec(w.stmtTableuse, tableUseValues(cmd, tu)); err != nil {
+			w.logger.Errorf("PostgreSQL tableuse insert: %v pid %d, lineNo %d, %s, %s, %s",
+				err, cmd.Pid, cmd.LineNo, cmd.GetKey(), string(cmd.Cmd), string(cmd.Args))
+		}
+	}
+	for _, l := range cmd.SerializedLocks {
+		w.rows++
+		if err := w.exec(w.stmtLocks, serializedLockValues(cmd, l)); err != nil {
+			w.logger.Errorf("PostgreSQL serializedLocks insert: %v pid %d, lineNo %d, %s, %s, %s",
+				err, cmd.Pid, cmd.LineNo, cmd.GetKey(), string(cmd.Cmd), string(cmd.Args))
+		}
+	}
+	for i := range cmd.Errors {
+		w.rows++
+		if err := w.exec(w.stmtErrors, cmdErrorValues(cmd, &cmd.Errors[i])); err != nil {
+			w.logger.Errorf("PostgreSQL cmdErrors insert: %v pid %d, lineNo %d, %s, %s, %s",
+				err, cmd.Pid, cmd.LineNo, cmd.GetKey(), string(cmd.Cmd), string(cmd.Args))
+		}
+	}
+	w.written()
+}
+
+func (w *pgWriter) writeEvent(evt *p4dlog.ServerEvent) {
+	if w.err != nil {
+		return
+	}
+	if err := w.exec(w.stmtEvents, eventValues(evt, pgDate)); err != nil {
+		w.logger.Errorf("PostgreSQL events insert: %v lineNo %d, %s",
+			err, evt.LineNo, dateStr(evt.EventTime))
+	}
+	w.written()
+}
+
+func (w *pgWriter) writeEventDay(d *p4dlog.ServerEventDay) {
+	if w.err != nil {
+		return
+	}
+	if _, err := w.stmtEventsDaily.Exec(eventDayValues(d, pgDate)...); err != nil { // An upsert
+		w.logger.Errorf("PostgreSQL eventsDaily insert: %v %s", err, dateStr(d.Day))
+	}
+	w.written()
+}
+
+func (w *pgWriter) writeProxy(evt *p4dlog.ProxyEvent) {
+	if w.err != nil {
+		return
+	}
+	if err := w.exec(w.stmtProxy, proxyValues(evt, pgDate)); err != nil {
+		w.logger.Errorf("PostgreSQL proxy insert: %v pid %d, lineNo %d, %s", err, evt.Pid, evt.LineNo, evt.Cmd)
+	}
+	w.written()
+}
+
+func (w *pgWriter) writeBroker(evt *p4dlog.BrokerEvent) {
+	if w.err != nil {
+		return
+	}
+	if err := w.exec(w.stmtBroker, brokerValues(evt, pgDate)); err != nil {
+		w.logger.Errorf("PostgreSQL broker insert: %v pid %d, lineNo %d, %s", err, evt.Pid, evt.LineNo, evt.Cmd)
+	}
+	w.written()
+}
+
+func (w *pgWriter) writeTypedEvent(evt *p4dlog.ServerEvent) {
+	if w.err != nil {
+		return
+	}
+	if err := w.exec(w.stmtTypedEvents, typedEventValues(evt, pgDate)); err != nil {
+		w.logger.Errorf("PostgreSQL serverEvents insert: %v lineNo %d, %s", err, evt.LineNo, evt.EventType)
+	}
+	w.written()
+}
+
+func (w *pgWriter) writeAnomaly(a *anomaly.Anomaly) {
+	if w.err != nil {
+		return
+	}
+	if err := w.exec(w.stmtAnomalies, anomalyValues(a, pgDate)); err != nil {
+		w.logger.Errorf("PostgreSQL anomalies insert: %v %s %s lineNo %d", err, a.Type, dateStr(a.Time), a.LineNo)
+	}
+	w.written()
+}
+
+// Close commits any outstanding rows and closes the connection, returning the first commit error
+func (w *pgWriter) Close() error {
+	err := w.err
+	if err == nil {
+		if err = w.commit(); err != nil {
+			err = fmt.Errorf("PostgreSQL commit error: %v", err)
+		}
+	}
+	if cerr := w.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package main
+
+// Progress reporting while parsing log files - either the traditional human readable line,
+// or JSON events (one per line) so that wrappers and web UIs can render progress without
+// having to parse free text.
+// When several files are parsed concurrently (--parallel) per-file progress lines would interleave, so
+// progress is aggregated across files and reported periodically as a single line (or a table of the files
+// in progress), together with a notification as each file completes.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/machinebox/progress"
+	"github.com/sirupsen/logrus"
+)
+
+// Values for --progress.format
+const (
+	progressFormatText = "text"
+	progressFormatJSON = "json"
+)
+
+// Interval between aggregated progress reports
+const aggregateProgressInterval = 10 * time.Second
+
+// progressEvent is written as a single line of JSON for each progress update. Aggregated events (across all files)
+// have no file, but the number of files completed.
+type progressEvent struct {
+	File          string  `json:"file,omitempty"`
+	Bytes         int64   `json:"bytes"`
+	TotalBytes    int64   `json:"totalBytes"`
+	Percent       float64 `json:"percent"`
+	ETA           string  `json:"eta,omitempty"`
+	RemainingSecs int64   `json:"remainingSecs"`
+	Cmds          int64   `json:"cmds"`
+	Done          bool    `json:"done"`
+	Files         int     `json:"files,omitempty"`
+	FilesDone     int     `json:"filesDone,omitempty"`
+}
+
+// fileProgress - progress of a single file when aggregating
+type fileProgress struct {
+	name    string
+	bytes   int64
+	total   int64
+	started time.Time
+	done    bool
+}
+
+// progressReporter outputs progress for each log file processed
+type progressReporter struct {
+	logger    *logrus.Logger
+	format    string
+	w         io.Writer
+	conn      net.Conn
+	cmds      int64 // Updated atomically as commands are processed
+	m         sync.Mutex
+	aggregate bool            // Set for concurrent files, see startAggregate()
+	table     bool            // Aggregated progress includes a line per file in progress
+	files     []*fileProgress // In order specified
+	fileMap   map[string]*fileProgress
+	filesDone int
+	started   time.Time
+}
+
+// newProgressReporter writes progress to stderr, or to the specified unix socket if set
+func newProgressReporter(logger *logrus.Logger, format, socket string) *progressReporter {
+	pr := &progressReporter{logger: logger, format: format, w: os.Stderr}
+	if socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			logger.Errorf("Failed to connect to progress socket %s, using stderr: %v", socket, err)
+		} else {
+			pr.conn = conn
+			pr.w = conn
+		}
+	}
+	return pr
+}
+
+// incCmds records that another command has been processed
+func (pr *progressReporter) incCmds() {
+	atomic.AddInt64(&pr.cmds, 1)
+}
+
+// opened records that processing of a file has started
+func (pr *progressReporter) opened(logfile string, fileSize int64) {
+	pr.m.Lock()
+	defer pr.m.Unlock()
+	if f := pr.fileMap[logfile]; f != nil {
+		f.started = time.Now()
+		f.total = fileSize
+	}
+}
+
+func (pr *progressReporter) report(logfile string, p progress.Progress, fileSize int64) {
+	pr.m.Lock()
+	defer pr.m.Unlock()
+	if pr.aggregate {
+		if f := pr.fileMap[logfile]; f != nil {
+			f.bytes = p.N()
+			f.total = fileSize
+		}
+		return
+	}
+	if pr.format == progressFormatJSON {
+		ev := progressEvent{
+			File:          logfile,
+			Bytes:         p.N(),
+			TotalBytes:    fileSize,
+			Percent:       p.Percent(),
+			RemainingSecs: int64(p.Remaining().Round(time.Second).Seconds()),
+			Cmds:          atomic.LoadInt64(&pr.cmds),
+		}
+		if !p.Estimated().IsZero() {
+			ev.ETA = p.Estimated().Format(time.RFC3339)
+		}
+		pr.writeJSON(ev)
+		return
+	}
+	fmt.Fprintf(pr.w, "%s: %s/%s %.0f%% estimated finish %s, %v remaining...\n",
+		logfile, byteCountDecimal(p.N()), byteCountDecimal(fileSize),
+		p.Percent(), p.Estimated().Format("15:04:05"),
+		p.Remaining().Round(time.Second))
+}
+
+func (pr *progressReporter) completed(logfile string, fileSize int64) {
+	pr.m.Lock()
+	defer pr.m.Unlock()
+	var f *fileProgress
+	if pr.aggregate {
+		if f = pr.fileMap[logfile]; f != nil && !f.done {
+			f.done = true
+			f.bytes = fileSize
+			f.total = fileSize
+			pr.filesDone++
+		}
+	}
+	if pr.format == progressFormatJSON {
+		ev := progressEvent{
+			File:       logfile,
+			Bytes:      fileSize,
+			TotalBytes: fileSize,
+			Percent:    100,
+			Cmds:       atomic.LoadInt64(&pr.cmds),
+			Done:       true,
+		}
+		if pr.aggregate {
+			ev.Files = len(pr.files)
+			ev.FilesDone = pr.filesDone
+		}
+		pr.writeJSON(ev)
+		return
+	}
+	if f != nil {
+		elapsed := time.Duration(0)
+		if !f.started.IsZero() {
+			elapsed = time.Since(f.started).Round(time.Second)
+		}
+		fmt.Fprintf(pr.w, "%s: processing completed, %s in %v (%d/%d files completed)\n",
+			logfile, byteCountDecimal(fileSize), elapsed, pr.filesDone, len(pr.files))
+		return
+	}
+	fmt.Fprintln(pr.w, "processing completed")
+}
+
+// startAggregate reports progress of files being processed concurrently every interval (until ctx is done or
+// all files have completed), instead of per-file progress lines
+func (pr *progressReporter) startAggregate(ctx context.Context, logfiles []string, interval time.Duration, table bool) {
+	pr.m.Lock()
+	pr.aggregate = true
+	pr.table = table
+	pr.started = time.Now()
+	pr.fileMap = make(map[string]*fileProgress, len(logfiles))
+	for _, name := range logfiles {
+		f := &fileProgress{name: name}
+		// Estimate until the file is opened
+		if fi, err := os.Stat(name); err == nil {
+			f.total = fi.Size()
+		}
+		pr.files = append(pr.files, f)
+		pr.fileMap[name] = f
+	}
+	pr.m.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !pr.reportAggregate() {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// reportAggregate outputs progress across all files, returning false once all have completed
+func (pr *progressReporter) reportAggregate() bool {
+	pr.m.Lock()
+	defer pr.m.Unlock()
+	if pr.filesDone == len(pr.files) {
+		return false
+	}
+	var bytes, total int64
+	var active []*fileProgress
+	for _, f := range pr.files {
+		bytes += f.bytes
+		total += f.total
+		if !f.done && !f.started.IsZero() {
+			active = append(active, f)
+		}
+	}
+	if bytes > total {
+		total = bytes
+	}
+	var percent float64
+	var remaining time.Duration
+	if total > 0 {
+		percent = float64(bytes) / float64(total) * 100
+	}
+	if bytes > 0 {
+		elapsed := time.Since(pr.started)
+		remaining = time.Duration(float64(elapsed) * float64(total-bytes) / float64(bytes))
+	}
+	cmds := atomic.LoadInt64(&pr.cmds)
+	if pr.format == progressFormatJSON {
+		ev := progressEvent{
+			Bytes:         bytes,
+			TotalBytes:    total,
+			Percent:       percent,
+			RemainingSecs: int64(remaining.Round(time.Second).Seconds()),
+			Cmds:          cmds,
+			Files:         len(pr.files),
+			FilesDone:     pr.filesDone,
+		}
+		if bytes > 0 {
+			ev.ETA = time.Now().Add(remaining).Format(time.RFC3339)
+		}
+		pr.writeJSON(ev)
+		return true
+	}
+	fmt.Fprintf(pr.w, "Progress: %d/%d files completed, %d in progress: %s/%s %.0f%% estimated finish %s, %v remaining...\n",
+		pr.filesDone, len(pr.files), len(active), byteCountDecimal(bytes), byteCountDecimal(total), percent,
+		time.Now().Add(remaining).Format("15:04:05"), remaining.Round(time.Second))
+	if pr.table {
+		for _, f := range active {
+			var p float64
+			if f.total > 0 {
+				p = float64(f.bytes) / float64(f.total) * 100
+			}
+			fmt.Fprintf(pr.w, "  %-30s %10s/%-10s %3.0f%%\n", filepath.Base(f.name),
+				byteCountDecimal(f.bytes), byteCountDecimal(f.total), p)
+		}
+	}
+	return true
+}
+
+func (pr *progressReporter) writeJSON(ev progressEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		pr.logger.Errorf("Failed to marshal progress: %v", err)
+		return
+	}
+	if _, err := fmt.Fprintf(pr.w, "%s\n", b); err != nil {
+		pr.logger.Errorf("Failed to write progress: %v", err)
+	}
+}
+
+// Close closes the progress socket if one was opened
+func (pr *progressReporter) Close() {
+	if pr.conn != nil {
+		pr.conn.Close()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+// Output of proxy (p4p) and broker (p4broker) log records to the proxy and broker tables - see p4dlog.ProxyEvent
+// and p4dlog.BrokerEvent. Written to SQLite, SQL and PostgreSQL output (Go schema only), but not Parquet.
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func getProxyStatement() string {
+	return `INSERT INTO proxy
+		(lineNumber, pid, startTime, user, workspace, ip, app, cmd, args, lapse,
+		filesServer, filesCache, bytesServer, bytesCache, serverID,
+		sourceFile, sourceLineNumber)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+}
+
+func getBrokerStatement() string {
+	return `INSERT INTO broker
+		(lineNumber, pid, startTime, user, workspace, ip, app, cmd, args,
+		action, target, serverID,
+		sourceFile, sourceLineNumber)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+}
+
+// proxyValues returns values for getProxyStatement()
+func proxyValues(evt *p4dlog.ProxyEvent, dateValue func(time.Time) interface{}) []interface{} {
+	return []interface{}{
+		evt.LineNo, evt.Pid, dateValue(evt.StartTime), evt.User, evt.Workspace, evt.IP, evt.App, evt.Cmd, evt.Args,
+		float64(evt.Lapse), evt.FilesServer, evt.FilesCache, evt.BytesServer, evt.BytesCache, evt.ServerID,
+		evt.SourceFile, evt.SourceLineNo}
+}
+
+// brokerValues returns values for getBrokerStatement()
+func brokerValues(evt *p4dlog.BrokerEvent, dateValue func(time.Time) interface{}) []interface{} {
+	return []interface{}{
+		evt.LineNo, evt.Pid, dateValue(evt.StartTime), evt.User, evt.Workspace, evt.IP, evt.App, evt.Cmd, evt.Args,
+		evt.Action, evt.Target, evt.ServerID,
+		evt.SourceFile, evt.SourceLineNo}
+}
+
+func preparedInsertProxy(logger *logrus.Logger, stmtProxy *sqlite3.Stmt, evt *p4dlog.ProxyEvent) int64 {
+	if err := stmtProxy.Exec(proxyValues(evt, sqliteDate)...); err != nil {
+		logger.Errorf("Proxy insert: %v pid %d, lineNo %d, %s", err, evt.Pid, evt.LineNo, evt.Cmd)
+	}
+	return 1
+}
+
+func preparedInsertBroker(logger *logrus.Logger, stmtBroker *sqlite3.Stmt, evt *p4dlog.BrokerEvent) int64 {
+	if err := stmtBroker.Exec(brokerValues(evt, sqliteDate)...); err != nil {
+		logger.Errorf("Broker insert: %v pid %d, lineNo %d, %s", err, evt.Pid, evt.LineNo, evt.Cmd)
+	}
+	return 1
+}
+
+func writeSQLProxy(f io.Writer, evt *p4dlog.ProxyEvent) int64 {
+	fmt.Fprintf(f, `INSERT INTO proxy VALUES (%d,%d,"%s","%s","%s","%s","%s","%s","%s",%0.3f,%d,%d,%d,%d,"%s","%s",%d);`+"\n",
+		evt.LineNo, evt.Pid, dateStr(evt.StartTime), evt.User, evt.Workspace, evt.IP, evt.App, evt.Cmd, evt.Args,
+		evt.Lapse, evt.FilesServer, evt.FilesCache, evt.BytesServer, evt.BytesCache, evt.ServerID,
+		evt.SourceFile, evt.SourceLineNo)
+	return 1
+}
+
+func writeSQLBroker(f io.Writer, evt *p4dlog.BrokerEvent) int64 {
+	fmt.Fprintf(f, `INSERT INTO broker VALUES (%d,%d,"%s","%s","%s","%s","%s","%s","%s","%s","%s","%s","%s",%d);`+"\n",
+		evt.LineNo, evt.Pid, dateStr(evt.StartTime), evt.User, evt.Workspace, evt.IP, evt.App, evt.Cmd, evt.Args,
+		evt.Action, evt.Target, evt.ServerID,
+		evt.SourceFile, evt.SourceLineNo)
+	return 1
+}
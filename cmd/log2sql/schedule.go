@@ -0,0 +1,72 @@
+package main
+
+// Periodic re-parsing of active logs - see --rerun.interval. For sites which can't tail the log (e.g. it is on an NFS
+// mount, without inotify support), log2sql re-runs itself every interval with the same arguments. Each run resumes from
+// the position saved in the --state.file, so only commands written to the log since the previous run are output, giving
+// near-real-time databases and metrics. Database inserts of commands already written (same processkey and lineNumber,
+// e.g. if a run is interrupted before the state is saved) are ignored unless --on.conflict is set.
+//
+// Each run is a separate process, so that memory used by one run is released before the next.
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Set in the environment of the runs started by the scheduler
+const scheduledRunEnv = "LOG2SQL_SCHEDULED_RUN"
+
+func isScheduledRun() bool {
+	return os.Getenv(scheduledRunEnv) != ""
+}
+
+// runEvery calls run straight away and then every interval (measured from the start of the previous run, so if a run
+// takes longer than interval the next starts when it finishes) until ctx is done. Errors are logged, not fatal, as the
+// next run may succeed, e.g. if the log was briefly unavailable.
+func runEvery(ctx context.Context, logger *logrus.Logger, interval time.Duration, run func(ctx context.Context) error) {
+	for {
+		start := time.Now()
+		if err := run(ctx); err != nil && ctx.Err() == nil {
+			logger.Errorf("Scheduled run failed: %v", err)
+		}
+		wait := time.NewTimer(time.Until(start.Add(interval)))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return
+		case <-wait.C:
+		}
+	}
+}
+
+// runScheduled re-runs this program with the same arguments every interval until interrupted
+func runScheduled(logger *logrus.Logger, interval time.Duration) {
+	exe, err := os.Executable()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Infof("Received %v, stopping after current run", sig)
+		cancel()
+	}()
+	logger.Infof("Re-running every %v until interrupted", interval)
+	runEvery(ctx, logger, interval, func(context.Context) error {
+		// Not CommandContext - a run in progress is not killed, so that it saves its state
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Env = append(os.Environ(), scheduledRunEnv+"=1")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	})
+}
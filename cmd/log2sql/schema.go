@@ -0,0 +1,159 @@
+package main
+
+// Process table column subsets for SQLite database output - see --schema. Most analysis only needs the core columns
+// (times, user, cmd, args, CPU, memory, errors etc), so groups of specialist columns may be omitted, speeding up
+// inserts and shrinking databases:
+//
+//	full     - all columns (default)
+//	standard - without the librarian columns (lbr*, 48 columns)
+//	minimal  - without the librarian, RPC (rpc*) and network sync estimate (netSync*) columns
+//
+// Subsets are derived from the full table definition (writeTables) and statement (getProcessStatement), so new
+// columns are included unless they are in an omitted group. Other tables are unchanged.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values for --schema
+const (
+	schemaFull     = "full"
+	schemaStandard = "standard"
+	schemaMinimal  = "minimal"
+)
+
+// Column name prefixes of the groups omitted by each schema
+var schemaOmitGroups = map[string][]string{
+	schemaStandard: {"lbr"},
+	schemaMinimal:  {"lbr", "rpc", "netSync"},
+}
+
+// processSchema - the process table columns written for a --schema. A nil *processSchema is the full schema.
+type processSchema struct {
+	omit    []string
+	columns []string // Of getProcessStatement()
+	keep    []bool   // Per column
+}
+
+// newProcessSchema returns the columns for schema, or nil for the full schema
+func newProcessSchema(schema string) *processSchema {
+	omit, ok := schemaOmitGroups[schema]
+	if !ok {
+		return nil
+	}
+	s := &processSchema{omit: omit}
+	m := reInsertCols.FindStringSubmatch(getProcessStatement())
+	for _, col := range strings.Split(m[2], ",") {
+		col = strings.TrimSpace(col)
+		s.columns = append(s.columns, col)
+		s.keep = append(s.keep, !s.omitted(col))
+	}
+	return s
+}
+
+func (s *processSchema) omitted(col string) bool {
+	for _, prefix := range s.omit {
+		if strings.HasPrefix(col, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// statement returns the insert statement for the columns kept
+func (s *processSchema) statement() string {
+	if s == nil {
+		return getProcessStatement()
+	}
+	cols := make([]string, 0, len(s.columns))
+	for i, col := range s.columns {
+		if s.keep[i] {
+			cols = append(cols, col)
+		}
+	}
+	return fmt.Sprintf("INSERT INTO process\n\t\t(%s)\n\t\tVALUES (%s)", strings.Join(cols, ", "),
+		strings.TrimSuffix(strings.Repeat("?,", len(cols)), ","))
+}
+
+// values returns those of vals (from processValues) for the columns kept
+func (s *processSchema) values(vals []interface{}) []interface{} {
+	if s == nil {
+		return vals
+	}
+	result := make([]interface{}, 0, len(vals))
+	for i, v := range vals {
+		if s.keep[i] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// filterColumns returns a line of the process table definition without omitted columns, and false if none are left.
+// Lines are of the form "col1 INT NULL, col2 INT NULL, -- comment".
+func (s *processSchema) filterColumns(line string) (string, bool) {
+	code, comment := line, ""
+	if i := strings.Index(line, "--"); i >= 0 {
+		code, comment = line[:i], line[i:]
+	}
+	kept := make([]string, 0)
+	dropped := false
+	for _, def := range strings.Split(code, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		if m := reDDLColumn.FindStringSubmatch(def); m != nil && s.omitted(m[1]) {
+			dropped = true
+			continue
+		}
+		kept = append(kept, def)
+	}
+	if !dropped {
+		return line, true
+	}
+	if len(kept) == 0 {
+		return "", false
+	}
+	result := "\t" + strings.Join(kept, ", ") + ","
+	if comment != "" {
+		result += " " + comment
+	}
+	return result, true
+}
+
+// ddl returns ddl (from writeHeader) with the definitions of omitted process columns (and comment lines preceding
+// them) removed
+func (s *processSchema) ddl(ddl string) string {
+	if s == nil {
+		return ddl
+	}
+	lines := strings.Split(ddl, "\n")
+	result := make([]string, 0, len(lines))
+	var comments []string // Comment lines, kept only if the following line is
+	inProcess := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "CREATE TABLE IF NOT EXISTS process ") {
+			inProcess = true
+		} else if inProcess && strings.Contains(line, "PRIMARY KEY") {
+			inProcess = false
+		}
+		if !inProcess {
+			result = append(result, comments...)
+			result = append(result, line)
+			comments = nil
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			comments = append(comments, line)
+			continue
+		}
+		if line, ok := s.filterColumns(line); ok {
+			result = append(result, comments...)
+			result = append(result, line)
+		}
+		comments = nil
+	}
+	return strings.Join(result, "\n")
+}
@@ -0,0 +1,153 @@
+package main
+
+// Output compatible with the schema created by the legacy log2sql.py script, so that existing
+// reports written against that database continue to work.
+// Differences from the native schema:
+//   - only the columns known to log2sql.py are created/populated (no lbr*, net*, mem* etc)
+//   - dates are written as "YYYY-MM-DD HH:MM:SS" rather than "YYYY/MM/DD HH:MM:SS"
+//   - error is NULL unless the command failed
+//   - no events table
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Values for --schema.compat
+const (
+	schemaCompatGo     = "go"
+	schemaCompatPython = "python"
+)
+
+func writeHeaderPython(f io.Writer) {
+	fmt.Fprintf(f, `CREATE TABLE IF NOT EXISTS process -- log2sql.py compatible process table
+	(processkey CHAR(50) NOT NULL, lineNumber INT NOT NULL, pid INT NOT NULL,
+	startTime DATETIME NOT NULL, endTime DATETIME NULL, computedLapse FLOAT NULL, completedLapse FLOAT NULL,
+	user TEXT NOT NULL, workspace TEXT NOT NULL, ip TEXT NOT NULL, app TEXT NOT NULL, cmd TEXT NOT NULL,
+	args TEXT NULL, uCpu INT NULL, sCpu INT NULL, diskIn INT NULL, diskOut INT NULL, ipcIn INT NULL,
+	ipcOut INT NULL, maxRss INT NULL, pageFaults INT NULL, rpcMsgsIn INT NULL, rpcMsgsOut INT NULL,
+	rpcSizeIn INT NULL, rpcSizeOut INT NULL, rpcHimarkFwd INT NULL, rpcHimarkRev INT NULL,
+	rpcSnd FLOAT NULL, rpcRcv FLOAT NULL, running INT NULL,
+	error TEXT NULL,
+	PRIMARY KEY (processkey, lineNumber));
+`)
+	fmt.Fprintf(f, `CREATE TABLE IF NOT EXISTS tableUse -- log2sql.py compatible tableUse table
+	(processkey CHAR(50) NOT NULL, lineNumber INT NOT NULL,
+	tableName VARCHAR(255) NOT NULL, pagesIn INT NULL, pagesOut INT NULL, pagesCached INT NULL,
+	readLocks INT NULL, writeLocks INT NULL, getRows INT NULL, posRows INT NULL, scanRows INT NULL,
+	putRows int NULL, delRows INT NULL, totalReadWait INT NULL, totalReadHeld INT NULL,
+	totalWriteWait INT NULL, totalWriteHeld INT NULL, maxReadWait INT NULL, maxReadHeld INT NULL,
+	maxWriteWait INT NULL, maxWriteHeld INT NULL, peekCount INT NULL,
+	totalPeekWait INT NULL, totalPeekHeld INT NULL, maxPeekWait INT NULL, maxPeekHeld INT NULL,
+	triggerLapse FLOAT NULL,
+	PRIMARY KEY (processkey, lineNumber, tableName));
+`)
+	fmt.Fprintf(f, "PRAGMA journal_mode = OFF;\nPRAGMA synchronous = OFF;\n")
+}
+
+// log2sql.py wrote dates with dashes rather than slashes
+func dateStrPython(t time.Time) string {
+	var blankTime time.Time
+	if t == blankTime {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// log2sql.py only set error when there was one
+func errorPython(cmd *p4dlog.Command) interface{} {
+	if cmd.CmdError {
+		return "true"
+	}
+	return nil
+}
+
+func getProcessStatementPython() string {
+	return `INSERT INTO process
+		(processkey, lineNumber, pid,
+		startTime, endTime, computedLapse, completedLapse,
+		user, workspace, ip, app, cmd,
+		args, uCpu, sCpu, diskIn, diskOut, ipcIn,
+		ipcOut, maxRss, pageFaults, rpcMsgsIn, rpcMsgsOut,
+		rpcSizeIn, rpcSizeOut, rpcHimarkFwd, rpcHimarkRev,
+		rpcSnd, rpcRcv, running, error)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+}
+
+func getTableUseStatementPython() string {
+	return `INSERT INTO tableuse
+		(processkey, lineNumber, tableName, pagesIn, pagesOut, pagesCached,
+		readLocks, writeLocks, getRows, posRows, scanRows,
+		putRows, delRows, totalReadWait, totalReadHeld,
+		totalWriteWait, totalWriteHeld, maxReadWait, maxReadHeld,
+		maxWriteWait, maxWriteHeld, peekCount,
+		totalPeekWait, totalPeekHeld, maxPeekWait, maxPeekHeld,
+		triggerLapse)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+}
+
+func preparedInsertPython(logger *logrus.Logger, stmtProcess, stmtTableuse *sqlite3.Stmt, cmd *p4dlog.Command) int64 {
+	rows := 1
+	err := stmtProcess.Exec(
+		cmd.GetKey(), cmd.LineNo, cmd.Pid, dateStrPython(cmd.StartTime), dateStrPython(cmd.EndTime),
+		float64(cmd.ComputeLapse), float64(cmd.CompletedLapse),
+		string(cmd.User), string(cmd.Workspace), string(cmd.IP), string(cmd.App), string(cmd.Cmd), string(cmd.Args),
+		cmd.UCpu, cmd.SCpu, cmd.DiskIn, cmd.DiskOut,
+		cmd.IpcIn, cmd.IpcOut, cmd.MaxRss, cmd.PageFaults, cmd.RPCMsgsIn, cmd.RPCMsgsOut,
+		cmd.RPCSizeIn, cmd.RPCSizeOut, cmd.RPCHimarkFwd, cmd.RPCHimarkRev,
+		float64(cmd.RPCSnd), float64(cmd.RPCRcv), cmd.Running,
+		errorPython(cmd))
+	if err != nil {
+		logger.Errorf("Process insert: %v pid %d, lineNo %d, %s",
+			err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
+	}
+	for _, t := range cmd.TablesWithLocks() { // Serialized locks as tables, as log2sql.py
+		rows++
+		err := stmtTableuse.Exec(
+			cmd.GetKey(), cmd.LineNo, t.TableName, t.PagesIn, t.PagesOut, t.PagesCached,
+			t.ReadLocks, t.WriteLocks, t.GetRows, t.PosRows, t.ScanRows, t.PutRows, t.DelRows,
+			t.TotalReadWait, t.TotalReadHeld, t.TotalWriteWait, t.TotalWriteHeld,
+			t.MaxReadWait, t.MaxReadHeld, t.MaxWriteWait, t.MaxWriteHeld, t.PeekCount,
+			t.TotalPeekWait, t.TotalPeekHeld, t.MaxPeekWait, t.MaxPeekHeld, float64(t.TriggerLapse))
+		if err != nil {
+			logger.Errorf("Tableuse insert: %v pid %d, lineNo %d, %s, %s, %s",
+				err, cmd.Pid, cmd.LineNo, cmd.GetKey(), string(cmd.Cmd), string(cmd.Args))
+		}
+	}
+	return int64(rows)
+}
+
+func writeSQLPython(f io.Writer, cmd *p4dlog.Command) int64 {
+	rows := 1
+	errStr := "NULL"
+	if cmd.CmdError {
+		errStr = `"true"`
+	}
+	fmt.Fprintf(f, `INSERT INTO process VALUES ("%s",%d,%d,"%s","%s",%0.3f,%0.3f,`+
+		`"%s","%s","%s","%s","%s","%s",%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,`+
+		`%.3f,%.3f,%d,%s);`+"\n",
+		cmd.GetKey(), cmd.LineNo, cmd.Pid, dateStrPython(cmd.StartTime), dateStrPython(cmd.EndTime),
+		cmd.ComputeLapse, cmd.CompletedLapse,
+		cmd.User, cmd.Workspace, cmd.IP, cmd.App, cmd.Cmd, cmd.Args,
+		cmd.UCpu, cmd.SCpu, cmd.DiskIn, cmd.DiskOut,
+		cmd.IpcIn, cmd.IpcOut, cmd.MaxRss, cmd.PageFaults, cmd.RPCMsgsIn, cmd.RPCMsgsOut,
+		cmd.RPCSizeIn, cmd.RPCSizeOut, cmd.RPCHimarkFwd, cmd.RPCHimarkRev,
+		cmd.RPCSnd, cmd.RPCRcv, cmd.Running, errStr)
+	for _, t := range cmd.TablesWithLocks() { // Serialized locks as tables, as log2sql.py
+		rows++
+		fmt.Fprintf(f, "INSERT INTO tableuse VALUES ("+
+			`"%s",%d,"%s",%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%.3f);`+"\n",
+			cmd.GetKey(), cmd.LineNo, t.TableName, t.PagesIn, t.PagesOut, t.PagesCached,
+			t.ReadLocks, t.WriteLocks, t.GetRows, t.PosRows, t.ScanRows, t.PutRows, t.DelRows,
+			t.TotalReadWait, t.TotalReadHeld, t.TotalWriteWait, t.TotalWriteHeld,
+			t.MaxReadWait, t.MaxReadHeld, t.MaxWriteWait, t.MaxWriteHeld, t.PeekCount,
+			t.TotalPeekWait, t.TotalPeekHeld, t.MaxPeekWait, t.MaxPeekHeld, t.TriggerLapse)
+	}
+	return int64(rows)
+}
@@ -0,0 +1,279 @@
+package main
+
+// log2sql selftest - parses a built-in synthetic log, verifies the results, and measures parsing and database
+// insert rates on this host, printing recommendations. Useful for diagnosing "it's slow on my box" reports.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/metrics"
+)
+
+// Rates below which recommendations are made - a modest modern server comfortably exceeds these
+const (
+	selfTestMinLinesPerSec  = 200 * 1000
+	selfTestMinRowsPerSec   = 50 * 1000
+	selfTestMaxMetricsRatio = 2.0 // Parse time with metrics compared to without
+)
+
+// selfTestLog returns a synthetic log of count commands, each with compute/completed records and track output for 2 tables
+func selfTestLog(count int) []string {
+	lines := make([]string, 0, count*22)
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		t := dateStr(start.Add(time.Duration(i/1000) * time.Second)) // Busy server - 1000 commands/sec
+		cmd := fmt.Sprintf("\t%s pid %d user%d@ws%d 10.0.%d.%d [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //depot/%d/...'",
+			t, 1000+i, i%100, i%500, (i/256)%256, i%256, i)
+		lines = append(lines,
+			"Perforce server info:", cmd,
+			"Perforce server info:", fmt.Sprintf("\t%s pid %d compute end .031s", t, 1000+i),
+			"Perforce server info:", fmt.Sprintf("\t%s pid %d completed .045s 8+1us 0+1408io 0+0net 4088k 0pf", t, 1000+i),
+			"Perforce server info:", cmd,
+			"--- lapse .045s",
+			"--- usage 10+11us 12+13io 14+15net 4088k 0pf",
+			"--- rpc msgs/size in+out 20+21/22mb+23mb himarks 318788/318789 snd/rcv .001s/.002s",
+			"--- db.have",
+			"---   pages in+out+cached 1+2+3",
+			"---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10",
+			"---   total lock wait+held read/write 12ms+13ms/14ms+15ms",
+			"---   max lock wait+held read/write 32ms+33ms/34ms+35ms",
+			"--- db.rev",
+			"---   pages in+out+cached 4+5+6",
+			"---   locks read/write 1/0 rows get+pos+scan put+del 1+0+0 0+0",
+			"---   total lock wait+held read/write 0ms+20ms/0ms+0ms",
+			"---   max lock wait+held read/write 0ms+20ms/0ms+0ms",
+			"")
+	}
+	return lines
+}
+
+// verifySelfTestCmd checks a parsed command against the values in selfTestLog
+func verifySelfTestCmd(cmd *p4dlog.Command) error {
+	if cmd.Cmd != "user-sync" || cmd.CompletedLapse != 0.045 || cmd.UCpu != 10 || cmd.RPCMsgsIn != 20 {
+		return fmt.Errorf("pid %d: unexpected command values: %s", cmd.Pid, cmd.String())
+	}
+	have, rev := cmd.Tables["have"], cmd.Tables["rev"]
+	if len(cmd.Tables) != 2 || have == nil || rev == nil || have.GetRows != 6 || have.MaxReadWait != 32 || rev.TotalReadHeld != 20 {
+		return fmt.Errorf("pid %d: unexpected table values: %s", cmd.Pid, cmd.String())
+	}
+	return nil
+}
+
+// selfTestParse parses lines, with or without metrics, verifying commands. Returns the commands and elapsed time.
+func selfTestParse(logger *logrus.Logger, lines []string, count int, withMetrics bool) ([]*p4dlog.Command, time.Duration, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	linesChan := make(chan string, 10000)
+	var cmdChan chan interface{}
+	startTime := time.Now()
+	if withMetrics {
+		mconfig := &metrics.Config{UpdateInterval: 10 * time.Second, OutputCmdsByUser: true, OutputCmdsByIP: true, CaseSensitiveServer: true}
+		mp := metrics.NewP4DMetricsLogParser(mconfig, &metrics.P4DMetricsVersion{}, logger, true)
+		var metricsChan chan string
+		cmdChan, metricsChan = mp.ProcessEvents(ctx, linesChan, true)
+		go func() {
+			for range metricsChan {
+			}
+		}()
+	} else {
+		fp := p4dlog.NewP4dFileParser(logger)
+		cmdChan = fp.LogParser(ctx, linesChan, make(chan time.Time)) // As for log2sql
+	}
+	go func() {
+		for _, line := range lines {
+			linesChan <- line
+		}
+		close(linesChan)
+	}()
+	cmds := make([]*p4dlog.Command, 0, count)
+	var err error
+	for c := range cmdChan {
+		if cmd, ok := c.(p4dlog.Command); ok {
+			if verr := verifySelfTestCmd(&cmd); verr != nil && err == nil {
+				err = verr
+			}
+			cmds = append(cmds, &cmd)
+		}
+	}
+	elapsed := time.Since(startTime)
+	if err == nil && len(cmds) != count {
+		err = fmt.Errorf("expected %d commands, parsed %d", count, len(cmds))
+	}
+	return cmds, elapsed, err
+}
+
+// selfTestDB inserts cmds into a new database in dir, verifying row counts. Returns rows inserted and elapsed time.
+func selfTestDB(logger *logrus.Logger, dir string, cmds []*p4dlog.Command) (int64, time.Duration, error) {
+	name := filepath.Join(dir, fmt.Sprintf("log2sql-selftest-%d.db", os.Getpid()))
+	defer os.Remove(name)
+	db, err := sqlite3.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	schema := new(strings.Builder)
+	writeHeader(schema)
+	if err = db.Exec(schema.String()); err != nil {
+		return 0, 0, err
+	}
+	stmtProcess, err := db.Prepare(getProcessStatement())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmtProcess.Close()
+	stmtTableuse, err := db.Prepare(getTableUseStatement())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmtTableuse.Close()
+	stmtLocks, err := db.Prepare(getSerializedLocksStatement())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmtLocks.Close()
+	stmtErrors, err := db.Prepare(getCmdErrorsStatement())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmtErrors.Close()
+
+	startTime := time.Now()
+	var rows, i int64
+	if err = db.Begin(); err != nil {
+		return 0, 0, err
+	}
+	for _, cmd := range cmds {
+		j := preparedInsert(logger, nil, stmtProcess, stmtTableuse, stmtLocks, stmtErrors, cmd)
+		rows += j
+		i += j
+		if i >= statementsPerTransaction {
+			if err = db.Commit(); err != nil {
+				return 0, 0, err
+			}
+			if err = db.Begin(); err != nil {
+				return 0, 0, err
+			}
+			i = 0
+		}
+	}
+	if err = db.Commit(); err != nil {
+		return 0, 0, err
+	}
+	elapsed := time.Since(startTime)
+
+	for table, expected := range map[string]int{"process": len(cmds), "tableUse": 2 * len(cmds)} {
+		stmt, err := db.Prepare("SELECT COUNT(*) FROM " + table)
+		if err != nil {
+			return 0, 0, err
+		}
+		var count int
+		if _, err = stmt.Step(); err == nil {
+			err = stmt.Scan(&count)
+		}
+		stmt.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+		if count != expected {
+			return 0, 0, fmt.Errorf("expected %d rows in %s, found %d", expected, table, count)
+		}
+	}
+	return rows, elapsed, nil
+}
+
+func perSec(count int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(count) / d.Seconds()
+}
+
+// runSelfTest implements "log2sql selftest [flags]" writing results to w - returns exit code
+func runSelfTest(w io.Writer, args []string) int {
+	app := kingpin.New("log2sql selftest", "Parses a built-in synthetic log, verifies the results, and measures parsing and database insert "+
+		"rates on this host, printing recommendations.")
+	app.HelpFlag.Short('h')
+	count := app.Flag("commands", "Number of commands in the synthetic log.").Default("20000").Int()
+	dir := app.Flag("dir", "Directory in which to create the test database - use the same filesystem as your real output.").
+		Default(os.TempDir()).String()
+	if _, err := app.Parse(args); err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return 2
+	}
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+
+	fmt.Fprintf(w, "log2sql selftest: %s %s/%s, %d CPUs (GOMAXPROCS %d)\n",
+		runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), runtime.GOMAXPROCS(0))
+	lines := selfTestLog(*count)
+	fmt.Fprintf(w, "Synthetic log: %d commands, %d lines\n", *count, len(lines))
+
+	failed := false
+	var recommendations []string
+	cmds, parseTime, err := selfTestParse(logger, lines, *count, false)
+	if err != nil {
+		fmt.Fprintf(w, "Parse:            FAILED: %v\n", err)
+		return 1
+	}
+	linesPerSec := perSec(int64(len(lines)), parseTime)
+	fmt.Fprintf(w, "Parse:            %d lines in %.2fs - %.0f lines/sec\n", len(lines), parseTime.Seconds(), linesPerSec)
+	if linesPerSec < selfTestMinLinesPerSec {
+		recommendations = append(recommendations, "Parsing is slow - check for other load on this host (log2sql uses 2-3 cores), "+
+			"or run log2sql on a less busy machine")
+	}
+
+	_, metricsTime, err := selfTestParse(logger, lines, *count, true)
+	if err != nil {
+		fmt.Fprintf(w, "Parse + metrics:  FAILED: %v\n", err)
+		failed = true
+	} else {
+		fmt.Fprintf(w, "Parse + metrics:  %d lines in %.2fs - %.0f lines/sec\n", len(lines), metricsTime.Seconds(),
+			perSec(int64(len(lines)), metricsTime))
+		if parseTime > 0 && metricsTime.Seconds()/parseTime.Seconds() > selfTestMaxMetricsRatio {
+			recommendations = append(recommendations, "Historical metrics add significant overhead - use --no.metrics if they are not required")
+		}
+	}
+
+	rows, dbTime, err := selfTestDB(logger, *dir, cmds)
+	if err != nil {
+		fmt.Fprintf(w, "Database inserts: FAILED: %v\n", err)
+		failed = true
+	} else {
+		rowsPerSec := perSec(rows, dbTime)
+		fmt.Fprintf(w, "Database inserts: %d rows in %.2fs - %.0f rows/sec (in %s)\n", rows, dbTime.Seconds(), rowsPerSec, *dir)
+		if rowsPerSec < selfTestMinRowsPerSec {
+			recommendations = append(recommendations, "Database inserts are slow - write the database to fast local disk (-d /local/path/logs.db) "+
+				"rather than network storage, or use -n with --parquet or --json")
+		}
+	}
+	if runtime.NumCPU() < 3 {
+		recommendations = append(recommendations, "Fewer than 3 CPUs - parsing, metrics and database output run concurrently, "+
+			"so consider --no.metrics or -n if their output is not required")
+	}
+
+	if len(recommendations) == 0 {
+		recommendations = append(recommendations, "None - performance is as expected")
+	}
+	fmt.Fprintf(w, "Recommendations:\n")
+	for _, r := range recommendations {
+		fmt.Fprintf(w, "  - %s\n", r)
+	}
+	if failed {
+		fmt.Fprintf(w, "FAILED\n")
+		return 1
+	}
+	fmt.Fprintf(w, "PASSED\n")
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+// Output of typed server events (e.g. server startup/shutdown, license warnings and db upgrades - those with
+// p4dlog.ServerEvent.EventType set) to the serverEvents table, rather than the events table of thread counts.
+// Written to SQLite, SQL and PostgreSQL output (Go schema only), but not Parquet.
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func getTypedEventsStatement() string {
+	return `INSERT INTO serverEvents
+		(lineNumber, eventTime, eventType, message, serverID,
+		sourceFile, sourceLineNumber)
+		VALUES (?,?,?,?,?,?,?)`
+}
+
+// typedEventValues returns values for getTypedEventsStatement()
+func typedEventValues(evt *p4dlog.ServerEvent, dateValue func(time.Time) interface{}) []interface{} {
+	return []interface{}{
+		evt.LineNo, dateValue(evt.EventTime), evt.EventType, evt.Message, evt.ServerID,
+		evt.SourceFile, evt.SourceLineNo}
+}
+
+func preparedInsertTypedEvent(logger *logrus.Logger, stmtTypedEvents *sqlite3.Stmt, evt *p4dlog.ServerEvent) int64 {
+	if err := stmtTypedEvents.Exec(typedEventValues(evt, sqliteDate)...); err != nil {
+		logger.Errorf("ServerEvents insert: %v lineNo %d, %s", err, evt.LineNo, evt.EventType)
+	}
+	return 1
+}
+
+func writeSQLTypedEvent(f io.Writer, evt *p4dlog.ServerEvent) int64 {
+	fmt.Fprintf(f, `INSERT INTO serverEvents VALUES (%d,"%s","%s","%s","%s","%s",%d);`+"\n",
+		evt.LineNo, dateStr(evt.EventTime), evt.EventType, evt.Message, evt.ServerID,
+		evt.SourceFile, evt.SourceLineNo)
+	return 1
+}
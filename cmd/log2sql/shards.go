@@ -0,0 +1,249 @@
+package main
+
+// SQLite database output, optionally split into one database per day or hour of log data - see --split.by. Records are
+// written to the database for their start time (event time for server events), e.g. logs-2024-06-10.db for a base
+// name of logs.db, so that analysis of long retention periods can use daily shards, and old shards can be deleted.
+// Without --split.by all records are written to the single database.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+// Values for --split.by
+const (
+	splitByNone = ""
+	splitByDay  = "day"
+	splitByHour = "hour"
+)
+
+// Max databases held open when split - logs are mostly in time order, so older shards are rarely written to again
+const maxOpenShards = 8
+
+// sqliteOptions - how databases are created and written
+type sqliteOptions struct {
+	pythonSchema bool           // --schema.compat=python
+	process      *processSchema // Subset of process table columns written (nil for all)
+	onConflict   string
+	wal          bool // Write-ahead logging rather than no journal
+	argsLimit    int  // Process args longer than this are truncated, with the complete args in argsBlob (0 for none)
+
+	lowerCase bool // Process user/workspace/app lower cased - see casefold.go
+}
+
+// sqliteDB - a database with its prepared statements, within a transaction
+type sqliteDB struct {
+	name                                                              string
+	conn                                                              *sqlite3.Conn
+	stmtProcess, stmtTableuse, stmtEvents, stmtEventsDaily, stmtLocks *sqlite3.Stmt
+	stmtProxy, stmtBroker, stmtTypedEvents, stmtErrors, stmtArgs      *sqlite3.Stmt
+	stmtAnomalies                                                     *sqlite3.Stmt
+	process                                                           *processSchema
+	argsLimit                                                         int
+	lowerCase                                                         bool
+	lastUsed                                                          int64
+
+	batchProcess, batchTableuse *insertBatch // Multi-row inserts, see insertCmd
+}
+
+// openSQLiteDB opens (creating if necessary) the database, creates the schema and prepares statements
+func openSQLiteDB(logger *logrus.Logger, name string, opts sqliteOptions) (*sqliteDB, error) {
+	conn, err := sqlite3.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	db := &sqliteDB{name: name, conn: conn, process: opts.process, argsLimit: opts.argsLimit,
+		lowerCase: opts.lowerCase}
+	stmt := new(bytes.Buffer)
+	if opts.pythonSchema {
+		writeHeaderPython(stmt)
+	} else {
+		writeHeader(stmt)
+	}
+	if opts.argsLimit > 0 {
+		writeArgsBlobTable(stmt)
+	}
+	compat := schemaCompatGo
+	if opts.pythonSchema {
+		compat = schemaCompatPython
+	}
+	writeSchemaVersion(stmt, compat)
+	if opts.wal {
+		// Readers (e.g. reports run while log2sql --rerun.interval is updating the database) don't block the writer
+		fmt.Fprintf(stmt, "PRAGMA journal_mode = WAL;\n")
+	}
+	ddl := opts.process.ddl(stmt.String())
+	if err = migrateSQLiteDB(logger, conn, name, ddl, compat); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = conn.Exec(ddl); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%q: %s", err, stmt)
+	}
+	processStatement, tableUseStatement := opts.process.statement(), getTableUseStatement()
+	if opts.pythonSchema {
+		processStatement, tableUseStatement = getProcessStatementPython(), getTableUseStatementPython()
+	}
+	onConflict := opts.onConflict
+	prepare := func(s string) *sqlite3.Stmt {
+		var st *sqlite3.Stmt
+		if err == nil {
+			if st, err = conn.Prepare(s); err != nil {
+				err = fmt.Errorf("error preparing statement: %v", err)
+			}
+		}
+		return st
+	}
+	db.stmtProcess = prepare(sqliteStatement(processStatement, onConflict))
+	db.stmtTableuse = prepare(sqliteStatement(tableUseStatement, onConflict))
+	if !opts.pythonSchema {
+		processBatch := batchStatement(processStatement, processBatchRows(opts.process))
+		tableUseBatch := batchStatement(tableUseStatement, tableUseBatchRows)
+		db.batchProcess = newInsertBatch("Process", db.stmtProcess, prepare(sqliteStatement(processBatch, onConflict)),
+			processBatchRows(opts.process))
+		db.batchTableuse = newInsertBatch("Tableuse", db.stmtTableuse, prepare(sqliteStatement(tableUseBatch, onConflict)),
+			tableUseBatchRows)
+		db.stmtEvents = prepare(sqliteStatement(getEventsStatement(), onConflict))
+		db.stmtLocks = prepare(sqliteStatement(getSerializedLocksStatement(), onConflict))
+		db.stmtErrors = prepare(sqliteStatement(getCmdErrorsStatement(), onConflict))
+		db.stmtEventsDaily = prepare(getEventsDailyStatement("MAX"))
+		db.stmtProxy = prepare(sqliteStatement(getProxyStatement(), onConflict))
+		db.stmtBroker = prepare(sqliteStatement(getBrokerStatement(), onConflict))
+		db.stmtTypedEvents = prepare(sqliteStatement(getTypedEventsStatement(), onConflict))
+		db.stmtAnomalies = prepare(sqliteStatement(getAnomaliesStatement(), onConflict))
+		if opts.argsLimit > 0 {
+			db.stmtArgs = prepare(sqliteStatement(getArgsBlobStatement(), onConflict))
+		}
+	}
+	if err == nil {
+		err = conn.Begin()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// commit the current transaction (after any batched inserts) and begin another
+func (db *sqliteDB) commit(logger *logrus.Logger) error {
+	db.flush(logger)
+	if err := db.conn.Commit(); err != nil {
+		return err
+	}
+	return db.conn.Begin()
+}
+
+// close commits the current transaction (after any batched inserts) and closes the database (statements must be
+// closed first)
+func (db *sqliteDB) close(logger *logrus.Logger) error {
+	db.flush(logger)
+	err := db.conn.Commit()
+	for _, stmt := range []*sqlite3.Stmt{db.stmtProcess, db.stmtTableuse, db.stmtEvents, db.stmtEventsDaily,
+		db.stmtLocks, db.stmtProxy, db.stmtBroker, db.stmtTypedEvents, db.stmtErrors, db.stmtArgs, db.stmtAnomalies} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	for _, b := range []*insertBatch{db.batchProcess, db.batchTableuse} {
+		if b != nil && b.batchStmt != nil {
+			b.batchStmt.Close()
+		}
+	}
+	if cerr := db.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// shardName returns the name of the database for time t, e.g. logs-2024-06-10.db, or name itself if not split
+func shardName(name, splitBy string, t time.Time) string {
+	format := ""
+	switch splitBy {
+	case splitByDay:
+		format = "2006-01-02"
+	case splitByHour:
+		format = "2006-01-02-15"
+	default:
+		return name
+	}
+	return fmt.Sprintf("%s-%s.db", strings.TrimSuffix(name, ".db"), t.Format(format))
+}
+
+// dbShards - the database(s) written to
+type dbShards struct {
+	logger  *logrus.Logger
+	name    string
+	splitBy string
+	opts    sqliteOptions
+	open    map[string]*sqliteDB
+	uses    int64
+}
+
+func newDBShards(logger *logrus.Logger, name, splitBy string, opts sqliteOptions) *dbShards {
+	return &dbShards{logger: logger, name: name, splitBy: splitBy, opts: opts, open: make(map[string]*sqliteDB)}
+}
+
+// get returns the database for records at time t, opening it (and closing the least recently used if too many are
+// open) if necessary. Failure to open a database is fatal.
+func (s *dbShards) get(t time.Time) *sqliteDB {
+	name := shardName(s.name, s.splitBy, t)
+	s.uses++
+	if db, ok := s.open[name]; ok {
+		db.lastUsed = s.uses
+		return db
+	}
+	if len(s.open) >= maxOpenShards {
+		var lru *sqliteDB
+		for _, db := range s.open {
+			if lru == nil || db.lastUsed < lru.lastUsed {
+				lru = db
+			}
+		}
+		if err := lru.close(s.logger); err != nil {
+			s.logger.Errorf("Error closing database %s: %v", lru.name, err)
+		}
+		delete(s.open, lru.name)
+	}
+	s.logger.Infof("Creating database: %s", name)
+	db, err := openSQLiteDB(s.logger, name, s.opts)
+	if err != nil {
+		s.logger.Fatal(err)
+	}
+	db.lastUsed = s.uses
+	s.open[name] = db
+	return db
+}
+
+// commit the transactions of all open databases
+func (s *dbShards) commit() {
+	for _, db := range s.open {
+		if err := db.commit(s.logger); err != nil {
+			s.logger.Errorf("commit error: %s: %v", db.name, err)
+		}
+	}
+}
+
+func (s *dbShards) close() {
+	for name, db := range s.open {
+		if err := db.close(s.logger); err != nil {
+			s.logger.Errorf("commit error: %s: %v", name, err)
+		}
+		delete(s.open, name)
+	}
+}
+
+// recordTime returns the time used to choose the database for a command - the end time if the start record was not
+// in the log
+func recordTime(start, end time.Time) time.Time {
+	if start.IsZero() {
+		return end
+	}
+	return start
+}
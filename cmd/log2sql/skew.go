@@ -0,0 +1,50 @@
+package main
+
+// Clock skew corrections per logfile - see --skew. The clocks of edge/replica and commit servers may be minutes apart,
+// so that commands in their logs can't be correlated (e.g. lock waits on the commit server with the edge commands
+// causing them). The times of commands and events from a logfile are adjusted by its skew before filtering and output.
+// Historical metrics for the logfile are also adjusted with --parallel, or if all logfiles have the same skew.
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// skews - keyed by logfile path or base name, as specified
+type skews map[string]time.Duration
+
+// parseSkews parses --skew values of <logfile>=<duration>, e.g. edge1.log=-2m30s
+func parseSkews(vals map[string]string) (skews, error) {
+	s := make(skews)
+	for f, v := range vals {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --skew for %s: %v", f, err)
+		}
+		s[f] = d
+	}
+	return s, nil
+}
+
+// lookup returns the skew for a logfile, matched by path or base name
+func (s skews) lookup(logfile string) time.Duration {
+	if d, ok := s[logfile]; ok {
+		return d
+	}
+	return s[filepath.Base(logfile)]
+}
+
+// common returns the skew of the logfiles if they all have the same skew, otherwise 0 - for historical metrics when
+// the logfiles are read by a single parser
+func (s skews) common(logfiles []string) time.Duration {
+	var d time.Duration
+	for i, f := range logfiles {
+		if i == 0 {
+			d = s.lookup(f)
+		} else if s.lookup(f) != d {
+			return 0
+		}
+	}
+	return d
+}
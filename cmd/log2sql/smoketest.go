@@ -0,0 +1,189 @@
+package main
+
+// log2sql --smoke.test - verifies a fresh install end-to-end by parsing a small bundled sample log (with metrics), writing
+// it to a temporary database, and printing expected vs actual counts. Unlike selftest (which measures performance) this
+// is quick, and is intended to be the first thing run after installing a release binary.
+// log2sql --print.example.config prints example Grafana provisioning for viewing the metrics in VictoriaMetrics.
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/metrics"
+)
+
+//go:embed smoketest/sample.log
+var smokeTestLog string
+
+//go:embed smoketest/example-config.yaml
+var exampleConfig string
+
+// smokeTestCounts - counts checked by the smoke test
+type smokeTestCounts struct {
+	commands          int64
+	serverEvents      int64
+	unrecognisedLines int64
+	processRows       int64
+	tableUseRows      int64
+	eventRows         int64
+	metricsCmds       int64 // Value of p4_prom_cmds_processed
+}
+
+// Expected counts for smoketest/sample.log - update if it is changed
+var smokeTestExpected = smokeTestCounts{
+	commands:          4,
+	serverEvents:      1,
+	unrecognisedLines: 0,
+	processRows:       4,
+	tableUseRows:      5,
+	eventRows:         1,
+	metricsCmds:       4,
+}
+
+func printExampleConfig(w io.Writer) {
+	fmt.Fprint(w, exampleConfig)
+}
+
+// smokeTestParse parses the sample log with metrics, returning commands and server events and setting parser counts
+func smokeTestParse(logger *logrus.Logger, actual *smokeTestCounts) ([]*p4dlog.Command, []*p4dlog.ServerEvent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	linesChan := make(chan string, 100)
+	mconfig := &metrics.Config{UpdateInterval: 10 * time.Second, OutputCmdsByUser: true, OutputCmdsByIP: true, CaseSensitiveServer: true}
+	mp := metrics.NewP4DMetricsLogParser(mconfig, &metrics.P4DMetricsVersion{}, logger, true)
+	cmdChan, metricsChan := mp.ProcessEvents(ctx, linesChan, true)
+	metricsDone := make(chan struct{})
+	go func() {
+		defer close(metricsDone)
+		for m := range metricsChan {
+			// Historical metrics are output in Graphite format, e.g. "p4_prom_cmds_processed 4 1704189600"
+			for _, line := range strings.Split(m, "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && fields[0] == "p4_prom_cmds_processed" {
+					actual.metricsCmds, _ = strconv.ParseInt(fields[1], 10, 64)
+				}
+			}
+		}
+	}()
+	go func() {
+		for _, line := range strings.Split(smokeTestLog, "\n") {
+			linesChan <- line
+		}
+		close(linesChan)
+	}()
+	cmds := make([]*p4dlog.Command, 0)
+	events := make([]*p4dlog.ServerEvent, 0)
+	for c := range cmdChan {
+		switch cmd := c.(type) {
+		case p4dlog.Command:
+			cmds = append(cmds, &cmd)
+		case p4dlog.ServerEvent:
+			events = append(events, &cmd)
+		}
+	}
+	<-metricsDone
+	actual.commands = int64(len(cmds))
+	actual.serverEvents = int64(len(events))
+	actual.unrecognisedLines = mp.Stats().UnrecognisedLines
+	return cmds, events
+}
+
+// smokeTestDB writes cmds and events to a new database in dir, setting counts of rows in each table
+func smokeTestDB(logger *logrus.Logger, dir string, cmds []*p4dlog.Command, events []*p4dlog.ServerEvent, actual *smokeTestCounts) error {
+	name := filepath.Join(dir, fmt.Sprintf("log2sql-smoketest-%d.db", os.Getpid()))
+	defer os.Remove(name)
+	db, err := sqlite3.Open(name)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	schema := new(strings.Builder)
+	writeHeader(schema)
+	if err = db.Exec(schema.String()); err != nil {
+		return err
+	}
+	stmts := make([]*sqlite3.Stmt, 0, 5)
+	for _, s := range []string{getProcessStatement(), getTableUseStatement(), getSerializedLocksStatement(), getEventsStatement(),
+		getCmdErrorsStatement()} {
+		stmt, err := db.Prepare(s)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		stmts = append(stmts, stmt)
+	}
+	for _, cmd := range cmds {
+		preparedInsert(logger, nil, stmts[0], stmts[1], stmts[2], stmts[4], cmd)
+	}
+	for _, evt := range events {
+		preparedInsertServerEvents(logger, stmts[3], evt)
+	}
+	for table, count := range map[string]*int64{"process": &actual.processRows, "tableUse": &actual.tableUseRows, "events": &actual.eventRows} {
+		stmt, err := db.Prepare("SELECT COUNT(*) FROM " + table)
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.Step(); err == nil {
+			err = stmt.Scan(count)
+		}
+		stmt.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSmokeTest implements "log2sql --smoke.test" writing results to w - returns exit code
+func runSmokeTest(w io.Writer, dir string) int {
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	lines := strings.Count(smokeTestLog, "\n")
+	fmt.Fprintf(w, "log2sql smoke test: bundled sample log of %d lines, database in %s\n", lines, dir)
+
+	var actual smokeTestCounts
+	cmds, events := smokeTestParse(logger, &actual)
+	if err := smokeTestDB(logger, dir, cmds, events, &actual); err != nil {
+		fmt.Fprintf(w, "Database: FAILED: %v\n", err)
+		return 1
+	}
+
+	failed := false
+	fmt.Fprintf(w, "%-30s %10s %10s\n", "Check", "Expected", "Actual")
+	for _, c := range []struct {
+		name             string
+		expected, actual int64
+	}{
+		{"Commands parsed", smokeTestExpected.commands, actual.commands},
+		{"Server events parsed", smokeTestExpected.serverEvents, actual.serverEvents},
+		{"Unrecognised lines", smokeTestExpected.unrecognisedLines, actual.unrecognisedLines},
+		{"Database process rows", smokeTestExpected.processRows, actual.processRows},
+		{"Database tableUse rows", smokeTestExpected.tableUseRows, actual.tableUseRows},
+		{"Database events rows", smokeTestExpected.eventRows, actual.eventRows},
+		{"Metrics p4_prom_cmds_processed", smokeTestExpected.metricsCmds, actual.metricsCmds},
+	} {
+		result := "OK"
+		if c.expected != c.actual {
+			result = "MISMATCH"
+			failed = true
+		}
+		fmt.Fprintf(w, "%-30s %10d %10d  %s\n", c.name, c.expected, c.actual, result)
+	}
+	if failed {
+		fmt.Fprintf(w, "FAILED\n")
+		return 1
+	}
+	fmt.Fprintf(w, "PASSED\n")
+	return 0
+}
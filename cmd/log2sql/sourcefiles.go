@@ -0,0 +1,82 @@
+package main
+
+// Line numbers assigned by the parser run on across logfiles read in sequence (one parser for all files), so when
+// several logfiles are loaded into one database, lineNumber alone does not identify the line. sourceFiles records
+// the range of line numbers read from each logfile so that commands and events can be tagged with their logfile
+// and the line number within it (sourceFile/sourceLineNumber columns). With --parallel each file has its own parser
+// so line numbers are already per file - unless several files have the same --file.server.id.
+
+import "sync"
+
+// sourceFile - range of parser line numbers read from a logfile
+type sourceFile struct {
+	name       string
+	firstLine  int64 // Parser line number of line 1 of the file (earlier if resumed part way through)
+	start, end int64 // Parser line numbers read [start, end) - end is 0 while the file is being read
+}
+
+type sourceFiles struct {
+	m        sync.RWMutex
+	files    []sourceFile
+	nextLine int64 // Parser line number of the next line to be read
+}
+
+// newSourceFiles - nextLine is the parser line number of the first line read (1 unless resumed from a checkpoint)
+func newSourceFiles(nextLine int64) *sourceFiles {
+	if nextLine < 1 {
+		nextLine = 1
+	}
+	return &sourceFiles{nextLine: nextLine}
+}
+
+// restore adds files read in a previous run (see --state.file), so that pending commands from them are found
+func (sf *sourceFiles) restore(files []logFileState) {
+	sf.m.Lock()
+	defer sf.m.Unlock()
+	for _, f := range files {
+		if f.FirstLineNo > 0 && f.Lines > 0 {
+			sf.files = append(sf.files, sourceFile{name: f.Name, firstLine: f.FirstLineNo,
+				start: f.FirstLineNo, end: f.FirstLineNo + f.Lines})
+		}
+	}
+}
+
+// start records that lines from the file follow those read so far, having already read linesRead lines of it
+// (when resumed from an offset). Returns the parser line number of line 1 of the file.
+func (sf *sourceFiles) start(name string, linesRead int64) int64 {
+	sf.m.Lock()
+	defer sf.m.Unlock()
+	f := sourceFile{name: name, firstLine: sf.nextLine - linesRead, start: sf.nextLine}
+	if linesRead > 0 {
+		// Resumed - the file may have been renamed (rotated) since the previous run
+		for i := range sf.files {
+			if sf.files[i].firstLine == f.firstLine {
+				sf.files[i].name = name
+			}
+		}
+	}
+	sf.files = append(sf.files, f)
+	return f.firstLine
+}
+
+// read records the count of lines read from the file being read
+func (sf *sourceFiles) read(lines int64) {
+	sf.m.Lock()
+	defer sf.m.Unlock()
+	sf.nextLine += lines
+	sf.files[len(sf.files)-1].end = sf.nextLine
+}
+
+// lookup returns the logfile and line number within it for a parser line number, or "" if not known
+func (sf *sourceFiles) lookup(lineNo int64) (string, int64) {
+	sf.m.RLock()
+	defer sf.m.RUnlock()
+	// Most recent first - the file being read, or one replaced since a previous run
+	for i := len(sf.files) - 1; i >= 0; i-- {
+		f := &sf.files[i]
+		if lineNo >= f.start && (f.end == 0 || lineNo < f.end) {
+			return f.name, lineNo - f.firstLine + 1
+		}
+	}
+	return "", 0
+}
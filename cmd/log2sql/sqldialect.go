@@ -0,0 +1,260 @@
+package main
+
+// SQL output dialects - see --sql.dialect. The default SQL output is for the sqlite3 command line (PRAGMAs, double
+// quoted strings, dates as 2006/01/02 15:04:05). The mysql and postgres dialects write a .sql file which may be loaded
+// directly with the mysql or psql clients:
+//
+//   - the schema uses the database's types (as for --pg.dsn), e.g. BIGINT since counts may exceed 32 bits
+//   - strings are single quoted (with backslashes escaped for MySQL), dates are YYYY-MM-DD HH:MM:SS and blank
+//     dates are NULL
+//   - session settings replace the PRAGMAs, and transactions are started with the database's syntax
+//   - duplicate rows are ignored rather than aborting the load (INSERT IGNORE / ON CONFLICT DO NOTHING), and the
+//     eventsDaily upsert keeps the larger of existing and new values as for SQLite
+//
+// Only the Go schema is supported.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/anomaly"
+)
+
+// Values for --sql.dialect
+const (
+	sqlDialectSQLite   = "sqlite"
+	sqlDialectMySQL    = "mysql"
+	sqlDialectPostgres = "postgres"
+)
+
+// Latency (secs) between two timestamps in the submitLatency view
+const mysqlLatency = "TIMESTAMPDIFF(SECOND, s.startTime, c.endTime)"
+
+var reServerIDKey = regexp.MustCompile(`\bserverID TEXT NOT NULL`) // Part of primary keys - MySQL can't index TEXT
+
+// mysqlSchema returns the Go schema converted to MySQL types
+func mysqlSchema() string {
+	buf := new(bytes.Buffer)
+	writeTables(buf)
+	s := buf.String()
+	s = reSQLiteFloat.ReplaceAllString(s, "DOUBLE")
+	s = reSQLiteInt.ReplaceAllString(s, "BIGINT")
+	s = reServerIDKey.ReplaceAllString(s, "serverID VARCHAR(255) NOT NULL")
+	buf.Reset()
+	buf.WriteString(s)
+	writeViews(buf, "CREATE OR REPLACE VIEW", mysqlLatency)
+	// || is logical OR in MySQL
+	return strings.Replace(buf.String(), "name || '_' || mode", "CONCAT(name, '_', mode)", 1)
+}
+
+// getEventsDailyStatementMySQL is getEventsDailyStatement() for MySQL, which has no ON CONFLICT clause
+func getEventsDailyStatementMySQL() string {
+	return `INSERT INTO eventsDaily
+		(day, activeThreadsMax, pausedThreadsMax)
+		VALUES (?,?,?)
+		ON DUPLICATE KEY UPDATE
+		activeThreadsMax = GREATEST(activeThreadsMax, VALUES(activeThreadsMax)),
+		pausedThreadsMax = GREATEST(pausedThreadsMax, VALUES(pausedThreadsMax))`
+}
+
+// sqlTextDate formats dates for MySQL and PostgreSQL
+func sqlTextDate(t time.Time) interface{} {
+	var blankTime time.Time
+	if t == blankTime {
+		return nil
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// sqlTemplate - an insert statement on one line, split at its placeholders
+type sqlTemplate []string
+
+func newSQLTemplate(stmt string) sqlTemplate {
+	return strings.Split(strings.Join(strings.Fields(stmt), " "), "?")
+}
+
+// sqlWriter writes SQL statements for a dialect - the sqlite dialect is as written by writeSQL() etc.
+type sqlWriter struct {
+	f                                             io.Writer
+	dialect                                       string
+	process, tableUse, locks, events, eventsDaily sqlTemplate
+	typedEvents, proxy, broker, cmdErrors         sqlTemplate
+	anomalies                                     sqlTemplate
+	lowerCase                                     bool // See casefold.go
+}
+
+func newSQLWriter(f io.Writer, dialect string) *sqlWriter {
+	w := &sqlWriter{f: f, dialect: dialect}
+	if dialect == sqlDialectSQLite {
+		return w
+	}
+	eventsDaily := getEventsDailyStatement("GREATEST")
+	if dialect == sqlDialectMySQL {
+		eventsDaily = getEventsDailyStatementMySQL()
+	}
+	for _, t := range []struct {
+		tmpl *sqlTemplate
+		stmt string
+	}{
+		{&w.process, getProcessStatement()},
+		{&w.tableUse, getTableUseStatement()},
+		{&w.locks, getSerializedLocksStatement()},
+		{&w.events, getEventsStatement()},
+		{&w.eventsDaily, eventsDaily},
+		{&w.typedEvents, getTypedEventsStatement()},
+		{&w.proxy, getProxyStatement()},
+		{&w.broker, getBrokerStatement()},
+		{&w.cmdErrors, getCmdErrorsStatement()},
+		{&w.anomalies, getAnomaliesStatement()},
+	} {
+		*t.tmpl = newSQLTemplate(w.statement(t.stmt))
+	}
+	return w
+}
+
+// statement converts an insert statement to the dialect, ignoring duplicate rows unless it is an upsert
+func (w *sqlWriter) statement(stmt string) string {
+	upsert := strings.Contains(stmt, "ON CONFLICT") || strings.Contains(stmt, "ON DUPLICATE KEY")
+	switch w.dialect {
+	case sqlDialectPostgres:
+		stmt = pgIdentifiers(stmt)
+		if !upsert {
+			stmt += " ON CONFLICT DO NOTHING"
+		}
+	case sqlDialectMySQL:
+		if !upsert {
+			stmt = strings.Replace(stmt, "INSERT INTO", "INSERT IGNORE INTO", 1)
+		}
+	}
+	return stmt
+}
+
+// literal formats a value for the dialect
+func (w *sqlWriter) literal(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	case string:
+		if w.dialect == sqlDialectMySQL {
+			v = strings.ReplaceAll(v, `\`, `\\`)
+		}
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	}
+	return w.literal(fmt.Sprint(v))
+}
+
+// insert writes a statement with the values substituted for its placeholders
+func (w *sqlWriter) insert(tmpl sqlTemplate, vals []interface{}) int64 {
+	var b strings.Builder
+	for i, s := range tmpl {
+		b.WriteString(s)
+		if i < len(vals) {
+			b.WriteString(w.literal(vals[i]))
+		}
+	}
+	b.WriteString(";\n")
+	io.WriteString(w.f, b.String())
+	return 1
+}
+
+// header writes the schema and session settings
+func (w *sqlWriter) header() {
+	switch w.dialect {
+	case sqlDialectMySQL:
+		fmt.Fprintf(w.f, "SET NAMES utf8mb4;\nSET unique_checks = 0;\n%s", mysqlSchema())
+	case sqlDialectPostgres:
+		// As for the SQLite PRAGMAs, trade security for speed
+		fmt.Fprintf(w.f, "SET client_encoding = 'UTF8';\nSET synchronous_commit = off;\n%s", pgSchema())
+	default:
+		writeHeader(w.f)
+	}
+}
+
+func (w *sqlWriter) begin() {
+	switch w.dialect {
+	case sqlDialectMySQL:
+		fmt.Fprintf(w.f, "START TRANSACTION;\n")
+	case sqlDialectPostgres:
+		fmt.Fprintf(w.f, "BEGIN;\n")
+	default:
+		startTransaction(w.f)
+	}
+}
+
+func (w *sqlWriter) commit() {
+	fmt.Fprintf(w.f, "COMMIT;\n")
+}
+
+func (w *sqlWriter) writeCmd(cmd *p4dlog.Command) int64 {
+	if w.dialect == sqlDialectSQLite {
+		if w.lowerCase {
+			return writeSQLCaseFolded(w.f, cmd)
+		}
+		return writeSQL(w.f, cmd)
+	}
+	rows := w.insert(w.process, processValuesFunc(w.lowerCase)(cmd, sqlTextDate))
+	for _, tu := range cmdTableUses(cmd) {
+		rows += w.insert(w.tableUse, tableUseValues(cmd, tu))
+	}
+	for _, l := range cmd.SerializedLocks {
+		rows += w.insert(w.locks, serializedLockValues(cmd, l))
+	}
+	for i := range cmd.Errors {
+		rows += w.insert(w.cmdErrors, cmdErrorValues(cmd, &cmd.Errors[i]))
+	}
+	return rows
+}
+
+func (w *sqlWriter) writeServerEvent(evt *p4dlog.ServerEvent) int64 {
+	if w.dialect == sqlDialectSQLite {
+		return writeSQLServerEvents(w.f, evt)
+	}
+	return w.insert(w.events, eventValues(evt, sqlTextDate))
+}
+
+func (w *sqlWriter) writeTypedEvent(evt *p4dlog.ServerEvent) int64 {
+	if w.dialect == sqlDialectSQLite {
+		return writeSQLTypedEvent(w.f, evt)
+	}
+	return w.insert(w.typedEvents, typedEventValues(evt, sqlTextDate))
+}
+
+func (w *sqlWriter) writeAnomaly(a *anomaly.Anomaly) int64 {
+	if w.dialect == sqlDialectSQLite {
+		return writeSQLAnomaly(w.f, a)
+	}
+	return w.insert(w.anomalies, anomalyValues(a, sqlTextDate))
+}
+
+func (w *sqlWriter) writeEventDay(d *p4dlog.ServerEventDay) int64 {
+	if w.dialect == sqlDialectSQLite {
+		return writeSQLEventDay(w.f, d)
+	}
+	return w.insert(w.eventsDaily, eventDayValues(d, sqlTextDate))
+}
+
+func (w *sqlWriter) writeProxy(evt *p4dlog.ProxyEvent) int64 {
+	if w.dialect == sqlDialectSQLite {
+		return writeSQLProxy(w.f, evt)
+	}
+	return w.insert(w.proxy, proxyValues(evt, sqlTextDate))
+}
+
+func (w *sqlWriter) writeBroker(evt *p4dlog.BrokerEvent) int64 {
+	if w.dialect == sqlDialectSQLite {
+		return writeSQLBroker(w.f, evt)
+	}
+	return w.insert(w.broker, brokerValues(evt, sqlTextDate))
+}
@@ -0,0 +1,144 @@
+package main
+
+// Rendering of simple SVG line charts of series over time - standalone, so they can be viewed directly or embedded
+// in the HTML report without any external JavaScript.
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	marginLeft   = 60
+	marginRight  = 20
+	marginTop    = 30
+	marginBottom = 40
+	yGridLines   = 5
+)
+
+// Colours of lines, by index in series values
+var lineColours = []string{"#1f77b4", "#ff7f0e", "#d62728", "#2ca02c"}
+
+// chart - a line chart of points with one line per value
+type chart struct {
+	title  string
+	yLabel string
+	lines  []string // Legend names of values
+	points []seriesPoint
+	width  int
+	height int
+}
+
+// niceMax returns a round number >= max for the top of the y axis
+func niceMax(max float64) float64 {
+	if max <= 0 {
+		return 1
+	}
+	mag := math.Pow(10, math.Floor(math.Log10(max)))
+	for _, m := range []float64{1, 2, 2.5, 5, 10} {
+		if m*mag >= max {
+			return m * mag
+		}
+	}
+	return 10 * mag
+}
+
+// tickStep returns the interval between x axis ticks - whole hours, with no more than about 24 ticks
+func tickStep(span time.Duration) time.Duration {
+	for _, h := range []int{1, 2, 3, 6, 12, 24} {
+		if span/(time.Duration(h)*time.Hour) <= 24 {
+			return time.Duration(h) * time.Hour
+		}
+	}
+	return 24 * time.Hour * time.Duration(span/(24*24*time.Hour)+1)
+}
+
+func formatValue(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// writeSVG writes the chart as an SVG document
+func (c *chart) writeSVG(w io.Writer) error {
+	var b strings.Builder
+	plotW := float64(c.width - marginLeft - marginRight)
+	plotH := float64(c.height - marginTop - marginBottom)
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		c.width, c.height, c.width, c.height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="white"/>`+"\n", c.width, c.height)
+	fmt.Fprintf(&b, `<text x="%d" y="18" font-size="14" font-weight="bold">%s</text>`+"\n", marginLeft, html.EscapeString(c.title))
+	if len(c.points) == 0 {
+		fmt.Fprintf(&b, `<text x="%d" y="%d">No commands</text>`+"\n", marginLeft, marginTop+20)
+		b.WriteString("</svg>\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	maxY := 0.0
+	for _, p := range c.points {
+		for _, v := range p.Values {
+			maxY = math.Max(maxY, v)
+		}
+	}
+	maxY = niceMax(maxY)
+	start := c.points[0].Time
+	span := c.points[len(c.points)-1].Time.Sub(start)
+	if span <= 0 {
+		span = time.Minute
+	}
+	x := func(t time.Time) float64 {
+		return marginLeft + plotW*float64(t.Sub(start))/float64(span)
+	}
+	y := func(v float64) float64 {
+		return marginTop + plotH*(1-v/maxY)
+	}
+
+	// Y gridlines and labels
+	for i := 0; i <= yGridLines; i++ {
+		v := maxY * float64(i) / yGridLines
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", marginLeft, y(v), marginLeft+plotW, y(v))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n", marginLeft-5, y(v)+4, formatValue(v))
+	}
+	fmt.Fprintf(&b, `<text x="12" y="%.1f" transform="rotate(-90 12 %.1f)" text-anchor="middle">%s</text>`+"\n",
+		marginTop+plotH/2, marginTop+plotH/2, html.EscapeString(c.yLabel))
+
+	// X ticks on the hour
+	step := tickStep(span)
+	end := c.points[len(c.points)-1].Time
+	for t := start.Truncate(step); !t.After(end); t = t.Add(step) {
+		if t.Before(start) {
+			continue
+		}
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", x(t), marginTop, x(t), marginTop+plotH)
+		label := t.Format("15:04")
+		if t.Hour() == 0 || t.Equal(start.Truncate(step)) {
+			label = t.Format("01/02 15:04")
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", x(t), marginTop+plotH+15, label)
+	}
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="none" stroke="#888"/>`+"\n", marginLeft, marginTop, plotW, plotH)
+
+	// Lines and legend
+	for i, name := range c.lines {
+		colour := lineColours[i%len(lineColours)]
+		pts := make([]string, 0, len(c.points))
+		for _, p := range c.points {
+			pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(p.Time), y(p.Values[i])))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`+"\n", colour, strings.Join(pts, " "))
+		if len(c.lines) > 1 {
+			lx := float64(c.width-marginRight) - float64(len(c.lines)-i)*70
+			fmt.Fprintf(&b, `<rect x="%.1f" y="8" width="10" height="10" fill="%s"/>`+"\n", lx, colour)
+			fmt.Fprintf(&b, `<text x="%.1f" y="17">%s</text>`+"\n", lx+14, html.EscapeString(name))
+		}
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
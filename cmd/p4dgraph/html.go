@@ -0,0 +1,79 @@
+package main
+
+// The HTML report - a single file with the charts embedded as inline SVG, so it can be opened locally or mailed
+// around without a web server or any external JavaScript (unlike the p4locks page, which uses Google Charts).
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+const reportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>p4d load: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+td { padding: 2px 12px 2px 0; }
+div.chart { margin-bottom: 20px; }
+</style>
+</head>
+<body>
+<h2>p4d load: {{.Title}}</h2>
+<table>
+<tr><td>Log files</td><td>{{.Logfiles}}</td></tr>
+<tr><td>Commands</td><td>{{.Commands}}</td></tr>
+<tr><td>Time range</td><td>{{.Start}} - {{.End}}</td></tr>
+<tr><td>Peak running commands</td><td>{{.PeakRunning}} at {{.PeakRunningTime}}</td></tr>
+<tr><td>Peak arrivals per minute</td><td>{{.PeakArrivals}} at {{.PeakArrivalsTime}}</td></tr>
+</table>
+{{range .Charts}}<div class="chart">
+{{.}}</div>
+{{end}}</body>
+</html>
+`
+
+// reportData - values for reportTemplate
+type reportData struct {
+	Title            string
+	Logfiles         string
+	Commands         int64
+	Start, End       string
+	PeakRunning      string
+	PeakRunningTime  string
+	PeakArrivals     string
+	PeakArrivalsTime string
+	Charts           []template.HTML
+}
+
+const reportTimeFormat = "2006/01/02 15:04:05"
+
+// writeHTML writes the report of charts
+func writeHTML(w io.Writer, title string, logfiles []string, s *loadSeries, charts []*chart) error {
+	data := reportData{Title: title, Logfiles: strings.Join(logfiles, ", "), Commands: s.count}
+	if s.count > 0 {
+		data.Start = time.Unix(s.first, 0).UTC().Format(reportTimeFormat)
+		data.End = time.Unix(s.last, 0).UTC().Format(reportTimeFormat)
+	}
+	if p, ok := peak(s.concurrency()); ok {
+		data.PeakRunning = formatValue(p.Values[0])
+		data.PeakRunningTime = p.Time.Format(reportTimeFormat)
+	}
+	if p, ok := peak(s.arrivalsPerMinute()); ok {
+		data.PeakArrivals = formatValue(p.Values[0])
+		data.PeakArrivalsTime = p.Time.Format(reportTimeFormat)
+	}
+	for _, c := range charts {
+		var b bytes.Buffer
+		if err := c.writeSVG(&b); err != nil {
+			return err
+		}
+		data.Charts = append(data.Charts, template.HTML(b.String())) // Generated by us with text escaped
+	}
+	return template.Must(template.New("report").Parse(reportTemplate)).Execute(w, data)
+}
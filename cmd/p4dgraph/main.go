@@ -0,0 +1,224 @@
+package main
+
+// p4dgraph - charts of p4d server load from p4d logs: the number of commands running concurrently, command arrivals
+// per minute, and percentiles of command lapse over time. Written as a single standalone HTML file (and optionally
+// separate SVG files) for load analysis without needing a metrics stack such as Prometheus/Grafana.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/perforce/p4prometheus/version"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logreader"
+)
+
+// parseLog parses a logfile ("-" for stdin), adding commands matching cmdRegex (if set) to s
+func parseLog(logger *logrus.Logger, opts []p4dlog.Option, logfile string, cmdRegex *regexp.Regexp, s *loadSeries) error {
+	fp, err := p4dlog.NewParser(opts...)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cmdChan <-chan interface{}
+	if logfile == "-" {
+		cmdChan, err = fp.ParseReader(ctx, os.Stdin)
+	} else {
+		cmdChan, err = fp.ParseFile(ctx, logfile)
+	}
+	if err != nil {
+		return err
+	}
+	for c := range cmdChan {
+		if cmd, ok := c.(p4dlog.Command); ok {
+			if cmdRegex != nil && !cmdRegex.MatchString(cmd.Cmd) {
+				continue
+			}
+			s.add(&cmd)
+		}
+	}
+	if err := fp.ReadErr(); err != nil {
+		return fmt.Errorf("%s: %v", logfile, err)
+	}
+	logger.Debugf("Parsed %s: %s", logfile, fp.Stats())
+	return nil
+}
+
+// namedChart - a chart with the name of its file for --svg.dir
+type namedChart struct {
+	name  string
+	chart *chart
+}
+
+func buildCharts(s *loadSeries, width, height int) []namedChart {
+	lapseNames := make([]string, 0, len(lapsePercentiles))
+	for _, pc := range lapsePercentiles {
+		lapseNames = append(lapseNames, fmt.Sprintf("p%.0f", pc))
+	}
+	return []namedChart{
+		{"concurrency", &chart{title: fmt.Sprintf("Running commands (max per %v)", s.interval), yLabel: "commands",
+			lines: []string{"running"}, points: s.concurrency(), width: width, height: height}},
+		{"arrivals", &chart{title: fmt.Sprintf("Command arrivals per minute (per %v)", s.interval), yLabel: "commands/min",
+			lines: []string{"arrivals"}, points: s.arrivalsPerMinute(), width: width, height: height}},
+		{"lapse", &chart{title: fmt.Sprintf("Completed lapse percentiles (commands starting per %v)", s.lapseInterval),
+			yLabel: "seconds", lines: lapseNames, points: s.lapsePercentiles(), width: width, height: height}},
+	}
+}
+
+func writeSVGFiles(dir string, charts []namedChart) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, c := range charts {
+		f, err := os.Create(filepath.Join(dir, c.name+".svg"))
+		if err != nil {
+			return err
+		}
+		if err := c.chart.writeSVG(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFilename returns the output name, defaulting to one based on the first logfile
+func getFilename(name string, logfiles []string) string {
+	if name != "" {
+		return name
+	}
+	if len(logfiles) == 0 || logfiles[0] == "-" {
+		return "p4dgraph.html"
+	}
+	return strings.TrimSuffix(logreader.TrimSuffix(logfiles[0]), ".log") + ".html"
+}
+
+func main() {
+	var (
+		logfiles = kingpin.Arg(
+			"logfile",
+			"Log files to process (may be gzip, zstd or bzip2 compressed), or - for stdin.").Required().Strings()
+		debug = kingpin.Flag(
+			"debug",
+			"Enable debugging level.",
+		).Int()
+		outputFile = kingpin.Flag(
+			"output",
+			"Name of HTML file to write (- for stdout). Defaults to name of first logfile with .html suffix.",
+		).Short('o').String()
+		svgDir = kingpin.Flag(
+			"svg.dir",
+			"Directory in which to also write each chart as a separate SVG file (concurrency.svg, arrivals.svg, lapse.svg).",
+		).String()
+		interval = kingpin.Flag(
+			"interval",
+			"Interval over which running commands (max) and arrivals are charted.",
+		).Default("1m").Duration()
+		lapseInterval = kingpin.Flag(
+			"lapse.interval",
+			"Interval of command start times over which lapse percentiles are calculated.",
+		).Default("10m").Duration()
+		cmdFilter = kingpin.Flag(
+			"cmd",
+			"Specify a (golang) regex to match commands to chart (e.g. 'user-(sync|submit)'). No default.",
+		).String()
+		width = kingpin.Flag(
+			"width",
+			"Width of charts in pixels.",
+		).Default("1200").Int()
+		height = kingpin.Flag(
+			"height",
+			"Height of charts in pixels.",
+		).Default("300").Int()
+		noCompletionRecords = kingpin.Flag(
+			"no.completion.records",
+			"Set if logs were generated with server=1 and thus no completion records expected.",
+		).Bool()
+	)
+	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("p4dgraph")).Author("Robert Cowham")
+	kingpin.CommandLine.Help = `Parses one or more p4d text log files (which may be gzip, zstd or bzip2 compressed) and writes a standalone HTML
+file with charts of commands running concurrently, command arrivals per minute and lapse percentiles over time.
+
+Usage examples:
+
+	p4dgraph log
+	p4dgraph -o load.html --interval 5m --lapse.interval 1h log-2024-*.gz
+	p4dgraph --cmd 'user-(sync|submit)' --svg.dir charts log
+`
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	if *debug > 0 {
+		logger.Level = logrus.DebugLevel
+	}
+	var cmdRegex *regexp.Regexp
+	if *cmdFilter != "" {
+		var err error
+		if cmdRegex, err = regexp.Compile(*cmdFilter); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to parse parameter '%s' as a valid Go regex\n", *cmdFilter)
+			os.Exit(1)
+		}
+	}
+	if *interval < time.Second || *lapseInterval < time.Second {
+		fmt.Fprintf(os.Stderr, "ERROR: --interval and --lapse.interval must be at least 1s\n")
+		os.Exit(1)
+	}
+	if *width < 200 || *height < 100 {
+		fmt.Fprintf(os.Stderr, "ERROR: --width must be at least 200 and --height at least 100\n")
+		os.Exit(1)
+	}
+
+	opts := []p4dlog.Option{p4dlog.WithLogger(logger), p4dlog.WithDebugMode(*debug)}
+	if *noCompletionRecords {
+		opts = append(opts, p4dlog.WithNoCompletionRecords())
+	}
+	s := newLoadSeries(*interval, *lapseInterval)
+	for _, f := range *logfiles {
+		logger.Infof("Processing: %s", f)
+		if err := parseLog(logger, opts, f, cmdRegex, s); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	charts := buildCharts(s, *width, *height)
+	if *svgDir != "" {
+		if err := writeSVGFiles(*svgDir, charts); err != nil {
+			logger.Fatalf("Failed to write SVG files: %v", err)
+		}
+	}
+	var w io.Writer = os.Stdout
+	name := getFilename(*outputFile, *logfiles)
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	htmlCharts := make([]*chart, 0, len(charts))
+	for _, c := range charts {
+		htmlCharts = append(htmlCharts, c.chart)
+	}
+	if err := writeHTML(w, strings.Join(*logfiles, " "), *logfiles, s, htmlCharts); err != nil {
+		logger.Fatalf("Failed to write report: %v", err)
+	}
+	if name != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", name)
+	}
+}
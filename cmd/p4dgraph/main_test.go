@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func TestLoadSeries(t *testing.T) {
+	start := time.Date(2024, 6, 10, 10, 0, 30, 0, time.UTC)
+	cmds := []p4dlog.Command{
+		{Pid: 1, Cmd: "user-sync", StartTime: start, EndTime: start.Add(90 * time.Second), CompletedLapse: 90},
+		{Pid: 2, Cmd: "user-info", StartTime: start.Add(10 * time.Second), EndTime: start.Add(10 * time.Second), CompletedLapse: 0.1},
+		{Pid: 3, Cmd: "user-info", StartTime: start.Add(20 * time.Second), CompletedLapse: 0.2}, // No end time
+		{Pid: 4, Cmd: "user-files", StartTime: start.Add(3 * time.Minute), EndTime: start.Add(3*time.Minute + time.Second), CompletedLapse: 1},
+		{Pid: 5, Cmd: "user-info"}, // No start time - ignored
+	}
+	s := newLoadSeries(time.Minute, 10*time.Minute)
+	for i := range cmds {
+		s.add(&cmds[i])
+	}
+	assert.Equal(t, int64(4), s.count)
+
+	running := s.concurrency()
+	if assert.Equal(t, 4, len(running)) {
+		assert.Equal(t, time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC), running[0].Time)
+		assert.Equal(t, []float64{2}, running[0].Values)
+		assert.Equal(t, []float64{1}, running[1].Values) // Sync still running
+		assert.Equal(t, []float64{1}, running[2].Values) // Ends at 10:02:00
+		assert.Equal(t, []float64{1}, running[3].Values)
+	}
+	arrivals := s.arrivalsPerMinute()
+	if assert.Equal(t, 4, len(arrivals)) {
+		assert.Equal(t, []float64{3}, arrivals[0].Values)
+		assert.Equal(t, []float64{0}, arrivals[2].Values)
+		assert.Equal(t, []float64{1}, arrivals[3].Values)
+	}
+	p, ok := peak(running)
+	assert.True(t, ok)
+	assert.Equal(t, start.Truncate(time.Minute), p.Time)
+
+	lapses := s.lapsePercentiles()
+	if assert.Equal(t, 1, len(lapses)) {
+		assert.Equal(t, []float64{0.20000000298023224, 90, 90}, lapses[0].Values)
+	}
+
+	// Arrivals are per minute whatever the interval
+	s = newLoadSeries(10*time.Second, time.Minute)
+	s.add(&cmds[0])
+	assert.Equal(t, []float64{6}, s.arrivalsPerMinute()[0].Values)
+
+	assert.Nil(t, newLoadSeries(time.Minute, time.Minute).concurrency())
+}
+
+func TestPercentile(t *testing.T) {
+	assert.Equal(t, 0.0, percentile(nil, 50))
+	vals := []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(t, 5.0, percentile(vals, 50))
+	assert.Equal(t, 9.0, percentile(vals, 90))
+	assert.Equal(t, 10.0, percentile(vals, 99))
+	assert.Equal(t, 1.0, percentile(vals, 0))
+}
+
+func TestChart(t *testing.T) {
+	assert.Equal(t, 1.0, niceMax(0))
+	assert.Equal(t, 5.0, niceMax(3))
+	assert.Equal(t, 250.0, niceMax(201))
+	assert.Equal(t, time.Hour, tickStep(30*time.Minute))
+	assert.Equal(t, 3*time.Hour, tickStep(50*time.Hour))
+
+	start := time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	c := &chart{title: "Lapse <secs>", yLabel: "seconds", lines: []string{"p50", "p90"}, width: 600, height: 200,
+		points: []seriesPoint{{start, []float64{1, 2}}, {start.Add(time.Hour), []float64{2, 5}}, {start.Add(2 * time.Hour), []float64{1, 3}}}}
+	var buf bytes.Buffer
+	assert.NoError(t, c.writeSVG(&buf))
+	svg := buf.String()
+	assert.Equal(t, 2, strings.Count(svg, "<polyline"))
+	assert.Contains(t, svg, "Lapse &lt;secs&gt;")
+	assert.Contains(t, svg, ">06/10 10:00<")
+	assert.Contains(t, svg, ">11:00<")
+	assertValidXML(t, svg)
+
+	// No points
+	buf.Reset()
+	c.points = nil
+	assert.NoError(t, c.writeSVG(&buf))
+	assert.Contains(t, buf.String(), "No commands")
+	assertValidXML(t, buf.String())
+}
+
+func assertValidXML(t *testing.T, s string) {
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+}
+
+func TestParseLogAndReport(t *testing.T) {
+	log := `Perforce server info:
+	2024/06/10 10:00:00 pid 100 fred@ws 127.0.0.1 [p4/2023.1] 'user-sync //...'
+Perforce server info:
+	2024/06/10 10:00:10 pid 101 fred@ws 127.0.0.1 [p4/2023.1] 'user-info'
+Perforce server info:
+	2024/06/10 10:00:11 pid 101 completed 1.0s
+Perforce server info:
+	2024/06/10 10:02:10 pid 100 completed 130s
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "p4d.log")
+	assert.NoError(t, os.WriteFile(path, []byte(log), 0644))
+	logger := logrus.New()
+	s := newLoadSeries(time.Minute, 10*time.Minute)
+	assert.NoError(t, parseLog(logger, []p4dlog.Option{p4dlog.WithLogger(logger)}, path, nil, s))
+	assert.Equal(t, int64(2), s.count)
+	assert.Equal(t, []float64{2}, s.concurrency()[0].Values)
+
+	charts := buildCharts(s, 800, 200)
+	assert.Equal(t, 3, len(charts))
+	assert.NoError(t, writeSVGFiles(filepath.Join(dir, "svg"), charts))
+	for _, name := range []string{"concurrency", "arrivals", "lapse"} {
+		assert.FileExists(t, filepath.Join(dir, "svg", name+".svg"))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeHTML(&buf, "p4d.log", []string{path}, s, []*chart{charts[0].chart}))
+	html := buf.String()
+	assert.Contains(t, html, "<tr><td>Commands</td><td>2</td></tr>")
+	assert.Contains(t, html, "<tr><td>Peak running commands</td><td>2 at 2024/06/10 10:00:00</td></tr>")
+	assert.Contains(t, html, "<tr><td>Time range</td><td>2024/06/10 10:00:00 - 2024/06/10 10:02:10</td></tr>")
+	assert.Equal(t, 1, strings.Count(html, "<svg "))
+
+	assert.Equal(t, filepath.Join(dir, "p4d.html"), getFilename("", []string{path}))
+	assert.Equal(t, "log-2024.html", getFilename("", []string{"log-2024.gz"}))
+	assert.Equal(t, "out.html", getFilename("out.html", []string{path}))
+}
@@ -0,0 +1,162 @@
+package main
+
+// Collection of load statistics over time from parsed commands: the number of commands running concurrently (max per
+// interval, to the second), command arrivals (starts) per minute, and percentiles of completed lapse of commands
+// starting in each (longer) lapse interval. Times are log times, in UTC as in the log.
+
+import (
+	"sort"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Percentiles of lapse charted
+var lapsePercentiles = []float64{50, 90, 99}
+
+// runEvent - a command starting (+1) or ending (-1) at a time (unix seconds)
+type runEvent struct {
+	t     int64
+	delta int
+}
+
+// loadSeries - collects commands for charting
+type loadSeries struct {
+	interval      time.Duration // Of concurrency and arrivals
+	lapseInterval time.Duration // Of lapse percentiles
+	count         int64
+	events        []runEvent
+	arrivals      map[int64]int64     // By interval index (unix seconds / interval)
+	lapses        map[int64][]float32 // By lapse interval index
+	first, last   int64               // Unix seconds of earliest start/latest end
+}
+
+func newLoadSeries(interval, lapseInterval time.Duration) *loadSeries {
+	return &loadSeries{interval: interval, lapseInterval: lapseInterval,
+		arrivals: make(map[int64]int64), lapses: make(map[int64][]float32)}
+}
+
+func (s *loadSeries) add(cmd *p4dlog.Command) {
+	if cmd.StartTime.IsZero() {
+		return
+	}
+	s.count++
+	start := cmd.StartTime.Unix()
+	end := start
+	if !cmd.EndTime.IsZero() && cmd.EndTime.Unix() > start {
+		end = cmd.EndTime.Unix()
+	}
+	// Running for each second from start to end inclusive, so commands taking less than a second are counted
+	s.events = append(s.events, runEvent{start, 1}, runEvent{end + 1, -1})
+	if s.first == 0 || start < s.first {
+		s.first = start
+	}
+	if end > s.last {
+		s.last = end
+	}
+	s.arrivals[start/s.secs(s.interval)]++
+	i := start / s.secs(s.lapseInterval)
+	s.lapses[i] = append(s.lapses[i], cmd.CompletedLapse)
+}
+
+func (s *loadSeries) secs(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// seriesPoint - values at the start of an interval
+type seriesPoint struct {
+	Time   time.Time
+	Values []float64
+}
+
+// times returns the start times of intervals of length d covering all commands
+func (s *loadSeries) times(d time.Duration) []int64 {
+	if s.count == 0 {
+		return nil
+	}
+	n := s.secs(d)
+	var result []int64
+	for i := s.first / n; i <= s.last/n; i++ {
+		result = append(result, i*n)
+	}
+	return result
+}
+
+// concurrency returns the max number of commands running in each interval
+func (s *loadSeries) concurrency() []seriesPoint {
+	sort.Slice(s.events, func(i, j int) bool {
+		if s.events[i].t != s.events[j].t {
+			return s.events[i].t < s.events[j].t
+		}
+		return s.events[i].delta < s.events[j].delta // Ends first
+	})
+	n := s.secs(s.interval)
+	var result []seriesPoint
+	running, j := 0, 0
+	for _, t := range s.times(s.interval) {
+		peak := running // Those running at the start of the interval
+		for ; j < len(s.events) && s.events[j].t < t+n; j++ {
+			running += s.events[j].delta
+			if running > peak {
+				peak = running
+			}
+		}
+		result = append(result, seriesPoint{time.Unix(t, 0).UTC(), []float64{float64(peak)}})
+	}
+	return result
+}
+
+// arrivalsPerMinute returns the rate at which commands started in each interval
+func (s *loadSeries) arrivalsPerMinute() []seriesPoint {
+	n := s.secs(s.interval)
+	scale := float64(time.Minute) / float64(s.interval)
+	var result []seriesPoint
+	for _, t := range s.times(s.interval) {
+		result = append(result, seriesPoint{time.Unix(t, 0).UTC(), []float64{float64(s.arrivals[t/n]) * scale}})
+	}
+	return result
+}
+
+// lapsePercentiles returns lapsePercentiles of completed lapse of commands starting in each lapse interval
+func (s *loadSeries) lapsePercentiles() []seriesPoint {
+	n := s.secs(s.lapseInterval)
+	var result []seriesPoint
+	for _, t := range s.times(s.lapseInterval) {
+		p := seriesPoint{Time: time.Unix(t, 0).UTC()}
+		lapses := s.lapses[t/n]
+		sort.Slice(lapses, func(i, j int) bool { return lapses[i] < lapses[j] })
+		for _, pc := range lapsePercentiles {
+			p.Values = append(p.Values, percentile(lapses, pc))
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// percentile returns the pc'th percentile (nearest rank) of sorted values, or 0 if none
+func percentile(sorted []float32, pc float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(pc/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return float64(sorted[rank])
+}
+
+// peak returns the point with the highest first value
+func peak(points []seriesPoint) (seriesPoint, bool) {
+	var max seriesPoint
+	found := false
+	for _, p := range points {
+		if !found || p.Values[0] > max.Values[0] {
+			max = p
+			found = true
+		}
+	}
+	return max, found
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/perforce/p4prometheus/version"
+)
+
+func main() {
+	var (
+		listenAddress = kingpin.Flag(
+			"web.listen-address",
+			"Address on which to listen for parse requests.",
+		).Default(":8088").String()
+		debug = kingpin.Flag(
+			"debug",
+			"Enable debugging level.",
+		).Int()
+		noCompletionRecords = kingpin.Flag(
+			"no.completion.records",
+			"Set if logs were generated with server=1 and thus no completion records expected. May be overridden per request.",
+		).Default("false").Bool()
+		replaySpeed = kingpin.Flag(
+			"replay.speed",
+			"Pace parsing of POSTed lines by their log timestamps at this multiple of real time (e.g. 10), so that records are streamed back as they would have been output live - for testing consumers against past incidents. 0 (default) for no pacing. May be overridden per request.",
+		).Default("0").Float64()
+		shutdownTimeout = kingpin.Flag(
+			"shutdown.timeout",
+			"Time to wait for in progress requests to complete on shutdown.",
+		).Default("30s").Duration()
+	)
+	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("p4dlogd")).Author("Robert Cowham")
+	kingpin.CommandLine.Help = "HTTP server which parses p4d log lines POSTed to /parse (raw or gzipped, may be chunked)\n" +
+		"and streams back parsed commands and server events as NDJSON."
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	if *debug > 0 {
+		logger.Level = logrus.DebugLevel
+	}
+	logger.Infof("%v", version.Print("p4dlogd"))
+	if *replaySpeed < 0 {
+		logger.Fatalf("--replay.speed must not be negative")
+	}
+	logger.Infof("Flags: debug %v, listen %s, noCompletionRecords %v, replaySpeed %g, shutdownTimeout %v",
+		*debug, *listenAddress, *noCompletionRecords, *replaySpeed, *shutdownTimeout)
+
+	ps := newParseServer(logger)
+	ps.debug = *debug
+	ps.noCompletionRecords = *noCompletionRecords
+	ps.replaySpeed = *replaySpeed
+
+	mux := http.NewServeMux()
+	mux.Handle("/parse", ps)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	srv := &http.Server{Addr: *listenAddress, Handler: mux}
+
+	// Graceful shutdown - stop accepting new requests and wait for in progress ones to complete
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Infof("Received %v, shutting down with %d active requests", sig, atomic.LoadInt64(&ps.activeRequests))
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Errorf("Shutdown: %v", err)
+			srv.Close()
+		}
+		close(idleConnsClosed)
+	}()
+
+	logger.Infof("Listening on %s", *listenAddress)
+	startTime := time.Now()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatalf("ListenAndServe: %v", err)
+	}
+	<-idleConnsClosed
+	logger.Infof("Stopped, uptime %s", time.Since(startTime))
+}
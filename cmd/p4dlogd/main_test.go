@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLog = `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 compute end .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+`
+
+func newTestServer() *httptest.Server {
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	ps := newParseServer(logger)
+	ps.outputDuration = 10 * time.Millisecond
+	return httptest.NewServer(ps)
+}
+
+func postLines(t *testing.T, url string, body io.Reader, gzipped bool) []string {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	assert.NoError(t, err)
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	b, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestParse(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	output := postLines(t, srv.URL, strings.NewReader(testLog), false)
+	sort.Strings(output) // Remaining commands output in no particular order at end
+	assert.Equal(t, 2, len(output))
+	assert.Contains(t, output[0], `"cmd":"user-info"`)
+	assert.Contains(t, output[1], `"cmd":"user-sync"`)
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Write([]byte(testLog))
+	zw.Close()
+	output = postLines(t, srv.URL, buf, true)
+	assert.Equal(t, 2, len(output))
+
+	resp, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"?no_completion_records=maybe", "text/plain", strings.NewReader(testLog))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Long lines are truncated rather than ending the parse
+	longLog := strings.Replace(testLog, "'user-sync //...'", "'user-sync //"+strings.Repeat("a", 6*1024*1024)+"'", 2)
+	output = postLines(t, srv.URL, strings.NewReader(longLog), false)
+	assert.Equal(t, 2, len(output))
+
+	// A body which can't be read fails the request rather than returning partial results
+	buf.Reset()
+	zw = gzip.NewWriter(buf)
+	zw.Write([]byte(testLog))
+	zw.Close()
+	req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(b), "failed to read request body: unexpected EOF")
+}
+
+// Records for completed commands are streamed back while the upload is still in progress
+func TestParseStreaming(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, srv.URL, pr)
+	assert.NoError(t, err)
+	// Completed commands are output as the log advances, so a later command is required
+	go pw.Write([]byte(testLog + `
+Perforce server info:
+	2015/09/02 15:23:20 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+
+`))
+	respChan := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		respChan <- resp
+	}()
+
+	var resp *http.Response
+	select {
+	case resp = <-respChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for response headers")
+	}
+	defer resp.Body.Close()
+	lineChan := make(chan string)
+	go func() {
+		b := make([]byte, 64*1024)
+		n, _ := resp.Body.Read(b)
+		lineChan <- string(b[:n])
+	}()
+	select {
+	case line := <-lineChan:
+		assert.Contains(t, line, `"cmd":"user-sync"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for streamed record")
+	}
+	pw.Close()
+	rest, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rest), `"cmd":"user-info"`)
+}
+
+// With replay_speed, lines are paced by their log timestamps - testLog spans a second
+func TestParseReplay(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	start := time.Now()
+	output := postLines(t, srv.URL+"?replay_speed=4", strings.NewReader(testLog), false)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, 2, len(output))
+
+	resp, err := http.Post(srv.URL+"?replay_speed=-1", "text/plain", strings.NewReader(testLog))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,174 @@
+package main
+
+// HTTP handler which parses p4d log lines POSTed to it (raw or gzipped, including chunked uploads)
+// and streams back parsed commands and server events as NDJSON (one JSON record per line) as soon
+// as they are output by the parser. Each request gets its own parser instance, so a long-running
+// upload behaves like tailing a log. Lines are read as by log2sql, with long lines truncated. If the body can't be
+// read (e.g. a corrupt gzip upload) the request fails - with 400 if no records have been written yet, otherwise the
+// response is aborted - rather than returning partial results as if complete.
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Lines longer than this are truncated, as by log2sql (see its --max.line.len)
+const maxLineLen = 5000
+
+// parseServer - state shared by all requests
+type parseServer struct {
+	logger              *logrus.Logger
+	debug               int
+	noCompletionRecords bool
+	replaySpeed         float64       // Lines paced by their log timestamps if > 0 - see p4dlog.Replay
+	outputDuration      time.Duration // How often the parser is ticked to output completed commands
+	activeRequests      int64         // Updated atomically
+}
+
+func newParseServer(logger *logrus.Logger) *parseServer {
+	return &parseServer{logger: logger, outputDuration: time.Second}
+}
+
+// ServeHTTP handles POST /parse - optional query parameters no_completion_records=true and replay_speed=N
+func (s *parseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST supported", http.StatusMethodNotAllowed)
+		return
+	}
+	noCompletionRecords := s.noCompletionRecords
+	if v := r.URL.Query().Get("no_completion_records"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid no_completion_records: %v", err), http.StatusBadRequest)
+			return
+		}
+		noCompletionRecords = b
+	}
+	replaySpeed := s.replaySpeed
+	if v := r.URL.Query().Get("replay_speed"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			http.Error(w, fmt.Sprintf("invalid replay_speed: %s", v), http.StatusBadRequest)
+			return
+		}
+		replaySpeed = f
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	}
+	// HTTP/1.x handlers may not otherwise read the request body once the response has started,
+	// so allow records to be streamed back while the upload is still in progress (HTTP/2 is always full duplex).
+	if fd, ok := w.(interface{ EnableFullDuplex() error }); ok {
+		if err := fd.EnableFullDuplex(); err != nil {
+			s.logger.Debugf("Failed to enable full duplex: %v", err)
+		}
+	}
+
+	n := atomic.AddInt64(&s.activeRequests, 1)
+	defer atomic.AddInt64(&s.activeRequests, -1)
+	s.logger.Infof("Parse request from %s, active requests %d", r.RemoteAddr, n)
+	lines, records, err := s.parse(r.Context(), body, noCompletionRecords, replaySpeed, w)
+	if err != nil {
+		s.logger.Errorf("Parse request from %s failed after lines %d, records %d: failed to read request body: %v",
+			r.RemoteAddr, lines, records, err)
+		if records == 0 {
+			http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		panic(http.ErrAbortHandler) // Too late for an error status - the client sees an incomplete response
+	}
+	s.logger.Infof("Parse request from %s completed: lines %d, records %d", r.RemoteAddr, lines, records)
+}
+
+// parse feeds lines from body to a new parser (paced by replaySpeed if > 0), writing records to w as they are output.
+// Returns count of lines read and records written, and any error reading body - in which case records not yet
+// written are discarded.
+func (s *parseServer) parse(ctx context.Context, body io.Reader, noCompletionRecords bool, replaySpeed float64,
+	w http.ResponseWriter) (int64, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := []p4dlog.Option{p4dlog.WithLogger(s.logger), p4dlog.WithDurations(s.outputDuration, 30*time.Second),
+		p4dlog.WithDebugMode(s.debug)}
+	if noCompletionRecords {
+		opts = append(opts, p4dlog.WithNoCompletionRecords())
+	}
+	fp, _ := p4dlog.NewParser(opts...) // No features set, so can't fail
+
+	linesChan := make(chan string, 10000)
+	parserLinesChan := linesChan
+	if replaySpeed > 0 {
+		parserLinesChan = make(chan string, 10000)
+		go p4dlog.Replay(ctx, linesChan, parserLinesChan, replaySpeed)
+	}
+	cmdChan := fp.LogParser(ctx, parserLinesChan, nil) // Completed commands output in real time
+	var lines int64
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(linesChan)
+		lr := p4dlog.NewLineReader(body, maxLineLen)
+		for lr.Scan() {
+			select {
+			case linesChan <- lr.Text():
+				atomic.AddInt64(&lines, 1)
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := lr.Err(); err != nil {
+			readErr <- err
+			cancel()
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	var records int64
+	for cmd := range cmdChan {
+		if ctx.Err() != nil {
+			continue // Drain cmdChan so parser goroutines exit
+		}
+		var rec string
+		switch cmd := cmd.(type) {
+		case p4dlog.Command:
+			rec = cmd.String()
+		case p4dlog.ServerEvent:
+			rec = cmd.String()
+		default:
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", rec); err != nil {
+			s.logger.Errorf("Failed to write response: %v", err)
+			cancel()
+			continue
+		}
+		records++
+		if flusher != nil && len(cmdChan) == 0 {
+			flusher.Flush()
+		}
+	}
+	var err error
+	select {
+	case err = <-readErr:
+	default:
+	}
+	return atomic.LoadInt64(&lines), records, err
+}
@@ -0,0 +1,153 @@
+package main
+
+// Follow mode - see --follow. Tails a live log (like tail -F) and every --interval writes a JSON snapshot (one line)
+// of the commands currently pending, i.e. started but not yet completed, with their age and any locks (see locks.go).
+// Commands running for longer than expected (e.g. stuck on a lock or a hung client) can then be alerted on, e.g.
+//
+//	p4dpending --follow --json.output=- --min.age 10m /p4/1/logs/log | jq '.pendingCount'
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logtail"
+)
+
+const p4timeformat = "2006/01/02 15:04:05"
+
+// logClock tracks the current time of the log. Log times are p4d server local time, so the latest seen is advanced
+// by elapsed wall clock time (for when the log is quiet) rather than comparing with the local clock.
+type logClock struct {
+	m       sync.Mutex
+	logTime time.Time // Latest time seen in log
+	seenAt  time.Time // Wall clock time when logTime was seen
+	now     func() time.Time
+}
+
+func newLogClock() *logClock {
+	return &logClock{now: time.Now}
+}
+
+func (c *logClock) seen(t time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if t.After(c.logTime) {
+		c.logTime = t
+		c.seenAt = c.now()
+	}
+}
+
+func (c *logClock) current() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.logTime.IsZero() {
+		return c.logTime
+	}
+	return c.logTime.Add(c.now().Sub(c.seenAt))
+}
+
+// pendingCmd - summary of a pending command in a snapshot
+type pendingCmd struct {
+	ProcessKey string  `json:"processKey"`
+	Pid        int64   `json:"pid"`
+	LineNo     int64   `json:"lineNo"`
+	User       string  `json:"user"`
+	Workspace  string  `json:"workspace"`
+	IP         string  `json:"ip"`
+	App        string  `json:"app"`
+	Cmd        string  `json:"cmd"`
+	Args       string  `json:"args"`
+	StartTime  string  `json:"startTime"`
+	Age        float64 `json:"age"` // Seconds
+
+	Locks []pendingLock `json:"locks,omitempty"` // Tables locked or waited on - see locks.go
+}
+
+// snapshot - commands pending at a point in time, oldest first
+type snapshot struct {
+	LogTime      string       `json:"logTime"`
+	PendingCount int          `json:"pendingCount"`
+	Pending      []pendingCmd `json:"pending"`
+}
+
+// newSnapshot returns the snapshot at log time now of the running commands (oldest first) at least minAge old
+func newSnapshot(now time.Time, running []p4dlog.Command, minAge time.Duration) snapshot {
+	s := snapshot{Pending: make([]pendingCmd, 0)}
+	if !now.IsZero() {
+		s.LogTime = now.Format(p4timeformat)
+	}
+	for i := range running {
+		cmd := &running[i]
+		age := pendingAge(cmd, now)
+		if age < minAge {
+			continue
+		}
+		s.Pending = append(s.Pending, pendingCmd{ProcessKey: cmd.ProcessKey, Pid: cmd.Pid, LineNo: cmd.LineNo,
+			User: cmd.User, Workspace: cmd.Workspace, IP: cmd.IP, App: cmd.App, Cmd: cmd.Cmd, Args: cmd.Args,
+			StartTime: cmd.StartTime.Format(p4timeformat), Age: age.Round(time.Second).Seconds(),
+			Locks: pendingLocks(cmd)})
+	}
+	s.PendingCount = len(s.Pending)
+	return s
+}
+
+// follow tails logfile, writing a snapshot of pending commands to w every interval until ctx is done
+func (p4p *P4Pending) follow(ctx context.Context, logfile string, fromStart bool, interval, minAge time.Duration,
+	w *bufio.Writer) error {
+	tailErr := make(chan error, 1)
+	tl := logtail.New(p4p.logger, logfile, fromStart)
+	go func() {
+		tailErr <- tl.Tail(ctx, p4p.linesChan)
+	}()
+	cmdChan := p4p.fp.LogParser(ctx, p4p.linesChan, nil) // Completed commands output in real time
+
+	clock := newLogClock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for c := range cmdChan {
+			switch c := c.(type) {
+			case p4dlog.Command:
+				clock.seen(c.StartTime)
+				clock.seen(c.EndTime)
+			case p4dlog.ServerEvent:
+				clock.seen(c.EventTime)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			return nil
+		case err := <-tailErr:
+			<-done
+			return err
+		case <-ticker.C:
+		}
+		running := p4p.fp.RunningCommands()
+		for i := range running {
+			clock.seen(running[i].StartTime)
+		}
+		s := newSnapshot(clock.current(), running, minAge)
+		p4p.totalCount++
+		p4p.pendingCount = s.PendingCount
+		p4p.logger.Debugf("Snapshot %d: %d pending, lines read %d", p4p.totalCount, s.PendingCount, tl.LinesRead())
+		j, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", j)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+// Locks of pending commands - the tables they have locked or waited on, from any track output seen so far (e.g. at
+// the end of the compute phase of a submit), so that a command blocking others can be identified, e.g.
+//
+//	p4dpending --follow --json.output=- /p4/1/logs/log | jq '.pending[] | select(.locks | length > 0) | [.pid, .cmd, .locks[].table]'
+//
+// Track output gives the totals for the command so far, so a table listed is not necessarily still locked. Compute
+// phase tables aren't recorded separately (no WithComputePhaseTables), so each table is listed once, with its totals.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// pendingLock - a table locked (or waited on) by a pending command. Times in ms.
+type pendingLock struct {
+	Table      string `json:"table"`
+	ReadLocks  int64  `json:"readLocks"`
+	WriteLocks int64  `json:"writeLocks"`
+	ReadWait   int64  `json:"readWait"`
+	ReadHeld   int64  `json:"readHeld"`
+	WriteWait  int64  `json:"writeWait"`
+	WriteHeld  int64  `json:"writeHeld"`
+}
+
+// pendingLocks returns the tables of cmd which it has locked or waited on, by name
+func pendingLocks(cmd *p4dlog.Command) []pendingLock {
+	locks := make([]pendingLock, 0)
+	for _, t := range cmd.Tables {
+		if t.ReadLocks+t.WriteLocks+t.TotalReadWait+t.TotalReadHeld+t.TotalWriteWait+t.TotalWriteHeld == 0 {
+			continue
+		}
+		locks = append(locks, pendingLock{Table: t.TableName, ReadLocks: t.ReadLocks, WriteLocks: t.WriteLocks,
+			ReadWait: t.TotalReadWait, ReadHeld: t.TotalReadHeld, WriteWait: t.TotalWriteWait,
+			WriteHeld: t.TotalWriteHeld})
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Table < locks[j].Table })
+	return locks
+}
+
+// pendingAge returns how long cmd has been pending at log time now
+func pendingAge(cmd *p4dlog.Command, now time.Time) time.Duration {
+	age := now.Sub(cmd.StartTime)
+	if age < 0 || now.IsZero() {
+		return 0
+	}
+	return age
+}
+
+// pendingJSON returns the JSON of a command pending at the end of the log (latest log time now), with its age (secs)
+// and locks added
+func pendingJSON(cmd *p4dlog.Command, now time.Time) string {
+	locks, _ := json.Marshal(pendingLocks(cmd))
+	return fmt.Sprintf(`%s,"age":%g,"locks":%s}`, strings.TrimSuffix(cmd.String(), "}"),
+		pendingAge(cmd, now).Round(time.Second).Seconds(), locks)
+}
@@ -2,14 +2,13 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
 	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -21,6 +20,7 @@ import (
 
 	"github.com/perforce/p4prometheus/version"
 	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logreader"
 )
 
 func byteCountDecimal(b int64) string {
@@ -36,33 +36,6 @@ func byteCountDecimal(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-func readerFromFile(file *os.File) (io.Reader, int64, error) {
-	//create a bufio.Reader so we can 'peek' at the first few bytes
-	bReader := bufio.NewReader(file)
-	testBytes, err := bReader.Peek(64) //read a few bytes without consuming
-	if err != nil {
-		return nil, 0, err
-	}
-	var fileSize int64
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-	fileSize = stat.Size()
-
-	// Detect if the content is gzipped
-	contentType := http.DetectContentType(testBytes)
-	if strings.Contains(contentType, "x-gzip") {
-		gzipReader, err := gzip.NewReader(bReader)
-		if err != nil {
-			return nil, 0, err
-		}
-		// Estimate filesize
-		return gzipReader, fileSize * 20, nil
-	}
-	return bReader, fileSize, nil
-}
-
 // P4Pending structure
 type P4Pending struct {
 	debug        int
@@ -87,18 +60,16 @@ func (p4p *P4Pending) parseLog(logfile string) {
 	}
 	defer file.Close()
 
-	const maxCapacity = 5 * 1024 * 1024
 	ctx := context.Background()
-	inbuf := make([]byte, maxCapacity)
-	reader, fileSize, err := readerFromFile(file)
+	reader, fileSize, err := logreader.FromFile(file)
 	if err != nil {
 		p4p.logger.Fatalf("Failed to open file: %v", err)
 	}
+	defer reader.Close()
 	p4p.logger.Debugf("Opened %s, size %v", logfile, fileSize)
-	reader = bufio.NewReaderSize(reader, maxCapacity)
 	preader := progress.NewReader(reader)
-	scanner := bufio.NewScanner(preader)
-	scanner.Buffer(inbuf, maxCapacity)
+	const maxLine = 10000
+	lr := p4dlog.NewLineReader(preader, maxLine)
 
 	// Start a goroutine printing progress
 	go func() {
@@ -124,20 +95,13 @@ func (p4p *P4Pending) parseLog(logfile string) {
 		fmt.Fprintln(os.Stderr, "processing completed")
 	}()
 
-	const maxLine = 10000
 	i := 0
-	for scanner.Scan() {
-		// Use time records in log to cause ticks for log parser
-		if len(scanner.Text()) > maxLine {
-			line := fmt.Sprintf("%s...'", scanner.Text()[0:maxLine])
-			p4p.linesChan <- line
-		} else {
-			p4p.linesChan <- scanner.Text()
-		}
+	for lr.Scan() {
+		p4p.linesChan <- lr.Text()
 		i += 1
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := lr.Err(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to read input file on line: %d, %v\n", i, err)
 	}
 
@@ -159,7 +123,7 @@ func getFilename(name, suffix string, requireSuffix bool, logfiles []string) str
 		if len(logfiles) == 0 {
 			name = "logs"
 		} else {
-			name = strings.TrimSuffix(logfiles[0], ".gz")
+			name = logreader.TrimSuffix(logfiles[0])
 			name = strings.TrimSuffix(name, ".log")
 		}
 		if !requireSuffix && !strings.HasSuffix(name, suffix) {
@@ -225,12 +189,37 @@ func main() {
 			"debug.cmd",
 			"Set for debug output for specified command - requires debug.pid to be also specified.",
 		).Default("").String()
+		follow = kingpin.Flag(
+			"follow",
+			"Follow a single live log as it is written (like tail -F), writing a JSON snapshot of the currently pending commands, with their age in seconds, every --interval.",
+		).Short('f').Bool()
+		interval = kingpin.Flag(
+			"interval",
+			"Interval between snapshots in --follow mode.",
+		).Default("1m").Duration()
+		fromStart = kingpin.Flag(
+			"from.start",
+			"In --follow mode, read the log from the start rather than only new lines written, so that commands already running are known.",
+		).Bool()
+		minAge = kingpin.Flag(
+			"min.age",
+			"In --follow mode, only include commands pending for at least this long (e.g. 10m), to alert on stuck commands.",
+		).Default("0s").Duration()
 	)
 	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("p4dpending")).Author("Robert Cowham")
-	kingpin.CommandLine.Help = "Parses one or more p4d text log files (which may be gzipped) and lists pending commands.\n" +
-		"Commands are produced in reverse chronological order."
+	kingpin.CommandLine.Help = "Parses one or more p4d text log files (which may be gzip, zstd or bzip2 compressed) and lists pending commands.\n" +
+		"Commands are produced in reverse chronological order.\n" +
+		"With --follow, tails a live log and writes a snapshot of pending commands every --interval."
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
+	if *follow && len(*logfiles) != 1 {
+		fmt.Fprintf(os.Stderr, "ERROR: --follow requires a single log file\n")
+		os.Exit(1)
+	}
+	if *follow && *interval <= 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: --interval must be positive\n")
+		os.Exit(1)
+	}
 
 	// if *debug > 0 {
 	// 	// CPU profiling by default
@@ -244,7 +233,7 @@ func main() {
 	startTime := time.Now()
 	logger.Infof("%v", version.Print("p4dpending"))
 	logger.Infof("Starting %s, Logfiles: %v", startTime, *logfiles)
-	logger.Infof("Flags: debug %v, jsonfile %v, debugPid/cmd %d/%s", *debug, *jsonOutputFile, *debugPID, *debugCmd)
+	logger.Infof("Flags: debug %v, jsonfile %v, debugPid/cmd %d/%s, follow %v", *debug, *jsonOutputFile, *debugPID, *debugCmd, *follow)
 
 	linesChan := make(chan string, 10000)
 
@@ -266,21 +255,34 @@ func main() {
 	var fp *p4dlog.P4dFileParser
 	var cmdChan chan interface{}
 
-	fp = p4dlog.NewP4dFileParser(logger)
+	opts := []p4dlog.Option{p4dlog.WithLogger(logger), p4dlog.WithDebugMode(*debug),
+		p4dlog.WithDebugPID(*debugPID, *debugCmd)}
+	if *follow {
+		opts = append(opts, p4dlog.WithDurations(time.Second, 30*time.Second))
+	}
+	fp, _ = p4dlog.NewParser(opts...)
 	p4p := &P4Pending{
 		debug:     *debug,
 		logger:    logger,
 		fp:        fp,
 		linesChan: linesChan,
 	}
-	if *debug > 0 {
-		fp.SetDebugMode(*debug)
-	}
 	if *debug >= int(p4dlog.DebugCommands) {
 		logger.Level = logrus.TraceLevel
 	}
-	if *debugPID != 0 && *debugCmd != "" {
-		fp.SetDebugPID(*debugPID, *debugCmd)
+	if *follow {
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			<-sigs
+			cancel()
+		}()
+		logger.Infof("Following %s, snapshot interval %v, min age %v", (*logfiles)[0], *interval, *minAge)
+		if err := p4p.follow(ctx, (*logfiles)[0], *fromStart, *interval, *minAge, fJSON); err != nil {
+			logger.Fatalf("Failed to follow %s: %v", (*logfiles)[0], err)
+		}
+		logger.Infof("Completed %s, elapsed %s, snapshots %d", time.Now(), time.Since(startTime), p4p.totalCount)
+		return
 	}
 	cmdChan = fp.LogParser(ctx, linesChan, nil)
 
@@ -294,25 +296,41 @@ func main() {
 
 	// Process all commands, but discarding those with completion records
 	// When we close the linesChan above, we will force the output of "pending" commands.
+	// They are written at the end, with ages relative to the latest time in the log.
+	var logTime time.Time
+	var pending []p4dlog.Command
+	seen := func(t time.Time) {
+		if t.After(logTime) {
+			logTime = t
+		}
+	}
 	for cmd := range cmdChan {
 		switch cmd := cmd.(type) {
 		case p4dlog.Command:
 			p4p.totalCount += 1
+			seen(cmd.StartTime)
+			seen(cmd.EndTime)
+			seen(cmd.LastSeenTime)
 			if cmd.EndTime.IsZero() {
 				p4p.pendingCount += 1
-				fmt.Fprintf(fJSON, "%s\n", cmd.String())
+				pending = append(pending, cmd)
 			} else {
 				if p4p.totalCount%100000 == 0 {
 					fJSON.Flush()
 				}
 			}
 		case p4dlog.ServerEvent:
+			seen(cmd.EventTime)
 			p4p.totalCount += 1
 			p4p.pendingCount += 1
 			fmt.Fprintf(fJSON, "%s\n", cmd.String())
 		}
 	}
 
+	for i := range pending {
+		fmt.Fprintf(fJSON, "%s\n", pendingJSON(&pending[i], logTime))
+	}
+
 	wg.Wait()
 	logger.Infof("Completed %s, elapsed %s, cmds total %d, pending %d",
 		time.Now(), time.Since(startTime), p4p.totalCount, p4p.pendingCount)
@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	p4dlog "github.com/rcowham/go-libp4dlog"
 
@@ -91,7 +92,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"4d4e5096f7b732e4ce95230ef085bf51","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0.031,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"4d4e5096f7b732e4ce95230ef085bf51","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0.031,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 
 }
@@ -106,7 +107,71 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"4d4e5096f7b732e4ce95230ef085bf51","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"0001/01/01 00:00:00","running":1,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"4d4e5096f7b732e4ce95230ef085bf51","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"0001/01/01 00:00:00","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 
 }
+
+func TestSnapshot(t *testing.T) {
+	start, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
+	running := []p4dlog.Command{
+		{Pid: 1616, Cmd: "user-sync", User: "robert", Args: "//...", StartTime: start},
+		{Pid: 1617, Cmd: "user-files", User: "fred", StartTime: start.Add(5 * time.Minute)},
+	}
+	s := newSnapshot(start.Add(10*time.Minute), running, 0)
+	assert.Equal(t, "2015/09/02 15:33:09", s.LogTime)
+	assert.Equal(t, 2, s.PendingCount)
+	assert.Equal(t, float64(600), s.Pending[0].Age)
+	assert.Equal(t, "2015/09/02 15:23:09", s.Pending[0].StartTime)
+	assert.Equal(t, float64(300), s.Pending[1].Age)
+
+	s = newSnapshot(start.Add(10*time.Minute), running, 6*time.Minute)
+	assert.Equal(t, 1, s.PendingCount)
+	assert.Equal(t, int64(1616), s.Pending[0].Pid)
+
+	s = newSnapshot(time.Time{}, nil, 0)
+	j, err := json.Marshal(s)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"logTime":"","pendingCount":0,"pending":[]}`, string(j))
+}
+
+func TestLogClock(t *testing.T) {
+	wall := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newLogClock()
+	c.now = func() time.Time { return wall }
+	assert.True(t, c.current().IsZero())
+	logTime, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
+	c.seen(logTime)
+	c.seen(logTime.Add(-time.Minute)) // Earlier times ignored
+	wall = wall.Add(30 * time.Second)
+	assert.Equal(t, logTime.Add(30*time.Second), c.current())
+}
+
+func TestPendingLocks(t *testing.T) {
+	start, _ := time.Parse(p4timeformat, "2024/04/03 12:20:14")
+	cmd := p4dlog.Command{Pid: 5032, Cmd: "user-submit", StartTime: start, Tables: map[string]*p4dlog.Table{
+		"rev":     {TableName: "rev", WriteLocks: 1, TotalWriteWait: 5, TotalWriteHeld: 1200},
+		"counter": {TableName: "counter", PagesIn: 3},
+		"change":  {TableName: "change", ReadLocks: 1, TotalReadHeld: 20},
+	}}
+	locks := pendingLocks(&cmd)
+	if assert.Equal(t, 2, len(locks)) {
+		assert.Equal(t, pendingLock{Table: "change", ReadLocks: 1, ReadHeld: 20}, locks[0])
+		assert.Equal(t, pendingLock{Table: "rev", WriteLocks: 1, WriteWait: 5, WriteHeld: 1200}, locks[1])
+	}
+	computeCmd := cmd // Tables are totals, so any compute phase tables aren't listed again
+	computeCmd.ComputeTables = map[string]*p4dlog.Table{"rev": {TableName: "rev", WriteLocks: 1, TotalWriteHeld: 900}}
+	assert.Equal(t, locks, pendingLocks(&computeCmd))
+
+	s := newSnapshot(start.Add(5*time.Minute), []p4dlog.Command{cmd}, 0)
+	assert.Equal(t, 2, len(s.Pending[0].Locks))
+
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(pendingJSON(&cmd, start.Add(5*time.Minute))), &result))
+	assert.Equal(t, "user-submit", result["cmd"])
+	assert.Equal(t, float64(300), result["age"])
+	assert.Equal(t, 2, len(result["locks"].([]interface{})))
+
+	// No locks, and no log time
+	assert.Contains(t, pendingJSON(&p4dlog.Command{Pid: 1}, time.Time{}), `,"age":0,"locks":[]}`)
+}
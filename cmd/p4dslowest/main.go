@@ -0,0 +1,155 @@
+package main
+
+// p4dslowest - report of the N slowest commands in p4d logs, by completed lapse (or compute lapse, or lock wait),
+// either individually or grouped by cmd and/or user. Rather than loading logs into a database with log2sql and
+// writing the same SQL every time.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/perforce/p4prometheus/version"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// parseLog parses a logfile ("-" for stdin), adding commands matching cmdRegex (if set) to s
+func parseLog(logger *logrus.Logger, opts []p4dlog.Option, logfile string, cmdRegex *regexp.Regexp, s *slowest) error {
+	fp, err := p4dlog.NewParser(opts...)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cmdChan <-chan interface{}
+	if logfile == "-" {
+		cmdChan, err = fp.ParseReader(ctx, os.Stdin)
+	} else {
+		cmdChan, err = fp.ParseFile(ctx, logfile)
+	}
+	if err != nil {
+		return err
+	}
+	for c := range cmdChan {
+		if cmd, ok := c.(p4dlog.Command); ok {
+			if cmdRegex != nil && !cmdRegex.MatchString(cmd.Cmd) {
+				continue
+			}
+			s.add(&cmd)
+		}
+	}
+	if err := fp.ReadErr(); err != nil {
+		return fmt.Errorf("%s: %v", logfile, err)
+	}
+	logger.Debugf("Parsed %s: %s", logfile, fp.Stats())
+	return nil
+}
+
+func main() {
+	var (
+		logfiles = kingpin.Arg(
+			"logfile",
+			"Log files to process (may be gzip, zstd or bzip2 compressed), or - for stdin.").Required().Strings()
+		debug = kingpin.Flag(
+			"debug",
+			"Enable debugging level.",
+		).Int()
+		top = kingpin.Flag(
+			"top",
+			"Number of commands (or groups) to report.",
+		).Short('n').Default("20").Int()
+		by = kingpin.Flag(
+			"by",
+			"Measure by which commands are ranked: lapse (completed lapse), compute (compute lapse) or lockwait (total read+write lock wait over all tables).",
+		).Default(byLapse).Enum(byLapse, byCompute, byLockWait)
+		group = kingpin.Flag(
+			"group",
+			"Group commands by: none (report individual commands), cmd, user or cmd+user - groups are ranked by the max for a single command, with count and total.",
+		).Default(groupNone).Enum(groupNone, groupCmd, groupUser, groupCmdUser)
+		cmdFilter = kingpin.Flag(
+			"cmd",
+			"Specify a (golang) regex to match commands to report (e.g. 'user-(sync|submit)'). No default.",
+		).String()
+		format = kingpin.Flag(
+			"format",
+			"Format of output: text, csv or json.",
+		).Short('f').Default("text").Enum("text", "csv", "json")
+		outputFile = kingpin.Flag(
+			"output",
+			"Name of file to which to write the report. Defaults to stdout.",
+		).Short('o').String()
+		noCompletionRecords = kingpin.Flag(
+			"no.completion.records",
+			"Set if logs were generated with server=1 and thus no completion records expected.",
+		).Bool()
+	)
+	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("p4dslowest")).Author("Robert Cowham")
+	kingpin.CommandLine.Help = `Parses one or more p4d text log files (which may be gzip, zstd or bzip2 compressed) and reports the slowest commands,
+by completed lapse (default), compute lapse or lock wait, either individually or grouped by cmd and/or user.
+
+Usage examples:
+
+	p4dslowest log
+	p4dslowest -n 50 --by lockwait --cmd 'user-(sync|submit)' log-2024-*.gz
+	p4dslowest --group cmd+user -f csv -o slowest.csv log
+`
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	if *debug > 0 {
+		logger.Level = logrus.DebugLevel
+	}
+	var cmdRegex *regexp.Regexp
+	if *cmdFilter != "" {
+		var err error
+		if cmdRegex, err = regexp.Compile(*cmdFilter); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to parse parameter '%s' as a valid Go regex\n", *cmdFilter)
+			os.Exit(1)
+		}
+	}
+	if *top <= 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: --top must be greater than 0\n")
+		os.Exit(1)
+	}
+
+	opts := []p4dlog.Option{p4dlog.WithLogger(logger), p4dlog.WithDebugMode(*debug)}
+	if *noCompletionRecords {
+		opts = append(opts, p4dlog.WithNoCompletionRecords())
+	}
+	s := newSlowest(*by, *group, *top)
+	for _, f := range *logfiles {
+		logger.Infof("Processing: %s", f)
+		if err := parseLog(logger, opts, f, cmdRegex, s); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *outputFile != "" && *outputFile != "-" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	var err error
+	switch *format {
+	case "csv":
+		err = s.writeCSV(w)
+	case "json":
+		err = s.writeJSON(w)
+	default:
+		err = s.writeText(w)
+	}
+	if err != nil {
+		logger.Fatalf("Failed to write report: %v", err)
+	}
+}
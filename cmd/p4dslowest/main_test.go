@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func TestSlowest(t *testing.T) {
+	start := time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	cmds := []p4dlog.Command{
+		{Pid: 1, LineNo: 10, Cmd: "user-sync", User: "fred", StartTime: start, CompletedLapse: 5, ComputeLapse: 1},
+		{Pid: 2, LineNo: 20, Cmd: "user-sync", User: "bill", StartTime: start, CompletedLapse: 12, ComputeLapse: 0.5},
+		{Pid: 3, LineNo: 30, Cmd: "user-submit", User: "fred", StartTime: start, CompletedLapse: 8,
+			Tables: map[string]*p4dlog.Table{"rev": {TableName: "rev", TotalReadWait: 1500, TotalWriteWait: 2500}}},
+		{Pid: 4, LineNo: 40, Cmd: "user-info", User: "fred", StartTime: start},
+	}
+	add := func(s *slowest) *slowest {
+		for i := range cmds {
+			s.add(&cmds[i])
+		}
+		return s
+	}
+
+	s := add(newSlowest(byLapse, groupNone, 2))
+	if assert.Equal(t, 2, len(s.cmds)) {
+		assert.Equal(t, int64(2), s.cmds[0].Pid)
+		assert.Equal(t, int64(3), s.cmds[1].Pid)
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.writeText(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "Slowest 2 of 4 commands by lapse (seconds):", lines[0])
+	assert.Regexp(t, `^12\.000 +2 +20 +bill +2024/06/10 10:00:00 +user-sync $`, lines[2])
+
+	s = add(newSlowest(byCompute, groupNone, 10))
+	assert.Equal(t, 2, len(s.cmds))
+	assert.Equal(t, int64(1), s.cmds[0].Pid)
+
+	s = add(newSlowest(byLockWait, groupNone, 10))
+	if assert.Equal(t, 1, len(s.cmds)) {
+		assert.Equal(t, 4.0, s.cmds[0].Value)
+	}
+	buf.Reset()
+	assert.NoError(t, s.writeCSV(&buf))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{csvCmdHeader,
+		{"4.000", "3", "30", "fred", "", "", "2024/06/10 10:00:00", "", "user-submit", ""}}, rows)
+
+	s = add(newSlowest(byLapse, groupUser, 10))
+	groups := s.topGroups()
+	assert.Equal(t, []cmdGroup{
+		{User: "bill", Count: 1, Total: 12, Max: 12, MaxPid: 2, MaxLine: 20},
+		{User: "fred", Count: 3, Total: 13, Max: 8, MaxPid: 3, MaxLine: 30},
+	}, groups)
+	buf.Reset()
+	assert.NoError(t, s.writeJSON(&buf))
+	var decoded []cmdGroup
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, groups, decoded)
+
+	s = add(newSlowest(byLapse, groupCmdUser, 1))
+	assert.Equal(t, []cmdGroup{{Cmd: "user-sync", User: "bill", Count: 1, Total: 12, Max: 12, MaxPid: 2, MaxLine: 20}}, s.topGroups())
+
+	// No commands is an empty array
+	buf.Reset()
+	assert.NoError(t, newSlowest(byLapse, groupNone, 10).writeJSON(&buf))
+	assert.Equal(t, "[]\n", buf.String())
+}
+
+func TestParseLog(t *testing.T) {
+	log := `Perforce server info:
+	2024/06/10 10:00:00 pid 100 fred@ws 127.0.0.1 [p4/2023.1] 'user-sync //...'
+Perforce server info:
+	2024/06/10 10:00:10 pid 100 completed 10.0s
+Perforce server info:
+	2024/06/10 10:00:11 pid 101 fred@ws 127.0.0.1 [p4/2023.1] 'user-info'
+Perforce server info:
+	2024/06/10 10:00:12 pid 101 completed 1.0s
+`
+	path := filepath.Join(t.TempDir(), "p4d.log")
+	assert.NoError(t, os.WriteFile(path, []byte(log), 0644))
+	logger := logrus.New()
+	s := newSlowest(byLapse, groupNone, 10)
+	assert.NoError(t, parseLog(logger, []p4dlog.Option{p4dlog.WithLogger(logger)}, path, nil, s))
+	assert.Equal(t, int64(2), s.count)
+	if assert.Equal(t, 2, len(s.cmds)) {
+		assert.Equal(t, "user-sync", s.cmds[0].Cmd)
+		assert.Equal(t, "fred", s.cmds[0].User)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+// Collection and output of the slowest commands - either individual commands, or commands grouped by cmd and/or user
+// (with the count, total and max of the measure for each group), ordered by the measure descending.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Measures by which commands are ranked - all in seconds
+const (
+	byLapse    = "lapse"    // completedLapse
+	byCompute  = "compute"  // computeLapse
+	byLockWait = "lockwait" // Total read+write lock wait over all tables
+)
+
+// Groupings of commands
+const (
+	groupNone    = "none"
+	groupCmd     = "cmd"
+	groupUser    = "user"
+	groupCmdUser = "cmd+user"
+)
+
+const timeFormat = "2006/01/02 15:04:05"
+
+// measure returns the value of cmd for by
+func measure(cmd *p4dlog.Command, by string) float64 {
+	switch by {
+	case byCompute:
+		return float64(cmd.ComputeLapse)
+	case byLockWait:
+		var wait int64
+		for _, t := range cmd.TablesWithLocks() {
+			wait += t.TotalReadWait + t.TotalWriteWait
+		}
+		return float64(wait) / 1000
+	}
+	return float64(cmd.CompletedLapse)
+}
+
+// slowCmd - a command and its measure
+type slowCmd struct {
+	Value     float64   `json:"value"`
+	Pid       int64     `json:"pid"`
+	LineNo    int64     `json:"lineNo"`
+	User      string    `json:"user"`
+	Workspace string    `json:"workspace"`
+	App       string    `json:"app"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Cmd       string    `json:"cmd"`
+	Args      string    `json:"args"`
+}
+
+// cmdGroup - totals of commands with the same cmd and/or user
+type cmdGroup struct {
+	Cmd     string  `json:"cmd,omitempty"`
+	User    string  `json:"user,omitempty"`
+	Count   int64   `json:"count"`
+	Total   float64 `json:"total"`
+	Max     float64 `json:"max"`
+	MaxPid  int64   `json:"maxPid"` // Of the command with Max
+	MaxLine int64   `json:"maxLineNo"`
+}
+
+// slowest - collects the top commands or groups
+type slowest struct {
+	by     string
+	group  string
+	top    int
+	count  int64     // Commands added
+	cmds   []slowCmd // By Value, descending - at most top
+	groups map[string]*cmdGroup
+}
+
+func newSlowest(by, group string, top int) *slowest {
+	return &slowest{by: by, group: group, top: top, groups: make(map[string]*cmdGroup)}
+}
+
+func (s *slowest) add(cmd *p4dlog.Command) {
+	s.count++
+	v := measure(cmd, s.by)
+	if s.group != groupNone {
+		s.addGroup(cmd, v)
+		return
+	}
+	if v <= 0 || (len(s.cmds) == s.top && v <= s.cmds[len(s.cmds)-1].Value) {
+		return
+	}
+	c := slowCmd{Value: v, Pid: cmd.Pid, LineNo: cmd.LineNo, User: cmd.User, Workspace: cmd.Workspace, App: cmd.App,
+		StartTime: cmd.StartTime, EndTime: cmd.EndTime, Cmd: cmd.Cmd, Args: cmd.Args}
+	i := sort.Search(len(s.cmds), func(i int) bool { return s.cmds[i].Value < v })
+	s.cmds = append(s.cmds, slowCmd{})
+	copy(s.cmds[i+1:], s.cmds[i:])
+	s.cmds[i] = c
+	if len(s.cmds) > s.top {
+		s.cmds = s.cmds[:s.top]
+	}
+}
+
+func (s *slowest) addGroup(cmd *p4dlog.Command, v float64) {
+	g := cmdGroup{}
+	if s.group == groupCmd || s.group == groupCmdUser {
+		g.Cmd = cmd.Cmd
+	}
+	if s.group == groupUser || s.group == groupCmdUser {
+		g.User = cmd.User
+	}
+	key := g.Cmd + "\x00" + g.User
+	pg, ok := s.groups[key]
+	if !ok {
+		pg = &g
+		s.groups[key] = pg
+	}
+	pg.Count++
+	pg.Total += v
+	if v > pg.Max || pg.Count == 1 {
+		pg.Max = v
+		pg.MaxPid = cmd.Pid
+		pg.MaxLine = cmd.LineNo
+	}
+}
+
+// topGroups returns the top groups by max, then total
+func (s *slowest) topGroups() []cmdGroup {
+	groups := make([]cmdGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Max != groups[j].Max {
+			return groups[i].Max > groups[j].Max
+		}
+		if groups[i].Total != groups[j].Total {
+			return groups[i].Total > groups[j].Total
+		}
+		return groups[i].Cmd+"\x00"+groups[i].User < groups[j].Cmd+"\x00"+groups[j].User
+	})
+	if len(groups) > s.top {
+		groups = groups[:s.top]
+	}
+	return groups
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(timeFormat)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+// writeText writes a report with aligned columns
+func (s *slowest) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if s.group == groupNone {
+		fmt.Fprintf(tw, "Slowest %d of %d commands by %s (seconds):\n", len(s.cmds), s.count, s.by)
+		fmt.Fprintf(tw, "%s\tPID\tLINE\tUSER\tWORKSPACE\tAPP\tSTART\tEND\tCOMMAND\n", strings.ToUpper(s.by))
+		for _, c := range s.cmds {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s %s\n", formatValue(c.Value), c.Pid, c.LineNo, c.User,
+				c.Workspace, c.App, formatTime(c.StartTime), formatTime(c.EndTime), c.Cmd, c.Args)
+		}
+		return tw.Flush()
+	}
+	groups := s.topGroups()
+	fmt.Fprintf(tw, "Slowest %d groups by %s of %d commands by max %s (seconds):\n", len(groups), s.group, s.count, s.by)
+	fmt.Fprintf(tw, "CMD\tUSER\tCOUNT\tTOTAL\tMAX\tAVG\tMAX PID\tMAX LINE\n")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%d\t%d\n", g.Cmd, g.User, g.Count, formatValue(g.Total),
+			formatValue(g.Max), formatValue(g.Total/float64(g.Count)), g.MaxPid, g.MaxLine)
+	}
+	return tw.Flush()
+}
+
+var csvCmdHeader = []string{"Value", "Pid", "Line", "User", "Workspace", "App", "Start", "End", "Cmd", "Args"}
+var csvGroupHeader = []string{"Cmd", "User", "Count", "Total", "Max", "Avg", "MaxPid", "MaxLine"}
+
+// writeCSV writes the commands (with csvCmdHeader) or groups (with csvGroupHeader)
+func (s *slowest) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	if s.group == groupNone {
+		cw.Write(csvCmdHeader)
+		for _, c := range s.cmds {
+			cw.Write([]string{formatValue(c.Value), i(c.Pid), i(c.LineNo), c.User, c.Workspace, c.App,
+				formatTime(c.StartTime), formatTime(c.EndTime), c.Cmd, c.Args})
+		}
+	} else {
+		cw.Write(csvGroupHeader)
+		for _, g := range s.topGroups() {
+			cw.Write([]string{g.Cmd, g.User, i(g.Count), formatValue(g.Total), formatValue(g.Max),
+				formatValue(g.Total / float64(g.Count)), i(g.MaxPid), i(g.MaxLine)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes the commands or groups as a JSON array
+func (s *slowest) writeJSON(w io.Writer) error {
+	var v interface{} = append([]slowCmd{}, s.cmds...) // Empty array rather than null if none
+	if s.group != groupNone {
+		v = s.topGroups()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,160 @@
+package main
+
+// Dashboard state, updated from parsed commands and server events, and rendered periodically as a
+// "p4 monitor" style view using ANSI escape sequences (so no curses library required).
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// ANSI - cursor home and clear screen
+const clearScreen = "\033[H\033[2J"
+
+type userTotal struct {
+	user  string
+	count int64
+	lapse float64 // Seconds
+}
+
+type dashboard struct {
+	logfile       string
+	topUsers      int
+	maxCmds       int
+	width         int
+	cmdsCompleted int64
+	userTotals    map[string]*userTotal
+	haveEvent     bool
+	activeThreads int64 // From latest server event
+	pausedThreads int64
+	logTime       time.Time // Latest time seen in log
+	logTimeSeenAt time.Time // Wall clock time when logTime was seen
+	speed         float64   // Log time elapsed per wall clock time - more than 1 when replaying
+	now           func() time.Time
+}
+
+func newDashboard(logfile string, topUsers, maxCmds, width int) *dashboard {
+	return &dashboard{logfile: logfile, topUsers: topUsers, maxCmds: maxCmds, width: width,
+		userTotals: make(map[string]*userTotal), speed: 1, now: time.Now}
+}
+
+func (d *dashboard) seen(t time.Time) {
+	if t.After(d.logTime) {
+		d.logTime = t
+		d.logTimeSeenAt = d.now()
+	}
+}
+
+// currentLogTime - log times are p4d server local time, so the latest seen is advanced by elapsed wall clock time
+// (for when the log is quiet) rather than comparing with the local clock
+func (d *dashboard) currentLogTime() time.Time {
+	if d.logTime.IsZero() {
+		return d.logTime
+	}
+	return d.logTime.Add(time.Duration(float64(d.now().Sub(d.logTimeSeenAt)) * d.speed))
+}
+
+func (d *dashboard) addCmd(cmd *p4dlog.Command) {
+	d.cmdsCompleted++
+	d.seen(cmd.StartTime)
+	d.seen(cmd.EndTime)
+	u, ok := d.userTotals[cmd.User]
+	if !ok {
+		u = &userTotal{user: cmd.User}
+		d.userTotals[cmd.User] = u
+	}
+	u.count++
+	u.lapse += float64(cmd.CompletedLapse)
+}
+
+func (d *dashboard) addEvent(evt *p4dlog.ServerEvent) {
+	d.haveEvent = true
+	d.activeThreads = evt.ActiveThreads
+	d.pausedThreads = evt.PausedThreads
+	d.seen(evt.EventTime)
+}
+
+func (d *dashboard) sortedUsers() []*userTotal {
+	users := make([]*userTotal, 0, len(d.userTotals))
+	for _, u := range d.userTotals {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].lapse != users[j].lapse {
+			return users[i].lapse > users[j].lapse
+		}
+		return users[i].user < users[j].user
+	})
+	if len(users) > d.topUsers {
+		users = users[:d.topUsers]
+	}
+	return users
+}
+
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return d.Round(time.Second).String()
+}
+
+// render writes the dashboard, given the currently running commands (oldest first)
+func (d *dashboard) render(w io.Writer, running []p4dlog.Command, linesRead int64, clear bool) {
+	for i := range running {
+		d.seen(running[i].StartTime)
+	}
+	now := d.currentLogTime()
+	var b strings.Builder
+	if clear {
+		b.WriteString(clearScreen)
+	}
+	logTime := "-"
+	if !now.IsZero() {
+		logTime = now.Format("2006/01/02 15:04:05")
+	}
+	fmt.Fprintf(&b, "p4dtop - %s   log time %s   lines read %d\n", d.logfile, logTime, linesRead)
+	threads := fmt.Sprintf("%d", len(running))
+	paused := "-"
+	if d.haveEvent {
+		threads = fmt.Sprintf("%d (from server) %d (from log)", d.activeThreads, len(running))
+		paused = fmt.Sprintf("%d", d.pausedThreads)
+	}
+	fmt.Fprintf(&b, "Threads running: %s   paused: %s   commands completed: %d\n\n", threads, paused, d.cmdsCompleted)
+
+	const cmdFormat = "%7s %-16s %-20s %-16s %9s  %s"
+	fmt.Fprintf(&b, cmdFormat+"\n", "PID", "USER", "WORKSPACE", "APP", "RUNNING", "COMMAND")
+	// Oldest (so longest running) first
+	for i := 0; i < len(running) && i < d.maxCmds; i++ {
+		c := &running[i]
+		line := fmt.Sprintf(cmdFormat, fmt.Sprintf("%d", c.Pid), truncate(c.User, 16), truncate(c.Workspace, 20),
+			truncate(c.App, 16), formatDuration(now.Sub(c.StartTime)), strings.TrimSpace(c.Cmd+" "+c.Args))
+		b.WriteString(truncate(line, d.width) + "\n")
+	}
+	if len(running) > d.maxCmds {
+		fmt.Fprintf(&b, "... and %d more\n", len(running)-d.maxCmds)
+	}
+
+	fmt.Fprintf(&b, "\nTop users by cumulative lapse of completed commands:\n")
+	const userHeader = "%-20s %8s %12s\n"
+	fmt.Fprintf(&b, userHeader, "USER", "CMDS", "LAPSE")
+	for _, u := range d.sortedUsers() {
+		fmt.Fprintf(&b, userHeader, truncate(u.user, 20), fmt.Sprintf("%d", u.count),
+			formatDuration(time.Duration(u.lapse*float64(time.Second))))
+	}
+	io.WriteString(w, b.String())
+}
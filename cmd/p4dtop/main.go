@@ -0,0 +1,153 @@
+package main
+
+// p4dtop - live terminal view of a p4d log as it is written: currently running commands, running/paused thread
+// counts and top users by cumulative lapse. Similar to "p4 monitor show" but derived purely from the log.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/perforce/p4prometheus/version"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logtail"
+)
+
+func main() {
+	var (
+		logfile = kingpin.Arg(
+			"logfile",
+			"Log file to follow.").Required().String()
+		debug = kingpin.Flag(
+			"debug",
+			"Enable debugging level (logging written to stderr - redirect it to a file).",
+		).Int()
+		interval = kingpin.Flag(
+			"interval",
+			"Interval between display refreshes.",
+		).Short('i').Default("2s").Duration()
+		fromStart = kingpin.Flag(
+			"from.start",
+			"Read the log from the start rather than only new lines written. Useful for recently rotated logs, so that commands already running are known.",
+		).Bool()
+		topUsers = kingpin.Flag(
+			"top.users",
+			"Number of users to show by cumulative lapse.",
+		).Default("10").Int()
+		maxCmds = kingpin.Flag(
+			"max.cmds",
+			"Maximum number of running commands to show (longest running first).",
+		).Default("25").Int()
+		width = kingpin.Flag(
+			"width",
+			"Width of display (longer lines are truncated).",
+		).Default("160").Int()
+		noCompletionRecords = kingpin.Flag(
+			"no.completion.records",
+			"Set if logs were generated with server=1 and thus no completion records expected.",
+		).Bool()
+		replaySpeed = kingpin.Flag(
+			"replay.speed",
+			"Replay a historical log from the start, paced by its timestamps at this multiple of real time (e.g. 10), to see past incidents as they happened. Implies --from.start.",
+		).Float64()
+	)
+	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("p4dtop")).Author("Robert Cowham")
+	kingpin.CommandLine.Help = `Follows a p4d text log as it is written (like tail -F) and displays a live view of currently running commands,
+running/paused thread counts and top users by cumulative lapse of completed commands, refreshing every few seconds.
+
+Usage examples:
+
+	p4dtop /p4/1/logs/log
+	p4dtop --from.start -i 5s /p4/1/logs/log
+	p4dtop --replay.speed 10 /p4/1/logs/log.2024-03-01
+`
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	if *debug > 0 {
+		logger.Level = logrus.DebugLevel
+	}
+	if _, err := os.Stat(*logfile); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	if *replaySpeed < 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: --replay.speed must not be negative\n")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	opts := []p4dlog.Option{p4dlog.WithLogger(logger), p4dlog.WithDurations(time.Second, 30*time.Second),
+		p4dlog.WithDebugMode(*debug)}
+	if *noCompletionRecords {
+		opts = append(opts, p4dlog.WithNoCompletionRecords())
+	}
+	fp, _ := p4dlog.NewParser(opts...) // No features set, so can't fail
+
+	linesChan := make(chan string, 10000)
+	tl := logtail.New(logger, *logfile, *fromStart || *replaySpeed > 0)
+	go func() {
+		if err := tl.Tail(ctx, linesChan); err != nil {
+			logger.Errorf("Failed to read %s: %v", *logfile, err)
+			cancel()
+		}
+	}()
+	parserLinesChan := linesChan
+	if *replaySpeed > 0 {
+		parserLinesChan = make(chan string, 10000)
+		go p4dlog.Replay(ctx, linesChan, parserLinesChan, *replaySpeed)
+	}
+	cmdChan := fp.LogParser(ctx, parserLinesChan, nil) // Completed commands output in real time
+
+	var m sync.Mutex
+	dash := newDashboard(*logfile, *topUsers, *maxCmds, *width)
+	if *replaySpeed > 0 {
+		dash.speed = *replaySpeed
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for c := range cmdChan {
+			m.Lock()
+			switch c := c.(type) {
+			case p4dlog.Command:
+				dash.addCmd(&c)
+			case p4dlog.ServerEvent:
+				dash.addEvent(&c)
+			}
+			m.Unlock()
+		}
+	}()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		running := fp.RunningCommands()
+		m.Lock()
+		dash.render(os.Stdout, running, tl.LinesRead(), *debug == 0)
+		m.Unlock()
+		select {
+		case <-ctx.Done():
+			<-done
+			return
+		case <-ticker.C:
+		}
+	}
+}
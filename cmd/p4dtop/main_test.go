@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func mustTime(t *testing.T, s string) time.Time {
+	tm, err := time.Parse("2006/01/02 15:04:05", s)
+	assert.NoError(t, err)
+	return tm
+}
+
+func TestDashboardRender(t *testing.T) {
+	wall := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := newDashboard("log", 2, 1, 200)
+	d.now = func() time.Time { return wall }
+
+	d.addCmd(&p4dlog.Command{Pid: 10, User: "fred", StartTime: mustTime(t, "2015/09/02 15:23:00"),
+		EndTime: mustTime(t, "2015/09/02 15:23:02"), CompletedLapse: 2})
+	d.addCmd(&p4dlog.Command{Pid: 11, User: "bill", StartTime: mustTime(t, "2015/09/02 15:23:01"),
+		EndTime: mustTime(t, "2015/09/02 15:23:05"), CompletedLapse: 4})
+	d.addCmd(&p4dlog.Command{Pid: 12, User: "fred", StartTime: mustTime(t, "2015/09/02 15:23:05"),
+		EndTime: mustTime(t, "2015/09/02 15:23:08"), CompletedLapse: 3})
+	d.addCmd(&p4dlog.Command{Pid: 13, User: "jim", StartTime: mustTime(t, "2015/09/02 15:23:05"),
+		EndTime: mustTime(t, "2015/09/02 15:23:06"), CompletedLapse: 1})
+
+	running := []p4dlog.Command{
+		{Pid: 20, User: "robert", Workspace: "robert-test", App: "p4/2016.2", Cmd: "user-sync", Args: "//...",
+			StartTime: mustTime(t, "2015/09/02 15:22:00")},
+		{Pid: 21, User: "fred", Cmd: "user-info", StartTime: mustTime(t, "2015/09/02 15:23:07")},
+	}
+	// Log quiet for 2 more seconds
+	wall = wall.Add(2 * time.Second)
+	var b bytes.Buffer
+	d.render(&b, running, 42, false)
+	out := b.String()
+	assert.Contains(t, out, "p4dtop - log   log time 2015/09/02 15:23:10   lines read 42\n")
+	assert.Contains(t, out, "Threads running: 2   paused: -   commands completed: 4\n")
+	assert.Contains(t, out, "robert-test")
+	assert.Contains(t, out, "1m10s  user-sync //...")
+	assert.NotContains(t, out, "user-info")
+	assert.Contains(t, out, "... and 1 more\n")
+	users := out[strings.Index(out, "Top users"):]
+	assert.Less(t, strings.Index(users, "fred"), strings.Index(users, "bill"))
+	assert.Contains(t, users, "5s")
+	assert.NotContains(t, users, "jim")
+	assert.False(t, strings.HasPrefix(out, clearScreen))
+
+	d.addEvent(&p4dlog.ServerEvent{EventTime: mustTime(t, "2015/09/02 15:23:20"), ActiveThreads: 5, PausedThreads: 1})
+	b.Reset()
+	d.render(&b, running, 50, true)
+	out = b.String()
+	assert.True(t, strings.HasPrefix(out, clearScreen))
+	assert.Contains(t, out, "log time 2015/09/02 15:23:20")
+	assert.Contains(t, out, "Threads running: 5 (from server) 2 (from log)   paused: 1   commands completed: 4\n")
+}
+
+func TestDashboardReplaySpeed(t *testing.T) {
+	wall := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := newDashboard("log", 2, 1, 200)
+	d.now = func() time.Time { return wall }
+	d.speed = 10
+	d.addCmd(&p4dlog.Command{Pid: 10, User: "fred", StartTime: mustTime(t, "2015/09/02 15:23:00"),
+		EndTime: mustTime(t, "2015/09/02 15:23:02"), CompletedLapse: 2})
+	wall = wall.Add(2 * time.Second)
+	assert.Equal(t, mustTime(t, "2015/09/02 15:23:22"), d.currentLogTime())
+}
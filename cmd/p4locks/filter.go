@@ -0,0 +1,115 @@
+package main
+
+// Filtering of the commands whose locks are output - see --start/--end/--user/--pid. Investigating an incident in a
+// huge log usually only needs a short time window, or a few users/pids, and a chart of tens of thousands of records
+// is too slow for browsers to filter. Logs are still parsed in full, as commands span many lines.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Format of --start/--end, as for timestamps in the log
+const filterTimeFormat = "2006/01/02 15:04:05"
+
+// cmdFilter - a nil filter matches everything
+type cmdFilter struct {
+	user  *regexp.Regexp
+	pids  map[int64]bool
+	start time.Time
+	end   time.Time
+}
+
+// newCmdFilter returns nil if no criteria are specified
+func newCmdFilter(user string, pids []int64, start, end string) (*cmdFilter, error) {
+	if user == "" && len(pids) == 0 && start == "" && end == "" {
+		return nil, nil
+	}
+	f := &cmdFilter{}
+	var err error
+	if user != "" {
+		if f.user, err = regexp.Compile(user); err != nil {
+			return nil, fmt.Errorf("invalid --user: %v", err)
+		}
+	}
+	if len(pids) > 0 {
+		f.pids = make(map[int64]bool, len(pids))
+		for _, pid := range pids {
+			f.pids[pid] = true
+		}
+	}
+	if start != "" {
+		if f.start, err = time.Parse(filterTimeFormat, start); err != nil {
+			return nil, fmt.Errorf("invalid --start, expected format %s: %v", filterTimeFormat, err)
+		}
+	}
+	if end != "" {
+		if f.end, err = time.Parse(filterTimeFormat, end); err != nil {
+			return nil, fmt.Errorf("invalid --end, expected format %s: %v", filterTimeFormat, err)
+		}
+	}
+	if !f.start.IsZero() && !f.end.IsZero() && f.end.Before(f.start) {
+		return nil, fmt.Errorf("--end %s is before --start %s", end, start)
+	}
+	return f, nil
+}
+
+// match returns true if the command's locks are to be output - i.e. the user and pid match, and it was running at
+// some point within the time window
+func (f *cmdFilter) match(cmd *p4dlog.Command) bool {
+	if f == nil {
+		return true
+	}
+	if f.user != nil && !f.user.MatchString(cmd.User) {
+		return false
+	}
+	if f.pids != nil && !f.pids[cmd.Pid] {
+		return false
+	}
+	end := cmd.EndTime
+	if end.IsZero() || end.Before(cmd.StartTime) {
+		end = cmd.StartTime
+	}
+	if !f.start.IsZero() && end.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && cmd.StartTime.After(f.end) {
+		return false
+	}
+	return true
+}
+
+// String describes the criteria, for the chart summary
+func (f *cmdFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	if !f.start.IsZero() {
+		parts = append(parts, "start: "+f.start.Format(filterTimeFormat))
+	}
+	if !f.end.IsZero() {
+		parts = append(parts, "end: "+f.end.Format(filterTimeFormat))
+	}
+	if f.user != nil {
+		parts = append(parts, "user: "+f.user.String())
+	}
+	if len(f.pids) > 0 {
+		pids := make([]int64, 0, len(f.pids))
+		for pid := range f.pids {
+			pids = append(pids, pid)
+		}
+		sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+		s := make([]string, len(pids))
+		for i, pid := range pids {
+			s[i] = fmt.Sprintf("%d", pid)
+		}
+		parts = append(parts, "pids: "+strings.Join(s, " "))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -3,12 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"regexp"
 	"strings"
@@ -26,6 +24,7 @@ import (
 
 	"github.com/perforce/p4prometheus/version"
 	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/rcowham/go-libp4dlog/internal/logreader"
 )
 
 // Threshold in milliseconds below which we filter out commands - for at least one of read/write wait/held
@@ -44,33 +43,6 @@ func byteCountDecimal(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-func readerFromFile(file *os.File) (io.Reader, int64, error) {
-	//create a bufio.Reader so we can 'peek' at the first few bytes
-	bReader := bufio.NewReader(file)
-	testBytes, err := bReader.Peek(64) //read a few bytes without consuming
-	if err != nil {
-		return nil, 0, err
-	}
-	var fileSize int64
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-	fileSize = stat.Size()
-
-	// Detect if the content is gzipped
-	contentType := http.DetectContentType(testBytes)
-	if strings.Contains(contentType, "x-gzip") {
-		gzipReader, err := gzip.NewReader(bReader)
-		if err != nil {
-			return nil, 0, err
-		}
-		// Estimate filesize
-		return gzipReader, fileSize * 20, nil
-	}
-	return bReader, fileSize, nil
-}
-
 // chart header followed by data records
 func writeHeader(f *bufio.Writer, thresholdFilter int64) error {
 	header := `
@@ -121,8 +93,8 @@ func writeHeader(f *bufio.Writer, thresholdFilter int64) error {
 	return err
 }
 
-// chart trailer
-func writeTrailer(f *bufio.Writer, params string) error {
+// chart trailer - dataFile if set is the (relative) URL of the JSON data file from which to load records
+func writeTrailer(f *bufio.Writer, params string, dataFile string) error {
 	trailer := `
 ];
 
@@ -131,6 +103,8 @@ func writeTrailer(f *bufio.Writer, params string) error {
 	var readWaitColor = '#8E44AD';
 	var writeHeldColor = '#C70039';
 	var writeWaitColor = '#FFC300';
+	var peekHeldColor = '#28B463';
+	var peekWaitColor = '#A9DFBF';
 
 	var perforceTableLockOrder = [
 		"db.config",
@@ -400,6 +374,40 @@ func writeTrailer(f *bufio.Writer, params string) error {
 					data.addRows(rows);
 				}
 			}
+
+			var peek_start = start;
+			var peek_end = start
+			if (command.Peek) {
+				var rows = [];
+
+				if (command.Peek.Wait > 0) {
+					peek_end = new Date(peek_end.getTime() + toMilliseconds(command.Peek.Wait));
+					rows.push([
+							command.Table,
+							"Peek Wait" + " ("+command.Pid+")",
+							peekWaitColor,
+							getTooltip(command, command.Peek.Wait),
+							peek_start,
+							peek_end
+					]);
+				}
+
+				if (command.Peek.Held > 0) {
+					peek_start = peek_end;
+					peek_end = new Date(peek_end.getTime() + toMilliseconds(command.Peek.Held));
+					rows.push([
+							command.Table,
+							"Peek Held" + " ("+command.Pid+")",
+							peekHeldColor,
+							getTooltip(command, command.Peek.Held),
+							peek_start,
+							peek_end
+					]);
+				}
+				if (rows.length > 0){
+					data.addRows(rows);
+				}
+			}
 		}
 
 		return data;
@@ -433,7 +441,17 @@ func writeTrailer(f *bufio.Writer, params string) error {
 	});
 
 	google.charts.load("current", {packages:["timeline"]});
+{{- if .dataFile }}
+	// Records are loaded from separate JSON data file
+	google.charts.setOnLoadCallback(function() {
+		fetch('{{ .dataFile }}')
+			.then(response => response.json())
+			.then(records => { base_data = records; drawChart(); })
+			.catch(err => { document.getElementById('txtSummary').innerHTML = 'Failed to load data file {{ .dataFile }}: ' + err; });
+	});
+{{- else }}
 	google.charts.setOnLoadCallback(drawChart);
+{{- end }}
 
 </script>
 
@@ -443,7 +461,8 @@ func writeTrailer(f *bufio.Writer, params string) error {
 	var buf bytes.Buffer
 	templ := template.Must(template.New("myname").Parse(trailer))
 	templ.Execute(&buf, map[string]interface{}{
-		"params": params,
+		"params":   params,
+		"dataFile": dataFile,
 	})
 
 	_, err := fmt.Fprint(f, buf.String())
@@ -474,6 +493,7 @@ type DataRec struct {
 	MaxLock        int64     `json:"MaxLock"` // Max of any read/write wait/held value - for filtering results
 	ReadLock       *LockRec  `json:"Read,omitempty"`
 	WriteLock      *LockRec  `json:"Write,omitempty"`
+	PeekLock       *LockRec  `json:"Peek,omitempty"` // Lockless reads (peeking)
 }
 
 func (d *DataRec) setMaxLock() {
@@ -491,6 +511,13 @@ func (d *DataRec) setMaxLock() {
 			d.MaxLock = d.WriteLock.TotalWait
 		}
 	}
+	if d.PeekLock != nil {
+		if d.PeekLock.TotalHeld > d.PeekLock.TotalWait {
+			d.MaxLock = d.PeekLock.TotalHeld
+		} else {
+			d.MaxLock = d.PeekLock.TotalWait
+		}
+	}
 }
 
 // P4DLocks structure
@@ -503,8 +530,27 @@ type P4DLocks struct {
 	linesChan           chan string
 	countTotal          int
 	countOutput         int
+	countSkipped        int           // Not matching --start/--end/--user/--pid
+	fHTML               *bufio.Writer // nil if HTML loads records from JSON file
+	fJSON               *bufio.Writer
+	fCSV                *csv.Writer
+	summary             *lockSummary // nil unless --summary/--summary.csv
+}
+
+// excludedTable returns true if tableName (without db. prefix) matches --exclude.tables
+func (pl *P4DLocks) excludedTable(tableName string) bool {
+	if pl.excludeTablesString == "" {
+		return false
+	}
+	if pl.excludeTablesRegex == nil {
+		regexStr := fmt.Sprintf("(%s)", pl.excludeTablesString)
+		pl.excludeTablesRegex = regexp.MustCompile(regexStr)
+	}
+	return pl.excludeTablesRegex.MatchString(tableName)
 }
 
+// lockRecs returns a record for each table read/write/peek lock of cmd exceeding the threshold, e.g.
+//
 //	{
 //		"Table": "db.revsx",
 //		"Pid": 72052,
@@ -516,19 +562,15 @@ type P4DLocks struct {
 //			"Held": 554000000
 //		}
 //	}
-func (pl *P4DLocks) writeCmd(f *bufio.Writer, cmd *p4dlog.Command) error {
-	for _, t := range cmd.Tables {
-		if pl.excludeTablesString != "" {
-			if pl.excludeTablesRegex == nil {
-				regexStr := fmt.Sprintf("(%s)", pl.excludeTablesString)
-				pl.excludeTablesRegex = regexp.MustCompile(regexStr)
-			}
-			if pl.excludeTablesRegex.MatchString(t.TableName) {
-				continue
-			}
+func (pl *P4DLocks) lockRecs(cmd *p4dlog.Command) []DataRec {
+	recs := make([]DataRec, 0)
+	for _, t := range cmd.TablesWithLocks() {
+		if pl.excludedTable(t.TableName) {
+			continue
 		}
 		if t.TotalReadHeld > thresholdFilter || t.TotalReadWait > thresholdFilter ||
-			t.TotalWriteHeld > thresholdFilter || t.TotalWriteWait > thresholdFilter {
+			t.TotalWriteHeld > thresholdFilter || t.TotalWriteWait > thresholdFilter ||
+			t.TotalPeekHeld > thresholdFilter || t.TotalPeekWait > thresholdFilter {
 			rec := DataRec{
 				CmdArgs:        fmt.Sprintf("%s %s", cmd.Cmd, cmd.Args),
 				Pid:            cmd.Pid,
@@ -551,18 +593,7 @@ func (pl *P4DLocks) writeCmd(f *bufio.Writer, cmd *p4dlog.Command) error {
 					TotalHeld: t.TotalReadHeld,
 				}
 				rec.setMaxLock()
-				j, _ := json.Marshal(rec)
-				if pl.countOutput > 0 {
-					_, err := fmt.Fprintf(f, ",\n")
-					if err != nil {
-						return err
-					}
-				}
-				_, err := fmt.Fprintf(f, "%s", string(j))
-				if err != nil {
-					return err
-				}
-				pl.countOutput += 1
+				recs = append(recs, rec)
 			}
 			if t.TotalWriteHeld > thresholdFilter || t.TotalWriteWait > thresholdFilter {
 				rec.ReadLock = nil
@@ -571,20 +602,49 @@ func (pl *P4DLocks) writeCmd(f *bufio.Writer, cmd *p4dlog.Command) error {
 					TotalHeld: t.TotalWriteHeld,
 				}
 				rec.setMaxLock()
-				j, _ := json.Marshal(rec)
-				if pl.countOutput > 0 {
-					_, err := fmt.Fprintf(f, ",\n")
-					if err != nil {
-						return err
-					}
+				recs = append(recs, rec)
+			}
+			if t.TotalPeekHeld > thresholdFilter || t.TotalPeekWait > thresholdFilter {
+				rec.ReadLock = nil
+				rec.WriteLock = nil
+				rec.PeekLock = &LockRec{
+					TotalWait: t.TotalPeekWait,
+					TotalHeld: t.TotalPeekHeld,
 				}
-				_, err := fmt.Fprintf(f, "%s", string(j))
+				rec.setMaxLock()
+				recs = append(recs, rec)
+			}
+		}
+	}
+	return recs
+}
+
+// writeCmd writes a record for each table lock of cmd exceeding the threshold to the HTML (unless it loads
+// records from the JSON file), JSON and CSV outputs as requested
+func (pl *P4DLocks) writeCmd(cmd *p4dlog.Command) error {
+	for _, rec := range pl.lockRecs(cmd) {
+		j, _ := json.Marshal(rec)
+		for _, f := range []*bufio.Writer{pl.fHTML, pl.fJSON} {
+			if f == nil {
+				continue
+			}
+			if pl.countOutput > 0 {
+				_, err := fmt.Fprintf(f, ",\n")
 				if err != nil {
 					return err
 				}
-				pl.countOutput += 1
+			}
+			_, err := fmt.Fprintf(f, "%s", string(j))
+			if err != nil {
+				return err
+			}
+		}
+		if pl.fCSV != nil {
+			if err := pl.fCSV.Write(rec.csvRecord()); err != nil {
+				return err
 			}
 		}
+		pl.countOutput += 1
 	}
 	return nil
 }
@@ -603,18 +663,16 @@ func (pl *P4DLocks) parseLog(logfile string) {
 	}
 	defer file.Close()
 
-	const maxCapacity = 5 * 1024 * 1024
 	ctx := context.Background()
-	inbuf := make([]byte, maxCapacity)
-	reader, fileSize, err := readerFromFile(file)
+	reader, fileSize, err := logreader.FromFile(file)
 	if err != nil {
 		pl.logger.Fatalf("Failed to open file: %v", err)
 	}
+	defer reader.Close()
 	pl.logger.Debugf("Opened %s, size %v", logfile, fileSize)
-	reader = bufio.NewReaderSize(reader, maxCapacity)
 	preader := progress.NewReader(reader)
-	scanner := bufio.NewScanner(preader)
-	scanner.Buffer(inbuf, maxCapacity)
+	const maxLine = 10000
+	lr := p4dlog.NewLineReader(preader, maxLine)
 
 	// Start a goroutine printing progress
 	go func() {
@@ -640,20 +698,13 @@ func (pl *P4DLocks) parseLog(logfile string) {
 		fmt.Fprintln(os.Stderr, "processing completed")
 	}()
 
-	const maxLine = 10000
 	i := 0
-	for scanner.Scan() {
-		// Use time records in log to cause ticks for log parser
-		if len(scanner.Text()) > maxLine {
-			line := fmt.Sprintf("%s...'", scanner.Text()[0:maxLine])
-			pl.linesChan <- line
-		} else {
-			pl.linesChan <- scanner.Text()
-		}
+	for lr.Scan() {
+		pl.linesChan <- lr.Text()
 		i += 1
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := lr.Err(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to read input file on line: %d, %v\n", i, err)
 	}
 
@@ -675,7 +726,7 @@ func getFilename(name, suffix string, requireSuffix bool, logfiles []string) str
 		if len(logfiles) == 0 {
 			name = "logs"
 		} else {
-			name = strings.TrimSuffix(logfiles[0], ".gz")
+			name = logreader.TrimSuffix(logfiles[0])
 			name = strings.TrimSuffix(name, ".log")
 		}
 		if !requireSuffix && !strings.HasSuffix(name, suffix) {
@@ -699,7 +750,7 @@ func openFile(outputName string) (*os.File, *bufio.Writer, error) {
 	if outputName == "-" {
 		fd = os.Stdout
 	} else {
-		fd, err = os.OpenFile(outputName, os.O_CREATE|os.O_WRONLY, 0644)
+		fd, err = os.OpenFile(outputName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -724,7 +775,7 @@ func main() {
 	var (
 		logfiles = kingpin.Arg(
 			"logfile",
-			"Log files to process (may be gzipped).").Strings()
+			"Log files to process (may be gzip, zstd or bzip2 compressed).").Strings()
 		debug = kingpin.Flag(
 			"debug",
 			"Enable debugging level.",
@@ -737,14 +788,54 @@ func main() {
 			"html.output",
 			"Name of file to which to write HTML. Defaults to <logfile-prefix>.html",
 		).Short('o').String()
+		jsonOutputFile = kingpin.Flag(
+			"json.output",
+			"Name of file to which to write lock records as JSON (an array). Not written unless specified (or --html.data.file).",
+		).Short('j').String()
+		csvOutputFile = kingpin.Flag(
+			"csv.output",
+			"Name of file to which to write lock records as CSV. Not written unless specified.",
+		).String()
+		htmlDataFile = kingpin.Flag(
+			"html.data.file",
+			"HTML loads lock records from the JSON file (--json.output, default <html-prefix>.json) rather than embedding them - for large datasets. Requires the HTML to be viewed via a web server.",
+		).Bool()
 		excludeTablesRegexString = kingpin.Flag(
 			"exclude.tables",
 			"Specify a (golang) regex to match tables to exclude from results (e.g. 'user$' or '(user|nameval)$'). No default.",
 		).Short('x').String()
+		filterStart = kingpin.Flag(
+			"start",
+			"Only output commands running at or after this time (format '2006/01/02 15:04:05' as in log).",
+		).String()
+		filterEnd = kingpin.Flag(
+			"end",
+			"Only output commands running at or before this time (format '2006/01/02 15:04:05' as in log).",
+		).String()
+		filterUser = kingpin.Flag(
+			"user",
+			"Specify a (golang) regex to match users whose commands are output (e.g. '^(fred|bill)$'). No default.",
+		).String()
+		filterPids = kingpin.Flag(
+			"pid",
+			"Only output commands with this pid. May be repeated.",
+		).Int64List()
+		summary = kingpin.Flag(
+			"summary",
+			"Print a summary of locks by table to stdout: total/max read/write/peek wait/held, commands over threshold and the top commands by held time.",
+		).Bool()
+		summaryCSVFile = kingpin.Flag(
+			"summary.csv",
+			"Name of file to which to write the summary of locks by table as CSV. Not written unless specified.",
+		).String()
+		summaryTop = kingpin.Flag(
+			"summary.top",
+			"Number of commands with the longest held locks to report per table in the summary.",
+		).Default(fmt.Sprintf("%d", defaultSummaryTop)).Int()
 	)
 	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("p4locks")).Author("Robert Cowham")
-	kingpin.CommandLine.Help = `Parses one or more p4d text log files (which may be gzipped) and outputs an HTML file with a Google Charts timeline with information about locks.
-Locks are listed by table and then pids with read/write wait/held.
+	kingpin.CommandLine.Help = `Parses one or more p4d text log files (which may be gzip, zstd or bzip2 compressed) and outputs an HTML file with a Google Charts timeline with information about locks.
+Locks are listed by table and then pids with read/write/peek wait/held.
 The output file can be opened locally by any browser (although internet access required to download JS).
 
 Usage examples:
@@ -757,6 +848,19 @@ Use a lower default threshold (ms):
 
 Process multiple log files (gzipped or not) into single output file:
 	p4locks -o report.html log-2023-*.gz
+
+Also write lock records as CSV for post-processing:
+	p4locks --csv.output locks.csv my.log
+
+Large dataset - HTML loads records from report.json (view via web server, e.g. "python3 -m http.server"):
+	p4locks -o report.html --html.data.file -j report.json log-2023-*.gz
+
+Print a summary of locks by table (and write it as CSV):
+	p4locks --summary --summary.csv summary.csv my.log
+
+Narrow a huge log to an incident window, and/or to particular users or pids:
+	p4locks --start "2023/03/01 10:00:00" --end "2023/03/01 10:30:00" log
+	p4locks --user '^build' --pid 1234 --pid 5678 log
 `
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
@@ -768,6 +872,11 @@ Process multiple log files (gzipped or not) into single output file:
 			os.Exit(1)
 		}
 	}
+	filter, err := newCmdFilter(*filterUser, *filterPids, *filterStart, *filterEnd)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		os.Exit(1)
+	}
 
 	if *debug > 0 {
 		// CPU profiling by default
@@ -802,7 +911,8 @@ Process multiple log files (gzipped or not) into single output file:
 	startTime := time.Now()
 	logger.Infof("%v", version.Print("p4locks"))
 	logger.Infof("Starting %s, Logfiles: %v", startTime, *logfiles)
-	logger.Infof("Flags: debug %v, htmlfile %v, threshold (ms) %v", *debug, *htmlOutputFile, *threshold)
+	logger.Infof("Flags: debug %v, htmlfile %v, jsonfile %v, csvfile %v, htmldatafile %v, threshold (ms) %v, filter '%v'",
+		*debug, *htmlOutputFile, *jsonOutputFile, *csvOutputFile, *htmlDataFile, *threshold, filter)
 
 	linesChan := make(chan string, 10000)
 
@@ -820,20 +930,65 @@ Process multiple log files (gzipped or not) into single output file:
 	defer fHTML.Flush()
 	logger.Infof("Creating HTML output: %s", htmlFilename)
 
+	var fJSON *bufio.Writer
+	var fdJSON *os.File
+	var jsonFilename, dataFile string
+	if *jsonOutputFile != "" || *htmlDataFile {
+		name := *jsonOutputFile
+		if name == "" && *htmlDataFile && htmlFilename != "-" {
+			// Alongside the HTML
+			name = strings.TrimSuffix(htmlFilename, ".html") + ".json"
+		}
+		jsonFilename = getJSONFilename(name, *logfiles)
+		fdJSON, fJSON, err = openFile(jsonFilename)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer fdJSON.Close()
+		defer fJSON.Flush()
+		logger.Infof("Creating JSON output: %s", jsonFilename)
+		if err = writeJSONHeader(fJSON); err != nil {
+			logger.Errorf("Failed to write JSON header: %v", err)
+		}
+		if *htmlDataFile {
+			dataFile = dataFileURL(htmlFilename, jsonFilename)
+		}
+	}
+	var fCSV *csv.Writer
+	if *csvOutputFile != "" {
+		fdCSV, fCSVBuf, err := openFile(*csvOutputFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer fdCSV.Close()
+		defer fCSVBuf.Flush()
+		logger.Infof("Creating CSV output: %s", *csvOutputFile)
+		fCSV = csv.NewWriter(fCSVBuf)
+		defer fCSV.Flush()
+		if err = fCSV.Write(csvHeader); err != nil {
+			logger.Errorf("Failed to write CSV header: %v", err)
+		}
+	}
+
 	var wg sync.WaitGroup
 	var fp *p4dlog.P4dFileParser
 	var cmdChan chan interface{}
 
-	fp = p4dlog.NewP4dFileParser(logger)
+	fp, _ = p4dlog.NewParser(p4dlog.WithLogger(logger), p4dlog.WithDebugMode(*debug))
 	pl := &P4DLocks{
 		debug:               *debug,
 		excludeTablesString: *excludeTablesRegexString,
 		logger:              logger,
 		fp:                  fp,
 		linesChan:           linesChan,
+		fJSON:               fJSON,
+		fCSV:                fCSV,
 	}
-	if *debug > 0 {
-		fp.SetDebugMode(*debug)
+	if dataFile == "" {
+		pl.fHTML = fHTML
+	}
+	if *summary || *summaryCSVFile != "" {
+		pl.summary = newLockSummary(*summaryTop)
 	}
 	cmdChan = fp.LogParser(ctx, linesChan, nil)
 
@@ -854,21 +1009,48 @@ Process multiple log files (gzipped or not) into single output file:
 		switch cmd := cmd.(type) {
 		case p4dlog.Command:
 			pl.countTotal += 1
-			err := pl.writeCmd(fHTML, &cmd)
+			if !filter.match(&cmd) {
+				pl.countSkipped += 1
+				continue
+			}
+			err := pl.writeCmd(&cmd)
 			if err != nil {
 				logger.Errorf("Failed to write cmd: %v", err)
 			}
+			if pl.summary != nil {
+				pl.summary.add(&cmd, pl.excludedTable)
+			}
 			if pl.countTotal%1000 == 0 {
 				fHTML.Flush()
 			}
 		}
 	}
-	err = writeTrailer(fHTML, fmt.Sprintf("extraction threshold (ms): %d, excluded tables: %s", thresholdFilter, pl.excludeTablesString))
+	params := fmt.Sprintf("extraction threshold (ms): %d, excluded tables: %s", thresholdFilter, pl.excludeTablesString)
+	if filter != nil {
+		params += ", " + filter.String()
+	}
+	err = writeTrailer(fHTML, params, dataFile)
 	if err != nil {
 		logger.Errorf("Failed to write trailer: %v", err)
 	}
+	if fJSON != nil {
+		if err = writeJSONTrailer(fJSON); err != nil {
+			logger.Errorf("Failed to write JSON trailer: %v", err)
+		}
+	}
+
+	if *summary {
+		if err = pl.summary.writeText(os.Stdout); err != nil {
+			logger.Errorf("Failed to write summary: %v", err)
+		}
+	}
+	if *summaryCSVFile != "" {
+		if err = writeSummaryCSV(*summaryCSVFile, pl.summary); err != nil {
+			logger.Errorf("Failed to write summary CSV: %v", err)
+		}
+	}
 
 	wg.Wait()
-	logger.Infof("Completed %s, elapsed %s, cmds total %d, filtered output count %d",
-		time.Now(), time.Since(startTime), pl.countTotal, pl.countOutput)
+	logger.Infof("Completed %s, elapsed %s, cmds total %d, skipped by filter %d, filtered output count %d",
+		time.Now(), time.Since(startTime), pl.countTotal, pl.countSkipped, pl.countOutput)
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func TestWriteCmdOutputs(t *testing.T) {
+	startTime := time.Date(2022, 2, 2, 15, 15, 14, 0, time.UTC)
+	cmd := p4dlog.Command{Pid: 72052, Cmd: "user-sync", Args: "-n //data/...", User: "build", Workspace: "build_ws",
+		LineNo: 12, StartTime: startTime, EndTime: startTime.Add(20 * time.Second), CompletedLapse: 20.5,
+		Tables: map[string]*p4dlog.Table{
+			"revsx": {TableName: "revsx", TotalReadHeld: 15000},
+			"have":  {TableName: "have", TotalReadWait: 12000, TotalWriteHeld: 11000},
+			"user":  {TableName: "user", TotalReadHeld: 100},
+			"rev":   {TableName: "rev", TotalReadHeld: 100, TotalPeekWait: 500, TotalPeekHeld: 13000},
+		}}
+
+	var htmlBuf, jsonBuf, csvBuf bytes.Buffer
+	fHTML := bufio.NewWriter(&htmlBuf)
+	fJSON := bufio.NewWriter(&jsonBuf)
+	fCSVBuf := bufio.NewWriter(&csvBuf)
+	pl := &P4DLocks{fHTML: fHTML, fJSON: fJSON, fCSV: csv.NewWriter(fCSVBuf)}
+	assert.NoError(t, writeJSONHeader(fJSON))
+	assert.NoError(t, pl.fCSV.Write(csvHeader))
+	assert.NoError(t, pl.writeCmd(&cmd))
+	assert.NoError(t, writeJSONTrailer(fJSON))
+	fHTML.Flush()
+	fJSON.Flush()
+	pl.fCSV.Flush()
+	fCSVBuf.Flush()
+	assert.Equal(t, 4, pl.countOutput)
+
+	// HTML embeds the same records as the JSON data file
+	var recs []DataRec
+	assert.NoError(t, json.Unmarshal(jsonBuf.Bytes(), &recs))
+	assert.Equal(t, 4, len(recs))
+	assert.Contains(t, jsonBuf.String(), htmlBuf.String())
+
+	rows, err := csv.NewReader(&csvBuf).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(rows))
+	assert.Equal(t, csvHeader, rows[0])
+	byLock := make(map[string][]string)
+	for _, r := range rows[1:] {
+		byLock[r[0]+" "+r[13]] = r
+	}
+	assert.Equal(t, []string{"db.revsx", "72052", "12", "build", "build_ws", "", "2022-02-02T15:15:14Z", "2022-02-02T15:15:34Z",
+		"0", "20500", "0", "0", "0", "Read", "0", "15000", "15000", "user-sync -n //data/..."}, byLock["db.revsx Read"])
+	assert.Equal(t, "12000", byLock["db.have Read"][14])
+	assert.Equal(t, "11000", byLock["db.have Write"][15])
+	assert.Equal(t, []string{"500", "13000", "13000"}, byLock["db.rev Peek"][14:17])
+	assert.NotContains(t, byLock, "db.rev Read")
+
+	// HTML loading records from JSON file has none embedded
+	htmlBuf.Reset()
+	pl = &P4DLocks{fJSON: fJSON}
+	assert.NoError(t, pl.writeCmd(&cmd))
+	fJSON.Flush()
+	assert.Equal(t, 0, htmlBuf.Len())
+}
+
+func TestWriteTrailerDataFile(t *testing.T) {
+	var buf bytes.Buffer
+	f := bufio.NewWriter(&buf)
+	assert.NoError(t, writeTrailer(f, "params", ""))
+	f.Flush()
+	assert.Contains(t, buf.String(), "google.charts.setOnLoadCallback(drawChart);")
+	assert.NotContains(t, buf.String(), "fetch(")
+
+	buf.Reset()
+	assert.NoError(t, writeTrailer(f, "params", dataFileURL("out/report.html", "out/data/report.json")))
+	f.Flush()
+	assert.Contains(t, buf.String(), "fetch('data/report.json')")
+	assert.NotContains(t, buf.String(), "google.charts.setOnLoadCallback(drawChart);")
+}
+
+func TestCmdFilter(t *testing.T) {
+	f, err := newCmdFilter("", nil, "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+	assert.True(t, f.match(&p4dlog.Command{}))
+
+	startTime := time.Date(2022, 2, 2, 15, 15, 14, 0, time.UTC)
+	cmd := &p4dlog.Command{Pid: 72052, User: "build", StartTime: startTime, EndTime: startTime.Add(20 * time.Second)}
+
+	f, err = newCmdFilter("^bu", []int64{72052, 1}, "", "")
+	assert.NoError(t, err)
+	assert.True(t, f.match(cmd))
+	assert.Equal(t, "user: ^bu, pids: 1 72052", f.String())
+	f, err = newCmdFilter("fred", nil, "", "")
+	assert.NoError(t, err)
+	assert.False(t, f.match(cmd))
+	f, err = newCmdFilter("", []int64{1}, "", "")
+	assert.NoError(t, err)
+	assert.False(t, f.match(cmd))
+
+	// Commands running at any time within the window match
+	for _, tc := range []struct {
+		start, end string
+		match      bool
+	}{
+		{"2022/02/02 15:15:20", "2022/02/02 15:15:25", true},
+		{"2022/02/02 15:15:34", "", true},
+		{"", "2022/02/02 15:15:14", true},
+		{"2022/02/02 15:15:35", "", false},
+		{"", "2022/02/02 15:15:13", false},
+	} {
+		f, err = newCmdFilter("", nil, tc.start, tc.end)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.match, f.match(cmd), "%s - %s", tc.start, tc.end)
+	}
+	// Running commands have no end time
+	assert.True(t, f.match(&p4dlog.Command{StartTime: startTime.Add(-time.Minute)}))
+
+	_, err = newCmdFilter("(", nil, "", "")
+	assert.Error(t, err)
+	_, err = newCmdFilter("", nil, "2022-02-02 15:15:14", "")
+	assert.Error(t, err)
+	_, err = newCmdFilter("", nil, "2022/02/02 15:15:14", "2022/02/02 15:00:00")
+	assert.Error(t, err)
+}
+
+func TestLockSummary(t *testing.T) {
+	startTime := time.Date(2022, 2, 2, 15, 15, 14, 0, time.UTC)
+	s := newLockSummary(2)
+	pl := &P4DLocks{excludeTablesString: "user"}
+	for i, held := range []int64{15000, 3000, 20000} {
+		cmd := p4dlog.Command{Pid: int64(100 + i), Cmd: "user-sync", Args: "//...", User: "build", LineNo: int64(i + 1),
+			StartTime: startTime, Tables: map[string]*p4dlog.Table{
+				"rev":  {TableName: "rev", TotalReadWait: 100, TotalReadHeld: held},
+				"user": {TableName: "user", TotalReadHeld: held},
+				"have": {TableName: "have", PeekCount: 1},
+			}}
+		s.add(&cmd, pl.excludedTable)
+	}
+	cmd := p4dlog.Command{Pid: 200, Cmd: "user-submit", User: "fred", StartTime: startTime,
+		Tables: map[string]*p4dlog.Table{"locks": {TableName: "locks", TotalWriteWait: 12000, TotalWriteHeld: 500}}}
+	s.add(&cmd, pl.excludedTable)
+
+	tables := s.sorted()
+	if assert.Equal(t, 2, len(tables)) {
+		rev := tables[0]
+		assert.Equal(t, "db.rev", rev.Table)
+		assert.Equal(t, int64(3), rev.Cmds)
+		assert.Equal(t, int64(2), rev.CmdsOverThreshold)
+		assert.Equal(t, LockRec{TotalWait: 300, TotalHeld: 38000}, rev.Read)
+		assert.Equal(t, LockRec{TotalWait: 100, TotalHeld: 20000}, rev.MaxRead)
+		if assert.Equal(t, 2, len(rev.Top)) {
+			assert.Equal(t, int64(102), rev.Top[0].Pid)
+			assert.Equal(t, int64(100), rev.Top[1].Pid)
+		}
+		assert.Equal(t, "db.locks", tables[1].Table)
+		assert.Equal(t, int64(1), tables[1].CmdsOverThreshold)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, s.writeText(&buf))
+	assert.Contains(t, buf.String(), "db.rev: cmds 3, over threshold 2\n  read wait/held total 300/38000 max 100/20000\n")
+	assert.Contains(t, buf.String(), "    20000 pid 102 line 3 build 2022/02/02 15:15:14 user-sync //...\n")
+
+	buf.Reset()
+	assert.NoError(t, s.writeCSV(csv.NewWriter(&buf)))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(rows)) {
+		assert.Equal(t, summaryCSVHeader, rows[0])
+		assert.Equal(t, []string{"db.rev", "1", "102", "20000"}, []string{rows[1][0], rows[1][15], rows[1][16], rows[1][20]})
+		assert.Equal(t, []string{"db.locks", "1", "1", "0", "0", "12000", "500"}, rows[3][:7])
+		assert.Equal(t, "1", rows[3][15])
+	}
+}
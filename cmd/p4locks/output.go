@@ -0,0 +1,71 @@
+package main
+
+// Lock records may also be written as JSON and/or CSV data files for storing and post-processing with other tools.
+// For large datasets the HTML page can load the records from the JSON file rather than embedding them, which keeps
+// the page small - although browsers only allow this when the page is served by a web server rather than opened
+// as a local file.
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Column names match the JSON field names, with Lock being Read, Write or Peek
+var csvHeader = []string{"Table", "Pid", "Line", "User", "Workspace", "App", "Start", "EndTime",
+	"ComputeLapse", "CompletedLapse", "Running", "UCpu", "SCpu", "Lock", "Wait", "Held", "MaxLock", "Command"}
+
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// csvRecord returns the values for csvHeader
+func (d *DataRec) csvRecord() []string {
+	lockType := "Read"
+	lock := d.ReadLock
+	if d.WriteLock != nil {
+		lockType = "Write"
+		lock = d.WriteLock
+	}
+	if d.PeekLock != nil {
+		lockType = "Peek"
+		lock = d.PeekLock
+	}
+	if lock == nil {
+		lock = &LockRec{}
+	}
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	return []string{d.Table, i(d.Pid), i(d.LineNo), d.User, d.Workspace, d.App,
+		formatCSVTime(d.StartTime), formatCSVTime(d.EndTime),
+		i(d.ComputeLapse), i(d.CompletedLapse), i(d.Running), i(d.UCpu), i(d.SCpu),
+		lockType, i(lock.TotalWait), i(lock.TotalHeld), i(d.MaxLock), d.CmdArgs}
+}
+
+// JSON data file is an array of DataRec, one per line
+func writeJSONHeader(f *bufio.Writer) error {
+	_, err := fmt.Fprint(f, "[\n")
+	return err
+}
+
+func writeJSONTrailer(f *bufio.Writer) error {
+	_, err := fmt.Fprint(f, "\n]\n")
+	return err
+}
+
+// dataFileURL returns the path of the JSON data file relative to the HTML file, for loading by the page
+func dataFileURL(htmlFilename, jsonFilename string) string {
+	rel, err := filepath.Rel(filepath.Dir(htmlFilename), jsonFilename)
+	if err != nil {
+		rel = jsonFilename
+	}
+	return filepath.ToSlash(rel)
+}
+
+func getJSONFilename(name string, logfiles []string) string {
+	return getFilename(name, ".json", false, logfiles)
+}
@@ -0,0 +1,215 @@
+package main
+
+// Summary of locks by table - see --summary and --summary.csv. The timeline shows individual locks, but the first
+// questions when investigating are usually "which table" and "who", so for each table the total and max (for a single
+// command) read/write/peek wait and held times are reported, with the number of commands over the threshold and the
+// commands holding locks on the table longest. All commands matching --start/--end/--user/--pid are included, not
+// just those over the threshold. Tables are listed in order of total (read+write) held time.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Default number of commands reported per table
+const defaultSummaryTop = 10
+
+// summaryCmd - a command holding locks on a table
+type summaryCmd struct {
+	Pid       int64
+	LineNo    int64
+	User      string
+	StartTime string
+	Held      int64 // Read+write held (ms)
+	CmdArgs   string
+}
+
+// tableSummary - lock totals for a table
+type tableSummary struct {
+	Table             string
+	Cmds              int64 // Commands with any lock wait/held time on the table
+	CmdsOverThreshold int64
+	Read              LockRec // Totals
+	Write             LockRec
+	Peek              LockRec
+	MaxRead           LockRec // Max for a single command
+	MaxWrite          LockRec
+	MaxPeek           LockRec
+	Top               []summaryCmd // By Held, descending
+}
+
+// lockSummary - summaries by table
+type lockSummary struct {
+	top    int
+	tables map[string]*tableSummary
+}
+
+func newLockSummary(top int) *lockSummary {
+	return &lockSummary{top: top, tables: make(map[string]*tableSummary)}
+}
+
+func (l *LockRec) add(wait, held int64) {
+	l.TotalWait += wait
+	l.TotalHeld += held
+}
+
+func (l *LockRec) max(wait, held int64) {
+	if wait > l.TotalWait {
+		l.TotalWait = wait
+	}
+	if held > l.TotalHeld {
+		l.TotalHeld = held
+	}
+}
+
+// add records the table locks of cmd, skipping tables for which excluded returns true
+func (s *lockSummary) add(cmd *p4dlog.Command, excluded func(tableName string) bool) {
+	for _, t := range cmd.TablesWithLocks() {
+		if t.TotalReadWait == 0 && t.TotalReadHeld == 0 && t.TotalWriteWait == 0 && t.TotalWriteHeld == 0 &&
+			t.TotalPeekWait == 0 && t.TotalPeekHeld == 0 {
+			continue
+		}
+		if excluded(t.TableName) {
+			continue
+		}
+		name := fmt.Sprintf("db.%s", t.TableName)
+		ts, ok := s.tables[name]
+		if !ok {
+			ts = &tableSummary{Table: name}
+			s.tables[name] = ts
+		}
+		ts.Cmds++
+		if t.TotalReadHeld > thresholdFilter || t.TotalReadWait > thresholdFilter ||
+			t.TotalWriteHeld > thresholdFilter || t.TotalWriteWait > thresholdFilter ||
+			t.TotalPeekHeld > thresholdFilter || t.TotalPeekWait > thresholdFilter {
+			ts.CmdsOverThreshold++
+		}
+		ts.Read.add(t.TotalReadWait, t.TotalReadHeld)
+		ts.Write.add(t.TotalWriteWait, t.TotalWriteHeld)
+		ts.Peek.add(t.TotalPeekWait, t.TotalPeekHeld)
+		ts.MaxRead.max(t.TotalReadWait, t.TotalReadHeld)
+		ts.MaxWrite.max(t.TotalWriteWait, t.TotalWriteHeld)
+		ts.MaxPeek.max(t.TotalPeekWait, t.TotalPeekHeld)
+		ts.addTop(cmd, t.TotalReadHeld+t.TotalWriteHeld, s.top)
+	}
+}
+
+// addTop records cmd in Top if it is one of the top commands by held time
+func (ts *tableSummary) addTop(cmd *p4dlog.Command, held int64, top int) {
+	if held == 0 || top <= 0 {
+		return
+	}
+	if len(ts.Top) == top && held <= ts.Top[len(ts.Top)-1].Held {
+		return
+	}
+	c := summaryCmd{Pid: cmd.Pid, LineNo: cmd.LineNo, User: cmd.User, StartTime: cmd.StartTime.Format(filterTimeFormat),
+		Held: held, CmdArgs: fmt.Sprintf("%s %s", cmd.Cmd, cmd.Args)}
+	i := sort.Search(len(ts.Top), func(i int) bool { return ts.Top[i].Held < held })
+	ts.Top = append(ts.Top, summaryCmd{})
+	copy(ts.Top[i+1:], ts.Top[i:])
+	ts.Top[i] = c
+	if len(ts.Top) > top {
+		ts.Top = ts.Top[:top]
+	}
+}
+
+// sorted returns table summaries by total held time, descending
+func (s *lockSummary) sorted() []*tableSummary {
+	result := make([]*tableSummary, 0, len(s.tables))
+	for _, ts := range s.tables {
+		result = append(result, ts)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		hi := result[i].Read.TotalHeld + result[i].Write.TotalHeld
+		hj := result[j].Read.TotalHeld + result[j].Write.TotalHeld
+		if hi != hj {
+			return hi > hj
+		}
+		return result[i].Table < result[j].Table
+	})
+	return result
+}
+
+// writeText writes the summary as a report (times in ms)
+func (s *lockSummary) writeText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "Lock summary by table (times in ms, threshold %d):\n", thresholdFilter); err != nil {
+		return err
+	}
+	for _, ts := range s.sorted() {
+		_, err := fmt.Fprintf(w, "%s: cmds %d, over threshold %d\n"+
+			"  read wait/held total %d/%d max %d/%d\n"+
+			"  write wait/held total %d/%d max %d/%d\n"+
+			"  peek wait/held total %d/%d max %d/%d\n",
+			ts.Table, ts.Cmds, ts.CmdsOverThreshold,
+			ts.Read.TotalWait, ts.Read.TotalHeld, ts.MaxRead.TotalWait, ts.MaxRead.TotalHeld,
+			ts.Write.TotalWait, ts.Write.TotalHeld, ts.MaxWrite.TotalWait, ts.MaxWrite.TotalHeld,
+			ts.Peek.TotalWait, ts.Peek.TotalHeld, ts.MaxPeek.TotalWait, ts.MaxPeek.TotalHeld)
+		if err != nil {
+			return err
+		}
+		if len(ts.Top) > 0 {
+			if _, err := fmt.Fprintf(w, "  top cmds by read+write held:\n"); err != nil {
+				return err
+			}
+		}
+		for _, c := range ts.Top {
+			if _, err := fmt.Fprintf(w, "    %d pid %d line %d %s %s %s\n", c.Held, c.Pid, c.LineNo, c.User, c.StartTime, c.CmdArgs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Table values are repeated for each of its top commands (or given once with empty command values if none)
+var summaryCSVHeader = []string{"Table", "Cmds", "CmdsOverThreshold",
+	"ReadWait", "ReadHeld", "WriteWait", "WriteHeld", "PeekWait", "PeekHeld",
+	"MaxReadWait", "MaxReadHeld", "MaxWriteWait", "MaxWriteHeld", "MaxPeekWait", "MaxPeekHeld",
+	"Rank", "Pid", "Line", "User", "Start", "Held", "Command"}
+
+// writeCSV writes the summary as CSV with summaryCSVHeader
+func (s *lockSummary) writeCSV(w *csv.Writer) error {
+	if err := w.Write(summaryCSVHeader); err != nil {
+		return err
+	}
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	for _, ts := range s.sorted() {
+		vals := []string{ts.Table, i(ts.Cmds), i(ts.CmdsOverThreshold),
+			i(ts.Read.TotalWait), i(ts.Read.TotalHeld), i(ts.Write.TotalWait), i(ts.Write.TotalHeld),
+			i(ts.Peek.TotalWait), i(ts.Peek.TotalHeld),
+			i(ts.MaxRead.TotalWait), i(ts.MaxRead.TotalHeld), i(ts.MaxWrite.TotalWait), i(ts.MaxWrite.TotalHeld),
+			i(ts.MaxPeek.TotalWait), i(ts.MaxPeek.TotalHeld)}
+		if len(ts.Top) == 0 {
+			if err := w.Write(append(vals, "", "", "", "", "", "", "")); err != nil {
+				return err
+			}
+			continue
+		}
+		for rank, c := range ts.Top {
+			row := append(append([]string{}, vals...), i(int64(rank+1)), i(c.Pid), i(c.LineNo), c.User, c.StartTime, i(c.Held), c.CmdArgs)
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeSummaryCSV writes the summary as CSV to the named file
+func writeSummaryCSV(name string, s *lockSummary) error {
+	fd, f, err := openFile(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err = s.writeCSV(csv.NewWriter(f)); err != nil {
+		return err
+	}
+	return f.Flush()
+}
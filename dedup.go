@@ -0,0 +1,49 @@
+package p4dlog
+
+// Detection of commands output more than once with the same process key and start line number - the primary key
+// of the log2sql process table - e.g. rmt-Journal records repeated in the log. Keys output within the last
+// dedupWindow (of log time) are remembered, and repeats counted (the first is logged) so that callers can report
+// them in a summary rather than as database insert errors row by row. As this costs a map lookup per command, it is
+// only done if FeatureDuplicates is enabled.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Period of log time for which output keys are remembered - repeats are expected to be close together
+const dedupWindow = 10 * time.Minute
+
+type outputKey struct {
+	processKey string
+	lineNo     int64
+}
+
+// noteOutput records the key of a command being output, counting it if already output
+func (fp *P4dFileParser) noteOutput(cmd *Command) {
+	if fp.outputKeys == nil {
+		fp.outputKeys = make(map[outputKey]int64)
+	}
+	k := outputKey{processKey: cmd.GetKey(), lineNo: cmd.LineNo}
+	if _, ok := fp.outputKeys[k]; ok {
+		if atomic.AddInt64(&fp.duplicateOutputCount, 1) == 1 && fp.logger != nil {
+			fp.logger.Infof("Command output more than once with the same process key and line number at line %d pid %d %s",
+				cmd.LineNo, cmd.Pid, cmd.Cmd)
+		}
+	}
+	fp.outputKeys[k] = cmd.StartTime.Unix()
+	if fp.currTime.Sub(fp.outputKeysPruned) > dedupWindow {
+		cutoff := fp.currTime.Add(-dedupWindow).Unix()
+		for k, t := range fp.outputKeys {
+			if t < cutoff {
+				delete(fp.outputKeys, k)
+			}
+		}
+		fp.outputKeysPruned = fp.currTime
+	}
+}
+
+// DuplicateOutputCount - count of commands output with the same process key and line number as one already output
+func (fp *P4dFileParser) DuplicateOutputCount() int64 {
+	return atomic.LoadInt64(&fp.duplicateOutputCount)
+}
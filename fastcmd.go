@@ -0,0 +1,207 @@
+package p4dlog
+
+// Fast path for command start lines - see FeatureFastCmdScan. Most of the CPU time parsing a log goes into matching
+// info lines such as
+//
+//	\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [Microsoft Visual Studio 2013/12.0.21005.1] 'user-sync //...'
+//	\t2015/09/02 15:23:10 pid 1616 completed .031s 7+4us 0+584io 0+0net 4580k 0pf
+//
+// against reCmd, reCmdNoarg and reCmdMultiLineDesc - every completed line is tried against all three before
+// reCompleted and reCmdUsage. The functions below match these lines by hand instead, giving exactly the same submatches
+// as the regexes, and leave anything unusual to them.
+
+import "strings"
+
+const cmdDateLen = len("2006/01/02 15:04:05")
+
+// scanCmdLine returns the submatches of reCmd, reCmdNoarg or reCmdMultiLineDesc (tried in that order, multiLineDesc
+// set for the last) for line, or nil if none of them match. ok is false for unusual lines (containing newlines) for
+// which the regexes should be tried instead.
+func scanCmdLine(line string) (m []string, multiLineDesc bool, ok bool) {
+	if strings.IndexByte(line, '\n') >= 0 {
+		return nil, false, false
+	}
+	if len(line) < 1+cmdDateLen+len(" pid 1 @  [] 'x") || line[0] != '\t' || !isCmdDate(line[1:1+cmdDateLen]) {
+		return nil, false, true
+	}
+	p := 1 + cmdDateLen
+	if !strings.HasPrefix(line[p:], " pid ") {
+		return nil, false, true
+	}
+	p += len(" pid ")
+	pidStart := p
+	p = skipDigits(line, p)
+	if p == pidStart || p >= len(line) || line[p] != ' ' {
+		return nil, false, true
+	}
+	pidEnd := p
+	p++
+	userStart := p
+	for p < len(line) && line[p] != '@' {
+		if line[p] == ' ' {
+			return nil, false, true
+		}
+		p++
+	}
+	if p >= len(line) {
+		return nil, false, true
+	}
+	userEnd := p
+	p++
+	wsStart := p
+	wsEnd := strings.IndexByte(line[p:], ' ')
+	if wsEnd < 0 {
+		return nil, false, true
+	}
+	wsEnd += p
+	ipStart := wsEnd + 1
+	ipEnd := strings.IndexByte(line[ipStart:], ' ')
+	if ipEnd < 0 {
+		return nil, false, true
+	}
+	ipEnd += ipStart
+	if ipEnd+1 >= len(line) || line[ipEnd+1] != '[' {
+		return nil, false, true
+	}
+	appStart := ipEnd + 2
+	m = []string{line, line[1 : 1+cmdDateLen], line[pidStart:pidEnd], line[userStart:userEnd], line[wsStart:wsEnd],
+		line[ipStart:ipEnd], "", "", ""}
+	// The app is as short as possible (non-greedy), so each "] '" is tried in turn - as reCmd, then reCmdNoarg, then
+	// reCmdMultiLineDesc
+	lastQuote := strings.LastIndexByte(line, '\'')
+	for re := 0; re < 3; re++ {
+		for i := appStart; ; {
+			j := strings.Index(line[i:], "] '")
+			if j < 0 {
+				break
+			}
+			appEnd := i + j
+			cmdStart := appEnd + len("] '")
+			cmdEnd := cmdStart
+			for cmdEnd < len(line) && isCmdChar(line[cmdEnd]) {
+				cmdEnd++
+			}
+			if cmdEnd > cmdStart {
+				m[6], m[7] = line[appStart:appEnd], line[cmdStart:cmdEnd]
+				switch {
+				case re == 0 && cmdEnd < len(line) && line[cmdEnd] == ' ' && lastQuote > cmdEnd:
+					m[8] = line[cmdEnd+1 : lastQuote]
+					return m, false, true
+				case re == 1 && cmdEnd < len(line) && line[cmdEnd] == '\'':
+					return m[:8], false, true
+				case re == 2:
+					end := strings.IndexByte(line[cmdEnd:], '\'')
+					if end < 0 {
+						end = len(line) - cmdEnd
+					}
+					m[0], m[8] = line[:cmdEnd+end], line[cmdEnd:cmdEnd+end]
+					return m, true, true
+				}
+			}
+			i = appEnd + 1
+		}
+	}
+	return nil, false, true
+}
+
+// scanCompletedLine returns the submatches of reCompleted for line, or nil if it doesn't match. ok is false for
+// unusual lines as for scanCmdLine.
+func scanCompletedLine(line string) (m []string, ok bool) {
+	if strings.IndexByte(line, '\n') >= 0 {
+		return nil, false
+	}
+	if len(line) < 1+cmdDateLen+len(" pid 1 completed 1s") || line[0] != '\t' || !isCmdDate(line[1:1+cmdDateLen]) {
+		return nil, true
+	}
+	p := 1 + cmdDateLen
+	if !strings.HasPrefix(line[p:], " pid ") {
+		return nil, true
+	}
+	p += len(" pid ")
+	pidStart := p
+	p = skipDigits(line, p)
+	pidEnd := p
+	if p == pidStart || !strings.HasPrefix(line[p:], " completed ") {
+		return nil, true
+	}
+	p += len(" completed ")
+	lapseStart := p
+	p = skipDigits(line, p)
+	if p < len(line) && line[p] == '.' && p+1 < len(line) && isDigit(line[p+1]) {
+		p = skipDigits(line, p+1)
+	}
+	if p == lapseStart || line[lapseStart] == '.' && p == lapseStart+1 || p >= len(line) || line[p] != 's' {
+		return nil, true
+	}
+	return []string{line, line[1 : 1+cmdDateLen], line[pidStart:pidEnd], line[lapseStart:p]}, true
+}
+
+// scanCmdUsage returns the submatches of reCmdUsage for line, or nil if it doesn't match
+func scanCmdUsage(line string) []string {
+	m := make([]string, 9)
+	for start := strings.IndexByte(line, ' '); start >= 0; {
+		p := start + 1
+		matched := true
+		for i, sep := range []string{"+", "us ", "+", "io ", "+", "net ", "k ", "pf"} {
+			end := skipDigits(line, p)
+			if end == p || !strings.HasPrefix(line[end:], sep) {
+				matched = false
+				break
+			}
+			m[i+1] = line[p:end]
+			p = end + len(sep)
+		}
+		if matched {
+			m[0] = line[start:p]
+			return m
+		}
+		next := strings.IndexByte(line[start+1:], ' ')
+		if next < 0 {
+			break
+		}
+		start += next + 1
+	}
+	return nil
+}
+
+// skipDigits returns the index of the first non-digit of s at or after i
+func skipDigits(s string, i int) int {
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
+
+// isCmdDate returns whether s is of the form dddd/dd/dd dd:dd:dd
+func isCmdDate(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 4, 7:
+			if s[i] != '/' {
+				return false
+			}
+		case 10:
+			if s[i] != ' ' {
+				return false
+			}
+		case 13, 16:
+			if s[i] != ':' {
+				return false
+			}
+		default:
+			if !isDigit(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isCmdChar returns whether c matches [\w-]
+func isCmdChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '-'
+}
@@ -0,0 +1,88 @@
+package p4dlog
+
+// Feature flags allow new parsing behaviours to be opted into gradually (or turned off again)
+// so that defaults can evolve without breaking established pipelines.
+// To add a feature: define a name constant, add it to knownFeatures, and check
+// fp.FeatureEnabled(name) where the behaviour is implemented.
+// When a feature is deprecated (its behaviour is now permanent or being removed) set Deprecated
+// so that users explicitly enabling/disabling it are warned.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Feature - a parsing behaviour which can be enabled or disabled
+type Feature struct {
+	Name        string
+	Description string
+	Default     bool // Whether enabled if not explicitly set
+	Deprecated  bool // If set, a warning is given when explicitly set
+}
+
+// Names of features
+const (
+	FeatureDSTCorrection = "dst.correction"
+	FeatureLogTruncated  = "log.truncated"
+	FeatureFastCmdScan   = "fast.cmd.scan"
+	FeatureDuplicates    = "duplicate.output"
+)
+
+var knownFeatures = []Feature{
+	{Name: FeatureDSTCorrection,
+		Description: "Correct end times of commands spanning DST transitions using completed lapse",
+		Default:     true},
+	{Name: FeatureLogTruncated,
+		Description: "Set endReason=log_truncated and lastSeenTime for commands not completed when log ends (e.g. server crash)",
+		Default:     false},
+	{Name: FeatureFastCmdScan,
+		Description: "Match common command start lines with a hand-written scanner rather than regexes (faster parsing)",
+		Default:     false},
+	{Name: FeatureDuplicates,
+		Description: "Count commands output more than once with the same process key and line number (see DuplicateOutputCount)",
+		Default:     false},
+}
+
+// Features returns all known features, sorted by name
+func Features() []Feature {
+	result := make([]Feature, len(knownFeatures))
+	copy(result, knownFeatures)
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func findFeature(name string) (Feature, bool) {
+	for _, f := range knownFeatures {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Feature{}, false
+}
+
+// SetFeature - enable or disable a named feature. Returns an error for unknown features.
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithFeature.
+func (fp *P4dFileParser) SetFeature(name string, enabled bool) error {
+	f, ok := findFeature(name)
+	if !ok {
+		return fmt.Errorf("unknown feature: %s", name)
+	}
+	if f.Deprecated {
+		fp.logger.Warnf("Feature %s is deprecated and may be removed in a future release", name)
+	}
+	if fp.features == nil {
+		fp.features = make(map[string]bool)
+	}
+	fp.features[name] = enabled
+	return nil
+}
+
+// FeatureEnabled - returns whether feature is enabled, either explicitly or by default
+func (fp *P4dFileParser) FeatureEnabled(name string) bool {
+	if enabled, ok := fp.features[name]; ok {
+		return enabled
+	}
+	f, _ := findFeature(name)
+	return f.Default
+}
@@ -0,0 +1,102 @@
+package p4dlog
+
+// Line hooks - so that downstream tools can capture site-specific log lines (e.g. output of custom triggers, broker
+// messages) and enrich the commands they relate to without forking the parser, e.g.
+//
+//	reBuild := regexp.MustCompile(`build-id=(\S+)`)
+//	fp, err := p4dlog.NewParser(p4dlog.WithLineHook(reBuild, func(cmd *p4dlog.Command, m []string) {
+//		if cmd != nil {
+//			cmd.SetExtra("buildID", m[1])
+//		}
+//	}))
+//
+// Hooks are called for lines within blocks of text logs (not discarded noise lines, or structured logs), after the
+// parser has recognised the block, in the order registered. The command is the one pending for the pid of the block.
+
+import (
+	"regexp"
+)
+
+// LineHook is called for each log line matching its pattern, with the submatches as returned by FindStringSubmatch.
+// cmd is the pending command for the pid of the block containing the line, or nil if there is none (e.g. a server
+// event, or the command has already been output). Hooks are called on the parsing goroutine, so must not block, and
+// may modify cmd (e.g. with SetExtra), which is output as normal.
+type LineHook func(cmd *Command, matches []string)
+
+// LineHookSpec - a pattern and the hook called for lines matching it
+type LineHookSpec struct {
+	Pattern *regexp.Regexp
+	Hook    LineHook
+}
+
+// Pid of the command a block relates to, e.g. "\t2024/01/02 10:00:00 pid 1234 ..." or "\tPid 1234" in error blocks
+var reBlockPid = regexp.MustCompile(`(?:\bpid |^\tPid )(\d+)`)
+
+// RegisterLineHook - call hook for each log line matching re. Must be called before parsing starts - use NewParser
+// with WithLineHook if the parser is shared between goroutines.
+func (fp *P4dFileParser) RegisterLineHook(re *regexp.Regexp, hook LineHook) {
+	fp.lineHooks = append(fp.lineHooks, LineHookSpec{Pattern: re, Hook: hook})
+}
+
+// SetExtra sets a value for key in cmd.Extra - for use by line hooks
+func (c *Command) SetExtra(key, value string) {
+	if c.Extra == nil {
+		c.Extra = make(map[string]string)
+	}
+	c.Extra[key] = value
+}
+
+type lineHookMatch struct {
+	hook    LineHook
+	matches []string
+}
+
+// matchLineHooks returns the hooks matching lines of the block, in line order
+func (fp *P4dFileParser) matchLineHooks(block *Block) []lineHookMatch {
+	var result []lineHookMatch
+	for _, line := range block.lines {
+		for _, h := range fp.lineHooks {
+			if m := h.Pattern.FindStringSubmatch(line); m != nil {
+				result = append(result, lineHookMatch{hook: h.Hook, matches: m})
+			}
+		}
+	}
+	return result
+}
+
+// blockPid returns the pid of the command a block relates to, or 0 if none
+func blockPid(block *Block) int64 {
+	for _, line := range block.lines {
+		if m := reBlockPid.FindStringSubmatch(line); m != nil {
+			return toInt64(m[1])
+		}
+	}
+	return 0
+}
+
+// processBlockWithHooks processes the block, calling any matching line hooks. Hooks for a command already pending
+// are called first, as processing (e.g. of its track records) may output it. Otherwise (e.g. the block starts the
+// command) they are called afterwards.
+func (fp *P4dFileParser) processBlockWithHooks(block *Block) {
+	matched := fp.matchLineHooks(block)
+	if len(matched) == 0 {
+		fp.processBlock(block)
+		return
+	}
+	pid := blockPid(block)
+	if cmd, ok := fp.cmds[fp.pidKey(pid)]; ok && pid != 0 {
+		for _, h := range matched {
+			h.hook(cmd, h.matches)
+		}
+		fp.processBlock(block)
+		return
+	}
+	fp.processBlock(block)
+	var cmd *Command
+	if pid != 0 {
+		cmd = fp.cmds[fp.pidKey(pid)]
+	}
+	for _, h := range matched {
+		h.hook(cmd, h.matches)
+	}
+}
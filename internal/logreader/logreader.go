@@ -0,0 +1,144 @@
+// Package logreader opens p4d log files for reading, decompressing them if required. The compression format is
+// detected from the first bytes of the file (not its name), so rotated logs compressed by any of the supported
+// formats - gzip, zstd and bzip2 - can be read directly.
+package logreader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats
+const (
+	None  = ""
+	Gzip  = "gzip"
+	Zstd  = "zstd"
+	Bzip2 = "bzip2"
+	XZ    = "xz" // Detected, but not supported
+)
+
+// Typical compression ratio of p4d logs, used to estimate the uncompressed size for progress reporting
+const compressionRatio = 20
+
+var magic = []struct {
+	format string
+	bytes  []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Bzip2, []byte("BZh")},
+	{XZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// Filename suffixes of compressed files, removed by TrimSuffix
+var suffixes = []string{".gz", ".zst", ".zstd", ".bz2", ".xz"}
+
+// ErrXZ is returned for xz compressed files
+var ErrXZ = errors.New("xz compressed files are not supported - decompress with 'xz -d' first")
+
+// Reader reads a log file, decompressing it if required
+type Reader struct {
+	io.Reader
+	format string
+	close  func()
+}
+
+// Format returns the compression format of the file, or None
+func (r *Reader) Format() string {
+	return r.format
+}
+
+// Compressed returns true if the file is compressed (so can't be read from an offset)
+func (r *Reader) Compressed() bool {
+	return r.format != None
+}
+
+// Close releases any resources used for decompression. It does not close the file.
+func (r *Reader) Close() error {
+	if r.close != nil {
+		r.close()
+		r.close = nil
+	}
+	return nil
+}
+
+// detect returns the compression format for the first bytes of a file
+func detect(b []byte) string {
+	for _, m := range magic {
+		if bytes.HasPrefix(b, m.bytes) {
+			return m.format
+		}
+	}
+	return None
+}
+
+// FromFile returns a reader for file from its current offset, and the file size (estimated uncompressed size if
+// compressed)
+func FromFile(file *os.File) (*Reader, int64, error) {
+	r, err := FromReader(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	if r.Compressed() {
+		return r, stat.Size() * compressionRatio, nil
+	}
+	return r, stat.Size(), nil
+}
+
+// FromReader returns a reader for r (e.g. stdin or a network stream), decompressing it if required
+func FromReader(reader io.Reader) (*Reader, error) {
+	// A bufio.Reader so we can 'peek' at the first few bytes
+	bReader := bufio.NewReader(reader)
+	testBytes, err := bReader.Peek(64) // Read a few bytes without consuming
+	// Short files (or the remainder of one being resumed) are fine
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	r := &Reader{format: detect(testBytes)}
+	switch r.format {
+	case Gzip:
+		gzipReader, err := gzip.NewReader(bReader)
+		if err != nil {
+			return nil, err
+		}
+		r.Reader = gzipReader
+	case Zstd:
+		zstdReader, err := zstd.NewReader(bReader)
+		if err != nil {
+			return nil, err
+		}
+		r.Reader = zstdReader
+		r.close = zstdReader.Close // Stops its decoding goroutines
+	case Bzip2:
+		r.Reader = bzip2.NewReader(bReader)
+	case XZ:
+		return nil, ErrXZ
+	default:
+		r.Reader = bReader
+	}
+	return r, nil
+}
+
+// TrimSuffix returns name without any compressed file suffix, e.g. p4d.log for p4d.log.zst
+func TrimSuffix(name string) string {
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s) {
+			return strings.TrimSuffix(name, s)
+		}
+	}
+	return name
+}
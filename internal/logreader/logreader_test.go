@@ -0,0 +1,90 @@
+package logreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLog = "Perforce server info:\n\t2024/06/10 23:59:50 pid 100 fred@ws 127.0.0.1 [p4/2023.1] 'user-info'\n"
+
+// testLog compressed with bzip2 -9 (there is no bzip2 writer in the standard library)
+var testLogBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xf9, 0x41,
+	0x4c, 0xee, 0x00, 0x00, 0x1b, 0xdf, 0x80, 0x00, 0x30, 0x40, 0x83, 0xff,
+	0xb0, 0x40, 0x00, 0x40, 0x0a, 0x0f, 0x21, 0xdb, 0x80, 0x20, 0x00, 0x54,
+	0x44, 0x98, 0x9a, 0x0f, 0x50, 0x19, 0x1b, 0x50, 0xda, 0x8f, 0x4d, 0x42,
+	0x29, 0xe9, 0x94, 0xd1, 0xa6, 0x40, 0x6c, 0xa0, 0x34, 0xf5, 0x00, 0xe4,
+	0x69, 0xab, 0x46, 0x42, 0xc3, 0xc7, 0x72, 0x35, 0xac, 0x34, 0x9a, 0x8c,
+	0x0d, 0x66, 0x04, 0xa0, 0xa4, 0x31, 0x07, 0x39, 0x2c, 0x31, 0x7b, 0xea,
+	0x64, 0x03, 0x28, 0x6a, 0x5a, 0x4a, 0x62, 0x31, 0xf7, 0x83, 0x75, 0x48,
+	0xec, 0x40, 0x7e, 0x12, 0x36, 0xe2, 0x08, 0xc4, 0x76, 0x41, 0x17, 0xb4,
+	0x15, 0x6d, 0xa8, 0xaf, 0xe2, 0xee, 0x48, 0xa7, 0x0a, 0x12, 0x1f, 0x28,
+	0x29, 0x9d, 0xc0,
+}
+
+func writeFile(t *testing.T, name string, data []byte) *os.File {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestFromFile(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testLog))
+	w.Close()
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	assert.NoError(t, err)
+	zw.Write([]byte(testLog))
+	zw.Close()
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"p4d.log", []byte(testLog), None},
+		{"p4d.log.gz", gz.Bytes(), Gzip},
+		{"p4d.log.zst", zs.Bytes(), Zstd},
+		{"p4d.log.bz2", testLogBzip2, Bzip2},
+		{"short.log", []byte("x\n"), None},
+	} {
+		f := writeFile(t, tc.name, tc.data)
+		r, size, err := FromFile(f)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.format, r.Format(), tc.name)
+		assert.Equal(t, tc.format != None, r.Compressed(), tc.name)
+		if tc.format == None {
+			assert.Equal(t, int64(len(tc.data)), size, tc.name)
+		} else {
+			assert.Equal(t, int64(len(tc.data))*compressionRatio, size, tc.name)
+		}
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err, tc.name)
+		if tc.name != "short.log" {
+			assert.Equal(t, testLog, string(b), tc.name)
+		}
+		assert.NoError(t, r.Close())
+	}
+
+	_, _, err = FromFile(writeFile(t, "p4d.log.xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}))
+	assert.Equal(t, ErrXZ, err)
+}
+
+func TestTrimSuffix(t *testing.T) {
+	assert.Equal(t, "p4d.log", TrimSuffix("p4d.log.gz"))
+	assert.Equal(t, "p4d.log", TrimSuffix("p4d.log.zst"))
+	assert.Equal(t, "p4d.log", TrimSuffix("p4d.log.bz2"))
+	assert.Equal(t, "p4d.log", TrimSuffix("p4d.log"))
+}
@@ -0,0 +1,114 @@
+// Package logtail follows a log file as it is written (like tail -F), sending complete lines. Copes with the log being
+// rotated or truncated by reopening it from the start.
+package logtail
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Lines longer than this are truncated (as for p4dlog.LineReader)
+const maxLineLen = 10000
+
+// Tailer follows a log file
+type Tailer struct {
+	logger       *logrus.Logger
+	name         string
+	fromStart    bool
+	pollInterval time.Duration
+	linesRead    int64 // Updated atomically
+}
+
+// New returns a Tailer for the named file, which reads from its end (only new lines written) unless fromStart is set
+func New(logger *logrus.Logger, name string, fromStart bool) *Tailer {
+	return &Tailer{logger: logger, name: name, fromStart: fromStart, pollInterval: 250 * time.Millisecond}
+}
+
+// LinesRead returns the count of lines sent
+func (t *Tailer) LinesRead() int64 {
+	return atomic.LoadInt64(&t.linesRead)
+}
+
+func (t *Tailer) open(seekEnd bool) (*os.File, *bufio.Reader, int64, error) {
+	f, err := os.Open(t.name)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var offset int64
+	if seekEnd {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, nil, 0, err
+		}
+	}
+	return f, bufio.NewReaderSize(f, 64*1024), offset, nil
+}
+
+// rotated returns true if the file has been replaced (different file) or truncated
+func (t *Tailer) rotated(f *os.File, offset int64) bool {
+	fi, err := os.Stat(t.name)
+	if err != nil {
+		return false // Perhaps in the middle of rotation - wait for the new file
+	}
+	cur, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(fi, cur) || fi.Size() < offset
+}
+
+// Tail sends lines to linesChan until ctx is done, then closes it
+func (t *Tailer) Tail(ctx context.Context, linesChan chan<- string) error {
+	defer close(linesChan)
+	f, r, offset, err := t.open(!t.fromStart)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	var partial strings.Builder
+	for {
+		chunk, err := r.ReadString('\n')
+		offset += int64(len(chunk))
+		if partial.Len() < maxLineLen {
+			partial.WriteString(chunk)
+		}
+		if err == nil {
+			line := strings.TrimRight(partial.String(), "\r\n")
+			partial.Reset()
+			if len(line) > maxLineLen {
+				line = line[:maxLineLen] + "...'"
+			}
+			select {
+			case linesChan <- line:
+				atomic.AddInt64(&t.linesRead, 1)
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		// At end of file - wait for more to be written, keeping any partial line
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(t.pollInterval):
+		}
+		if t.rotated(f, offset) {
+			t.logger.Infof("Log %s rotated, reopening", t.name)
+			f.Close()
+			if f, r, offset, err = t.open(false); err != nil {
+				return err
+			}
+			partial.Reset()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package logtail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func readLines(t *testing.T, linesChan chan string, n int) []string {
+	lines := make([]string, 0)
+	for i := 0; i < n; i++ {
+		select {
+		case line := <-linesChan:
+			lines = append(lines, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line %d, got %v", i, lines)
+		}
+	}
+	return lines
+}
+
+func appendFile(t *testing.T, name, s string) {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(s)
+	assert.NoError(t, err)
+	f.Close()
+}
+
+func TestTailer(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	name := filepath.Join(t.TempDir(), "log")
+	assert.NoError(t, os.WriteFile(name, []byte("old line\n"), 0644))
+
+	tl := New(logger, name, false)
+	tl.pollInterval = 10 * time.Millisecond
+	linesChan := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() { errChan <- tl.Tail(ctx, linesChan) }()
+
+	// Wait for tailer to have opened file at end before appending
+	time.Sleep(100 * time.Millisecond)
+	appendFile(t, name, "line 1\nline 2\r\npart")
+	assert.Equal(t, []string{"line 1", "line 2"}, readLines(t, linesChan, 2))
+	appendFile(t, name, "ial line\n")
+	assert.Equal(t, []string{"partial line"}, readLines(t, linesChan, 1))
+
+	// Rotate - replace the file
+	assert.NoError(t, os.Rename(name, name+".1"))
+	assert.NoError(t, os.WriteFile(name, []byte("new 1\n"), 0644))
+	assert.Equal(t, []string{"new 1"}, readLines(t, linesChan, 1))
+
+	// Truncate
+	assert.NoError(t, os.WriteFile(name, []byte("t1\n"), 0644))
+	assert.Equal(t, []string{"t1"}, readLines(t, linesChan, 1))
+	assert.Equal(t, int64(5), tl.LinesRead())
+
+	cancel()
+	assert.NoError(t, <-errChan)
+	_, ok := <-linesChan
+	assert.False(t, ok)
+}
+
+func TestTailerFromStart(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	name := filepath.Join(t.TempDir(), "log")
+	long := strings.Repeat("x", maxLineLen+100)
+	assert.NoError(t, os.WriteFile(name, []byte("old line\n"+long+"\n"), 0644))
+
+	tl := New(logger, name, true)
+	tl.pollInterval = 10 * time.Millisecond
+	linesChan := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tl.Tail(ctx, linesChan)
+	lines := readLines(t, linesChan, 2)
+	assert.Equal(t, "old line", lines[0])
+	assert.Equal(t, strings.Repeat("x", maxLineLen)+"...'", lines[1])
+}
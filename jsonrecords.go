@@ -0,0 +1,161 @@
+package p4dlog
+
+// Reading of records previously output as JSON lines (e.g. by log2sql --json or p4dpending), so that they can be
+// loaded into a database or metrics again without re-parsing the original log - e.g. to rebuild databases with a
+// new schema from archived JSON. Commands, server events and proxy/broker events are recognised by their fields.
+// Other records (e.g. daily event summaries with recordType RecordTypeServerEventDay, which are recalculated) are
+// ignored.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UnmarshalJSON - reverses MarshalJSON, e.g. times formatted as in the log and tables as a list
+func (c *Command) UnmarshalJSON(data []byte) error {
+	type command Command // Without methods, to avoid recursion
+	aux := &struct {
+		*command
+		CmdError        bool             `json:"cmdError"`
+		StartTime       string           `json:"startTime"`
+		EndTime         string           `json:"endTime"`
+		LastSeenTime    string           `json:"lastSeenTime"`
+		Tables          []Table          `json:"tables"`
+		ComputeTables   []Table          `json:"computeTables"`
+		SerializedLocks []SerializedLock `json:"serializedLocks"`
+	}{command: (*command)(c)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	c.CmdError = aux.CmdError
+	for _, t := range []struct {
+		val  string
+		dest *time.Time
+	}{{aux.StartTime, &c.StartTime}, {aux.EndTime, &c.EndTime}, {aux.LastSeenTime, &c.LastSeenTime}} {
+		if t.val == "" {
+			continue
+		}
+		v, err := time.Parse(p4timeformat, t.val)
+		if err != nil {
+			return fmt.Errorf("invalid time %q: %v", t.val, err)
+		}
+		if !v.Equal(blankTime) {
+			*t.dest = v
+		}
+	}
+	c.Tables = make(map[string]*Table, len(aux.Tables))
+	for i := range aux.Tables {
+		c.Tables[aux.Tables[i].TableName] = &aux.Tables[i]
+	}
+	if len(aux.ComputeTables) > 0 {
+		c.ComputeTables = make(map[string]*Table, len(aux.ComputeTables))
+		for i := range aux.ComputeTables {
+			c.ComputeTables[aux.ComputeTables[i].TableName] = &aux.ComputeTables[i]
+		}
+	}
+	c.SerializedLocks = make(map[string]*SerializedLock, len(aux.SerializedLocks))
+	for i := range aux.SerializedLocks {
+		c.SerializedLocks[aux.SerializedLocks[i].LegacyTableName()] = &aux.SerializedLocks[i]
+	}
+	return nil
+}
+
+// DecodeJSONRecord returns the Command, ServerEvent, ProxyEvent or BrokerEvent (as output on the channel returned
+// by LogParser) encoded in line, or nil if it is valid JSON but not one of those
+func DecodeJSONRecord(line []byte) (interface{}, error) {
+	var probe struct {
+		RecordType  string           `json:"recordType"`
+		ProcessKey  *string          `json:"processKey"`
+		EventTime   *json.RawMessage `json:"eventTime"`
+		FilesServer *json.RawMessage `json:"filesServer"`
+		Action      *json.RawMessage `json:"action"`
+	}
+	if err := json.Unmarshal(line, &probe); err != nil {
+		return nil, err
+	}
+	var err error
+	switch {
+	case probe.RecordType != "":
+		return nil, nil
+	case probe.ProcessKey != nil:
+		var cmd Command
+		err = json.Unmarshal(line, &cmd)
+		return cmd, err
+	case probe.EventTime != nil:
+		var evt ServerEvent
+		err = json.Unmarshal(line, &evt)
+		return evt, err
+	case probe.FilesServer != nil:
+		var evt ProxyEvent
+		err = json.Unmarshal(line, &evt)
+		return evt, err
+	case probe.Action != nil:
+		var evt BrokerEvent
+		err = json.Unmarshal(line, &evt)
+		return evt, err
+	}
+	return nil, nil
+}
+
+// JSONRecordParser - reads records output as JSON lines
+type JSONRecordParser struct {
+	logger            *logrus.Logger
+	cmdChan           chan interface{}
+	lineNo            int64
+	invalidLinesCount int64
+}
+
+// NewJSONRecordParser - create and initialise properly
+func NewJSONRecordParser(logger *logrus.Logger) *JSONRecordParser {
+	return &JSONRecordParser{logger: logger}
+}
+
+// NoiseLinesCount - count of lines discarded as not being valid JSON records
+func (jp *JSONRecordParser) NoiseLinesCount() int64 {
+	return atomic.LoadInt64(&jp.invalidLinesCount)
+}
+
+func (jp *JSONRecordParser) processLine(line string) {
+	jp.lineNo++
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	rec, err := DecodeJSONRecord([]byte(line))
+	if err != nil {
+		if atomic.AddInt64(&jp.invalidLinesCount, 1) == 1 {
+			jp.logger.Warnf("Invalid JSON record at line %d: %v", jp.lineNo, err)
+		}
+		return
+	}
+	if rec != nil {
+		jp.cmdChan <- rec
+	}
+}
+
+// LogParser - interface to be run on a go routine - records are returned on the returned channel, which
+// is closed when linesChan is closed
+func (jp *JSONRecordParser) LogParser(ctx context.Context, linesChan <-chan string) chan interface{} {
+	jp.cmdChan = make(chan interface{}, 10000)
+	go func() {
+		defer close(jp.cmdChan)
+		for {
+			select {
+			case <-ctx.Done():
+				jp.logger.Debugf("JSONRecordParser: context done")
+				return
+			case line, ok := <-linesChan:
+				if !ok {
+					return
+				}
+				jp.processLine(line)
+			}
+		}
+	}()
+	return jp.cmdChan
+}
@@ -0,0 +1,66 @@
+package p4dlog
+
+// Process keys identify commands (with line numbers for duplicates - see GetKey), e.g. as the primary key of the
+// process table in log2sql. By default (KeyModeLine) the key is the MD5 hash of the command's start line, so commands
+// whose start lines are identical get the same key - in particular very long lines truncated when read (see
+// LineReader) which differ only beyond the truncation point, e.g. several commands run in the same second by one
+// 'p4 -x' process. KeyModeFullArgs instead hashes the pid, start time, command and complete arguments (before Swarm/Git
+// Fusion JSON is stripped from Args). Truncated lines should be read with LineReader.SetTruncatedDigest so that their
+// arguments include a digest of the complete line.
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+)
+
+// KeyMode - how process keys are generated
+type KeyMode int
+
+// Process key modes
+const (
+	KeyModeLine     KeyMode = iota // MD5 of start line (default)
+	KeyModeFullArgs                // MD5 of pid, start time, command and complete arguments
+)
+
+var keyModeNames = map[KeyMode]string{
+	KeyModeLine:     "line",
+	KeyModeFullArgs: "full",
+}
+
+func (k KeyMode) String() string {
+	if name, ok := keyModeNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyMode(%d)", int(k))
+}
+
+// ParseKeyMode returns the KeyMode for a name as returned by String(), e.g. "full"
+func ParseKeyMode(name string) (KeyMode, error) {
+	for k, n := range keyModeNames {
+		if n == name {
+			return k, nil
+		}
+	}
+	return KeyModeLine, fmt.Errorf("unknown key mode: %s", name)
+}
+
+// SetKeyMode - how process keys are generated - KeyModeLine by default
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithKeyMode.
+func (fp *P4dFileParser) SetKeyMode(mode KeyMode) {
+	fp.keyMode = mode
+}
+
+// processKey returns the key of a command from its start line (with any trigger stripped) and complete arguments
+func (fp *P4dFileParser) processKey(cmd *Command, line, args string) string {
+	key := line
+	if fp.keyMode == KeyModeFullArgs {
+		key = fmt.Sprintf("%d %s %s %s", cmd.Pid, cmd.StartTime.Format(p4timeformat), cmd.Cmd, args)
+	}
+	if cmd.ServerID != "" { // Set with WithServerPrefix - see serverprefix.go
+		key = cmd.ServerID + " " + key
+	}
+	h := md5.Sum([]byte(key))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,143 @@
+package p4dlog
+
+// LineReader reads log lines of any length - unlike bufio.Scanner, which fails with "token too long" and abandons the
+// rest of the file (e.g. for a single 77MB line). Lines longer than the maximum are truncated (with "...'" appended, so
+// that a truncated command line still ends with a quote) and reading continues. Memory used is bounded by the maximum.
+// Used by log2sql, p4locks and p4dpending.
+// With SetTruncatedDigest, the suffix of a truncated line includes a digest of the complete line, so that lines which
+// differ only beyond the truncation point still differ (and give different process keys - see KeyModeFullArgs).
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// Suffix appended to truncated lines
+const truncatedLineSuffix = "...'"
+
+// LineReader - similar to bufio.Scanner with bufio.ScanLines, but truncating long lines rather than failing
+type LineReader struct {
+	r              *bufio.Reader
+	maxLen         int
+	completeOnly   bool
+	digest         hash.Hash // Set if truncated lines include a digest
+	line           []byte
+	offset         int64
+	err            error
+	truncatedCount int64 // Updated atomically
+}
+
+// NewLineReader - lines longer than maxLen bytes (excluding line ending) are truncated to maxLen. If maxLen <= 0 lines
+// are never truncated (e.g. for JSON records, which would be invalid), so memory used is not bounded.
+func NewLineReader(r io.Reader, maxLen int) *LineReader {
+	if maxLen <= 0 {
+		maxLen = math.MaxInt - 2
+	}
+	return &LineReader{r: bufio.NewReaderSize(r, 64*1024), maxLen: maxLen}
+}
+
+// SetCompleteLinesOnly - a final line without a newline (e.g. still being written) is not returned, so that
+// Offset() is that of the end of the last complete line
+func (lr *LineReader) SetCompleteLinesOnly() {
+	lr.completeOnly = true
+}
+
+// SetTruncatedDigest - truncated lines end with "...[md5 <digest of complete line>]'" rather than "...'"
+func (lr *LineReader) SetTruncatedDigest() {
+	lr.digest = md5.New()
+}
+
+// Scan reads the next line, available via Text(). Returns false at EOF or on error.
+func (lr *LineReader) Scan() bool {
+	if lr.err != nil {
+		return false
+	}
+	lr.line = lr.line[:0]
+	var n int64 // Bytes consumed, including line ending
+	var prev, last byte
+	contentLen := 0
+	hashing := false
+	for {
+		chunk, err := lr.r.ReadSlice('\n')
+		if lr.digest != nil && !hashing && n+int64(len(chunk)) > int64(lr.maxLen) {
+			// Line may be truncated - all bytes so far are in lr.line
+			hashing = true
+			lr.digest.Reset()
+			lr.digest.Write(lr.line)
+		}
+		if hashing {
+			lr.digest.Write(chunk)
+		}
+		n += int64(len(chunk))
+		contentLen += len(chunk)
+		// Keep 2 bytes beyond maxLen for the line ending
+		if room := lr.maxLen + 2 - len(lr.line); room > 0 {
+			if len(chunk) > room {
+				lr.line = append(lr.line, chunk[:room]...)
+			} else {
+				lr.line = append(lr.line, chunk...)
+			}
+		}
+		if len(chunk) > 1 {
+			prev, last = chunk[len(chunk)-2], chunk[len(chunk)-1]
+		} else if len(chunk) == 1 {
+			prev, last = last, chunk[0]
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			lr.err = err
+			if n == 0 || (lr.completeOnly && err == io.EOF) {
+				return false
+			}
+		}
+		break
+	}
+	if last == '\n' {
+		contentLen--
+		if prev == '\r' {
+			contentLen--
+		}
+	}
+	if contentLen > lr.maxLen {
+		if hashing {
+			lr.line = append(lr.line[:lr.maxLen], fmt.Sprintf("...[md5 %x]'", lr.digest.Sum(nil))...)
+		} else {
+			lr.line = append(lr.line[:lr.maxLen], truncatedLineSuffix...)
+		}
+		atomic.AddInt64(&lr.truncatedCount, 1)
+	} else {
+		lr.line = lr.line[:contentLen]
+	}
+	lr.offset += n
+	return true
+}
+
+// Text returns the line read by the last call to Scan, without line ending
+func (lr *LineReader) Text() string {
+	return string(lr.line)
+}
+
+// Err returns the first error other than io.EOF
+func (lr *LineReader) Err() error {
+	if lr.err == io.EOF {
+		return nil
+	}
+	return lr.err
+}
+
+// Offset returns the number of bytes read up to the end of the last line returned
+func (lr *LineReader) Offset() int64 {
+	return lr.offset
+}
+
+// TruncatedCount returns the number of lines truncated
+func (lr *LineReader) TruncatedCount() int64 {
+	return atomic.LoadInt64(&lr.truncatedCount)
+}
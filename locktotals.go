@@ -0,0 +1,20 @@
+package p4dlog
+
+// Lock totals of commands (WithLockTotals) - the read/write lock wait and held times (ms) of a command summed across
+// its tables, so that commands waiting on (or holding) locks for long can be found without aggregating their table
+// usage, e.g. in log2sql databases
+//
+//	SELECT cmd, user, totalReadWait + totalWriteWait AS lockWait FROM process WHERE lockWait > 10000
+//
+// Only Tables (the totals for the command) are summed, not ComputeTables or SerializedLocks.
+
+// setLockTotals sets the lock totals of c from its tables
+func (c *Command) setLockTotals() {
+	c.TotalReadWait, c.TotalReadHeld, c.TotalWriteWait, c.TotalWriteHeld = 0, 0, 0, 0
+	for _, t := range c.Tables {
+		c.TotalReadWait += t.TotalReadWait
+		c.TotalReadHeld += t.TotalReadHeld
+		c.TotalWriteWait += t.TotalWriteWait
+		c.TotalWriteHeld += t.TotalWriteHeld
+	}
+}
@@ -0,0 +1,71 @@
+package p4dlog
+
+// Hard memory cap mode - for the very largest logs we prefer to complete the run with correct
+// command level counts rather than running out of memory. When the heap exceeds the configured
+// limit the parser stops retaining table level detail (track records, serialized locks and trigger
+// lapses) for all commands from that point onwards. The switch point is logged and available via TableDetailDroppedAt().
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// How often (in blocks processed) heap usage is checked - runtime.ReadMemStats is not free
+const memCheckInterval = 10000
+
+func readHeapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// SetMemoryLimit - set a limit (in MB) of heap usage above which table detail is no longer retained. 0 means no limit.
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithMemoryLimit.
+func (fp *P4dFileParser) SetMemoryLimit(limitMB int64) {
+	fp.memoryLimit = uint64(limitMB) * 1024 * 1024
+}
+
+// TableDetailDroppedAt - returns the log line number at which table detail stopped being retained
+// due to the memory limit, or 0 if still retained
+func (fp *P4dFileParser) TableDetailDroppedAt() int64 {
+	return atomic.LoadInt64(&fp.tableDetailDroppedAt)
+}
+
+func (fp *P4dFileParser) tableDetailDropped() bool {
+	return fp.TableDetailDroppedAt() > 0
+}
+
+// checkMemoryLimit is called for every block processed, and switches to degraded mode if the
+// heap exceeds the memory limit
+func (fp *P4dFileParser) checkMemoryLimit(block *Block) {
+	if fp.memoryLimit == 0 || fp.tableDetailDropped() {
+		return
+	}
+	fp.blocksSinceMemCheck++
+	if fp.blocksSinceMemCheck < fp.memCheckInterval {
+		return
+	}
+	fp.blocksSinceMemCheck = 0
+	heap := fp.heapAlloc()
+	if heap < fp.memoryLimit {
+		return
+	}
+	atomic.StoreInt64(&fp.tableDetailDroppedAt, block.lineNo)
+	if fp.logger != nil {
+		fp.logger.Warnf("Memory limit %d MB exceeded (heap %d MB) at line %d: table level detail no longer retained",
+			fp.memoryLimit/1024/1024, heap/1024/1024, block.lineNo)
+	}
+	fp.m.Lock()
+	for _, cmd := range fp.cmds {
+		dropTableDetail(cmd)
+	}
+	fp.m.Unlock()
+	runtime.GC()
+}
+
+func dropTableDetail(cmd *Command) {
+	cmd.Tables = make(map[string]*Table)
+	cmd.ComputeTables = nil
+	cmd.SerializedLocks = make(map[string]*SerializedLock)
+}
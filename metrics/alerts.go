@@ -0,0 +1,151 @@
+package metrics
+
+// Threshold alert rules - values derived from the metrics (e.g. running commands, or the rate of commands in error)
+// are compared with the thresholds of Config.AlertRules each time metrics are output (every UpdateInterval, in log
+// time for historical metrics). An Alert is sent on the channel returned by Alerts() when a rule starts firing, and
+// another with Resolved set when its value drops back to the threshold or below - so that batch analysis of logs can
+// flag incident windows. Alerts are dropped (with a warning) rather than blocking processing if the channel is full.
+
+import (
+	"fmt"
+	"time"
+)
+
+// Metrics which alert rules may test
+const (
+	AlertMetricCmdsRunning     = "cmds_running"      // Running commands (from server events)
+	AlertMetricCmdsPaused      = "cmds_paused"       // Paused commands (from server events)
+	AlertMetricCmdsPerMinute   = "cmds_per_minute"   // Commands completed per minute since the previous evaluation
+	AlertMetricErrorsPerMinute = "errors_per_minute" // Commands in error per minute since the previous evaluation
+)
+
+var alertMetrics = map[string]bool{AlertMetricCmdsRunning: true, AlertMetricCmdsPaused: true,
+	AlertMetricCmdsPerMinute: true, AlertMetricErrorsPerMinute: true}
+
+// Size of the alerts channel
+const alertsChanSize = 1000
+
+// AlertRule - a threshold on one of the AlertMetric* values
+type AlertRule struct {
+	Name   string  `yaml:"name"`   // Reported in alerts - defaults to the metric
+	Metric string  `yaml:"metric"` // One of AlertMetric*
+	Above  float64 `yaml:"above"`  // Fires while the value is above this
+}
+
+// Alert - a rule starting to fire, or resolving
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"` // Log time for historical metrics
+	Resolved  bool      `json:"resolved"`
+	ServerID  string    `json:"serverID,omitempty"`
+}
+
+func (a Alert) String() string {
+	state := "firing"
+	if a.Resolved {
+		state = "resolved"
+	}
+	return fmt.Sprintf("%s %s %s: %s %.2f (threshold %.2f)", a.Time.Format(p4timeformat), a.Rule, state,
+		a.Metric, a.Value, a.Threshold)
+}
+
+func validAlertRules(rules []AlertRule) error {
+	for i, r := range rules {
+		if !alertMetrics[r.Metric] {
+			return fmt.Errorf("rule %d: unknown metric '%s'", i+1, r.Metric)
+		}
+		if r.Above < 0 {
+			return fmt.Errorf("rule %d: above must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+// alertState - evaluation state of the rules
+type alertState struct {
+	firing       []bool // By rule
+	lastTime     time.Time
+	lastCmds     int64
+	lastErrors   int64
+	droppedCount int64
+}
+
+// Alerts returns the channel on which alerts are sent, or nil if no rules are configured. It is closed when
+// processing ends.
+func (p4m *P4DMetrics) Alerts() <-chan Alert {
+	return p4m.alerts
+}
+
+// closeAlerts is called when processing ends
+func (p4m *P4DMetrics) closeAlerts() {
+	if p4m.alerts != nil {
+		close(p4m.alerts)
+	}
+}
+
+// alertValues returns the value of each alert metric as at time t, with rates since the previous evaluation
+// (rates are not available on the first evaluation)
+func (p4m *P4DMetrics) alertValues(t time.Time) map[string]float64 {
+	var cmds, errors int64
+	for _, c := range p4m.cmdCounter {
+		cmds += c
+	}
+	for _, c := range p4m.cmdErrorCounter {
+		errors += c
+	}
+	s := &p4m.alertState
+	values := map[string]float64{
+		AlertMetricCmdsRunning: float64(p4m.cmdsRunning),
+		AlertMetricCmdsPaused:  float64(p4m.cmdsPaused),
+	}
+	if !s.lastTime.IsZero() && t.After(s.lastTime) {
+		mins := t.Sub(s.lastTime).Minutes()
+		values[AlertMetricCmdsPerMinute] = float64(cmds-s.lastCmds) / mins
+		values[AlertMetricErrorsPerMinute] = float64(errors-s.lastErrors) / mins
+	}
+	if s.lastTime.IsZero() || t.After(s.lastTime) {
+		s.lastTime, s.lastCmds, s.lastErrors = t, cmds, errors
+	}
+	return values
+}
+
+// evaluateAlerts evaluates the rules, sending alerts for those which start firing or resolve
+func (p4m *P4DMetrics) evaluateAlerts() {
+	if p4m.alerts == nil {
+		return
+	}
+	t := time.Now()
+	if p4m.historical {
+		t = p4m.timeLatestStartCmd
+	}
+	values := p4m.alertValues(t)
+	s := &p4m.alertState
+	for i, r := range p4m.config.AlertRules {
+		v, ok := values[r.Metric]
+		if !ok {
+			continue
+		}
+		firing := v > r.Above
+		if firing == s.firing[i] {
+			continue
+		}
+		s.firing[i] = firing
+		name := r.Name
+		if name == "" {
+			name = r.Metric
+		}
+		alert := Alert{Rule: name, Metric: r.Metric, Value: v, Threshold: r.Above, Time: t, Resolved: !firing,
+			ServerID: p4m.config.ServerID}
+		select {
+		case p4m.alerts <- alert:
+		default:
+			if s.droppedCount == 0 {
+				p4m.logger.Warnf("Alerts channel full - dropping alerts: %s", alert)
+			}
+			s.droppedCount++
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package metrics
+
+// Command durations by client application family (P4V, p4 CLI, p4python, UnrealGameSync, Swarm etc), since
+// differences in client behaviour often explain perceived slowness. Apps (e.g. "Helix P4V/NTX64/2019.2/1904275/v86")
+// are grouped into families so that the number of label values stays small whatever the client versions.
+// Histograms are always recorded (for the end of run summary), and output as p4_cmd_app_duration_seconds
+// if OutputCmdHistogramByApp is set.
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Family for apps not otherwise recognised
+const appFamilyOther = "other"
+
+// appFamilies - matched in order against lower case app, first match wins
+var appFamilies = []struct {
+	family   string
+	prefixes []string
+	contains []string
+}{
+	{family: "P4V", prefixes: []string{"p4v/"}, contains: []string{" p4v/"}},
+	{family: "P4VS", prefixes: []string{"p4vs/"}, contains: []string{"visual studio"}},
+	{family: "p4", prefixes: []string{"p4/"}},
+	{family: "p4d", prefixes: []string{"p4d/"}},
+	{family: "p4python", contains: []string{"p4python", "p4-python"}},
+	{family: "p4java", contains: []string{"p4java", "jenkins"}},
+	{family: "UnrealGameSync", contains: []string{"unrealgamesync"}},
+	{family: "Swarm", prefixes: []string{"swarm/"}},
+}
+
+// AppFamily returns the client application family of a command's app, e.g. "P4V" for "Helix P4V/NTX64/2019.2/1904275/v86"
+func AppFamily(app string) string {
+	a := strings.ToLower(app)
+	for _, f := range appFamilies {
+		for _, p := range f.prefixes {
+			if strings.HasPrefix(a, p) {
+				return f.family
+			}
+		}
+		for _, c := range f.contains {
+			if strings.Contains(a, c) {
+				return f.family
+			}
+		}
+	}
+	return appFamilyOther
+}
+
+func (p4m *P4DMetrics) observeAppDuration(app string, lapse float64) {
+	family := AppFamily(app)
+	h, ok := p4m.cmdDurationByApp[family]
+	if !ok {
+		h = newHistogram(durationBuckets)
+		p4m.cmdDurationByApp[family] = h
+	}
+	h.observe(lapse, nil, false)
+}
+
+func (p4m *P4DMetrics) outputAppDurations(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	if len(p4m.cmdDurationByApp) == 0 {
+		return
+	}
+	mname := "p4_cmd_app_duration_seconds"
+	p4m.printMetricHeader(metrics, mname, "Histogram of completed cmd durations in seconds (by client application family)", "histogram")
+	for _, family := range sortedKeys(p4m.cmdDurationByApp) {
+		labels := append(fixedLabels, labelStruct{"app_family", family})
+		p4m.outputHistogramValues(metrics, mname, p4m.cmdDurationByApp[family], labels)
+	}
+}
+
+func sortedKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quantile estimates the q'th quantile (0-1) by linear interpolation within the bucket containing it
+// (as for Prometheus histogram_quantile). Values in the +Inf bucket are reported as the highest bucket bound.
+func (h *histogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cumulative int64
+	for i, c := range h.counts {
+		if float64(cumulative+c) < rank || c == 0 {
+			cumulative += c
+			continue
+		}
+		if i == len(h.buckets) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.buckets[i-1]
+		}
+		return lower + (h.buckets[i]-lower)*(rank-float64(cumulative))/float64(c)
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+// AppDurations - summary of command durations for a client application family
+type AppDurations struct {
+	AppFamily string
+	Count     int64
+	Total     float64 // Seconds
+	P50       float64 // Percentiles (seconds) are estimated from histogram buckets
+	P90       float64
+	P99       float64
+}
+
+// DurationsByApp returns command durations by client application family, most total time first.
+// Should only be called once processing is complete.
+func (p4m *P4DMetrics) DurationsByApp() []AppDurations {
+	result := make([]AppDurations, 0, len(p4m.cmdDurationByApp))
+	for family, h := range p4m.cmdDurationByApp {
+		result = append(result, AppDurations{
+			AppFamily: family,
+			Count:     h.count,
+			Total:     h.sum,
+			P50:       h.quantile(0.5),
+			P90:       h.quantile(0.9),
+			P99:       h.quantile(0.99),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Total != result[j].Total {
+			return result[i].Total > result[j].Total
+		}
+		return result[i].AppFamily < result[j].AppFamily
+	})
+	return result
+}
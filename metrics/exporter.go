@@ -0,0 +1,132 @@
+package metrics
+
+// HTTP exporter - serves live metrics at /metrics for Prometheus to scrape directly (in the style of promhttp), as an
+// alternative to writing them to a file for the node_exporter textfile collector. The latest output of ProcessEvents
+// or ProcessCmds (non-historical, so Prometheus text format with labels as set by Config) is served unchanged.
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MetricsPath - path on which metrics are served
+const MetricsPath = "/metrics"
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Exporter serves the latest metrics over HTTP
+type Exporter struct {
+	config  *Config
+	logger  *logrus.Logger
+	m       sync.RWMutex
+	metrics string
+	updated time.Time
+}
+
+// NewExporter - config.OutputExemplars selects OpenMetrics format
+func NewExporter(config *Config, logger *logrus.Logger) *Exporter {
+	return &Exporter{config: config, logger: logger}
+}
+
+// Update sets the metrics to be served
+func (e *Exporter) Update(metrics string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.metrics = metrics
+	e.updated = time.Now()
+}
+
+// Consume updates the metrics served from metricsChan (as returned by ProcessEvents) until it is closed.
+// If out is not nil, metrics are also sent to it (e.g. to continue writing a textfile), and it is closed at the end.
+func (e *Exporter) Consume(metricsChan <-chan string, out chan<- string) {
+	for m := range metricsChan {
+		e.Update(m)
+		if out != nil {
+			out <- m
+		}
+	}
+	if out != nil {
+		close(out)
+	}
+}
+
+// ServeHTTP writes the latest metrics - 503 if none have been output yet
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.m.RLock()
+	metrics, updated := e.metrics, e.updated
+	e.m.RUnlock()
+	if updated.IsZero() {
+		http.Error(w, "No metrics available yet", http.StatusServiceUnavailable)
+		return
+	}
+	contentType := contentTypeText
+	if e.config.OutputExemplars {
+		// Exemplars are only valid in OpenMetrics, which requires a terminating EOF marker
+		contentType = contentTypeOpenMetrics
+		metrics += "# EOF\n"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	if _, err := io.WriteString(out, metrics); err != nil {
+		e.logger.Debugf("Exporter: error writing metrics: %v", err)
+	}
+}
+
+// handler returns the handler for MetricsPath, with a landing page at /
+func (e *Exporter) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, e)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><head><title>p4d log metrics</title></head><body><h1>p4d log metrics</h1>"+
+			"<p><a href=\"%s\">Metrics</a></p></body></html>\n", MetricsPath)
+	})
+	return mux
+}
+
+// Serve serves metrics on the listener until ctx is done
+func (e *Exporter) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: e.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	e.logger.Infof("Serving metrics on %s%s", l.Addr(), MetricsPath)
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ListenAndServe serves metrics on addr (e.g. ":9100") until ctx is done
+func (e *Exporter) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return e.Serve(ctx, l)
+}
@@ -0,0 +1,56 @@
+package metrics
+
+// Commands terminated by governor limits (MaxResults, MaxScanRows, MaxLockTime etc - see p4dlog.Command.LimitExceeded),
+// counted by limit and user. Tuning these limits (in group specs) is a primary admin workflow - the counts show which
+// limits are being hit, and by whom. They are rare, so the user label does not add many series.
+//
+// Commands killed (see p4dlog.Command.KillReason) are also counted by reason, i.e. the governor limit, or terminated
+// by p4 monitor terminate, or paused due to resource pressure - to track how often enforcement fires.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+type limitUser struct {
+	limit string
+	user  string
+}
+
+func (p4m *P4DMetrics) observeLimitExceeded(cmd *p4dlog.Command) {
+	if cmd.LimitExceeded == "" {
+		return
+	}
+	user := cmd.User
+	if !p4m.config.CaseSensitiveServer {
+		user = strings.ToLower(user)
+	}
+	p4m.cmdLimitExceededCounter[limitUser{limit: cmd.LimitExceeded, user: user}]++
+}
+
+func (p4m *P4DMetrics) outputLimitExceeded(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	mname := "p4_cmd_limit_exceeded_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of cmds terminated by governor limits, e.g. MaxResults (by limit and user)", "counter")
+	for k, count := range p4m.cmdLimitExceededCounter {
+		labels := append(fixedLabels, labelStruct{"limit", k.limit}, labelStruct{"user", k.user})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+}
+
+func (p4m *P4DMetrics) observeKilled(cmd *p4dlog.Command) {
+	if cmd.Killed {
+		p4m.cmdKilledCounter[cmd.KillReason]++
+	}
+}
+
+func (p4m *P4DMetrics) outputKilled(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	mname := "p4_cmd_killed_total"
+	p4m.printMetricHeader(metrics, mname, "A count of cmds killed by p4 monitor terminate, governor limits or resource pressure (by reason)", "counter")
+	for reason, count := range p4m.cmdKilledCounter {
+		labels := append(fixedLabels, labelStruct{"reason", reason})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+}
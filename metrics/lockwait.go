@@ -0,0 +1,66 @@
+package metrics
+
+// Histograms of per command lock waits by table, output as p4_table_read_wait_seconds and p4_table_write_wait_seconds
+// if OutputLockWaitHistogram is set. The p4_total_*_wait_seconds counters only give averages, whereas with buckets
+// percentiles can be estimated, e.g. in Grafana: histogram_quantile(0.95, rate(p4_table_write_wait_seconds_bucket[5m]))
+// A command is observed for a table if it took (or waited for) a read/write lock on it.
+
+import (
+	"bytes"
+	"fmt"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Default upper bounds (seconds) of lock wait histogram buckets - last (+Inf) bucket is implicit
+var lockWaitBuckets = []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+func validBuckets(buckets []float64) error {
+	for i, b := range buckets {
+		if b <= 0 || (i > 0 && b <= buckets[i-1]) {
+			return fmt.Errorf("buckets must be positive and increasing: %v", buckets)
+		}
+	}
+	return nil
+}
+
+func (p4m *P4DMetrics) observeLockWait(hists map[string]*histogram, table string, wait int64) {
+	h, ok := hists[table]
+	if !ok {
+		buckets := p4m.config.LockWaitBuckets
+		if len(buckets) == 0 {
+			buckets = lockWaitBuckets
+		}
+		h = newHistogram(buckets)
+		hists[table] = h
+	}
+	h.observe(float64(wait)/1000, nil, false)
+}
+
+func (p4m *P4DMetrics) observeLockWaits(t *p4dlog.Table) {
+	if t.ReadLocks > 0 || t.TotalReadWait > 0 || t.TotalReadHeld > 0 {
+		p4m.observeLockWait(p4m.tableReadWait, t.TableName, t.TotalReadWait)
+	}
+	if t.WriteLocks > 0 || t.TotalWriteWait > 0 || t.TotalWriteHeld > 0 {
+		p4m.observeLockWait(p4m.tableWriteWait, t.TableName, t.TotalWriteWait)
+	}
+}
+
+func (p4m *P4DMetrics) outputLockWaits(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	for _, m := range []struct {
+		name, help string
+		hists      map[string]*histogram
+	}{
+		{"p4_table_read_wait_seconds", "Histogram of cmd waits for read locks in seconds (by table)", p4m.tableReadWait},
+		{"p4_table_write_wait_seconds", "Histogram of cmd waits for write locks in seconds (by table)", p4m.tableWriteWait},
+	} {
+		if len(m.hists) == 0 {
+			continue
+		}
+		p4m.printMetricHeader(metrics, m.name, m.help, "histogram")
+		for _, table := range sortedKeys(m.hists) {
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.outputHistogramValues(metrics, m.name, m.hists[table], labels)
+		}
+	}
+}
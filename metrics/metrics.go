@@ -15,6 +15,8 @@ import (
 	"io"
 	"regexp"
 	"runtime/metrics"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +41,127 @@ type Config struct {
 	OutputCmdsByUserRegex string        `yaml:"output_cmds_by_user_regex"`
 	OutputCmdsByIP        bool          `yaml:"output_cmds_by_ip"`
 	CaseSensitiveServer   bool          `yaml:"case_sensitive_server"`
+	OutputTableIO         bool          `yaml:"output_table_io"`
+	OutputCmdHistogram    bool          `yaml:"output_cmd_histogram"`
+	// Regex of workspaces for which cmds are counted (p4_cmd_workspace_*) - see workspace.go
+	OutputCmdsByWorkspaceRegex string `yaml:"output_cmds_by_workspace_regex"`
+	// Histogram of command durations by client application family (p4_cmd_app_duration_seconds) - see appfamily.go
+	OutputCmdHistogramByApp bool `yaml:"output_cmd_histogram_by_app"`
+	// Histograms of per command lock waits by table (p4_table_read/write_wait_seconds) - see lockwait.go.
+	// LockWaitBuckets are upper bounds in seconds - a default set is used if not specified.
+	OutputLockWaitHistogram bool      `yaml:"output_lock_wait_histogram"`
+	LockWaitBuckets         []float64 `yaml:"lock_wait_buckets"`
+	// Completed cmds by band of count of cmds running (p4_cmd_running_band_*) - see runningband.go
+	// RunningBands are the upper bounds of bands - a default set is used if not specified.
+	OutputCmdsByRunningBand bool    `yaml:"output_cmds_by_running_band"`
+	RunningBands            []int64 `yaml:"running_bands"`
+	// Rows scanned by table (p4_table_scan_rows_total), with alerts for cmds scanning more than ScanRowsAlertThreshold
+	// rows of a table (default 10M) - see tablescan.go
+	OutputTableScanRows    bool  `yaml:"output_table_scan_rows"`
+	ScanRowsAlertThreshold int64 `yaml:"scan_rows_alert_threshold"`
+	// Label p4_cmd_counter and p4_cmd_cumulative_seconds with origin (direct/brokered/edge-forwarded/background) - see origin.go
+	OutputCmdsByOrigin bool `yaml:"output_cmds_by_origin"`
+	// Commands (e.g. user-sync) for which the most frequent argument patterns are recorded, see TopArgs and topargs.go
+	TopArgsCmds []string `yaml:"top_args_cmds"`
+	// Exemplars are only valid in OpenMetrics format - don't set if output is read by node_exporter
+	OutputExemplars bool `yaml:"output_exemplars"`
+	// Command storm detection - alert if a single user or IP exceeds either threshold within StormWindow (default 1m).
+	// Thresholds of 0 disable detection. See storm.go
+	StormWindow        time.Duration `yaml:"storm_window"`
+	StormCmdsPerMinute int64         `yaml:"storm_cmds_per_minute"`
+	StormLapse         float64       `yaml:"storm_lapse"` // Cumulative lapse (secs) of commands within window
+	// Threshold rules producing Alerts on the channel returned by P4DMetrics.Alerts() - see alerts.go
+	AlertRules []AlertRule `yaml:"alert_rules"`
+	// Added to timestamps of historical metrics, e.g. to correct for clock skew of the server writing the log
+	TimeOffset time.Duration `yaml:"time_offset"`
+	// Replaces the "p4_" prefix of all metric names, e.g. "perforce_" (default "p4_")
+	MetricPrefix string `yaml:"metric_prefix"`
+	// Static labels added to all series, e.g. {"datacenter": "lon", "environment": "prod"} - for aggregating the
+	// metrics of several sites without post-processing
+	Labels map[string]string `yaml:"labels"`
+	// Commands completed at or before this log time (and server events before it) are excluded from metrics, and
+	// historical metrics are not output before it - for re-processing logs which overlap a previous run, see since.go
+	Since time.Time `yaml:"since"`
+}
+
+// Default metric name prefix - see Config.MetricPrefix
+const defaultMetricPrefix = "p4_"
+
+var reMetricPrefix = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var reLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Label names output by all metrics, so not valid as static labels
+var reservedLabels = map[string]bool{"serverid": true, "sdpinst": true}
+
+// Characters which would corrupt the output of server_id/sdp_instance label values
+var reInvalidFixedLabelValue = regexp.MustCompile(`["\r\n]`)
+
+// Validate checks that config values are usable, e.g. that server_id and sdp_instance (which are output as
+// labels serverid and sdpinst on every metric) don't contain quotes or newlines. Other characters (e.g. spaces)
+// are output as given, so that existing series keep their labels.
+func (c *Config) Validate() error {
+	for _, l := range []labelStruct{{"server_id", c.ServerID}, {"sdp_instance", c.SDPInstance}} {
+		if reInvalidFixedLabelValue.MatchString(l.value) {
+			return fmt.Errorf("%s '%s' contains characters not valid in a metric label value", l.name, l.value)
+		}
+	}
+	if c.OutputCmdsByUserRegex != "" {
+		if _, err := regexp.Compile(fmt.Sprintf("(%s)", c.OutputCmdsByUserRegex)); err != nil {
+			return fmt.Errorf("output_cmds_by_user_regex '%s' is not a valid Go regex: %v", c.OutputCmdsByUserRegex, err)
+		}
+	}
+	if c.OutputCmdsByWorkspaceRegex != "" {
+		if _, err := regexp.Compile(c.OutputCmdsByWorkspaceRegex); err != nil {
+			return fmt.Errorf("output_cmds_by_workspace_regex '%s' is not a valid Go regex: %v", c.OutputCmdsByWorkspaceRegex, err)
+		}
+	}
+	if c.UpdateInterval < 0 || c.StormWindow < 0 {
+		return fmt.Errorf("update_interval and storm_window must not be negative")
+	}
+	if c.StormCmdsPerMinute < 0 || c.StormLapse < 0 {
+		return fmt.Errorf("storm_cmds_per_minute and storm_lapse must not be negative")
+	}
+	if c.ScanRowsAlertThreshold < 0 {
+		return fmt.Errorf("scan_rows_alert_threshold must not be negative")
+	}
+	if err := validAlertRules(c.AlertRules); err != nil {
+		return fmt.Errorf("alert_rules: %v", err)
+	}
+	if err := validRunningBands(c.RunningBands); err != nil {
+		return fmt.Errorf("running_bands: %v", err)
+	}
+	if err := validBuckets(c.LockWaitBuckets); err != nil {
+		return fmt.Errorf("lock_wait_buckets: %v", err)
+	}
+	if c.MetricPrefix != "" && !reMetricPrefix.MatchString(c.MetricPrefix) {
+		return fmt.Errorf("metric_prefix '%s' contains characters not valid in a metric name", c.MetricPrefix)
+	}
+	for name, value := range c.Labels {
+		if !reLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("labels: '%s' is not a valid label name", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("labels: '%s' is output on all metrics - use server_id/sdp_instance", name)
+		}
+		if value == "" || NotLabelValueRE.MatchString(value) {
+			return fmt.Errorf("labels: value '%s' of %s is empty or contains characters not valid in a metric label value", value, name)
+		}
+	}
+	return nil
+}
+
+// staticLabels returns Labels sorted by name
+func (c *Config) staticLabels() []labelStruct {
+	names := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := make([]labelStruct, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, labelStruct{name: name, value: c.Labels[name]})
+	}
+	return labels
 }
 
 // P4DMetricsVersion - for version info
@@ -50,135 +173,224 @@ type P4DMetricsVersion struct {
 
 // P4DMetrics structure
 type P4DMetrics struct {
-	config                    *Config
-	version                   *P4DMetricsVersion
-	historical                bool
-	debug                     int
-	fp                        *p4dlog.P4dFileParser
-	timeLatestStartCmd        time.Time
-	latestStartCmdBuf         string
-	logger                    *logrus.Logger
-	timeChan                  chan time.Time
-	cmdsRunning               int64
-	cmdsRunningMax            int64
-	cmdsPaused                int64 // Server Events
-	cmdsPausedMax             int64 // Server Events
-	cmdsPausedErrorCount      int64 // ditto
-	pauseRateCPU              int64 // ditto
-	pauseRateMem              int64 // ditto
-	cpuPressureState          int64 // ditto
-	memPressureState          int64 // ditto
-	cmdsPausedCumulative      float64
-	cmdCounter                map[string]int64
-	cmdErrorCounter           map[string]int64
-	cmdCumulative             map[string]float64
-	cmduCPUCumulative         map[string]float64
-	cmdsCPUCumulative         map[string]float64
-	cmdByUserCounter          map[string]int64
-	cmdByUserCumulative       map[string]float64
-	cmdByIPCounter            map[string]int64
-	cmdByIPCumulative         map[string]float64
-	cmdByReplicaCounter       map[string]int64
-	cmdByReplicaCumulative    map[string]float64
-	cmdByProgramCounter       map[string]int64
-	cmdByProgramCumulative    map[string]float64
-	cmdByUserDetailCounter    map[string]map[string]int64
-	cmdByUserDetailCumulative map[string]map[string]float64
-	totalReadWait             map[string]float64
-	totalReadHeld             map[string]float64
-	totalWriteWait            map[string]float64
-	totalWriteHeld            map[string]float64
-	totalTriggerLapse         map[string]float64
-	memMB                     int64
-	memPeakMB                 int64
-	syncFilesAdded            int64
-	syncFilesUpdated          int64
-	syncFilesDeleted          int64
-	syncBytesAdded            int64
-	syncBytesUpdated          int64
-	cmdsProcessed             int64
-	svrEventsProcessed        int64
-	linesRead                 int64
-	lbrRcsOpens               int64
-	lbrRcsCloses              int64
-	lbrRcsCheckins            int64
-	lbrRcsExists              int64
-	lbrRcsReads               int64
-	lbrRcsReadBytes           int64
-	lbrRcsWrites              int64
-	lbrRcsWriteBytes          int64
-	lbrRcsDigests             int64
-	lbrRcsFileSizes           int64
-	lbrRcsModTimes            int64
-	lbrRcsCopies              int64
-	lbrBinaryOpens            int64
-	lbrBinaryCloses           int64
-	lbrBinaryCheckins         int64
-	lbrBinaryExists           int64
-	lbrBinaryReads            int64
-	lbrBinaryReadBytes        int64
-	lbrBinaryWrites           int64
-	lbrBinaryWriteBytes       int64
-	lbrBinaryDigests          int64
-	lbrBinaryFileSizes        int64
-	lbrBinaryModTimes         int64
-	lbrBinaryCopies           int64
-	lbrCompressOpens          int64
-	lbrCompressCloses         int64
-	lbrCompressCheckins       int64
-	lbrCompressExists         int64
-	lbrCompressReads          int64
-	lbrCompressReadBytes      int64
-	lbrCompressWrites         int64
-	lbrCompressWriteBytes     int64
-	lbrCompressDigests        int64
-	lbrCompressFileSizes      int64
-	lbrCompressModTimes       int64
-	lbrCompressCopies         int64
-	lbrUncompressOpens        int64
-	lbrUncompressCloses       int64
-	lbrUncompressCheckins     int64
-	lbrUncompressExists       int64
-	lbrUncompressReads        int64
-	lbrUncompressReadBytes    int64
-	lbrUncompressWrites       int64
-	lbrUncompressWriteBytes   int64
-	lbrUncompressDigests      int64
-	lbrUncompressFileSizes    int64
-	lbrUncompressModTimes     int64
-	lbrUncompressCopies       int64
-	outputCmdsByUserRegex     *regexp.Regexp
+	config                     *Config
+	version                    *P4DMetricsVersion
+	historical                 bool
+	debug                      int
+	fp                         *p4dlog.P4dFileParser
+	timeLatestStartCmd         time.Time
+	latestStartCmdBuf          string
+	logger                     *logrus.Logger
+	timeChan                   chan time.Time
+	cmdsRunning                int64
+	cmdsRunningMax             int64
+	cmdsPaused                 int64 // Server Events
+	cmdsPausedMax              int64 // Server Events
+	cmdsPausedErrorCount       int64 // ditto
+	pauseRateCPU               int64 // ditto
+	pauseRateMem               int64 // ditto
+	cpuPressureState           int64 // ditto
+	memPressureState           int64 // ditto
+	svrEventDay                *p4dlog.ServerEventDay
+	monitorRemovedCount        int64 // Threads removed from monitor table (IDLE, Init())
+	serverRestarts             int64 // Server Events of type startup
+	timewarps                  int64 // Server Events of type timewarp
+	cmdsPausedCumulative       float64
+	cmdPausedCumulative        map[string]float64 // By cmd
+	cmdPausedTerminated        map[string]int64   // By cmd
+	cmdCounter                 map[string]int64
+	cmdErrorCounter            map[string]int64
+	cmdLimitExceededCounter    map[limitUser]int64
+	cmdKilledCounter           map[string]int64 // By reason
+	cmdCumulative              map[string]float64
+	cmduCPUCumulative          map[string]float64
+	cmdsCPUCumulative          map[string]float64
+	cmdByOriginCounter         map[cmdOrigin]int64
+	cmdByOriginCumulative      map[cmdOrigin]float64
+	cmdByUserCounter           map[string]int64
+	cmdByUserCumulative        map[string]float64
+	cmdByIPCounter             map[string]int64
+	cmdByIPCumulative          map[string]float64
+	cmdByWorkspaceCounter      map[string]int64
+	cmdByWorkspaceCumulative   map[string]float64
+	cmdByReplicaCounter        map[string]int64
+	cmdByReplicaCumulative     map[string]float64
+	cmdByRunningBandCounter    map[string]int64
+	cmdByRunningBandCumulative map[string]float64
+	tableScanRows              map[string]int64
+	tableScanRowsAlerts        map[string]int64
+	cmdByProgramCounter        map[string]int64
+	cmdByProgramCumulative     map[string]float64
+	cmdByUserDetailCounter     map[string]map[string]int64
+	cmdByUserDetailCumulative  map[string]map[string]float64
+	totalReadWait              map[string]float64
+	totalReadHeld              map[string]float64
+	totalWriteWait             map[string]float64
+	totalWriteHeld             map[string]float64
+	totalTriggerLapse          map[string]float64
+	swarmTriggerCounter        map[string]int64 // By swarm workflow stage
+	swarmTriggerLapse          map[string]float64
+	serializedLocks            map[string]*serializedLockTotals // By legacy table name, e.g. storageup_R
+	totalPagesIn               map[string]int64
+	totalPagesOut              map[string]int64
+	totalPagesCached           map[string]int64
+	cmdDuration                *histogram
+	cmdDurationByApp           map[string]*histogram
+	topArgs                    map[string]*argsPatterns
+	tableReadWait              map[string]*histogram // Lock wait histograms by table
+	tableWriteWait             map[string]*histogram
+	submitLatency              *histogram
+	pulls                      *pullStats          // Replication - see replication.go
+	pendingSubmits             map[int64]time.Time // user-submit start times by pid - see observeSubmitLatency
+	stormTrackers              map[stormKey]*stormTracker
+	stormLatestTime            time.Time
+	alerts                     chan Alert // Nil unless Config.AlertRules - see alerts.go
+	alertState                 alertState
+	memMB                      int64
+	memPeakMB                  int64
+	syncFilesAdded             int64
+	syncFilesUpdated           int64
+	syncFilesDeleted           int64
+	syncBytesAdded             int64
+	syncBytesUpdated           int64
+	filesSent                  int64 // From filetotals track output
+	filesReceived              int64
+	bytesSent                  int64
+	bytesReceived              int64
+	clientFilesSent            int64 // From filetotals (client) output of client-Stats records
+	clientFilesReceived        int64
+	clientBytesSent            int64
+	clientBytesReceived        int64
+	cmdsProcessed              int64
+	svrEventsProcessed         int64
+	linesRead                  int64
+	skippedBeforeSince         int64     // Commands/server events excluded as before Config.Since
+	latestCmdTime              time.Time // Latest completion time of commands processed
+	lbrRcsOpens                int64
+	lbrRcsCloses               int64
+	lbrRcsCheckins             int64
+	lbrRcsExists               int64
+	lbrRcsReads                int64
+	lbrRcsReadBytes            int64
+	lbrRcsWrites               int64
+	lbrRcsWriteBytes           int64
+	lbrRcsDigests              int64
+	lbrRcsFileSizes            int64
+	lbrRcsModTimes             int64
+	lbrRcsCopies               int64
+	lbrBinaryOpens             int64
+	lbrBinaryCloses            int64
+	lbrBinaryCheckins          int64
+	lbrBinaryExists            int64
+	lbrBinaryReads             int64
+	lbrBinaryReadBytes         int64
+	lbrBinaryWrites            int64
+	lbrBinaryWriteBytes        int64
+	lbrBinaryDigests           int64
+	lbrBinaryFileSizes         int64
+	lbrBinaryModTimes          int64
+	lbrBinaryCopies            int64
+	lbrCompressOpens           int64
+	lbrCompressCloses          int64
+	lbrCompressCheckins        int64
+	lbrCompressExists          int64
+	lbrCompressReads           int64
+	lbrCompressReadBytes       int64
+	lbrCompressWrites          int64
+	lbrCompressWriteBytes      int64
+	lbrCompressDigests         int64
+	lbrCompressFileSizes       int64
+	lbrCompressModTimes        int64
+	lbrCompressCopies          int64
+	lbrUncompressOpens         int64
+	lbrUncompressCloses        int64
+	lbrUncompressCheckins      int64
+	lbrUncompressExists        int64
+	lbrUncompressReads         int64
+	lbrUncompressReadBytes     int64
+	lbrUncompressWrites        int64
+	lbrUncompressWriteBytes    int64
+	lbrUncompressDigests       int64
+	lbrUncompressFileSizes     int64
+	lbrUncompressModTimes      int64
+	lbrUncompressCopies        int64
+	outputCmdsByUserRegex      *regexp.Regexp
+	outputCmdsByWorkspaceRegex *regexp.Regexp
 }
 
 // NewP4DMetricsLogParser - wraps P4dFileParser
 func NewP4DMetricsLogParser(config *Config, version *P4DMetricsVersion, logger *logrus.Logger, historical bool) *P4DMetrics {
-	return &P4DMetrics{
-		config:                    config,
-		version:                   version,
-		logger:                    logger,
-		fp:                        p4dlog.NewP4dFileParser(logger),
-		historical:                historical,
-		cmdCounter:                make(map[string]int64),
-		cmdErrorCounter:           make(map[string]int64),
-		cmdCumulative:             make(map[string]float64),
-		cmduCPUCumulative:         make(map[string]float64),
-		cmdsCPUCumulative:         make(map[string]float64),
-		cmdByUserCounter:          make(map[string]int64),
-		cmdByUserCumulative:       make(map[string]float64),
-		cmdByIPCounter:            make(map[string]int64),
-		cmdByIPCumulative:         make(map[string]float64),
-		cmdByReplicaCounter:       make(map[string]int64),
-		cmdByReplicaCumulative:    make(map[string]float64),
-		cmdByProgramCounter:       make(map[string]int64),
-		cmdByProgramCumulative:    make(map[string]float64),
-		cmdByUserDetailCounter:    make(map[string]map[string]int64),
-		cmdByUserDetailCumulative: make(map[string]map[string]float64),
-		totalReadWait:             make(map[string]float64),
-		totalReadHeld:             make(map[string]float64),
-		totalWriteWait:            make(map[string]float64),
-		totalWriteHeld:            make(map[string]float64),
-		totalTriggerLapse:         make(map[string]float64),
+	p4m, _ := NewP4DMetricsParser(config, version, logger, historical) // No options so no error
+	return p4m
+}
+
+// NewP4DMetricsParser - wraps a P4dFileParser created by p4dlog.NewParser with logger and opts, e.g.
+// p4dlog.WithServerPrefix. Returns an error for unknown features.
+func NewP4DMetricsParser(config *Config, version *P4DMetricsVersion, logger *logrus.Logger, historical bool,
+	opts ...p4dlog.Option) (*P4DMetrics, error) {
+	fp, err := p4dlog.NewParser(append([]p4dlog.Option{p4dlog.WithLogger(logger)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	p4m := &P4DMetrics{
+		config:                     config,
+		version:                    version,
+		logger:                     logger,
+		fp:                         fp,
+		historical:                 historical,
+		cmdCounter:                 make(map[string]int64),
+		cmdErrorCounter:            make(map[string]int64),
+		cmdPausedCumulative:        make(map[string]float64),
+		cmdPausedTerminated:        make(map[string]int64),
+		cmdLimitExceededCounter:    make(map[limitUser]int64),
+		cmdKilledCounter:           make(map[string]int64),
+		cmdCumulative:              make(map[string]float64),
+		cmduCPUCumulative:          make(map[string]float64),
+		cmdsCPUCumulative:          make(map[string]float64),
+		cmdByOriginCounter:         make(map[cmdOrigin]int64),
+		cmdByOriginCumulative:      make(map[cmdOrigin]float64),
+		cmdByUserCounter:           make(map[string]int64),
+		cmdByUserCumulative:        make(map[string]float64),
+		cmdByIPCounter:             make(map[string]int64),
+		cmdByIPCumulative:          make(map[string]float64),
+		cmdByWorkspaceCounter:      make(map[string]int64),
+		cmdByWorkspaceCumulative:   make(map[string]float64),
+		cmdByReplicaCounter:        make(map[string]int64),
+		cmdByReplicaCumulative:     make(map[string]float64),
+		cmdByRunningBandCounter:    make(map[string]int64),
+		cmdByRunningBandCumulative: make(map[string]float64),
+		tableScanRows:              make(map[string]int64),
+		tableScanRowsAlerts:        make(map[string]int64),
+		cmdByProgramCounter:        make(map[string]int64),
+		cmdByProgramCumulative:     make(map[string]float64),
+		cmdByUserDetailCounter:     make(map[string]map[string]int64),
+		cmdByUserDetailCumulative:  make(map[string]map[string]float64),
+		totalReadWait:              make(map[string]float64),
+		totalReadHeld:              make(map[string]float64),
+		totalWriteWait:             make(map[string]float64),
+		totalWriteHeld:             make(map[string]float64),
+		totalTriggerLapse:          make(map[string]float64),
+		swarmTriggerCounter:        make(map[string]int64),
+		swarmTriggerLapse:          make(map[string]float64),
+		serializedLocks:            make(map[string]*serializedLockTotals),
+		totalPagesIn:               make(map[string]int64),
+		totalPagesOut:              make(map[string]int64),
+		totalPagesCached:           make(map[string]int64),
+		cmdDuration:                newHistogram(durationBuckets),
+		cmdDurationByApp:           make(map[string]*histogram),
+		topArgs:                    make(map[string]*argsPatterns),
+		tableReadWait:              make(map[string]*histogram),
+		tableWriteWait:             make(map[string]*histogram),
+		submitLatency:              newHistogram(durationBuckets),
+		pulls:                      newPullStats(),
+		pendingSubmits:             make(map[int64]time.Time),
+		stormTrackers:              make(map[stormKey]*stormTracker),
 	}
+	if len(config.AlertRules) > 0 {
+		p4m.alerts = make(chan Alert, alertsChanSize)
+		p4m.alertState.firing = make([]bool, len(config.AlertRules))
+	}
+	return p4m, nil
 }
 
 // SetDebugPID - for debug purposes
@@ -197,6 +409,76 @@ func (p4m *P4DMetrics) SetNoCompletionRecords() {
 	p4m.fp.SetNoCompletionRecords()
 }
 
+// NoiseLinesCount - count of log lines discarded as not written by p4d
+func (p4m *P4DMetrics) NoiseLinesCount() int64 {
+	return p4m.fp.NoiseLinesCount()
+}
+
+// DuplicateOutputCount - count of commands output more than once with the same process key and line number
+func (p4m *P4DMetrics) DuplicateOutputCount() int64 {
+	return p4m.fp.DuplicateOutputCount()
+}
+
+// MonitorRemovedCount - count of threads removed from the monitor table (e.g. IDLE, Init())
+func (p4m *P4DMetrics) MonitorRemovedCount() int64 {
+	return p4m.fp.MonitorRemovedCount()
+}
+
+// LocksOnlyTrackCount - count of track records with table locks but no lapse/usage/rpc lines
+func (p4m *P4DMetrics) LocksOnlyTrackCount() int64 {
+	return p4m.fp.LocksOnlyTrackCount()
+}
+
+// SetMemoryLimit - set heap limit (MB) above which parser no longer retains table detail
+func (p4m *P4DMetrics) SetMemoryLimit(limitMB int64) {
+	p4m.fp.SetMemoryLimit(limitMB)
+}
+
+// TableDetailDroppedAt - log line no at which parser memory limit was exceeded, or 0
+func (p4m *P4DMetrics) TableDetailDroppedAt() int64 {
+	return p4m.fp.TableDetailDroppedAt()
+}
+
+// RegisterLineHook - call hook for each log line matching re, see p4dlog.LineHook
+func (p4m *P4DMetrics) RegisterLineHook(re *regexp.Regexp, hook p4dlog.LineHook) {
+	p4m.fp.RegisterLineHook(re, hook)
+}
+
+// SetFeature - enable or disable a parser feature
+func (p4m *P4DMetrics) SetFeature(name string, enabled bool) error {
+	return p4m.fp.SetFeature(name, enabled)
+}
+
+// SetDescriptionLimit - capture -d descriptions up to limit bytes, see p4dlog.SetDescriptionLimit
+func (p4m *P4DMetrics) SetDescriptionLimit(limit int) {
+	p4m.fp.SetDescriptionLimit(limit)
+}
+
+// Stats - parser statistics, see p4dlog.ParserStats
+func (p4m *P4DMetrics) Stats() p4dlog.ParserStats {
+	return p4m.fp.Stats()
+}
+
+// SetKeyMode - how process keys are generated, see p4dlog.KeyMode
+func (p4m *P4DMetrics) SetKeyMode(mode p4dlog.KeyMode) {
+	p4m.fp.SetKeyMode(mode)
+}
+
+// SetKeepPending - retain commands pending at end of input for checkpointing, see p4dlog.Checkpoint
+func (p4m *P4DMetrics) SetKeepPending() {
+	p4m.fp.SetKeepPending()
+}
+
+// Checkpoint - returns parser state once all commands have been processed
+func (p4m *P4DMetrics) Checkpoint() p4dlog.ParserCheckpoint {
+	return p4m.fp.Checkpoint()
+}
+
+// RestoreCheckpoint - restores parser state saved by Checkpoint before processing starts
+func (p4m *P4DMetrics) RestoreCheckpoint(cp p4dlog.ParserCheckpoint) {
+	p4m.fp.RestoreCheckpoint(cp)
+}
+
 // defines metrics label
 type labelStruct struct {
 	name  string
@@ -221,8 +503,17 @@ func (p4m *P4DMetrics) getMemoryUsage() uint64 {
 	return freeBytes
 }
 
+// metricName returns name (which starts "p4_") with the configured prefix
+func (p4m *P4DMetrics) metricName(name string) string {
+	if p4m.config.MetricPrefix == "" || p4m.config.MetricPrefix == defaultMetricPrefix {
+		return name
+	}
+	return p4m.config.MetricPrefix + strings.TrimPrefix(name, defaultMetricPrefix)
+}
+
 func (p4m *P4DMetrics) printMetricHeader(f io.Writer, name string, help string, metricType string) {
 	if !p4m.historical {
+		name = p4m.metricName(name)
 		fmt.Fprintf(f, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
 	}
 }
@@ -230,6 +521,7 @@ func (p4m *P4DMetrics) printMetricHeader(f io.Writer, name string, help string,
 // Prometheus format: 	metric_name{label1="val1",label2="val2"}
 // Graphite format:  	metric_name;label1=val1;label2=val2
 func (p4m *P4DMetrics) formatLabels(mname string, labels []labelStruct) string {
+	mname = p4m.metricName(mname)
 	nonBlankLabels := make([]labelStruct, 0)
 	for _, l := range labels {
 		if l.value != "" {
@@ -257,7 +549,7 @@ func (p4m *P4DMetrics) formatLabels(mname string, labels []labelStruct) string {
 func (p4m *P4DMetrics) formatMetric(mname string, labels []labelStruct, metricVal string) string {
 	if p4m.historical {
 		return fmt.Sprintf("%s %s %d\n", p4m.formatLabels(mname, labels),
-			metricVal, p4m.timeLatestStartCmd.Unix())
+			metricVal, p4m.timeLatestStartCmd.Add(p4m.config.TimeOffset).Unix())
 	}
 	return fmt.Sprintf("%s %s\n", p4m.formatLabels(mname, labels), metricVal)
 }
@@ -277,10 +569,111 @@ func (p4m *P4DMetrics) outputMetric(metrics *bytes.Buffer, mname string, mhelp s
 	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
 }
 
+// Upper bounds (seconds) of histogram buckets for durations - last (+Inf) bucket is implicit
+var durationBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+// exemplar links a histogram bucket to a specific command (e.g. the slowest in the interval)
+type exemplar struct {
+	processKey string
+	pid        int64
+	value      float64
+	endTime    time.Time
+}
+
+// OpenMetrics exemplar suffix: # {processKey="abc",pid="123"} 12.300 1520879607
+func (e *exemplar) format() string {
+	return fmt.Sprintf(" # {processKey=\"%s\",pid=\"%d\"} %0.3f %d", e.processKey, e.pid, e.value, e.endTime.Unix())
+}
+
+// histogram of durations in seconds, with optional exemplar (the slowest cmd) per bucket
+type histogram struct {
+	buckets   []float64
+	counts    []int64 // Per bucket (not cumulative)
+	sum       float64
+	count     int64
+	exemplars []*exemplar // Slowest cmd per bucket since last output
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets:   buckets,
+		counts:    make([]int64, len(buckets)+1),
+		exemplars: make([]*exemplar, len(buckets)+1),
+	}
+}
+
+func (h *histogram) observe(value float64, cmd *p4dlog.Command, withExemplar bool) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+	if withExemplar {
+		if e := h.exemplars[i]; e == nil || value > e.value {
+			h.exemplars[i] = &exemplar{processKey: cmd.GetKey(), pid: cmd.Pid, value: value, endTime: cmd.EndTime}
+		}
+	}
+}
+
+// Outputs the histogram with cumulative buckets. Exemplars are only written in non-historical mode
+// since Graphite format has no equivalent, and are reset after each output.
+func (p4m *P4DMetrics) outputHistogram(metrics *bytes.Buffer, mname, help string, h *histogram, fixedLabels []labelStruct) {
+	p4m.printMetricHeader(metrics, mname, help, "histogram")
+	p4m.outputHistogramValues(metrics, mname, h, fixedLabels)
+}
+
+func (p4m *P4DMetrics) outputHistogramValues(metrics *bytes.Buffer, mname string, h *histogram, fixedLabels []labelStruct) {
+	var count int64
+	for i := range h.counts {
+		count += h.counts[i]
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = strconv.FormatFloat(h.buckets[i], 'f', -1, 64)
+		}
+		labels := append(fixedLabels, labelStruct{"le", le})
+		buf := p4m.formatMetric(mname+"_bucket", labels, fmt.Sprintf("%d", count))
+		if e := h.exemplars[i]; e != nil && !p4m.historical {
+			buf = strings.TrimSuffix(buf, "\n") + e.format() + "\n"
+		}
+		fmt.Fprint(metrics, buf)
+		h.exemplars[i] = nil
+	}
+	p4m.printMetric(metrics, mname+"_sum", fixedLabels, fmt.Sprintf("%0.3f", h.sum))
+	p4m.printMetric(metrics, mname+"_count", fixedLabels, fmt.Sprintf("%d", h.count))
+}
+
+// Submits are processed in phases with the same pid: user-submit, dm-SubmitChange, dm-CommitSubmit.
+// We remember user-submit start times until the corresponding dm-CommitSubmit completes to give end-to-end latency.
+// Submits which fail never get a dm-CommitSubmit so we discard entries older than this.
+const submitLinkWindow = 24 * time.Hour
+
+func (p4m *P4DMetrics) observeSubmitLatency(cmd *p4dlog.Command) {
+	switch cmd.Cmd {
+	case "user-submit":
+		if len(p4m.pendingSubmits) > 1000 {
+			for pid, t := range p4m.pendingSubmits {
+				if cmd.StartTime.Sub(t) > submitLinkWindow {
+					delete(p4m.pendingSubmits, pid)
+				}
+			}
+		}
+		p4m.pendingSubmits[cmd.Pid] = cmd.StartTime
+	case "dm-CommitSubmit":
+		startTime, ok := p4m.pendingSubmits[cmd.Pid]
+		if !ok || cmd.EndTime.IsZero() || cmd.EndTime.Before(startTime) {
+			return
+		}
+		delete(p4m.pendingSubmits, cmd.Pid)
+		p4m.submitLatency.observe(cmd.EndTime.Sub(startTime).Seconds(), cmd, p4m.config.OutputExemplars)
+	}
+}
+
 // Publish cumulative results - called on a ticker or in historical mode
 func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	fixedLabels := []labelStruct{{name: "serverid", value: p4m.config.ServerID},
 		{name: "sdpinst", value: p4m.config.SDPInstance}}
+	fixedLabels = append(fixedLabels, p4m.config.staticLabels()...)
+	// No spare capacity, as metrics append their own labels to fixedLabels
+	fixedLabels = fixedLabels[:len(fixedLabels):len(fixedLabels)]
 	metrics := new(bytes.Buffer)
 	if p4dlog.FlagSet(p4m.debug, p4dlog.DebugMetricStats) {
 		p4m.logger.Debugf("Writing stats")
@@ -295,6 +688,7 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	p4m.printMetric(metrics, mname, labels, "1")
 
 	p4m.outputMetric(metrics, "p4_prom_log_lines_read", "A count of log lines read", "counter", fmt.Sprintf("%d", p4m.linesRead), fixedLabels)
+	p4m.outputMetric(metrics, "p4_prom_log_lines_discarded", "A count of log lines discarded as not written by p4d", "counter", fmt.Sprintf("%d", p4m.fp.NoiseLinesCount()), fixedLabels)
 	p4m.outputMetric(metrics, "p4_prom_cmds_processed", "A count of all cmds processed", "counter", fmt.Sprintf("%d", p4m.cmdsProcessed), fixedLabels)
 	p4m.outputMetric(metrics, "p4_prom_svr_events_processed", "A count of all server events processed", "counter", fmt.Sprintf("%d", p4m.svrEventsProcessed), fixedLabels)
 	p4m.outputMetric(metrics, "p4_prom_cmds_pending", "A count of all current cmds (not completed)", "gauge", fmt.Sprintf("%d", p4m.fp.CmdsPendingCount()), fixedLabels)
@@ -304,6 +698,13 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	p4m.outputMetric(metrics, "p4_cmds_paused", "The number of (resource pressure) paused commands at any one time", "gauge", fmt.Sprintf("%d", p4m.cmdsPaused), fixedLabels)
 	p4m.outputMetric(metrics, "p4_cmds_paused_max", "The max number of (resource pressure) paused commands since last metric", "gauge", fmt.Sprintf("%d", p4m.cmdsPausedMax), fixedLabels)
 	p4m.outputMetric(metrics, "p4_cmds_paused_errors", "The number of commands exited with error due to resource pressure thresholds being exceeded", "counter", fmt.Sprintf("%d", p4m.cmdsPausedErrorCount), fixedLabels)
+	p4m.outputMetric(metrics, "p4_threads_removed_from_monitor", "The number of threads (e.g. IDLE, Init()) which exited unexpectedly and were removed from the monitor table", "counter", fmt.Sprintf("%d", p4m.monitorRemovedCount), fixedLabels)
+	p4m.outputMetric(metrics, "p4_server_restarts_total", "The number of server startups seen in the log", "counter", fmt.Sprintf("%d", p4m.serverRestarts), fixedLabels)
+	p4m.outputMetric(metrics, "p4_log_timewarps_total", "The number of times log time went backwards by more than the timewarp threshold", "counter", fmt.Sprintf("%d", p4m.timewarps), fixedLabels)
+	if p4m.svrEventDay != nil {
+		p4m.outputMetric(metrics, "p4_cmds_running_max_daily", "The max number of running commands so far today (log time)", "gauge", fmt.Sprintf("%d", p4m.svrEventDay.ActiveThreadsMax), fixedLabels)
+		p4m.outputMetric(metrics, "p4_cmds_paused_max_daily", "The max number of (resource pressure) paused commands so far today (log time)", "gauge", fmt.Sprintf("%d", p4m.svrEventDay.PausedThreadsMax), fixedLabels)
+	}
 	p4m.outputMetric(metrics, "p4_pause_rate_cpu", "The (resource pressure) pause rate for CPU", "gauge", fmt.Sprintf("%d", p4m.pauseRateCPU), fixedLabels)
 	p4m.outputMetric(metrics, "p4_pause_rate_mem", "The (resource pressure) pause rate for Mem", "gauge", fmt.Sprintf("%d", p4m.pauseRateMem), fixedLabels)
 	p4m.outputMetric(metrics, "p4_pause_state_cpu", "The (resource pressure) pause state for CPU (0-2)", "gauge", fmt.Sprintf("%d", p4m.cpuPressureState), fixedLabels)
@@ -322,6 +723,18 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	p4m.outputMetric(metrics, "p4_sync_files_deleted", "The number of files deleted in workspaces by syncs", "counter", fmt.Sprintf("%d", p4m.syncFilesDeleted), fixedLabels)
 	p4m.outputMetric(metrics, "p4_sync_bytes_added", "The number of bytes added to workspaces by syncs", "counter", fmt.Sprintf("%d", p4m.syncBytesAdded), fixedLabels)
 	p4m.outputMetric(metrics, "p4_sync_bytes_updated", "The number of bytes updated in workspaces by syncs", "counter", fmt.Sprintf("%d", p4m.syncBytesUpdated), fixedLabels)
+	if p4m.filesSent+p4m.filesReceived > 0 { // Once filetotals track output has been seen
+		p4m.outputMetric(metrics, "p4_files_sent_total", "The number of files sent by commands (from filetotals track output)", "counter", fmt.Sprintf("%d", p4m.filesSent), fixedLabels)
+		p4m.outputMetric(metrics, "p4_files_received_total", "The number of files received by commands (from filetotals track output)", "counter", fmt.Sprintf("%d", p4m.filesReceived), fixedLabels)
+		p4m.outputMetric(metrics, "p4_bytes_sent_total", "The number of bytes sent by commands (from filetotals track output - which has MB resolution)", "counter", fmt.Sprintf("%d", p4m.bytesSent), fixedLabels)
+		p4m.outputMetric(metrics, "p4_bytes_received_total", "The number of bytes received by commands (from filetotals track output - which has MB resolution)", "counter", fmt.Sprintf("%d", p4m.bytesReceived), fixedLabels)
+	}
+	if p4m.clientFilesSent+p4m.clientFilesReceived > 0 { // Once client-Stats filetotals have been seen
+		p4m.outputMetric(metrics, "p4_client_files_sent_total", "The number of files sent by clients (from filetotals (client) output of client-Stats)", "counter", fmt.Sprintf("%d", p4m.clientFilesSent), fixedLabels)
+		p4m.outputMetric(metrics, "p4_client_files_received_total", "The number of files received by clients (from filetotals (client) output of client-Stats)", "counter", fmt.Sprintf("%d", p4m.clientFilesReceived), fixedLabels)
+		p4m.outputMetric(metrics, "p4_client_bytes_sent_total", "The number of bytes sent by clients (from filetotals (client) output of client-Stats - which has MB resolution)", "counter", fmt.Sprintf("%d", p4m.clientBytesSent), fixedLabels)
+		p4m.outputMetric(metrics, "p4_client_bytes_received_total", "The number of bytes received by clients (from filetotals (client) output of client-Stats - which has MB resolution)", "counter", fmt.Sprintf("%d", p4m.clientBytesReceived), fixedLabels)
+	}
 
 	p4m.outputMetric(metrics, "p4_lbr_rcs_opens", "The number of Lbr Rcs opens for commands", "counter", fmt.Sprintf("%d", p4m.lbrRcsOpens), fixedLabels)
 	p4m.outputMetric(metrics, "p4_lbr_rcs_closes", "The number of Lbr Rcs closes for commands", "counter", fmt.Sprintf("%d", p4m.lbrRcsCloses), fixedLabels)
@@ -372,17 +785,35 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	p4m.outputMetric(metrics, "p4_lbr_uncompress_modtimes", "The number of Lbr Uncompress ModTimes for commands", "counter", fmt.Sprintf("%d", p4m.lbrUncompressModTimes), fixedLabels)
 	p4m.outputMetric(metrics, "p4_lbr_uncompress_copies", "The number of Lbr Uncompress Copies for commands", "counter", fmt.Sprintf("%d", p4m.lbrUncompressCopies), fixedLabels)
 
-	mname = "p4_cmd_counter"
-	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by cmd)", "counter")
-	for cmd, count := range p4m.cmdCounter {
-		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	if p4m.config.OutputCmdHistogram {
+		p4m.outputHistogram(metrics, "p4_cmd_duration_seconds", "Histogram of completed cmd durations in seconds",
+			p4m.cmdDuration, fixedLabels)
 	}
-	mname = "p4_cmd_cumulative_seconds"
-	p4m.printMetricHeader(metrics, mname, "The total in seconds (by cmd)", "counter")
-	for cmd, lapse := range p4m.cmdCumulative {
-		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", lapse))
+	if p4m.config.OutputCmdHistogramByApp {
+		p4m.outputAppDurations(metrics, fixedLabels)
+	}
+	if p4m.submitLatency.count > 0 {
+		p4m.outputHistogram(metrics, "p4_submit_latency_seconds", "Histogram of end-to-end submit latency in seconds (user-submit start to dm-CommitSubmit end)",
+			p4m.submitLatency, fixedLabels)
+	}
+	p4m.outputPulls(metrics, fixedLabels)
+	p4m.outputRunningBands(metrics, fixedLabels)
+
+	if p4m.config.OutputCmdsByOrigin {
+		p4m.outputCmdsByOrigin(metrics, fixedLabels)
+	} else {
+		mname = "p4_cmd_counter"
+		p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by cmd)", "counter")
+		for cmd, count := range p4m.cmdCounter {
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+		}
+		mname = "p4_cmd_cumulative_seconds"
+		p4m.printMetricHeader(metrics, mname, "The total in seconds (by cmd)", "counter")
+		for cmd, lapse := range p4m.cmdCumulative {
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", lapse))
+		}
 	}
 	mname = "p4_cmd_cpu_user_cumulative_seconds"
 	p4m.printMetricHeader(metrics, mname, "The total in user CPU seconds (by cmd)", "counter")
@@ -402,6 +833,9 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 		labels := append(fixedLabels, labelStruct{"cmd", cmd})
 		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
 	}
+	p4m.outputLimitExceeded(metrics, fixedLabels)
+	p4m.outputKilled(metrics, fixedLabels)
+	p4m.outputPaused(metrics, fixedLabels)
 	// For large sites this might not be sensible - so they can turn it off
 	if p4m.config.OutputCmdsByUser {
 		mname = "p4_cmd_user_counter"
@@ -432,6 +866,9 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", lapse))
 		}
 	}
+	p4m.outputWorkspaces(metrics, fixedLabels)
+	p4m.outputStorms(metrics, fixedLabels)
+	p4m.evaluateAlerts()
 	// For large sites this might not be sensible - so they can turn it off
 	if p4m.config.OutputCmdsByUserRegex != "" {
 		mname = "p4_cmd_user_detail_counter"
@@ -505,6 +942,31 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 		labels := append(fixedLabels, labelStruct{"table", table})
 		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", total))
 	}
+	p4m.outputLockWaits(metrics, fixedLabels)
+	if p4m.config.OutputTableIO {
+		mname = "p4_total_pages_in"
+		p4m.printMetricHeader(metrics, mname,
+			"The total btree pages read (by table)", "counter")
+		for table, total := range p4m.totalPagesIn {
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", total))
+		}
+		mname = "p4_total_pages_out"
+		p4m.printMetricHeader(metrics, mname,
+			"The total btree pages written (by table)", "counter")
+		for table, total := range p4m.totalPagesOut {
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", total))
+		}
+		mname = "p4_total_pages_cached"
+		p4m.printMetricHeader(metrics, mname,
+			"The total btree pages cached (by table)", "counter")
+		for table, total := range p4m.totalPagesCached {
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", total))
+		}
+	}
+	p4m.outputTableScans(metrics, fixedLabels)
 	if len(p4m.totalTriggerLapse) > 0 {
 		mname = "p4_total_trigger_lapse_seconds"
 		p4m.printMetricHeader(metrics, mname,
@@ -514,9 +976,63 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", total))
 		}
 	}
+	if len(p4m.swarmTriggerCounter) > 0 {
+		mname = "p4_swarm_trigger_counter"
+		p4m.printMetricHeader(metrics, mname,
+			"A count of Swarm trigger executions (by workflow stage)", "counter")
+		for stage, count := range p4m.swarmTriggerCounter {
+			labels := append(fixedLabels, labelStruct{"stage", stage})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+		}
+		mname = "p4_swarm_trigger_lapse_seconds"
+		p4m.printMetricHeader(metrics, mname,
+			"The total lapse time for Swarm triggers in seconds (by workflow stage)", "counter")
+		for stage, total := range p4m.swarmTriggerLapse {
+			labels := append(fixedLabels, labelStruct{"stage", stage})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", total))
+		}
+	}
+	if len(p4m.serializedLocks) > 0 {
+		p4m.outputSerializedLocks(metrics, fixedLabels)
+	}
 	return metrics.String()
 }
 
+// serializedLockTotals - totals for a storage serialization lock, e.g. storageup(R), which gate submits
+type serializedLockTotals struct {
+	name, mode                               string
+	count                                    int64
+	readWait, readHeld, writeWait, writeHeld float64 // Seconds
+}
+
+func (p4m *P4DMetrics) outputSerializedLocks(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	outputs := []struct {
+		name, help string
+		value      func(l *serializedLockTotals) string
+	}{
+		{"p4_serialized_lock_counter", "A count of commands taking storage serialization locks (by lock name and mode)",
+			func(l *serializedLockTotals) string { return fmt.Sprintf("%d", l.count) }},
+		{"p4_serialized_lock_read_wait_seconds", "The total waiting for storage serialization read locks in seconds",
+			func(l *serializedLockTotals) string { return fmt.Sprintf("%0.3f", l.readWait) }},
+		{"p4_serialized_lock_read_held_seconds", "The total storage serialization read locks held in seconds",
+			func(l *serializedLockTotals) string { return fmt.Sprintf("%0.3f", l.readHeld) }},
+		{"p4_serialized_lock_write_wait_seconds", "The total waiting for storage serialization write locks in seconds",
+			func(l *serializedLockTotals) string { return fmt.Sprintf("%0.3f", l.writeWait) }},
+		{"p4_serialized_lock_write_held_seconds", "The total storage serialization write locks held in seconds",
+			func(l *serializedLockTotals) string { return fmt.Sprintf("%0.3f", l.writeHeld) }},
+	}
+	for _, o := range outputs {
+		p4m.printMetricHeader(metrics, o.name, o.help, "counter")
+		for _, l := range p4m.serializedLocks {
+			labels := append(fixedLabels, labelStruct{"name", l.name})
+			if l.mode != "" {
+				labels = append(labels, labelStruct{"mode", l.mode})
+			}
+			p4m.printMetric(metrics, o.name, labels, o.value(l))
+		}
+	}
+}
+
 func (p4m *P4DMetrics) publishSvrEvent(evt p4dlog.ServerEvent) {
 	p4m.cmdsRunning = evt.ActiveThreads
 	p4m.cmdsRunningMax = evt.ActiveThreadsMax
@@ -527,6 +1043,19 @@ func (p4m *P4DMetrics) publishSvrEvent(evt p4dlog.ServerEvent) {
 	p4m.pauseRateMem = evt.PauseRateMem
 	p4m.cpuPressureState = evt.CPUPressureState
 	p4m.memPressureState = evt.MemPressureState
+	if evt.RemovedPid != 0 {
+		p4m.monitorRemovedCount++
+	}
+	if evt.EventType == p4dlog.EventTypeStartup {
+		p4m.serverRestarts++
+	}
+	if evt.EventType == p4dlog.EventTypeTimewarp {
+		p4m.timewarps++
+	}
+	if day := evt.Day(); p4m.svrEventDay == nil || !p4m.svrEventDay.Day.Equal(day) {
+		p4m.svrEventDay = &p4dlog.ServerEventDay{Day: day}
+	}
+	p4m.svrEventDay.Update(&evt)
 }
 
 func (p4m *P4DMetrics) publishCmdEvent(cmd p4dlog.Command) {
@@ -534,12 +1063,25 @@ func (p4m *P4DMetrics) publishCmdEvent(cmd p4dlog.Command) {
 	p4m.cmdCumulative[cmd.Cmd] += float64(cmd.CompletedLapse)
 	p4m.cmduCPUCumulative[cmd.Cmd] += float64(cmd.UCpu) / 1000
 	p4m.cmdsCPUCumulative[cmd.Cmd] += float64(cmd.SCpu) / 1000
+	if p4m.config.OutputCmdsByOrigin {
+		p4m.observeCmdOrigin(&cmd)
+	}
 	if cmd.CmdError {
 		p4m.cmdErrorCounter[cmd.Cmd]++
 	}
-	if cmd.Paused > 0.0 {
-		p4m.cmdsPausedCumulative += float64(cmd.Paused)
+	p4m.observeLimitExceeded(&cmd)
+	p4m.observeKilled(&cmd)
+	if p4m.config.OutputCmdHistogram {
+		p4m.cmdDuration.observe(float64(cmd.CompletedLapse), &cmd, p4m.config.OutputExemplars)
 	}
+	p4m.observeAppDuration(cmd.App, float64(cmd.CompletedLapse))
+	p4m.observeTopArgs(&cmd)
+	p4m.observeSubmitLatency(&cmd)
+	p4m.observePull(&cmd)
+	if p4m.config.OutputCmdsByRunningBand {
+		p4m.observeRunningBand(cmd.Running, float64(cmd.CompletedLapse))
+	}
+	p4m.observePaused(&cmd)
 	p4m.cmdsRunning = cmd.Running
 	p4m.memMB += cmd.MemMB
 	p4m.memPeakMB += cmd.MemPeakMB
@@ -548,6 +1090,16 @@ func (p4m *P4DMetrics) publishCmdEvent(cmd p4dlog.Command) {
 	p4m.syncFilesDeleted += cmd.NetFilesDeleted
 	p4m.syncBytesAdded += cmd.NetBytesAdded
 	p4m.syncBytesUpdated += cmd.NetBytesUpdated
+	p4m.filesSent += cmd.FileTotalsSnd
+	p4m.filesReceived += cmd.FileTotalsRcv
+	p4m.bytesSent += cmd.FileTotalsSndMBytes * 1024 * 1024
+	p4m.bytesReceived += cmd.FileTotalsRcvMBytes * 1024 * 1024
+	if cmd.Cmd == "client-Stats" { // Counted once, rather than also for the command to which they are attributed
+		p4m.clientFilesSent += cmd.FileTotalsClientSnd
+		p4m.clientFilesReceived += cmd.FileTotalsClientRcv
+		p4m.clientBytesSent += cmd.FileTotalsClientSndMBytes * 1024 * 1024
+		p4m.clientBytesReceived += cmd.FileTotalsClientRcvMBytes * 1024 * 1024
+	}
 	p4m.lbrRcsOpens += cmd.LbrRcsOpens
 	p4m.lbrRcsCloses += cmd.LbrRcsCloses
 	p4m.lbrRcsExists += cmd.LbrRcsExists
@@ -626,6 +1178,8 @@ func (p4m *P4DMetrics) publishCmdEvent(cmd p4dlog.Command) {
 	}
 	p4m.cmdByIPCounter[ip]++
 	p4m.cmdByIPCumulative[ip] += float64(cmd.CompletedLapse)
+	p4m.observeWorkspace(cmd.Workspace, float64(cmd.CompletedLapse))
+	p4m.observeStorm(&cmd, user, ip)
 	if replica != "" {
 		p4m.cmdByReplicaCounter[replica]++
 		p4m.cmdByReplicaCumulative[replica] += float64(cmd.CompletedLapse)
@@ -641,13 +1195,76 @@ func (p4m *P4DMetrics) publishCmdEvent(cmd p4dlog.Command) {
 		if len(t.TableName) > len(triggerPrefix) && t.TableName[:len(triggerPrefix)] == triggerPrefix {
 			triggerName := t.TableName[len(triggerPrefix):]
 			p4m.totalTriggerLapse[triggerName] += float64(t.TriggerLapse)
+			if t.TriggerStage != "" {
+				p4m.swarmTriggerCounter[t.TriggerStage]++
+				p4m.swarmTriggerLapse[t.TriggerStage] += float64(t.TriggerLapse)
+			}
 		} else {
 			p4m.totalReadHeld[t.TableName] += float64(t.TotalReadHeld) / 1000
 			p4m.totalReadWait[t.TableName] += float64(t.TotalReadWait) / 1000
 			p4m.totalWriteHeld[t.TableName] += float64(t.TotalWriteHeld) / 1000
 			p4m.totalWriteWait[t.TableName] += float64(t.TotalWriteWait) / 1000
+			if p4m.config.OutputLockWaitHistogram {
+				p4m.observeLockWaits(t)
+			}
+			if p4m.config.OutputTableScanRows {
+				p4m.observeTableScan(&cmd, t)
+			}
+			p4m.totalPagesIn[t.TableName] += t.PagesIn
+			p4m.totalPagesOut[t.TableName] += t.PagesOut
+			p4m.totalPagesCached[t.TableName] += t.PagesCached
+		}
+	}
+	for k, l := range cmd.SerializedLocks {
+		totals, ok := p4m.serializedLocks[k]
+		if !ok {
+			totals = &serializedLockTotals{name: l.Name, mode: l.Mode}
+			p4m.serializedLocks[k] = totals
+		}
+		totals.count++
+		totals.readWait += float64(l.TotalReadWait) / 1000
+		totals.readHeld += float64(l.TotalReadHeld) / 1000
+		totals.writeWait += float64(l.TotalWriteWait) / 1000
+		totals.writeHeld += float64(l.TotalWriteHeld) / 1000
+		// Also in the table lock totals as before they were separated from tables, e.g. table="storageup_R"
+		p4m.totalReadHeld[k] += float64(l.TotalReadHeld) / 1000
+		p4m.totalReadWait[k] += float64(l.TotalReadWait) / 1000
+		p4m.totalWriteHeld[k] += float64(l.TotalWriteHeld) / 1000
+		p4m.totalWriteWait[k] += float64(l.TotalWriteWait) / 1000
+	}
+}
+
+// TableIO - aggregated btree page IO for a single table
+type TableIO struct {
+	TableName   string
+	PagesIn     int64
+	PagesOut    int64
+	PagesCached int64
+}
+
+// TopTablesByIO returns up to n tables with the most pages read+written, highest first.
+// Should only be called once processing is complete.
+func (p4m *P4DMetrics) TopTablesByIO(n int) []TableIO {
+	result := make([]TableIO, 0, len(p4m.totalPagesIn))
+	for table := range p4m.totalPagesIn {
+		result = append(result, TableIO{
+			TableName:   table,
+			PagesIn:     p4m.totalPagesIn[table],
+			PagesOut:    p4m.totalPagesOut[table],
+			PagesCached: p4m.totalPagesCached[table],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti, tj := result[i].PagesIn+result[i].PagesOut, result[j].PagesIn+result[j].PagesOut
+		if ti != tj {
+			return ti > tj
 		}
+		return result[i].TableName < result[j].TableName
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
 	}
+	return result
 }
 
 // GO standard reference value/format: Mon Jan 2 15:04:05 -0700 MST 2006
@@ -698,6 +1315,102 @@ func (p4m *P4DMetrics) historicalUpdateRequired(line string) bool {
 	return false
 }
 
+// publishEvent publishes a command or server event, passing it on to cmdsOutChan if not nil
+func (p4m *P4DMetrics) publishEvent(evt interface{}, cmdsOutChan chan interface{}) {
+	switch cmd := evt.(type) {
+	case p4dlog.Command:
+		if p4m.logger.Level > logrus.DebugLevel && p4dlog.FlagSet(p4m.debug, p4dlog.DebugCommands) {
+			p4m.logger.Tracef("Publishing cmd: %s", cmd.String())
+		}
+		p4m.cmdsProcessed++
+		if !p4m.skipCmd(&cmd) {
+			p4m.publishCmdEvent(cmd)
+		}
+		if cmdsOutChan != nil {
+			cmdsOutChan <- cmd
+		}
+	case p4dlog.ServerEvent:
+		if p4m.logger.Level > logrus.DebugLevel && p4dlog.FlagSet(p4m.debug, p4dlog.DebugCommands) {
+			p4m.logger.Tracef("Publishing svrEvent: %s", cmd.String())
+		}
+		p4m.svrEventsProcessed++
+		if !p4m.skipSvrEvent(&cmd) {
+			p4m.publishSvrEvent(cmd)
+		}
+		if cmdsOutChan != nil {
+			cmdsOutChan <- cmd
+		}
+	default:
+		// Other records (e.g. p4dlog.ProxyEvent/BrokerEvent) have no metrics but are passed on
+		if cmdsOutChan != nil {
+			cmdsOutChan <- evt
+		}
+	}
+}
+
+// historicalCmdUpdateRequired - as historicalUpdateRequired but using command start times, for input
+// without text log lines (e.g. structured logs)
+func (p4m *P4DMetrics) historicalCmdUpdateRequired(evt interface{}) bool {
+	cmd, ok := evt.(p4dlog.Command)
+	if !ok || !p4m.historical || cmd.StartTime.IsZero() {
+		return false
+	}
+	if p4m.timeLatestStartCmd.IsZero() {
+		p4m.timeLatestStartCmd = cmd.StartTime
+		return false
+	}
+	if cmd.StartTime.Sub(p4m.timeLatestStartCmd) >= p4m.config.UpdateInterval {
+		p4m.timeLatestStartCmd = cmd.StartTime
+		return true
+	}
+	return false
+}
+
+// ProcessCmds - as ProcessEvents but for commands/server events already parsed, e.g. by
+// p4dlog.StructuredLogParser, rather than p4d log lines
+func (p4m *P4DMetrics) ProcessCmds(ctx context.Context, cmdsInChan <-chan interface{}, needCmdChan bool) (
+	chan interface{}, chan string) {
+	ticker := time.NewTicker(p4m.config.UpdateInterval)
+	metricsChan := make(chan string, 1000)
+	var cmdsOutChan chan interface{}
+	if needCmdChan {
+		cmdsOutChan = make(chan interface{}, 10000)
+	}
+
+	go func() {
+		defer close(metricsChan)
+		defer p4m.closeAlerts()
+		if needCmdChan {
+			defer close(cmdsOutChan)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				p4m.logger.Info("Done received")
+				return
+			case <-ticker.C:
+				if !p4m.historical {
+					metricsChan <- p4m.getCumulativeMetrics()
+				}
+			case cmd, ok := <-cmdsInChan:
+				if !ok {
+					p4m.logger.Debugf("Cmds closed")
+					if p4m.historicalOutputRequired() {
+						metricsChan <- p4m.getCumulativeMetrics()
+					}
+					return
+				}
+				if p4m.historicalCmdUpdateRequired(cmd) && p4m.historicalOutputRequired() {
+					metricsChan <- p4m.getCumulativeMetrics()
+				}
+				p4m.publishEvent(cmd, cmdsOutChan)
+			}
+		}
+	}()
+
+	return cmdsOutChan, metricsChan
+}
+
 // ProcessEvents - main event loop for P4Prometheus - reads lines and outputs metrics
 // Wraps p4dlog.LogParser event loop
 func (p4m *P4DMetrics) ProcessEvents(ctx context.Context, linesInChan <-chan string, needCmdChan bool) (
@@ -722,6 +1435,7 @@ func (p4m *P4DMetrics) ProcessEvents(ctx context.Context, linesInChan <-chan str
 
 	go func() {
 		defer close(metricsChan)
+		defer p4m.closeAlerts()
 		if needCmdChan {
 			defer close(cmdsOutChan)
 		}
@@ -740,29 +1454,12 @@ func (p4m *P4DMetrics) ProcessEvents(ctx context.Context, linesInChan <-chan str
 				}
 			case cmd, ok := <-cmdsInChan:
 				if ok {
-					switch cmd := cmd.(type) {
-					case p4dlog.Command:
-						if p4m.logger.Level > logrus.DebugLevel && p4dlog.FlagSet(p4m.debug, p4dlog.DebugCommands) {
-							p4m.logger.Tracef("Publishing cmd: %s", cmd.String())
-						}
-						p4m.cmdsProcessed++
-						p4m.publishCmdEvent(cmd)
-						if needCmdChan {
-							cmdsOutChan <- cmd
-						}
-					case p4dlog.ServerEvent:
-						if p4m.logger.Level > logrus.DebugLevel && p4dlog.FlagSet(p4m.debug, p4dlog.DebugCommands) {
-							p4m.logger.Tracef("Publishing svrEvent: %s", cmd.String())
-						}
-						p4m.svrEventsProcessed++
-						p4m.publishSvrEvent(cmd)
-						if needCmdChan {
-							cmdsOutChan <- cmd
-						}
-					}
+					p4m.publishEvent(cmd, cmdsOutChan)
 				} else {
 					p4m.logger.Debugf("FP Cmd closed")
-					metricsChan <- p4m.getCumulativeMetrics()
+					if p4m.historicalOutputRequired() {
+						metricsChan <- p4m.getCumulativeMetrics()
+					}
 					return
 				}
 			case line, ok := <-linesInChan:
@@ -772,7 +1469,7 @@ func (p4m *P4DMetrics) ProcessEvents(ctx context.Context, linesInChan <-chan str
 					}
 					p4m.linesRead++
 					fpLinesChan <- line
-					if p4m.historical && p4m.historicalUpdateRequired(line) {
+					if p4m.historical && p4m.historicalUpdateRequired(line) && p4m.historicalOutputRequired() {
 						metricsChan <- p4m.getCumulativeMetrics()
 					}
 				} else {
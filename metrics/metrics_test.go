@@ -1,12 +1,18 @@
 package metrics
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -270,6 +276,53 @@ p4_sync_files_updated;serverid=myserverid 6 1441210990`, -1)
 
 }
 
+// Tests filetotals counting
+func TestP4PromFileTotals(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@fred_ws 10.1.2.212 [p4/2024.1/LINUX26X86_64/2573667] 'user-sync //...'
+Perforce server info:
+	2024/04/03 12:20:15 pid 5032 completed 1.2s
+Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@fred_ws 10.1.2.212 [p4/2024.1/LINUX26X86_64/2573667] 'user-sync //...'
+--- lapse 1.2s
+--- rpc msgs/size in+out 0+12/0mb+0mb himarks 64836/523588 snd/rcv .000s/.000s
+--- filetotals (svr) send/recv files+bytes 120+35mb/4+2mb
+
+Perforce server info:
+	2024/04/03 12:20:16 pid 5033 fred@fred_ws 10.1.2.212 [p4/2024.1/LINUX26X86_64/2573667] 'user-submit -d test'
+Perforce server info:
+	2024/04/03 12:20:17 pid 5033 completed 1.1s
+Perforce server info:
+	2024/04/03 12:20:16 pid 5033 fred@fred_ws 10.1.2.212 [p4/2024.1/LINUX26X86_64/2573667] 'user-submit -d test'
+--- lapse 1.1s
+
+Perforce server info:
+	2024/04/03 12:20:17 pid 5033 unknown@unknown 10.1.2.212 [p4/2024.1/LINUX26X86_64/2573667] 'client-Stats'
+--- filetotals (client) send/recv files+bytes 3+2mb/0+0mb
+`
+	output := basicTest(cfg, input, false)
+	totals := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_files_") || strings.HasPrefix(line, "p4_bytes_") || strings.HasPrefix(line, "p4_client_") {
+			totals = append(totals, line)
+		}
+	}
+	sort.Strings(totals)
+	assert.Equal(t, []string{
+		`p4_bytes_received_total{serverid="myserverid"} 2097152`,
+		`p4_bytes_sent_total{serverid="myserverid"} 36700160`,
+		`p4_client_bytes_received_total{serverid="myserverid"} 0`,
+		`p4_client_bytes_sent_total{serverid="myserverid"} 2097152`,
+		`p4_client_files_received_total{serverid="myserverid"} 0`,
+		`p4_client_files_sent_total{serverid="myserverid"} 3`,
+		`p4_files_received_total{serverid="myserverid"} 4`,
+		`p4_files_sent_total{serverid="myserverid"} 120`}, totals)
+}
+
 func TestP4PromBasicNoUser(t *testing.T) {
 	cfg := &Config{
 		ServerID:         "myserverid",
@@ -408,6 +461,55 @@ p4_prom_log_lines_read;serverid=myserverid 10 1441207450
 p4_prom_log_lines_read;serverid=myserverid 17 1441207511
 p4_prom_log_lines_read;serverid=myserverid 22 1441207511`, -1)
 	compareOutput(t, expected, output)
+
+	// Clock skew correction
+	cfg.TimeOffset = -90 * time.Second
+	output = basicTest(cfg, input, historical)
+	assert.Contains(t, output, fmt.Sprintf("p4_cmd_counter;serverid=myserverid;cmd=user-sync 3 %d", cmdTime.Unix()-90))
+}
+
+func TestP4PromSince(t *testing.T) {
+	// Commands completed before (or at) Since are from a previous run, so aren't counted again
+	since, _ := time.Parse(p4timeformat, "2015/09/02 15:24:10")
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		Since:          since}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+
+Perforce server info:
+	2015/09/02 15:24:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:24:10 pid 1617 completed .032s
+
+Perforce server info:
+	2015/09/02 15:25:11 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:25:11 pid 1617 completed .033s
+`
+	output := basicTest(cfg, input, true)
+	assert.Contains(t, output, "p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1441207511")
+	assert.Contains(t, output, "p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.033 1441207511")
+	for _, line := range output {
+		fields := strings.Fields(line)
+		ts, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		assert.NoError(t, err)
+		assert.False(t, ts < since.Unix(), line)
+	}
+
+	// Only the command completed at Since was counted by the previous run
+	cfg.Since = since.Add(-time.Second)
+	output = basicTest(cfg, input, true)
+	assert.Contains(t, output, "p4_cmd_counter;serverid=myserverid;cmd=user-sync 2 1441207511")
+	assert.Contains(t, output, "p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.065 1441207511")
+
+	// Nothing is output for a log entirely before Since
+	cfg.Since = since.Add(time.Hour)
+	assert.Equal(t, []string{}, basicTest(cfg, input, true))
 }
 
 func TestP4PromMultiCmds(t *testing.T) {
@@ -483,6 +585,8 @@ p4_total_read_held_seconds{serverid="myserverid",table="integed"} 0.022
 p4_total_read_wait_seconds{serverid="myserverid",table="archmap"} 0.032
 p4_total_read_wait_seconds{serverid="myserverid",table="counters"} 0.000
 p4_total_read_wait_seconds{serverid="myserverid",table="integed"} 0.012
+p4_swarm_trigger_counter{serverid="myserverid",stage="changesave"} 1
+p4_swarm_trigger_lapse_seconds{serverid="myserverid",stage="changesave"} 0.044
 p4_total_trigger_lapse_seconds{serverid="myserverid",trigger="swarm.changesave"} 0.044
 p4_total_write_held_seconds{serverid="myserverid",table="archmap"} 0.780
 p4_total_write_held_seconds{serverid="myserverid",table="counters"} 0.000
@@ -532,6 +636,8 @@ p4_total_read_held_seconds;serverid=myserverid;table=integed 0.022 1528673409
 p4_total_read_wait_seconds;serverid=myserverid;table=archmap 0.032 1528673409
 p4_total_read_wait_seconds;serverid=myserverid;table=counters 0.000 1528673409
 p4_total_read_wait_seconds;serverid=myserverid;table=integed 0.012 1528673409
+p4_swarm_trigger_counter;serverid=myserverid;stage=changesave 1 1528673409
+p4_swarm_trigger_lapse_seconds;serverid=myserverid;stage=changesave 0.044 1528673409
 p4_total_trigger_lapse_seconds;serverid=myserverid;trigger=swarm.changesave 0.044 1528673409
 p4_total_write_held_seconds;serverid=myserverid;table=archmap 0.780 1528673409
 p4_total_write_held_seconds;serverid=myserverid;table=counters 0.000 1528673409
@@ -713,6 +819,163 @@ func TestP4PromLabelValues(t *testing.T) {
 
 }
 
+// Every metric family must include sdpinst if set, otherwise series from different instances can't be aggregated
+func TestP4PromSDPInstanceLabels(t *testing.T) {
+	cfg := &Config{
+		ServerID:                "myserverid",
+		SDPInstance:             "1",
+		UpdateInterval:          10 * time.Millisecond,
+		OutputCmdsByUser:        true,
+		OutputCmdsByUserRegex:   ".*",
+		OutputCmdsByIP:          true,
+		OutputTableIO:           true,
+		OutputCmdHistogram:      true,
+		OutputCmdHistogramByApp: true,
+		StormCmdsPerMinute:      1,
+	}
+	input := `
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 fred@fred_ws 10.1.4.213/10.1.3.243 [Helix P4V/NTX64/2019.2/1904275/v86] 'user-submit -i'
+--- storageup/storageup(R)
+---   total lock wait+held read/write 1000ms+2000ms/0ms+0ms
+
+Perforce server info:
+	2020/03/11 06:08:17 pid 15855 completed .276s 4+4us 256+224io 0+0net 9212k 0pf
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 fred@fred_ws 10.1.4.213/10.1.3.243 [Helix P4V/NTX64/2019.2/1904275/v86] 'user-submit -i'
+--- lapse .276s
+--- db.counters
+---   pages in+out+cached 7+6+2
+---   locks read/write 0/2 rows get+pos+scan put+del 0+0+0 1+0
+---   total lock wait+held read/write 0ms+0ms/10ms+20ms
+
+Perforce server info:
+	2020/03/11 06:08:18 pid 15856 fred@fred_ws 10.1.4.213 [Helix P4V/NTX64/2019.2/1904275/v86] 'dm-CommitSubmit'
+Perforce server info:
+	2020/03/11 06:08:19 pid 15856 completed .276s 4+4us 256+224io 0+0net 9212k 0pf
+`
+	for _, historical := range []bool{false, true} {
+		output := basicTest(cfg, input, historical)
+		assert.Greater(t, len(output), 50)
+		for _, line := range output {
+			if !strings.Contains(line, `sdpinst="1"`) && !strings.Contains(line, ";sdpinst=1") {
+				t.Errorf("sdpinst label missing: %s", line)
+			}
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg Config
+		err string
+	}{
+		{cfg: Config{ServerID: "myserverid", SDPInstance: "1", OutputCmdsByUserRegex: "svc_.*"}},
+		{cfg: Config{}},
+		{cfg: Config{ServerID: "my server"}},
+		{cfg: Config{ServerID: "my\nserver"}, err: "server_id 'my\nserver' contains characters not valid"},
+		{cfg: Config{ServerID: "myserverid", SDPInstance: `1"`}, err: "sdp_instance '1\"' contains characters not valid"},
+		{cfg: Config{OutputCmdsByUserRegex: "svc_(.*"}, err: "output_cmds_by_user_regex 'svc_(.*' is not a valid Go regex"},
+		{cfg: Config{OutputCmdsByWorkspaceRegex: "bld_(.*"}, err: "output_cmds_by_workspace_regex 'bld_(.*' is not a valid Go regex"},
+		{cfg: Config{UpdateInterval: -time.Second}, err: "must not be negative"},
+		{cfg: Config{StormCmdsPerMinute: -1}, err: "must not be negative"},
+		{cfg: Config{LockWaitBuckets: []float64{0.1, 1, 10}}},
+		{cfg: Config{LockWaitBuckets: []float64{1, 0.1}}, err: "lock_wait_buckets: buckets must be positive and increasing"},
+		{cfg: Config{LockWaitBuckets: []float64{0, 1}}, err: "lock_wait_buckets"},
+		{cfg: Config{RunningBands: []int64{10, 50}}},
+		{cfg: Config{ScanRowsAlertThreshold: -1}, err: "scan_rows_alert_threshold must not be negative"},
+		{cfg: Config{RunningBands: []int64{10, 10}}, err: "running_bands: bands must be positive and increasing"},
+		{cfg: Config{MetricPrefix: "perforce_", Labels: map[string]string{"datacenter": "lon", "env": "prod"}}},
+		{cfg: Config{MetricPrefix: "p4-"}, err: "metric_prefix 'p4-' contains characters not valid"},
+		{cfg: Config{Labels: map[string]string{"data-center": "lon"}}, err: "labels: 'data-center' is not a valid label name"},
+		{cfg: Config{Labels: map[string]string{"serverid": "lon"}}, err: "labels: 'serverid' is output on all metrics"},
+		{cfg: Config{Labels: map[string]string{"env": "my prod"}}, err: "labels: value 'my prod' of env"},
+		{cfg: Config{AlertRules: []AlertRule{{Metric: AlertMetricCmdsRunning, Above: 100}}}},
+		{cfg: Config{AlertRules: []AlertRule{{Metric: "cmds"}}}, err: "alert_rules: rule 1: unknown metric 'cmds'"},
+	}
+	for i, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.err == "" {
+			assert.NoError(t, err, "test %d", i)
+		} else if assert.Error(t, err, "test %d", i) {
+			assert.Contains(t, err.Error(), tt.err, "test %d", i)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	cfg := &Config{ServerID: "myserverid", AlertRules: []AlertRule{
+		{Name: "busy", Metric: AlertMetricCmdsRunning, Above: 10},
+		{Metric: AlertMetricErrorsPerMinute, Above: 1}}}
+	p4m := NewP4DMetricsLogParser(cfg, &P4DMetricsVersion{}, logger, true)
+	t0 := time.Date(2018, 6, 10, 23, 30, 0, 0, time.UTC)
+	evaluate := func(t time.Time, running, errors int64) []Alert {
+		p4m.timeLatestStartCmd = t
+		p4m.cmdsRunning = running
+		p4m.cmdErrorCounter["user-sync"] = errors
+		p4m.evaluateAlerts()
+		var alerts []Alert
+		for len(p4m.alerts) > 0 {
+			alerts = append(alerts, <-p4m.alerts)
+		}
+		return alerts
+	}
+
+	// No rates on first evaluation
+	assert.Equal(t, []Alert{{Rule: "busy", Metric: AlertMetricCmdsRunning, Value: 20, Threshold: 10, Time: t0,
+		ServerID: "myserverid"}}, evaluate(t0, 20, 5))
+	assert.Empty(t, evaluate(t0.Add(time.Minute), 15, 6))
+	t2 := t0.Add(2 * time.Minute)
+	assert.Equal(t, []Alert{
+		{Rule: "busy", Metric: AlertMetricCmdsRunning, Value: 5, Threshold: 10, Time: t2, Resolved: true, ServerID: "myserverid"},
+		{Rule: AlertMetricErrorsPerMinute, Metric: AlertMetricErrorsPerMinute, Value: 4, Threshold: 1, Time: t2, ServerID: "myserverid"},
+	}, evaluate(t2, 5, 10))
+	assert.Equal(t, "2018/06/10 23:32:00 busy resolved: cmds_running 5.00 (threshold 10.00)",
+		Alert{Rule: "busy", Metric: AlertMetricCmdsRunning, Value: 5, Threshold: 10, Time: t2, Resolved: true}.String())
+
+	p4m.closeAlerts()
+	_, ok := <-p4m.Alerts()
+	assert.False(t, ok)
+	assert.Nil(t, NewP4DMetricsLogParser(&Config{}, &P4DMetricsVersion{}, logger, true).Alerts())
+}
+
+func TestMetricPrefixLabels(t *testing.T) {
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	filter := func(output []string) []string {
+		result := make([]string, 0)
+		for _, line := range output {
+			if strings.HasPrefix(line, "perforce_cmd_counter") || strings.HasPrefix(line, "perforce_prom_build_info") {
+				result = append(result, line)
+			}
+		}
+		return result
+	}
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		MetricPrefix:   "perforce_",
+		Labels:         map[string]string{"env": "prod", "datacenter": "lon"}}
+	output := basicTest(cfg, input, false)
+	compareOutput(t, []string{
+		`perforce_cmd_counter{serverid="myserverid",datacenter="lon",env="prod",cmd="user-sync"} 1`,
+		`perforce_prom_build_info{serverid="myserverid",datacenter="lon",env="prod",goversion="` + runtime.Version() + `",revision="testrevision",version="test"} 1`},
+		filter(output))
+	for _, line := range output {
+		assert.False(t, strings.HasPrefix(line, "p4_"), line)
+	}
+
+	output = basicTest(cfg, input, true)
+	compareOutput(t, []string{
+		`perforce_cmd_counter;serverid=myserverid;datacenter=lon;env=prod;cmd=user-sync 1 1441207389`,
+		`perforce_prom_build_info;serverid=myserverid;datacenter=lon;env=prod;goversion=` + runtime.Version() + `;revision=testrevision;version=test 1 1441207389`},
+		filter(output))
+}
+
 func TestP4PromTransmitCmds(t *testing.T) {
 	cfg := &Config{
 		ServerID:         "myserverid",
@@ -837,9 +1100,11 @@ func TestServerEvents(t *testing.T) {
 	expected := eol.Split(`p4_prom_log_lines_read{serverid="myserverid"} 5
 p4_cmds_paused{serverid="myserverid"} 10
 p4_cmds_paused_max{serverid="myserverid"} 10
+p4_cmds_paused_max_daily{serverid="myserverid"} 10
 p4_cmd_running{serverid="myserverid"} 55
 p4_cmds_running{serverid="myserverid"} 55
 p4_cmds_running_max{serverid="myserverid"} 55
+p4_cmds_running_max_daily{serverid="myserverid"} 55
 p4_pause_rate_cpu{serverid="myserverid"} 59
 p4_pause_rate_mem{serverid="myserverid"} 20
 p4_pause_state_cpu{serverid="myserverid"} 2
@@ -903,6 +1168,117 @@ p4_prom_svr_events_processed{serverid="myserverid"} 1`, -1)
 	compareOutput(t, expected, output)
 }
 
+func TestServerEventsMonitorRemoved(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2020/01/11 02:01:01 pid 25601 swarm@~tmp.1578736802.31818.5e199ca2c9d493.85829556 10.5.70.45 [SWARM/2019.3-MAIN-TEST_ONLY/1897025] 'IDLE' exited unexpectedly, removed from monitor table.
+
+Perforce server info:
+	2024/06/10 08:09:02 pid 2064774 unknown@unknown 127.0.0.1 [unknown] 'Init()' exited unexpectedly, removed from monitor table.
+`
+	output := basicTest(cfg, input, false)
+	expected := eol.Split(`p4_prom_log_lines_read{serverid="myserverid"} 7
+p4_prom_svr_events_processed{serverid="myserverid"} 2
+p4_threads_removed_from_monitor{serverid="myserverid"} 2`, -1)
+	compareOutput(t, expected, output)
+}
+
+func TestServerEventsRestarts(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2024/01/02 10:00:00 pid 1234 Perforce Server starting 2023.2/LINUX26X86_64/2578891
+2024/01/02 10:05:00 123456789 pid 1234: Server shutting down
+Perforce server info:
+	2024/01/02 10:06:00 pid 1300 Perforce Server starting 2023.2/LINUX26X86_64/2578891
+`
+	output := basicTest(cfg, input, false)
+	restarts := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_server_restarts_total") {
+			restarts = append(restarts, line)
+		}
+	}
+	compareOutput(t, []string{`p4_server_restarts_total{serverid="myserverid"} 2`}, restarts)
+}
+
+func TestCmdLimitExceeded(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2024/06/19 12:25:31 pid 1056864 Fred@ws1 127.0.0.1 [p4/2024.1/LINUX26X86_64/2611120] 'user-files //...'
+
+Perforce server error:
+	Date 2024/06/19 12:25:32:
+	Pid 1056864
+	Operation: user-files
+	Too many rows scanned (over 10000000); see 'p4 help maxscanrows'.
+
+Perforce server info:
+	2024/06/19 12:25:32 pid 1056864 completed 1.02s
+Perforce server info:
+	2024/06/19 12:25:33 pid 1056865 fred@ws1 127.0.0.1 [p4/2024.1/LINUX26X86_64/2611120] 'user-changes -m10'
+Perforce server info:
+	2024/06/19 12:25:33 pid 1056865 completed .01s
+`
+	output := basicTest(cfg, input, false)
+	limits := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_limit_exceeded_counter{") {
+			limits = append(limits, line)
+		}
+	}
+	compareOutput(t, []string{`p4_cmd_limit_exceeded_counter{serverid="myserverid",limit="MaxScanRows",user="fred"} 1`}, limits)
+}
+
+func TestCmdKilled(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2024/06/19 12:25:31 pid 1056864 fred@ws1 127.0.0.1 [p4/2024.1/LINUX26X86_64/2611120] 'user-sync //...'
+
+Perforce server error:
+	Date 2024/06/19 12:25:40:
+	Pid 1056864
+	Operation: user-sync
+	Command terminated by 'p4 monitor terminate'.
+
+Perforce server info:
+	2024/06/19 12:25:41 pid 1056865 fred@ws1 127.0.0.1 [p4/2024.1/LINUX26X86_64/2611120] 'user-files //...'
+
+Perforce server error:
+	Date 2024/06/19 12:25:42:
+	Pid 1056865
+	Operation: user-files
+	Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'.
+
+Perforce server info:
+	2024/06/19 12:25:42 pid 1056865 completed 1.02s
+Perforce server info:
+	2024/06/19 12:25:43 pid 1056866 fred@ws1 127.0.0.1 [p4/2024.1/LINUX26X86_64/2611120] 'user-changes -m10'
+Perforce server info:
+	2024/06/19 12:25:43 pid 1056866 completed .01s
+`
+	output := basicTest(cfg, input, false)
+	killed := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_killed_total{") {
+			killed = append(killed, line)
+		}
+	}
+	compareOutput(t, []string{`p4_cmd_killed_total{serverid="myserverid",reason="MaxLockTime"} 1`,
+		`p4_cmd_killed_total{serverid="myserverid",reason="terminated"} 1`}, killed)
+}
+
 func TestServerEventsPausedCumulative(t *testing.T) {
 	cfg := &Config{
 		ServerID:         "myserverid",
@@ -940,6 +1316,7 @@ p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.598
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 8.390
 p4_cmd_mem_mb{serverid="myserverid"} 74
 p4_cmd_mem_peak_mb{serverid="myserverid"} 74
+p4_cmd_paused_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.802
 p4_cmd_program_counter{serverid="myserverid",program="p4/2024.1.TEST-TEST_ONLY/LINUX26X86_64/2611120"} 1
 p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2024.1.TEST-TEST_ONLY/LINUX26X86_64/2611120"} 8.390
 p4_cmd_running{serverid="myserverid"} 1
@@ -956,3 +1333,830 @@ p4_prom_log_lines_read{serverid="myserverid"} 23
 p4_prom_svr_events_processed{serverid="myserverid"} 1`, -1)
 	compareOutput(t, expected, output)
 }
+
+func TestCmdPausedTerminated(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2024/06/19 12:25:31 pid 1056864 perforce@ws1 127.0.0.1 [p4/2024.1/LINUX26X86_64/2611120] 'user-fstat -Ob //...'
+
+Perforce server error:
+	Date 2024/06/19 12:25:35:
+	Pid 1056864
+	Operation: user-fstat
+	Operation 'user-fstat' failed.
+	Too many commands paused;  terminated.
+
+Perforce server info:
+	2024/06/19 12:25:35 pid 1056864 completed 4.01s
+`
+	output := basicTest(cfg, input, false)
+	paused := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_paused_") || strings.HasPrefix(line, "p4_cmd_killed_total") {
+			paused = append(paused, line)
+		}
+	}
+	compareOutput(t, []string{`p4_cmd_killed_total{serverid="myserverid",reason="paused"} 1`,
+		`p4_cmd_paused_terminated_counter{serverid="myserverid",cmd="user-fstat"} 1`}, paused)
+}
+
+func TestP4PromLockWaitHistogram(t *testing.T) {
+	cfg := &Config{
+		ServerID:                "myserverid",
+		UpdateInterval:          10 * time.Millisecond,
+		OutputLockWaitHistogram: true,
+		LockWaitBuckets:         []float64{0.01, 0.1, 1}}
+	input := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit'
+--- lapse .413s
+--- db.rev
+---   pages in+out+cached 600+3+20
+---   locks read/write 1/1 rows get+pos+scan put+del 0+1+50000 0+0
+---   total lock wait+held read/write 5ms+10ms/250ms+20ms
+--- db.counters
+---   pages in+out+cached 6+3+2
+---   locks read/write 0/2 rows get+pos+scan put+del 2+0+0 1+0
+---   total lock wait+held read/write 0ms+0ms/2000ms+5ms
+--- db.user
+---   pages in+out+cached 6+3+2
+---   locks read/write 0/0 rows get+pos+scan put+del 2+0+0 0+0
+`
+	output := basicTest(cfg, input, false)
+	lockWaits := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_table_") {
+			lockWaits = append(lockWaits, line)
+		}
+	}
+	expected := eol.Split(`p4_table_read_wait_seconds_bucket{serverid="myserverid",table="rev",le="0.01"} 1
+p4_table_read_wait_seconds_bucket{serverid="myserverid",table="rev",le="0.1"} 1
+p4_table_read_wait_seconds_bucket{serverid="myserverid",table="rev",le="1"} 1
+p4_table_read_wait_seconds_bucket{serverid="myserverid",table="rev",le="+Inf"} 1
+p4_table_read_wait_seconds_sum{serverid="myserverid",table="rev"} 0.005
+p4_table_read_wait_seconds_count{serverid="myserverid",table="rev"} 1
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="counters",le="0.01"} 0
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="counters",le="0.1"} 0
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="counters",le="1"} 0
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="counters",le="+Inf"} 1
+p4_table_write_wait_seconds_sum{serverid="myserverid",table="counters"} 2.000
+p4_table_write_wait_seconds_count{serverid="myserverid",table="counters"} 1
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="rev",le="0.01"} 0
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="rev",le="0.1"} 0
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="rev",le="1"} 1
+p4_table_write_wait_seconds_bucket{serverid="myserverid",table="rev",le="+Inf"} 1
+p4_table_write_wait_seconds_sum{serverid="myserverid",table="rev"} 0.250
+p4_table_write_wait_seconds_count{serverid="myserverid",table="rev"} 1`, -1)
+	compareOutput(t, expected, lockWaits)
+}
+
+func TestP4PromReplication(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2018/06/01 04:29:43 pid 55997 svc0@unknown background [p4d/2018.1/DARWIN90X86_64/1660568] 'pull -i 1'
+--- db.counters
+---   pages in+out+cached 2+0+2
+---   locks read/write 0/1 rows get+pos+scan put+del 1+0+0 0+0
+
+Perforce server info:
+	2018/06/01 04:29:45 pid 55997 svc0@unknown background [p4d/2018.1/DARWIN90X86_64/1660568] 'pull -i 1'
+--- db.counters
+---   pages in+out+cached 2+0+2
+---   locks read/write 0/1 rows get+pos+scan put+del 1+0+0 0+0
+
+Perforce server info:
+	2018/06/01 04:29:44 pid 55998 svc0@unknown background [p4d/2018.1/DARWIN90X86_64/1660568] 'pull -u -i 1 -b 1'
+--- rdb.lbr
+---   pages in+out+cached 7+4+2
+---   locks read/write 0/3 rows get+pos+scan put+del 1+1+40 1+1
+--- lbr Binary
+---   opens+closes+checkins+exists 1+1+0+0
+---   reads+readbytes+writes+writebytes 0+0+1+1.5M
+
+Perforce server info:
+	2018/06/01 04:29:50 pid 55998 svc0@unknown background [p4d/2018.1/DARWIN90X86_64/1660568] 'pull -u -i 1 -b 1'
+--- rdb.lbr
+---   pages in+out+cached 7+4+2
+---   locks read/write 0/3 rows get+pos+scan put+del 1+1+25 1+1
+--- lbr Binary
+---   opens+closes+checkins+exists 1+1+0+0
+---   reads+readbytes+writes+writebytes 0+0+1+1K
+
+Perforce server info:
+	2018/06/01 04:29:51 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2018/06/01 04:29:51 pid 1616 completed .031s
+`
+	output := basicTest(cfg, input, false)
+	pulls := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_pull_") {
+			pulls = append(pulls, line)
+		}
+	}
+	expected := eol.Split(`p4_pull_batch_interval_seconds{serverid="myserverid",type="archive"} 6.000
+p4_pull_batch_interval_seconds{serverid="myserverid",type="journal"} 2.000
+p4_pull_batches{serverid="myserverid",type="archive"} 2
+p4_pull_batches{serverid="myserverid",type="journal"} 2
+p4_pull_bytes_transferred{serverid="myserverid"} 1573888
+p4_pull_queue_depth{serverid="myserverid"} 25`, -1)
+	compareOutput(t, expected, pulls)
+}
+
+func TestP4PromRunningBands(t *testing.T) {
+	cfg := &Config{
+		ServerID:                "myserverid",
+		UpdateInterval:          10 * time.Millisecond,
+		OutputCmdsByRunningBand: true,
+		RunningBands:            []int64{1, 2}}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 completed 1.0s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed 1.5s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed 2.0s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1619 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1619 completed .5s
+`
+	output := basicTest(cfg, input, false)
+	bands := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_running_band_") {
+			bands = append(bands, line)
+		}
+	}
+	expected := eol.Split(`p4_cmd_running_band_counter{serverid="myserverid",band="1"} 2
+p4_cmd_running_band_counter{serverid="myserverid",band="2"} 1
+p4_cmd_running_band_counter{serverid="myserverid",band="3+"} 1
+p4_cmd_running_band_cumulative_seconds{serverid="myserverid",band="1"} 1.500
+p4_cmd_running_band_cumulative_seconds{serverid="myserverid",band="2"} 1.500
+p4_cmd_running_band_cumulative_seconds{serverid="myserverid",band="3+"} 2.000`, -1)
+	compareOutput(t, expected, bands)
+	assert.Equal(t, "11-50", runningBand(runningBands, 11))
+	assert.Equal(t, "201+", runningBand(runningBands, 1000))
+}
+
+func TestP4PromWorkspaces(t *testing.T) {
+	cfg := &Config{
+		ServerID:                   "myserverid",
+		UpdateInterval:             10 * time.Millisecond,
+		OutputCmdsByWorkspaceRegex: `^(jenkins-[a-z]+)-\d+$|^bld_`}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 builder@Jenkins-Linux-001 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 builder@jenkins-linux-002 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 builder@bld_win 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 completed 1.0s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed 1.5s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed 2.0s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1619 completed .5s
+`
+	output := basicTest(cfg, input, false)
+	workspaces := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_workspace_") {
+			workspaces = append(workspaces, line)
+		}
+	}
+	// Agents are grouped by the subexpression, and other workspaces matching have their own series
+	expected := eol.Split(`p4_cmd_workspace_counter{serverid="myserverid",workspace="bld_win"} 1
+p4_cmd_workspace_counter{serverid="myserverid",workspace="jenkins-linux"} 2
+p4_cmd_workspace_cumulative_seconds{serverid="myserverid",workspace="bld_win"} 2.000
+p4_cmd_workspace_cumulative_seconds{serverid="myserverid",workspace="jenkins-linux"} 2.500`, -1)
+	compareOutput(t, expected, workspaces)
+
+	cfg.OutputCmdsByWorkspaceRegex = ""
+	output = basicTest(cfg, input, false)
+	for _, line := range output {
+		assert.False(t, strings.HasPrefix(line, "p4_cmd_workspace_"), line)
+	}
+}
+
+func TestP4PromTableIO(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		OutputTableIO:  true}
+	input := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+--- lapse .413s
+--- db.rev
+---   pages in+out+cached 600+3+20
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+50000 0+0
+--- db.counters
+---   pages in+out+cached 6+3+2
+---   locks read/write 0/2 rows get+pos+scan put+del 2+0+0 1+0
+`
+	output := basicTest(cfg, input, false)
+	tableIO := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_total_pages_") {
+			tableIO = append(tableIO, line)
+		}
+	}
+	expected := eol.Split(`p4_total_pages_cached{serverid="myserverid",table="counters"} 2
+p4_total_pages_cached{serverid="myserverid",table="rev"} 20
+p4_total_pages_in{serverid="myserverid",table="counters"} 6
+p4_total_pages_in{serverid="myserverid",table="rev"} 600
+p4_total_pages_out{serverid="myserverid",table="counters"} 3
+p4_total_pages_out{serverid="myserverid",table="rev"} 3`, -1)
+	assert.Equal(t, expected, tableIO)
+}
+
+func TestP4PromTableScanRows(t *testing.T) {
+	cfg := &Config{
+		ServerID:               "myserverid",
+		UpdateInterval:         10 * time.Millisecond,
+		OutputTableScanRows:    true,
+		ScanRowsAlertThreshold: 10000}
+	input := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+--- lapse .413s
+--- db.rev
+---   pages in+out+cached 600+3+20
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+50000 0+0
+--- db.counters
+---   pages in+out+cached 6+3+2
+---   locks read/write 0/2 rows get+pos+scan put+del 2+0+0 1+0
+Perforce server info:
+	2017/12/07 15:00:22 pid 148470 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/a/...'
+Perforce server info:
+	2017/12/07 15:00:22 pid 148470 completed .013s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:22 pid 148470 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/a/...'
+--- lapse .013s
+--- db.rev
+---   pages in+out+cached 6+3+20
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+500 0+0
+`
+	output := basicTest(cfg, input, false)
+	scans := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_table_scan_rows_") {
+			scans = append(scans, line)
+		}
+	}
+	expected := eol.Split(`p4_table_scan_rows_alerts{serverid="myserverid",table="rev"} 1
+p4_table_scan_rows_total{serverid="myserverid",table="rev"} 50500`, -1)
+	compareOutput(t, expected, scans)
+}
+
+func TestP4PromCmdsByOrigin(t *testing.T) {
+	cfg := &Config{
+		ServerID:           "myserverid",
+		UpdateInterval:     10 * time.Millisecond,
+		OutputCmdsByOrigin: true}
+	input := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:21 pid 148470 fred@LONWS 10.40.16.14/10.40.48.29 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148470 completed .2s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:21 pid 148471 fred@LONWS 127.0.0.1/10.40.48.29 [p4/2016.2/LINUX26X86_64/1598668 (brokered)] 'user-sync //...'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148471 completed .1s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2017/12/07 15:00:21 pid 148472 svc_edge@unknown background [p4d/2016.2/LINUX26X86_64/1598668] 'pull -i 1'
+Perforce server info:
+	2017/12/07 15:00:21 pid 148472 completed .05s 7+4us 0+584io 0+0net 4580k 0pf
+`
+	output := basicTest(cfg, input, false)
+	cmds := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_counter") || strings.HasPrefix(line, "p4_cmd_cumulative_seconds") {
+			cmds = append(cmds, line)
+		}
+	}
+	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="pull",origin="background"} 1
+p4_cmd_counter{serverid="myserverid",cmd="user-sync",origin="brokered"} 1
+p4_cmd_counter{serverid="myserverid",cmd="user-sync",origin="direct"} 1
+p4_cmd_counter{serverid="myserverid",cmd="user-sync",origin="edge-forwarded"} 1
+p4_cmd_cumulative_seconds{serverid="myserverid",cmd="pull",origin="background"} 0.050
+p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync",origin="brokered"} 0.100
+p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync",origin="direct"} 0.413
+p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync",origin="edge-forwarded"} 0.200`, -1)
+	compareOutput(t, expected, cmds)
+}
+
+func TestTopTablesByIO(t *testing.T) {
+	p4m := NewP4DMetricsLogParser(&Config{}, &P4DMetricsVersion{}, logger, true)
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-files", Tables: map[string]*p4dlog.Table{
+		"rev":      {TableName: "rev", PagesIn: 600, PagesOut: 3, PagesCached: 20},
+		"counters": {TableName: "counters", PagesIn: 6, PagesOut: 3, PagesCached: 2},
+		"have":     {TableName: "have", PagesIn: 100, PagesOut: 50},
+	}})
+	top := p4m.TopTablesByIO(2)
+	assert.Equal(t, []TableIO{
+		{TableName: "rev", PagesIn: 600, PagesOut: 3, PagesCached: 20},
+		{TableName: "have", PagesIn: 100, PagesOut: 50},
+	}, top)
+}
+
+func TestNormalizeArgs(t *testing.T) {
+	for args, expected := range map[string]string{
+		"//depot/main/src/lib/foo/bar.c#3":  "//depot/main/src/lib/...#N",
+		"//depot/main/...@12345":            "//depot/main/...@N",
+		"//depot/main/...#head":             "//depot/main/...#head",
+		"//.../*.c":                         "//.../*.c",
+		"//depot/*/src/foo.c@2024/01/02":    "//depot/*/src/foo.c@N/N/N",
+		"-m10 -s submitted //depot/rel/...": "-mN -s submitted //depot/rel/...",
+		"-q a.c b.c c.c d.c e.c":            "-q a.c b.c c.c (+2)",
+		"":                                  "",
+	} {
+		assert.Equal(t, expected, normalizeArgs(args), args)
+	}
+}
+
+func TestTopArgs(t *testing.T) {
+	p4m := NewP4DMetricsLogParser(&Config{TopArgsCmds: []string{"user-sync", "user-files"}}, &P4DMetricsVersion{}, logger, true)
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", Args: "//depot/main/...@100", CompletedLapse: 2})
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", Args: "//depot/main/...@200", CompletedLapse: 3})
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", Args: "//depot/rel/...", CompletedLapse: 10})
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", Args: "//depot/dev/...", CompletedLapse: 0.5})
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-files", Args: "//.../*.c", CompletedLapse: 30})
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-fstat", Args: "//depot/main/...", CompletedLapse: 1})
+
+	// Most frequent first
+	assert.Equal(t, []CmdArgs{
+		{Cmd: "user-files", Args: "//.../*.c", Count: 1, Lapse: 30},
+		{Cmd: "user-sync", Args: "//depot/main/...@N", Count: 2, Lapse: 5},
+		{Cmd: "user-sync", Args: "//depot/rel/...", Count: 1, Lapse: 10},
+	}, p4m.TopArgs(2))
+
+	// Beyond maxArgPatterns the least frequent are counted as argsOther, however late frequent ones are seen
+	p4m = NewP4DMetricsLogParser(&Config{TopArgsCmds: []string{"user-sync"}}, &P4DMetricsVersion{}, logger, true)
+	path := func(i int) string { // Without digits, which are normalised
+		return fmt.Sprintf("//depot/%c%c%c/...", 'a'+i/676%26, 'a'+i/26%26, 'a'+i%26)
+	}
+	for i := 0; i < maxArgPatterns+10; i++ {
+		p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", Args: path(i), CompletedLapse: 1})
+		if i >= maxArgPatterns {
+			for j := 0; j < 3; j++ {
+				p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", Args: "//depot/hot/...", CompletedLapse: 1})
+			}
+		}
+	}
+	assert.Equal(t, []CmdArgs{
+		{Cmd: "user-sync", Args: "//depot/hot/...", Count: 30, Lapse: 30},
+		{Cmd: "user-sync", Args: argsOther, Count: 11, Lapse: 11},
+	}, p4m.TopArgs(2))
+}
+
+func TestP4PromCmdHistogram(t *testing.T) {
+	cfg := &Config{
+		ServerID:           "myserverid",
+		OutputCmdHistogram: true,
+		OutputExemplars:    true}
+	p4m := NewP4DMetricsLogParser(cfg, &P4DMetricsVersion{}, logger, false)
+	fixedLabels := []labelStruct{{name: "serverid", value: cfg.ServerID}}
+	endTime, _ := time.Parse(p4timeformat, "2015/09/02 15:23:16")
+	p4m.publishCmdEvent(p4dlog.Command{ProcessKey: "key1", Cmd: "user-sync", Pid: 1616, CompletedLapse: 0.031, EndTime: endTime})
+	p4m.publishCmdEvent(p4dlog.Command{ProcessKey: "key2", Cmd: "user-sync", Pid: 1617, CompletedLapse: 7.2, EndTime: endTime})
+	p4m.publishCmdEvent(p4dlog.Command{ProcessKey: "key3", Cmd: "user-sync", Pid: 1618, CompletedLapse: 6.1, EndTime: endTime})
+
+	metrics := new(bytes.Buffer)
+	p4m.outputHistogram(metrics, "p4_cmd_duration_seconds", "", p4m.cmdDuration, fixedLabels)
+	expected := `p4_cmd_duration_seconds_bucket{serverid="myserverid",le="0.01"} 0
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="0.1"} 1 # {processKey="key1",pid="1616"} 0.031 1441207396
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="0.5"} 1
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="1"} 1
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="5"} 1
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="10"} 3 # {processKey="key2",pid="1617"} 7.200 1441207396
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="30"} 3
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="60"} 3
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="300"} 3
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="600"} 3
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="1800"} 3
+p4_cmd_duration_seconds_bucket{serverid="myserverid",le="+Inf"} 3
+p4_cmd_duration_seconds_sum{serverid="myserverid"} 13.331
+p4_cmd_duration_seconds_count{serverid="myserverid"} 3
+`
+	assert.Equal(t, expected, removeHelpLines(metrics.String()))
+
+	// Exemplars are only for the slowest commands since last output
+	metrics = new(bytes.Buffer)
+	p4m.outputHistogram(metrics, "p4_cmd_duration_seconds", "", p4m.cmdDuration, fixedLabels)
+	assert.NotContains(t, metrics.String(), "processKey")
+}
+
+func TestAppFamily(t *testing.T) {
+	for app, family := range map[string]string{
+		"p4/2019.2/LINUX26X86_64/1891638":            "p4",
+		"p4/2018.1/LINUX26X86_64/1957529 (brokered)": "p4",
+		"Helix P4V/NTX64/2019.2/1904275/v86":         "P4V",
+		"P4V/NTX64/2014.1/888424/v76":                "P4V",
+		"Microsoft Visual Studio 2013/12.0.21005.1":  "P4VS",
+		"p4d/2019.2/LINUX26X86_64/1891638":           "p4d",
+		"unnamed p4-python script/v81":               "p4python",
+		"jenkins.p4-plugin/1.10.3-SNAPSHOT/Linux":    "p4java",
+		"UnrealGameSync/v84":                         "UnrealGameSync",
+		"SWARM/2019.3-MAIN-TEST_ONLY/1897025":        "Swarm",
+		"3DSMax/1.0.0.0":                             "other",
+		"":                                           "other",
+	} {
+		assert.Equal(t, family, AppFamily(app), app)
+	}
+}
+
+func TestP4PromCmdHistogramByApp(t *testing.T) {
+	cfg := &Config{ServerID: "myserverid", OutputCmdHistogramByApp: true}
+	p4m := NewP4DMetricsLogParser(cfg, &P4DMetricsVersion{}, logger, false)
+	fixedLabels := []labelStruct{{name: "serverid", value: cfg.ServerID}}
+	for i := 0; i < 10; i++ {
+		p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-sync", App: "p4/2019.2/LINUX26X86_64/1891638", CompletedLapse: 0.2})
+	}
+	p4m.publishCmdEvent(p4dlog.Command{Cmd: "user-fstat", App: "Helix P4V/NTX64/2019.2/1904275/v86", CompletedLapse: 7})
+
+	apps := p4m.DurationsByApp()
+	assert.Equal(t, 2, len(apps))
+	assert.Equal(t, "P4V", apps[0].AppFamily)
+	assert.Equal(t, int64(1), apps[0].Count)
+	assert.InDelta(t, 7.5, apps[0].P50, 0.001) // Interpolated within 5-10 bucket
+	assert.Equal(t, "p4", apps[1].AppFamily)
+	assert.Equal(t, int64(10), apps[1].Count)
+	assert.InDelta(t, 2.0, apps[1].Total, 0.001)
+	assert.InDelta(t, 0.3, apps[1].P50, 0.001)
+	assert.InDelta(t, 0.496, apps[1].P99, 0.001)
+
+	metrics := new(bytes.Buffer)
+	p4m.outputAppDurations(metrics, fixedLabels)
+	out := metrics.String()
+	assert.Equal(t, 1, strings.Count(out, "# TYPE p4_cmd_app_duration_seconds histogram"))
+	assert.Contains(t, out, `p4_cmd_app_duration_seconds_bucket{serverid="myserverid",app_family="P4V",le="10"} 1`)
+	assert.Contains(t, out, `p4_cmd_app_duration_seconds_bucket{serverid="myserverid",app_family="p4",le="0.5"} 10`)
+	assert.Contains(t, out, `p4_cmd_app_duration_seconds_count{serverid="myserverid",app_family="p4"} 10`)
+}
+
+func removeHelpLines(metrics string) string {
+	result := ""
+	for _, line := range eol.Split(metrics, -1) {
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			result += line + "\n"
+		}
+	}
+	return result
+}
+
+func TestP4PromSubmitLatency(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -i'
+
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 completed .178s 96+17us 0+208io 0+0net 15668k 0pf
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-SubmitChange'
+
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 compute end .252s 35+6us 0+8io 0+0net 49596k 0pf
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 completed 1.38s 490+165us 0+178824io 0+0net 127728k 0pf
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-CommitSubmit'
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-CommitSubmit'
+--- meta/commit(W)
+---   total lock wait+held read/write 0ms+0ms/0ms+795ms
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-CommitSubmit'
+--- clients/MCM_client_184%2E51%2E33%2E29_prod_prefix1(W)
+---   total lock wait+held read/write 0ms+0ms/0ms+1367ms
+
+Perforce server info:
+	2018/06/10 23:30:09 pid 25568 completed 1.38s 34+61us 59680+59904io 0+0net 127728k 1pf
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-CommitSubmit'
+--- db.integed
+---   total lock wait+held read/write 0ms+0ms/0ms+795ms
+--- db.archmap
+---   total lock wait+held read/write 0ms+0ms/0ms+780ms
+
+`
+	output := basicTest(cfg, input, true)
+	latency := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_submit_latency_seconds") && !strings.Contains(line, "_bucket") {
+			latency = append(latency, line)
+		}
+	}
+	assert.Equal(t, []string{"p4_submit_latency_seconds_count;serverid=myserverid 1 1528673409",
+		"p4_submit_latency_seconds_sum;serverid=myserverid 3.000 1528673409"}, latency)
+	assert.Contains(t, output, "p4_submit_latency_seconds_bucket;serverid=myserverid;le=5 1 1528673409")
+	assert.Contains(t, output, "p4_submit_latency_seconds_bucket;serverid=myserverid;le=1 0 1528673409")
+}
+
+func TestP4PromSerializedLocks(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 fred@fred_ws 10.1.4.213/10.1.3.243 [Helix P4V/NTX64/2019.2/1904275/v86] 'user-change -i'
+--- storageup/storageup(R)
+---   total lock wait+held read/write 1000ms+2000ms/0ms+0ms
+
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 fred@fred_ws 10.1.4.213/10.1.3.243 [Helix P4V/NTX64/2019.2/1904275/v86] 'user-change -i'
+--- storageup/storagemasterup(W)
+---   total lock wait+held read/write 0ms+0ms/3000ms+4000ms
+
+Perforce server info:
+	2020/03/11 06:08:17 pid 15855 completed .276s 4+4us 256+224io 0+0net 9212k 0pf
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 fred@fred_ws 10.1.4.213/10.1.3.243 [Helix P4V/NTX64/2019.2/1904275/v86] 'user-change -i'
+--- lapse .276s
+--- db.counters
+---   pages in+out+cached 7+6+2
+`
+	output := basicTest(cfg, input, false)
+	locks := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_serialized_lock_") || strings.Contains(line, "storage") {
+			locks = append(locks, line)
+		}
+	}
+	expected := eol.Split(`p4_serialized_lock_counter{serverid="myserverid",name="storagemasterup",mode="W"} 1
+p4_serialized_lock_counter{serverid="myserverid",name="storageup",mode="R"} 1
+p4_serialized_lock_read_held_seconds{serverid="myserverid",name="storagemasterup",mode="W"} 0.000
+p4_serialized_lock_read_held_seconds{serverid="myserverid",name="storageup",mode="R"} 2.000
+p4_serialized_lock_read_wait_seconds{serverid="myserverid",name="storagemasterup",mode="W"} 0.000
+p4_serialized_lock_read_wait_seconds{serverid="myserverid",name="storageup",mode="R"} 1.000
+p4_serialized_lock_write_held_seconds{serverid="myserverid",name="storagemasterup",mode="W"} 4.000
+p4_serialized_lock_write_held_seconds{serverid="myserverid",name="storageup",mode="R"} 0.000
+p4_serialized_lock_write_wait_seconds{serverid="myserverid",name="storagemasterup",mode="W"} 3.000
+p4_serialized_lock_write_wait_seconds{serverid="myserverid",name="storageup",mode="R"} 0.000
+p4_total_read_held_seconds{serverid="myserverid",table="storagemasterup_W"} 0.000
+p4_total_read_held_seconds{serverid="myserverid",table="storageup_R"} 2.000
+p4_total_read_wait_seconds{serverid="myserverid",table="storagemasterup_W"} 0.000
+p4_total_read_wait_seconds{serverid="myserverid",table="storageup_R"} 1.000
+p4_total_write_held_seconds{serverid="myserverid",table="storagemasterup_W"} 4.000
+p4_total_write_held_seconds{serverid="myserverid",table="storageup_R"} 0.000
+p4_total_write_wait_seconds{serverid="myserverid",table="storagemasterup_W"} 3.000
+p4_total_write_wait_seconds{serverid="myserverid",table="storageup_R"} 0.000`, -1)
+	// Serialized locks remain in the table lock totals, as when they were tables
+	assert.Equal(t, expected, locks)
+}
+
+func TestP4PromCmdStorm(t *testing.T) {
+	cfg := &Config{
+		ServerID:           "myserverid",
+		UpdateInterval:     10 * time.Millisecond,
+		StormCmdsPerMinute: 3}
+	input := ""
+	for i := 0; i < 5; i++ {
+		input += fmt.Sprintf(`
+Perforce server info:
+	2018/06/10 23:30:%02d pid %d fred@fred_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //depot/...'
+Perforce server info:
+	2018/06/10 23:30:%02d pid %d completed .1s 1+1us 0+0io 0+0net 1k 0pf
+`, i*2, 100+i, i*2, 100+i)
+	}
+	input += `
+Perforce server info:
+	2018/06/10 23:30:20 pid 200 bob@bob_ws 10.1.2.4 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //depot/...'
+Perforce server info:
+	2018/06/10 23:30:20 pid 200 completed .1s 1+1us 0+0io 0+0net 1k 0pf
+
+`
+	output := basicTest(cfg, input, true)
+	storms := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_storm_") {
+			storms = append(storms, line)
+		}
+	}
+	sort.Strings(storms)
+	assert.Equal(t, []string{
+		"p4_cmd_storm_ip_active;serverid=myserverid;ip=10.1.2.3 1 1528673420",
+		"p4_cmd_storm_ip_alerts;serverid=myserverid;ip=10.1.2.3 1 1528673420",
+		"p4_cmd_storm_user_active;serverid=myserverid;user=fred 1 1528673420",
+		"p4_cmd_storm_user_alerts;serverid=myserverid;user=fred 1 1528673420"}, storms)
+}
+
+func TestProxyEventsPassedOn(t *testing.T) {
+	cfg := &Config{ServerID: "myserverid", UpdateInterval: 10 * time.Second}
+	input := `
+Perforce proxy info:
+	2024/01/02 10:00:00 pid 1234 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/...'
+--- proxytotals files/size svr+cache 1+3/512B+1.5K
+`
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	linesChan := make(chan string, 100)
+	p4m := NewP4DMetricsLogParser(cfg, &P4DMetricsVersion{}, logger, true)
+	cmdChan, metricsChan := p4m.ProcessEvents(ctx, linesChan, true)
+	for _, l := range eol.Split(input, -1) {
+		linesChan <- l
+	}
+	close(linesChan)
+	var records []interface{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for c := range cmdChan {
+			records = append(records, c)
+		}
+	}()
+	getOutput(metricsChan, true)
+	<-done
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, int64(3), records[0].(p4dlog.ProxyEvent).FilesCache)
+	}
+}
+
+func TestProcessCmds(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Second,
+		OutputCmdsByUser: true}
+	input := `0,1718799931,0,2024/06/19 12:25:31,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1,//...
+3,1718799933,0,2024/06/19 12:25:33,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1,//...,3,6,17,Error
+2,1718799934,0,2024/06/19 12:25:34,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1,//...
+0,1718799951,0,2024/06/19 12:25:51,1056865,7a3d,,1,fred,ws2,user-info,127.0.0.1,p4,2024.1,
+2,1718799952,0,2024/06/19 12:25:52,1056865,7a3d,,1,fred,ws2,user-info,127.0.0.1,p4,2024.1,`
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	linesChan := make(chan string, 100)
+	sp := p4dlog.NewStructuredLogParser(logger)
+	p4m := NewP4DMetricsLogParser(cfg, &P4DMetricsVersion{}, logger, true)
+	cmdChan, metricsChan := p4m.ProcessCmds(ctx, sp.LogParser(ctx, linesChan), true)
+	for _, l := range eol.Split(input, -1) {
+		linesChan <- l
+	}
+	close(linesChan)
+	var cmds []p4dlog.Command
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for c := range cmdChan {
+			cmds = append(cmds, c.(p4dlog.Command))
+		}
+	}()
+	output := getOutput(metricsChan, true)
+	<-done
+	assert.Equal(t, 2, len(cmds))
+
+	// Output when a command starts UpdateInterval or more after the previous output (before it is counted), and at the end
+	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1718799951
+p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1718799951
+p4_cmd_counter;serverid=myserverid;cmd=user-info 1 1718799951
+p4_cmd_error_counter;serverid=myserverid;cmd=user-sync 1 1718799951
+p4_cmd_error_counter;serverid=myserverid;cmd=user-sync 1 1718799951`, -1)
+	var actual []string
+	for _, l := range output {
+		if strings.HasPrefix(l, "p4_cmd_counter;") || strings.HasPrefix(l, "p4_cmd_error_counter;") {
+			actual = append(actual, l)
+		}
+	}
+	assert.ElementsMatch(t, expected, actual)
+}
+
+// Servers with track=0 (but vtrack) log table lock summaries without lapse/usage/rpc lines
+func TestP4PromTrackLocksOnly(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		OutputCmdsByUser: true}
+	input := `
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //...'
+Perforce server info:
+	2024/01/02 10:00:01 pid 100 completed 1.045s
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //...'
+--- db.have
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+---   total lock wait+held read/write 12ms+13ms/14ms+15ms
+---   max lock wait+held read/write 32ms+33ms/34ms+35ms
+`
+	historical := false
+	output := basicTest(cfg, input, historical)
+	for _, s := range []string{
+		`p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1`,
+		`p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 1.045`,
+		`p4_total_read_held_seconds{serverid="myserverid",table="have"} 0.013`,
+		`p4_total_write_wait_seconds{serverid="myserverid",table="have"} 0.014`,
+	} {
+		assert.Contains(t, output, s)
+	}
+	for _, l := range output {
+		assert.False(t, strings.HasPrefix(l, "p4_cmd_error_counter"), l)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		SDPInstance:    "1",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := NewExporter(cfg, logger)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- e.Serve(ctx, l) }()
+	url := "http://" + l.Addr().String()
+
+	resp, err := http.Get(url + MetricsPath)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	fp := p4dlog.NewP4dFileParser(logger)
+	fp.SetDurations(10*time.Millisecond, 20*time.Millisecond)
+	p4m := NewP4DMetricsLogParser(cfg, &P4DMetricsVersion{}, logger, false)
+	p4m.fp = fp
+	linesChan := make(chan string, 100)
+	_, metricsChan := p4m.ProcessEvents(ctx, linesChan, false)
+	for _, line := range eol.Split(input, -1) {
+		linesChan <- line
+	}
+	close(linesChan)
+	out := make(chan string, 100)
+	go e.Consume(metricsChan, out)
+	n := 0
+	for range out {
+		n++
+	}
+	assert.Greater(t, n, 0)
+
+	resp, err = http.Get(url + MetricsPath)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body) // Transparently gunzipped
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contentTypeText, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "# TYPE p4_cmd_counter counter\n")
+	assert.Contains(t, string(body), `p4_cmd_counter{serverid="myserverid",sdpinst="1",cmd="user-sync"} 1`+"\n")
+	assert.NotContains(t, string(body), "# EOF")
+
+	resp, err = http.Get(url + "/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// OpenMetrics when exemplars are output
+	cfg.OutputExemplars = true
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	assert.Equal(t, contentTypeOpenMetrics, rec.Header().Get("Content-Type"))
+	assert.True(t, strings.HasSuffix(rec.Body.String(), "# EOF\n"))
+
+	cancel()
+	assert.NoError(t, <-served)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+// Completed cmds by origin (direct, brokered, edge-forwarded or background - see p4dlog.Command.Origin). If
+// OutputCmdsByOrigin is set, p4_cmd_counter and p4_cmd_cumulative_seconds have an origin label as well as cmd, so that
+// dashboards for a commit server can separate commands from users connected directly from those forwarded by edge
+// servers or brokers, and from replication, without separate parsing runs per server.
+
+import (
+	"bytes"
+	"fmt"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+type cmdOrigin struct {
+	cmd    string
+	origin string
+}
+
+func (p4m *P4DMetrics) observeCmdOrigin(cmd *p4dlog.Command) {
+	k := cmdOrigin{cmd: cmd.Cmd, origin: cmd.Origin()}
+	p4m.cmdByOriginCounter[k]++
+	p4m.cmdByOriginCumulative[k] += float64(cmd.CompletedLapse)
+}
+
+func (p4m *P4DMetrics) outputCmdsByOrigin(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	mname := "p4_cmd_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by cmd and origin)", "counter")
+	for k, count := range p4m.cmdByOriginCounter {
+		labels := append(fixedLabels, labelStruct{"cmd", k.cmd}, labelStruct{"origin", k.origin})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+	mname = "p4_cmd_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds (by cmd and origin)", "counter")
+	for k, lapse := range p4m.cmdByOriginCumulative {
+		labels := append(fixedLabels, labelStruct{"cmd", k.cmd}, labelStruct{"origin", k.origin})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", lapse))
+	}
+}
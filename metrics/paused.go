@@ -0,0 +1,38 @@
+package metrics
+
+// Commands paused due to resource pressure, by cmd - which commands are being slowed by pausing (cumulative paused
+// seconds from the track output), and which are terminated as too many commands are paused (see
+// p4dlog.KillReasonPaused). Current and max paused thread counts, pause rates and states, and the total terminated
+// count are from server events (p4_cmds_paused, p4_cmds_paused_max, p4_pause_rate_*, p4_cmds_paused_errors).
+
+import (
+	"bytes"
+	"fmt"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+func (p4m *P4DMetrics) observePaused(cmd *p4dlog.Command) {
+	if cmd.Paused > 0 {
+		p4m.cmdsPausedCumulative += float64(cmd.Paused)
+		p4m.cmdPausedCumulative[cmd.Cmd] += float64(cmd.Paused)
+	}
+	if cmd.KillReason == p4dlog.KillReasonPaused {
+		p4m.cmdPausedTerminated[cmd.Cmd]++
+	}
+}
+
+func (p4m *P4DMetrics) outputPaused(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	mname := "p4_cmd_paused_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total time in seconds cmds were paused due to resource pressure (by cmd)", "counter")
+	for cmd, paused := range p4m.cmdPausedCumulative {
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", paused))
+	}
+	mname = "p4_cmd_paused_terminated_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of cmds terminated as too many cmds were paused due to resource pressure (by cmd)", "counter")
+	for cmd, count := range p4m.cmdPausedTerminated {
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+}
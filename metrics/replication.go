@@ -0,0 +1,83 @@
+package metrics
+
+// Replication metrics from the pull commands of replica/edge servers - journal and archive pull batches, the time
+// between them, the bytes of archive files transferred, and the queue (backlog) of pending archive transfers as
+// indicated by the rows of rdb.lbr scanned by the latest archive pull. Only output if pull commands have been seen.
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// pullStats - replication state derived from pull commands
+type pullStats struct {
+	batches    map[string]int64     // Count of pull commands by pull type
+	lastStart  map[string]time.Time // Start time of latest pull by pull type
+	interval   map[string]float64   // Seconds between the starts of the latest two pulls by pull type
+	queueDepth int64                // rdb.lbr rows scanned by latest archive pull
+	queueSeen  bool
+	bytes      int64 // Archive bytes written by archive pulls
+}
+
+func newPullStats() *pullStats {
+	return &pullStats{
+		batches:   make(map[string]int64),
+		lastStart: make(map[string]time.Time),
+		interval:  make(map[string]float64),
+	}
+}
+
+func (p4m *P4DMetrics) observePull(cmd *p4dlog.Command) {
+	pullType := cmd.PullType()
+	if pullType == "" {
+		return
+	}
+	ps := p4m.pulls
+	ps.batches[pullType]++
+	if last, ok := ps.lastStart[pullType]; ok && !cmd.StartTime.Before(last) {
+		ps.interval[pullType] = cmd.StartTime.Sub(last).Seconds()
+	}
+	if !cmd.StartTime.Before(ps.lastStart[pullType]) {
+		ps.lastStart[pullType] = cmd.StartTime
+	}
+	if pullType != p4dlog.PullTypeArchive {
+		return
+	}
+	ps.bytes += cmd.LbrWriteBytes()
+	if rows, ok := cmd.PullQueueRows(); ok {
+		ps.queueDepth = rows
+		ps.queueSeen = true
+	}
+}
+
+func (p4m *P4DMetrics) outputPulls(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	ps := p4m.pulls
+	if len(ps.batches) == 0 {
+		return
+	}
+	mname := "p4_pull_batches"
+	p4m.printMetricHeader(metrics, mname, "A count of replica pull commands (by type journal/archive)", "counter")
+	for pullType, count := range ps.batches {
+		labels := append(fixedLabels, labelStruct{"type", pullType})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+	if len(ps.interval) > 0 {
+		mname = "p4_pull_batch_interval_seconds"
+		p4m.printMetricHeader(metrics, mname, "Seconds between the starts of the latest two replica pull commands (by type)", "gauge")
+		for pullType, interval := range ps.interval {
+			labels := append(fixedLabels, labelStruct{"type", pullType})
+			p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", interval))
+		}
+	}
+	if _, ok := ps.batches[p4dlog.PullTypeArchive]; ok {
+		p4m.outputMetric(metrics, "p4_pull_bytes_transferred", "The bytes of archive files transferred by replica pull commands",
+			"counter", fmt.Sprintf("%d", ps.bytes), fixedLabels)
+	}
+	if ps.queueSeen {
+		p4m.outputMetric(metrics, "p4_pull_queue_depth", "Rows of rdb.lbr (pending archive transfers) scanned by the latest replica archive pull",
+			"gauge", fmt.Sprintf("%d", ps.queueDepth), fixedLabels)
+	}
+}
@@ -0,0 +1,69 @@
+package metrics
+
+// Completed commands by the concurrency they experienced - the count of commands running (cmd.Running) when they
+// started, grouped into bands, e.g. "1-10", "11-50", "51-200" and "201+". Shows how much work is done during peaks of
+// contention, as p4_cmd_running_band_counter and p4_cmd_running_band_cumulative_seconds if OutputCmdsByRunningBand
+// is set. Commands without a running count (e.g. those with no completion records) are not counted.
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Default upper bounds of running bands - the last band (above the highest bound) is implicit
+var runningBands = []int64{10, 50, 200}
+
+func validRunningBands(bands []int64) error {
+	for i, b := range bands {
+		if b <= 0 || (i > 0 && b <= bands[i-1]) {
+			return fmt.Errorf("bands must be positive and increasing: %v", bands)
+		}
+	}
+	return nil
+}
+
+// runningBand returns the label of the band containing running
+func runningBand(bands []int64, running int64) string {
+	lower := int64(1)
+	for _, upper := range bands {
+		if running <= upper {
+			if lower == upper {
+				return fmt.Sprintf("%d", upper)
+			}
+			return fmt.Sprintf("%d-%d", lower, upper)
+		}
+		lower = upper + 1
+	}
+	return fmt.Sprintf("%d+", lower)
+}
+
+func (p4m *P4DMetrics) observeRunningBand(running int64, lapse float64) {
+	if running <= 0 {
+		return
+	}
+	bands := p4m.config.RunningBands
+	if len(bands) == 0 {
+		bands = runningBands
+	}
+	band := runningBand(bands, running)
+	p4m.cmdByRunningBandCounter[band]++
+	p4m.cmdByRunningBandCumulative[band] += lapse
+}
+
+func (p4m *P4DMetrics) outputRunningBands(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	if len(p4m.cmdByRunningBandCounter) == 0 {
+		return
+	}
+	mname := "p4_cmd_running_band_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by band of count of cmds running when started)", "counter")
+	for band, count := range p4m.cmdByRunningBandCounter {
+		labels := append(fixedLabels, labelStruct{"band", band})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+	mname = "p4_cmd_running_band_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds (by band of count of cmds running when started)", "counter")
+	for band, lapse := range p4m.cmdByRunningBandCumulative {
+		labels := append(fixedLabels, labelStruct{"band", band})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", lapse))
+	}
+}
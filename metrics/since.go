@@ -0,0 +1,64 @@
+package metrics
+
+// Incremental processing of logs which overlap those of a previous run (e.g. rolling logs re-processed daily) - see
+// Config.Since. Commands completed at or before Since, and server events before it, are not included in metrics, and
+// historical metrics are not output for log times before it, so that the overlap is not counted twice. Commands and
+// events are still passed on (e.g. for database output) - only metrics are affected.
+// Since is normally the latest completion time of the previous run, so commands completed in that second were counted
+// by it. Log times are whole seconds, so a command completed in the same second but not logged until after the previous
+// run is not counted - a lesser evil than counting every boundary command twice.
+
+import (
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// cmdCompletedTime returns the end time of cmd, or its start time if it has none
+func cmdCompletedTime(cmd *p4dlog.Command) time.Time {
+	if cmd.EndTime.IsZero() {
+		return cmd.StartTime
+	}
+	return cmd.EndTime
+}
+
+func (p4m *P4DMetrics) beforeSince(t time.Time) bool {
+	return !p4m.config.Since.IsZero() && t.Before(p4m.config.Since)
+}
+
+// skipCmd returns true if cmd completed at or before Since, so is excluded from metrics
+func (p4m *P4DMetrics) skipCmd(cmd *p4dlog.Command) bool {
+	t := cmdCompletedTime(cmd)
+	if t.After(p4m.latestCmdTime) {
+		p4m.latestCmdTime = t
+	}
+	if !p4m.config.Since.IsZero() && !t.After(p4m.config.Since) {
+		p4m.skippedBeforeSince++
+		return true
+	}
+	return false
+}
+
+// skipSvrEvent returns true if evt is before Since, so is excluded from metrics
+func (p4m *P4DMetrics) skipSvrEvent(evt *p4dlog.ServerEvent) bool {
+	if p4m.beforeSince(evt.EventTime) {
+		p4m.skippedBeforeSince++
+		return true
+	}
+	return false
+}
+
+// historicalOutputRequired returns false while the log time reached is before Since
+func (p4m *P4DMetrics) historicalOutputRequired() bool {
+	return !p4m.historical || !p4m.beforeSince(p4m.timeLatestStartCmd)
+}
+
+// SkippedBeforeSince - count of commands and server events excluded from metrics as before (or at) Config.Since
+func (p4m *P4DMetrics) SkippedBeforeSince() int64 {
+	return p4m.skippedBeforeSince
+}
+
+// LatestCmdTime - latest completion time of commands processed, e.g. to be used as Config.Since by the next run
+func (p4m *P4DMetrics) LatestCmdTime() time.Time {
+	return p4m.latestCmdTime
+}
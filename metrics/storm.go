@@ -0,0 +1,142 @@
+package metrics
+
+// Command storm detection - a single user or IP running more commands per minute, or more cumulative
+// command lapse time, than configured thresholds within a sliding window (e.g. a runaway script).
+// A warning is logged and p4_cmd_storm_*_alerts incremented when a storm starts, and
+// p4_cmd_storm_*_active is 1 until it ends.
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+const defaultStormWindow = time.Minute
+
+type stormKey struct {
+	kind string // user or ip
+	id   string
+}
+
+type stormEntry struct {
+	startTime time.Time
+	lapse     float64
+}
+
+// stormTracker - commands for a single user or IP within the window
+type stormTracker struct {
+	entries []stormEntry
+	lapse   float64 // Sum of entries
+	active  bool
+	alerts  int64
+}
+
+func (p4m *P4DMetrics) stormDetectionEnabled() bool {
+	return p4m.config.StormCmdsPerMinute > 0 || p4m.config.StormLapse > 0
+}
+
+func (p4m *P4DMetrics) stormWindow() time.Duration {
+	if p4m.config.StormWindow > 0 {
+		return p4m.config.StormWindow
+	}
+	return defaultStormWindow
+}
+
+// expire removes entries older than window as at time t
+func (st *stormTracker) expire(t time.Time, window time.Duration) {
+	i := 0
+	for i < len(st.entries) && t.Sub(st.entries[i].startTime) > window {
+		st.lapse -= st.entries[i].lapse
+		i++
+	}
+	st.entries = st.entries[i:]
+}
+
+// updateStorm checks thresholds for a tracker, logging the start and end of storms
+func (p4m *P4DMetrics) updateStorm(k stormKey, st *stormTracker) {
+	window := p4m.stormWindow()
+	cmdsPerMinute := float64(len(st.entries)) / window.Minutes()
+	storm := (p4m.config.StormCmdsPerMinute > 0 && cmdsPerMinute > float64(p4m.config.StormCmdsPerMinute)) ||
+		(p4m.config.StormLapse > 0 && st.lapse > p4m.config.StormLapse)
+	if storm && !st.active {
+		st.active = true
+		st.alerts++
+		p4m.logger.Warnf("Command storm started: %s %s ran %d cmds (%.0f/min) with total lapse %.1fs in last %s",
+			k.kind, k.id, len(st.entries), cmdsPerMinute, st.lapse, window)
+	} else if !storm && st.active {
+		st.active = false
+		p4m.logger.Infof("Command storm ended: %s %s", k.kind, k.id)
+	}
+}
+
+func (p4m *P4DMetrics) observeStorm(cmd *p4dlog.Command, user, ip string) {
+	if !p4m.stormDetectionEnabled() {
+		return
+	}
+	window := p4m.stormWindow()
+	if cmd.StartTime.After(p4m.stormLatestTime) {
+		p4m.stormLatestTime = cmd.StartTime
+	}
+	if len(p4m.stormTrackers) > 1000 {
+		p4m.expireStorms()
+	}
+	for _, k := range []stormKey{{"user", user}, {"ip", ip}} {
+		st, ok := p4m.stormTrackers[k]
+		if !ok {
+			st = &stormTracker{}
+			p4m.stormTrackers[k] = st
+		}
+		st.entries = append(st.entries, stormEntry{startTime: cmd.StartTime, lapse: float64(cmd.CompletedLapse)})
+		st.lapse += float64(cmd.CompletedLapse)
+		st.expire(cmd.StartTime, window)
+		p4m.updateStorm(k, st)
+	}
+}
+
+// expireStorms ends storms for users/IPs which have not run commands recently, and removes
+// trackers no longer required
+func (p4m *P4DMetrics) expireStorms() {
+	window := p4m.stormWindow()
+	for k, st := range p4m.stormTrackers {
+		st.expire(p4m.stormLatestTime, window)
+		p4m.updateStorm(k, st)
+		if len(st.entries) == 0 && st.alerts == 0 {
+			delete(p4m.stormTrackers, k)
+		}
+	}
+}
+
+func (p4m *P4DMetrics) outputStorms(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	if !p4m.stormDetectionEnabled() {
+		return
+	}
+	p4m.expireStorms()
+	for _, kind := range []string{"user", "ip"} {
+		desc := "user"
+		if kind == "ip" {
+			desc = "IP"
+		}
+		mname := fmt.Sprintf("p4_cmd_storm_%s_alerts", kind)
+		p4m.printMetricHeader(metrics, mname, fmt.Sprintf("A count of command storms (by %s)", desc), "counter")
+		for k, st := range p4m.stormTrackers {
+			if k.kind == kind && st.alerts > 0 {
+				labels := append(fixedLabels, labelStruct{kind, k.id})
+				p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", st.alerts))
+			}
+		}
+		mname = fmt.Sprintf("p4_cmd_storm_%s_active", kind)
+		p4m.printMetricHeader(metrics, mname, fmt.Sprintf("1 if a command storm is in progress (by %s)", desc), "gauge")
+		for k, st := range p4m.stormTrackers {
+			if k.kind == kind && st.alerts > 0 {
+				active := 0
+				if st.active {
+					active = 1
+				}
+				labels := append(fixedLabels, labelStruct{kind, k.id})
+				p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", active))
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+// Rows scanned by table, output as p4_table_scan_rows_total if OutputTableScanRows is set. Massive scans (typically of
+// db.rev by commands with wide or wildcarded paths) are a common cause of server load, but otherwise only visible in
+// the tableUse rows of log2sql. A command scanning more than ScanRowsAlertThreshold rows of a single table logs a
+// warning (with its process key, so the command can be found in log2sql output) and increments
+// p4_table_scan_rows_alerts.
+
+import (
+	"bytes"
+	"fmt"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Default rows scanned of a single table by a single command above which an alert is raised
+const defaultScanRowsAlertThreshold = 10000000
+
+func (p4m *P4DMetrics) scanRowsAlertThreshold() int64 {
+	if p4m.config.ScanRowsAlertThreshold > 0 {
+		return p4m.config.ScanRowsAlertThreshold
+	}
+	return defaultScanRowsAlertThreshold
+}
+
+func (p4m *P4DMetrics) observeTableScan(cmd *p4dlog.Command, t *p4dlog.Table) {
+	if t.ScanRows <= 0 {
+		return
+	}
+	p4m.tableScanRows[t.TableName] += t.ScanRows
+	if t.ScanRows > p4m.scanRowsAlertThreshold() {
+		p4m.tableScanRowsAlerts[t.TableName]++
+		p4m.logger.Warnf("Large table scan: %s scanned %d rows of %s, pid %d line %d processKey %s user %s args '%s'",
+			cmd.Cmd, t.ScanRows, t.TableName, cmd.Pid, cmd.LineNo, cmd.GetKey(), cmd.User, cmd.Args)
+	}
+}
+
+func (p4m *P4DMetrics) outputTableScans(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	if len(p4m.tableScanRows) == 0 {
+		return
+	}
+	mname := "p4_table_scan_rows_total"
+	p4m.printMetricHeader(metrics, mname, "The total rows scanned (by table)", "counter")
+	for table, total := range p4m.tableScanRows {
+		labels := append(fixedLabels, labelStruct{"table", table})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", total))
+	}
+	mname = "p4_table_scan_rows_alerts"
+	p4m.printMetricHeader(metrics, mname,
+		"A count of cmds scanning more rows than the alert threshold (by table)", "counter")
+	for table, count := range p4m.tableScanRowsAlerts {
+		labels := append(fixedLabels, labelStruct{"table", table})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+}
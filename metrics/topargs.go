@@ -0,0 +1,202 @@
+package metrics
+
+// Most frequent argument patterns of selected commands (Config.TopArgsCmds, e.g. user-sync, user-files), with their
+// cumulative lapse, to identify hot depot paths or pathological wildcard patterns (e.g. //.../*.c) straight from the
+// parse. Args are normalised (see normalizeArgs) so that e.g. syncs of different changelists of the same path are
+// counted together. Only reported in the end of run summary (see TopArgs), not as metrics, as the number of distinct
+// patterns is unbounded.
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+const (
+	maxArgPathDepth = 4    // Depot path components kept, e.g. //depot/main/src/lib/...
+	maxArgFields    = 4    // Args kept, e.g. the first few files of p4 files a b c d e...
+	maxArgPatterns  = 1000 // Per command, the least frequent beyond this are counted as argsOther
+	argsOther       = "(other)"
+)
+
+// Revision specifiers with meaning beyond their number
+var symbolicRevs = map[string]bool{"#head": true, "#have": true, "#none": true, "@now": true}
+
+// replaceDigits replaces each run of digits with N, e.g. @12345 -> @N
+func replaceDigits(s string) string {
+	var b strings.Builder
+	inDigits := false
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			if !inDigits {
+				b.WriteByte('N')
+			}
+			inDigits = true
+			continue
+		}
+		inDigits = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// normalizeDepotPath normalises revision specifiers, and keeps up to maxArgPathDepth components of a depot path
+// without wildcards, e.g. //depot/main/src/lib/foo/bar.c#3 -> //depot/main/src/lib/...#N. Wildcard paths (e.g.
+// //.../*.c) are kept in full, as the pattern is what matters.
+func normalizeDepotPath(arg string) string {
+	path, rev := arg, ""
+	if i := strings.IndexAny(arg, "#@"); i >= 0 {
+		path, rev = arg[:i], arg[i:]
+	}
+	if !symbolicRevs[strings.ToLower(rev)] {
+		rev = replaceDigits(rev)
+	}
+	if strings.Contains(path, "...") || strings.ContainsAny(path, "*%") {
+		return path + rev
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "//"), "/")
+	if len(parts) > maxArgPathDepth {
+		path = "//" + strings.Join(parts[:maxArgPathDepth], "/") + "/..."
+	}
+	return path + rev
+}
+
+// normalizeArgs returns the pattern of a command's args
+func normalizeArgs(args string) string {
+	fields := strings.Fields(args)
+	result := make([]string, 0, maxArgFields+1)
+	for i, f := range fields {
+		if i == maxArgFields {
+			result = append(result, fmt.Sprintf("(+%d)", len(fields)-maxArgFields))
+			break
+		}
+		if strings.HasPrefix(f, "//") {
+			result = append(result, normalizeDepotPath(f))
+		} else {
+			result = append(result, replaceDigits(f))
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// argsTotals - totals for a pattern
+type argsTotals struct {
+	pattern string
+	count   int64
+	lapse   float64
+	index   int // In argsPatterns.heap
+}
+
+// argsHeap - min heap of patterns by count
+type argsHeap []*argsTotals
+
+func (h argsHeap) Len() int           { return len(h) }
+func (h argsHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h argsHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *argsHeap) Push(x interface{}) {
+	t := x.(*argsTotals)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *argsHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// argsPatterns - the patterns of a command. Beyond maxArgPatterns the least frequent is evicted, with its totals
+// added to argsOther, so that frequent patterns are kept however many infrequent ones are seen.
+type argsPatterns struct {
+	byPattern map[string]*argsTotals
+	heap      argsHeap
+	other     argsTotals
+}
+
+func (ap *argsPatterns) observe(pattern string, lapse float64) {
+	t, ok := ap.byPattern[pattern]
+	if !ok {
+		if len(ap.heap) >= maxArgPatterns {
+			evicted := heap.Pop(&ap.heap).(*argsTotals)
+			delete(ap.byPattern, evicted.pattern)
+			ap.other.count += evicted.count
+			ap.other.lapse += evicted.lapse
+		}
+		t = &argsTotals{pattern: pattern}
+		ap.byPattern[pattern] = t
+		heap.Push(&ap.heap, t)
+	}
+	t.count++
+	t.lapse += lapse
+	heap.Fix(&ap.heap, t.index)
+}
+
+func (p4m *P4DMetrics) observeTopArgs(cmd *p4dlog.Command) {
+	tracked := false
+	for _, c := range p4m.config.TopArgsCmds {
+		if c == cmd.Cmd {
+			tracked = true
+			break
+		}
+	}
+	if !tracked {
+		return
+	}
+	patterns, ok := p4m.topArgs[cmd.Cmd]
+	if !ok {
+		patterns = &argsPatterns{byPattern: make(map[string]*argsTotals), other: argsTotals{pattern: argsOther}}
+		p4m.topArgs[cmd.Cmd] = patterns
+	}
+	patterns.observe(normalizeArgs(cmd.Args), float64(cmd.CompletedLapse))
+}
+
+// CmdArgs - totals for a normalised argument pattern of a command
+type CmdArgs struct {
+	Cmd   string
+	Args  string
+	Count int64
+	Lapse float64 // Cumulative seconds
+}
+
+// TopArgs returns up to n argument patterns for each of Config.TopArgsCmds seen, ordered by command and then most
+// frequent first. Should only be called once processing is complete.
+func (p4m *P4DMetrics) TopArgs(n int) []CmdArgs {
+	cmds := make([]string, 0, len(p4m.topArgs))
+	for cmd := range p4m.topArgs {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	result := make([]CmdArgs, 0)
+	for _, cmd := range cmds {
+		patterns := p4m.topArgs[cmd]
+		args := make([]CmdArgs, 0, len(patterns.heap)+1)
+		for _, t := range patterns.heap {
+			args = append(args, CmdArgs{Cmd: cmd, Args: t.pattern, Count: t.count, Lapse: t.lapse})
+		}
+		if patterns.other.count > 0 {
+			args = append(args, CmdArgs{Cmd: cmd, Args: argsOther, Count: patterns.other.count, Lapse: patterns.other.lapse})
+		}
+		sort.Slice(args, func(i, j int) bool {
+			if args[i].Count != args[j].Count {
+				return args[i].Count > args[j].Count
+			}
+			if args[i].Lapse != args[j].Lapse {
+				return args[i].Lapse > args[j].Lapse
+			}
+			return args[i].Args < args[j].Args
+		})
+		if n > 0 && len(args) > n {
+			args = args[:n]
+		}
+		result = append(result, args...)
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package metrics
+
+// Completed commands by client workspace, for workspaces matching OutputCmdsByWorkspaceRegex, as
+// p4_cmd_workspace_counter and p4_cmd_workspace_cumulative_seconds. Commands can otherwise only be split by user or IP,
+// which hides hotspots such as build farms where many agents run as the same user, each with its own workspace.
+// Agent workspaces typically share a prefix (e.g. jenkins-linux-042) - if the regex has a subexpression, the
+// first one is used as the workspace label, so that e.g. '^(jenkins-[a-z]+)-' groups agents by pool rather than
+// producing a series per agent. Workspace names are lowercased unless CaseSensitiveServer is set.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func (p4m *P4DMetrics) observeWorkspace(workspace string, lapse float64) {
+	if p4m.config.OutputCmdsByWorkspaceRegex == "" || workspace == "" {
+		return
+	}
+	if p4m.outputCmdsByWorkspaceRegex == nil {
+		p4m.outputCmdsByWorkspaceRegex = regexp.MustCompile(p4m.config.OutputCmdsByWorkspaceRegex)
+	}
+	if !p4m.config.CaseSensitiveServer {
+		workspace = strings.ToLower(workspace)
+	}
+	m := p4m.outputCmdsByWorkspaceRegex.FindStringSubmatch(workspace)
+	if m == nil {
+		return
+	}
+	if len(m) > 1 && m[1] != "" {
+		workspace = m[1]
+	}
+	workspace = NotLabelValueRE.ReplaceAllString(workspace, "_")
+	p4m.cmdByWorkspaceCounter[workspace]++
+	p4m.cmdByWorkspaceCumulative[workspace] += lapse
+}
+
+func (p4m *P4DMetrics) outputWorkspaces(metrics *bytes.Buffer, fixedLabels []labelStruct) {
+	if p4m.config.OutputCmdsByWorkspaceRegex == "" {
+		return
+	}
+	mname := "p4_cmd_workspace_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by workspace)", "counter")
+	for workspace, count := range p4m.cmdByWorkspaceCounter {
+		labels := append(fixedLabels, labelStruct{"workspace", workspace})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%d", count))
+	}
+	mname = "p4_cmd_workspace_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds (by workspace)", "counter")
+	for workspace, lapse := range p4m.cmdByWorkspaceCumulative {
+		labels := append(fixedLabels, labelStruct{"workspace", workspace})
+		p4m.printMetric(metrics, mname, labels, fmt.Sprintf("%0.3f", lapse))
+	}
+}
@@ -0,0 +1,51 @@
+package p4dlog
+
+// Network address lines - written by p4d (without a pid) when a connection is accepted, before the info block
+// recording the start of the command on it:
+//
+//	server to client 10.0.0.5:52344 vs 192.168.1.10:1666
+//	Forwarder set trusted client address 10.0.0.5
+//
+// The first gives the address of the connected peer, which for NAT'd clients differs from the IP in the command
+// start record, the second the client address passed on by a trusted broker/proxy/forwarder. They are attached to the
+// next command started as PeerAddress and TrustedAddress - if no command starts before the next such line, the
+// earlier one is discarded. Other lines with these prefixes are ignored as before.
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	serverToClientPrefix = "server to client"
+	trustedAddressPrefix = "Forwarder set trusted client address"
+)
+
+var reServerToClient = regexp.MustCompile(`^server to client (\S+) vs (\S+)`)
+var reTrustedAddress = regexp.MustCompile(`^Forwarder set trusted client address:? *(\S+)`)
+
+// isNetAddressLine returns true for lines which are parsed as a netAddressType block
+func isNetAddressLine(line string) bool {
+	return strings.HasPrefix(line, serverToClientPrefix) || strings.HasPrefix(line, trustedAddressPrefix)
+}
+
+func (fp *P4dFileParser) processNetAddressBlock(block *Block) {
+	line := block.lines[0]
+	if m := reServerToClient.FindStringSubmatch(line); len(m) > 0 {
+		fp.peerAddress = m[1]
+	} else if m := reTrustedAddress.FindStringSubmatch(line); len(m) > 0 {
+		fp.trustedAddress = m[1]
+	}
+}
+
+// setNetAddresses attaches the addresses from any preceding network address lines to a newly started command. The
+// start record repeated with the track output of a pending command is not a new command, so doesn't consume them.
+func (fp *P4dFileParser) setNetAddresses(cmd *Command) {
+	if pending, ok := fp.cmds[fp.cmdKey(cmd)]; ok && pending.ProcessKey == cmd.ProcessKey {
+		return
+	}
+	cmd.PeerAddress = fp.peerAddress
+	cmd.TrustedAddress = fp.trustedAddress
+	fp.peerAddress = ""
+	fp.trustedAddress = ""
+}
@@ -0,0 +1,248 @@
+package p4dlog
+
+// Parser construction with functional options. NewP4dFileParser followed by Set* calls is only safe before parsing
+// starts, and embedders sharing a parser between goroutines can't easily guarantee that. NewParser applies all
+// configuration before the parser is returned, after which it is not changed, e.g.
+//
+//	fp, err := p4dlog.NewParser(p4dlog.WithLogger(logger), p4dlog.WithNoCompletionRecords(),
+//		p4dlog.WithFeature(p4dlog.FeatureLogTruncated, true))
+//
+// Alternatively an Options struct (e.g. read from a config file) can be passed with WithOptions.
+
+import (
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Options - configuration of a parser created by NewParser
+type Options struct {
+	Logger              *logrus.Logger  // Defaults to the logrus standard logger
+	Debug               int             // Debug level - see DebugLevel
+	DebugPID            int64           // Debug a single command (with DebugCmd)
+	DebugCmd            string          // ditto
+	OutputDuration      time.Duration   // Interval at which completed commands are output - defaults to 1s
+	DebugDuration       time.Duration   // Interval of debug progress messages - defaults to 30s
+	DescriptionLimit    int             // Max length of -d descriptions captured - 0 means not captured
+	NoCompletionRecords bool            // Set if completion records not expected - e.g. configurable server=1
+	Features            map[string]bool // Features explicitly enabled/disabled - see features.go
+	MemoryLimitMB       int64           // Heap usage above which table detail is dropped - 0 means no limit
+	KeepPending         bool            // Retain commands pending at end of input - see Checkpoint()
+	KeepPendingMax      int             // Max uncompleted commands retained with KeepPending - negative means no limit
+	KeepPendingTTL      time.Duration   // Uncompleted commands inactive for this long (log time) aren't retained - negative means no limit
+	KeyMode             KeyMode         // How process keys are generated - see keymode.go
+	UnmatchedLines      io.Writer       // Unrecognised and noise lines are written to this if set - see stats.go
+	MaxPending          int             // Max uncompleted commands retained before eviction - 0 means no limit, see pending.go
+	PendingTTL          time.Duration   // Log time after which inactive uncompleted commands are evicted - 0 means never
+	SpillDir            string          // Directory for temporary file of evicted commands - if empty they are output
+	LineHooks           []LineHookSpec  // Called for matching log lines - see hooks.go
+	TimewarpThreshold   time.Duration   // Log time going backwards by more than this is reported - 0 means not detected, see timewarp.go
+	ReorderBuffer       int             // Commands held to output them in order of start time - 0 means not re-ordered
+	ComputePhaseTables  bool            // Record compute phase table usage in Command.ComputeTables - see phasetables.go
+	ServerPrefix        *regexp.Regexp  // Prefix of lines identifying the server in interleaved logs - see serverprefix.go
+	LockTotals          bool            // Set Command lock wait/held totals summed across tables - see locktotals.go
+}
+
+// Option - sets a parser option for NewParser
+type Option func(*Options)
+
+// DefaultOptions returns the options used by NewParser if none are given
+func DefaultOptions() Options {
+	return Options{
+		Logger:         logrus.StandardLogger(),
+		OutputDuration: time.Second * 1,
+		DebugDuration:  time.Second * 30,
+		KeepPendingMax: DefaultKeepPendingMax,
+		KeepPendingTTL: DefaultKeepPendingTTL,
+	}
+}
+
+// NewParser - create a parser configured by opts, applied in order over DefaultOptions().
+// Returns an error for unknown features.
+func NewParser(opts ...Option) (*P4dFileParser, error) {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	fp := NewP4dFileParser(o.Logger)
+	fp.debug = o.Debug
+	fp.debugPID = o.DebugPID
+	fp.debugCmd = o.DebugCmd
+	fp.outputDuration = o.OutputDuration
+	fp.debugDuration = o.DebugDuration
+	fp.descriptionLimit = o.DescriptionLimit
+	fp.noCompletionRecords = o.NoCompletionRecords
+	fp.memoryLimit = uint64(o.MemoryLimitMB) * 1024 * 1024
+	fp.keepPending = o.KeepPending
+	fp.keepPendingMax = o.KeepPendingMax
+	fp.keepPendingTTL = o.KeepPendingTTL
+	fp.keyMode = o.KeyMode
+	fp.unmatchedWriter = o.UnmatchedLines
+	fp.maxPending = o.MaxPending
+	fp.pendingTTL = o.PendingTTL
+	fp.spillDir = o.SpillDir
+	fp.timewarpThreshold = o.TimewarpThreshold
+	fp.reorderSize = o.ReorderBuffer
+	fp.computePhaseTables = o.ComputePhaseTables
+	fp.lockTotals = o.LockTotals
+	if o.ServerPrefix != nil {
+		fp.setServerPrefix(o.ServerPrefix)
+	}
+	for _, h := range o.LineHooks {
+		fp.RegisterLineHook(h.Pattern, h.Hook)
+	}
+	for name, enabled := range o.Features {
+		if err := fp.SetFeature(name, enabled); err != nil {
+			return nil, err
+		}
+	}
+	return fp, nil
+}
+
+// WithOptions - replaces all options set so far by o, with defaults for any zero Logger/durations
+func WithOptions(o Options) Option {
+	return func(opts *Options) {
+		def := DefaultOptions()
+		*opts = o
+		if opts.Logger == nil {
+			opts.Logger = def.Logger
+		}
+		if opts.OutputDuration == 0 {
+			opts.OutputDuration = def.OutputDuration
+		}
+		if opts.DebugDuration == 0 {
+			opts.DebugDuration = def.DebugDuration
+		}
+		if opts.KeepPendingMax == 0 {
+			opts.KeepPendingMax = def.KeepPendingMax
+		}
+		if opts.KeepPendingTTL == 0 {
+			opts.KeepPendingTTL = def.KeepPendingTTL
+		}
+	}
+}
+
+// WithLogger - logger for parser messages
+func WithLogger(logger *logrus.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+// WithDebugMode - turn on debugging - very verbose!
+func WithDebugMode(level int) Option {
+	return func(o *Options) { o.Debug = level }
+}
+
+// WithDebugPID - turn on debugging for a PID
+func WithDebugPID(pid int64, cmdName string) Option {
+	return func(o *Options) {
+		o.DebugPID = pid
+		o.DebugCmd = cmdName
+	}
+}
+
+// WithDurations - intervals at which completed commands are output and debug progress is logged
+func WithDurations(outputDuration, debugDuration time.Duration) Option {
+	return func(o *Options) {
+		o.OutputDuration = outputDuration
+		o.DebugDuration = debugDuration
+	}
+}
+
+// WithDescriptionLimit - capture -d descriptions into Description, truncated to limit bytes
+func WithDescriptionLimit(limit int) Option {
+	return func(o *Options) { o.DescriptionLimit = limit }
+}
+
+// WithNoCompletionRecords - don't expect completion records
+func WithNoCompletionRecords() Option {
+	return func(o *Options) { o.NoCompletionRecords = true }
+}
+
+// WithFeature - enable or disable a named feature (NewParser returns an error if unknown)
+func WithFeature(name string, enabled bool) Option {
+	return func(o *Options) {
+		// Copied so that a map passed in with WithOptions is not modified
+		features := make(map[string]bool, len(o.Features)+1)
+		for k, v := range o.Features {
+			features[k] = v
+		}
+		features[name] = enabled
+		o.Features = features
+	}
+}
+
+// WithMemoryLimit - limit (in MB) of heap usage above which table detail is no longer retained
+func WithMemoryLimit(limitMB int64) Option {
+	return func(o *Options) { o.MemoryLimitMB = limitMB }
+}
+
+// WithKeepPending - retain commands still pending at end of input rather than outputting them, see Checkpoint()
+func WithKeepPending() Option {
+	return func(o *Options) { o.KeepPending = true }
+}
+
+// WithKeepPendingLimits - bounds on the uncompleted commands retained with WithKeepPending, beyond which the least
+// recently active are evicted at end of input - negative for no limit. Defaults to DefaultKeepPendingMax/DefaultKeepPendingTTL.
+func WithKeepPendingLimits(max int, ttl time.Duration) Option {
+	return func(o *Options) { o.KeepPendingMax, o.KeepPendingTTL = max, ttl }
+}
+
+// WithKeyMode - how process keys are generated, e.g. KeyModeFullArgs
+func WithKeyMode(mode KeyMode) Option {
+	return func(o *Options) { o.KeyMode = mode }
+}
+
+// WithUnmatchedLines - write lines not recognised by the parser to w, as "<lineNo>\t<unrecognised|noise>\t<line>"
+func WithUnmatchedLines(w io.Writer) Option {
+	return func(o *Options) { o.UnmatchedLines = w }
+}
+
+// WithMaxPending - evict the least recently active uncompleted commands when more than max are pending, see pending.go
+func WithMaxPending(max int) Option {
+	return func(o *Options) { o.MaxPending = max }
+}
+
+// WithPendingTTL - evict uncompleted commands with no activity within ttl of log time
+func WithPendingTTL(ttl time.Duration) Option {
+	return func(o *Options) { o.PendingTTL = ttl }
+}
+
+// WithSpillDir - write evicted commands to a temporary file in dir, restoring them if they complete later
+func WithSpillDir(dir string) Option {
+	return func(o *Options) { o.SpillDir = dir }
+}
+
+// WithLineHook - call hook for each log line matching re (may be given more than once), see LineHook
+func WithLineHook(re *regexp.Regexp, hook LineHook) Option {
+	return func(o *Options) { o.LineHooks = append(o.LineHooks, LineHookSpec{Pattern: re, Hook: hook}) }
+}
+
+// WithTimewarpThreshold - output a "timewarp" server event when log time goes backwards by more than threshold
+func WithTimewarpThreshold(threshold time.Duration) Option {
+	return func(o *Options) { o.TimewarpThreshold = threshold }
+}
+
+// WithReorderBuffer - hold up to size commands, outputting them in order of start time
+func WithReorderBuffer(size int) Option {
+	return func(o *Options) { o.ReorderBuffer = size }
+}
+
+// WithComputePhaseTables - record table usage from track output at the end of the compute phase in
+// Command.ComputeTables, rather than merging it into the command totals
+func WithComputePhaseTables() Option {
+	return func(o *Options) { o.ComputePhaseTables = true }
+}
+
+// WithServerPrefix - regex matching the prefix of lines of interleaved logs from several servers, whose first
+// subexpression (or that named "server", or if none the whole prefix) identifies the server. Commands are keyed by
+// (server, pid).
+func WithServerPrefix(re *regexp.Regexp) Option {
+	return func(o *Options) { o.ServerPrefix = re }
+}
+
+// WithLockTotals - set Command.TotalReadWait etc, the lock wait and held times of each command summed across its tables
+func WithLockTotals() Option {
+	return func(o *Options) { o.LockTotals = true }
+}
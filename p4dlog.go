@@ -15,16 +15,16 @@ package p4dlog
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -67,6 +67,8 @@ var reCmd = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+)
 var reCmdNoarg = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+)\'.*`)
 var reCmdMultiLineDesc = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+)([^\']*)`)
 var reCompute = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) compute end ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s.*`)
+var monitorRemovedSuffix = "' exited unexpectedly, removed from monitor table."
+var reMonitorRemoved = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@.*\] '(.*)' exited unexpectedly, removed from monitor table\.`)
 var reCompleted = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) completed ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s.*`)
 var reJSONCmdargs = regexp.MustCompile(`^(.*) \{.*\}$`)
 
@@ -88,6 +90,10 @@ const (
 	activeThreadsType
 	pausedThreadsType
 	resourcePressureType
+	proxyType
+	brokerType
+	serverMessageType
+	netAddressType
 )
 
 // Block is a block of lines parsed from a file
@@ -95,6 +101,7 @@ type Block struct {
 	lineNo int64
 	btype  blockType
 	lines  []string
+	server string // With WithServerPrefix - see serverprefix.go
 }
 
 func (block *Block) addLine(line string, lineNo int64) {
@@ -107,6 +114,10 @@ func (block *Block) addLine(line string, lineNo int64) {
 			block.btype = blankType
 		} else if strings.HasPrefix(line, infoBlock) {
 			block.btype = infoType
+		} else if strings.HasPrefix(line, proxyInfoBlock) {
+			block.btype = proxyType
+		} else if strings.HasPrefix(line, brokerInfoBlock) {
+			block.btype = brokerType
 		} else if strings.HasSuffix(line, msgActiveThreads) {
 			block.btype = activeThreadsType
 			block.lines = append(block.lines, line)
@@ -116,6 +127,12 @@ func (block *Block) addLine(line string, lineNo int64) {
 		} else if strings.Contains(line, msgResourcePressure) {
 			block.btype = resourcePressureType
 			block.lines = append(block.lines, line)
+		} else if isServerMessageLine(line) {
+			block.btype = serverMessageType
+			block.lines = append(block.lines, line)
+		} else if isNetAddressLine(line) {
+			block.btype = netAddressType
+			block.lines = append(block.lines, line)
 		} else {
 			block.btype = errorType
 		}
@@ -137,6 +154,18 @@ type ServerEvent struct {
 	PauseRateMem     int64     `json:"pauseRateMem"`     // Percentage 1-100
 	CPUPressureState int64     `json:"cpuPressureState"` // 0-2
 	MemPressureState int64     `json:"memPressureState"` // 0-2
+	// Set for typed events such as server startup/shutdown (see serverevents.go) - empty for thread/pressure updates
+	EventType string `json:"eventType,omitempty"`
+	Message   string `json:"message,omitempty"` // Text of a typed event
+	// Set for a thread removed from the monitor table (e.g. 'IDLE' or 'Init()' exited unexpectedly), with the
+	// thread values current at the time. Such records never update commands.
+	RemovedPid  int64  `json:"removedPid"`
+	RemovedUser string `json:"removedUser"`
+	RemovedCmd  string `json:"removedCmd"`
+	ServerID    string `json:"serverID"` // Not set by the parser - for callers combining logs from several servers
+	// Not set by the parser - for callers reading several files in sequence, when LineNo runs on across files
+	SourceFile   string `json:"sourceFile"`
+	SourceLineNo int64  `json:"sourceLineNo"` // Line no within SourceFile
 }
 
 func (s *ServerEvent) String() string {
@@ -144,104 +173,195 @@ func (s *ServerEvent) String() string {
 	return string(j)
 }
 
+// Day returns the start of the (log) day of the event
+func (s *ServerEvent) Day() time.Time {
+	y, m, d := s.EventTime.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, s.EventTime.Location())
+}
+
+// RecordTypeServerEventDay - recordType of ServerEventDay JSON, distinguishing it from the commands and events
+// output with it
+const RecordTypeServerEventDay = "serverEventDay"
+
+// ServerEventDay records daily high-water marks of ServerEvent values, e.g. for capacity trends over months of logs
+type ServerEventDay struct {
+	Day              time.Time `json:"day"`
+	ActiveThreadsMax int64     `json:"activeThreadsMax"`
+	PausedThreadsMax int64     `json:"pausedThreadsMax"`
+}
+
+// Update updates high-water marks from evt, which should be for the same Day. The thread counts change only
+// when events are output, so their values are used rather than the Max fields, which may span days.
+func (d *ServerEventDay) Update(evt *ServerEvent) {
+	if evt.ActiveThreads > d.ActiveThreadsMax {
+		d.ActiveThreadsMax = evt.ActiveThreads
+	}
+	if evt.PausedThreads > d.PausedThreadsMax {
+		d.PausedThreadsMax = evt.PausedThreads
+	}
+}
+
+// MarshalJSON formats Day as a date only, with recordType RecordTypeServerEventDay
+func (d *ServerEventDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		RecordType       string `json:"recordType"`
+		Day              string `json:"day"`
+		ActiveThreadsMax int64  `json:"activeThreadsMax"`
+		PausedThreadsMax int64  `json:"pausedThreadsMax"`
+	}{
+		RecordType:       RecordTypeServerEventDay,
+		Day:              d.Day.Format("2006/01/02"),
+		ActiveThreadsMax: d.ActiveThreadsMax,
+		PausedThreadsMax: d.PausedThreadsMax,
+	})
+}
+
+func (d *ServerEventDay) String() string {
+	j, _ := json.Marshal(d)
+	return string(j)
+}
+
 // Command is a command found in the block
 type Command struct {
-	ProcessKey              string    `json:"processKey"`
-	Cmd                     string    `json:"cmd"`
-	Pid                     int64     `json:"pid"`
-	LineNo                  int64     `json:"lineNo"`
-	User                    string    `json:"user"`
-	Workspace               string    `json:"workspace"`
-	StartTime               time.Time `json:"startTime"`
-	EndTime                 time.Time `json:"endTime"`
-	ComputeLapse            float32   `json:"computeLapse"`
-	CompletedLapse          float32   `json:"completedLapse"`
-	Paused                  float32   `json:"paused"` // How long command was paused
-	IP                      string    `json:"ip"`
-	App                     string    `json:"app"`
-	Args                    string    `json:"args"`
-	Running                 int64     `json:"running"`
-	UCpu                    int64     `json:"uCpu"`
-	SCpu                    int64     `json:"sCpu"`
-	DiskIn                  int64     `json:"diskIn"`
-	DiskOut                 int64     `json:"diskOut"`
-	IpcIn                   int64     `json:"ipcIn"`
-	IpcOut                  int64     `json:"ipcOut"`
-	MaxRss                  int64     `json:"maxRss"`
-	PageFaults              int64     `json:"pageFaults"`
-	MemMB                   int64     `json:"memMB"`
-	MemPeakMB               int64     `json:"memPeakMB"`
-	RPCMsgsIn               int64     `json:"rpcMsgsIn"`
-	RPCMsgsOut              int64     `json:"rpcMsgsOut"`
-	RPCSizeIn               int64     `json:"rpcSizeIn"`
-	RPCSizeOut              int64     `json:"rpcSizeOut"`
-	RPCHimarkFwd            int64     `json:"rpcHimarkFwd"`
-	RPCHimarkRev            int64     `json:"rpcHimarkRev"`
-	RPCSnd                  float32   `json:"rpcSnd"`
-	RPCRcv                  float32   `json:"rpcRcv"`
-	FileTotalsSnd           int64     `json:"fileTotalsSnd`
-	FileTotalsRcv           int64     `json:"fileTotalsRcv`
-	FileTotalsSndMBytes     int64     `json:"fileTotalsSndMBytes`
-	FileTotalsRcvMBytes     int64     `json:"fileTotalsRcvMBytes`
-	NetFilesAdded           int64     `json:"netFilesAdded"` // Valid for syncs and network estimates records
-	NetFilesUpdated         int64     `json:"netFilesUpdated"`
-	NetFilesDeleted         int64     `json:"netFilesDeleted"`
-	NetBytesAdded           int64     `json:"netBytesAdded"`
-	NetBytesUpdated         int64     `json:"netBytesUpdated"`
-	LbrRcsOpens             int64     `json:"lbrRcsOpens"` // Required for processing lbr records
-	LbrRcsCloses            int64     `json:"lbrRcsCloses"`
-	LbrRcsCheckins          int64     `json:"lbrRcsCheckins"`
-	LbrRcsExists            int64     `json:"lbrRcsExists"`
-	LbrRcsReads             int64     `json:"lbrRcsReads"`
-	LbrRcsReadBytes         int64     `json:"lbrRcsReadBytes"`
-	LbrRcsWrites            int64     `json:"lbrRcsWrites"`
-	LbrRcsWriteBytes        int64     `json:"lbrRcsWriteBytes"`
-	LbrRcsDigests           int64     `json:"lbrRcsDigests"`
-	LbrRcsFileSizes         int64     `json:"lbrRcsFileSizes"`
-	LbrRcsModTimes          int64     `json:"lbrRcsModTimes"`
-	LbrRcsCopies            int64     `json:"lbrRcsCopies"`
-	LbrBinaryOpens          int64     `json:"lbrBinaryOpens"`
-	LbrBinaryCloses         int64     `json:"lbrBinaryCloses"`
-	LbrBinaryCheckins       int64     `json:"lbrBinaryCheckins"`
-	LbrBinaryExists         int64     `json:"lbrBinaryExists"`
-	LbrBinaryReads          int64     `json:"lbrBinaryReads"`
-	LbrBinaryReadBytes      int64     `json:"lbrBinaryReadBytes"`
-	LbrBinaryWrites         int64     `json:"lbrBinaryWrites"`
-	LbrBinaryWriteBytes     int64     `json:"lbrBinaryWriteBytes"`
-	LbrBinaryDigests        int64     `json:"lbrBinaryDigests"`
-	LbrBinaryFileSizes      int64     `json:"lbrBinaryFileSizes"`
-	LbrBinaryModTimes       int64     `json:"lbrBinaryModTimes"`
-	LbrBinaryCopies         int64     `json:"lbrBinaryCopies"`
-	LbrCompressOpens        int64     `json:"lbrCompressOpens"`
-	LbrCompressCloses       int64     `json:"lbrCompressCloses"`
-	LbrCompressCheckins     int64     `json:"lbrCompressCheckins"`
-	LbrCompressExists       int64     `json:"lbrCompressExists"`
-	LbrCompressReads        int64     `json:"lbrCompressReads"`
-	LbrCompressReadBytes    int64     `json:"lbrCompressReadBytes"`
-	LbrCompressWrites       int64     `json:"lbrCompressWrites"`
-	LbrCompressWriteBytes   int64     `json:"lbrCompressWriteBytes"`
-	LbrCompressDigests      int64     `json:"lbrCompressDigests"`
-	LbrCompressFileSizes    int64     `json:"lbrCompressFileSizes"`
-	LbrCompressModTimes     int64     `json:"lbrCompressModTimes"`
-	LbrCompressCopies       int64     `json:"lbrCompressCopies"`
-	LbrUncompressOpens      int64     `json:"lbrUncompressOpens"`
-	LbrUncompressCloses     int64     `json:"lbrUncompressCloses"`
-	LbrUncompressCheckins   int64     `json:"lbrUncompressCheckins"`
-	LbrUncompressExists     int64     `json:"lbrUncompressExists"`
-	LbrUncompressReads      int64     `json:"lbrUncompressReads"`
-	LbrUncompressReadBytes  int64     `json:"lbrUncompressReadBytes"`
-	LbrUncompressWrites     int64     `json:"lbrUncompressWrites"`
-	LbrUncompressWriteBytes int64     `json:"lbrUncompressWriteBytes"`
-	LbrUncompressDigests    int64     `json:"lbrUncompressDigests"`
-	LbrUncompressFileSizes  int64     `json:"lbrUncompressFileSizes"`
-	LbrUncompressModTimes   int64     `json:"lbrUncompressModTimes"`
-	LbrUncompressCopies     int64     `json:"lbrUncompressCopies"`
-	CmdError                bool      `json:"cmderror"`
-	Tables                  map[string]*Table
-	duplicateKey            bool
-	completed               bool
-	countedInRunning        bool
-	hasTrackInfo            bool
+	ProcessKey                string    `json:"processKey"`
+	Cmd                       string    `json:"cmd"`
+	Pid                       int64     `json:"pid"`
+	LineNo                    int64     `json:"lineNo"`
+	User                      string    `json:"user"`
+	Workspace                 string    `json:"workspace"`
+	StartTime                 time.Time `json:"startTime"`
+	EndTime                   time.Time `json:"endTime"`
+	ComputeLapse              float32   `json:"computeLapse"`
+	CompletedLapse            float32   `json:"completedLapse"`
+	Paused                    float32   `json:"paused"` // How long command was paused
+	IP                        string    `json:"ip"`
+	PeerAddress               string    `json:"peerAddress"`    // From preceding "server to client" line - see netaddress.go
+	TrustedAddress            string    `json:"trustedAddress"` // From preceding "Forwarder set trusted client address" line
+	App                       string    `json:"app"`
+	Args                      string    `json:"args"`
+	Description               string    `json:"description"` // Full -d description (may be multi-line) if SetDescriptionLimit set
+	Running                   int64     `json:"running"`
+	RunningPeak               int64     `json:"runningPeak"` // Max of Running while the command was running - see runningpeak.go
+	UCpu                      int64     `json:"uCpu"`
+	SCpu                      int64     `json:"sCpu"`
+	DiskIn                    int64     `json:"diskIn"`
+	DiskOut                   int64     `json:"diskOut"`
+	IpcIn                     int64     `json:"ipcIn"`
+	IpcOut                    int64     `json:"ipcOut"`
+	MaxRss                    int64     `json:"maxRss"`
+	PageFaults                int64     `json:"pageFaults"`
+	MemMB                     int64     `json:"memMB"`
+	MemPeakMB                 int64     `json:"memPeakMB"`
+	RPCMsgsIn                 int64     `json:"rpcMsgsIn"`
+	RPCMsgsOut                int64     `json:"rpcMsgsOut"`
+	RPCSizeIn                 int64     `json:"rpcSizeIn"`
+	RPCSizeOut                int64     `json:"rpcSizeOut"`
+	RPCHimarkFwd              int64     `json:"rpcHimarkFwd"`
+	RPCHimarkRev              int64     `json:"rpcHimarkRev"`
+	RPCSnd                    float32   `json:"rpcSnd"`
+	RPCRcv                    float32   `json:"rpcRcv"`
+	RPCForwardHost            string    `json:"rpcForwardHost"` // Server to which an edge/forwarder sent RPCs, e.g. commit:1666
+	RPCForwardMsgsIn          int64     `json:"rpcForwardMsgsIn"`
+	RPCForwardMsgsOut         int64     `json:"rpcForwardMsgsOut"`
+	RPCForwardSizeIn          int64     `json:"rpcForwardSizeIn"` // MB
+	RPCForwardSizeOut         int64     `json:"rpcForwardSizeOut"`
+	FileTotalsSnd             int64     `json:"fileTotalsSnd"`
+	FileTotalsRcv             int64     `json:"fileTotalsRcv"`
+	FileTotalsSndMBytes       int64     `json:"fileTotalsSndMBytes"`
+	FileTotalsRcvMBytes       int64     `json:"fileTotalsRcvMBytes"`
+	FileTotalsClientSnd       int64     `json:"fileTotalsClientSnd"` // From the client-Stats record following the command on the same pid
+	FileTotalsClientRcv       int64     `json:"fileTotalsClientRcv"`
+	FileTotalsClientSndMBytes int64     `json:"fileTotalsClientSndMBytes"`
+	FileTotalsClientRcvMBytes int64     `json:"fileTotalsClientRcvMBytes"`
+	NetFilesAdded             int64     `json:"netFilesAdded"` // Valid for syncs and network estimates records
+	NetFilesUpdated           int64     `json:"netFilesUpdated"`
+	NetFilesDeleted           int64     `json:"netFilesDeleted"`
+	NetBytesAdded             int64     `json:"netBytesAdded"`
+	NetBytesUpdated           int64     `json:"netBytesUpdated"`
+	LbrRcsOpens               int64     `json:"lbrRcsOpens"` // Required for processing lbr records
+	LbrRcsCloses              int64     `json:"lbrRcsCloses"`
+	LbrRcsCheckins            int64     `json:"lbrRcsCheckins"`
+	LbrRcsExists              int64     `json:"lbrRcsExists"`
+	LbrRcsReads               int64     `json:"lbrRcsReads"`
+	LbrRcsReadBytes           int64     `json:"lbrRcsReadBytes"`
+	LbrRcsWrites              int64     `json:"lbrRcsWrites"`
+	LbrRcsWriteBytes          int64     `json:"lbrRcsWriteBytes"`
+	LbrRcsDigests             int64     `json:"lbrRcsDigests"`
+	LbrRcsFileSizes           int64     `json:"lbrRcsFileSizes"`
+	LbrRcsModTimes            int64     `json:"lbrRcsModTimes"`
+	LbrRcsCopies              int64     `json:"lbrRcsCopies"`
+	LbrBinaryOpens            int64     `json:"lbrBinaryOpens"`
+	LbrBinaryCloses           int64     `json:"lbrBinaryCloses"`
+	LbrBinaryCheckins         int64     `json:"lbrBinaryCheckins"`
+	LbrBinaryExists           int64     `json:"lbrBinaryExists"`
+	LbrBinaryReads            int64     `json:"lbrBinaryReads"`
+	LbrBinaryReadBytes        int64     `json:"lbrBinaryReadBytes"`
+	LbrBinaryWrites           int64     `json:"lbrBinaryWrites"`
+	LbrBinaryWriteBytes       int64     `json:"lbrBinaryWriteBytes"`
+	LbrBinaryDigests          int64     `json:"lbrBinaryDigests"`
+	LbrBinaryFileSizes        int64     `json:"lbrBinaryFileSizes"`
+	LbrBinaryModTimes         int64     `json:"lbrBinaryModTimes"`
+	LbrBinaryCopies           int64     `json:"lbrBinaryCopies"`
+	LbrCompressOpens          int64     `json:"lbrCompressOpens"`
+	LbrCompressCloses         int64     `json:"lbrCompressCloses"`
+	LbrCompressCheckins       int64     `json:"lbrCompressCheckins"`
+	LbrCompressExists         int64     `json:"lbrCompressExists"`
+	LbrCompressReads          int64     `json:"lbrCompressReads"`
+	LbrCompressReadBytes      int64     `json:"lbrCompressReadBytes"`
+	LbrCompressWrites         int64     `json:"lbrCompressWrites"`
+	LbrCompressWriteBytes     int64     `json:"lbrCompressWriteBytes"`
+	LbrCompressDigests        int64     `json:"lbrCompressDigests"`
+	LbrCompressFileSizes      int64     `json:"lbrCompressFileSizes"`
+	LbrCompressModTimes       int64     `json:"lbrCompressModTimes"`
+	LbrCompressCopies         int64     `json:"lbrCompressCopies"`
+	LbrUncompressOpens        int64     `json:"lbrUncompressOpens"`
+	LbrUncompressCloses       int64     `json:"lbrUncompressCloses"`
+	LbrUncompressCheckins     int64     `json:"lbrUncompressCheckins"`
+	LbrUncompressExists       int64     `json:"lbrUncompressExists"`
+	LbrUncompressReads        int64     `json:"lbrUncompressReads"`
+	LbrUncompressReadBytes    int64     `json:"lbrUncompressReadBytes"`
+	LbrUncompressWrites       int64     `json:"lbrUncompressWrites"`
+	LbrUncompressWriteBytes   int64     `json:"lbrUncompressWriteBytes"`
+	LbrUncompressDigests      int64     `json:"lbrUncompressDigests"`
+	LbrUncompressFileSizes    int64     `json:"lbrUncompressFileSizes"`
+	LbrUncompressModTimes     int64     `json:"lbrUncompressModTimes"`
+	LbrUncompressCopies       int64     `json:"lbrUncompressCopies"`
+	TotalReadWait             int64     `json:"totalReadWait"` // Summed across Tables (ms) - see locktotals.go
+	TotalReadHeld             int64     `json:"totalReadHeld"`
+	TotalWriteWait            int64     `json:"totalWriteWait"`
+	TotalWriteHeld            int64     `json:"totalWriteHeld"`
+	CmdError                  bool      `json:"cmderror"`
+	ErrorText                 string    `json:"errorText"`     // Text of "Perforce server error" block(s) for the command
+	ErrorSeverity             string    `json:"errorSeverity"` // One of ErrorSeverityInfo etc if CmdError
+	ErrorCode                 int64     `json:"errorCode"`     // Error number if present in ErrorText
+	ErrorCount                int64     `json:"errorCount"`    // Number of error blocks (e.g. one per file for some commands)
+	LimitExceeded             string    `json:"limitExceeded"` // Governor limit which terminated the command, e.g. LimitMaxResults
+	Killed                    bool      `json:"killed"`        // Terminated by p4 monitor terminate, a governor limit or resource pressure
+	KillReason                string    `json:"killReason"`    // If Killed: KillReasonTerminated, KillReasonPaused or as LimitExceeded
+	EndReason                 string    `json:"endReason"`     // Set if command did not complete normally, e.g. EndReasonLogTruncated
+	LastSeenTime              time.Time `json:"lastSeenTime"`  // Latest time in log when EndReasonLogTruncated/EndReasonEvicted
+	ServerID                  string    `json:"serverID"`      // Set by the parser with WithServerPrefix, else by callers combining logs from several servers
+	SourceFile                string    `json:"sourceFile"`    // Not set by the parser - for callers reading several files in sequence
+	SourceLineNo              int64     `json:"sourceLineNo"`  // Line no within SourceFile (LineNo runs on across files)
+	Tables                    map[string]*Table
+	ComputeTables             map[string]*Table          // Compute phase table usage, if WithComputePhaseTables - see phasetables.go
+	SerializedLocks           map[string]*SerializedLock // Storage serialization locks (storageup etc) - keyed by LegacyTableName()
+	Errors                    []ErrorBlock               `json:"errors"` // Error blocks in order, up to maxErrorBlocks - ErrorText is all of them joined
+	duplicateKey              bool
+	completed                 bool
+	countedInRunning          bool
+	runningSeq                int64     // When counted in running - see runningpeak.go
+	lastActive                time.Time // Log time last started/updated - see pending.go
+	hasTrackInfo              bool
+
+	// Not set by the parser - values set by line hooks, see hooks.go
+	Extra map[string]string `json:"extra"`
+}
+
+// ErrorBlock - the text of a server error block for a command (part of Command)
+type ErrorBlock struct {
+	LineNo int64  `json:"lineNo"`
+	Text   string `json:"text"`
 }
 
 // Table stores track information per table (part of Command)
@@ -273,6 +393,7 @@ type Table struct {
 	MaxPeekWait        int64   `json:"maxPeekWait"`
 	MaxPeekHeld        int64   `json:"maxPeekHeld"`
 	TriggerLapse       float32 `json:"triggerLapse"`
+	TriggerStage       string  `json:"triggerStage,omitempty"` // Swarm workflow stage, e.g. changesave/enforce/strict
 }
 
 func (t *Table) setPages(pagesIn, pagesOut, pagesCached string) {
@@ -319,9 +440,82 @@ func (t *Table) setPeek(peekCount, totalPeekWait, totalPeekHeld, maxPeekWait, ma
 	t.MaxPeekHeld, _ = strconv.ParseInt(maxPeekHeld, 10, 64)
 }
 
+// SerializedLock stores track information for the storage serialization pseudo-tables, e.g.
+// "--- storageup/storagemasterup(R)", which gate submits. Only lock values are reported for these.
+type SerializedLock struct {
+	Name           string `json:"name"` // e.g. storageup or storagemasterup
+	Mode           string `json:"mode"` // R or W if reported
+	TotalReadWait  int64  `json:"totalReadWait"`
+	TotalReadHeld  int64  `json:"totalReadHeld"`
+	TotalWriteWait int64  `json:"totalWriteWait"`
+	TotalWriteHeld int64  `json:"totalWriteHeld"`
+	MaxReadWait    int64  `json:"maxReadWait"`
+	MaxReadHeld    int64  `json:"maxReadHeld"`
+	MaxWriteWait   int64  `json:"maxWriteWait"`
+	MaxWriteHeld   int64  `json:"maxWriteHeld"`
+}
+
+// newSerializedLock parses the name after "--- storageup/", e.g. "storagemasterup(R)"
+func newSerializedLock(val string) *SerializedLock {
+	l := &SerializedLock{Name: val}
+	for _, mode := range []string{"R", "W"} {
+		if j := strings.Index(val, "("+mode+")"); j > 0 {
+			l.Name = val[:j]
+			l.Mode = mode
+			break
+		}
+	}
+	return l
+}
+
+// LegacyTableName - name as previously recorded as a table, e.g. storageup_R
+func (l *SerializedLock) LegacyTableName() string {
+	if l.Mode == "" {
+		return l.Name
+	}
+	return fmt.Sprintf("%s_%s", l.Name, l.Mode)
+}
+
+// Table - returns lock values as a Table with LegacyTableName() for consumers which treat all locks alike
+func (l *SerializedLock) Table() *Table {
+	return &Table{TableName: l.LegacyTableName(),
+		TotalReadWait: l.TotalReadWait, TotalReadHeld: l.TotalReadHeld,
+		TotalWriteWait: l.TotalWriteWait, TotalWriteHeld: l.TotalWriteHeld,
+		MaxReadWait: l.MaxReadWait, MaxReadHeld: l.MaxReadHeld,
+		MaxWriteWait: l.MaxWriteWait, MaxWriteHeld: l.MaxWriteHeld}
+}
+
+func (l *SerializedLock) setTotalLock(totalReadWait, totalReadHeld, totalWriteWait, totalWriteHeld string) {
+	l.TotalReadWait, _ = strconv.ParseInt(totalReadWait, 10, 64)
+	l.TotalReadHeld, _ = strconv.ParseInt(totalReadHeld, 10, 64)
+	l.TotalWriteWait, _ = strconv.ParseInt(totalWriteWait, 10, 64)
+	l.TotalWriteHeld, _ = strconv.ParseInt(totalWriteHeld, 10, 64)
+}
+
+func (l *SerializedLock) setMaxLock(maxReadWait, maxReadHeld, maxWriteWait, maxWriteHeld string) {
+	l.MaxReadWait, _ = strconv.ParseInt(maxReadWait, 10, 64)
+	l.MaxReadHeld, _ = strconv.ParseInt(maxReadHeld, 10, 64)
+	l.MaxWriteWait, _ = strconv.ParseInt(maxWriteWait, 10, 64)
+	l.MaxWriteHeld, _ = strconv.ParseInt(maxWriteHeld, 10, 64)
+}
+
+// TablesWithLocks - returns Tables plus SerializedLocks as tables (with legacy names), for consumers
+// analysing all locks together
+func (c *Command) TablesWithLocks() []*Table {
+	tables := make([]*Table, 0, len(c.Tables)+len(c.SerializedLocks))
+	for _, t := range c.Tables {
+		tables = append(tables, t)
+	}
+	for _, l := range c.SerializedLocks {
+		tables = append(tables, l.Table())
+	}
+	return tables
+}
+
 func newCommand() *Command {
 	c := new(Command)
 	c.Tables = make(map[string]*Table, 0)
+	c.SerializedLocks = make(map[string]*SerializedLock, 0)
 	return c
 }
 
@@ -339,11 +533,42 @@ func (c *Command) GetKey() string {
 	return c.ProcessKey
 }
 
+// Origins of commands as returned by Origin
+const (
+	OriginDirect        = "direct"         // From a client connected directly to this server
+	OriginBrokered      = "brokered"       // Via a p4broker
+	OriginEdgeForwarded = "edge-forwarded" // Via an edge server, forwarding replica or proxy
+	OriginBackground    = "background"     // Started by this or another server, e.g. replica pulls or rmt- cmds
+)
+
+// Origin classifies where a command came from, e.g. for metrics on a commit server which distinguish commands from
+// edge servers. Intermediaries record an IP of "client/intermediary", and brokers append " (brokered)" to the app.
+func (c *Command) Origin() string {
+	switch {
+	case c.IP == "background" || strings.HasPrefix(c.Cmd, "rmt-") || strings.HasPrefix(c.App, "p4d/"):
+		return OriginBackground
+	case strings.HasSuffix(c.App, " (brokered)"):
+		return OriginBrokered
+	case strings.Contains(c.IP, "/"):
+		return OriginEdgeForwarded
+	}
+	return OriginDirect
+}
+
 func (c *Command) String() string {
 	j, _ := json.Marshal(c)
 	return string(j)
 }
 
+// AdjustTimes adds d to the command's times, e.g. to correct for clock skew between servers
+func (c *Command) AdjustTimes(d time.Duration) {
+	for _, t := range []*time.Time{&c.StartTime, &c.EndTime, &c.LastSeenTime} {
+		if !t.IsZero() {
+			*t = t.Add(d)
+		}
+	}
+}
+
 func (c *Command) setStartTime(t string) {
 	c.StartTime, _ = time.Parse(p4timeformat, t)
 }
@@ -375,6 +600,27 @@ func (c *Command) updateStartEndTimes() {
 	}
 }
 
+// Allowed difference between (end - start - completed lapse) and an hour for us to regard it as a DST shift
+const dstTolerance = 5 * time.Second
+
+// Log times are local wall clock times (without timezone), so a command which spans a DST transition
+// appears to take an hour less (clocks go back - it may even end before it started), or an extra hour (clocks
+// go forward). The completed lapse is measured by p4d and not affected, so we use it to correct the end time.
+// Commands spanning midnight are fine since the date is included in the log.
+func (c *Command) correctEndTime() {
+	if c.StartTime == blankTime || c.EndTime == blankTime {
+		return
+	}
+	lapse := time.Duration(float64(c.CompletedLapse) * float64(time.Second))
+	diff := c.EndTime.Sub(c.StartTime) - lapse
+	if diff < 0 {
+		diff = -diff
+	}
+	if c.EndTime.Before(c.StartTime) || (diff > time.Hour-dstTolerance && diff < time.Hour+dstTolerance) {
+		c.EndTime = c.StartTime.Add(lapse)
+	}
+}
+
 func (c *Command) setUsage(uCPU, sCPU, diskIn, diskOut, ipcIn, ipcOut, maxRss, pageFaults string) {
 	c.UCpu, _ = strconv.ParseInt(uCPU, 10, 64)
 	c.SCpu, _ = strconv.ParseInt(sCPU, 10, 64)
@@ -416,6 +662,21 @@ func (c *Command) setRPC(rpcMsgsIn, rpcMsgsOut, rpcSizeIn, rpcSizeOut, rpcHimark
 	}
 }
 
+// setRPCForward records RPCs forwarded by an edge/forwarder to another server. If there is more than one such line
+// (e.g. several upstream servers) they are summed, with the hosts comma separated.
+func (c *Command) setRPCForward(host, msgsIn, msgsOut, sizeIn, sizeOut string) {
+	switch {
+	case c.RPCForwardHost == "":
+		c.RPCForwardHost = host
+	case !strings.Contains(","+c.RPCForwardHost+",", ","+host+","):
+		c.RPCForwardHost += "," + host
+	}
+	c.RPCForwardMsgsIn += toInt64(msgsIn)
+	c.RPCForwardMsgsOut += toInt64(msgsOut)
+	c.RPCForwardSizeIn += toInt64(sizeIn)
+	c.RPCForwardSizeOut += toInt64(sizeOut)
+}
+
 func (c *Command) setFileTotals(fileTotalsSnd, fileTotalsSndMBytes, fileTotalsRcv, fileTotalsRcvMBytes string) {
 	c.FileTotalsSnd, _ = strconv.ParseInt(fileTotalsSnd, 10, 64)
 	c.FileTotalsSndMBytes, _ = strconv.ParseInt(fileTotalsSndMBytes, 10, 64)
@@ -423,6 +684,22 @@ func (c *Command) setFileTotals(fileTotalsSnd, fileTotalsSndMBytes, fileTotalsRc
 	c.FileTotalsRcvMBytes, _ = strconv.ParseInt(fileTotalsRcvMBytes, 10, 64)
 }
 
+func (c *Command) setFileTotalsClient(fileTotalsSnd, fileTotalsSndMBytes, fileTotalsRcv, fileTotalsRcvMBytes string) {
+	c.FileTotalsClientSnd, _ = strconv.ParseInt(fileTotalsSnd, 10, 64)
+	c.FileTotalsClientSndMBytes, _ = strconv.ParseInt(fileTotalsSndMBytes, 10, 64)
+	c.FileTotalsClientRcv, _ = strconv.ParseInt(fileTotalsRcv, 10, 64)
+	c.FileTotalsClientRcvMBytes, _ = strconv.ParseInt(fileTotalsRcvMBytes, 10, 64)
+}
+
+// attachClientStats records the client side file totals of a client-Stats command against the command which it
+// follows on the same pid
+func (c *Command) attachClientStats(stats *Command) {
+	c.FileTotalsClientSnd = stats.FileTotalsClientSnd
+	c.FileTotalsClientRcv = stats.FileTotalsClientRcv
+	c.FileTotalsClientSndMBytes = stats.FileTotalsClientSndMBytes
+	c.FileTotalsClientRcvMBytes = stats.FileTotalsClientRcvMBytes
+}
+
 func (c *Command) setLbrRcsOpensCloses(lbrOpens, lbrCloses, lbrCheckins, lbrExists string) {
 	if lbrOpens != "" {
 		c.LbrRcsOpens, _ = strconv.ParseInt(lbrOpens, 10, 64)
@@ -587,6 +864,13 @@ func (c *Command) setLbrUncompressDigestFilesizes(digests, filesizez, modtimes,
 	}
 }
 
+// AdjustTimes adds d to the event time, e.g. to correct for clock skew between servers
+func (s *ServerEvent) AdjustTimes(d time.Duration) {
+	if !s.EventTime.IsZero() {
+		s.EventTime = s.EventTime.Add(d)
+	}
+}
+
 // MarshalJSON - handle formatting
 func (s *ServerEvent) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
@@ -601,6 +885,14 @@ func (s *ServerEvent) MarshalJSON() ([]byte, error) {
 		PauseRateMem     int64     `json:"pauseRateMem"`     // Percentage 1-100
 		CPUPressureState int64     `json:"cpuPressureState"` // 0-2
 		MemPressureState int64     `json:"memPressureState"` // 0-2
+		EventType        string    `json:"eventType,omitempty"`
+		Message          string    `json:"message,omitempty"`
+		RemovedPid       int64     `json:"removedPid,omitempty"`
+		RemovedUser      string    `json:"removedUser,omitempty"`
+		RemovedCmd       string    `json:"removedCmd,omitempty"`
+		ServerID         string    `json:"serverID,omitempty"`
+		SourceFile       string    `json:"sourceFile,omitempty"`
+		SourceLineNo     int64     `json:"sourceLineNo,omitempty"`
 	}{
 		EventTime:        s.EventTime,
 		LineNo:           s.LineNo,
@@ -613,211 +905,367 @@ func (s *ServerEvent) MarshalJSON() ([]byte, error) {
 		PauseRateMem:     s.PauseRateMem,
 		CPUPressureState: s.CPUPressureState,
 		MemPressureState: s.MemPressureState,
+		EventType:        s.EventType,
+		Message:          s.Message,
+		RemovedPid:       s.RemovedPid,
+		RemovedUser:      s.RemovedUser,
+		RemovedCmd:       s.RemovedCmd,
+		ServerID:         s.ServerID,
+		SourceFile:       s.SourceFile,
+		SourceLineNo:     s.SourceLineNo,
 	})
 }
 
 // MarshalJSON - handle time formatting
 func (c *Command) MarshalJSON() ([]byte, error) {
-	tables := make([]Table, len(c.Tables))
-	i := 0
-	for _, v := range c.Tables {
-		tables[i] = *v
-		i++
+	tables := sortedTables(c.Tables)
+	var computeTables []Table
+	if len(c.ComputeTables) > 0 {
+		computeTables = sortedTables(c.ComputeTables)
 	}
-	sort.Slice(tables[:], func(i, j int) bool {
-		return tables[i].TableName < tables[j].TableName
+	var locks []SerializedLock
+	for _, l := range c.SerializedLocks {
+		locks = append(locks, *l)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].LegacyTableName() < locks[j].LegacyTableName()
 	})
+	lastSeenTime := ""
+	if !c.LastSeenTime.IsZero() {
+		lastSeenTime = c.LastSeenTime.Format(p4timeformat)
+	}
 	return json.Marshal(&struct {
-		ProcessKey              string  `json:"processKey"`
-		Cmd                     string  `json:"cmd"`
-		Pid                     int64   `json:"pid"`
-		LineNo                  int64   `json:"lineNo"`
-		User                    string  `json:"user"`
-		Workspace               string  `json:"workspace"`
-		ComputeLapse            float32 `json:"computeLapse"`
-		CompletedLapse          float32 `json:"completedLapse"`
-		Paused                  float32 `json:"paused"`
-		IP                      string  `json:"ip"`
-		App                     string  `json:"app"`
-		Args                    string  `json:"args"`
-		StartTime               string  `json:"startTime"`
-		EndTime                 string  `json:"endTime"`
-		Running                 int64   `json:"running"`
-		UCpu                    int64   `json:"uCpu"`
-		SCpu                    int64   `json:"sCpu"`
-		DiskIn                  int64   `json:"diskIn"`
-		DiskOut                 int64   `json:"diskOut"`
-		IpcIn                   int64   `json:"ipcIn"`
-		IpcOut                  int64   `json:"ipcOut"`
-		MaxRss                  int64   `json:"maxRss"`
-		PageFaults              int64   `json:"pageFaults"`
-		MemMB                   int64   `json:"memMB"`
-		MemPeakMB               int64   `json:"memPeakMB"`
-		RPCMsgsIn               int64   `json:"rpcMsgsIn"`
-		RPCMsgsOut              int64   `json:"rpcMsgsOut"`
-		RPCSizeIn               int64   `json:"rpcSizeIn"`
-		RPCSizeOut              int64   `json:"rpcSizeOut"`
-		RPCHimarkFwd            int64   `json:"rpcHimarkFwd"`
-		RPCHimarkRev            int64   `json:"rpcHimarkRev"`
-		RPCSnd                  float32 `json:"rpcSnd"`
-		RPCRcv                  float32 `json:"rpcRcv"`
-		FileTotalsSnd           int64   `json:"fileTotalsSnd"`       // Valid for syncs
-		FileTotalsRcv           int64   `json:"fileTotalsRcv"`       // Valid for syncs
-		FileTotalsSndMBytes     int64   `json:"fileTotalsSndMBytes"` // Valid for syncs
-		FileTotalsRcvMBytes     int64   `json:"fileTotalsRcvMBytes"` // Valid for syncs
-		NetFilesAdded           int64   `json:"netFilesAdded"`       // Valid for syncs and network estimates records
-		NetFilesUpdated         int64   `json:"netFilesUpdated"`
-		NetFilesDeleted         int64   `json:"netFilesDeleted"`
-		NetBytesAdded           int64   `json:"netBytesAdded"`
-		NetBytesUpdated         int64   `json:"netBytesUpdated"`
-		LbrRcsOpens             int64   `json:"lbrRcsOpens"` // Required for processing lbr records
-		LbrRcsCloses            int64   `json:"lbrRcsCloses"`
-		LbrRcsCheckins          int64   `json:"lbrRcsCheckins"`
-		LbrRcsExists            int64   `json:"lbrRcsExists"`
-		LbrRcsReads             int64   `json:"lbrRcsReads"`
-		LbrRcsReadBytes         int64   `json:"lbrRcsReadBytes"`
-		LbrRcsWrites            int64   `json:"lbrRcsWrites"`
-		LbrRcsWriteBytes        int64   `json:"lbrRcsWriteBytes"`
-		LbrRcsDigests           int64   `json:"lbrRcsDigests"`
-		LbrRcsFileSizes         int64   `json:"lbrRcsFileSizes"`
-		LbrRcsModTimes          int64   `json:"lbrRcsModTimes"`
-		LbrRcsCopies            int64   `json:"lbrRcsCopies"`
-		LbrBinaryOpens          int64   `json:"lbrBinaryOpens"`
-		LbrBinaryCloses         int64   `json:"lbrBinaryCloses"`
-		LbrBinaryCheckins       int64   `json:"lbrBinaryCheckins"`
-		LbrBinaryExists         int64   `json:"lbrBinaryExists"`
-		LbrBinaryReads          int64   `json:"lbrBinaryReads"`
-		LbrBinaryReadBytes      int64   `json:"lbrBinaryReadBytes"`
-		LbrBinaryWrites         int64   `json:"lbrBinaryWrites"`
-		LbrBinaryWriteBytes     int64   `json:"lbrBinaryWriteBytes"`
-		LbrBinaryDigests        int64   `json:"lbrBinaryDigests"`
-		LbrBinaryFileSizes      int64   `json:"lbrBinaryFileSizes"`
-		LbrBinaryModTimes       int64   `json:"lbrBinaryModTimes"`
-		LbrBinaryCopies         int64   `json:"lbrBinaryCopies"`
-		LbrCompressOpens        int64   `json:"lbrCompressOpens"`
-		LbrCompressCloses       int64   `json:"lbrCompressCloses"`
-		LbrCompressCheckins     int64   `json:"lbrCompressCheckins"`
-		LbrCompressExists       int64   `json:"lbrCompressExists"`
-		LbrCompressReads        int64   `json:"lbrCompressReads"`
-		LbrCompressReadBytes    int64   `json:"lbrCompressReadBytes"`
-		LbrCompressWrites       int64   `json:"lbrCompressWrites"`
-		LbrCompressWriteBytes   int64   `json:"lbrCompressWriteBytes"`
-		LbrCompressDigests      int64   `json:"lbrCompressDigests"`
-		LbrCompressFileSizes    int64   `json:"lbrCompressFileSizes"`
-		LbrCompressModTimes     int64   `json:"lbrCompressModTimes"`
-		LbrCompressCopies       int64   `json:"lbrCompressCopies"`
-		LbrUncompressOpens      int64   `json:"lbrUncompressOpens"`
-		LbrUncompressCloses     int64   `json:"lbrUncompressCloses"`
-		LbrUncompressCheckins   int64   `json:"lbrUncompressCheckins"`
-		LbrUncompressExists     int64   `json:"lbrUncompressExists"`
-		LbrUncompressReads      int64   `json:"lbrUncompressReads"`
-		LbrUncompressReadBytes  int64   `json:"lbrUncompressReadBytes"`
-		LbrUncompressWrites     int64   `json:"lbrUncompressWrites"`
-		LbrUncompressWriteBytes int64   `json:"lbrUncompressWriteBytes"`
-		LbrUncompressDigests    int64   `json:"lbrUncompressDigests"`
-		LbrUncompressFileSizes  int64   `json:"lbrUncompressFileSizes"`
-		LbrUncompressModTimes   int64   `json:"lbrUncompressModTimes"`
-		LbrUncompressCopies     int64   `json:"lbrUncompressCopies"`
-		CmdError                bool    `json:"cmdError"`
-		Tables                  []Table `json:"tables"`
+		ProcessKey                string           `json:"processKey"`
+		Cmd                       string           `json:"cmd"`
+		Pid                       int64            `json:"pid"`
+		LineNo                    int64            `json:"lineNo"`
+		User                      string           `json:"user"`
+		Workspace                 string           `json:"workspace"`
+		ComputeLapse              float32          `json:"computeLapse"`
+		CompletedLapse            float32          `json:"completedLapse"`
+		Paused                    float32          `json:"paused"`
+		IP                        string           `json:"ip"`
+		PeerAddress               string           `json:"peerAddress,omitempty"`
+		TrustedAddress            string           `json:"trustedAddress,omitempty"`
+		App                       string           `json:"app"`
+		Args                      string           `json:"args"`
+		Description               string           `json:"description,omitempty"`
+		StartTime                 string           `json:"startTime"`
+		EndTime                   string           `json:"endTime"`
+		Running                   int64            `json:"running"`
+		RunningPeak               int64            `json:"runningPeak"`
+		UCpu                      int64            `json:"uCpu"`
+		SCpu                      int64            `json:"sCpu"`
+		DiskIn                    int64            `json:"diskIn"`
+		DiskOut                   int64            `json:"diskOut"`
+		IpcIn                     int64            `json:"ipcIn"`
+		IpcOut                    int64            `json:"ipcOut"`
+		MaxRss                    int64            `json:"maxRss"`
+		PageFaults                int64            `json:"pageFaults"`
+		MemMB                     int64            `json:"memMB"`
+		MemPeakMB                 int64            `json:"memPeakMB"`
+		RPCMsgsIn                 int64            `json:"rpcMsgsIn"`
+		RPCMsgsOut                int64            `json:"rpcMsgsOut"`
+		RPCSizeIn                 int64            `json:"rpcSizeIn"`
+		RPCSizeOut                int64            `json:"rpcSizeOut"`
+		RPCHimarkFwd              int64            `json:"rpcHimarkFwd"`
+		RPCHimarkRev              int64            `json:"rpcHimarkRev"`
+		RPCSnd                    float32          `json:"rpcSnd"`
+		RPCRcv                    float32          `json:"rpcRcv"`
+		RPCForwardHost            string           `json:"rpcForwardHost,omitempty"`
+		RPCForwardMsgsIn          int64            `json:"rpcForwardMsgsIn,omitempty"`
+		RPCForwardMsgsOut         int64            `json:"rpcForwardMsgsOut,omitempty"`
+		RPCForwardSizeIn          int64            `json:"rpcForwardSizeIn,omitempty"`
+		RPCForwardSizeOut         int64            `json:"rpcForwardSizeOut,omitempty"`
+		FileTotalsSnd             int64            `json:"fileTotalsSnd"`       // Valid for syncs
+		FileTotalsRcv             int64            `json:"fileTotalsRcv"`       // Valid for syncs
+		FileTotalsSndMBytes       int64            `json:"fileTotalsSndMBytes"` // Valid for syncs
+		FileTotalsRcvMBytes       int64            `json:"fileTotalsRcvMBytes"` // Valid for syncs
+		FileTotalsClientSnd       int64            `json:"fileTotalsClientSnd,omitempty"`
+		FileTotalsClientRcv       int64            `json:"fileTotalsClientRcv,omitempty"`
+		FileTotalsClientSndMBytes int64            `json:"fileTotalsClientSndMBytes,omitempty"`
+		FileTotalsClientRcvMBytes int64            `json:"fileTotalsClientRcvMBytes,omitempty"`
+		NetFilesAdded             int64            `json:"netFilesAdded"` // Valid for syncs and network estimates records
+		NetFilesUpdated           int64            `json:"netFilesUpdated"`
+		NetFilesDeleted           int64            `json:"netFilesDeleted"`
+		NetBytesAdded             int64            `json:"netBytesAdded"`
+		NetBytesUpdated           int64            `json:"netBytesUpdated"`
+		LbrRcsOpens               int64            `json:"lbrRcsOpens"` // Required for processing lbr records
+		LbrRcsCloses              int64            `json:"lbrRcsCloses"`
+		LbrRcsCheckins            int64            `json:"lbrRcsCheckins"`
+		LbrRcsExists              int64            `json:"lbrRcsExists"`
+		LbrRcsReads               int64            `json:"lbrRcsReads"`
+		LbrRcsReadBytes           int64            `json:"lbrRcsReadBytes"`
+		LbrRcsWrites              int64            `json:"lbrRcsWrites"`
+		LbrRcsWriteBytes          int64            `json:"lbrRcsWriteBytes"`
+		LbrRcsDigests             int64            `json:"lbrRcsDigests"`
+		LbrRcsFileSizes           int64            `json:"lbrRcsFileSizes"`
+		LbrRcsModTimes            int64            `json:"lbrRcsModTimes"`
+		LbrRcsCopies              int64            `json:"lbrRcsCopies"`
+		LbrBinaryOpens            int64            `json:"lbrBinaryOpens"`
+		LbrBinaryCloses           int64            `json:"lbrBinaryCloses"`
+		LbrBinaryCheckins         int64            `json:"lbrBinaryCheckins"`
+		LbrBinaryExists           int64            `json:"lbrBinaryExists"`
+		LbrBinaryReads            int64            `json:"lbrBinaryReads"`
+		LbrBinaryReadBytes        int64            `json:"lbrBinaryReadBytes"`
+		LbrBinaryWrites           int64            `json:"lbrBinaryWrites"`
+		LbrBinaryWriteBytes       int64            `json:"lbrBinaryWriteBytes"`
+		LbrBinaryDigests          int64            `json:"lbrBinaryDigests"`
+		LbrBinaryFileSizes        int64            `json:"lbrBinaryFileSizes"`
+		LbrBinaryModTimes         int64            `json:"lbrBinaryModTimes"`
+		LbrBinaryCopies           int64            `json:"lbrBinaryCopies"`
+		LbrCompressOpens          int64            `json:"lbrCompressOpens"`
+		LbrCompressCloses         int64            `json:"lbrCompressCloses"`
+		LbrCompressCheckins       int64            `json:"lbrCompressCheckins"`
+		LbrCompressExists         int64            `json:"lbrCompressExists"`
+		LbrCompressReads          int64            `json:"lbrCompressReads"`
+		LbrCompressReadBytes      int64            `json:"lbrCompressReadBytes"`
+		LbrCompressWrites         int64            `json:"lbrCompressWrites"`
+		LbrCompressWriteBytes     int64            `json:"lbrCompressWriteBytes"`
+		LbrCompressDigests        int64            `json:"lbrCompressDigests"`
+		LbrCompressFileSizes      int64            `json:"lbrCompressFileSizes"`
+		LbrCompressModTimes       int64            `json:"lbrCompressModTimes"`
+		LbrCompressCopies         int64            `json:"lbrCompressCopies"`
+		LbrUncompressOpens        int64            `json:"lbrUncompressOpens"`
+		LbrUncompressCloses       int64            `json:"lbrUncompressCloses"`
+		LbrUncompressCheckins     int64            `json:"lbrUncompressCheckins"`
+		LbrUncompressExists       int64            `json:"lbrUncompressExists"`
+		LbrUncompressReads        int64            `json:"lbrUncompressReads"`
+		LbrUncompressReadBytes    int64            `json:"lbrUncompressReadBytes"`
+		LbrUncompressWrites       int64            `json:"lbrUncompressWrites"`
+		LbrUncompressWriteBytes   int64            `json:"lbrUncompressWriteBytes"`
+		LbrUncompressDigests      int64            `json:"lbrUncompressDigests"`
+		LbrUncompressFileSizes    int64            `json:"lbrUncompressFileSizes"`
+		LbrUncompressModTimes     int64            `json:"lbrUncompressModTimes"`
+		LbrUncompressCopies       int64            `json:"lbrUncompressCopies"`
+		TotalReadWait             int64            `json:"totalReadWait,omitempty"`
+		TotalReadHeld             int64            `json:"totalReadHeld,omitempty"`
+		TotalWriteWait            int64            `json:"totalWriteWait,omitempty"`
+		TotalWriteHeld            int64            `json:"totalWriteHeld,omitempty"`
+		CmdError                  bool             `json:"cmdError"`
+		ErrorText                 string           `json:"errorText,omitempty"`
+		ErrorSeverity             string           `json:"errorSeverity,omitempty"`
+		ErrorCode                 int64            `json:"errorCode,omitempty"`
+		ErrorCount                int64            `json:"errorCount,omitempty"`
+		Errors                    []ErrorBlock     `json:"errors,omitempty"`
+		LimitExceeded             string           `json:"limitExceeded,omitempty"`
+		Killed                    bool             `json:"killed,omitempty"`
+		KillReason                string           `json:"killReason,omitempty"`
+		EndReason                 string           `json:"endReason,omitempty"`
+		LastSeenTime              string           `json:"lastSeenTime,omitempty"`
+		ServerID                  string           `json:"serverID,omitempty"`
+		SourceFile                string           `json:"sourceFile,omitempty"`
+		SourceLineNo              int64            `json:"sourceLineNo,omitempty"`
+		Tables                    []Table          `json:"tables"`
+		ComputeTables             []Table          `json:"computeTables,omitempty"`
+		SerializedLocks           []SerializedLock `json:"serializedLocks,omitempty"`
+
+		Extra map[string]string `json:"extra,omitempty"`
 	}{
-		ProcessKey:              c.GetKey(),
-		Cmd:                     c.Cmd,
-		Pid:                     c.Pid,
-		LineNo:                  c.LineNo,
-		User:                    c.User,
-		Workspace:               c.Workspace,
-		ComputeLapse:            c.ComputeLapse,
-		CompletedLapse:          c.CompletedLapse,
-		Paused:                  c.Paused,
-		IP:                      c.IP,
-		App:                     c.App,
-		Args:                    c.Args,
-		StartTime:               c.StartTime.Format(p4timeformat),
-		EndTime:                 c.EndTime.Format(p4timeformat),
-		Running:                 c.Running,
-		UCpu:                    c.UCpu,
-		SCpu:                    c.SCpu,
-		DiskIn:                  c.DiskIn,
-		DiskOut:                 c.DiskOut,
-		IpcIn:                   c.IpcIn,
-		IpcOut:                  c.IpcOut,
-		MaxRss:                  c.MaxRss,
-		PageFaults:              c.PageFaults,
-		MemMB:                   c.MemMB,
-		MemPeakMB:               c.MemPeakMB,
-		RPCMsgsIn:               c.RPCMsgsIn,
-		RPCMsgsOut:              c.RPCMsgsOut,
-		RPCSizeIn:               c.RPCSizeIn,
-		RPCSizeOut:              c.RPCSizeOut,
-		RPCHimarkFwd:            c.RPCHimarkFwd,
-		RPCHimarkRev:            c.RPCHimarkRev,
-		RPCSnd:                  c.RPCSnd,
-		RPCRcv:                  c.RPCRcv,
-		FileTotalsSnd:           c.FileTotalsSnd,
-		FileTotalsRcv:           c.FileTotalsRcv,
-		FileTotalsSndMBytes:     c.FileTotalsSndMBytes,
-		FileTotalsRcvMBytes:     c.FileTotalsRcvMBytes,
-		NetFilesAdded:           c.NetFilesAdded,
-		NetFilesUpdated:         c.NetFilesUpdated,
-		NetFilesDeleted:         c.NetFilesDeleted,
-		NetBytesAdded:           c.NetBytesAdded,
-		NetBytesUpdated:         c.NetBytesUpdated,
-		LbrRcsOpens:             c.LbrRcsOpens,
-		LbrRcsCloses:            c.LbrRcsCloses,
-		LbrRcsCheckins:          c.LbrRcsCheckins,
-		LbrRcsExists:            c.LbrRcsExists,
-		LbrRcsReads:             c.LbrRcsReads,
-		LbrRcsReadBytes:         c.LbrRcsReadBytes,
-		LbrRcsWrites:            c.LbrRcsWrites,
-		LbrRcsWriteBytes:        c.LbrRcsWriteBytes,
-		LbrRcsDigests:           c.LbrRcsDigests,
-		LbrRcsFileSizes:         c.LbrRcsFileSizes,
-		LbrRcsModTimes:          c.LbrRcsModTimes,
-		LbrRcsCopies:            c.LbrRcsCopies,
-		LbrBinaryOpens:          c.LbrBinaryOpens,
-		LbrBinaryCloses:         c.LbrBinaryCloses,
-		LbrBinaryCheckins:       c.LbrBinaryCheckins,
-		LbrBinaryExists:         c.LbrBinaryExists,
-		LbrBinaryReads:          c.LbrBinaryReads,
-		LbrBinaryReadBytes:      c.LbrBinaryReadBytes,
-		LbrBinaryWrites:         c.LbrBinaryWrites,
-		LbrBinaryWriteBytes:     c.LbrBinaryWriteBytes,
-		LbrBinaryDigests:        c.LbrBinaryDigests,
-		LbrBinaryModTimes:       c.LbrBinaryModTimes,
-		LbrBinaryFileSizes:      c.LbrBinaryFileSizes,
-		LbrBinaryCopies:         c.LbrBinaryCopies,
-		LbrCompressOpens:        c.LbrCompressOpens,
-		LbrCompressCloses:       c.LbrCompressCloses,
-		LbrCompressCheckins:     c.LbrCompressCheckins,
-		LbrCompressExists:       c.LbrCompressExists,
-		LbrCompressReads:        c.LbrCompressReads,
-		LbrCompressReadBytes:    c.LbrCompressReadBytes,
-		LbrCompressWrites:       c.LbrCompressWrites,
-		LbrCompressWriteBytes:   c.LbrCompressWriteBytes,
-		LbrCompressDigests:      c.LbrCompressDigests,
-		LbrCompressFileSizes:    c.LbrCompressFileSizes,
-		LbrCompressModTimes:     c.LbrCompressModTimes,
-		LbrCompressCopies:       c.LbrCompressCopies,
-		LbrUncompressOpens:      c.LbrUncompressOpens,
-		LbrUncompressCloses:     c.LbrUncompressCloses,
-		LbrUncompressCheckins:   c.LbrUncompressCheckins,
-		LbrUncompressExists:     c.LbrUncompressExists,
-		LbrUncompressReads:      c.LbrUncompressReads,
-		LbrUncompressReadBytes:  c.LbrUncompressReadBytes,
-		LbrUncompressWrites:     c.LbrUncompressWrites,
-		LbrUncompressWriteBytes: c.LbrUncompressWriteBytes,
-		LbrUncompressDigests:    c.LbrUncompressDigests,
-		LbrUncompressFileSizes:  c.LbrUncompressFileSizes,
-		LbrUncompressModTimes:   c.LbrUncompressModTimes,
-		LbrUncompressCopies:     c.LbrUncompressCopies,
-		CmdError:                c.CmdError,
-		Tables:                  tables,
+		ProcessKey:                c.GetKey(),
+		Cmd:                       c.Cmd,
+		Pid:                       c.Pid,
+		LineNo:                    c.LineNo,
+		User:                      c.User,
+		Workspace:                 c.Workspace,
+		ComputeLapse:              c.ComputeLapse,
+		CompletedLapse:            c.CompletedLapse,
+		Paused:                    c.Paused,
+		IP:                        c.IP,
+		PeerAddress:               c.PeerAddress,
+		TrustedAddress:            c.TrustedAddress,
+		App:                       c.App,
+		Args:                      c.Args,
+		Description:               c.Description,
+		StartTime:                 c.StartTime.Format(p4timeformat),
+		EndTime:                   c.EndTime.Format(p4timeformat),
+		Running:                   c.Running,
+		RunningPeak:               c.RunningPeak,
+		UCpu:                      c.UCpu,
+		SCpu:                      c.SCpu,
+		DiskIn:                    c.DiskIn,
+		DiskOut:                   c.DiskOut,
+		IpcIn:                     c.IpcIn,
+		IpcOut:                    c.IpcOut,
+		MaxRss:                    c.MaxRss,
+		PageFaults:                c.PageFaults,
+		MemMB:                     c.MemMB,
+		MemPeakMB:                 c.MemPeakMB,
+		RPCMsgsIn:                 c.RPCMsgsIn,
+		RPCMsgsOut:                c.RPCMsgsOut,
+		RPCSizeIn:                 c.RPCSizeIn,
+		RPCSizeOut:                c.RPCSizeOut,
+		RPCHimarkFwd:              c.RPCHimarkFwd,
+		RPCHimarkRev:              c.RPCHimarkRev,
+		RPCSnd:                    c.RPCSnd,
+		RPCRcv:                    c.RPCRcv,
+		RPCForwardHost:            c.RPCForwardHost,
+		RPCForwardMsgsIn:          c.RPCForwardMsgsIn,
+		RPCForwardMsgsOut:         c.RPCForwardMsgsOut,
+		RPCForwardSizeIn:          c.RPCForwardSizeIn,
+		RPCForwardSizeOut:         c.RPCForwardSizeOut,
+		FileTotalsSnd:             c.FileTotalsSnd,
+		FileTotalsRcv:             c.FileTotalsRcv,
+		FileTotalsSndMBytes:       c.FileTotalsSndMBytes,
+		FileTotalsRcvMBytes:       c.FileTotalsRcvMBytes,
+		FileTotalsClientSnd:       c.FileTotalsClientSnd,
+		FileTotalsClientRcv:       c.FileTotalsClientRcv,
+		FileTotalsClientSndMBytes: c.FileTotalsClientSndMBytes,
+		FileTotalsClientRcvMBytes: c.FileTotalsClientRcvMBytes,
+		NetFilesAdded:             c.NetFilesAdded,
+		NetFilesUpdated:           c.NetFilesUpdated,
+		NetFilesDeleted:           c.NetFilesDeleted,
+		NetBytesAdded:             c.NetBytesAdded,
+		NetBytesUpdated:           c.NetBytesUpdated,
+		LbrRcsOpens:               c.LbrRcsOpens,
+		LbrRcsCloses:              c.LbrRcsCloses,
+		LbrRcsCheckins:            c.LbrRcsCheckins,
+		LbrRcsExists:              c.LbrRcsExists,
+		LbrRcsReads:               c.LbrRcsReads,
+		LbrRcsReadBytes:           c.LbrRcsReadBytes,
+		LbrRcsWrites:              c.LbrRcsWrites,
+		LbrRcsWriteBytes:          c.LbrRcsWriteBytes,
+		LbrRcsDigests:             c.LbrRcsDigests,
+		LbrRcsFileSizes:           c.LbrRcsFileSizes,
+		LbrRcsModTimes:            c.LbrRcsModTimes,
+		LbrRcsCopies:              c.LbrRcsCopies,
+		LbrBinaryOpens:            c.LbrBinaryOpens,
+		LbrBinaryCloses:           c.LbrBinaryCloses,
+		LbrBinaryCheckins:         c.LbrBinaryCheckins,
+		LbrBinaryExists:           c.LbrBinaryExists,
+		LbrBinaryReads:            c.LbrBinaryReads,
+		LbrBinaryReadBytes:        c.LbrBinaryReadBytes,
+		LbrBinaryWrites:           c.LbrBinaryWrites,
+		LbrBinaryWriteBytes:       c.LbrBinaryWriteBytes,
+		LbrBinaryDigests:          c.LbrBinaryDigests,
+		LbrBinaryModTimes:         c.LbrBinaryModTimes,
+		LbrBinaryFileSizes:        c.LbrBinaryFileSizes,
+		LbrBinaryCopies:           c.LbrBinaryCopies,
+		LbrCompressOpens:          c.LbrCompressOpens,
+		LbrCompressCloses:         c.LbrCompressCloses,
+		LbrCompressCheckins:       c.LbrCompressCheckins,
+		LbrCompressExists:         c.LbrCompressExists,
+		LbrCompressReads:          c.LbrCompressReads,
+		LbrCompressReadBytes:      c.LbrCompressReadBytes,
+		LbrCompressWrites:         c.LbrCompressWrites,
+		LbrCompressWriteBytes:     c.LbrCompressWriteBytes,
+		LbrCompressDigests:        c.LbrCompressDigests,
+		LbrCompressFileSizes:      c.LbrCompressFileSizes,
+		LbrCompressModTimes:       c.LbrCompressModTimes,
+		LbrCompressCopies:         c.LbrCompressCopies,
+		LbrUncompressOpens:        c.LbrUncompressOpens,
+		LbrUncompressCloses:       c.LbrUncompressCloses,
+		LbrUncompressCheckins:     c.LbrUncompressCheckins,
+		LbrUncompressExists:       c.LbrUncompressExists,
+		LbrUncompressReads:        c.LbrUncompressReads,
+		LbrUncompressReadBytes:    c.LbrUncompressReadBytes,
+		LbrUncompressWrites:       c.LbrUncompressWrites,
+		LbrUncompressWriteBytes:   c.LbrUncompressWriteBytes,
+		LbrUncompressDigests:      c.LbrUncompressDigests,
+		LbrUncompressFileSizes:    c.LbrUncompressFileSizes,
+		LbrUncompressModTimes:     c.LbrUncompressModTimes,
+		LbrUncompressCopies:       c.LbrUncompressCopies,
+		TotalReadWait:             c.TotalReadWait,
+		TotalReadHeld:             c.TotalReadHeld,
+		TotalWriteWait:            c.TotalWriteWait,
+		TotalWriteHeld:            c.TotalWriteHeld,
+		CmdError:                  c.CmdError,
+		ErrorText:                 c.ErrorText,
+		ErrorSeverity:             c.ErrorSeverity,
+		ErrorCode:                 c.ErrorCode,
+		ErrorCount:                c.ErrorCount,
+		Errors:                    c.Errors,
+		LimitExceeded:             c.LimitExceeded,
+		Killed:                    c.Killed,
+		KillReason:                c.KillReason,
+		EndReason:                 c.EndReason,
+		LastSeenTime:              lastSeenTime,
+		ServerID:                  c.ServerID,
+		SourceFile:                c.SourceFile,
+		SourceLineNo:              c.SourceLineNo,
+		Tables:                    tables,
+		ComputeTables:             computeTables,
+		SerializedLocks:           locks,
+		Extra:                     c.Extra,
 	})
 }
 
 var blankTime time.Time
 
+// Values for Command.EndReason
+const (
+	EndReasonLogTruncated = "log_truncated" // Log ended before command completed
+	EndReasonEvicted      = "evicted"       // Evicted from pending commands before completion - see pending.go
+	// Thread removed from the monitor table before the command completed - see outputMonitorRemoved
+	EndReasonMonitorRemoved = "monitor_removed"
+)
+
+// Values for Command.ErrorSeverity - in increasing order of severity
+const (
+	ErrorSeverityInfo  = "info"  // e.g. file already opened by another user
+	ErrorSeverityWarn  = "warn"  // e.g. no such file(s), file(s) up-to-date
+	ErrorSeverityError = "error" // Default for other errors
+	ErrorSeverityFatal = "fatal" // Command terminated, e.g. exited on fatal server error
+)
+
+// Values for Command.LimitExceeded - named as the group spec fields/configurables setting them
+const (
+	LimitMaxResults   = "MaxResults"   // Request too large
+	LimitMaxScanRows  = "MaxScanRows"  // Too many rows scanned
+	LimitMaxLockTime  = "MaxLockTime"  // Operation took too long
+	LimitMaxMemory    = "MaxMemory"    // Command used too much memory
+	LimitMaxOpenFiles = "MaxOpenFiles" // Opening too many files
+)
+
+// Values for Command.KillReason, other than the LimitExceeded values
+const (
+	KillReasonTerminated = "terminated" // p4 monitor terminate
+	KillReasonPaused     = "paused"     // Too many commands paused due to resource pressure
+)
+
+var errorSeverityLevels = map[string]int{
+	ErrorSeverityInfo:  1,
+	ErrorSeverityWarn:  2,
+	ErrorSeverityError: 3,
+	ErrorSeverityFatal: 4,
+}
+
+// setError records an error for the command, keeping the most severe level seen
+func (c *Command) setError(severity string) {
+	c.CmdError = true
+	if errorSeverityLevels[severity] > errorSeverityLevels[c.ErrorSeverity] {
+		c.ErrorSeverity = severity
+	}
+}
+
+// Max error blocks recorded individually per command (e.g. for a sync with one error per file), beyond which they are
+// only counted (in ErrorCount) and in ErrorText
+const maxErrorBlocks = 1000
+
+// addErrorBlocks appends blocks to the command's Errors, up to maxErrorBlocks
+func (c *Command) addErrorBlocks(blocks ...ErrorBlock) {
+	room := maxErrorBlocks - len(c.Errors)
+	if room <= 0 {
+		return
+	}
+	if len(blocks) > room {
+		blocks = blocks[:room]
+	}
+	c.Errors = append(c.Errors, blocks...)
+}
+
+// addError records the text of an error block for the command
+func (c *Command) addError(lineNo int64, text string) {
+	c.ErrorCount++
+	c.addErrorBlocks(ErrorBlock{LineNo: lineNo, Text: text})
+	if text != "" {
+		if c.ErrorText != "" {
+			c.ErrorText += "\n"
+		}
+		c.ErrorText += text
+	}
+}
+
 func (c *Command) updateFrom(other *Command) {
 	// The first two fields are unusual but occur when we get a completed record with no start record
 	// and then get a record with track info.
@@ -839,9 +1287,18 @@ func (c *Command) updateFrom(other *Command) {
 	if c.Args == "" {
 		c.Args = other.Args
 	}
+	if c.Description == "" {
+		c.Description = other.Description
+	}
 	if c.IP == "" {
 		c.IP = other.IP
 	}
+	if c.PeerAddress == "" {
+		c.PeerAddress = other.PeerAddress
+	}
+	if c.TrustedAddress == "" {
+		c.TrustedAddress = other.TrustedAddress
+	}
 	if c.App == "" {
 		c.App = other.App
 	}
@@ -918,6 +1375,13 @@ func (c *Command) updateFrom(other *Command) {
 	if other.RPCRcv > 0 {
 		c.RPCRcv = other.RPCRcv
 	}
+	if other.RPCForwardHost != "" {
+		c.RPCForwardHost = other.RPCForwardHost
+		c.RPCForwardMsgsIn = other.RPCForwardMsgsIn
+		c.RPCForwardMsgsOut = other.RPCForwardMsgsOut
+		c.RPCForwardSizeIn = other.RPCForwardSizeIn
+		c.RPCForwardSizeOut = other.RPCForwardSizeOut
+	}
 	if other.FileTotalsSnd > 0 {
 		c.FileTotalsSnd = other.FileTotalsSnd
 	}
@@ -930,6 +1394,18 @@ func (c *Command) updateFrom(other *Command) {
 	if other.FileTotalsRcvMBytes > 0 {
 		c.FileTotalsRcvMBytes = other.FileTotalsRcvMBytes
 	}
+	if other.FileTotalsClientSnd > 0 {
+		c.FileTotalsClientSnd = other.FileTotalsClientSnd
+	}
+	if other.FileTotalsClientRcv > 0 {
+		c.FileTotalsClientRcv = other.FileTotalsClientRcv
+	}
+	if other.FileTotalsClientSndMBytes > 0 {
+		c.FileTotalsClientSndMBytes = other.FileTotalsClientSndMBytes
+	}
+	if other.FileTotalsClientRcvMBytes > 0 {
+		c.FileTotalsClientRcvMBytes = other.FileTotalsClientRcvMBytes
+	}
 	if other.NetFilesAdded > 0 {
 		c.NetFilesAdded = other.NetFilesAdded
 	}
@@ -947,12 +1423,46 @@ func (c *Command) updateFrom(other *Command) {
 	}
 	if other.CmdError {
 		c.CmdError = other.CmdError
+		c.setError(other.ErrorSeverity)
+	}
+	if other.ErrorText != "" {
+		if c.ErrorText != "" {
+			c.ErrorText += "\n"
+		}
+		c.ErrorText += other.ErrorText
+	}
+	c.ErrorCount += other.ErrorCount
+	c.addErrorBlocks(other.Errors...)
+	if other.ErrorCode != 0 {
+		c.ErrorCode = other.ErrorCode
+	}
+	if other.LimitExceeded != "" {
+		c.LimitExceeded = other.LimitExceeded
+	}
+	if other.Killed {
+		c.Killed = true
+		c.KillReason = other.KillReason
+	}
+	for k, v := range other.Extra {
+		c.SetExtra(k, v)
 	}
 	if len(other.Tables) > 0 {
 		for k, t := range other.Tables {
 			c.Tables[k] = t
 		}
 	}
+	for k, t := range other.ComputeTables {
+		if c.ComputeTables == nil {
+			c.ComputeTables = make(map[string]*Table)
+		}
+		c.ComputeTables[k] = t
+	}
+	for k, l := range other.SerializedLocks {
+		if c.SerializedLocks == nil {
+			c.SerializedLocks = make(map[string]*SerializedLock)
+		}
+		c.SerializedLocks[k] = l
+	}
 	if other.LbrRcsOpens > 0 {
 		c.LbrRcsOpens = other.LbrRcsOpens
 	}
@@ -1123,6 +1633,8 @@ type P4dFileParser struct {
 	pidsSeenThisSecond   map[int64]bool
 	cmdsRunning          int64           // No of currently running threads
 	cmdsRunningMax       int64           // Max No of currently running threads
+	runningSeq           int64           // Sequence no of changes in cmdsRunning - see runningpeak.go
+	runningLevels        []runningLevel  // Counts of running commands not exceeded since
 	cmdsPaused           int64           // No of paused threads
 	cmdsPausedMax        int64           // Max no of paused threads
 	cmdsPausedErrorCount int64           // Count of commands paused due to resource pressure errors
@@ -1137,6 +1649,68 @@ type P4dFileParser struct {
 	outputCmdsContinued  int64
 	outputCmdsExited     int64
 	lastSyncPID          int64
+	features             map[string]bool // Explicitly set features - see features.go
+	noiseLinesCount      int64           // Count of non-p4d lines discarded - see resyncLine. Updated atomically.
+	argsPending          bool            // Lines goroutine: command args (e.g. a -d description) continue on following lines
+	lastSeenTime         time.Time       // Latest start/end time of any command seen in log
+	memoryLimit          uint64          // Heap size (bytes) above which table detail is dropped - see memlimit.go
+	memCheckInterval     int
+	blocksSinceMemCheck  int
+	heapAlloc            func() uint64
+	tableDetailDroppedAt int64         // Line no at which memory limit exceeded. Updated atomically.
+	locksOnlyTrackCount  int64         // Count of track records with table locks but no lapse/usage/rpc. Updated atomically.
+	keepPending          bool          // Retain pending commands at end of input - see checkpoint.go
+	keepPendingMax       int           // Bounds on the pending commands retained - see checkpoint.go
+	keepPendingTTL       time.Duration // ditto
+	resumeLineNo         int64         // Line no to start from when resuming from a checkpoint
+	descriptionLimit     int           // Max length of Description captured - 0 means not captured
+	keyMode              KeyMode
+	// Bounding of pending commands - see pending.go
+	maxPending   int
+	pendingTTL   time.Duration
+	lastTTLCheck time.Time
+	spillDir     string
+	spill        *spillFile
+	spillErr     error // First error writing spill file - evicted commands are then output
+	lineHooks    []LineHookSpec
+	evictedCount int64 // Updated atomically
+	// Statistics - see stats.go. Updated atomically.
+	linesRead            int64
+	cmdsOutput           int64
+	svrEventsOutput      int64
+	cmdsPending          int64
+	unrecognisedLines    int64
+	parseErrors          int64
+	unmatchedWriter      io.Writer // Unrecognised/noise lines written to this if set
+	unmatchedMu          sync.Mutex
+	unmatchedErr         error // First error writing unmatched lines - no more are written
+	duplicateOutputCount int64 // Count of commands output more than once with the same key. Updated atomically.
+	monitorRemovedCount  int64 // Count of threads removed from the monitor table. Updated atomically.
+	// Keys of recently output commands (to start time) - see dedup.go
+	outputKeys       map[outputKey]int64
+	outputKeysPruned time.Time
+	// Requests for snapshots of running commands - see running.go
+	runningReq chan chan []Command
+	parseDone  chan struct{}  // Closed when processing of blocks finishes
+	timeTick   chan time.Time // Time advanced - completed commands are output if no blocks are being processed
+	readErr    error          // Error reading the log - see ParseReader
+	// Detection of log time going backwards, and re-ordering of output - see timewarp.go
+	timewarpThreshold time.Duration
+	timewarpLatest    time.Time
+	timewarpCount     int64 // Updated atomically
+	reorderSize       int
+	reorder           reorderBuffer
+	// From network address lines, for the next command started - see netaddress.go
+	peerAddress        string
+	trustedAddress     string
+	computePhaseTables bool // Compute phase table usage recorded separately - see phasetables.go
+	lockTotals         bool // Command lock totals set - see locktotals.go
+	// Interleaved logs from several servers - see serverprefix.go
+	serverPrefix      *regexp.Regexp
+	serverPrefixGroup int
+	lineServer        string           // Of the latest line read
+	currServer        string           // Of the block being processed
+	serverIndexes     map[string]int64 // For keys of pending commands
 }
 
 // NewP4dFileParser - create and initialise properly
@@ -1145,25 +1719,47 @@ func NewP4dFileParser(logger *logrus.Logger) *P4dFileParser {
 	fp.cmds = make(map[int64]*Command)
 	fp.pidsSeenThisSecond = make(map[int64]bool)
 	fp.runningPids = make(map[int64]int64)
+	fp.serverIndexes = make(map[string]int64)
 	fp.logger = logger
 	fp.outputDuration = time.Second * 1
 	fp.debugDuration = time.Second * 30
 	fp.cmdsMaxResetDuration = time.Second * 10
+	fp.keepPendingMax = DefaultKeepPendingMax
+	fp.keepPendingTTL = DefaultKeepPendingTTL
+	fp.memCheckInterval = memCheckInterval
+	fp.heapAlloc = readHeapAlloc
+	fp.runningReq = make(chan chan []Command)
+	fp.parseDone = make(chan struct{})
+	fp.timeTick = make(chan time.Time, 1)
 	return &fp
 }
 
 // SetDebugMode - turn on debugging - very verbose!
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithDebugMode.
 func (fp *P4dFileParser) SetDebugMode(level int) {
 	fp.debug = level
 }
 
 // SetDebugPID - turn on debugging for a PID
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithDebugPID.
 func (fp *P4dFileParser) SetDebugPID(pid int64, cmdName string) {
 	fp.debugPID = pid
 	fp.debugCmd = cmdName
 }
 
+// SetDescriptionLimit - capture the full (possibly multi-line) -d description of commands such as submit
+// into Description, truncated to limit bytes. 0 (the default) means not captured.
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithDescriptionLimit.
+func (fp *P4dFileParser) SetDescriptionLimit(limit int) {
+	fp.descriptionLimit = limit
+}
+
 // SetNoCompletionRecords - don't expect completion records
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithNoCompletionRecords.
 func (fp *P4dFileParser) SetNoCompletionRecords() {
 	fp.noCompletionRecords = true
 }
@@ -1173,6 +1769,8 @@ func (fp *P4dFileParser) debugLog(cmd *Command) bool {
 }
 
 // SetDurations - for debugging
+//
+// Deprecated: not safe once parsing has started - use NewParser with WithDurations.
 func (fp *P4dFileParser) SetDurations(outputDuration, debugDuration time.Duration) {
 	fp.outputDuration = outputDuration
 	fp.debugDuration = debugDuration
@@ -1185,11 +1783,13 @@ func (fp *P4dFileParser) trackRunning(msg string, cmd *Command, delta int) {
 			recorded = true
 			fp.cmdsRunning++
 			cmd.Running = fp.cmdsRunning
+			cmd.runningSeq = fp.noteRunning()
 			cmd.countedInRunning = true
 		}
 	} else {
 		if cmd.countedInRunning {
 			recorded = true
+			cmd.RunningPeak = fp.runningPeak(cmd)
 			fp.cmdsRunning--
 			cmd.countedInRunning = false
 		}
@@ -1199,8 +1799,8 @@ func (fp *P4dFileParser) trackRunning(msg string, cmd *Command, delta int) {
 	}
 	// In debug mode we record and output tracks
 	if delta > 0 && recorded {
-		if line, ok := fp.runningPids[cmd.Pid]; !ok {
-			fp.runningPids[cmd.Pid] = cmd.LineNo
+		if line, ok := fp.runningPids[fp.cmdKey(cmd)]; !ok {
+			fp.runningPids[fp.cmdKey(cmd)] = cmd.LineNo
 		} else {
 			if FlagSet(fp.debug, DebugTrackRunning) {
 				fp.logger.Debugf("running-warn: unexpected cmd found line1 %d delta %d %s cmd %s pid %d line %d",
@@ -1208,8 +1808,8 @@ func (fp *P4dFileParser) trackRunning(msg string, cmd *Command, delta int) {
 			}
 		}
 	} else if delta < 0 && recorded {
-		if _, ok := fp.runningPids[cmd.Pid]; ok {
-			delete(fp.runningPids, cmd.Pid)
+		if _, ok := fp.runningPids[fp.cmdKey(cmd)]; ok {
+			delete(fp.runningPids, fp.cmdKey(cmd))
 		} else {
 			if FlagSet(fp.debug, DebugTrackRunning) {
 				fp.logger.Debugf("running-warn: unexpected cmd not found delta %d %s cmd %s pid %d line %d",
@@ -1231,11 +1831,16 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 		fp.currTime = newCmd.StartTime
 	}
 	newCmd.Running = fp.cmdsRunning
+	fp.checkTimewarp(newCmd.StartTime, newCmd.LineNo)
+	fp.updateLastSeenTime(newCmd.StartTime)
 	if fp.currStartTime != newCmd.StartTime && newCmd.StartTime.After(fp.currStartTime) {
 		fp.currStartTime = newCmd.StartTime
 		fp.pidsSeenThisSecond = make(map[int64]bool)
 	}
-	if cmd, ok := fp.cmds[newCmd.Pid]; ok {
+	newCmd.lastActive = fp.currTime
+	key := fp.cmdKey(newCmd)
+	if cmd, ok := fp.cmds[key]; ok {
+		cmd.lastActive = fp.currTime
 		if debugLog {
 			fp.logger.Infof("addCommand found: pid %d lineNo %d cmd %s dup %v", cmd.Pid, cmd.LineNo, cmd.Cmd, cmd.duplicateKey)
 		}
@@ -1243,8 +1848,12 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 			if debugLog {
 				fp.logger.Infof("addCommand outputting old since process key different")
 			}
+			// The client sends its stats after the command completes, so attribute them if it is still pending
+			if newCmd.Cmd == "client-Stats" && cmd.Cmd != "client-Stats" {
+				cmd.attachClientStats(newCmd)
+			}
 			fp.outputCmd(cmd)
-			fp.cmds[newCmd.Pid] = newCmd // Replace previous cmd with same PID
+			fp.cmds[key] = newCmd // Replace previous cmd with same PID
 			if !cmdHasNoCompletionRecord(newCmd.Cmd) {
 				fp.trackRunning("t01", newCmd, 1)
 			}
@@ -1255,7 +1864,7 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 			} else {
 				fp.outputCmd(cmd)
 				newCmd.duplicateKey = true
-				fp.cmds[newCmd.Pid] = newCmd // Replace previous cmd with same PID
+				fp.cmds[key] = newCmd // Replace previous cmd with same PID
 			}
 		} else {
 			// Typically track info only present when command has completed - especially for duplicates
@@ -1272,7 +1881,7 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 					fp.outputCmd(cmd)
 					fp.trackRunning("t02", newCmd, 1)
 					newCmd.duplicateKey = true
-					fp.cmds[newCmd.Pid] = newCmd // Replace previous cmd with same PID
+					fp.cmds[key] = newCmd // Replace previous cmd with same PID
 				}
 			} else {
 				if debugLog {
@@ -1291,15 +1900,16 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 		if debugLog {
 			fp.logger.Infof("addCommand remembering newCmd")
 		}
-		fp.cmds[newCmd.Pid] = newCmd
-		if _, ok := fp.pidsSeenThisSecond[newCmd.Pid]; ok {
+		fp.cmds[key] = newCmd
+		if _, ok := fp.pidsSeenThisSecond[key]; ok {
 			newCmd.duplicateKey = true
 		}
-		fp.pidsSeenThisSecond[newCmd.Pid] = true
+		fp.pidsSeenThisSecond[key] = true
 		if !cmdHasNoCompletionRecord(newCmd.Cmd) && !newCmd.completed {
 			fp.trackRunning("t03", newCmd, 1)
 		}
 	}
+	fp.evictPendingCommands()
 	fp.outputCompletedCommands()
 }
 
@@ -1334,6 +1944,7 @@ var reCmdTrigger = regexp.MustCompile(` trigger ([^ ]+)$`)
 var reTriggerLapse = regexp.MustCompile(`^lapse (\d+\.\d+)s|^lapse (\.\d+)s|^lapse (\d+)s`)
 var prefixTrackCmdMem = "--- memory cmd/proc "
 var prefixTrackRPC = "--- rpc msgs/size in+out "
+var prefixTrackRPCForward = "--- rpc ("
 var prefixTrackFileTotals = "--- filetotals (svr) send/recv files+bytes "
 var prefixTrackFileTotalsClient = "--- filetotals (client) send/recv files+bytes "
 var prefixTrackLbr = "---   opens+closes"
@@ -1345,6 +1956,7 @@ var reTrackLbrDigestFilesize = regexp.MustCompile(`^---   digests\+filesizes\+mo
 var reTrackCmdMem = regexp.MustCompile(`^--- memory cmd/proc (\d+)mb\/(\d+)mb`)
 var reTrackRPC = regexp.MustCompile(`^--- rpc msgs/size in\+out (\d+)\+(\d+)/(\d+)mb\+(\d+)mb himarks (\d+)/(\d+)`)
 var reTrackRPC2 = regexp.MustCompile(`^--- rpc msgs/size in\+out (\d+)\+(\d+)/(\d+)mb\+(\d+)mb himarks (\d+)/(\d+) snd/rcv ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s/([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s`)
+var reTrackRPCForward = regexp.MustCompile(`^--- rpc \(([^)]+)\) msgs/size in\+out (\d+)\+(\d+)/(\d+)mb\+(\d+)mb`)
 var reTrackFileTotals = regexp.MustCompile(`^--- filetotals \(svr\) send/recv files\+bytes (\d+)\+(\d+)mb/(\d+)\+(\d+)mb`)
 var reTrackFileTotalsClient = regexp.MustCompile(`^--- filetotals \(client\) send/recv files\+bytes (\d+)\+(\d+)mb/(\d+)\+(\d+)mb`)
 var prefixTrackUsage = "--- usage"
@@ -1375,9 +1987,12 @@ func getTable(cmd *Command, tableName string) *Table {
 }
 
 func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
+	computePhase := fp.isComputePhaseTrack(cmd)
 	hasTrackInfo := false
+	hasUsage := false // Lapse/usage/rpc lines - not present if server only tracks locks (e.g. track=0 with vtrack)
 	var tableName string
 	var lbrAction string
+	var lock *SerializedLock // Set while processing storage serialization lock records
 	for _, line := range lines {
 		if strings.HasPrefix(line, trackLapse) {
 			val := line[len(trackLapse):]
@@ -1387,6 +2002,7 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 				cmd.CompletedLapse = float32(f)
 			}
 			hasTrackInfo = true
+			hasUsage = true
 			continue
 		}
 		if strings.HasPrefix(line, trackPaused) {
@@ -1403,12 +2019,13 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 			continue
 		}
 		if strings.HasPrefix(line, trackFatalError) {
-			cmd.CmdError = true
+			cmd.setError(ErrorSeverityFatal)
 			hasTrackInfo = true
 			fp.cmdsPausedErrorCount += 1
 			continue
 		}
 		if strings.HasPrefix(line, trackDB) {
+			lock = nil
 			tableName = string(line[len(trackDB):])
 			t := newTable(tableName)
 			cmd.Tables[tableName] = t
@@ -1416,43 +2033,38 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 			continue
 		}
 		if strings.HasPrefix(line, trackRdbLbr) {
-			tableName = "rdb.lbr"
+			lock = nil
+			tableName = rdbLbrTable
 			t := newTable(tableName)
 			cmd.Tables[tableName] = t
 			hasTrackInfo = true
 			continue
 		}
 		if strings.HasPrefix(line, trackStorage) {
-			ext := ""
-			val := line[len(trackStorage):]
-			j := strings.Index(val, "(R)")
-			if j > 0 {
-				tableName = val[:j]
-				ext = "_R"
-			} else {
-				k := strings.Index(val, "(W)")
-				if k > 0 {
-					tableName = val[:k]
-					ext = "_W"
-				} else {
-					tableName = val
-				}
+			tableName = ""
+			lock = newSerializedLock(line[len(trackStorage):])
+			if cmd.SerializedLocks == nil {
+				cmd.SerializedLocks = make(map[string]*SerializedLock)
 			}
-			tableName = fmt.Sprintf("%s%s", tableName, ext)
-			t := newTable(tableName)
-			cmd.Tables[tableName] = t
+			cmd.SerializedLocks[lock.LegacyTableName()] = lock
 			// Normally if we find track info we note it but this is a sppecial case since storageup
 			// often output before end of command. If we note track info then we may not process end
 			// record properly with the rest of the track info.
 			hasTrackInfo = false
 			continue
 		}
+		if computePhase && strings.HasPrefix(line, trackMeta) {
+			lock = nil
+			tableName = metaTableName(line)
+			continue
+		}
 		if strings.HasPrefix(line, trackMeta) ||
 			strings.HasPrefix(line, trackChange) ||
 			strings.HasPrefix(line, trackClients) ||
 			strings.HasPrefix(line, trackClientEntity) ||
 			strings.HasPrefix(line, trackReplicaPull) {
 			// Special tables don't have trackInfo set
+			lock = nil
 			tableName = ""
 			continue
 		}
@@ -1464,6 +2076,7 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 			m = reTrackUsage.FindStringSubmatch(line)
 			if len(m) > 0 {
 				cmd.setUsage(m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[8])
+				hasUsage = true
 				continue
 			}
 		}
@@ -1478,11 +2091,21 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 			m = reTrackRPC2.FindStringSubmatch(line)
 			if len(m) > 0 {
 				cmd.setRPC(m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[8])
+				hasUsage = true
 				continue
 			}
 			m = reTrackRPC.FindStringSubmatch(line)
 			if len(m) > 0 {
 				cmd.setRPC(m[1], m[2], m[3], m[4], m[5], m[6], "", "")
+				hasUsage = true
+				continue
+			}
+		}
+		if strings.HasPrefix(line, prefixTrackRPCForward) {
+			m = reTrackRPCForward.FindStringSubmatch(line)
+			if len(m) > 0 {
+				cmd.setRPCForward(m[1], m[2], m[3], m[4], m[5])
+				hasUsage = true
 				continue
 			}
 		}
@@ -1497,7 +2120,7 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 		if strings.HasPrefix(line, prefixTrackFileTotalsClient) {
 			m = reTrackFileTotalsClient.FindStringSubmatch(line)
 			if len(m) > 0 {
-				cmd.setFileTotals(m[1], m[2], m[3], m[4])
+				cmd.setFileTotalsClient(m[1], m[2], m[3], m[4])
 				hasTrackInfo = true
 				continue
 			}
@@ -1616,6 +2239,21 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 			}
 		}
 
+		if lock != nil {
+			if len(line) > 4 && strings.HasPrefix(line, "--- ") && line[5] != ' ' {
+				lock = nil // Some other (unknown) table
+			} else if strings.HasPrefix(line, prefixTrackTotalLock) {
+				if m = reTrackTotalLock.FindStringSubmatch(line); len(m) > 0 {
+					lock.setTotalLock(m[1], m[2], m[3], m[4])
+				}
+				continue
+			} else if strings.HasPrefix(line, prefixTrackMaxLock) || strings.HasPrefix(line, prefixTrackMaxLock2) {
+				if m = reTrackMaxLock.FindStringSubmatch(line); len(m) > 0 {
+					lock.setMaxLock(m[1], m[2], m[3], m[4])
+				}
+				continue
+			}
+		}
 		// One of the special tables - discard track records
 		if len(tableName) == 0 {
 			continue
@@ -1691,7 +2329,18 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 		}
 
 	}
+	if computePhase {
+		// Not the final track output, which is then processed as normal
+		cmd.setComputeTables()
+		hasTrackInfo = false
+	}
 	cmd.hasTrackInfo = hasTrackInfo
+	if hasTrackInfo && !hasUsage && len(cmd.Tables) > 0 {
+		fp.noteLocksOnlyTrack(cmd)
+	}
+	if fp.tableDetailDropped() {
+		dropTableDetail(cmd)
+	}
 	fp.addCommand(cmd, hasTrackInfo)
 }
 
@@ -1720,10 +2369,19 @@ func parseBytesString(value string) int64 {
 // Output a single command to appropriate channel
 func (fp *P4dFileParser) outputCmd(cmd *Command) {
 	fp.trackRunning("t04", cmd, -1)
+	if cmd.RunningPeak < cmd.Running {
+		cmd.RunningPeak = cmd.Running // Not counted in running, e.g. no completion record expected
+	}
 	if fp.debugLog(cmd) {
 		fp.logger.Infof("outputting: pid %d lineNo %d cmd %s dup %v", cmd.Pid, cmd.LineNo, cmd.Cmd, cmd.duplicateKey)
 	}
 	cmd.updateStartEndTimes() // Required in some cases with partiall records
+	if fp.FeatureEnabled(FeatureDSTCorrection) {
+		cmd.correctEndTime()
+	}
+	if fp.lockTotals {
+		cmd.setLockTotals()
+	}
 	// Ensure entire structure is copied, particularly map member to avoid concurrency issues
 	cmdcopy := *cmd
 	if cmdHasNoCompletionRecord(cmd.Cmd) {
@@ -1735,16 +2393,67 @@ func (fp *P4dFileParser) outputCmd(cmd *Command) {
 		cmdcopy.Tables[k] = v
 		i++
 	}
+	if cmd.ComputeTables != nil {
+		cmdcopy.ComputeTables = make(map[string]*Table, len(cmd.ComputeTables))
+		for k, v := range cmd.ComputeTables {
+			cmdcopy.ComputeTables[k] = v
+		}
+	}
+	cmdcopy.SerializedLocks = make(map[string]*SerializedLock, len(cmd.SerializedLocks))
+	for k, v := range cmd.SerializedLocks {
+		cmdcopy.SerializedLocks[k] = v
+	}
 	if fp.debugLog(&cmdcopy) {
 		fp.logger.Infof("outputting: computelapse %v completelapse %v endTime %s", cmdcopy.ComputeLapse,
 			cmdcopy.CompletedLapse, cmdcopy.EndTime)
 	}
-	fp.cmdChan <- cmdcopy
+	if fp.FeatureEnabled(FeatureDuplicates) {
+		fp.noteOutput(&cmdcopy)
+	}
+	fp.sendCmd(cmdcopy)
 	fp.CmdsCount++
+	atomic.AddInt64(&fp.cmdsOutput, 1)
 }
 
 // Output a server event to appropriate channel
 func (fp *P4dFileParser) outputSvrEvent(timeStr string, lineNo int64) {
+	fp.cmdChan <- fp.newSvrEvent(timeStr, lineNo)
+	fp.ServerEventsCount++
+	atomic.AddInt64(&fp.svrEventsOutput, 1)
+}
+
+// Output a server event for a thread removed from the monitor table (e.g. 'IDLE' or 'Init()' exited unexpectedly).
+// The thread has gone, so a command with the same pid still running is completed (with EndReasonMonitorRemoved)
+// rather than left pending, but not otherwise updated (e.g. marked as failed) - the record says nothing about its
+// outcome (e.g. an idle connection which has gone away).
+func (fp *P4dFileParser) outputMonitorRemoved(m []string, lineNo int64) {
+	atomic.AddInt64(&fp.monitorRemovedCount, 1)
+	svrEvent := fp.newSvrEvent(m[1], lineNo)
+	svrEvent.RemovedPid = toInt64(m[2])
+	svrEvent.RemovedUser = m[3]
+	svrEvent.RemovedCmd = m[4]
+	if cmd, ok := fp.cmds[fp.pidKey(svrEvent.RemovedPid)]; ok && !cmd.completed {
+		cmd.completed = true
+		cmd.EndReason = EndReasonMonitorRemoved
+		if cmd.EndTime.IsZero() {
+			cmd.EndTime = svrEvent.EventTime
+		}
+		if !cmdHasNoCompletionRecord(cmd.Cmd) {
+			fp.trackRunning("t07", cmd, -1)
+		}
+	}
+	fp.cmdChan <- svrEvent
+	fp.ServerEventsCount++
+	atomic.AddInt64(&fp.svrEventsOutput, 1)
+}
+
+// MonitorRemovedCount - count of threads removed from the monitor table, see outputMonitorRemoved
+func (fp *P4dFileParser) MonitorRemovedCount() int64 {
+	return atomic.LoadInt64(&fp.monitorRemovedCount)
+}
+
+// newSvrEvent returns a server event with current thread/pressure values
+func (fp *P4dFileParser) newSvrEvent(timeStr string, lineNo int64) ServerEvent {
 	eventTime, _ := time.Parse(p4timeformat, timeStr)
 	// Record the values when we last output a server event - means we can update if things change.
 	if FlagSet(fp.debug, DebugTrackPaused) {
@@ -1775,8 +2484,7 @@ func (fp *P4dFileParser) outputSvrEvent(timeStr string, lineNo int64) {
 		CPUPressureState: fp.cpuPressureState,
 		MemPressureState: fp.memPressureState,
 	}
-	fp.cmdChan <- svrEvent
-	fp.ServerEventsCount++
+	return svrEvent
 }
 
 // Output pending commands on debug channel if set - for debug purposes
@@ -1813,6 +2521,21 @@ func (fp *P4dFileParser) debugOutputCommands() {
 	}
 }
 
+// tick notes that time has advanced to t, without blocking - replacing any earlier time not yet handled
+func (fp *P4dFileParser) tick(t time.Time) {
+	for {
+		select {
+		case fp.timeTick <- t:
+			return
+		default:
+			select {
+			case <-fp.timeTick:
+			default:
+			}
+		}
+	}
+}
+
 // Output all completed commands 3 or more seconds ago - we wait that time for possible delayed track info to come in
 func (fp *P4dFileParser) outputCompletedCommands() {
 	if fp.currTime.Sub(fp.timeLastCmdProcessed) < fp.outputDuration {
@@ -1865,7 +2588,7 @@ func (fp *P4dFileParser) outputCompletedCommands() {
 		if completed {
 			cmdHasBeenProcessed = true
 			cmdsToOutput = append(cmdsToOutput, cmd)
-			delete(fp.cmds, cmd.Pid)
+			delete(fp.cmds, fp.cmdKey(cmd))
 		}
 	}
 	// Sort by line no in log and output
@@ -1893,6 +2616,7 @@ func (fp *P4dFileParser) outputRemainingCommands() {
 		fp.outputCmd(cmd)
 	}
 	fp.cmds = make(map[int64]*Command)
+	fp.outputSpilledCommands()
 	if fp.logger != nil && fp.debug > 0 {
 		endCount := len(fp.cmds)
 		fp.logger.Debugf("outputRemainingCommands: start %d, end %d, count %d",
@@ -1900,8 +2624,28 @@ func (fp *P4dFileParser) outputRemainingCommands() {
 	}
 }
 
+// When the log ends abruptly (e.g. server crash) commands which have not completed are marked as such,
+// so that they can be distinguished from parser artifacts in post-crash analysis
+func (fp *P4dFileParser) markTruncatedCommands() {
+	if !fp.FeatureEnabled(FeatureLogTruncated) || fp.noCompletionRecords {
+		return
+	}
+	for _, cmd := range fp.cmds {
+		if !cmd.completed && !cmdHasNoCompletionRecord(cmd.Cmd) {
+			cmd.EndReason = EndReasonLogTruncated
+			cmd.LastSeenTime = fp.lastSeenTime
+		}
+	}
+}
+
+func (fp *P4dFileParser) updateLastSeenTime(t time.Time) {
+	if t.After(fp.lastSeenTime) {
+		fp.lastSeenTime = t
+	}
+}
+
 func (fp *P4dFileParser) updateComputeTime(pid int64, computeLapse string) {
-	if cmd, ok := fp.cmds[pid]; ok {
+	if cmd, ok := fp.cmds[fp.pidKey(pid)]; ok {
 		f, _ := strconv.ParseFloat(string(computeLapse), 32)
 		cmd.ComputeLapse = float32(f)
 		if cmd.Cmd == "user-sync" {
@@ -1911,10 +2655,17 @@ func (fp *P4dFileParser) updateComputeTime(pid int64, computeLapse string) {
 }
 
 func (fp *P4dFileParser) updateCompletionTime(pid int64, lineNo int64, endTime string, completedLapse string) {
-	if cmd, ok := fp.cmds[pid]; ok {
+	if t, err := time.Parse(p4timeformat, endTime); err != nil || t.IsZero() {
+		fp.parseError(lineNo, "invalid end time: "+endTime)
+	}
+	if cmd, ok := fp.pendingCmd(pid); ok {
 		cmd.setEndTime(endTime)
+		fp.updateLastSeenTime(cmd.EndTime)
 		f, _ := strconv.ParseFloat(string(completedLapse), 32)
 		cmd.CompletedLapse = float32(f)
+		if fp.FeatureEnabled(FeatureDSTCorrection) {
+			cmd.correctEndTime()
+		}
 		cmd.completed = true
 		fp.trackRunning("t05", cmd, -1)
 	} else {
@@ -1922,6 +2673,7 @@ func (fp *P4dFileParser) updateCompletionTime(pid int64, lineNo int64, endTime s
 		// We create a new command because there may be a track record along soon with more info
 		cmd = newCommand()
 		cmd.Pid = pid
+		cmd.ServerID = fp.currServer
 		cmd.LineNo = lineNo
 		cmd.setEndTime(endTime)
 		f, _ := strconv.ParseFloat(string(completedLapse), 32)
@@ -1932,18 +2684,42 @@ func (fp *P4dFileParser) updateCompletionTime(pid int64, lineNo int64, endTime s
 }
 
 func (fp *P4dFileParser) updateUsage(pid int64, uCPU, sCPU, diskIn, diskOut, ipcIn, ipcOut, maxRss, pageFaults string) {
-	if cmd, ok := fp.cmds[pid]; ok {
+	if cmd, ok := fp.cmds[fp.pidKey(pid)]; ok {
 		cmd.setUsage(uCPU, sCPU, diskIn, diskOut, ipcIn, ipcOut, maxRss, pageFaults)
 	}
 }
 
 func (fp *P4dFileParser) updateNetworkEstimates(pid int64, netFilesAdded, netFilesUpdated,
 	netFilesDeleted, netBytesAdded, netBytesUpdated string) {
-	if cmd, ok := fp.cmds[pid]; ok {
+	if cmd, ok := fp.cmds[fp.pidKey(pid)]; ok {
 		cmd.setNetworkEstimates(netFilesAdded, netFilesUpdated, netFilesDeleted, netBytesAdded, netBytesUpdated)
 	}
 }
 
+// Swarm installs triggers named swarm.<stage>, e.g. swarm.changesave, or swarm.enforce.1 where there are multiple
+// entries for a stage. Slow Swarm triggers are a recurring cause of slow submits.
+var swarmTriggerStages = map[string]bool{
+	"changesave": true, "commit": true, "demand": true, "enforce": true, "group": true, "groupdel": true,
+	"job": true, "shelve": true, "shelvedel": true, "strict": true, "user": true, "userdel": true,
+}
+
+// SwarmTriggerStage returns the Swarm workflow stage for a trigger name, "other" for unknown Swarm triggers,
+// or "" if not a Swarm trigger
+func SwarmTriggerStage(trigger string) string {
+	const swarmPrefix = "swarm."
+	if !strings.HasPrefix(strings.ToLower(trigger), swarmPrefix) {
+		return ""
+	}
+	stage := strings.ToLower(trigger[len(swarmPrefix):])
+	if i := strings.Index(stage, "."); i >= 0 {
+		stage = stage[:i]
+	}
+	if swarmTriggerStages[stage] {
+		return stage
+	}
+	return "other"
+}
+
 func (fp *P4dFileParser) processTriggerLapse(cmd *Command, trigger string, line string) {
 	// Expects a single line with a lapse statement on it
 	var triggerLapse float64
@@ -1957,14 +2733,48 @@ func (fp *P4dFileParser) processTriggerLapse(cmd *Command, trigger string, line
 			}
 		}
 	}
-	if triggerLapse > 0 {
+	if triggerLapse > 0 && !fp.tableDetailDropped() {
 		tableName := fmt.Sprintf("trigger_%s", trigger)
 		t := newTable(tableName)
 		t.TriggerLapse = float32(triggerLapse)
+		t.TriggerStage = SwarmTriggerStage(trigger)
 		cmd.Tables[tableName] = t
 	}
 }
 
+// Matches the -d flag of commands such as submit, populate and shelve which take a description
+var reDescFlag = regexp.MustCompile(`(?:^|\s)-d\s`)
+
+// getDescription returns the -d description from args, together with any continuation lines of a multi-line
+// description (up to the line with the closing quote of the command), truncated to limit bytes (including "...").
+// Note that a description containing a blank line is cut short there, as the blank line ends the log block.
+func getDescription(args string, lines []string, limit int) string {
+	loc := reDescFlag.FindStringIndex(args)
+	if loc == nil {
+		return ""
+	}
+	desc := args[loc[1]:]
+	for _, line := range lines {
+		if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, trackStart) {
+			break
+		}
+		if strings.HasSuffix(line, "'") {
+			desc += "\n" + strings.TrimSuffix(line, "'")
+			break
+		}
+		desc += "\n" + line
+	}
+	desc = strings.TrimRight(desc, "\n")
+	if len(desc) > limit {
+		n := limit - len("...")
+		if n < 0 {
+			n = 0
+		}
+		desc = strings.ToValidUTF8(desc[:n], "") + "..."
+	}
+	return desc
+}
+
 func (fp *P4dFileParser) processInfoBlock(block *Block) {
 
 	var cmd *Command
@@ -1978,6 +2788,7 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 		return
 	}
 
+	fastCmdScan := fp.FeatureEnabled(FeatureFastCmdScan)
 	i := 0
 	for _, line := range block.lines {
 		if cmd != nil && strings.HasPrefix(line, trackStart) {
@@ -1986,21 +2797,41 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 		}
 		i++
 
-		matched := false
-		m := reCmd.FindStringSubmatch(line)
-		if len(m) == 0 {
-			m = reCmdNoarg.FindStringSubmatch(line)
+		// Pseudo commands such as IDLE and Init() are server events, not commands
+		if strings.HasSuffix(line, monitorRemovedSuffix) {
+			if m := reMonitorRemoved.FindStringSubmatch(line); len(m) > 0 {
+				fp.outputMonitorRemoved(m, block.lineNo)
+				return
+			}
 		}
-		if len(m) == 0 {
-			// Note multiline descriptions will not be appended to the cmd.Args value - just the first line
-			m = reCmdMultiLineDesc.FindStringSubmatch(line)
+		matched := false
+		multiLineDesc := false
+		var m []string
+		scanned := false
+		if fastCmdScan {
+			m, multiLineDesc, scanned = scanCmdLine(line) // See fastcmd.go
+		}
+		if !scanned {
+			m = reCmd.FindStringSubmatch(line)
+			if len(m) == 0 {
+				m = reCmdNoarg.FindStringSubmatch(line)
+			}
+			if len(m) == 0 {
+				// Note multiline descriptions will not be appended to the cmd.Args value - just the first line
+				m = reCmdMultiLineDesc.FindStringSubmatch(line)
+				multiLineDesc = len(m) > 0
+			}
 		}
 		if len(m) > 0 {
 			matched = true
 			cmd = newCommand()
 			cmd.LineNo = block.lineNo
 			cmd.setStartTime(m[1])
+			if cmd.StartTime.IsZero() {
+				fp.parseError(block.lineNo, "invalid start time: "+m[1])
+			}
 			cmd.Pid = toInt64(m[2])
+			cmd.ServerID = fp.currServer
 			cmd.User = m[3]
 			cmd.Workspace = m[4]
 			cmd.IP = m[5]
@@ -2008,13 +2839,24 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 			cmd.Cmd = m[7]
 			// # following gsub required due to a 2009.2 P4V bug
 			// App = match.group(6).replace("\x00", "/")
+			args := ""
 			if len(m) > 8 {
+				args = m[8]
 				cmd.Args = string(m[8])
 				// Strip Swarm/Git Fusion commands with lots of json
-				sm := reJSONCmdargs.FindStringSubmatch(cmd.Args)
-				if len(sm) > 0 {
-					cmd.Args = string(sm[1])
+				if strings.HasSuffix(cmd.Args, "}") {
+					sm := reJSONCmdargs.FindStringSubmatch(cmd.Args)
+					if len(sm) > 0 {
+						cmd.Args = string(sm[1])
+					}
+				}
+			}
+			if fp.descriptionLimit > 0 {
+				var descLines []string
+				if multiLineDesc {
+					descLines = block.lines[i:]
 				}
+				cmd.Description = getDescription(cmd.Args, descLines, fp.descriptionLimit)
 			}
 			// Detect trigger entries
 			trigger := ""
@@ -2025,31 +2867,32 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 				}
 				line = line[:i+1] // Strip from the line
 			}
-			// Detect slightly strange IDLE, Init() commands
-			if i := strings.Index(line, "' exited unexpectedly, removed from monitor table."); i >= 0 {
-				if fcmd, ok := fp.cmds[cmd.Pid]; ok {
-					fcmd.CmdError = true
-					fcmd.completed = true
-					if fcmd.EndTime.IsZero() {
-						fcmd.EndTime = fcmd.StartTime
-					}
-					if !cmdHasNoCompletionRecord(fcmd.Cmd) {
-						fp.trackRunning("t06", fcmd, -1)
-					}
-				}
-				return
-			}
-			h := md5.Sum([]byte(line))
-			cmd.ProcessKey = hex.EncodeToString(h[:])
+			cmd.ProcessKey = fp.processKey(cmd, line, args)
+			fp.setNetAddresses(cmd)
 			if len(trigger) > 0 {
 				fp.processTriggerLapse(cmd, trigger, block.lines[len(block.lines)-1])
 			}
+			// Client totals are attributed to the previous command on the pid, which is output when this is added
+			if cmd.Cmd == "client-Stats" {
+				for _, l := range block.lines[i:] {
+					if m := reTrackFileTotalsClient.FindStringSubmatch(l); len(m) > 0 {
+						cmd.setFileTotalsClient(m[1], m[2], m[3], m[4])
+					}
+				}
+			}
 			fp.addCommand(cmd, false)
 		}
 		if !matched {
 			// process completed and computed
 			var pid int64
-			m := reCompleted.FindStringSubmatch(line)
+			var m []string
+			scanned := false
+			if fastCmdScan {
+				m, scanned = scanCompletedLine(line)
+			}
+			if !scanned {
+				m = reCompleted.FindStringSubmatch(line)
+			}
 			if len(m) > 0 {
 				matched = true
 				endTime := m[1]
@@ -2059,7 +2902,11 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 			}
 			// Note cmd completion also has usage data potentially
 			if matched {
-				m = reCmdUsage.FindStringSubmatch(line)
+				if scanned {
+					m = scanCmdUsage(line)
+				} else {
+					m = reCmdUsage.FindStringSubmatch(line)
+				}
 				if len(m) > 0 {
 					fp.updateUsage(pid, m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[8])
 				}
@@ -2074,36 +2921,119 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 				fp.updateComputeTime(pid, computeLapse)
 			}
 		}
-		if !matched && FlagSet(fp.debug, DebugUnrecognised) {
-			if !strings.HasPrefix(line, "server to client") {
-				buf := fmt.Sprintf("Unrecognised: %d %s\n", block.lineNo, line)
-				if fp.logger != nil {
-					fp.logger.Trace(buf)
-				} else {
-					fmt.Fprint(os.Stderr, buf)
-				}
-			}
+		if !matched && cmd == nil {
+			matched = fp.outputServerMessage(line, block.lineNo)
+		}
+		if !matched {
+			fp.unrecognisedLine(block.lineNo+int64(i), line)
+		}
+
+	}
+}
+
+// Severity of error text - fatal if the command was terminated, info/warn for common user errors
+var reErrorFatal = regexp.MustCompile(`(?i)\bfatal\b|terminated|exited unexpectedly`)
+var reErrorWarn = regexp.MustCompile(`(?i)no such file\(s\)|no file\(s\)|file\(s\) (up-to-date|not opened|not on client|not in client view)|no revision\(s\)`)
+var reErrorInfo = regexp.MustCompile(`(?i)also opened by|currently opened for|already opened for`)
+var reErrorCode = regexp.MustCompile(`(?i)\b(?:errno|error|code)[:= ]\s*(\d+)\b`)
+
+// Governor limit error messages, e.g. "Request too large (over 500000); see 'p4 help maxresults'."
+var governorLimits = []struct {
+	limit string
+	re    *regexp.Regexp
+}{
+	{LimitMaxResults, regexp.MustCompile(`(?i)request too large \(over|help maxresults`)},
+	{LimitMaxScanRows, regexp.MustCompile(`(?i)too many rows scanned \(over|help maxscanrows`)},
+	{LimitMaxLockTime, regexp.MustCompile(`(?i)operation took too long \(over|help maxlocktime`)},
+	{LimitMaxMemory, regexp.MustCompile(`(?i)help maxmemory|exceeded (its|the) (maximum )?memory limit`)},
+	{LimitMaxOpenFiles, regexp.MustCompile(`(?i)opening too many files \(over|help maxopenfiles`)},
+}
+
+// limitExceeded returns the governor limit reported by the text of a server error block, or "" if none
+func limitExceeded(text string) string {
+	for _, g := range governorLimits {
+		if g.re.MatchString(text) {
+			return g.limit
 		}
+	}
+	return ""
+}
+
+// Error messages of commands killed other than by governor limits
+var reKilledTerminate = regexp.MustCompile(`(?i)\bmonitor terminate\b`)
+var reKilledPaused = regexp.MustCompile(`(?i)too many commands paused`)
+
+// killReason returns why the command was killed as reported by the text of a server error block, or "" if it wasn't
+func killReason(text string) string {
+	if limit := limitExceeded(text); limit != "" {
+		return limit
+	}
+	switch {
+	case reKilledTerminate.MatchString(text):
+		return KillReasonTerminated
+	case reKilledPaused.MatchString(text):
+		return KillReasonPaused
+	}
+	return ""
+}
+
+// setKilled records any governor limit exceeded, and whether the command was killed, from server error text
+func (c *Command) setKilled(text string) {
+	if limit := limitExceeded(text); limit != "" {
+		c.LimitExceeded = limit
+	}
+	if reason := killReason(text); reason != "" {
+		c.Killed = true
+		c.KillReason = reason
+	}
+}
 
+// errorSeverity classifies the text of a server error block
+func errorSeverity(text string) string {
+	switch {
+	case reErrorFatal.MatchString(text):
+		return ErrorSeverityFatal
+	case reErrorWarn.MatchString(text):
+		return ErrorSeverityWarn
+	case reErrorInfo.MatchString(text):
+		return ErrorSeverityInfo
 	}
+	return ErrorSeverityError
 }
 
 func (fp *P4dFileParser) processErrorBlock(block *Block) {
 	var cmd *Command
-	for _, line := range block.lines {
-		m := rePid.FindStringSubmatch(line)
-		if len(m) > 0 {
-			pid := toInt64(m[1])
-			ok := false
-			if cmd, ok = fp.cmds[pid]; ok {
-				cmd.CmdError = true
-				cmd.completed = true
-				if !cmdHasNoCompletionRecord(cmd.Cmd) {
-					fp.trackRunning("t06", cmd, -1)
+	var msgs []string
+	for _, line := range block.lines[1:] {
+		if cmd == nil {
+			if m := rePid.FindStringSubmatch(line); len(m) > 0 {
+				var ok bool
+				if cmd, ok = fp.pendingCmd(toInt64(m[1])); !ok {
+					return
 				}
+				continue
 			}
-			return
 		}
+		if strings.HasPrefix(line, "\tDate ") || strings.HasPrefix(line, "\tOperation: ") {
+			continue
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			msgs = append(msgs, line)
+		}
+	}
+	if cmd == nil {
+		return
+	}
+	text := strings.Join(msgs, "\n")
+	cmd.setError(errorSeverity(text))
+	cmd.addError(block.lineNo, text)
+	if m := reErrorCode.FindStringSubmatch(text); len(m) > 0 {
+		cmd.ErrorCode = toInt64(m[1])
+	}
+	cmd.setKilled(text)
+	cmd.completed = true
+	if !cmdHasNoCompletionRecord(cmd.Cmd) {
+		fp.trackRunning("t06", cmd, -1)
 	}
 }
 
@@ -2115,6 +3045,7 @@ func (fp *P4dFileParser) processServerThreadsBlock(block *Block) {
 		i, err := strconv.ParseInt(m[3], 10, 64)
 		if err == nil {
 			fp.cmdsRunning = i
+			fp.noteRunning()
 			fp.logger.Debugf("Encountered server running threads (%d) message", i)
 			fp.outputSvrEvent(m[1], block.lineNo)
 		}
@@ -2157,6 +3088,14 @@ func (fp *P4dFileParser) processBlock(block *Block) {
 		fp.processPausedThreadsBlock(block)
 	} else if block.btype == resourcePressureType {
 		fp.processResourcePressureBlock(block)
+	} else if block.btype == proxyType {
+		fp.processProxyBlock(block)
+	} else if block.btype == brokerType {
+		fp.processBrokerBlock(block)
+	} else if block.btype == serverMessageType {
+		fp.processServerMessageBlock(block)
+	} else if block.btype == netAddressType {
+		fp.processNetAddressBlock(block)
 	} else if block.btype == errorType {
 		fp.processErrorBlock(block)
 	} //TODO: output unrecognised block if wanted
@@ -2170,14 +3109,17 @@ func blankLine(line string) bool {
 var blockEnds = []string{
 	"Perforce server info:",
 	"Perforce server error:",
+	proxyInfoBlock,
+	brokerInfoBlock,
 }
 
-// Various line prefixes that both can end a block, and should be ignored - see ignoreLine
+// Various line prefixes that both can end a block, and should be ignored - see ignoreLine. Network address lines
+// are parsed as single line blocks instead - see netaddress.go
 var BlockEndPrefixes = []string{
 	"Rpc himark:",
-	"server to client",
+	serverToClientPrefix,
 	"server to inter",
-	"Forwarder set trusted client address",
+	trustedAddressPrefix,
 	"NetSslTransport::SendOrReceive", // Optional configurable
 }
 
@@ -2221,11 +3163,14 @@ func blockEnd(line string) bool {
 			return true
 		}
 	}
-	return false
+	return isServerMessageLine(line)
 }
 
 // Lines to be ignored and not added to blocks
 func ignoreLine(line string) bool {
+	if isNetAddressLine(line) {
+		return false
+	}
 	for _, str := range BlockEndPrefixes {
 		if strings.HasPrefix(line, str) {
 			return true
@@ -2234,6 +3179,67 @@ func ignoreLine(line string) bool {
 	return false
 }
 
+// Logs captured via wrappers may contain lines not written by p4d (shell noise, supervisor output etc).
+// Between blocks, valid lines either start a block or are tab indented/track lines, so others are discarded.
+// Noise written without a trailing newline may also precede a block start on the same line, which would
+// otherwise cause the following block to be appended to the previous one.
+// Multi-line command args (e.g. a -d description, which may include blank lines) are not noise, so nothing is
+// discarded until the closing quote.
+// Returns the line to process and whether it should be discarded.
+func (fp *P4dFileParser) resyncLine(line string, block *Block) (string, bool) {
+	for _, str := range blockEnds {
+		if len(line) > len(str) && strings.HasSuffix(line, str) && strings.TrimSpace(line[:len(line)-len(str)]) != "" {
+			fp.countNoiseLine(line)
+			fp.argsPending = false
+			return str, false
+		}
+	}
+	if fp.argsPending {
+		if blankLine(line) || !(line[0] == '\t' || strings.HasPrefix(line, trackStart) || blockEnd(line)) {
+			fp.argsPending = !strings.HasSuffix(line, "'")
+			return line, false
+		}
+		fp.argsPending = false
+	}
+	if block.btype == infoType && len(block.lines) == 0 && strings.HasPrefix(line, "\t") &&
+		strings.Contains(line, " '") && !strings.HasSuffix(line, "'") {
+		fp.argsPending = true
+	}
+	if block.btype == blankType && len(block.lines) == 0 && !blankLine(line) &&
+		line[0] != '\t' && !strings.HasPrefix(line, trackStart) && !blockEnd(line) {
+		fp.countNoiseLine(line)
+		return line, true
+	}
+	return line, false
+}
+
+func (fp *P4dFileParser) countNoiseLine(line string) {
+	atomic.AddInt64(&fp.noiseLinesCount, 1)
+	if FlagSet(fp.debug, DebugUnrecognised) && fp.logger != nil {
+		fp.logger.Tracef("Noise: %d %s", fp.lineNo, line)
+	}
+	fp.writeUnmatched(fp.lineNo, "noise", line)
+}
+
+// NoiseLinesCount - count of lines discarded as not being from p4d
+func (fp *P4dFileParser) NoiseLinesCount() int64 {
+	return atomic.LoadInt64(&fp.noiseLinesCount)
+}
+
+// noteLocksOnlyTrack counts track records with table locks only - commands are output as normal but with
+// zero usage/rpc values. The first is logged so that users know why those values are missing.
+func (fp *P4dFileParser) noteLocksOnlyTrack(cmd *Command) {
+	if atomic.AddInt64(&fp.locksOnlyTrackCount, 1) == 1 && fp.logger != nil {
+		fp.logger.Infof("Detected track output with table locks only (no lapse/usage/rpc lines, e.g. track=0 with vtrack) "+
+			"at line %d pid %d %s - usage values will be zero", cmd.LineNo, cmd.Pid, cmd.Cmd)
+	}
+}
+
+// LocksOnlyTrackCount - count of track records with table locks but no lapse/usage/rpc lines
+func (fp *P4dFileParser) LocksOnlyTrackCount() int64 {
+	return atomic.LoadInt64(&fp.locksOnlyTrackCount)
+}
+
 // CmdsPendingCount - count of unmatched commands
 func (fp *P4dFileParser) CmdsPendingCount() int {
 	fp.m.Lock()
@@ -2244,48 +3250,43 @@ func (fp *P4dFileParser) CmdsPendingCount() int {
 // LogParser - interface to be run on a go routine - commands are returned on cmdchan
 func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string, timeChan <-chan time.Time) chan interface{} {
 	fp.lineNo = 1
+	if fp.resumeLineNo > 0 {
+		fp.lineNo = fp.resumeLineNo
+	}
 
 	fp.cmdChan = make(chan interface{}, 10000)
 	fp.linesChan = &linesChan
 	fp.blockChan = make(chan *Block, 1000)
 
-	// Commands are output on a seperate thread
-	// timeChan is nil when there are no metrics to process.
-	// We need to consume events on timeChan to avoid blocking other processes
-	if timeChan == nil {
-		ticker := time.NewTicker(fp.outputDuration)
+	// Time advances as given on timeChan (e.g. log times from metrics), or if it is nil with the wall clock (for live
+	// logs) - passed to the block routine below, which outputs completed commands. Runs until parsing finishes.
+	go func() {
 		tickerDebug := time.NewTicker(fp.debugDuration)
-		go func() {
-			for {
-				select {
-				case t := <-ticker.C:
-					fp.m.Lock()
-					fp.currTime = t
-					fp.m.Unlock()
-				case <-tickerDebug.C:
-					fp.debugOutputCommands()
-				}
-			}
-		}()
-	} else {
-		go func() {
-			tickerDebug := time.NewTicker(fp.debugDuration)
-			for {
-				select {
-				case t, ok := <-timeChan:
-					if ok {
-						fp.m.Lock()
-						fp.currTime = t
-						fp.m.Unlock()
-					} else {
-						return
-					}
-				case <-tickerDebug.C:
-					fp.debugOutputCommands()
+		defer tickerDebug.Stop()
+		var wallClock <-chan time.Time
+		if timeChan == nil {
+			ticker := time.NewTicker(fp.outputDuration)
+			defer ticker.Stop()
+			wallClock = ticker.C
+		}
+		for {
+			select {
+			case <-fp.parseDone:
+				return
+			case <-ctx.Done():
+				return
+			case t := <-wallClock:
+				fp.tick(t)
+			case t, ok := <-timeChan:
+				if !ok {
+					return
 				}
+				fp.tick(t)
+			case <-tickerDebug.C:
+				fp.debugOutputCommands()
 			}
-		}()
-	}
+		}
+	}()
 
 	// Go routine to process all the lines being received
 	// sends blocks on the blockChannel
@@ -2301,7 +3302,24 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 				return
 			case line, ok := <-linesChan:
 				if ok {
+					atomic.AddInt64(&fp.linesRead, 1)
 					line = strings.TrimRight(line, "\r\n")
+					server := ""
+					if fp.serverPrefix != nil {
+						line, server = fp.splitServerPrefix(line)
+						if server != block.server && len(block.lines) > 0 {
+							if !blankLine(block.lines[0]) {
+								fp.blockChan <- block
+							}
+							block = new(Block)
+						}
+						block.server = server
+					}
+					line, discard := fp.resyncLine(line, block)
+					if discard {
+						fp.lineNo++
+						continue
+					}
 					if blockEnd(line) {
 						if len(block.lines) > 0 {
 							if !blankLine(block.lines[0]) {
@@ -2309,6 +3327,7 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 							}
 						}
 						block = new(Block)
+						block.server = server
 						if !ignoreLine(line) {
 							block.addLine(line, fp.lineNo)
 						}
@@ -2334,8 +3353,25 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 	// This routine handles blocks in parallel to lines above
 	go func() {
 		defer close(fp.cmdChan)
+		defer close(fp.parseDone)
+		defer fp.flushReorderBuffer()
+		idle := true // No blocks processed since the last time tick
 		for {
 			select {
+			case req := <-fp.runningReq:
+				req <- fp.runningSnapshot()
+			case t := <-fp.timeTick:
+				// Log times on timeChan are sent ahead of their lines, so the time is only taken from the blocks
+				// themselves (see addCommand) - otherwise commands could be output before their track records
+				if timeChan == nil {
+					fp.currTime = t
+				}
+				// Otherwise commands completed while a live log is quiet are only output once more lines are written
+				if idle {
+					fp.outputCompletedCommands()
+					atomic.StoreInt64(&fp.cmdsPending, int64(len(fp.cmds)))
+				}
+				idle = true
 			case <-ctx.Done():
 				if fp.logger != nil {
 					fp.logger.Debugf("lines got Done")
@@ -2344,14 +3380,26 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 				return
 			case b, ok := <-fp.blockChan:
 				if ok {
-					fp.processBlock(b)
+					idle = false
+					fp.currServer = b.server
+					fp.processBlockWithHooks(b)
+					fp.checkMemoryLimit(b)
+					atomic.StoreInt64(&fp.cmdsPending, int64(len(fp.cmds)))
 					if fp.cmdsRunning > maxRunningCount {
 						panic(fmt.Sprintf("ERROR: max running command limit (%d) exceeded. Does this server log have completion records configured (p4 configure set server=3)? "+
 							"If using log2sql, then you can try to re-run with parameter --no.completion.records - but we strongly recommend you change p4d configurable to get completion records instead and re-analyze the log!",
 							maxRunningCount))
 					}
 				} else {
-					fp.outputRemainingCommands()
+					if fp.keepPending {
+						fp.evictKeptPending()
+						fp.outputFinishedCommands()
+						fp.outputSpilledCommands()
+					} else {
+						fp.markTruncatedCommands()
+						fp.outputRemainingCommands()
+					}
+					atomic.StoreInt64(&fp.cmdsPending, int64(len(fp.cmds)))
 					return
 				}
 			}
@@ -2,8 +2,16 @@ package p4dlog
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
@@ -22,12 +30,17 @@ import (
 // }
 
 func parseLogLines(input string) []string {
-
-	inchan := make(chan string, 10)
-
 	logger := logrus.New()
 	logger.Level = logrus.InfoLevel
 	fp := NewP4dFileParser(logger)
+	return parseLogLinesWithParser(fp, input)
+}
+
+// As above but with a parser which may have been configured
+func parseLogLinesWithParser(fp *P4dFileParser, input string) []string {
+
+	inchan := make(chan string, 10)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -47,6 +60,10 @@ func parseLogLines(input string) []string {
 			output = append(output, cmd.String())
 		case ServerEvent:
 			output = append(output, cmd.String())
+		case ProxyEvent:
+			output = append(output, cmd.String())
+		case BrokerEvent:
+			output = append(output, cmd.String())
 		}
 	}
 	sort.Strings(output)
@@ -103,7 +120,7 @@ Perforce server info:
 	2015/09/02 15:23:09 pid 1616 completed .031s`
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey": "4d4e5096f7b732e4ce95230ef085bf51","cmd": "user-sync","pid": 1616,"lineNo": 2,"user": "robert","workspace": "robert-test","computeLapse": 0.031,"completedLapse": 0.031,"ip": "127.0.0.1","app": "Microsoft Visual Studio 2013/12.0.21005.1","args": "//...","startTime": "2015/09/02 15:23:09","endTime": "2015/09/02 15:23:09","running": 1,"cmdError": false,"tables": []}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey": "4d4e5096f7b732e4ce95230ef085bf51","cmd": "user-sync","pid": 1616,"lineNo": 2,"user": "robert","workspace": "robert-test","computeLapse": 0.031,"completedLapse": 0.031,"ip": "127.0.0.1","app": "Microsoft Visual Studio 2013/12.0.21005.1","args": "//...","startTime": "2015/09/02 15:23:09","endTime": "2015/09/02 15:23:09","running": 1,"runningPeak": 1,"cmdError": false,"tables": []}`),
 		cleanJSON(output[0]))
 
 	// Sames as above with invalid Unicode strings
@@ -116,11 +133,28 @@ Perforce server info:
 	2015/09/02 15:23:09 pid 1616 completed .031s`
 	output = parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"1f360d628fb2c9fe5354b8cf5022f7bd","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0.031,"ip":"127.0.0.1","app":"Microsoft® Visual Studio® 2013/12.0.21005.1","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"1f360d628fb2c9fe5354b8cf5022f7bd","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0.031,"ip":"127.0.0.1","app":"Microsoft® Visual Studio® 2013/12.0.21005.1","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 
 }
 
+func TestCommandJSONTags(t *testing.T) {
+	// Malformed tags (e.g. a missing closing quote) are ignored by encoding/json
+	typ := reflect.TypeOf(Command{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Tag == "" {
+			continue
+		}
+		_, ok := f.Tag.Lookup("json")
+		assert.True(t, ok, "json tag of %s", f.Name)
+	}
+	f, _ := typ.FieldByName("FileTotalsSnd")
+	assert.Equal(t, "fileTotalsSnd", f.Tag.Get("json"))
+	f, _ = typ.FieldByName("FileTotalsRcvMBytes")
+	assert.Equal(t, "fileTotalsRcvMBytes", f.Tag.Get("json"))
+}
+
 func TestClientLockRecords(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -146,7 +180,7 @@ Perforce server info:
 ---   peek count 20 wait+held total/max 21ms+22ms/23ms+24ms`
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"7868f2723d35c6cb91784afa6bef4a7a","cmd":"user-client","pid":81805,"lineNo":2,"user":"bruno","workspace":"robert_cowham-dvcs-1487082773","completedLapse":0.009,"ip":"10.62.185.98","app":"p4/2016.2/LINUX26X86_64/1468155","args":"-d -f bruno.139631598948304.irp210-h03","startTime":"2017/02/15 13:46:42","endTime":"2017/02/15 13:46:42","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"cmdError":false,"tables":[{"tableName":"have","pagesIn":1,"pagesOut":2,"pagesCached":3,"pagesSplitInternal":41,"pagesSplitLeaf":42,"readLocks":4,"writeLocks":5,"getRows":6,"posRows":7,"scanRows":8,"putRows":9,"delRows":10,"totalReadWait":12,"totalReadHeld":13,"totalWriteWait":14,"totalWriteHeld":15,"maxReadWait":32,"maxReadHeld":33,"maxWriteWait":34,"maxWriteHeld":35,"peekCount":20,"totalPeekWait":21,"totalPeekHeld":22,"maxPeekWait":23,"maxPeekHeld":24}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7868f2723d35c6cb91784afa6bef4a7a","cmd":"user-client","pid":81805,"lineNo":2,"user":"bruno","workspace":"robert_cowham-dvcs-1487082773","completedLapse":0.009,"ip":"10.62.185.98","app":"p4/2016.2/LINUX26X86_64/1468155","args":"-d -f bruno.139631598948304.irp210-h03","startTime":"2017/02/15 13:46:42","endTime":"2017/02/15 13:46:42","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"cmdError":false,"tables":[{"tableName":"have","pagesIn":1,"pagesOut":2,"pagesCached":3,"pagesSplitInternal":41,"pagesSplitLeaf":42,"readLocks":4,"writeLocks":5,"getRows":6,"posRows":7,"scanRows":8,"putRows":9,"delRows":10,"totalReadWait":12,"totalReadHeld":13,"totalWriteWait":14,"totalWriteHeld":15,"maxReadWait":32,"maxReadHeld":33,"maxWriteWait":34,"maxWriteHeld":35,"peekCount":20,"totalPeekWait":21,"totalPeekHeld":22,"maxPeekWait":23,"maxPeekHeld":24}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -175,7 +209,7 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"7ca020fc087e28ca774cc2267a45cedf","cmd":"user-client","pid":8748,"lineNo":2,"user":"build","workspace":"commander-controller","completedLapse":0.012,"ip":"10.5.20.152","app":"p4/2018.1/LINUX26X86_64/1957529","args":"-i","startTime":"2020/10/16 06:00:01","endTime":"2020/10/16 06:00:01","running":1,"uCpu":4,"sCpu":4,"diskIn":8,"diskOut":80,"maxRss":9984,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcHimarkFwd":795800,"rpcHimarkRev":318788,"rpcRcv":0.004,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":3,"pagesCached":2,"readLocks":1,"getRows":1},{"tableName":"storagemasterup_R","totalReadHeld":3},{"tableName":"storageup_R","totalReadHeld":3}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7ca020fc087e28ca774cc2267a45cedf","cmd":"user-client","pid":8748,"lineNo":2,"user":"build","workspace":"commander-controller","completedLapse":0.012,"ip":"10.5.20.152","app":"p4/2018.1/LINUX26X86_64/1957529","args":"-i","startTime":"2020/10/16 06:00:01","endTime":"2020/10/16 06:00:01","running":1,"runningPeak":1,"uCpu":4,"sCpu":4,"diskIn":8,"diskOut":80,"maxRss":9984,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcHimarkFwd":795800,"rpcHimarkRev":318788,"rpcRcv":0.004,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":3,"pagesCached":2,"readLocks":1,"getRows":1}], "serializedLocks":[{"name":"storagemasterup","mode":"R","totalReadHeld":3}, {"name":"storageup","mode":"R","totalReadHeld":3}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -201,7 +235,7 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"7e3d11dfb4701f7818a630d0b2c2c1ba","cmd":"user-label","pid":8748,"lineNo":2,"user":"build","workspace":"commander-controller","completedLapse":0.012,"ip":"10.5.20.152","app":"p4/2018.1/LINUX26X86_64/1957529","args":"-i","startTime":"2020/10/16 06:00:01","endTime":"2020/10/16 06:00:01","running":1,"uCpu":4,"sCpu":4,"diskIn":8,"diskOut":80,"maxRss":9984,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcHimarkFwd":795800,"rpcHimarkRev":318788,"rpcRcv":0.004,"cmdError":false,"tables":[{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":4096,"writeLocks":2,"putRows":2}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7e3d11dfb4701f7818a630d0b2c2c1ba","cmd":"user-label","pid":8748,"lineNo":2,"user":"build","workspace":"commander-controller","completedLapse":0.012,"ip":"10.5.20.152","app":"p4/2018.1/LINUX26X86_64/1957529","args":"-i","startTime":"2020/10/16 06:00:01","endTime":"2020/10/16 06:00:01","running":1,"runningPeak":1,"uCpu":4,"sCpu":4,"diskIn":8,"diskOut":80,"maxRss":9984,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcHimarkFwd":795800,"rpcHimarkRev":318788,"rpcRcv":0.004,"cmdError":false,"tables":[{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":4096,"writeLocks":2,"putRows":2}]}`),
 		cleanJSON(output[0]))
 	// assert.Equal(t, ``,
 	// 	cleanJSON(output[0]))
@@ -216,7 +250,7 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"d0ae06fd40d95180ca403a9c30084a66","cmd":"user-counter","pid":14769,"lineNo":2,"user":"perforce","workspace":"~tmp.1482305462.13038.585a2fb6041cc1.60954329","completedLapse":0.003,"ip":"192.168.18.31","app":"SWARM/2016.2/1446446","args":"-u swarm-activity-fffec3dd","startTime":"2016/12/21 08:39:39","endTime":"2016/12/21 08:39:39","running":1,"uCpu":4,"diskOut":16,"maxRss":6432,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"d0ae06fd40d95180ca403a9c30084a66","cmd":"user-counter","pid":14769,"lineNo":2,"user":"perforce","workspace":"~tmp.1482305462.13038.585a2fb6041cc1.60954329","completedLapse":0.003,"ip":"192.168.18.31","app":"SWARM/2016.2/1446446","args":"-u swarm-activity-fffec3dd","startTime":"2016/12/21 08:39:39","endTime":"2016/12/21 08:39:39","running":1,"runningPeak":1,"uCpu":4,"diskOut":16,"maxRss":6432,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -252,7 +286,7 @@ Perforce server info:
 	2016/10/19 12:01:09 pid 10664 completed .844s`
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"1eec998ae9cc1ce44058f4503a01f2c0","cmd":"user-key","pid":10664,"lineNo":2,"user":"git-fusion-user","workspace":"GF-TRIGGER-567d67de-962","completedLapse":0.844,"ip":"10.100.104.199","app":"p4/2016.1/NTX64/1396108","args":"git-fusion-reviews-common-lock-owner","startTime":"2016/10/19 12:01:08","endTime":"2016/10/19 12:01:09","running":1,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcHimarkFwd":523588,"rpcHimarkRev":523588,"rpcRcv":0.015,"cmdError":false,"tables":[{"tableName":"group","pagesIn":7,"pagesCached":6,"readLocks":1,"posRows":3,"scanRows":67,"totalReadHeld":15},{"tableName":"nameval","pagesIn":6,"pagesOut":4,"pagesCached":4,"writeLocks":1,"putRows":1,"totalWriteWait":16,"totalWriteHeld":15},{"tableName":"protect","pagesIn":282,"pagesCached":96,"readLocks":1,"posRows":1,"scanRows":14495,"totalReadHeld":641},{"tableName":"trigger","pagesIn":21,"pagesCached":20,"readLocks":1,"posRows":1,"scanRows":486,"totalReadHeld":47},{"tableName":"user","pagesIn":4,"pagesCached":3,"readLocks":1,"getRows":1,"totalReadHeld":16}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"1eec998ae9cc1ce44058f4503a01f2c0","cmd":"user-key","pid":10664,"lineNo":2,"user":"git-fusion-user","workspace":"GF-TRIGGER-567d67de-962","completedLapse":0.844,"ip":"10.100.104.199","app":"p4/2016.1/NTX64/1396108","args":"git-fusion-reviews-common-lock-owner","startTime":"2016/10/19 12:01:08","endTime":"2016/10/19 12:01:09","running":1,"runningPeak":1,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcHimarkFwd":523588,"rpcHimarkRev":523588,"rpcRcv":0.015,"cmdError":false,"tables":[{"tableName":"group","pagesIn":7,"pagesCached":6,"readLocks":1,"posRows":3,"scanRows":67,"totalReadHeld":15},{"tableName":"nameval","pagesIn":6,"pagesOut":4,"pagesCached":4,"writeLocks":1,"putRows":1,"totalWriteWait":16,"totalWriteHeld":15},{"tableName":"protect","pagesIn":282,"pagesCached":96,"readLocks":1,"posRows":1,"scanRows":14495,"totalReadHeld":641},{"tableName":"trigger","pagesIn":21,"pagesCached":20,"readLocks":1,"posRows":1,"scanRows":486,"totalReadHeld":47},{"tableName":"user","pagesIn":4,"pagesCached":3,"readLocks":1,"getRows":1,"totalReadHeld":16}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -270,7 +304,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"e2bf456007fe305acdae759996dbbeb9","cmd":"user-reconcile","pid":4500,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":0.187,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"-eadf -c 12253 c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt","startTime":"2015/09/02 16:43:36","endTime":"2015/09/02 16:43:36","running":1,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"e2bf456007fe305acdae759996dbbeb9","cmd":"user-reconcile","pid":4500,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":0.187,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"-eadf -c 12253 c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt","startTime":"2015/09/02 16:43:36","endTime":"2015/09/02 16:43:36","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -290,9 +324,9 @@ Perforce server info:
 	2017/02/15 10:11:30 pid 4917 completed .034s 19+4us 0+8io 0+0net 8996k 0pf`
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"4964a5f82541f47985f0965ab47c1e39","cmd":"user-have","pid":4917,"lineNo":2,"user":"bruno","workspace":"bruno.140451462678608","completedLapse":0.002,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","args":"","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"uCpu":2,"maxRss":8932,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"4964a5f82541f47985f0965ab47c1e39","cmd":"user-have","pid":4917,"lineNo":2,"user":"bruno","workspace":"bruno.140451462678608","completedLapse":0.002,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","args":"","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"runningPeak":1,"uCpu":2,"maxRss":8932,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"7c65428ac3b32f6f42f84ead5694ffb4","cmd":"user-sync","pid":4917,"lineNo":6,"user":"bruno","workspace":"bruno.140451462678608","computeLapse":0.02,"completedLapse":0.034,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","args":"//bruno.140451462678608/...","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"uCpu":19,"sCpu":4,"diskOut":8,"maxRss":8996,"netFilesAdded":1,"netFilesUpdated":2,"netFilesDeleted":3,"netBytesAdded":111325,"netBytesUpdated":813906,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7c65428ac3b32f6f42f84ead5694ffb4","cmd":"user-sync","pid":4917,"lineNo":6,"user":"bruno","workspace":"bruno.140451462678608","computeLapse":0.02,"completedLapse":0.034,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","args":"//bruno.140451462678608/...","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"runningPeak":1,"uCpu":19,"sCpu":4,"diskOut":8,"maxRss":8996,"netFilesAdded":1,"netFilesUpdated":2,"netFilesDeleted":3,"netBytesAdded":111325,"netBytesUpdated":813906,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[1]))
 }
 
@@ -335,8 +369,8 @@ Perforce server info:
 	2015/09/02 15:23:09 pid 1616 completed .031s
 Perforce server info:
 	2015/09/02 15:23:09 pid 1534 completed .041s`
-var multiExp1 = `{"processKey":"f9a64670da4d77a44225be236974bc8b","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0.031,"ip":"127.0.0.1","app":"p4/2016.2/LINUX26X86_64/1598668","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"cmdError":false,"tables":[]}`
-var multiExp2 = `{"processKey":"2908cdb35e4b82dae3d0b403ef0c3bbf","cmd":"user-sync","pid":1534,"lineNo":6,"user":"fred","workspace":"fred-test","computeLapse":0.021,"completedLapse":0.041,"ip":"127.0.0.1","app":"p4/2016.2/LINUX26X86_64/1598668","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":2,"cmdError":false,"tables":[]}`
+var multiExp1 = `{"processKey":"f9a64670da4d77a44225be236974bc8b","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0.031,"completedLapse":0.031,"ip":"127.0.0.1","app":"p4/2016.2/LINUX26X86_64/1598668","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"runningPeak":2,"cmdError":false,"tables":[]}`
+var multiExp2 = `{"processKey":"2908cdb35e4b82dae3d0b403ef0c3bbf","cmd":"user-sync","pid":1534,"lineNo":6,"user":"fred","workspace":"fred-test","computeLapse":0.021,"completedLapse":0.041,"ip":"127.0.0.1","app":"p4/2016.2/LINUX26X86_64/1598668","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":2,"runningPeak":2,"cmdError":false,"tables":[]}`
 
 func TestLogParseMulti(t *testing.T) {
 	output := parseLogLines(multiInput)
@@ -388,11 +422,11 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 3, len(output))
 	//assert.Equal(t, "", output[1])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":15,"user":"fred","workspace":"lon_ws","completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"maxRss":127728,"pageFaults":1,"cmdError":false,"tables":[{"tableName":"archmap","totalWriteHeld":780},{"tableName":"integed","totalWriteHeld":795}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":15,"user":"fred","workspace":"lon_ws","completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"runningPeak":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"maxRss":127728,"pageFaults":1,"cmdError":false,"tables":[{"tableName":"archmap","totalWriteHeld":780},{"tableName":"integed","totalWriteHeld":795}]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"465f0a630b021d3c695e90924a757b75","cmd":"user-submit","pid":25568,"lineNo":2,"user":"fred","workspace":"lon_ws","completedLapse":0.178,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"-i","startTime":"2018/06/10 23:30:06","endTime":"2018/06/10 23:30:07","running":1,"uCpu":96,"sCpu":17,"diskOut":208,"maxRss":15668,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"465f0a630b021d3c695e90924a757b75","cmd":"user-submit","pid":25568,"lineNo":2,"user":"fred","workspace":"lon_ws","completedLapse":0.178,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"-i","startTime":"2018/06/10 23:30:06","endTime":"2018/06/10 23:30:07","running":1,"runningPeak":1,"uCpu":96,"sCpu":17,"diskOut":208,"maxRss":15668,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[1]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"78dbd54644e624a9c6f5c338a0864d2a","cmd":"dm-SubmitChange","pid":25568,"lineNo":7,"user":"fred","workspace":"lon_ws","computeLapse":0.252,"completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:07","endTime":"2018/06/10 23:30:08","running":1,"uCpu":490,"sCpu":165,"diskOut":178824,"maxRss":127728,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"78dbd54644e624a9c6f5c338a0864d2a","cmd":"dm-SubmitChange","pid":25568,"lineNo":7,"user":"fred","workspace":"lon_ws","computeLapse":0.252,"completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:07","endTime":"2018/06/10 23:30:08","running":1,"runningPeak":1,"uCpu":490,"sCpu":165,"diskOut":178824,"maxRss":127728,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[2]))
 
 }
@@ -441,11 +475,11 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 3, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":18,"user":"fred","workspace":"lon_ws","completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"maxRss":127728,"pageFaults":1,"cmdError":false,"tables":[{"tableName":"archmap","totalWriteHeld":780},{"tableName":"integed","totalWriteHeld":795}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":18,"user":"fred","workspace":"lon_ws","completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"runningPeak":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"maxRss":127728,"pageFaults":1,"cmdError":false,"tables":[{"tableName":"archmap","totalWriteHeld":780},{"tableName":"integed","totalWriteHeld":795}]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"78dbd54644e624a9c6f5c338a0864d2a","cmd":"dm-SubmitChange","pid":25568,"lineNo":10,"user":"fred","workspace":"lon_ws","computeLapse":0.252,"completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:07","endTime":"2018/06/10 23:30:08","running":1,"uCpu":490,"sCpu":165,"diskOut":178824,"maxRss":127728,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"78dbd54644e624a9c6f5c338a0864d2a","cmd":"dm-SubmitChange","pid":25568,"lineNo":10,"user":"fred","workspace":"lon_ws","computeLapse":0.252,"completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:07","endTime":"2018/06/10 23:30:08","running":1,"runningPeak":1,"uCpu":490,"sCpu":165,"diskOut":178824,"maxRss":127728,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[1]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"954a5899d56e015d5080e4f8ef7f9e39","cmd":"user-submit","pid":25568,"lineNo":2,"user":"fred","workspace":"lon_ws","completedLapse":0.178,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":" -d First line","startTime":"2018/06/10 23:30:06","endTime":"2018/06/10 23:30:07","running":1,"uCpu":96,"sCpu":17,"diskOut":208,"maxRss":15668,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"954a5899d56e015d5080e4f8ef7f9e39","cmd":"user-submit","pid":25568,"lineNo":2,"user":"fred","workspace":"lon_ws","completedLapse":0.178,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":" -d First line","startTime":"2018/06/10 23:30:06","endTime":"2018/06/10 23:30:07","running":1,"runningPeak":1,"uCpu":96,"sCpu":17,"diskOut":208,"maxRss":15668,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[2]))
 	// assert.Equal(t, `asdf`,
 	// 	output[3])
@@ -496,7 +530,7 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"c3ddb95f03f30b508e0e96dd8754b419","cmd":"user-populate","pid":36276,"lineNo":2,"user":"fred","workspace":"fred-dvcs-1671638968","completedLapse":0.02,"ip":"unknown","app":"p4/2021.1/MACOSX1015X86_64/2156517","args":" -d    First line","startTime":"2022/12/21 18:10:48","endTime":"2022/12/21 18:10:48","running":1,"sCpu":3,"maxRss":8577024,"pageFaults":9,"rpcMsgsOut":1,"rpcHimarkFwd":2000,"rpcHimarkRev":2000,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":14,"pagesOut":6,"pagesCached":2,"readLocks":4,"writeLocks":4,"getRows":7,"putRows":2,"totalWriteHeld":4,"maxWriteHeld":4},{"tableName":"logger","pagesIn":3,"pagesCached":1,"writeLocks":1,"getRows":0},{"tableName":"storagemasterup_R","totalReadHeld":15},{"tableName":"stream","pagesIn":8,"pagesOut":3,"pagesCached":2,"readLocks":4,"writeLocks":1,"getRows":3,"posRows":6,"scanRows":6,"putRows":1}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"c3ddb95f03f30b508e0e96dd8754b419","cmd":"user-populate","pid":36276,"lineNo":2,"user":"fred","workspace":"fred-dvcs-1671638968","completedLapse":0.02,"ip":"unknown","app":"p4/2021.1/MACOSX1015X86_64/2156517","args":" -d    First line","startTime":"2022/12/21 18:10:48","endTime":"2022/12/21 18:10:48","running":1,"runningPeak":1,"sCpu":3,"maxRss":8577024,"pageFaults":9,"rpcMsgsOut":1,"rpcHimarkFwd":2000,"rpcHimarkRev":2000,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":14,"pagesOut":6,"pagesCached":2,"readLocks":4,"writeLocks":4,"getRows":7,"putRows":2,"totalWriteHeld":4,"maxWriteHeld":4},{"tableName":"logger","pagesIn":3,"pagesCached":1,"writeLocks":1,"getRows":0},{"tableName":"stream","pagesIn":8,"pagesOut":3,"pagesCached":2,"readLocks":4,"writeLocks":1,"getRows":3,"posRows":6,"scanRows":6,"putRows":1}], "serializedLocks":[{"name":"storagemasterup","mode":"R","totalReadHeld":15}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -536,9 +570,9 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c","cmd":"user-change","pid":4496,"lineNo":2,"user":"lcheng","workspace":"lcheng","completedLapse":0.015,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"rpcMsgsOut":1,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesCached":7,"readLocks":1,"posRows":6,"scanRows":11},{"tableName":"user","pagesIn":1,"pagesCached":3,"readLocks":1,"getRows":1}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c","cmd":"user-change","pid":4496,"lineNo":2,"user":"lcheng","workspace":"lcheng","completedLapse":0.015,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"runningPeak":1,"rpcMsgsOut":1,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesCached":7,"readLocks":1,"posRows":6,"scanRows":11},{"tableName":"user","pagesIn":1,"pagesCached":3,"readLocks":1,"getRows":1}]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c.18","cmd":"user-change","pid":4496,"lineNo":18,"user":"lcheng","workspace":"lcheng","completedLapse":0.016,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"rpcMsgsOut":1,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesCached":7,"readLocks":1,"posRows":6,"scanRows":11},{"tableName":"user","pagesIn":1,"pagesCached":3,"readLocks":1,"getRows":1}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c.18","cmd":"user-change","pid":4496,"lineNo":18,"user":"lcheng","workspace":"lcheng","completedLapse":0.016,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"runningPeak":1,"rpcMsgsOut":1,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesCached":7,"readLocks":1,"posRows":6,"scanRows":11},{"tableName":"user","pagesIn":1,"pagesCached":3,"readLocks":1,"getRows":1}]}`),
 		cleanJSON(output[1]))
 }
 
@@ -562,7 +596,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"25aeba7a5658170fea61117076fa00d5","cmd":"user-change","pid":148469,"lineNo":2,"user":"Fred","workspace":"LONWS","completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"pagesSplitInternal":41,"pagesSplitLeaf":42,"writeLocks":2,"getRows":2,"putRows":1},{"tableName":"trigger_swarm.changesave","triggerLapse":0.044}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"25aeba7a5658170fea61117076fa00d5","cmd":"user-change","pid":148469,"lineNo":2,"user":"Fred","workspace":"LONWS","completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"pagesSplitInternal":41,"pagesSplitLeaf":42,"writeLocks":2,"getRows":2,"putRows":1},{"tableName":"trigger_swarm.changesave","triggerLapse":0.044,"triggerStage":"changesave"}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -607,9 +641,9 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
 	//assert.Equal(t, "", output[1])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":16,"user":"fred","workspace":"lon_ws","completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"maxRss":127728,"pageFaults":1,"cmdError":false,"tables":[{"tableName":"archmap","totalWriteHeld":780},{"tableName":"integed","totalWriteHeld":795}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":16,"user":"fred","workspace":"lon_ws","completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"runningPeak":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"maxRss":127728,"pageFaults":1,"cmdError":false,"tables":[{"tableName":"archmap","totalWriteHeld":780},{"tableName":"integed","totalWriteHeld":795}]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"441371d8e17558bfb8e6cf7c1ca7b3ac","cmd":"user-change","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"writeLocks":2,"getRows":2,"putRows":1},{"tableName":"trigger_swarm.changesave","triggerLapse":0.044}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"441371d8e17558bfb8e6cf7c1ca7b3ac","cmd":"user-change","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"writeLocks":2,"getRows":2,"putRows":1},{"tableName":"trigger_swarm.changesave","triggerLapse":0.044,"triggerStage":"changesave"}]}`),
 		cleanJSON(output[1]))
 }
 
@@ -628,7 +662,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"memMB":1,"memPeakMB":2,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"memMB":1,"memPeakMB":2,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -654,9 +688,9 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
 	//assert.Equal(t, "", output[1])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"7c437167b3eef0a81ba6ecb710ad7572","cmd":"user-serverid","pid":25396,"lineNo":2,"user":"p4sdp","workspace":"chi","completedLapse":0.002,"ip":"127.0.0.1","app":"p4/2019.2/LINUX26X86_64/1891638","args":"","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"diskOut":8,"maxRss":8036,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcHimarkFwd":795800,"rpcHimarkRev":795656,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7c437167b3eef0a81ba6ecb710ad7572","cmd":"user-serverid","pid":25396,"lineNo":2,"user":"p4sdp","workspace":"chi","completedLapse":0.002,"ip":"127.0.0.1","app":"p4/2019.2/LINUX26X86_64/1891638","args":"","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"runningPeak":1,"diskOut":8,"maxRss":8036,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcHimarkFwd":795800,"rpcHimarkRev":795656,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"9bbbb204208b1af212c38a906294708c","cmd":"user-login","pid":25390,"lineNo":4,"user":"bot-integ","workspace":"_____CLIENT_UNSET_____","completedLapse":0.008,"ip":"127.0.0.1/10.5.40.103","app":"jenkins.p4-plugin/1.10.3-SNAPSHOT/Linux (brokered)","args":"-s","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"diskOut":8,"maxRss":7632,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcHimarkFwd":795800,"rpcHimarkRev":185540,"rpcRcv":0.007,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"9bbbb204208b1af212c38a906294708c","cmd":"user-login","pid":25390,"lineNo":4,"user":"bot-integ","workspace":"_____CLIENT_UNSET_____","completedLapse":0.008,"ip":"127.0.0.1/10.5.40.103","app":"jenkins.p4-plugin/1.10.3-SNAPSHOT/Linux (brokered)","args":"-s","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"runningPeak":1,"diskOut":8,"maxRss":7632,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcHimarkFwd":795800,"rpcHimarkRev":185540,"rpcRcv":0.007,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[1]))
 }
 
@@ -674,10 +708,134 @@ Perforce server error:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"227e3b54b1283b1fef89bc5843eb87d5","cmd":"user-resolved","pid":25883,"lineNo":2,"user":"user1","workspace":"ws1","ip":"10.1.3.158","app":"IntelliJ_IDEA_resolved/2018.1/LINUX26X86_64/1637071","args":"/home/user1/perforce_ws/ws1/.idea/... /home/user1/perforce_ws/ws1/...","startTime":"2019/12/20 09:42:15","endTime":"0001/01/01 00:00:00","running":1,"cmdError":true,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"227e3b54b1283b1fef89bc5843eb87d5","cmd":"user-resolved","pid":25883,"lineNo":2,"user":"user1","workspace":"ws1","ip":"10.1.3.158","app":"IntelliJ_IDEA_resolved/2018.1/LINUX26X86_64/1637071","args":"/home/user1/perforce_ws/ws1/.idea/... /home/user1/perforce_ws/ws1/...","startTime":"2019/12/20 09:42:15","endTime":"0001/01/01 00:00:00","running":1,"runningPeak":1,"cmdError":true,"errorSeverity":"warn","errorText":"/home/user1/perforce_ws/ws1/... - no file(s) resolved.","errorCount":1,"errors":[{"lineNo":5,"text":"/home/user1/perforce_ws/ws1/... - no file(s) resolved."}],"tables":[]}`),
+		cleanJSON(output[0]))
+}
+
+func TestLogErrorSeverity(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2019/12/20 09:42:15 pid 25883 user1@ws1 10.1.3.158 [p4/2019.2/LINUX26X86_64/1891638] 'user-edit //depot/a.txt'
+
+Perforce server error:
+	Date 2019/12/20 09:42:15:
+	Pid 25883
+	Operation: user-edit
+	//depot/a.txt - also opened by user2@ws2
+
+Perforce server error:
+	Date 2019/12/20 09:42:15:
+	Pid 25883
+	Operation: user-edit
+	Librarian checkin failed.
+	open for write: /p4/1/depots/depot/a.txt,v: Permission denied (errno 13)
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"dcd7ac2ed6732f431c73a22bfd0651af","cmd":"user-edit","pid":25883,"lineNo":2,"user":"user1","workspace":"ws1","ip":"10.1.3.158","app":"p4/2019.2/LINUX26X86_64/1891638","args":"//depot/a.txt","startTime":"2019/12/20 09:42:15","endTime":"0001/01/01 00:00:00","running":1,"runningPeak":1,"cmdError":true,"errorSeverity":"error","errorCode":13,"errorText":"//depot/a.txt - also opened by user2@ws2\nLibrarian checkin failed.\nopen for write: /p4/1/depots/depot/a.txt,v: Permission denied (errno 13)","errorCount":2,"errors":[{"lineNo":5,"text":"//depot/a.txt - also opened by user2@ws2"},{"lineNo":11,"text":"Librarian checkin failed.\nopen for write: /p4/1/depots/depot/a.txt,v: Permission denied (errno 13)"}],"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
+func TestErrorBlocksLimit(t *testing.T) {
+	var cmd, other Command
+	for i := 0; i < maxErrorBlocks+5; i++ {
+		cmd.addError(int64(i), "error")
+	}
+	other.addError(1, "other")
+	cmd.updateFrom(&other)
+	// Still counted, and in ErrorText, but not recorded individually
+	assert.Equal(t, int64(maxErrorBlocks+6), cmd.ErrorCount)
+	assert.Equal(t, maxErrorBlocks, len(cmd.Errors))
+	assert.Equal(t, int64(maxErrorBlocks-1), cmd.Errors[maxErrorBlocks-1].LineNo)
+	assert.True(t, strings.HasSuffix(cmd.ErrorText, "error\nother"))
+}
+
+func TestErrorSeverity(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		severity string
+	}{
+		{"//depot/... - no such file(s).", ErrorSeverityWarn},
+		{"//ws1/a.txt - file(s) up-to-date.", ErrorSeverityWarn},
+		{"//depot/a.txt - currently opened for edit", ErrorSeverityInfo},
+		{"Operation 'user-fstat' failed.\nToo many commands paused;  terminated.", ErrorSeverityFatal},
+		{"Change 1234 unknown.", ErrorSeverityError},
+	} {
+		assert.Equal(t, tc.severity, errorSeverity(tc.text), tc.text)
+	}
+}
+
+func TestLimitExceeded(t *testing.T) {
+	for _, tc := range []struct {
+		text  string
+		limit string
+	}{
+		{"Request too large (over 500000); see 'p4 help maxresults'.", LimitMaxResults},
+		{"Too many rows scanned (over 10000000); see 'p4 help maxscanrows'.", LimitMaxScanRows},
+		{"Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'.", LimitMaxLockTime},
+		{"Command has exceeded its maximum memory limit (over 2048 MB); see 'p4 help maxmemory'.", LimitMaxMemory},
+		{"Opening too many files (over 1000); see 'p4 help maxopenfiles'.", LimitMaxOpenFiles},
+		{"//depot/... - no such file(s).", ""},
+	} {
+		assert.Equal(t, tc.limit, limitExceeded(tc.text), tc.text)
+	}
+
+	testInput := `
+Perforce server info:
+	2019/12/20 09:42:15 pid 25883 user1@ws1 10.1.3.158 [p4/2019.2/LINUX26X86_64/1891638] 'user-files //...'
+
+Perforce server error:
+	Date 2019/12/20 09:42:16:
+	Pid 25883
+	Operation: user-files
+	Too many rows scanned (over 10000000); see 'p4 help maxscanrows'.
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"errorSeverity":"error"`)
+	assert.Contains(t, output[0], `"limitExceeded":"MaxScanRows"`)
+}
+
+func TestKillReason(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		reason string
+	}{
+		{"Command terminated by 'p4 monitor terminate'.", KillReasonTerminated},
+		{"Operation 'user-fstat' failed.\nToo many commands paused;  terminated.", KillReasonPaused},
+		{"Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'.", LimitMaxLockTime},
+		{"Request too large (over 500000); see 'p4 help maxresults'.", LimitMaxResults},
+		{"Change 1234 unknown.", ""},
+	} {
+		assert.Equal(t, tc.reason, killReason(tc.text), tc.text)
+	}
+
+	testInput := `
+Perforce server info:
+	2019/12/20 09:42:15 pid 25883 user1@ws1 10.1.3.158 [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //...'
+
+Perforce server error:
+	Date 2019/12/20 09:42:20:
+	Pid 25883
+	Operation: user-sync
+	Command terminated by 'p4 monitor terminate'.
+
+Perforce server info:
+	2019/12/20 09:42:21 pid 25884 user1@ws1 10.1.3.158 [p4/2019.2/LINUX26X86_64/1891638] 'user-files //...'
+
+Perforce server error:
+	Date 2019/12/20 09:42:22:
+	Pid 25884
+	Operation: user-files
+	Request too large (over 500000); see 'p4 help maxresults'.
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 2, len(output))
+	sort.Strings(output) // By processKey
+	assert.Contains(t, output[1], `"errorText":"Command terminated by 'p4 monitor terminate'.","errorSeverity":"fatal","errorCount":1,"errors":[{"lineNo":5,"text":"Command terminated by 'p4 monitor terminate'."}],"killed":true,"killReason":"terminated"`)
+	assert.Contains(t, output[0], `"limitExceeded":"MaxResults","killed":true,"killReason":"MaxResults"`)
+}
+
 func TestIDLEErrors(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -686,8 +844,15 @@ Perforce server info:
 Perforce server info:
 	2020/01/11 02:04:01 pid 26617 git-fusion-user@git-fusion--gfprod3-8dd305d0-3459-11ea-a8b4-0050568421b4 10.5.40.30 [Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)] 'IDLE' exited unexpectedly, removed from monitor table.
 `
-	output := parseLogLines(testInput)
-	assert.Equal(t, 0, len(output))
+	fp := NewP4dFileParser(nil)
+	output := parseLogLinesWithParser(fp, testInput)
+	// Server events rather than commands
+	assert.Equal(t, 2, len(output))
+	assert.JSONEq(t, cleanJSON(`{"eventTime":"2020-01-11T02:01:01Z", "lineNo":2, "removedPid":25601, "removedUser":"swarm", "removedCmd":"IDLE"}`),
+		cleanJSON(output[0]))
+	assert.JSONEq(t, cleanJSON(`{"eventTime":"2020-01-11T02:04:01Z", "lineNo":5, "removedPid":26617, "removedUser":"git-fusion-user", "removedCmd":"IDLE"}`),
+		cleanJSON(output[1]))
+	assert.Equal(t, int64(2), fp.MonitorRemovedCount())
 }
 
 func TestServerActiveThreads(t *testing.T) {
@@ -708,9 +873,9 @@ Perforce server info:
 	// assert.Equal(t, "", output[0])
 	assert.JSONEq(t, cleanJSON(`{"activeThreads":148, "activeThreadsMax":148, "eventTime":"2020-01-11T02:00:05Z", "lineNo":6}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"33ac9675a65f8c437998987e55c11f9f","cmd":"pull","pid":6170,"lineNo":7,"user":"svc_wok","workspace":"unknown","ip":"background","app":"p4d/2019.2/LINUX26X86_64/1891638","args":"-i 1","startTime":"2020/01/11 02:00:06","endTime":"2020/01/11 02:00:06","running":148,"cmdError":false,"tables":[{"tableName":"view","pagesIn":2,"pagesOut":3,"pagesCached":96,"readLocks":4,"writeLocks":5,"getRows":6,"posRows":7,"scanRows":8,"putRows":9,"delRows":10}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"33ac9675a65f8c437998987e55c11f9f","cmd":"pull","pid":6170,"lineNo":7,"user":"svc_wok","workspace":"unknown","ip":"background","app":"p4d/2019.2/LINUX26X86_64/1891638","args":"-i 1","startTime":"2020/01/11 02:00:06","endTime":"2020/01/11 02:00:06","running":148,"runningPeak":148,"cmdError":false,"tables":[{"tableName":"view","pagesIn":2,"pagesOut":3,"pagesCached":96,"readLocks":4,"writeLocks":5,"getRows":6,"posRows":7,"scanRows":8,"putRows":9,"delRows":10}]}`),
 		cleanJSON(output[1]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"7c437167b3eef0a81ba6ecb710ad7572","cmd":"user-serverid","pid":25396,"lineNo":2,"user":"p4sdp","workspace":"chi","completedLapse":0.008,"ip":"127.0.0.1","app":"p4/2019.2/LINUX26X86_64/1891638","args":"","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"diskOut":8,"maxRss":7632,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7c437167b3eef0a81ba6ecb710ad7572","cmd":"user-serverid","pid":25396,"lineNo":2,"user":"p4sdp","workspace":"chi","completedLapse":0.008,"ip":"127.0.0.1","app":"p4/2019.2/LINUX26X86_64/1891638","args":"","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"runningPeak":1,"diskOut":8,"maxRss":7632,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[2]))
 }
 
@@ -815,7 +980,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"026c2d4135085764d23fd21f41d30f77","cmd":"user-sync","pid":145941,"lineNo":2,"user":"builder","workspace":"LON","computeLapse":0.11,"completedLapse":0.111,"ip":"10.10.16.171/10.10.20.195","app":"AutoWorker/1.0.0.0","args":"//assets/level/instances.xml","startTime":"2017/12/07 15:00:01","endTime":"2017/12/07 15:00:01","running":1,"uCpu":77,"sCpu":25,"diskIn":112,"diskOut":3136,"maxRss":4964,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"026c2d4135085764d23fd21f41d30f77","cmd":"user-sync","pid":145941,"lineNo":2,"user":"builder","workspace":"LON","computeLapse":0.11,"completedLapse":0.111,"ip":"10.10.16.171/10.10.20.195","app":"AutoWorker/1.0.0.0","args":"//assets/level/instances.xml","startTime":"2017/12/07 15:00:01","endTime":"2017/12/07 15:00:01","running":1,"runningPeak":1,"uCpu":77,"sCpu":25,"diskIn":112,"diskOut":3136,"maxRss":4964,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -898,7 +1063,7 @@ locks acquired by blocking after 3 non-blocking attempts
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"f7d483631e94d16adde6c5306be15fbe","cmd":"user-revert","pid":22245,"lineNo":2,"user":"auto","workspace":"archive_auto","completedLapse":6.92,"ip":"127.0.0.1","app":"archive/v60","args":"/usr/local/arch/datastore/...","startTime":"2018/09/06 06:00:02","endTime":"2018/09/06 06:00:02","running":1,"uCpu":6901,"sCpu":4,"diskIn":32,"diskOut":8,"maxRss":19996,"cmdError":false,"tables":[{"tableName":"protect","totalReadWait":4,"totalReadHeld":6875,"totalWriteWait":5,"totalWriteHeld":6},{"tableName":"resolve","totalReadWait":23792,"totalReadHeld":3,"totalWriteWait":2,"totalWriteHeld":1,"maxReadWait":23792,"maxReadHeld":3,"maxWriteWait":2,"maxWriteHeld":1}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"f7d483631e94d16adde6c5306be15fbe","cmd":"user-revert","pid":22245,"lineNo":2,"user":"auto","workspace":"archive_auto","completedLapse":6.92,"ip":"127.0.0.1","app":"archive/v60","args":"/usr/local/arch/datastore/...","startTime":"2018/09/06 06:00:02","endTime":"2018/09/06 06:00:02","running":1,"runningPeak":1,"uCpu":6901,"sCpu":4,"diskIn":32,"diskOut":8,"maxRss":19996,"cmdError":false,"tables":[{"tableName":"protect","totalReadWait":4,"totalReadHeld":6875,"totalWriteWait":5,"totalWriteHeld":6},{"tableName":"resolve","totalReadWait":23792,"totalReadHeld":3,"totalWriteWait":2,"totalWriteHeld":1,"maxReadWait":23792,"maxReadHeld":3,"maxWriteWait":2,"maxWriteHeld":1}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -958,11 +1123,11 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 3, len(output))
 	//assert.Equal(t, "", output[2])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"b9ec8da8ea642419a06f8ac4060f261c","cmd":"rmt-Journal","pid":17916,"lineNo":4,"user":"svc_p4d_ha_chi","workspace":"unknown","completedLapse":0.202,"ip":"10.5.70.41","app":"p4d/2019.2/LINUX26X86_64/1908095","args":"","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:16","running":2,"rpcMsgsOut":1,"rpcHimarkFwd":280100,"rpcHimarkRev":278660,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesCached":2,"readLocks":6,"getRows":6}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"b9ec8da8ea642419a06f8ac4060f261c","cmd":"rmt-Journal","pid":17916,"lineNo":4,"user":"svc_p4d_ha_chi","workspace":"unknown","completedLapse":0.202,"ip":"10.5.70.41","app":"p4d/2019.2/LINUX26X86_64/1908095","args":"","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:16","running":2,"runningPeak":2,"rpcMsgsOut":1,"rpcHimarkFwd":280100,"rpcHimarkRev":278660,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesCached":2,"readLocks":6,"getRows":6}]}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"b9ec8da8ea642419a06f8ac4060f261c.12","cmd":"rmt-Journal","pid":17916,"lineNo":12,"user":"svc_p4d_ha_chi","workspace":"unknown","completedLapse":0.001,"ip":"10.5.70.41","app":"p4d/2019.2/LINUX26X86_64/1908095","args":"","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:16","running":2,"rpcMsgsOut":1,"rpcHimarkFwd":280100,"rpcHimarkRev":278660,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":1,"pagesCached":2,"readLocks":1,"getRows":1}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"b9ec8da8ea642419a06f8ac4060f261c.12","cmd":"rmt-Journal","pid":17916,"lineNo":12,"user":"svc_p4d_ha_chi","workspace":"unknown","completedLapse":0.001,"ip":"10.5.70.41","app":"p4d/2019.2/LINUX26X86_64/1908095","args":"","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:16","running":2,"runningPeak":2,"rpcMsgsOut":1,"rpcHimarkFwd":280100,"rpcHimarkRev":278660,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":1,"pagesCached":2,"readLocks":1,"getRows":1}]}`),
 		cleanJSON(output[1]))
-	assert.JSONEq(t, cleanJSON(`{"processKey":"b9f9aee10027df004a0e35a3c9931e27","cmd":"user-change","pid":15855,"lineNo":2,"user":"fred","workspace":"fred_ws","completedLapse":0.276,"ip":"10.1.4.213/10.1.3.243","app":"Helix P4V/NTX64/2019.2/1904275/v86","args":"-i","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:17","running":1,"uCpu":4,"sCpu":4,"diskIn":256,"diskOut":240,"maxRss":9212,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcHimarkFwd":280100,"rpcHimarkRev":280100,"rpcRcv":0.19,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":7,"pagesOut":6,"pagesCached":2,"readLocks":1,"writeLocks":2,"getRows":3,"putRows":2},{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":256,"writeLocks":2,"putRows":2},{"tableName":"protect","pagesIn":9,"pagesCached":7,"readLocks":1,"posRows":1,"scanRows":345,"peekCount":1},{"tableName":"storagemasterup_R","totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4},{"tableName":"storageup_R","totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4},{"tableName":"trigger_swarm.changesave","triggerLapse":0.076}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"b9f9aee10027df004a0e35a3c9931e27","cmd":"user-change","pid":15855,"lineNo":2,"user":"fred","workspace":"fred_ws","completedLapse":0.276,"ip":"10.1.4.213/10.1.3.243","app":"Helix P4V/NTX64/2019.2/1904275/v86","args":"-i","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:17","running":1,"runningPeak":2,"uCpu":4,"sCpu":4,"diskIn":256,"diskOut":240,"maxRss":9212,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcHimarkFwd":280100,"rpcHimarkRev":280100,"rpcRcv":0.19,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":7,"pagesOut":6,"pagesCached":2,"readLocks":1,"writeLocks":2,"getRows":3,"putRows":2},{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":256,"writeLocks":2,"putRows":2},{"tableName":"protect","pagesIn":9,"pagesCached":7,"readLocks":1,"posRows":1,"scanRows":345,"peekCount":1},{"tableName":"trigger_swarm.changesave","triggerLapse":0.076,"triggerStage":"changesave"}], "serializedLocks":[{"name":"storagemasterup","mode":"R","totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4}, {"name":"storageup","mode":"R","totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4}]}`),
 		cleanJSON(output[2]))
 }
 
@@ -975,7 +1140,7 @@ lapse .079s
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","ip":"10.1.20.80","app":"robomerge/v717","args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"cmdError":false,"tables":[{"tableName":"trigger_swarm.commit","triggerLapse":0.079}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","ip":"10.1.20.80","app":"robomerge/v717","args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"runningPeak":1,"cmdError":false,"tables":[{"tableName":"trigger_swarm.commit","triggerLapse":0.079,"triggerStage":"commit"}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -988,7 +1153,7 @@ lapse 1.39s
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","ip":"10.1.20.80","app":"robomerge/v717","args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"cmdError":false,"tables":[{"tableName":"trigger_swarm.strict","triggerLapse":1.39}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","ip":"10.1.20.80","app":"robomerge/v717","args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"runningPeak":1,"cmdError":false,"tables":[{"tableName":"trigger_swarm.strict","triggerLapse":1.39,"triggerStage":"strict"}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -1009,7 +1174,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"lbrRcsOpens":1,"lbrRcsExists":4,"lbrRcsReads":6,"lbrRcsReadBytes":12390,"lbrRcsWriteBytes":3379,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"lbrRcsOpens":1,"lbrRcsExists":4,"lbrRcsReads":6,"lbrRcsReadBytes":12390,"lbrRcsWriteBytes":3379,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -1030,7 +1195,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"lbrCompressOpens":6,"lbrCompressCloses":4,"lbrCompressCheckins":2,"lbrCompressExists":5,"lbrCompressReads":3,"lbrCompressReadBytes":13623389302292480,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"lbrCompressOpens":6,"lbrCompressCloses":4,"lbrCompressCheckins":2,"lbrCompressExists":5,"lbrCompressReads":3,"lbrCompressReadBytes":13623389302292480,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -1051,7 +1216,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"lbrUncompressOpens":1,"lbrUncompressCloses":2,"lbrUncompressCheckins":3,"lbrUncompressExists":4,"lbrUncompressReads":6,"lbrUncompressWriteBytes":4198,"cmdError":false,"tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"f00da0667f738b28e706360f6997741e","cmd":"user-files","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","completedLapse":2.02,"ip":"10.40.16.14","app":"3DSMax/1.0.0.0","args":"//depot/....3ds","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:23","running":1,"runningPeak":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"lbrUncompressOpens":1,"lbrUncompressCloses":2,"lbrUncompressCheckins":3,"lbrUncompressExists":4,"lbrUncompressReads":6,"lbrUncompressWriteBytes":4198,"cmdError":false,"tables":[]}`),
 		cleanJSON(output[0]))
 }
 
@@ -1088,7 +1253,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"c64b38c5e71582bd477ffcaab5b3514d","cmd":"user-transmit","pid":1871637,"lineNo":2,"user":"build","workspace":"cmdr-tools-change-155476395","completedLapse":0.011,"ip":"127.0.0.1/10.5.64.108","app":"p4/2018.1/LINUX26X86_64/1957529 (brokered)","args":"-t1871630 -b8 -s524288 -p","startTime":"2023/07/01 02:00:02","endTime":"2023/07/01 02:00:02","running":1,"uCpu":5,"sCpu":4,"diskOut":8,"maxRss":10364,"memMB":25,"memPeakMB":26,"rpcMsgsIn":2,"rpcMsgsOut":74,"rpcHimarkFwd":97604,"rpcHimarkRev":318788,"rpcRcv":0.001,"lbrRcsOpens":8,"lbrRcsCloses":8,"lbrRcsReads":16,"lbrRcsReadBytes":202547,"lbrRcsDigests":1,"lbrRcsFileSizes":2,"lbrRcsModTimes":3,"lbrRcsCopies":4,"lbrCompressOpens":16,"lbrCompressCloses":16,"lbrCompressReads":32,"lbrCompressReadBytes":142028,"cmdError":false,"tables":[{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":4096,"writeLocks":2,"putRows":2,"totalWriteWait":1,"maxWriteWait":1},{"tableName":"topology","pagesIn":5,"pagesCached":4,"readLocks":1,"posRows":1,"scanRows":1}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"c64b38c5e71582bd477ffcaab5b3514d","cmd":"user-transmit","pid":1871637,"lineNo":2,"user":"build","workspace":"cmdr-tools-change-155476395","completedLapse":0.011,"ip":"127.0.0.1/10.5.64.108","app":"p4/2018.1/LINUX26X86_64/1957529 (brokered)","args":"-t1871630 -b8 -s524288 -p","startTime":"2023/07/01 02:00:02","endTime":"2023/07/01 02:00:02","running":1,"runningPeak":1,"uCpu":5,"sCpu":4,"diskOut":8,"maxRss":10364,"memMB":25,"memPeakMB":26,"rpcMsgsIn":2,"rpcMsgsOut":74,"rpcHimarkFwd":97604,"rpcHimarkRev":318788,"rpcRcv":0.001,"lbrRcsOpens":8,"lbrRcsCloses":8,"lbrRcsReads":16,"lbrRcsReadBytes":202547,"lbrRcsDigests":1,"lbrRcsFileSizes":2,"lbrRcsModTimes":3,"lbrRcsCopies":4,"lbrCompressOpens":16,"lbrCompressCloses":16,"lbrCompressReads":32,"lbrCompressReadBytes":142028,"cmdError":false,"tables":[{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":4096,"writeLocks":2,"putRows":2,"totalWriteWait":1,"maxWriteWait":1},{"tableName":"topology","pagesIn":5,"pagesCached":4,"readLocks":1,"posRows":1,"scanRows":1}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -1219,7 +1384,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"processKey":"adb2b3c890b15d59f748c064e2c181b6","cmd":"user-changes","pid":5032,"lineNo":2,"user":"fred","workspace":"fred-Dinner-dev","computeLapse":60.9,"completedLapse":60.9,"ip":"10.1.2.212","app":"UnrealGameSync/v84","args":"-m1 -ssubmitted //fred-Dinner-dev/*.cs@\u003c=764311 //fred-Dinner-dev/Engine/....cs@\u003c=764311 //fred-Dinner-dev/Dinner/....cs@\u003c=764311","startTime":"2024/04/03 12:20:14","endTime":"2024/04/03 12:21:15","running":1,"memMB":8,"memPeakMB":442,"rpcMsgsOut":12,"rpcHimarkFwd":64836,"rpcHimarkRev":523588,"cmdError":false,"tables":[{"tableName":"change","pagesIn":35,"pagesCached":10,"posRows":12,"scanRows":12,"peekCount":21,"totalPeekHeld":60953,"maxPeekHeld":34390},{"tableName":"rev","pagesIn":1558725,"pagesCached":96,"posRows":56,"scanRows":22442266,"peekCount":21,"totalPeekHeld":60953,"maxPeekHeld":34390}]}`),
+	assert.JSONEq(t, cleanJSON(`{"processKey":"adb2b3c890b15d59f748c064e2c181b6","cmd":"user-changes","pid":5032,"lineNo":2,"user":"fred","workspace":"fred-Dinner-dev","computeLapse":60.9,"completedLapse":60.9,"ip":"10.1.2.212","app":"UnrealGameSync/v84","args":"-m1 -ssubmitted //fred-Dinner-dev/*.cs@\u003c=764311 //fred-Dinner-dev/Engine/....cs@\u003c=764311 //fred-Dinner-dev/Dinner/....cs@\u003c=764311","startTime":"2024/04/03 12:20:14","endTime":"2024/04/03 12:21:15","running":1,"runningPeak":1,"memMB":8,"memPeakMB":442,"rpcMsgsOut":12,"rpcHimarkFwd":64836,"rpcHimarkRev":523588,"cmdError":false,"tables":[{"tableName":"change","pagesIn":35,"pagesCached":10,"posRows":12,"scanRows":12,"peekCount":21,"totalPeekHeld":60953,"maxPeekHeld":34390},{"tableName":"rev","pagesIn":1558725,"pagesCached":96,"posRows":56,"scanRows":22442266,"peekCount":21,"totalPeekHeld":60953,"maxPeekHeld":34390}]}`),
 		cleanJSON(output[0]))
 }
 
@@ -1240,11 +1405,15 @@ Perforce server info:
 Perforce server info:
 	2024/06/10 08:09:02 pid 2064774 unknown@unknown 127.0.0.1 [unknown] 'Init()' exited unexpectedly, removed from monitor table.
 `
-	output := parseLogLines(testInput)
-	assert.Equal(t, 1, len(output))
-	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"app":"p4/2024.1.PREP-TEST_ONLY/LINUX26X86_64/2589505", "args":"", "cmd":"user-counters", "cmdError":true, "completedLapse":0.005, "diskOut":8, "endTime":"2024/06/10 08:08:01", "ip":"127.0.0.1", "lineNo":2, "maxRss":11896, "memMB":28, "memPeakMB":28, "pid":2.064774e+06, "processKey":"6b134fc7c84aa5d25dcaa814e13a7848", "rpcHimarkFwd":97604, "rpcHimarkRev":97604, "rpcMsgsIn":2, "rpcMsgsOut":40, "running":1, "sCpu":5, "startTime":"2024/06/10 08:08:01", "user":"p4sdp", "workspace":"p4svr","tables":[]}`),
+	fp := NewP4dFileParser(nil)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	// The earlier command with the same pid is not updated
+	assert.JSONEq(t, cleanJSON(`{"eventTime":"2024-06-10T08:09:02Z", "lineNo":14, "removedPid":2064774, "removedUser":"unknown", "removedCmd":"Init()"}`),
 		cleanJSON(output[0]))
+	assert.JSONEq(t, cleanJSON(`{"app":"p4/2024.1.PREP-TEST_ONLY/LINUX26X86_64/2589505", "args":"", "cmd":"user-counters", "cmdError":false, "completedLapse":0.005, "diskOut":8, "endTime":"2024/06/10 08:08:01", "ip":"127.0.0.1", "lineNo":2, "maxRss":11896, "memMB":28, "memPeakMB":28, "pid":2.064774e+06, "processKey":"6b134fc7c84aa5d25dcaa814e13a7848", "rpcHimarkFwd":97604, "rpcHimarkRev":97604, "rpcMsgsIn":2, "rpcMsgsOut":40, "running":1,"runningPeak":1, "sCpu":5, "startTime":"2024/06/10 08:08:01", "user":"p4sdp", "workspace":"p4svr","tables":[]}`),
+		cleanJSON(output[1]))
+	assert.Equal(t, int64(1), fp.MonitorRemovedCount())
 }
 
 func TestRemovedFromMonitorTable2(t *testing.T) {
@@ -1273,13 +1442,47 @@ Perforce server info:
 
 Perforce server info:
 	2024/06/10 06:13:02 pid 1837049 git-fusion-user@git-fusion--gfprod3-076a3fa2-272b-11ef-8240-0050568421b4 10.5.40.30 [Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)] 'IDLE' exited unexpectedly, removed from monitor table.`
-	output := parseLogLines(testInput)
-	assert.Equal(t, 2, len(output))
-	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"app":"Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)", "args":"git-fusion-auth-keys-last-changenum-gfprod3", "cmd":"user-key", "cmdError":false, "completedLapse":0.002, "diskOut":8, "endTime":"2024/06/10 06:12:03", "ip":"127.0.0.1/10.5.40.30", "lineNo":2, "maxRss":13876, "memMB":30, "memPeakMB":30, "pid":1.837049e+06, "processKey":"e60035bfd064b9c153c732d3b6a9206a", "rpcHimarkFwd":97604, "rpcHimarkRev":318788, "rpcMsgsOut":1, "running":1, "sCpu":1, "startTime":"2024/06/10 06:12:03", "uCpu":1, "user":"git-fusion-user", "workspace":"git-fusion--gfprod3-076a3fa2-272b-11ef-8240-0050568421b4","tables":[]}`),
+	fp := NewP4dFileParser(nil)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 3, len(output))
+	assert.JSONEq(t, cleanJSON(`{"eventTime":"2024-06-10T06:13:02Z", "lineNo":24, "activeThreads":1, "activeThreadsMax":1, "removedPid":1837049, "removedUser":"git-fusion-user", "removedCmd":"IDLE"}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"app":"Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)", "args":"git-fusion-auth-keys-last-changenum-gfprod3", "cmd":"user-key", "cmdError":true, "endTime":"2024/06/10 06:12:03", "ip":"127.0.0.1/10.5.40.30", "lineNo":14, "pid":1.837049e+06, "processKey":"e60035bfd064b9c153c732d3b6a9206a.14", "running":1, "startTime":"2024/06/10 06:12:03", "user":"git-fusion-user", "workspace":"git-fusion--gfprod3-076a3fa2-272b-11ef-8240-0050568421b4", "tables":[]}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)", "args":"git-fusion-auth-keys-last-changenum-gfprod3", "cmd":"user-key", "cmdError":false, "completedLapse":0.002, "diskOut":8, "endTime":"2024/06/10 06:12:03", "ip":"127.0.0.1/10.5.40.30", "lineNo":2, "maxRss":13876, "memMB":30, "memPeakMB":30, "pid":1.837049e+06, "processKey":"e60035bfd064b9c153c732d3b6a9206a", "rpcHimarkFwd":97604, "rpcHimarkRev":318788, "rpcMsgsOut":1, "running":1,"runningPeak":1, "sCpu":1, "startTime":"2024/06/10 06:12:03", "uCpu":1, "user":"git-fusion-user", "workspace":"git-fusion--gfprod3-076a3fa2-272b-11ef-8240-0050568421b4","tables":[]}`),
 		cleanJSON(output[1]))
+	// Completed by the IDLE record for the same pid, but not otherwise updated (e.g. marked as failed)
+	assert.JSONEq(t, cleanJSON(`{"app":"Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)", "args":"git-fusion-auth-keys-last-changenum-gfprod3", "cmd":"user-key", "cmdError":false, "endReason":"monitor_removed", "endTime":"2024/06/10 06:13:02", "ip":"127.0.0.1/10.5.40.30", "lineNo":14, "pid":1.837049e+06, "processKey":"e60035bfd064b9c153c732d3b6a9206a.14", "running":1,"runningPeak":1, "startTime":"2024/06/10 06:12:03", "user":"git-fusion-user", "workspace":"git-fusion--gfprod3-076a3fa2-272b-11ef-8240-0050568421b4", "tables":[]}`),
+		cleanJSON(output[2]))
+	assert.Equal(t, int64(1), fp.MonitorRemovedCount())
+}
+
+// A command still running when its thread is removed from the monitor table is completed, and no longer counted as running
+func TestMonitorRemovedRunning(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2024/06/10 06:12:03 pid 1837049 fred@fred_ws 10.5.40.30 [p4/2024.1/LINUX26X86_64/2596290] 'user-sync //...'
+
+Perforce server info:
+	2024/06/10 06:13:02 pid 1837049 fred@fred_ws 10.5.40.30 [p4/2024.1/LINUX26X86_64/2596290] 'IDLE' exited unexpectedly, removed from monitor table.
+
+Perforce server info:
+	2024/06/10 06:14:02 pid 1837050 bob@bob_ws 10.5.40.31 [p4/2024.1/LINUX26X86_64/2596290] 'user-info'
+Perforce server info:
+	2024/06/10 06:14:02 pid 1837050 completed .002s
+Perforce server info:
+	2024/06/10 06:14:09 pid 1837051 bob@bob_ws 10.5.40.31 [p4/2024.1/LINUX26X86_64/2596290] 'user-info'
+`
+	fp := NewP4dFileParser(nil)
+	output := parseLogLinesWithParser(fp, testInput)
+	if !assert.Equal(t, 4, len(output)) {
+		return
+	}
+	assert.Contains(t, output[0], `"removedPid":1837049`)
+	// Output once the log has moved on, rather than at the end
+	assert.Contains(t, output[1], `"cmd":"user-sync"`)
+	assert.Contains(t, output[1], `"endTime":"2024/06/10 06:13:02"`)
+	assert.Contains(t, output[1], `"cmdError":false,"endReason":"monitor_removed"`)
+	assert.Contains(t, output[2], `"lineNo":8,`)
+	assert.Contains(t, output[2], `"running":1,`)
 }
 
 func TestTriggerLapse(t *testing.T) {
@@ -1314,7 +1517,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"app":"p4jobdt/v93 (brokered)", "args":"-i", "cmd":"user-job", "cmdError":false, "completedLapse":0.216, "diskIn":288, "diskOut":712, "endTime":"2024/06/09 22:16:38", "ip":"127.0.0.1/10.5.53.61", "lineNo":2, "maxRss":18476, "memMB":31, "memPeakMB":32, "pid":485300, "processKey":"f59cacda1499ad10dd54d6fae994530b", "running":1, "sCpu":10, "startTime":"2024/06/09 22:16:38", "tables":[{"tableName":"storagemasterup_R", "totalReadHeld":60}, {"tableName":"storageup_R", "totalReadHeld":60}, {"tableName":"trigger_JIRAUpdater", "triggerLapse":0.149}, {"tableName":"trigger_swarm", "triggerLapse":0.044}], "uCpu":38, "user":"p4dtguser", "workspace":"p4dtgprod20"}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"p4jobdt/v93 (brokered)", "args":"-i", "cmd":"user-job", "cmdError":false, "completedLapse":0.216, "diskIn":288, "diskOut":712, "endTime":"2024/06/09 22:16:38", "ip":"127.0.0.1/10.5.53.61", "lineNo":2, "maxRss":18476, "memMB":31, "memPeakMB":32, "pid":485300, "processKey":"f59cacda1499ad10dd54d6fae994530b", "running":1,"runningPeak":1, "sCpu":10, "startTime":"2024/06/09 22:16:38", "tables":[{"tableName":"trigger_JIRAUpdater", "triggerLapse":0.149}, {"tableName":"trigger_swarm", "triggerLapse":0.044}], "serializedLocks":[{"name":"storagemasterup","mode":"R", "totalReadHeld":60}, {"name":"storageup","mode":"R", "totalReadHeld":60}], "uCpu":38, "user":"p4dtguser", "workspace":"p4dtgprod20"}`),
 		cleanJSON(output[0]))
 }
 
@@ -1338,8 +1541,313 @@ Perforce server info:
 	// assert.Equal(t, "", output[0])
 	assert.JSONEq(t, cleanJSON(`{"activeThreads":1, "activeThreadsMax":1, "eventTime":"2024-06-19T12:25:31Z", "lineNo":4, "pausedThreads":10, "pausedThreadsMax":10}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"app":"p4/2024.1.TEST-TEST_ONLY/LINUX26X86_64/2611120", "args":"-Ob //...", "cmd":"user-fstat", "cmdError":false, "completedLapse":8.39, "diskIn":304, "endTime":"2024/06/19 12:25:39", "ip":"127.0.0.1", "lineNo":2, "maxRss":68864, "memMB":74, "memPeakMB":74, "paused":1.2, "pid":1.056864e+06, "processKey":"861c79f6f864bc6cfd2aa3d0ba35952e", "rpcHimarkFwd":795416, "rpcHimarkRev":795272, "rpcMsgsIn":2, "rpcMsgsOut":84225, "rpcRcv":0.002, "rpcSizeOut":45, "rpcSnd":5.64, "running":1, "sCpu":67, "startTime":"2024/06/19 12:25:31", "tables":[], "uCpu":598, "user":"perforce", "workspace":"ip-10-0-0-106"}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"p4/2024.1.TEST-TEST_ONLY/LINUX26X86_64/2611120", "args":"-Ob //...", "cmd":"user-fstat", "cmdError":false, "completedLapse":8.39, "diskIn":304, "endTime":"2024/06/19 12:25:39", "ip":"127.0.0.1", "lineNo":2, "maxRss":68864, "memMB":74, "memPeakMB":74, "paused":1.2, "pid":1.056864e+06, "processKey":"861c79f6f864bc6cfd2aa3d0ba35952e", "rpcHimarkFwd":795416, "rpcHimarkRev":795272, "rpcMsgsIn":2, "rpcMsgsOut":84225, "rpcRcv":0.002, "rpcSizeOut":45, "rpcSnd":5.64, "running":1,"runningPeak":1, "sCpu":67, "startTime":"2024/06/19 12:25:31", "tables":[], "uCpu":598, "user":"perforce", "workspace":"ip-10-0-0-106"}`),
+		cleanJSON(output[1]))
+}
+
+// Servers with track=0 (but vtrack) log table lock summaries without lapse/usage/rpc lines
+func TestTrackLocksOnly(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //...'
+Perforce server info:
+	2024/01/02 10:00:01 pid 100 completed 1.045s
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //...'
+--- db.have
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+---   total lock wait+held read/write 12ms+13ms/14ms+15ms
+---   max lock wait+held read/write 32ms+33ms/34ms+35ms
+
+Perforce server info:
+	2024/01/02 10:00:02 pid 101 user2@ws2 10.0.0.2 [p4/2019.2/LINUX26X86_64/1891638] 'user-fstat //b/...'
+
+Perforce server info:
+	2024/01/02 10:00:02 pid 101 user2@ws2 10.0.0.2 [p4/2019.2/LINUX26X86_64/1891638] 'user-fstat //b/...'
+--- db.rev
+---   total lock wait+held read/write 0ms+20ms/0ms+0ms
+---   max lock wait+held read/write 0ms+20ms/0ms+0ms
+`
+	fp := NewP4dFileParser(logrus.New())
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"0ad2fc622050f21f58af2ed3d6d5fd18","cmd":"user-sync","pid":100,"lineNo":2,"user":"user1","workspace":"ws1","completedLapse":1.045,"ip":"10.0.0.1","app":"p4/2019.2/LINUX26X86_64/1891638","args":"//...","startTime":"2024/01/02 10:00:00","endTime":"2024/01/02 10:00:01","running":1,"runningPeak":1,"cmdError":false,
+		"tables":[{"tableName":"have","readLocks":4,"writeLocks":5,"getRows":6,"posRows":7,"scanRows":8,"putRows":9,"delRows":10,"totalReadWait":12,"totalReadHeld":13,"totalWriteWait":14,"totalWriteHeld":15,"maxReadWait":32,"maxReadHeld":33,"maxWriteWait":34,"maxWriteHeld":35}]}`),
+		cleanJSON(output[0]))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"3857954404757037f24dca62f79ba496","cmd":"user-fstat","pid":101,"lineNo":13,"user":"user2","workspace":"ws2","ip":"10.0.0.2","app":"p4/2019.2/LINUX26X86_64/1891638","args":"//b/...","startTime":"2024/01/02 10:00:02","endTime":"0001/01/01 00:00:00","running":1,"runningPeak":1,"cmdError":false,
+		"tables":[{"tableName":"rev","totalReadHeld":20,"maxReadHeld":20}]}`),
 		cleanJSON(output[1]))
+	assert.Equal(t, int64(2), fp.LocksOnlyTrackCount())
+
+	// Normal track output is not counted
+	fp = NewP4dFileParser(logrus.New())
+	parseLogLinesWithParser(fp, `
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-sync //...'
+--- lapse .045s
+--- usage 10+11us 12+13io 14+15net 4088k 0pf
+--- db.have
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+`)
+	assert.Equal(t, int64(0), fp.LocksOnlyTrackCount())
+}
+
+func TestProxyBrokerEvents(t *testing.T) {
+	testInput := `
+Perforce proxy info:
+	2024/01/02 10:00:00 pid 1234 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/...'
+--- lapse .041s
+--- proxytotals files/size svr+cache 1+3/512B+1.5K
+
+Perforce proxy info:
+	2024/01/02 10:00:01 pid 1235 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-info'
+
+Perforce broker info:
+	2024/01/02 10:00:02 pid 2345 fred@fred-ws 10.0.0.2 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/main/...'
+	action: REDIRECT target: replica1
+
+Perforce server info:
+	2024/01/02 10:00:03 pid 3456 fred@fred-ws 10.0.0.2 [p4/2023.2/LINUX26X86_64/2578891] 'user-info'
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 3, len(output))
+	assert.JSONEq(t, `{"lineNo":2,"startTime":"2024-01-02T10:00:00Z","pid":1234,"user":"bob","workspace":"bob-ws","ip":"10.0.0.1",`+
+		`"app":"p4/2023.2/LINUX26X86_64/2578891","cmd":"user-sync","args":"//depot/...","lapse":0.041,`+
+		`"filesServer":1,"filesCache":3,"bytesServer":512,"bytesCache":1536}`, output[1])
+	assert.JSONEq(t, `{"lineNo":10,"startTime":"2024-01-02T10:00:02Z","pid":2345,"user":"fred","workspace":"fred-ws","ip":"10.0.0.2",`+
+		`"app":"p4/2023.2/LINUX26X86_64/2578891","cmd":"user-sync","args":"//depot/main/...","action":"redirect","target":"replica1"}`, output[0])
+	assert.Contains(t, output[2], `"cmd":"user-info"`)
+	assert.Contains(t, output[2], `"pid":3456`)
+
+	p := ProxyEvent{FilesServer: 1, FilesCache: 3}
+	assert.Equal(t, 0.75, p.CacheHitRatio())
+}
+
+func TestDecodeJSONRecord(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2020/01/11 02:00:02 pid 25396 p4sdp@chi 127.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-serverid'
+Perforce server info:
+	2020/01/11 02:00:02 pid 25396 completed .008s 0+0us 0+8io 0+0net 7632k 0pf 
+2020/01/11 02:00:05 731966731 pid 24961: Server is now using 148 active threads.
+Perforce server info:
+	2020/01/11 02:00:06 pid 6170 svc_wok@unknown background [p4d/2019.2/LINUX26X86_64/1891638] 'pull -i 1'
+--- db.view
+---   pages in+out+cached 2+3+96
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+--- db.integed
+---   total lock wait+held read/write 0ms+0ms/0ms+795ms
+
+Perforce proxy info:
+	2024/01/02 10:00:00 pid 1234 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/...'
+--- lapse .041s
+--- proxytotals files/size svr+cache 1+3/512B+1.5K
+
+Perforce broker info:
+	2024/01/02 10:00:02 pid 2345 fred@fred-ws 10.0.0.2 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/main/...'
+	action: REDIRECT target: replica1
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 5, len(output))
+	for _, line := range output {
+		rec, err := DecodeJSONRecord([]byte(line))
+		assert.NoError(t, err)
+		var j []byte
+		switch r := rec.(type) {
+		case Command:
+			j, err = json.Marshal(&r)
+		case ServerEvent:
+			j, err = json.Marshal(&r)
+		case ProxyEvent:
+			j, err = json.Marshal(&r)
+		case BrokerEvent:
+			j, err = json.Marshal(&r)
+		default:
+			t.Fatalf("unexpected record %T for %s", rec, line)
+		}
+		assert.NoError(t, err)
+		assert.JSONEq(t, line, string(j))
+	}
+
+	rec, err := DecodeJSONRecord([]byte(`{"day":"2024-06-19","activeThreadsMax":8}`))
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+	rec, err = DecodeJSONRecord([]byte(`{"recordType":"serverEventDay","day":"2024/06/19","activeThreadsMax":8}`))
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+	_, err = DecodeJSONRecord([]byte(`{"processKey":"abc","startTime":"not a time"}`))
+	assert.Error(t, err)
+	_, err = DecodeJSONRecord([]byte(`Perforce server info:`))
+	assert.Error(t, err)
+}
+
+func TestBinaryRecords(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2020/01/11 02:00:06 pid 6170 svc_wok@unknown background [p4d/2019.2/LINUX26X86_64/1891638] 'pull -i 1'
+--- db.view
+---   pages in+out+cached 2+3+96
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+--- db.integed
+---   total lock wait+held read/write 0ms+0ms/0ms+795ms
+2020/01/11 02:00:05 731966731 pid 24961: Server is now using 148 active threads.
+
+Perforce proxy info:
+	2024/01/02 10:00:00 pid 1234 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/...'
+--- lapse .041s
+--- proxytotals files/size svr+cache 1+3/512B+1.5K
+
+Perforce broker info:
+	2024/01/02 10:00:02 pid 2345 fred@fred-ws 10.0.0.2 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/main/...'
+	action: REDIRECT target: replica1
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 4, len(output))
+	var buf bytes.Buffer
+	bw := NewBinaryRecordWriter(&buf)
+	for _, line := range output {
+		rec, err := DecodeJSONRecord([]byte(line))
+		assert.NoError(t, err)
+		assert.NoError(t, bw.Write(rec))
+	}
+	assert.NoError(t, bw.Write("ignored"))
+
+	br := NewBinaryRecordReader(&buf)
+	for _, line := range output {
+		rec, err := br.Read()
+		assert.NoError(t, err)
+		var j []byte
+		switch r := rec.(type) {
+		case Command:
+			j, err = json.Marshal(&r)
+		case ServerEvent:
+			j, err = json.Marshal(&r)
+		case ProxyEvent:
+			j, err = json.Marshal(&r)
+		case BrokerEvent:
+			j, err = json.Marshal(&r)
+		default:
+			t.Fatalf("unexpected record %T for %s", rec, line)
+		}
+		assert.NoError(t, err)
+		assert.JSONEq(t, line, string(j))
+	}
+	_, err := br.Read()
+	assert.Equal(t, io.EOF, err)
+
+	// Duplicate keys keep their line number suffix
+	buf.Reset()
+	bw = NewBinaryRecordWriter(&buf)
+	dup := &Command{ProcessKey: "4b2a9ea7", LineNo: 20, Pid: 4496, Cmd: "rmt-Journal", duplicateKey: true}
+	assert.NoError(t, bw.Write(dup))
+	rec, err := NewBinaryRecordReader(&buf).Read()
+	assert.NoError(t, err)
+	if cmd, ok := rec.(Command); assert.True(t, ok) {
+		assert.Equal(t, "4b2a9ea7.20", cmd.GetKey())
+	}
+}
+
+func TestCommandOrigin(t *testing.T) {
+	for _, c := range []struct {
+		cmd, ip, app, origin string
+	}{
+		{"user-sync", "10.1.2.3", "p4/2023.2/LINUX26X86_64/2578891", OriginDirect},
+		{"user-sync", "10.1.2.3/10.5.6.7", "p4/2023.2/LINUX26X86_64/2578891", OriginEdgeForwarded},
+		{"user-sync", "127.0.0.1/10.5.6.7", "p4/2023.2/LINUX26X86_64/2578891 (brokered)", OriginBrokered},
+		{"pull", "background", "p4d/2023.2/LINUX26X86_64/2578891", OriginBackground},
+		{"rmt-FileFetch", "10.5.6.7", "p4d/2023.2/LINUX26X86_64/2578891", OriginBackground},
+		{"rmt-Journal", "10.5.6.7", "", OriginBackground},
+	} {
+		cmd := Command{Cmd: c.cmd, IP: c.ip, App: c.app}
+		assert.Equal(t, c.origin, cmd.Origin(), "%s %s %s", c.cmd, c.ip, c.app)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	testInput := `Perforce server info:
+	2020/01/11 02:00:02 pid 25396 p4sdp@chi 127.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-serverid'
+Perforce server info:
+	2020/01/11 02:00:12 pid 25396 completed .008s 0+0us 0+8io 0+0net 7632k 0pf
+2020/01/11 02:00:05 731966731 pid 24961: Server is now using 148 active threads.
+Perforce server info:
+	2020/01/11 02:01:42 pid 6170 svc_wok@unknown background [p4d/2019.2/LINUX26X86_64/1891638] 'pull -i 1'`
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sleeps []time.Duration
+	r := &replayer{speed: 10, now: func() time.Time { return now },
+		sleep: func(ctx context.Context, d time.Duration) {
+			sleeps = append(sleeps, d)
+			now = now.Add(d)
+		}}
+	lines := strings.Split(testInput, "\n")
+	in := make(chan string, len(lines))
+	out := make(chan string, len(lines))
+	for _, l := range lines {
+		in <- l
+	}
+	close(in)
+	r.replay(context.Background(), in, out)
+	result := make([]string, 0)
+	for l := range out {
+		result = append(result, l)
+	}
+	assert.Equal(t, lines, result)
+	// 10s and then 100s of log at 10x - the line with an earlier time is not delayed
+	assert.Equal(t, []time.Duration{time.Second, 9 * time.Second}, sleeps)
+}
+
+func TestTypedServerEvents(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2024/01/02 10:00:00 pid 1234 Perforce Server starting 2023.2/LINUX26X86_64/2578891
+Perforce server info:
+	2024/01/02 10:00:01 pid 1240 fred@fred-ws 10.0.0.2 [p4/2023.2/LINUX26X86_64/2578891] 'user-info'
+2024/01/02 10:00:02 123456789 pid 1234: Licensed user count 95 is within 5 of the license limit
+2024/01/02 10:00:03 123456789 pid 1234: Server is now using 3 active threads.
+2024/01/02 10:00:04 123456789 pid 1234: Database upgrade to 2024.1 required
+Perforce server info:
+	2024/01/02 10:00:05 pid 1234 Server shutting down
+Perforce server info:
+	2024/01/02 10:00:06 pid 1235 Something else entirely
+`
+	fp := NewP4dFileParser(logrus.New())
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 6, len(output))
+	types := make(map[string]string)
+	for _, line := range output {
+		var evt ServerEvent
+		if strings.Contains(line, `"eventTime"`) {
+			assert.NoError(t, json.Unmarshal([]byte(line), &evt))
+			types[evt.EventTime.Format(p4timeformat)] = evt.EventType
+			if evt.EventType == EventTypeStartup {
+				assert.Equal(t, "Perforce Server starting 2023.2/LINUX26X86_64/2578891", evt.Message)
+				assert.Equal(t, int64(2), evt.LineNo)
+			} else if evt.EventType == "" {
+				assert.NotContains(t, line, "eventType") // Unchanged for thread counts
+			}
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"2024/01/02 10:00:00": EventTypeStartup,
+		"2024/01/02 10:00:02": EventTypeLicense,
+		"2024/01/02 10:00:03": "",
+		"2024/01/02 10:00:04": EventTypeUpgrade,
+		"2024/01/02 10:00:05": EventTypeShutdown,
+	}, types)
+	assert.Equal(t, int64(1), fp.Stats().UnrecognisedLines)
+}
+
+func TestServerEventDay(t *testing.T) {
+	evts := []ServerEvent{
+		{EventTime: time.Date(2024, 6, 19, 0, 0, 1, 0, time.UTC), ActiveThreads: 5, ActiveThreadsMax: 8, PausedThreads: 1},
+		{EventTime: time.Date(2024, 6, 19, 12, 0, 0, 0, time.UTC), ActiveThreads: 3, ActiveThreadsMax: 20, PausedThreads: 3, PausedThreadsMax: 3},
+		{EventTime: time.Date(2024, 6, 19, 23, 59, 59, 0, time.UTC), ActiveThreads: 12, ActiveThreadsMax: 12, PausedThreads: 0, PausedThreadsMax: 3},
+	}
+	d := &ServerEventDay{Day: evts[0].Day()}
+	for i := range evts {
+		assert.Equal(t, d.Day, evts[i].Day())
+		d.Update(&evts[i])
+	}
+	assert.JSONEq(t, `{"recordType":"serverEventDay", "day":"2024/06/19", "activeThreadsMax":12, "pausedThreadsMax":3}`, d.String())
 }
 
 func TestPauseError(t *testing.T) {
@@ -1367,7 +1875,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"app":"p4/2024.1.TEST-TEST_ONLY/LINUX26X86_64/2611120", "args":"-Ob //...", "cmd":"user-fstat", "cmdError":true, "completedLapse":8.39, "diskIn":304, "endTime":"2024/06/19 12:25:39", "ip":"127.0.0.1", "lineNo":2, "maxRss":68864, "memMB":74, "memPeakMB":74, "pid":1.056864e+06, "processKey":"861c79f6f864bc6cfd2aa3d0ba35952e", "rpcHimarkFwd":795416, "rpcHimarkRev":795272, "rpcMsgsIn":2, "rpcMsgsOut":84225, "rpcRcv":0.002, "rpcSizeOut":45, "rpcSnd":5.64, "running":1, "sCpu":67, "startTime":"2024/06/19 12:25:31", "tables":[], "uCpu":598, "user":"perforce", "workspace":"ip-10-0-0-106"}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"p4/2024.1.TEST-TEST_ONLY/LINUX26X86_64/2611120", "args":"-Ob //...", "cmd":"user-fstat", "cmdError":true, "errorSeverity":"fatal", "completedLapse":8.39, "diskIn":304, "endTime":"2024/06/19 12:25:39", "ip":"127.0.0.1", "lineNo":2, "maxRss":68864, "memMB":74, "memPeakMB":74, "pid":1.056864e+06, "processKey":"861c79f6f864bc6cfd2aa3d0ba35952e", "rpcHimarkFwd":795416, "rpcHimarkRev":795272, "rpcMsgsIn":2, "rpcMsgsOut":84225, "rpcRcv":0.002, "rpcSizeOut":45, "rpcSnd":5.64, "running":1,"runningPeak":1, "sCpu":67, "startTime":"2024/06/19 12:25:31", "tables":[], "uCpu":598, "user":"perforce", "workspace":"ip-10-0-0-106"}`),
 		cleanJSON(output[0]))
 }
 
@@ -1384,12 +1892,34 @@ func TestFileTotals(t *testing.T) {
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"app":"p4/2023.2/LINUX26X86_64/2605454", "args":"-f //depot/data/...", "cmd":"user-sync", "cmdError":false, "completedLapse":70.9, "diskIn":136024, "diskOut":176, "endTime":"2024/07/11 11:18:01", "fileTotalsRcv":1, "fileTotalsRcvMBytes":2, "fileTotalsSnd":25, "fileTotalsSndMBytes":1862, "ip":"127.0.0.1", "lineNo":1, "maxRss":15216, "memMB":5, "memPeakMB":5, "pid":3.433924e+06, "processKey":"06b672ec262cbfde8633bc759d498340", "rpcHimarkFwd":97604, "rpcHimarkRev":97604, "rpcMsgsIn":32, "rpcMsgsOut":29907, "rpcRcv":0.326, "rpcSizeOut":1863, "rpcSnd":58.5, "running":1, "sCpu":5907, "startTime":"2024/07/11 11:16:51", "tables":[], "uCpu":16270, "user":"bruno", "workspace":"bruno_ws"}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"p4/2023.2/LINUX26X86_64/2605454", "args":"-f //depot/data/...", "cmd":"user-sync", "cmdError":false, "completedLapse":70.9, "diskIn":136024, "diskOut":176, "endTime":"2024/07/11 11:18:01", "fileTotalsRcv":1, "fileTotalsRcvMBytes":2, "fileTotalsSnd":25, "fileTotalsSndMBytes":1862, "ip":"127.0.0.1", "lineNo":1, "maxRss":15216, "memMB":5, "memPeakMB":5, "pid":3.433924e+06, "processKey":"06b672ec262cbfde8633bc759d498340", "rpcHimarkFwd":97604, "rpcHimarkRev":97604, "rpcMsgsIn":32, "rpcMsgsOut":29907, "rpcRcv":0.326, "rpcSizeOut":1863, "rpcSnd":58.5, "running":1,"runningPeak":1, "sCpu":5907, "startTime":"2024/07/11 11:16:51", "tables":[], "uCpu":16270, "user":"bruno", "workspace":"bruno_ws"}`),
 		cleanJSON(output[0]))
 }
 
+func TestRPCForward(t *testing.T) {
+	// Commands on an edge server forwarded to the commit server have a second rpc line for that connection
+	testInput := `Perforce server info:
+	2024/07/11 11:16:51 pid 3433924 bruno@bruno_ws 127.0.0.1 [p4/2023.2/LINUX26X86_64/2605454] 'user-submit -d test'
+--- lapse 1.2s
+--- rpc msgs/size in+out 32+40/1mb+0mb himarks 97604/97604 snd/rcv .001s/.326s
+--- rpc (commit:1666) msgs/size in+out 12+15/0mb+2mb himarks 795416/795272 snd/rcv .002s/.5s
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"rpcMsgsIn":32,"rpcMsgsOut":40,"rpcSizeIn":1,"rpcSizeOut":0`)
+	assert.Contains(t, output[0], `"rpcForwardHost":"commit:1666","rpcForwardMsgsIn":12,"rpcForwardMsgsOut":15,"rpcForwardSizeOut":2`)
+
+	cmd := &Command{}
+	cmd.setRPCForward("commit:1666", "1", "2", "3", "4")
+	cmd.setRPCForward("edge2:1666", "1", "2", "3", "4")
+	cmd.setRPCForward("commit:1666", "1", "2", "3", "4")
+	assert.Equal(t, "commit:1666,edge2:1666", cmd.RPCForwardHost)
+	assert.Equal(t, int64(3), cmd.RPCForwardMsgsIn)
+	assert.Equal(t, int64(12), cmd.RPCForwardSizeOut)
+}
+
 func TestClientStats(t *testing.T) {
-	// These records turn up on their own after track records - potentially useful for metrics
+	// These records turn up on their own after track records - the client totals are also attributed to the command
 	testInput := `Perforce server info:
 	2024/12/21 10:08:51 pid 93275 jenkins@${P4_CLIENT} 10.1.2.3 [unnamed p4-python script [PY3.10.4/P4PY2024.2/API2024.2/2675662]/v97] 'user-print -o C:\Users\jenkins\AppData\Local\Temp\9asfdhwehs //utils/configs/config.yaml'
 
@@ -1409,8 +1939,1307 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
 	// assert.Equal(t, "", output[0])
-	assert.JSONEq(t, cleanJSON(`{"app":"unnamed p4-python script [PY3.10.4/P4PY2024.2/API2024.2/5662]/v97", "args":"", "cmd":"client-Stats", "cmdError":false, "endTime":"2024/12/21 10:08:51", "fileTotalsRcv":3, "fileTotalsRcvMBytes":4, "fileTotalsSnd":1, "fileTotalsSndMBytes":2, "ip":"10.1.2.3", "lineNo":12, "pid":93275, "processKey":"89b4e4bf56c0419db857bda47c0e8433", "startTime":"2024/12/21 10:08:51", "tables":[], "user":"unknown", "workspace":"unknown"}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"unnamed p4-python script [PY3.10.4/P4PY2024.2/API2024.2/5662]/v97", "args":"", "cmd":"client-Stats", "cmdError":false, "endTime":"2024/12/21 10:08:51", "fileTotalsClientRcv":3, "fileTotalsClientRcvMBytes":4, "fileTotalsClientSnd":1, "fileTotalsClientSndMBytes":2, "ip":"10.1.2.3", "lineNo":12, "pid":93275, "processKey":"89b4e4bf56c0419db857bda47c0e8433", "startTime":"2024/12/21 10:08:51", "tables":[], "user":"unknown", "workspace":"unknown"}`),
 		cleanJSON(output[0]))
-	assert.JSONEq(t, cleanJSON(`{"app":"unnamed p4-python script [PY3.10.4/P4PY2024.2/API2024.2/2675662]/v97", "args":"-o C:\\Users\\jenkins\\AppData\\Local\\Temp\\9asfdhwehs //utils/configs/config.yaml", "cmd":"user-print", "cmdError":false, "completedLapse":0.001, "endTime":"2024/12/21 10:08:51", "ip":"10.1.2.3", "lineNo":1, "maxRss":10936, "memMB":19, "memPeakMB":19, "pid":93275, "processKey":"b38b2f8982d9c6f0a6e84f62380e4f9e", "rpcHimarkFwd":175862, "rpcHimarkRev":130372, "rpcMsgsIn":2, "rpcMsgsOut":6, "running":1, "startTime":"2024/12/21 10:08:51", "tables":[], "user":"jenkins", "workspace":"${P4_CLIENT}"}`),
+	assert.JSONEq(t, cleanJSON(`{"app":"unnamed p4-python script [PY3.10.4/P4PY2024.2/API2024.2/2675662]/v97", "args":"-o C:\\Users\\jenkins\\AppData\\Local\\Temp\\9asfdhwehs //utils/configs/config.yaml", "cmd":"user-print", "cmdError":false, "completedLapse":0.001, "endTime":"2024/12/21 10:08:51", "fileTotalsClientRcv":3, "fileTotalsClientRcvMBytes":4, "fileTotalsClientSnd":1, "fileTotalsClientSndMBytes":2, "ip":"10.1.2.3", "lineNo":1, "maxRss":10936, "memMB":19, "memPeakMB":19, "pid":93275, "processKey":"b38b2f8982d9c6f0a6e84f62380e4f9e", "rpcHimarkFwd":175862, "rpcHimarkRev":130372, "rpcMsgsIn":2, "rpcMsgsOut":6, "running":1,"runningPeak":1, "startTime":"2024/12/21 10:08:51", "tables":[], "user":"jenkins", "workspace":"${P4_CLIENT}"}`),
 		cleanJSON(output[1]))
 }
+
+func TestDSTTransitions(t *testing.T) {
+	// Clocks go back an hour while the command is running - completion appears before start
+	testInput := `
+Perforce server info:
+	2023/10/29 01:59:50 pid 1616 robert@robert-test 127.0.0.1 [p4/2023.1/LINUX26X86_64/2468153] 'user-sync //...'
+Perforce server info:
+	2023/10/29 01:00:10 pid 1616 completed 20.0s
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"997aa09a34ea723e0da2bcc5935b36e8","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":20,"ip":"127.0.0.1","app":"p4/2023.1/LINUX26X86_64/2468153","args":"//...","startTime":"2023/10/29 01:59:50","endTime":"2023/10/29 02:00:10","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
+		cleanJSON(output[0]))
+
+	// Clocks go forward an hour while the command is running - an extra hour appears
+	testInput = `
+Perforce server info:
+	2023/03/26 00:59:58 pid 1616 robert@robert-test 127.0.0.1 [p4/2023.1/LINUX26X86_64/2468153] 'user-sync //...'
+Perforce server info:
+	2023/03/26 02:00:01 pid 1616 completed 3.0s
+`
+	output = parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"7f2a7e8385f54a4cc6c9d0efe6aa3d44","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":3,"ip":"127.0.0.1","app":"p4/2023.1/LINUX26X86_64/2468153","args":"//...","startTime":"2023/03/26 00:59:58","endTime":"2023/03/26 01:00:01","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
+		cleanJSON(output[0]))
+
+	// Clocks go back an hour while a command of over an hour is running - it appears to take an hour less
+	testInput = `
+Perforce server info:
+	2023/10/29 01:30:00 pid 1616 robert@robert-test 127.0.0.1 [p4/2023.1/LINUX26X86_64/2468153] 'user-sync //...'
+Perforce server info:
+	2023/10/29 02:30:00 pid 1616 completed 7200.0s
+`
+	output = parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"startTime":"2023/10/29 01:30:00","endTime":"2023/10/29 03:30:00"`)
+
+	// Spanning midnight is fine and not changed
+	testInput = `
+Perforce server info:
+	2023/03/26 23:59:58 pid 1616 robert@robert-test 127.0.0.1 [p4/2023.1/LINUX26X86_64/2468153] 'user-sync //...'
+Perforce server info:
+	2023/03/27 00:00:01 pid 1616 completed 3.0s
+`
+	output = parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"5c52a23b134998e8466732bdc7766deb","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":3,"ip":"127.0.0.1","app":"p4/2023.1/LINUX26X86_64/2468153","args":"//...","startTime":"2023/03/26 23:59:58","endTime":"2023/03/27 00:00:01","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
+		cleanJSON(output[0]))
+}
+
+func TestCorrectEndTime(t *testing.T) {
+	start := time.Date(2023, 10, 29, 1, 59, 50, 0, time.UTC)
+	for _, tc := range []struct {
+		end      time.Time
+		lapse    float32
+		expected time.Time
+	}{
+		// Fractional lapse is not truncated
+		{start.Add(-time.Hour + 20*time.Second), 20.5, start.Add(20500 * time.Millisecond)},
+		{start.Add(time.Hour + 3*time.Second), 2.5, start.Add(2500 * time.Millisecond)},
+		// Clocks go back during a command of over an hour
+		{start.Add(time.Hour), 7200, start.Add(2 * time.Hour)},
+		// Not a DST transition
+		{start.Add(30 * time.Minute), 1800.5, start.Add(30 * time.Minute)},
+		{start.Add(2 * time.Hour), 1, start.Add(2 * time.Hour)},
+		{start.Add(time.Hour + dstTolerance), 0, start.Add(time.Hour + dstTolerance)},
+	} {
+		cmd := Command{StartTime: start, EndTime: tc.end, CompletedLapse: tc.lapse}
+		cmd.correctEndTime()
+		assert.Equal(t, tc.expected, cmd.EndTime, "lapse %v", tc.lapse)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	logger := logrus.New()
+	fp := NewP4dFileParser(logger)
+	assert.True(t, fp.FeatureEnabled(FeatureDSTCorrection))
+	assert.Error(t, fp.SetFeature("no.such.feature", true))
+	assert.NoError(t, fp.SetFeature(FeatureDSTCorrection, false))
+	assert.False(t, fp.FeatureEnabled(FeatureDSTCorrection))
+	assert.True(t, NewP4dFileParser(logger).FeatureEnabled(FeatureDSTCorrection))
+
+	names := []string{}
+	for _, f := range Features() {
+		names = append(names, f.Name)
+	}
+	assert.Contains(t, names, FeatureDSTCorrection)
+
+	// With DST correction disabled the end time is as logged
+	testInput := `
+Perforce server info:
+	2023/10/29 01:59:50 pid 1616 robert@robert-test 127.0.0.1 [p4/2023.1/LINUX26X86_64/2468153] 'user-sync //...'
+Perforce server info:
+	2023/10/29 01:00:10 pid 1616 completed 20.0s
+`
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"997aa09a34ea723e0da2bcc5935b36e8","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":20,"ip":"127.0.0.1","app":"p4/2023.1/LINUX26X86_64/2468153","args":"//...","startTime":"2023/10/29 01:59:50","endTime":"2023/10/29 01:00:10","running":1,"runningPeak":1,"cmdError":false,"tables":[]}`),
+		cleanJSON(output[0]))
+}
+
+func TestNewParser(t *testing.T) {
+	logger := logrus.New()
+	_, err := NewParser(WithLogger(logger), WithFeature("no.such.feature", true))
+	assert.Error(t, err)
+
+	fp, err := NewParser(WithLogger(logger), WithDebugPID(1616, "user-sync"), WithDescriptionLimit(100),
+		WithNoCompletionRecords(), WithFeature(FeatureDSTCorrection, false), WithMemoryLimit(10), WithKeepPending())
+	assert.NoError(t, err)
+	assert.Equal(t, logger, fp.logger)
+	assert.Equal(t, int64(1616), fp.debugPID)
+	assert.Equal(t, "user-sync", fp.debugCmd)
+	assert.Equal(t, 100, fp.descriptionLimit)
+	assert.True(t, fp.noCompletionRecords)
+	assert.False(t, fp.FeatureEnabled(FeatureDSTCorrection))
+	assert.Equal(t, uint64(10*1024*1024), fp.memoryLimit)
+	assert.True(t, fp.keepPending)
+	assert.Equal(t, time.Second, fp.outputDuration)
+
+	// Options struct - later options override, and the caller's features are not modified
+	opts := Options{Logger: logger, Debug: 1, Features: map[string]bool{FeatureLogTruncated: true}}
+	fp, err = NewParser(WithOptions(opts), WithFeature(FeatureDSTCorrection, false),
+		WithDurations(time.Millisecond, time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fp.debug)
+	assert.True(t, fp.FeatureEnabled(FeatureLogTruncated))
+	assert.False(t, fp.FeatureEnabled(FeatureDSTCorrection))
+	assert.Equal(t, time.Millisecond, fp.outputDuration)
+	assert.Equal(t, time.Minute, fp.debugDuration)
+	assert.Equal(t, 1, len(opts.Features))
+
+	// Defaults
+	fp, err = NewParser(WithOptions(Options{}))
+	assert.NoError(t, err)
+	assert.Equal(t, logrus.StandardLogger(), fp.logger)
+	assert.Equal(t, 30*time.Second, fp.debugDuration)
+	assert.True(t, fp.FeatureEnabled(FeatureDSTCorrection))
+}
+
+func TestPullType(t *testing.T) {
+	cmd := Command{Cmd: "pull", Args: "-u -i 1 -b 1", Tables: map[string]*Table{}}
+	assert.Equal(t, PullTypeArchive, cmd.PullType())
+	_, ok := cmd.PullQueueRows()
+	assert.False(t, ok)
+	getTable(&cmd, "rdb.lbr").ScanRows = 12
+	rows, ok := cmd.PullQueueRows()
+	assert.True(t, ok)
+	assert.Equal(t, int64(12), rows)
+	cmd.LbrBinaryWriteBytes = 100
+	cmd.LbrRcsWriteBytes = 20
+	assert.Equal(t, int64(120), cmd.LbrWriteBytes())
+
+	cmd = Command{Cmd: "pull", Args: "-I 100 -b 1"}
+	assert.Equal(t, PullTypeJournal, cmd.PullType())
+	cmd = Command{Cmd: "user-sync", Args: "-u"}
+	assert.Equal(t, "", cmd.PullType())
+}
+
+func TestStats(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+	2015/09/02 15:23:09 pid 1616 some new format line
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+
+supervisord: p4d entered RUNNING state
+Perforce server info:
+	2015/13/45 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .011s
+`
+	var unmatched bytes.Buffer
+	fp, err := NewParser(WithLogger(logrus.New()), WithUnmatchedLines(&unmatched))
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	stats := fp.Stats()
+	assert.Equal(t, ParserStats{LinesRead: 12, CmdsOutput: 2, UnrecognisedLines: 1, NoiseLines: 1, ParseErrors: 1}, stats)
+	assert.Contains(t, stats.String(), "unrecognised lines 1")
+	// Noise and unrecognised lines are found by different goroutines so may be written in either order
+	assert.ElementsMatch(t, []string{"4\tunrecognised\t\t2015/09/02 15:23:09 pid 1616 some new format line",
+		"8\tnoise\tsupervisord: p4d entered RUNNING state", ""}, strings.Split(unmatched.String(), "\n"))
+}
+
+func TestNoiseLines(t *testing.T) {
+	// Shell/supervisor output captured along with the log, including noise without a trailing newline
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+--- lapse .031s
+--- db.rev
+---   pages in+out+cached 6+0+4
+
+supervisord: p4d entered RUNNING state
++ echo starting
+[supervisor] restartPerforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .011s
+`
+	logger := logrus.New()
+	fp := NewP4dFileParser(logger)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, int64(3), fp.NoiseLinesCount())
+	assert.Equal(t, 2, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"f9a64670da4d77a44225be236974bc8b","cmd":"user-sync","pid":1616,"lineNo":2,"user":"robert","workspace":"robert-test","completedLapse":0.031,"ip":"127.0.0.1","app":"p4/2016.2/LINUX26X86_64/1598668","args":"//...","startTime":"2015/09/02 15:23:09","endTime":"2015/09/02 15:23:09","running":1,"runningPeak":2,"cmdError":false,"tables":[{"tableName":"rev","pagesIn":6,"pagesCached":4}]}`),
+		cleanJSON(output[1]))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"ccab34de022a9947edf4ad9ae59660fd","cmd":"user-files","pid":1617,"lineNo":10,"user":"robert","workspace":"robert-test","completedLapse":0.011,"ip":"127.0.0.1","app":"p4/2016.2/LINUX26X86_64/1598668","args":"//...","startTime":"2015/09/02 15:23:10","endTime":"2015/09/02 15:23:10","running":2,"runningPeak":2,"cmdError":false,"tables":[]}`),
+		cleanJSON(output[0]))
+}
+
+func TestNoiseLinesDescription(t *testing.T) {
+	// Blank lines within a multi-line description - the lines following them are not noise
+	testInput := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d First line
+
+Third line
+
+'
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 completed .178s 96+17us 0+208io 0+0net 15668k 0pf
+
+supervisord: p4d entered RUNNING state
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-changes -m 1'
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 completed .010s
+`
+	fp := NewP4dFileParser(logrus.New())
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, int64(1), fp.NoiseLinesCount())
+}
+
+func TestLogTruncated(t *testing.T) {
+	// Log ends (server crash) while pid 1617 still running
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -i'
+Perforce server info:
+	2015/09/02 15:23:12 pid 1616 completed 3.01s
+`
+	// Default is unchanged
+	output := parseLogLines(testInput)
+	assert.Equal(t, 2, len(output))
+	assert.NotContains(t, output[0]+output[1], "endReason")
+
+	logger := logrus.New()
+	fp := NewP4dFileParser(logger)
+	assert.NoError(t, fp.SetFeature(FeatureLogTruncated, true))
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	var truncated, completed map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(output[0]), &truncated))
+	assert.NoError(t, json.Unmarshal([]byte(output[1]), &completed))
+	if truncated["pid"] != 1617.0 {
+		truncated, completed = completed, truncated
+	}
+	assert.Equal(t, "log_truncated", truncated["endReason"])
+	assert.Equal(t, "2015/09/02 15:23:12", truncated["lastSeenTime"])
+	assert.NotContains(t, completed, "endReason")
+	assert.NotContains(t, completed, "lastSeenTime")
+}
+
+func TestMaxPending(t *testing.T) {
+	// 3 commands running when pid 1616 completes - with max 2 pending it is evicted first (least recently active)
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -i'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2015/09/02 15:23:12 pid 1616 completed 3.01s
+Perforce server info:
+	2015/09/02 15:23:13 pid 1617 completed 3.01s
+Perforce server info:
+	2015/09/02 15:23:13 pid 1618 completed 2.01s
+`
+	fp, err := NewParser(WithLogger(logrus.New()), WithMaxPending(2))
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, int64(1), fp.EvictedCount())
+	assert.Equal(t, int64(1), fp.Stats().CmdsEvicted)
+	evicted := 0
+	for _, line := range output {
+		if strings.Contains(line, `"endReason":"evicted"`) {
+			evicted++
+			assert.Contains(t, line, `"pid":1616`)
+			assert.Contains(t, line, `"cmd":"user-sync"`)
+			assert.Contains(t, line, `"lastSeenTime":"2015/09/02 15:23:11"`)
+		}
+	}
+	assert.Equal(t, 1, evicted)
+
+	// With spill, the evicted command is restored on completion and output as normal
+	fp, err = NewParser(WithLogger(logrus.New()), WithMaxPending(2), WithSpillDir(t.TempDir()))
+	assert.NoError(t, err)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, int64(1), fp.EvictedCount())
+	assert.Equal(t, 3, len(output))
+	for _, line := range output {
+		assert.NotContains(t, line, "endReason")
+	}
+	assert.Contains(t, strings.Join(output, "\n"), `"cmd":"user-sync","pid":1616`)
+	assert.Contains(t, strings.Join(output, "\n"), `"completedLapse":3.01`)
+}
+
+func TestPendingTTL(t *testing.T) {
+	// pid 1616 never completes, and is evicted an hour later, with the spilled command output at the end
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 16:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -i'
+Perforce server info:
+	2015/09/02 16:23:12 pid 1617 completed 2.01s
+`
+	dir := t.TempDir()
+	fp, err := NewParser(WithLogger(logrus.New()), WithPendingTTL(time.Hour), WithSpillDir(dir))
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, int64(1), fp.EvictedCount())
+	assert.Equal(t, 2, len(output))
+	all := strings.Join(output, "\n")
+	assert.Contains(t, all, `"cmd":"user-sync","pid":1616`)
+	assert.Contains(t, all, `"endReason":"evicted"`)
+	assert.Equal(t, 1, strings.Count(all, "endReason"))
+	// Spill file removed
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestSwarmTriggerStage(t *testing.T) {
+	assert.Equal(t, "changesave", SwarmTriggerStage("swarm.changesave"))
+	assert.Equal(t, "enforce", SwarmTriggerStage("swarm.enforce.1"))
+	assert.Equal(t, "strict", SwarmTriggerStage("Swarm.Strict.2"))
+	assert.Equal(t, "shelvedel", SwarmTriggerStage("swarm.shelvedel"))
+	assert.Equal(t, "other", SwarmTriggerStage("swarm.newthing"))
+	assert.Equal(t, "", SwarmTriggerStage("check-submit"))
+}
+
+func TestMemoryLimit(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+--- lapse .031s
+--- db.rev
+---   pages in+out+cached 6+0+4
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+--- lapse .011s
+--- db.rev
+---   pages in+out+cached 3+0+2
+--- storageup/storagemasterup(R)
+---   total lock wait+held read/write 0ms+2ms/0ms+0ms
+`
+	logger := logrus.New()
+	fp := NewP4dFileParser(logger)
+	fp.SetMemoryLimit(100)
+	fp.memCheckInterval = 1
+	heap := []uint64{50 * 1024 * 1024, 200 * 1024 * 1024}
+	fp.heapAlloc = func() uint64 {
+		h := heap[0]
+		heap = heap[1:]
+		return h
+	}
+	output := parseLogLinesWithParser(fp, testInput)
+	sort.Strings(output) // user-files before user-sync
+	assert.Equal(t, 2, len(output))
+	// Limit exceeded after 2nd block, so no table detail retained (including for pending commands), but still counted
+	assert.Equal(t, int64(8), fp.TableDetailDroppedAt())
+	assert.Contains(t, output[0], `"cmd":"user-files"`)
+	assert.Contains(t, output[0], `"tables":[]`)
+	assert.NotContains(t, output[0], `"serializedLocks"`)
+	assert.Contains(t, output[1], `"cmd":"user-sync"`)
+	assert.Contains(t, output[1], `"tables":[]`)
+
+	// Below limit - detail retained
+	fp = NewP4dFileParser(logger)
+	fp.SetMemoryLimit(100)
+	fp.memCheckInterval = 1
+	fp.heapAlloc = func() uint64 { return 50 * 1024 * 1024 }
+	output = parseLogLinesWithParser(fp, testInput)
+	sort.Strings(output)
+	assert.Equal(t, int64(0), fp.TableDetailDroppedAt())
+	assert.Contains(t, output[0], `"tableName":"rev","pagesIn":3`)
+	assert.Contains(t, output[0], `"serializedLocks":[{"name":"storagemasterup"`)
+	assert.Contains(t, output[1], `"tableName":"rev","pagesIn":6`)
+}
+
+func TestSerializedLocks(t *testing.T) {
+	l := newSerializedLock("storagemasterup(W)")
+	assert.Equal(t, "storagemasterup", l.Name)
+	assert.Equal(t, "W", l.Mode)
+	assert.Equal(t, "storagemasterup_W", l.LegacyTableName())
+	l = newSerializedLock("storageup")
+	assert.Equal(t, "storageup", l.LegacyTableName())
+
+	// Lock records are followed by a normal table
+	testInput := `
+Perforce server info:
+	2020/10/16 06:00:01 pid 8748 build@commander-controller 10.5.20.152 [p4/2018.1/LINUX26X86_64/1957529] 'user-submit -i'
+--- lapse .012s
+--- storageup/storageup(W)
+---   total lock wait+held read/write 0ms+0ms/5ms+7ms
+---   max lock wait+held read/write 0ms+0ms/5ms+6ms
+--- db.counters
+---   pages in+out+cached 3+0+2
+---   total lock wait+held read/write 0ms+1ms/0ms+0ms
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"e8f70400d0ff1e89574dc22b823c5e24","cmd":"user-submit","pid":8748,"lineNo":2,"user":"build","workspace":"commander-controller","completedLapse":0.012,"ip":"10.5.20.152","app":"p4/2018.1/LINUX26X86_64/1957529","args":"-i","startTime":"2020/10/16 06:00:01","endTime":"2020/10/16 06:00:01","running":1,"runningPeak":1,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":3,"pagesCached":2,"totalReadHeld":1}],"serializedLocks":[{"name":"storageup","mode":"W","totalWriteWait":5,"totalWriteHeld":7,"maxWriteWait":5,"maxWriteHeld":6}]}`),
+		cleanJSON(output[0]))
+}
+
+func parseStructuredLines(input string) []string {
+	inchan := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sp := NewStructuredLogParser(logrus.New())
+	cmdChan := sp.LogParser(ctx, inchan)
+	go func() {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		for scanner.Scan() {
+			inchan <- scanner.Text()
+		}
+		close(inchan)
+	}()
+	output := []string{}
+	for cmd := range cmdChan {
+		if cmd, ok := cmd.(Command); ok {
+			output = append(output, cmd.String())
+		}
+	}
+	return output
+}
+
+func TestStructuredLog(t *testing.T) {
+	// As for all.csv - start/compute/error/end events in order, plus an audit event (ignored)
+	testInput := `0,1718799931,560465,2024/06/19 12:25:31 560465376,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1/LINUX26X86_64/2611120,"//depot/a b/...,//depot/c/..."
+1,1718799932,60465,2024/06/19 12:25:32 060465376,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1/LINUX26X86_64/2611120,"//depot/a b/...,//depot/c/..."
+5,1718799932,60465,2024/06/19 12:25:32 060465376,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1/LINUX26X86_64/2611120,//depot/a.txt,sync,1
+3,1718799933,0,2024/06/19 12:25:33,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1/LINUX26X86_64/2611120,"//depot/a b/...,//depot/c/...",2,6,17,//depot/c/... - no such file(s).
+2,1718799934,560465,2024/06/19 12:25:34 560465376,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1/LINUX26X86_64/2611120,"//depot/a b/...,//depot/c/..."
+not a structured log line
+0,1718799935,0,2024/06/19 12:25:35,1056865,7a3d,,1,fred,ws2,user-info,10.1.2.3,p4v,,
+`
+	output := parseStructuredLines(testInput)
+	assert.Equal(t, 2, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"b758129982aa426d083096a312f25bae","cmd":"user-sync","pid":1056864,"lineNo":1,"user":"perforce","workspace":"ws1","ip":"127.0.0.1","app":"p4/2024.1/LINUX26X86_64/2611120","args":"//depot/a b/...,//depot/c/...","startTime":"2024/06/19 12:25:31","endTime":"2024/06/19 12:25:34","computeLapse":0.5,"completedLapse":3,"cmdError":true,"errorSeverity":"warn","errorText":"//depot/c/... - no such file(s).","errorCode":6161,"errorCount":1,"errors":[{"lineNo":4,"text":"//depot/c/... - no such file(s)."}],"tables":[]}`),
+		cleanJSON(output[0]))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"a921c9cb5311a46b6c615a2fda74abdb","cmd":"user-info","pid":1056865,"lineNo":7,"user":"fred","workspace":"ws2","ip":"10.1.2.3","app":"p4v","args":"","startTime":"2024/06/19 12:25:35","endTime":"0001/01/01 00:00:00","cmdError":false,"tables":[]}`),
+		cleanJSON(output[1]))
+
+	// errors.csv processed before commands.csv
+	testInput = `4,1718799933,0,2024/06/19 12:25:33,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1,//...,4,3,12,Operation 'user-sync' failed.
+0,1718799931,0,2024/06/19 12:25:31,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1,//...
+2,1718799934,0,2024/06/19 12:25:34,1056864,7a3c,,1,perforce,ws1,user-sync,127.0.0.1,p4,2024.1,//...
+`
+	output = parseStructuredLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.JSONEq(t, cleanJSON(`{"processKey":"2437148e56582dcb5a47242ff4e74181","cmd":"user-sync","pid":1056864,"lineNo":2,"user":"perforce","workspace":"ws1","ip":"127.0.0.1","app":"p4/2024.1","args":"//...","startTime":"2024/06/19 12:25:31","endTime":"2024/06/19 12:25:34","completedLapse":3,"cmdError":true,"errorSeverity":"fatal","errorText":"Operation 'user-sync' failed.","errorCode":3084,"errorCount":1,"errors":[{"lineNo":1,"text":"Operation 'user-sync' failed."}],"tables":[]}`),
+		cleanJSON(output[0]))
+}
+
+func TestCheckpoint(t *testing.T) {
+	part1 := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [Microsoft Visual Studio 2013/12.0.21005.1] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 compute end .031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .001s
+`
+	part2 := `Perforce server info:
+	2015/09/02 15:23:11 pid 1616 completed .045s 8+1us 0+1408io 0+0net 4088k 0pf
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [Microsoft Visual Studio 2013/12.0.21005.1] 'user-sync //...'
+--- lapse .045s
+--- db.have
+---   pages in+out+cached 1+2+3
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+`
+	logger := logrus.New()
+	expected := parseLogLines(part1 + part2)
+	assert.Equal(t, 2, len(expected))
+
+	fp := NewP4dFileParser(logger)
+	fp.SetKeepPending()
+	output := parseLogLinesWithParser(fp, part1)
+	assert.Equal(t, 0, len(output))
+	cp := fp.Checkpoint()
+	assert.Equal(t, int64(10), cp.LineNo)
+	assert.Equal(t, 2, len(cp.Pending))
+
+	fp = NewP4dFileParser(logger)
+	fp.RestoreCheckpoint(cp)
+	output = parseLogLinesWithParser(fp, part2)
+	assert.Equal(t, expected, output)
+}
+
+func TestCheckpointBound(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/01 15:23:09 pid 1615 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //a/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //b/...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //c/...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed .001s
+`
+	// Commands inactive for over the TTL aren't retained
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetKeepPending()
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"args":"//a/..."`)
+	assert.Contains(t, output[0], `"endReason":"evicted"`)
+	cp := fp.Checkpoint()
+	assert.Equal(t, 3, len(cp.Pending)) // Including user-info, which may yet have track info
+
+	// Nor those beyond the max, least recently active first
+	fp, err := NewParser(WithKeepPending(), WithKeepPendingLimits(1, -1))
+	assert.NoError(t, err)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	assert.Contains(t, output[0], `"args":"//a/..."`)
+	assert.Contains(t, output[1], `"args":"//b/..."`)
+	cp = fp.Checkpoint()
+	assert.Equal(t, 2, len(cp.Pending))
+
+	// Unbounded
+	fp, err = NewParser(WithKeepPending(), WithKeepPendingLimits(-1, -1))
+	assert.NoError(t, err)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 0, len(output))
+	assert.Equal(t, 4, len(fp.Checkpoint().Pending))
+}
+
+func TestDescription(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d First line
+Second line
+Third line
+'
+
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 completed .178s 96+17us 0+208io 0+0net 15668k 0pf
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-shelve -f -d Single line'
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 completed .010s 96+17us 0+208io 0+0net 15668k 0pf
+`
+	// Not captured by default
+	output := parseLogLines(testInput)
+	assert.Equal(t, 2, len(output))
+	assert.NotContains(t, output[0], "description")
+
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetDescriptionLimit(100)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	assert.Contains(t, output[0], `"args":"-f -d Single line","description":"Single line"`)
+	assert.Contains(t, output[1], `"args":" -d First line","description":"First line\nSecond line\nThird line"`)
+
+	fp = NewP4dFileParser(logrus.New())
+	fp.SetDescriptionLimit(12)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Contains(t, output[1], `"description":"First lin..."`)
+
+	assert.Equal(t, "", getDescription("-c 1234", nil, 100))
+	assert.Equal(t, "", getDescription("-dfoo", nil, 100))
+	assert.Equal(t, "abc\ndef", getDescription(" -d abc", []string{"def'", "ghi"}, 100))
+	assert.Equal(t, "abc", getDescription(" -d abc", []string{"--- lapse .1s"}, 100))
+	assert.Equal(t, "caf...", getDescription("-d caféteria", nil, 7)) // Not split within a character
+}
+
+func TestLineReader(t *testing.T) {
+	for _, completeOnly := range []bool{false, true} {
+		lr := NewLineReader(strings.NewReader("line1\r\nline2\n\nline3"), 100)
+		if completeOnly {
+			lr.SetCompleteLinesOnly()
+		}
+		var lines []string
+		for lr.Scan() {
+			lines = append(lines, lr.Text())
+		}
+		assert.NoError(t, lr.Err())
+		if completeOnly {
+			assert.Equal(t, []string{"line1", "line2", ""}, lines)
+			assert.Equal(t, int64(14), lr.Offset())
+		} else {
+			assert.Equal(t, []string{"line1", "line2", "", "line3"}, lines)
+			assert.Equal(t, int64(19), lr.Offset())
+		}
+	}
+
+	// Lines longer than the read buffer (and the 5MB limit of the previous bufio.Scanner) are truncated,
+	// and reading continues with the following lines
+	long := "\t'user-submit -d " + strings.Repeat("x", 6*1024*1024) + "'"
+	input := "first\n" + long + "\r\n" + long[:100] + "\nlast\n"
+	lr := NewLineReader(strings.NewReader(input), 50)
+	var lines []string
+	for lr.Scan() {
+		lines = append(lines, lr.Text())
+	}
+	assert.NoError(t, lr.Err())
+	assert.Equal(t, 4, len(lines))
+	assert.Equal(t, "first", lines[0])
+	assert.Equal(t, long[:50]+"...'", lines[1])
+	assert.Equal(t, long[:50]+"...'", lines[2])
+	assert.Equal(t, "last", lines[3])
+	assert.Equal(t, int64(2), lr.TruncatedCount())
+	assert.Equal(t, int64(len(input)), lr.Offset())
+
+	// Exactly maxLen is not truncated, whatever the line ending
+	lr = NewLineReader(strings.NewReader("12345\r\n123456\n12345"), 5)
+	lines = nil
+	for lr.Scan() {
+		lines = append(lines, lr.Text())
+	}
+	assert.Equal(t, []string{"12345", "12345...'", "12345"}, lines)
+	assert.Equal(t, int64(1), lr.TruncatedCount())
+
+	// With a digest, lines which differ beyond the truncation point still differ
+	lr = NewLineReader(strings.NewReader(long+"\n"+long+"\n"+long[:len(long)-1]+"y'\n12345\n"), 50)
+	lr.SetTruncatedDigest()
+	lines = nil
+	for lr.Scan() {
+		lines = append(lines, lr.Text())
+	}
+	assert.Equal(t, 4, len(lines))
+	assert.Regexp(t, `^\t'user-submit -d x+\.\.\.\[md5 [0-9a-f]{32}\]'$`, lines[0])
+	assert.Equal(t, lines[0], lines[1])
+	assert.NotEqual(t, lines[0], lines[2])
+	assert.Equal(t, long[:50], lines[2][:50])
+	assert.Equal(t, "12345", lines[3])
+}
+
+func TestKeyMode(t *testing.T) {
+	mode, err := ParseKeyMode("full")
+	assert.NoError(t, err)
+	assert.Equal(t, KeyModeFullArgs, mode)
+	assert.Equal(t, "line", KeyModeLine.String())
+	_, err = ParseKeyMode("other")
+	assert.Error(t, err)
+
+	// Two commands run by the same pid in the same second
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/a/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .011s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/b/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .011s
+`
+	keys := func(fp *P4dFileParser) []string {
+		var result []string
+		for _, out := range parseLogLinesWithParser(fp, testInput) {
+			var c struct {
+				ProcessKey string `json:"processKey"`
+			}
+			assert.NoError(t, json.Unmarshal([]byte(out), &c))
+			result = append(result, c.ProcessKey)
+		}
+		return result
+	}
+	logger := logrus.New()
+	lineKeys := keys(NewP4dFileParser(logger))
+	fp, _ := NewParser(WithLogger(logger), WithKeyMode(KeyModeFullArgs))
+	fullKeys := keys(fp)
+	assert.Equal(t, 2, len(fullKeys))
+	assert.NotEqual(t, fullKeys[0], fullKeys[1])
+	assert.NotEqual(t, lineKeys, fullKeys)
+
+	// Keys depend on pid, start time, command and args only
+	cmd := &Command{Pid: 1616, Cmd: "user-files"}
+	cmd.setStartTime("2015/09/02 15:23:09")
+	key := fp.processKey(cmd, "some line", "//depot/a/...")
+	assert.Equal(t, key, fp.processKey(cmd, "other line", "//depot/a/..."))
+	assert.Contains(t, fullKeys, key)
+}
+
+func TestDuplicateOutput(t *testing.T) {
+	fp := NewP4dFileParser(nil)
+	start, _ := time.Parse(p4timeformat, "2024/01/08 10:00:00")
+	fp.currTime = start
+	cmd := &Command{ProcessKey: "4d4e5096f7b732e4ce95230ef085bf51", LineNo: 2, Pid: 4496, Cmd: "rmt-Journal", StartTime: start}
+	fp.noteOutput(cmd)
+	assert.Equal(t, int64(0), fp.DuplicateOutputCount())
+	fp.noteOutput(cmd)
+	assert.Equal(t, int64(1), fp.DuplicateOutputCount())
+	// Duplicate keys (same pid in the same second) include the line number so are distinct
+	dup := &Command{ProcessKey: cmd.ProcessKey, LineNo: 20, Pid: 4496, Cmd: "rmt-Journal", StartTime: start, duplicateKey: true}
+	fp.noteOutput(dup)
+	assert.Equal(t, int64(1), fp.DuplicateOutputCount())
+
+	// Keys are forgotten once older than dedupWindow
+	fp.currTime = start.Add(2 * dedupWindow)
+	later := &Command{ProcessKey: "9a1f6aa9bd0ccb2fd1b5d7b5fa43a8e3", LineNo: 200, StartTime: fp.currTime}
+	fp.noteOutput(later)
+	assert.Equal(t, 1, len(fp.outputKeys))
+
+	// Only counted when output if enabled
+	input := `
+Perforce server info:
+	2024/01/08 10:00:00 pid 4496 svc@unknown background [p4d/2023.1/LINUX26X86_64/2468153] 'rmt-Journal'
+Perforce server info:
+	2024/01/08 10:00:00 pid 4496 completed .001s
+Perforce server info:
+	2024/01/08 10:00:00 pid 4496 svc@unknown background [p4d/2023.1/LINUX26X86_64/2468153] 'rmt-Journal'
+Perforce server info:
+	2024/01/08 10:00:00 pid 4496 completed .001s
+`
+	for _, enabled := range []bool{false, true} {
+		fp, err := NewParser(WithFeature(FeatureDuplicates, enabled))
+		assert.NoError(t, err)
+		parseLogLinesWithParser(fp, input)
+		assert.Equal(t, enabled, fp.outputKeys != nil)
+	}
+}
+
+func TestRunningCommands(t *testing.T) {
+	fp := NewP4dFileParser(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inchan := make(chan string, 100)
+	cmdChan := fp.LogParser(ctx, inchan, make(chan time.Time))
+	for _, line := range strings.Split(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:08 pid 1615 fred@fred-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1615 completed 2.1s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 bob@bob-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+`, "\n") {
+		inchan <- line
+	}
+	// Blocks are processed asynchronously
+	var running []Command
+	for i := 0; i < 100; i++ {
+		running = fp.RunningCommands()
+		if len(running) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.Equal(t, 2, len(running)) {
+		assert.Equal(t, "user-sync", running[0].Cmd)
+		assert.Equal(t, "robert", running[0].User)
+		assert.Equal(t, "user-info", running[1].Cmd)
+		assert.Nil(t, running[0].Tables)
+	}
+
+	close(inchan)
+	for range cmdChan {
+	}
+	assert.Nil(t, fp.RunningCommands())
+}
+
+func TestRunningCommandsTables(t *testing.T) {
+	// Track output at the end of the compute phase of a command still running
+	fp := NewP4dFileParser(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inchan := make(chan string, 100)
+	cmdChan := fp.LogParser(ctx, inchan, make(chan time.Time))
+	for _, line := range strings.Split(`Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@ws 10.1.2.212 [p4/2023.1] 'user-submit -i'
+Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@ws 10.1.2.212 [p4/2023.1] 'user-submit -i'
+--- db.rev
+---   locks read/write 0/1 rows get+pos+scan put+del 0+56+2000 0+0
+---   total lock wait+held read/write 0ms+0ms/5ms+1200ms
+Perforce server info:
+	2024/04/03 12:20:15 pid 5033 bob@ws 10.1.2.212 [p4/2023.1] 'user-info'
+Perforce server info:
+`, "\n") {
+		inchan <- line
+	}
+	var running []Command
+	for i := 0; i < 100; i++ {
+		running = fp.RunningCommands()
+		if len(running) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.Equal(t, 2, len(running)) {
+		assert.Equal(t, "user-submit", running[0].Cmd)
+		if assert.Equal(t, 1, len(running[0].Tables)) {
+			assert.Equal(t, int64(1), running[0].Tables["rev"].WriteLocks)
+			assert.Equal(t, int64(1200), running[0].Tables["rev"].TotalWriteHeld)
+		}
+		assert.Nil(t, running[1].Tables)
+	}
+
+	close(inchan)
+	for range cmdChan {
+	}
+}
+
+func TestLineHooks(t *testing.T) {
+	// Site-specific lines (e.g. output of a trigger) captured into the command, and a line outside any command
+	testInput := `Perforce server info:
+	2024/07/11 11:16:51 pid 3433924 bruno@bruno_ws 127.0.0.1 [p4/2023.2/LINUX26X86_64/2605454] 'user-submit -d test'
+	trigger build-id=b1234 queued
+Perforce server info:
+	2024/07/11 11:16:51 pid 3433924 completed .1s 0+0us 0+0io 0+0net 10936k 0pf
+Perforce server info:
+	build-id=orphan
+`
+	reBuild := regexp.MustCompile(`build-id=(\S+)`)
+	var nilCmds []string
+	fp, err := NewParser(WithLineHook(reBuild, func(cmd *Command, m []string) {
+		if cmd == nil {
+			nilCmds = append(nilCmds, m[1])
+			return
+		}
+		cmd.SetExtra("buildID", m[1])
+	}))
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"extra":{"buildID":"b1234"}`)
+	assert.Equal(t, []string{"orphan"}, nilCmds)
+
+	// No extra field without hooks
+	output = parseLogLines(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.NotContains(t, output[0], `"extra"`)
+}
+
+func TestParseReader(t *testing.T) {
+	testInput := `Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 completed 1.1s`
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testInput))
+	w.Close()
+	path := filepath.Join(t.TempDir(), "p4d.log.gz")
+	assert.NoError(t, os.WriteFile(path, gz.Bytes(), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, compressed := range []bool{false, true} {
+		fp := NewP4dFileParser(nil)
+		var cmdChan <-chan interface{}
+		var err error
+		if compressed {
+			cmdChan, err = fp.ParseFile(ctx, path)
+		} else {
+			cmdChan, err = fp.ParseReader(ctx, strings.NewReader(testInput))
+		}
+		assert.NoError(t, err)
+		var cmds []Command
+		for c := range cmdChan {
+			if cmd, ok := c.(Command); ok {
+				cmds = append(cmds, cmd)
+			}
+		}
+		assert.NoError(t, fp.ReadErr())
+		if assert.Equal(t, 1, len(cmds)) {
+			assert.Equal(t, "user-sync", cmds[0].Cmd)
+			assert.Equal(t, float32(1.1), cmds[0].CompletedLapse)
+		}
+	}
+
+	_, err := NewP4dFileParser(nil).ParseFile(ctx, filepath.Join(t.TempDir(), "missing.log"))
+	assert.Error(t, err)
+
+	// Nothing is left running once a log has been parsed
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		cmdChan, err := NewP4dFileParser(nil).ParseReader(ctx, strings.NewReader(testInput))
+		assert.NoError(t, err)
+		for range cmdChan {
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestTimewarp(t *testing.T) {
+	// Second range of log (e.g. from a replica) starts an hour before the end of the first
+	testInput := `Perforce server info:
+	2024/06/10 11:00:00 pid 100 fred@ws 127.0.0.1 [p4/2023.1] 'user-info'
+Perforce server info:
+	2024/06/10 11:00:01 pid 100 completed .1s
+Perforce server info:
+	2024/06/10 11:00:02 pid 101 fred@ws 127.0.0.1 [p4/2023.1] 'user-sync'
+Perforce server info:
+	2024/06/10 11:00:03 pid 101 completed .1s
+Perforce server info:
+	2024/06/10 10:00:00 pid 200 bob@ws 127.0.0.1 [p4/2023.1] 'user-changes'
+Perforce server info:
+	2024/06/10 10:00:01 pid 200 completed .1s
+Perforce server info:
+	2024/06/10 10:00:02 pid 201 bob@ws 127.0.0.1 [p4/2023.1] 'user-files'
+Perforce server info:
+	2024/06/10 10:00:03 pid 201 completed .1s
+`
+	// Not detected by default
+	fp := NewP4dFileParser(nil)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 4, len(output))
+	assert.Equal(t, int64(0), fp.TimewarpCount())
+
+	fp, err := NewParser(WithTimewarpThreshold(10*time.Minute), WithReorderBuffer(10))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmdChan, err := fp.ParseReader(ctx, strings.NewReader(testInput))
+	assert.NoError(t, err)
+	var events []ServerEvent
+	var cmds []string
+	for c := range cmdChan {
+		switch c := c.(type) {
+		case Command:
+			cmds = append(cmds, c.Cmd)
+		case ServerEvent:
+			events = append(events, c)
+		}
+	}
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, EventTypeTimewarp, events[0].EventType)
+		assert.Equal(t, int64(9), events[0].LineNo)
+		assert.Equal(t, "Log time went backwards by 1h0m2s from 2024/06/10 11:00:02", events[0].Message)
+	}
+	assert.Equal(t, []string{"user-changes", "user-files", "user-info", "user-sync"}, cmds)
+	assert.Equal(t, int64(1), fp.Stats().Timewarps)
+}
+
+func TestNetAddresses(t *testing.T) {
+	// Network address lines are attached to the next command started, not the repeated start record with track output
+	testInput := `server to client 10.0.0.5:52344 vs 192.168.1.10:1666
+Forwarder set trusted client address 10.0.0.5
+Perforce server info:
+	2024/07/11 11:16:51 pid 3433924 bruno@bruno_ws 192.168.1.20/10.0.0.5 [p4/2023.2/LINUX26X86_64/2605454] 'user-sync //depot/...'
+server to client 10.0.0.6:40000 vs 192.168.1.10:1666
+Perforce server info:
+	2024/07/11 11:16:51 pid 3433924 bruno@bruno_ws 192.168.1.20/10.0.0.5 [p4/2023.2/LINUX26X86_64/2605454] 'user-sync //depot/...'
+--- lapse .012s
+Perforce server info:
+	2024/07/11 11:16:52 pid 3433925 fred@fred_ws 10.0.0.6 [p4/2023.2/LINUX26X86_64/2605454] 'user-info'
+--- lapse .001s
+Perforce server info:
+	2024/07/11 11:16:53 pid 3433926 fred@fred_ws 10.0.0.6 [p4/2023.2/LINUX26X86_64/2605454] 'user-info'
+--- lapse .001s
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 3, len(output))
+	byPid := map[string]string{}
+	for _, o := range output {
+		byPid[regexp.MustCompile(`"pid":(\d+)`).FindStringSubmatch(o)[1]] = o
+	}
+	assert.Contains(t, byPid["3433924"], `"ip":"192.168.1.20/10.0.0.5","peerAddress":"10.0.0.5:52344","trustedAddress":"10.0.0.5",`)
+	assert.Contains(t, byPid["3433925"], `"ip":"10.0.0.6","peerAddress":"10.0.0.6:40000","app"`)
+	assert.NotContains(t, byPid["3433926"], "peerAddress")
+	assert.NotContains(t, byPid["3433926"], "trustedAddress")
+}
+
+func TestRunningPeak(t *testing.T) {
+	// Running is the count when the command started, RunningPeak the max while it was running
+	testInput := `
+Perforce server info:
+	2024/07/11 10:00:00 pid 1 fred@ws 10.0.0.6 [p4/2023.2] 'user-sync //...'
+Perforce server info:
+	2024/07/11 10:00:01 pid 2 fred@ws 10.0.0.6 [p4/2023.2] 'user-sync //...'
+Perforce server info:
+	2024/07/11 10:00:02 pid 3 fred@ws 10.0.0.6 [p4/2023.2] 'user-info'
+Perforce server info:
+	2024/07/11 10:00:02 pid 3 completed .001s
+Perforce server info:
+	2024/07/11 10:00:03 pid 2 completed 2s
+Perforce server info:
+	2024/07/11 10:00:04 pid 4 fred@ws 10.0.0.6 [p4/2023.2] 'user-files //...'
+Perforce server info:
+	2024/07/11 10:00:04 pid 4 completed .1s
+Perforce server info:
+	2024/07/11 10:00:05 pid 1 completed 5s
+`
+	output := parseLogLines(testInput)
+	assert.Equal(t, 4, len(output))
+	byPid := map[string]string{}
+	for _, o := range output {
+		byPid[regexp.MustCompile(`"pid":(\d+)`).FindStringSubmatch(o)[1]] = o
+	}
+	assert.Contains(t, byPid["1"], `"running":1,"runningPeak":3,`)
+	assert.Contains(t, byPid["2"], `"running":2,"runningPeak":3,`)
+	assert.Contains(t, byPid["3"], `"running":3,"runningPeak":3,`)
+	assert.Contains(t, byPid["4"], `"running":2,"runningPeak":2,`)
+}
+
+func TestComputePhaseTables(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@ws 10.1.2.212 [p4/2023.1] 'user-sync //ws/...'
+Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@ws 10.1.2.212 [p4/2023.1] 'user-sync //ws/...'
+--- meta/db(R)
+---   total lock wait+held read/write 0ms+1210ms/0ms+0ms
+--- db.rev
+---   pages in+out+cached 100+0+96
+---   locks read/write 1/0 rows get+pos+scan put+del 0+56+2000 0+0
+---   total lock wait+held read/write 5ms+1200ms/0ms+0ms
+Perforce server info:
+	2024/04/03 12:20:15 pid 5032 compute end 1.5s
+Perforce server info:
+	2024/04/03 12:20:20 pid 5032 completed 6.1s
+Perforce server info:
+	2024/04/03 12:20:14 pid 5032 fred@ws 10.1.2.212 [p4/2023.1] 'user-sync //ws/...'
+--- lapse 6.1s
+--- db.rev
+---   pages in+out+cached 150+0+96
+---   locks read/write 2/0 rows get+pos+scan put+del 0+60+2100 0+0
+---   total lock wait+held read/write 5ms+1300ms/0ms+0ms
+--- db.have
+---   pages in+out+cached 10+20+5
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+10 10+0
+---   total lock wait+held read/write 0ms+0ms/2ms+50ms
+`
+	// By default compute phase track output is not distinguished
+	output := parseLogLines(testInput)
+	assert.Equal(t, 2, len(output))
+	assert.NotContains(t, output[0], "computeTables")
+
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	fp, err := NewParser(WithLogger(logger), WithComputePhaseTables())
+	assert.NoError(t, err)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 1, len(output))
+	var cmd Command
+	assert.NoError(t, json.Unmarshal([]byte(output[0]), &cmd))
+	assert.Equal(t, float32(1.5), cmd.ComputeLapse)
+	assert.Equal(t, 2, len(cmd.Tables))
+	assert.Equal(t, int64(1300), cmd.Tables["rev"].TotalReadHeld)
+	assert.Equal(t, int64(50), cmd.Tables["have"].TotalWriteHeld)
+	assert.Equal(t, 2, len(cmd.ComputeTables))
+	assert.Equal(t, int64(1200), cmd.ComputeTables["rev"].TotalReadHeld)
+	assert.Equal(t, int64(2000), cmd.ComputeTables["rev"].ScanRows)
+	assert.Equal(t, int64(1210), cmd.ComputeTables["meta/db_R"].TotalReadHeld)
+}
+
+func TestServerPrefix(t *testing.T) {
+	// Interleaved logs of two servers, with the same pid on each
+	testInput := `
+commit  | Perforce server info:
+edge1   | Perforce server info:
+commit  | 	2024/07/11 10:00:00 pid 1234 fred@ws 10.0.0.6 [p4/2023.2] 'user-sync //...'
+edge1   | 	2024/07/11 10:00:00 pid 1234 fred@ws 10.0.0.6 [p4/2023.2] 'user-sync //...'
+edge1   | Perforce server info:
+edge1   | 	2024/07/11 10:00:01 pid 1234 completed 1s
+commit  | Perforce server info:
+commit  | 	2024/07/11 10:00:02 pid 1234 completed 2s
+`
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	fp, err := NewParser(WithLogger(logger), WithServerPrefix(regexp.MustCompile(`^(\S+)\s+\| `)))
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 2, len(output))
+	cmds := map[string]Command{}
+	for _, o := range output {
+		var cmd Command
+		assert.NoError(t, json.Unmarshal([]byte(o), &cmd))
+		cmds[cmd.ServerID] = cmd
+	}
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, float32(2), cmds["commit"].CompletedLapse)
+	assert.Equal(t, float32(1), cmds["edge1"].CompletedLapse)
+	assert.Equal(t, int64(1234), cmds["edge1"].Pid)
+	assert.NotEqual(t, cmds["commit"].ProcessKey, cmds["edge1"].ProcessKey)
+
+	// Without the prefix regex the lines are not recognised
+	output = parseLogLines(testInput)
+	assert.Equal(t, 0, len(output))
+}
+
+// Lines for scanCmdLine - which must give the same result as the regexes
+var cmdLines = []string{
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [Microsoft Visual Studio 2013/12.0.21005.1] 'user-sync //...'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-change -o'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [] 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-sync ' trigger swarm.changesave",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-fstat -Ol //depot/it's/file' trigger x",
+	"\t2015/09/02 15:23:09 pid 1616 git-fusion-user@git-fusion--gf-host 10.1.2.3/10.4.5.6 [Git Fusion/2017.1] 'user-key -i {\"a\": \"b\"}'",
+	"\t2015/09/02 15:23:09 pid 1616 svc@unknown background [p4d] 'pull -i 1'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [app] '[x] 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [app] 'x] 'user-sync a'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [app] 'user-info' x] 'user-sync a'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-submit -d first line of desc",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-sync",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-sync.x' y'",
+	"\t2015/09/02 15:23:09 pid 1616 rob ert@robert-test 127.0.0.1 [p4] 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@rob@ert 127.0.0.1 [p4] 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 @ws  [p4] 'x'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] ''",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-info '",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4]  'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 p4 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 completed .031s 7+4us 0+584io 0+0net 4580k 0pf",
+	"\t2015/09/02 15:23:09 pid x robert@robert-test 127.0.0.1 [p4] 'user-info'",
+	"\t2015-09-02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-info'",
+	"2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-info'",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4\xff] 'user-s\xffync \xfe'",
+	"",
+	"\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-info'\n'",
+}
+
+func regexCmdLine(line string) ([]string, bool) {
+	m := reCmd.FindStringSubmatch(line)
+	if len(m) == 0 {
+		m = reCmdNoarg.FindStringSubmatch(line)
+	}
+	if len(m) == 0 {
+		m = reCmdMultiLineDesc.FindStringSubmatch(line)
+		return m, len(m) > 0
+	}
+	return m, false
+}
+
+func TestScanCmdLine(t *testing.T) {
+	check := func(line string) bool {
+		m, multiLineDesc, ok := scanCmdLine(line)
+		if !ok {
+			return false // Falls back to the regexes
+		}
+		rm, rMultiLineDesc := regexCmdLine(line)
+		if len(rm) == 0 {
+			rm = nil
+		}
+		return assert.Equal(t, rm, m, line) && assert.Equal(t, rMultiLineDesc, multiLineDesc, line)
+	}
+	for _, line := range cmdLines {
+		check(line)
+	}
+	// Only lines with newlines are left to the regexes
+	for _, line := range cmdLines[:len(cmdLines)-1] {
+		_, _, ok := scanCmdLine(line)
+		assert.True(t, ok, line)
+	}
+
+	// Truncations and single character changes of the lines
+	for _, line := range cmdLines {
+		for i := 0; i < len(line); i++ {
+			for _, l := range []string{line[:i], line[:i] + line[i+1:], line[:i] + " " + line[i+1:],
+				line[:i] + "'" + line[i+1:], line[:i] + "] '" + line[i+1:]} {
+				check(l)
+			}
+		}
+	}
+}
+
+func TestScanCompletedLine(t *testing.T) {
+	check := func(line string) {
+		m, ok := scanCompletedLine(line)
+		if !ok {
+			return
+		}
+		rm := reCompleted.FindStringSubmatch(line)
+		if len(rm) == 0 {
+			rm = nil
+		}
+		assert.Equal(t, rm, m, line)
+		if m != nil {
+			um := reCmdUsage.FindStringSubmatch(line)
+			if len(um) == 0 {
+				um = nil
+			}
+			assert.Equal(t, um, scanCmdUsage(line), line)
+		}
+	}
+	lines := []string{
+		"\t2015/09/02 15:23:10 pid 1616 completed .031s 7+4us 0+584io 0+0net 4580k 0pf",
+		"\t2015/09/02 15:23:10 pid 1616 completed 12s 17+14us 10+584io 1+20net 4580k 12pf",
+		"\t2015/09/02 15:23:10 pid 1616 completed 1.5s",
+		"\t2015/09/02 15:23:10 pid 1616 completed 1.5.3s 1+2us 1+2us 3+4io 5+6net 7k 8pf x",
+		"\t2015/09/02 15:23:10 pid 1616 completed 12.s",
+		"\t2015/09/02 15:23:10 pid 1616 completed .s",
+		"\t2015/09/02 15:23:10 pid 1616 compute end .031s",
+	}
+	for _, line := range lines {
+		check(line)
+	}
+	m, _ := scanCompletedLine(lines[0])
+	assert.NotNil(t, m)
+	for _, line := range lines {
+		for i := 0; i < len(line); i++ {
+			for _, l := range []string{line[:i], line[:i] + line[i+1:], line[:i] + " " + line[i+1:],
+				line[:i] + "." + line[i+1:], line[:i] + "1" + line[i+1:]} {
+				check(l)
+			}
+		}
+	}
+}
+
+func TestFastCmdScan(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 robert@robert-test 127.0.0.1 [p4] 'user-submit -d first line
+second line
+'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 completed .031s 7+4us 0+584io 0+0net 4580k 0pf
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .011s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed 2s
+`
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	fp, err := NewParser(WithLogger(logger), WithFeature(FeatureFastCmdScan, true))
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 3, len(output))
+	assert.Equal(t, parseLogLines(testInput), output)
+}
+
+func BenchmarkCmdLine(b *testing.B) {
+	line := cmdLines[0]
+	b.Run("regex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			regexCmdLine(line)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanCmdLine(line)
+		}
+	})
+}
+
+func TestLockTotals(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-submit -i'
+Perforce server info:
+	2024/01/02 10:00:00 pid 100 user1@ws1 10.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-submit -i'
+--- lapse 1.5s
+--- db.have
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+---   total lock wait+held read/write 12ms+13ms/14ms+15ms
+---   max lock wait+held read/write 12ms+13ms/14ms+15ms
+--- db.rev
+---   total lock wait+held read/write 100ms+20ms/0ms+1ms
+---   max lock wait+held read/write 100ms+20ms/0ms+1ms
+`
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	fp, err := NewParser(WithLogger(logger), WithLockTotals(), WithNoCompletionRecords())
+	assert.NoError(t, err)
+	output := parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 1, len(output))
+	var cmd Command
+	assert.NoError(t, json.Unmarshal([]byte(output[0]), &cmd))
+	assert.Equal(t, int64(112), cmd.TotalReadWait)
+	assert.Equal(t, int64(33), cmd.TotalReadHeld)
+	assert.Equal(t, int64(14), cmd.TotalWriteWait)
+	assert.Equal(t, int64(16), cmd.TotalWriteHeld)
+
+	// Not set by default
+	fp, err = NewParser(WithLogger(logger), WithNoCompletionRecords())
+	assert.NoError(t, err)
+	output = parseLogLinesWithParser(fp, testInput)
+	assert.Equal(t, 1, len(output))
+	assert.NotContains(t, output[0], `"totalReadWait":112`)
+}
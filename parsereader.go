@@ -0,0 +1,82 @@
+package p4dlog
+
+// Convenience APIs for parsing a complete log from an io.Reader or a file, e.g. when embedding the library. Rather than
+// callers splitting lines and feeding LogParser a channel, lines are read (with oversized lines truncated, see
+// LineReader) and compressed logs decompressed (gzip, zstd or bzip2, detected from the first bytes) internally. Time
+// advances only as per log entries, as the log is read much faster than it was written.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rcowham/go-libp4dlog/internal/logreader"
+)
+
+// Lines longer than this are truncated by ParseReader and ParseFile, as by log2sql
+const parseMaxLineLen = 5000
+
+// ParseReader parses the log read from r, returning commands and server events on the channel (as for LogParser),
+// which is closed at the end of the log. An error is returned if r can't be read or is in an unsupported compression
+// format - errors reading it later are available from ReadErr once the channel is closed.
+func (fp *P4dFileParser) ParseReader(ctx context.Context, r io.Reader) (<-chan interface{}, error) {
+	return fp.parseReader(ctx, r, nil)
+}
+
+// ParseFile is ParseReader for the file at path
+func (fp *P4dFileParser) ParseFile(ctx context.Context, path string) (<-chan interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cmdChan, err := fp.parseReader(ctx, file, file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cmdChan, nil
+}
+
+// parseReader - closer (if not nil) is closed once r has been read
+func (fp *P4dFileParser) parseReader(ctx context.Context, r io.Reader, closer io.Closer) (<-chan interface{}, error) {
+	reader, err := logreader.FromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	linesChan := make(chan string, 10000)
+	timeChan := make(chan time.Time) // Closed once the log has been read - time advances only as per log entries
+	go func() {
+		defer close(timeChan)
+		defer close(linesChan)
+		defer reader.Close()
+		if closer != nil {
+			defer closer.Close()
+		}
+		lr := NewLineReader(reader, parseMaxLineLen)
+		for lr.Scan() {
+			select {
+			case linesChan <- lr.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := lr.Err(); err != nil {
+			fp.m.Lock()
+			fp.readErr = err
+			fp.m.Unlock()
+			if fp.logger != nil {
+				fp.logger.Errorf("Error reading log: %v", err)
+			}
+		}
+	}()
+	return fp.LogParser(ctx, linesChan, timeChan), nil
+}
+
+// ReadErr - error reading the log by ParseReader or ParseFile, if any
+func (fp *P4dFileParser) ReadErr() error {
+	fp.m.Lock()
+	defer fp.m.Unlock()
+	return fp.readErr
+}
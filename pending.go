@@ -0,0 +1,215 @@
+package p4dlog
+
+// Bounding of the commands pending (started but not yet output) - on huge logs with many long-running or never
+// completed pids the map of pending commands otherwise grows without limit. With WithMaxPending, when more than the
+// maximum have not completed, the least recently active (i.e. started or updated longest ago in the log) are evicted.
+// With WithPendingTTL, uncompleted commands not active within that period of log time are evicted.
+//
+// Evicted commands are output with EndReason "evicted", unless a spill directory is set with WithSpillDir. In that
+// case they are written (gob encoded) to a temporary file in that directory, and restored if a completion record for
+// the pid is found later, so that they are output as normal. Those never restored are output with EndReason "evicted"
+// at the end of input.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// Fraction of MaxPending to evict at a time when exceeded, so the search for the least recently active is not repeated
+// for every new command
+const pendingEvictFraction = 10
+
+// spillEntry - location of an evicted command in the spill file
+type spillEntry struct {
+	offset int64
+	size   int64
+	lineNo int64
+}
+
+// spillFile - temporary file of evicted commands
+type spillFile struct {
+	f       *os.File
+	offset  int64
+	entries map[int64]spillEntry // Indexed by key of pending commands, i.e. pid unless WithServerPrefix
+}
+
+// EvictedCount - count of pending commands evicted due to MaxPending/PendingTTL (including those later restored)
+func (fp *P4dFileParser) EvictedCount() int64 {
+	return atomic.LoadInt64(&fp.evictedCount)
+}
+
+// evictPendingCommands is called as commands are added, and evicts uncompleted commands as required
+func (fp *P4dFileParser) evictPendingCommands() {
+	if fp.maxPending <= 0 && fp.pendingTTL <= 0 {
+		return
+	}
+	overMax := fp.maxPending > 0 && len(fp.cmds) > fp.maxPending
+	ttlDue := fp.pendingTTL > 0 && fp.currTime.Sub(fp.lastTTLCheck) >= fp.outputDuration
+	if !overMax && !ttlDue {
+		return
+	}
+	fp.m.Lock()
+	defer fp.m.Unlock()
+	candidates := fp.evictionCandidates()
+	evict := 0
+	if ttlDue {
+		fp.lastTTLCheck = fp.currTime
+		for evict < len(candidates) && fp.currTime.Sub(candidates[evict].lastActive) >= fp.pendingTTL {
+			evict++
+		}
+	}
+	// Completed commands (e.g. awaiting track records) are output shortly anyway, so only uncompleted ones count
+	if fp.maxPending > 0 && len(candidates)-evict > fp.maxPending {
+		target := fp.maxPending - fp.maxPending/pendingEvictFraction
+		evict = len(candidates) - target
+	}
+	for _, cmd := range candidates[:evict] {
+		delete(fp.cmds, fp.cmdKey(cmd))
+		fp.evictCmd(cmd)
+	}
+	atomic.StoreInt64(&fp.cmdsPending, int64(len(fp.cmds)))
+}
+
+// evictionCandidates returns the uncompleted pending commands, least recently active first
+func (fp *P4dFileParser) evictionCandidates() []*Command {
+	candidates := make([]*Command, 0)
+	for _, cmd := range fp.cmds {
+		if !cmd.completed && !cmdHasNoCompletionRecord(cmd.Cmd) {
+			candidates = append(candidates, cmd)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].lastActive.Equal(candidates[j].lastActive) {
+			return candidates[i].LineNo < candidates[j].LineNo
+		}
+		return candidates[i].lastActive.Before(candidates[j].lastActive)
+	})
+	return candidates
+}
+
+// evictCmd spills the command if possible, otherwise outputs it marked as evicted
+func (fp *P4dFileParser) evictCmd(cmd *Command) {
+	atomic.AddInt64(&fp.evictedCount, 1)
+	if fp.debugLog(cmd) {
+		fp.logger.Infof("evicting: pid %d lineNo %d cmd %s", cmd.Pid, cmd.LineNo, cmd.Cmd)
+	}
+	cmd.EndReason = EndReasonEvicted
+	cmd.LastSeenTime = fp.lastSeenTime
+	if fp.spillDir == "" || fp.spillErr != nil {
+		fp.outputCmd(cmd)
+		return
+	}
+	if err := fp.spillCmd(cmd); err != nil {
+		fp.spillErr = err
+		if fp.logger != nil {
+			fp.logger.Errorf("Error writing spill file - evicted commands will be output: %v", err)
+		}
+		fp.outputCmd(cmd)
+	}
+}
+
+func (fp *P4dFileParser) spillCmd(cmd *Command) error {
+	if fp.spill == nil {
+		f, err := os.CreateTemp(fp.spillDir, "p4dlog-spill-*")
+		if err != nil {
+			return err
+		}
+		fp.spill = &spillFile{f: f, entries: make(map[int64]spillEntry)}
+	}
+	// A previously evicted command with the same pid can no longer be completed
+	key := fp.cmdKey(cmd)
+	if _, ok := fp.spill.entries[key]; ok {
+		if old := fp.readSpilled(key); old != nil {
+			fp.outputCmd(old)
+		}
+	}
+	// Each command is encoded separately so that it can be read back on its own
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(PendingCommand{
+		Cmd:          *cmd,
+		HasTrackInfo: cmd.hasTrackInfo,
+		DuplicateKey: cmd.duplicateKey,
+	}); err != nil {
+		return err
+	}
+	if _, err := fp.spill.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	fp.spill.entries[key] = spillEntry{offset: fp.spill.offset, size: int64(buf.Len()), lineNo: cmd.LineNo}
+	fp.spill.offset += int64(buf.Len())
+	fp.trackRunning("t07", cmd, -1)
+	return nil
+}
+
+// readSpilled removes and returns the spilled command for key, or nil if none
+func (fp *P4dFileParser) readSpilled(key int64) *Command {
+	if fp.spill == nil {
+		return nil
+	}
+	e, ok := fp.spill.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(fp.spill.entries, key)
+	var p PendingCommand
+	if err := gob.NewDecoder(io.NewSectionReader(fp.spill.f, e.offset, e.size)).Decode(&p); err != nil {
+		if fp.logger != nil {
+			fp.logger.Errorf("Error reading spill file for line %d: %v", e.lineNo, err)
+		}
+		return nil
+	}
+	cmd := p.Cmd
+	cmd.hasTrackInfo = p.HasTrackInfo
+	cmd.duplicateKey = p.DuplicateKey
+	if cmd.Tables == nil {
+		cmd.Tables = make(map[string]*Table)
+	}
+	if cmd.SerializedLocks == nil {
+		cmd.SerializedLocks = make(map[string]*SerializedLock)
+	}
+	return &cmd
+}
+
+// pendingCmd returns the pending command for pid, restoring it from the spill file if it was evicted
+func (fp *P4dFileParser) pendingCmd(pid int64) (*Command, bool) {
+	key := fp.pidKey(pid)
+	if cmd, ok := fp.cmds[key]; ok {
+		return cmd, true
+	}
+	cmd := fp.readSpilled(key)
+	if cmd == nil {
+		return nil, false
+	}
+	if fp.debugLog(cmd) {
+		fp.logger.Infof("restoring: pid %d lineNo %d cmd %s", cmd.Pid, cmd.LineNo, cmd.Cmd)
+	}
+	cmd.EndReason = ""
+	cmd.LastSeenTime = blankTime
+	cmd.lastActive = fp.currTime
+	fp.cmds[key] = cmd
+	return cmd, true
+}
+
+// outputSpilledCommands outputs (in order) any commands remaining in the spill file, which is then removed
+func (fp *P4dFileParser) outputSpilledCommands() {
+	if fp.spill == nil {
+		return
+	}
+	keys := make([]int64, 0, len(fp.spill.entries))
+	for key := range fp.spill.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fp.spill.entries[keys[i]].lineNo < fp.spill.entries[keys[j]].lineNo })
+	for _, key := range keys {
+		if cmd := fp.readSpilled(key); cmd != nil {
+			fp.outputCmd(cmd)
+		}
+	}
+	fp.spill.f.Close()
+	os.Remove(fp.spill.f.Name())
+	fp.spill = nil
+}
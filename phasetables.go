@@ -0,0 +1,58 @@
+package p4dlog
+
+// Compute phase table usage. Commands such as sync and submit may write track output at the end of their compute
+// phase (before the completion record), e.g.
+//
+//	Perforce server info:
+//		2017/12/07 15:00:01 pid 145941 builder@LON 10.10.16.171 [p4/2017.1] 'user-sync //assets/...'
+//	--- meta/db(R)
+//	---   total lock wait+held read/write 0ms+0ms/0ms+0ms
+//
+// By default such records are merged into the command (with meta/db etc discarded), so the final track output gives
+// the table usage of the command as a whole. With WithComputePhaseTables they are instead recorded in
+// Command.ComputeTables (including meta/* locks, as e.g. meta/db_R), as lock behaviour during compute differs
+// materially from the commit phase. If there are several compute phases (e.g. sync with several args) the latest
+// values for each table are kept, as for the command totals.
+
+import (
+	"sort"
+	"strings"
+)
+
+// isComputePhaseTrack returns true if track output for cmd is from the end of the compute phase of a command already
+// pending, rather than from its completion
+func (fp *P4dFileParser) isComputePhaseTrack(cmd *Command) bool {
+	if !fp.computePhaseTables || fp.noCompletionRecords || cmdHasNoCompletionRecord(cmd.Cmd) {
+		return false
+	}
+	pending, ok := fp.cmds[fp.cmdKey(cmd)]
+	return ok && pending != cmd && pending.ProcessKey == cmd.ProcessKey && !pending.completed && !pending.hasTrackInfo
+}
+
+// metaTableName returns the table name for a "--- meta/db(R)" line, e.g. meta/db_R
+func metaTableName(line string) string {
+	return newSerializedLock(strings.TrimSpace(line[len(trackStart):])).LegacyTableName()
+}
+
+// setComputeTables moves the tables parsed from compute phase track output to ComputeTables
+func (c *Command) setComputeTables() {
+	if c.ComputeTables == nil {
+		c.ComputeTables = make(map[string]*Table, len(c.Tables))
+	}
+	for k, t := range c.Tables {
+		c.ComputeTables[k] = t
+	}
+	c.Tables = make(map[string]*Table)
+}
+
+// sortedTables returns the values of tables sorted by name, for output
+func sortedTables(tables map[string]*Table) []Table {
+	result := make([]Table, 0, len(tables))
+	for _, t := range tables {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].TableName < result[j].TableName
+	})
+	return result
+}
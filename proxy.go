@@ -0,0 +1,194 @@
+package p4dlog
+
+// Parsing of P4LOG files written by the proxy (p4p) and broker (p4broker), whose blocks start with
+// "Perforce proxy info:" and "Perforce broker info:" rather than "Perforce server info:". They are output as
+// ProxyEvent and BrokerEvent records on the same channel as Command records.
+//
+// Proxy blocks (track output, e.g. with -v track=1) record the files/bytes delivered from the server vs the cache:
+//
+//	Perforce proxy info:
+//		2024/01/02 10:00:00 pid 1234 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/...'
+//	--- lapse .041s
+//	--- proxytotals files/size svr+cache 1+20/1.2K+3.4M
+//
+// Broker blocks record the action taken for a command and where it was routed:
+//
+//	Perforce broker info:
+//		2024/01/02 10:00:00 pid 2345 bob@bob-ws 10.0.0.1 [p4/2023.2/LINUX26X86_64/2578891] 'user-sync //depot/...'
+//		action: redirect target: replica1
+//
+// Other lines in these blocks are ignored.
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyInfoBlock  = "Perforce proxy info:"
+	brokerInfoBlock = "Perforce broker info:"
+)
+
+var reProxyTotals = regexp.MustCompile(`^--- proxytotals files/size svr\+cache (\d+)\+(\d+)/([0-9.]+[BKMGTP]?)\+([0-9.]+[BKMGTP]?)`)
+var reBrokerAction = regexp.MustCompile(`^\t[Aa]ction:? (\S+)(?: [Tt]arget:? (\S+))?`)
+
+// ProxyEvent - a command serviced by a proxy, with counts of files/bytes from the server and the proxy cache
+type ProxyEvent struct {
+	LineNo      int64     `json:"lineNo"`
+	StartTime   time.Time `json:"startTime"`
+	Pid         int64     `json:"pid"`
+	User        string    `json:"user"`
+	Workspace   string    `json:"workspace"`
+	IP          string    `json:"ip"`
+	App         string    `json:"app"`
+	Cmd         string    `json:"cmd"`
+	Args        string    `json:"args"`
+	Lapse       float32   `json:"lapse"`
+	FilesServer int64     `json:"filesServer"` // Files fetched from the server
+	FilesCache  int64     `json:"filesCache"`  // Files delivered from the proxy cache
+	BytesServer int64     `json:"bytesServer"`
+	BytesCache  int64     `json:"bytesCache"`
+	ServerID    string    `json:"serverID,omitempty"` // Not set by the parser - see ServerEvent
+	// Not set by the parser - see ServerEvent
+	SourceFile   string `json:"sourceFile,omitempty"`
+	SourceLineNo int64  `json:"sourceLineNo,omitempty"`
+}
+
+func (p *ProxyEvent) String() string {
+	j, _ := json.Marshal(p)
+	return string(j)
+}
+
+// CacheHitRatio returns the fraction of files delivered from the cache (0 if there were no files)
+func (p *ProxyEvent) CacheHitRatio() float64 {
+	if p.FilesServer+p.FilesCache == 0 {
+		return 0
+	}
+	return float64(p.FilesCache) / float64(p.FilesServer+p.FilesCache)
+}
+
+// BrokerEvent - a command received by a broker, with the action taken (e.g. pass, redirect, reject, filter) and target
+type BrokerEvent struct {
+	LineNo    int64     `json:"lineNo"`
+	StartTime time.Time `json:"startTime"`
+	Pid       int64     `json:"pid"`
+	User      string    `json:"user"`
+	Workspace string    `json:"workspace"`
+	IP        string    `json:"ip"`
+	App       string    `json:"app"`
+	Cmd       string    `json:"cmd"`
+	Args      string    `json:"args"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	ServerID  string    `json:"serverID,omitempty"` // Not set by the parser - see ServerEvent
+	// Not set by the parser - see ServerEvent
+	SourceFile   string `json:"sourceFile,omitempty"`
+	SourceLineNo int64  `json:"sourceLineNo,omitempty"`
+}
+
+func (b *BrokerEvent) String() string {
+	j, _ := json.Marshal(b)
+	return string(j)
+}
+
+// AdjustTimes adds d to the start time, e.g. to correct for clock skew
+func (p *ProxyEvent) AdjustTimes(d time.Duration) {
+	if !p.StartTime.IsZero() {
+		p.StartTime = p.StartTime.Add(d)
+	}
+}
+
+// AdjustTimes adds d to the start time, e.g. to correct for clock skew
+func (b *BrokerEvent) AdjustTimes(d time.Duration) {
+	if !b.StartTime.IsZero() {
+		b.StartTime = b.StartTime.Add(d)
+	}
+}
+
+// proxyBytes parses sizes such as "0B", "1.2K" or "3.4M"
+func proxyBytes(value string) int64 {
+	return parseBytesString(strings.TrimSuffix(value, "B"))
+}
+
+// parseEventCmd parses a command start line (as in server info blocks) returning the fields of interest:
+// time, pid, user, workspace, ip, app, cmd, args
+func parseEventCmd(line string) []string {
+	m := reCmd.FindStringSubmatch(line)
+	if len(m) == 0 {
+		if m = reCmdNoarg.FindStringSubmatch(line); len(m) > 0 {
+			m = append(m, "")
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m[1:9]
+}
+
+func (fp *P4dFileParser) processProxyBlock(block *Block) {
+	var evt *ProxyEvent
+	hasTotals := false
+	for _, line := range block.lines {
+		if evt == nil {
+			m := parseEventCmd(line)
+			if m == nil {
+				continue
+			}
+			startTime, err := time.Parse(p4timeformat, m[0])
+			if err != nil {
+				fp.parseError(block.lineNo, line)
+				return
+			}
+			pid, _ := strconv.ParseInt(m[1], 10, 64)
+			evt = &ProxyEvent{LineNo: block.lineNo, StartTime: startTime, Pid: pid, User: m[2], Workspace: m[3],
+				IP: m[4], App: m[5], Cmd: m[6], Args: m[7]}
+			continue
+		}
+		if strings.HasPrefix(line, "--- lapse ") {
+			if f, err := strconv.ParseFloat(strings.TrimSuffix(line[len("--- lapse "):], "s"), 32); err == nil {
+				evt.Lapse = float32(f)
+			}
+		} else if m := reProxyTotals.FindStringSubmatch(line); len(m) > 0 {
+			hasTotals = true
+			evt.FilesServer, _ = strconv.ParseInt(m[1], 10, 64)
+			evt.FilesCache, _ = strconv.ParseInt(m[2], 10, 64)
+			evt.BytesServer = proxyBytes(m[3])
+			evt.BytesCache = proxyBytes(m[4])
+		}
+	}
+	// Blocks without track output (e.g. just the command start) have no cache information
+	if evt != nil && hasTotals {
+		fp.cmdChan <- *evt
+	}
+}
+
+func (fp *P4dFileParser) processBrokerBlock(block *Block) {
+	var evt *BrokerEvent
+	for _, line := range block.lines {
+		if evt == nil {
+			m := parseEventCmd(line)
+			if m == nil {
+				continue
+			}
+			startTime, err := time.Parse(p4timeformat, m[0])
+			if err != nil {
+				fp.parseError(block.lineNo, line)
+				return
+			}
+			pid, _ := strconv.ParseInt(m[1], 10, 64)
+			evt = &BrokerEvent{LineNo: block.lineNo, StartTime: startTime, Pid: pid, User: m[2], Workspace: m[3],
+				IP: m[4], App: m[5], Cmd: m[6], Args: m[7]}
+			continue
+		}
+		if m := reBrokerAction.FindStringSubmatch(line); len(m) > 0 {
+			evt.Action = strings.ToLower(m[1])
+			evt.Target = m[2]
+		}
+	}
+	if evt != nil && evt.Action != "" {
+		fp.cmdChan <- *evt
+	}
+}
@@ -0,0 +1,80 @@
+package p4dlog
+
+// Replay of a historical log at the pace at which it was written (or faster), so that live consumers - e.g. p4dtop or
+// metrics served by an Exporter and scraped by Prometheus - can be tested against past incidents realistically, e.g.
+//
+//	replayChan := make(chan string, 10000)
+//	go p4dlog.Replay(ctx, linesChan, replayChan, 10) // 10x real time
+//	cmdChan := fp.LogParser(ctx, replayChan, nil)
+//
+// Lines are delayed according to the time at the start of the line (as in command start/completion records and
+// server events) relative to the first such time. Lines without a time are passed on straight away.
+
+import (
+	"context"
+	"regexp"
+	"time"
+)
+
+var reLineTime = regexp.MustCompile(`^\s*(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d) `)
+
+// replayer - the clock is replaceable for tests
+type replayer struct {
+	speed    float64
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration)
+	logStart time.Time // Time of first line with a time
+	start    time.Time // Wall clock time at which it was sent
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// wait delays until line is due, if it has a time
+func (r *replayer) wait(ctx context.Context, line string) {
+	m := reLineTime.FindStringSubmatch(line)
+	if len(m) == 0 {
+		return
+	}
+	t, err := time.Parse(p4timeformat, m[1])
+	if err != nil {
+		return
+	}
+	if r.logStart.IsZero() {
+		r.logStart, r.start = t, r.now()
+		return
+	}
+	// Times going backwards (e.g. out of order lines or DST) are sent straight away
+	due := r.start.Add(time.Duration(float64(t.Sub(r.logStart)) / r.speed))
+	if d := due.Sub(r.now()); d > 0 {
+		r.sleep(ctx, d)
+	}
+}
+
+func (r *replayer) replay(ctx context.Context, in <-chan string, out chan<- string) {
+	defer close(out)
+	for line := range in {
+		r.wait(ctx, line)
+		select {
+		case out <- line:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Replay copies lines from in to out, pacing them by the times in the log at speed times real time (e.g. 1 for
+// real time, 60 for an hour of log per minute). Out is closed when in is closed or ctx is done.
+func Replay(ctx context.Context, in <-chan string, out chan<- string, speed float64) {
+	if speed <= 0 {
+		speed = 1
+	}
+	r := &replayer{speed: speed, now: time.Now, sleep: sleepContext}
+	r.replay(ctx, in, out)
+}
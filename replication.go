@@ -0,0 +1,45 @@
+package p4dlog
+
+// Replica pull threads are logged as 'pull' commands (with no completion records). Journal pull threads ('pull -i 1')
+// transfer journal records from the upstream server, while archive pull threads ('pull -u -i 1') transfer the
+// contents of files, taking them from the replica's queue of pending transfers held in rdb.lbr. The rows of rdb.lbr
+// scanned by an archive pull give an indication of the size of the queue (backlog), and the lbr write bytes the
+// amount of data transferred. These are used for replication metrics (p4_pull_*) - see metrics/replication.go
+
+import "strings"
+
+// Types of pull command, as returned by PullType
+const (
+	PullTypeJournal = "journal"
+	PullTypeArchive = "archive"
+)
+
+const rdbLbrTable = "rdb.lbr"
+
+// PullType returns PullTypeArchive for 'pull -u' commands, PullTypeJournal for other pull commands,
+// or "" if not a pull command
+func (c *Command) PullType() string {
+	if c.Cmd != "pull" {
+		return ""
+	}
+	for _, arg := range strings.Fields(c.Args) {
+		if arg == "-u" {
+			return PullTypeArchive
+		}
+	}
+	return PullTypeJournal
+}
+
+// PullQueueRows returns the rows of rdb.lbr scanned by the command, and whether it accessed rdb.lbr at all
+func (c *Command) PullQueueRows() (int64, bool) {
+	t, ok := c.Tables[rdbLbrTable]
+	if !ok {
+		return 0, false
+	}
+	return t.ScanRows, true
+}
+
+// LbrWriteBytes returns the total bytes written to archive files (of all types) by the command
+func (c *Command) LbrWriteBytes() int64 {
+	return c.LbrRcsWriteBytes + c.LbrBinaryWriteBytes + c.LbrCompressWriteBytes + c.LbrUncompressWriteBytes
+}
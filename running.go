@@ -0,0 +1,61 @@
+package p4dlog
+
+// Snapshots of currently running commands, e.g. for a live "p4 monitor" style view when tailing a log.
+// Pending commands are only accessed by the goroutine processing blocks, so a snapshot is requested from
+// that goroutine rather than taking a lock.
+
+import "sort"
+
+// RunningCommands returns copies of commands started but not yet completed, oldest first, with copies of any tables
+// from track output seen so far (e.g. at the end of the compute phase), so that locks held or waited on can be
+// reported. Serialized locks are not included. To be called while LogParser is running - returns nil once it has
+// finished.
+func (fp *P4dFileParser) RunningCommands() []Command {
+	req := make(chan []Command, 1)
+	select {
+	case fp.runningReq <- req:
+		return <-req
+	case <-fp.parseDone:
+		return nil
+	}
+}
+
+func (fp *P4dFileParser) runningSnapshot() []Command {
+	cmds := make([]Command, 0)
+	for _, cmd := range fp.cmds {
+		if cmd.completed {
+			continue
+		}
+		c := *cmd
+		if cmd.countedInRunning {
+			c.RunningPeak = fp.runningPeak(cmd) // So far
+		}
+		c.Tables = copyTables(cmd.Tables)
+		c.ComputeTables = copyTables(cmd.ComputeTables)
+		c.SerializedLocks = nil
+		if fp.lockTotals {
+			c.setLockTotals() // So far
+		}
+		cmds = append(cmds, c)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		if !cmds[i].StartTime.Equal(cmds[j].StartTime) {
+			return cmds[i].StartTime.Before(cmds[j].StartTime)
+		}
+		return cmds[i].LineNo < cmds[j].LineNo
+	})
+	return cmds
+}
+
+// copyTables returns copies of tables (nil if none), which the parser may update after a snapshot is returned
+func copyTables(tables map[string]*Table) map[string]*Table {
+	if len(tables) == 0 {
+		return nil
+	}
+	result := make(map[string]*Table, len(tables))
+	for k, t := range tables {
+		tc := *t
+		result[k] = &tc
+	}
+	return result
+}
@@ -0,0 +1,42 @@
+package p4dlog
+
+// Peak concurrency while a command was running. Command.Running is a snapshot of the count of running commands when
+// the command started, whereas Command.RunningPeak is the max count observed at any time until it completed - which
+// is the better measure of the server saturation experienced by e.g. a long running sync.
+//
+// Rather than updating every running command each time another starts, each change in the count is recorded with
+// a sequence number, keeping only those levels not exceeded later (so levels are in decreasing order of count and
+// there are at most as many as the peak count). The peak for a command is then the first level recorded since it
+// started.
+
+import "sort"
+
+// runningLevel - the count of running commands after change seq
+type runningLevel struct {
+	seq     int64
+	running int64
+}
+
+// noteRunning records the current count of running commands, returning its sequence number
+func (fp *P4dFileParser) noteRunning() int64 {
+	fp.runningSeq++
+	i := len(fp.runningLevels)
+	for i > 0 && fp.runningLevels[i-1].running <= fp.cmdsRunning {
+		i--
+	}
+	fp.runningLevels = append(fp.runningLevels[:i], runningLevel{seq: fp.runningSeq, running: fp.cmdsRunning})
+	return fp.runningSeq
+}
+
+// runningPeak returns the peak count of running commands since cmd started - only valid while it is counted in running
+func (fp *P4dFileParser) runningPeak(cmd *Command) int64 {
+	peak := cmd.RunningPeak
+	if cmd.Running > peak {
+		peak = cmd.Running
+	}
+	i := sort.Search(len(fp.runningLevels), func(i int) bool { return fp.runningLevels[i].seq >= cmd.runningSeq })
+	if i < len(fp.runningLevels) && fp.runningLevels[i].running > peak {
+		peak = fp.runningLevels[i].running
+	}
+	return peak
+}
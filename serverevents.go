@@ -0,0 +1,99 @@
+package p4dlog
+
+// Typed server events - notices written by p4d other than thread counts/resource pressure, output as ServerEvent
+// records with EventType set (and the thread values current at the time). They are written either in an info block:
+//
+//	Perforce server info:
+//		2024/01/02 10:00:00 pid 1234 Perforce Server starting 2023.2/LINUX26X86_64/2578891
+//
+// or as a single line, in the same way as "Server is now using N active threads":
+//
+//	2024/01/02 10:00:00 123456789 pid 1234: Server shutting down
+//
+// The message is classified by its content (see classifyServerMessage), as the exact text varies between p4d releases.
+// Other such lines are counted as unrecognised as before.
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Types of ServerEvent - thread count/resource pressure updates have an empty EventType
+const (
+	EventTypeStartup  = "startup"  // Server (re)started
+	EventTypeShutdown = "shutdown" // Server stopping, e.g. p4 admin stop
+	EventTypeLicense  = "license"  // License warnings, e.g. user count near the licensed limit, or expiry
+	EventTypeUpgrade  = "upgrade"  // Database upgrade notices, e.g. p4d -xu
+	EventTypeTimewarp = "timewarp" // Log time went backwards - see timewarp.go
+)
+
+// In order - the first match wins, e.g. "upgrade" for "Server starting database upgrade"
+var serverMessageTypes = []struct {
+	eventType string
+	re        *regexp.Regexp
+}{
+	{EventTypeLicense, regexp.MustCompile(`(?i)\blicen[cs]e`)},
+	{EventTypeUpgrade, regexp.MustCompile(`(?i)\bupgrad(e|ed|ing)\b`)},
+	{EventTypeShutdown, regexp.MustCompile(`(?i)\b(shut(ting)? ?down|stopp(ing|ed)|exiting)\b`)},
+	{EventTypeStartup, regexp.MustCompile(`(?i)\b(start(ing|ed)|restart(ing|ed)?)\b`)},
+}
+
+// Info block form, e.g. "\t2024/01/02 10:00:00 pid 1234 Perforce Server starting..."
+var reServerMessageInfo = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) (.+)$`)
+
+// Single line form, e.g. "2024/01/02 10:00:00 123456789 pid 1234: Server shutting down"
+var reServerMessageLine = regexp.MustCompile(`^(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) \d+ pid (\d+): (.+)$`)
+
+// classifyServerMessage returns the type of a server message, or "" if not recognised
+func classifyServerMessage(msg string) string {
+	// Messages must mention the server/database, e.g. not "... start ..." from a command
+	lower := strings.ToLower(msg)
+	if !strings.Contains(lower, "server") && !strings.Contains(lower, "database") && !strings.Contains(lower, "licen") {
+		return ""
+	}
+	for _, t := range serverMessageTypes {
+		if t.re.MatchString(msg) {
+			return t.eventType
+		}
+	}
+	return ""
+}
+
+// isServerMessageLine returns true for the single line form of a typed server event - these end a block
+func isServerMessageLine(line string) bool {
+	if len(line) == 0 || line[0] < '0' || line[0] > '9' {
+		return false
+	}
+	m := reServerMessageLine.FindStringSubmatch(line)
+	return len(m) > 0 && classifyServerMessage(m[3]) != ""
+}
+
+// outputServerMessage outputs a typed server event if line (from an info block, or the single line form)
+// is a recognised server message, returning true if so
+func (fp *P4dFileParser) outputServerMessage(line string, lineNo int64) bool {
+	m := reServerMessageInfo.FindStringSubmatch(line)
+	if len(m) == 0 {
+		m = reServerMessageLine.FindStringSubmatch(line)
+	}
+	if len(m) == 0 {
+		return false
+	}
+	eventType := classifyServerMessage(m[3])
+	if eventType == "" {
+		return false
+	}
+	svrEvent := fp.newSvrEvent(m[1], lineNo)
+	svrEvent.EventType = eventType
+	svrEvent.Message = strings.TrimSpace(m[3])
+	fp.cmdChan <- svrEvent
+	fp.ServerEventsCount++
+	atomic.AddInt64(&fp.svrEventsOutput, 1)
+	return true
+}
+
+func (fp *P4dFileParser) processServerMessageBlock(block *Block) {
+	if !fp.outputServerMessage(block.lines[0], block.lineNo) {
+		fp.unrecognisedLine(block.lineNo, block.lines[0])
+	}
+}
@@ -0,0 +1,70 @@
+package p4dlog
+
+// Interleaved logs from several p4d processes - e.g. a commit server and its replicas (or two instances) whose output
+// is collected into the same stream, with each line prefixed by the server it came from, as by docker compose:
+//
+//	commit  | Perforce server info:
+//	edge1   | Perforce server info:
+//	commit  | 	2024/07/11 11:16:51 pid 1234 fred@ws 10.0.0.5 [p4/2023.2] 'user-sync //...'
+//
+// Pids are only unique within a server, so commands from different servers with the same pid would otherwise be
+// merged. With WithServerPrefix the prefix is matched (and removed) from the start of each line, with its first
+// subexpression (or that named "server", or if none the whole prefix) identifying the server - e.g. `^(\S+)\s+\| `
+// for the above. Lines without the prefix are taken to be from the same server as the previous line, and a change
+// of server ends a block.
+// Commands are then keyed by (server, pid) rather than pid alone, and have ServerID set to the server. Their
+// process keys include the server so that identical start lines from different servers have different keys.
+
+import "regexp"
+
+// Server indexes are stored above the bits of pids in keys of pending commands
+const serverKeyShift = 40
+
+// setServerPrefix - set a regex matching the server prefix of each line, see WithServerPrefix
+func (fp *P4dFileParser) setServerPrefix(re *regexp.Regexp) {
+	fp.serverPrefix = re
+	fp.serverPrefixGroup = 0 // Whole prefix
+	if i := re.SubexpIndex("server"); i > 0 {
+		fp.serverPrefixGroup = i
+	} else if re.NumSubexp() > 0 {
+		fp.serverPrefixGroup = 1
+	}
+}
+
+// splitServerPrefix returns line without any server prefix, and the server it is from
+func (fp *P4dFileParser) splitServerPrefix(line string) (string, string) {
+	m := fp.serverPrefix.FindStringSubmatchIndex(line)
+	if m == nil {
+		return line, fp.lineServer
+	}
+	if g := 2 * fp.serverPrefixGroup; m[g] >= 0 {
+		fp.lineServer = line[m[g]:m[g+1]]
+	}
+	return line[m[1]:], fp.lineServer
+}
+
+// serverKey returns the key of pending commands for pid on server
+func (fp *P4dFileParser) serverKey(server string, pid int64) int64 {
+	if server == "" {
+		return pid
+	}
+	i, ok := fp.serverIndexes[server]
+	if !ok {
+		i = int64(len(fp.serverIndexes) + 1)
+		fp.serverIndexes[server] = i
+	}
+	return i<<serverKeyShift | pid
+}
+
+// pidKey returns the key of pending commands for pid in the block being processed
+func (fp *P4dFileParser) pidKey(pid int64) int64 {
+	return fp.serverKey(fp.currServer, pid)
+}
+
+// cmdKey returns the key of cmd in pending commands
+func (fp *P4dFileParser) cmdKey(cmd *Command) int64 {
+	if fp.serverPrefix == nil {
+		return cmd.Pid
+	}
+	return fp.serverKey(cmd.ServerID, cmd.Pid)
+}
@@ -0,0 +1,82 @@
+package p4dlog
+
+// Parser statistics, e.g. to check coverage of the parser against logs from new p4d releases which may add line
+// formats not yet recognised. Counters are updated atomically so Stats may be called while LogParser is running.
+// Unrecognised lines (lines within info blocks not matching any known format) and noise lines (not written by p4d -
+// see resyncLine) can also be written to a file with WithUnmatchedLines.
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ParserStats - counts of lines and records processed by the parser
+type ParserStats struct {
+	LinesRead         int64 // Lines received by LogParser
+	CmdsOutput        int64 // Commands output (completed, or pending at end of input)
+	ServerEvents      int64 // Server events output
+	CmdsPending       int64 // Commands started but not yet output
+	UnrecognisedLines int64 // Lines in info blocks not matching any known format
+	NoiseLines        int64 // Lines discarded as not written by p4d
+	ParseErrors       int64 // Lines of known format with values which couldn't be parsed, e.g. invalid timestamps
+	CmdsEvicted       int64 // Uncompleted commands evicted due to max pending/pending TTL - see pending.go
+	Timewarps         int64 // Times log time went backwards by more than the threshold - see timewarp.go
+}
+
+// Stats returns counts of lines and records processed so far
+func (fp *P4dFileParser) Stats() ParserStats {
+	return ParserStats{
+		LinesRead:         atomic.LoadInt64(&fp.linesRead),
+		CmdsOutput:        atomic.LoadInt64(&fp.cmdsOutput),
+		ServerEvents:      atomic.LoadInt64(&fp.svrEventsOutput),
+		CmdsPending:       atomic.LoadInt64(&fp.cmdsPending),
+		UnrecognisedLines: atomic.LoadInt64(&fp.unrecognisedLines),
+		NoiseLines:        fp.NoiseLinesCount(),
+		ParseErrors:       atomic.LoadInt64(&fp.parseErrors),
+		CmdsEvicted:       fp.EvictedCount(),
+		Timewarps:         fp.TimewarpCount(),
+	}
+}
+
+func (s ParserStats) String() string {
+	return fmt.Sprintf("lines read %d, cmds output %d, server events %d, cmds pending %d, unrecognised lines %d, noise lines %d, parse errors %d, cmds evicted %d, timewarps %d",
+		s.LinesRead, s.CmdsOutput, s.ServerEvents, s.CmdsPending, s.UnrecognisedLines, s.NoiseLines, s.ParseErrors, s.CmdsEvicted,
+		s.Timewarps)
+}
+
+// writeUnmatched writes a line as "<lineNo>\t<kind>\t<line>"
+func (fp *P4dFileParser) writeUnmatched(lineNo int64, kind, line string) {
+	if fp.unmatchedWriter == nil {
+		return
+	}
+	// Noise lines are found by the goroutine reading lines, unrecognised lines by that processing blocks
+	fp.unmatchedMu.Lock()
+	defer fp.unmatchedMu.Unlock()
+	if fp.unmatchedErr != nil {
+		return
+	}
+	if _, fp.unmatchedErr = fmt.Fprintf(fp.unmatchedWriter, "%d\t%s\t%s\n", lineNo, kind, line); fp.unmatchedErr != nil && fp.logger != nil {
+		fp.logger.Errorf("Error writing unmatched lines: %v", fp.unmatchedErr)
+	}
+}
+
+// unrecognisedLine notes a line in an info block not matching any known format
+func (fp *P4dFileParser) unrecognisedLine(lineNo int64, line string) {
+	if strings.HasPrefix(line, "server to client") {
+		return
+	}
+	atomic.AddInt64(&fp.unrecognisedLines, 1)
+	if FlagSet(fp.debug, DebugUnrecognised) && fp.logger != nil {
+		fp.logger.Tracef("Unrecognised: %d %s", lineNo, line)
+	}
+	fp.writeUnmatched(lineNo, "unrecognised", line)
+}
+
+// parseError notes a line of known format with a value which couldn't be parsed
+func (fp *P4dFileParser) parseError(lineNo int64, msg string) {
+	atomic.AddInt64(&fp.parseErrors, 1)
+	if FlagSet(fp.debug, DebugUnrecognised) && fp.logger != nil {
+		fp.logger.Tracef("Parse error: %d %s", lineNo, msg)
+	}
+}
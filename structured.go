@@ -0,0 +1,249 @@
+package p4dlog
+
+// Parser for p4d structured logs - CSV files written as configured by serverlog.file.N, e.g. commands.csv,
+// errors.csv, or all.csv which contains all events in order. See "p4 help serverlog" and "p4 logschema".
+// Command start/compute/end and error events are combined into the same Command objects as produced by
+// P4dFileParser, so that output can be processed in the same way (metrics, SQL etc).
+// Structured logs do not contain track output, so Tables, usage and rpc values are not set.
+//
+// When commands and errors are in separate files, process errors.csv before commands.csv - errors for
+// commands which have already been output are otherwise output as separate (error only) commands. Callers can
+// identify such files with StructuredErrorEvent, as log2sql does to order them.
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields common to command and error events (in order)
+const (
+	slEventType = iota
+	slTimestamp
+	slTimestamp2
+	slDate
+	slPid
+	slCmdIdent
+	slServerID
+	slCmdNo
+	slUser
+	slClient
+	slFunc
+	slHost
+	slProg
+	slVersion
+	slArgs
+	slCmdFields // Count of the above
+)
+
+// Additional fields for error events
+const (
+	slSeverity = slCmdFields + iota
+	slSubsys
+	slSubcode
+	slText
+	slErrorFields
+)
+
+// Values of f_eventtype which are processed - others (audit, track etc) are ignored
+const (
+	slCommandStart   = "0"
+	slCommandCompute = "1"
+	slCommandEnd     = "2"
+	slErrorFailed    = "3"
+	slErrorFatal     = "4"
+)
+
+// Values of f_severity (E_EMPTY, E_INFO, E_WARN, E_FAILED, E_FATAL)
+var slSeverities = []string{"", ErrorSeverityInfo, ErrorSeverityWarn, ErrorSeverityError, ErrorSeverityFatal}
+
+// StructuredErrorEvent reports whether line is an error event, e.g. the first line of errors.csv
+func StructuredErrorEvent(line string) bool {
+	eventType := line
+	if i := strings.IndexByte(line, ','); i >= 0 {
+		eventType = line[:i]
+	}
+	return eventType == slErrorFailed || eventType == slErrorFatal
+}
+
+// StructuredLogParser - parses p4d structured (CSV) logs
+type StructuredLogParser struct {
+	logger          *logrus.Logger
+	cmds            map[string]*Command // Keyed by pid/cmdident/cmdno
+	cmdChan         chan interface{}
+	lineNo          int64
+	noiseLinesCount int64
+}
+
+// NewStructuredLogParser - create and initialise properly
+func NewStructuredLogParser(logger *logrus.Logger) *StructuredLogParser {
+	return &StructuredLogParser{
+		logger: logger,
+		cmds:   make(map[string]*Command),
+	}
+}
+
+// NoiseLinesCount - count of lines discarded as not being valid CSV events
+func (sp *StructuredLogParser) NoiseLinesCount() int64 {
+	return atomic.LoadInt64(&sp.noiseLinesCount)
+}
+
+// parseStructuredDate parses f_date, e.g. "2024/06/19 12:25:31 560465376" (with optional nanoseconds),
+// falling back to f_timestamp (secs since epoch)
+func parseStructuredDate(date, timestamp string) (time.Time, error) {
+	if len(date) >= len(p4timeformat) {
+		t, err := time.Parse(p4timeformat, date[:len(p4timeformat)])
+		if err == nil {
+			if frac := strings.TrimSpace(date[len(p4timeformat):]); frac != "" {
+				if ns, err := strconv.ParseInt(frac, 10, 64); err == nil && len(frac) <= 9 {
+					for i := len(frac); i < 9; i++ {
+						ns *= 10
+					}
+					t = t.Add(time.Duration(ns))
+				}
+			}
+			return t, nil
+		}
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return blankTime, fmt.Errorf("invalid date %q / timestamp %q", date, timestamp)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// getCmd returns the key and command for the event, creating it if necessary
+func (sp *StructuredLogParser) getCmd(line string, fields []string, t time.Time) (string, *Command) {
+	key := fmt.Sprintf("%s/%s/%s", fields[slPid], fields[slCmdIdent], fields[slCmdNo])
+	cmd, ok := sp.cmds[key]
+	if !ok {
+		cmd = newCommand()
+		sp.setStart(cmd, line, t)
+		sp.cmds[key] = cmd
+	}
+	cmd.Pid = toInt64(fields[slPid])
+	cmd.User = fields[slUser]
+	cmd.Workspace = fields[slClient]
+	cmd.Cmd = fields[slFunc]
+	cmd.IP = fields[slHost]
+	cmd.App = fields[slProg]
+	if fields[slVersion] != "" {
+		cmd.App += "/" + fields[slVersion]
+	}
+	cmd.Args = fields[slArgs]
+	return key, cmd
+}
+
+// setStart sets values from the start event - or the first event seen for the command if errors are processed first
+func (sp *StructuredLogParser) setStart(cmd *Command, line string, t time.Time) {
+	h := md5.Sum([]byte(line))
+	cmd.ProcessKey = hex.EncodeToString(h[:])
+	cmd.LineNo = sp.lineNo
+	cmd.StartTime = t
+}
+
+func (sp *StructuredLogParser) outputCmd(key string, cmd *Command) {
+	delete(sp.cmds, key)
+	cmd.updateStartEndTimes()
+	sp.cmdChan <- *cmd
+}
+
+// processLine processes a single CSV event
+func (sp *StructuredLogParser) processLine(line string) {
+	sp.lineNo++
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	r := csv.NewReader(strings.NewReader(line))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	fields, err := r.Read()
+	if err != nil || len(fields) < slCmdFields {
+		atomic.AddInt64(&sp.noiseLinesCount, 1)
+		sp.logger.Tracef("Unrecognised: %d %s", sp.lineNo, line)
+		return
+	}
+	eventType := fields[slEventType]
+	switch eventType {
+	case slCommandStart, slCommandCompute, slCommandEnd, slErrorFailed, slErrorFatal:
+	default:
+		return
+	}
+	t, err := parseStructuredDate(fields[slDate], fields[slTimestamp])
+	if err != nil {
+		atomic.AddInt64(&sp.noiseLinesCount, 1)
+		sp.logger.Tracef("Unrecognised: %d %s: %v", sp.lineNo, line, err)
+		return
+	}
+	key, cmd := sp.getCmd(line, fields, t)
+	switch eventType {
+	case slCommandStart:
+		sp.setStart(cmd, line, t)
+	case slCommandCompute:
+		cmd.ComputeLapse = float32(t.Sub(cmd.StartTime).Seconds())
+	case slCommandEnd:
+		cmd.EndTime = t
+		cmd.CompletedLapse = float32(t.Sub(cmd.StartTime).Seconds())
+		sp.outputCmd(key, cmd)
+	case slErrorFailed, slErrorFatal:
+		severity := ErrorSeverityError
+		if eventType == slErrorFatal {
+			severity = ErrorSeverityFatal
+		}
+		if len(fields) >= slErrorFields {
+			if i, err := strconv.Atoi(fields[slSeverity]); err == nil && i > 0 && i < len(slSeverities) {
+				severity = slSeverities[i]
+			}
+			// Unique error code as reported by p4 -e (subsystem and code within it)
+			cmd.ErrorCode = toInt64(fields[slSubsys])<<10 | toInt64(fields[slSubcode])
+			text := strings.TrimSpace(fields[slText])
+			cmd.addError(sp.lineNo, text)
+			cmd.setKilled(text)
+		}
+		cmd.setError(severity)
+	}
+}
+
+// outputRemainingCommands outputs commands without end events, in order
+func (sp *StructuredLogParser) outputRemainingCommands() {
+	keys := make([]string, 0, len(sp.cmds))
+	for k := range sp.cmds {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return sp.cmds[keys[i]].LineNo < sp.cmds[keys[j]].LineNo })
+	for _, k := range keys {
+		sp.outputCmd(k, sp.cmds[k])
+	}
+}
+
+// LogParser - interface to be run on a go routine - commands are returned on the returned channel, which
+// is closed when linesChan is closed
+func (sp *StructuredLogParser) LogParser(ctx context.Context, linesChan <-chan string) chan interface{} {
+	sp.cmdChan = make(chan interface{}, 10000)
+	go func() {
+		defer close(sp.cmdChan)
+		for {
+			select {
+			case <-ctx.Done():
+				sp.logger.Debugf("StructuredLogParser: context done")
+				return
+			case line, ok := <-linesChan:
+				if !ok {
+					sp.outputRemainingCommands()
+					return
+				}
+				sp.processLine(line)
+			}
+		}
+	}()
+	return sp.cmdChan
+}
@@ -0,0 +1,90 @@
+package p4dlog
+
+// Detection of log time going backwards ("timewarps"), e.g. in large consolidated logs containing the logs of several
+// replicas concatenated, or after the server clock was corrected. With WithTimewarpThreshold, a command starting more
+// than the threshold before the latest start time seen so far is preceded by a ServerEvent with EventType "timewarp".
+// Later commands are then compared with the new (earlier) time, so that each warp is reported once.
+//
+// As commands are normally output in order of completion, out of order time ranges also result in out of order output.
+// With WithReorderBuffer, up to N commands are held and output in order of start time (the earliest being output
+// when the buffer is full), which is enough to re-order output over short warps. Server events are not held.
+
+import (
+	"container/heap"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// TimewarpCount - count of times log time went backwards by more than the threshold
+func (fp *P4dFileParser) TimewarpCount() int64 {
+	return atomic.LoadInt64(&fp.timewarpCount)
+}
+
+// checkTimewarp is called with the start time of each command, outputting a server event if it is before the
+// latest start time by more than the threshold
+func (fp *P4dFileParser) checkTimewarp(t time.Time, lineNo int64) {
+	if fp.timewarpThreshold <= 0 || t.IsZero() {
+		return
+	}
+	prev := fp.timewarpLatest
+	if prev.IsZero() || t.After(prev) {
+		fp.timewarpLatest = t
+		return
+	}
+	d := prev.Sub(t)
+	if d <= fp.timewarpThreshold {
+		return
+	}
+	fp.timewarpLatest = t
+	if atomic.AddInt64(&fp.timewarpCount, 1) == 1 && fp.logger != nil {
+		fp.logger.Warnf("Log time went backwards by %s at line %d (from %s to %s) - see timewarp server events",
+			d, lineNo, prev.Format(p4timeformat), t.Format(p4timeformat))
+	}
+	svrEvent := fp.newSvrEvent(t.Format(p4timeformat), lineNo)
+	svrEvent.EventType = EventTypeTimewarp
+	svrEvent.Message = fmt.Sprintf("Log time went backwards by %s from %s", d, prev.Format(p4timeformat))
+	fp.cmdChan <- svrEvent
+	fp.ServerEventsCount++
+	atomic.AddInt64(&fp.svrEventsOutput, 1)
+}
+
+// reorderBuffer - heap of commands ordered by start time (then line no)
+type reorderBuffer []Command
+
+func (b reorderBuffer) Len() int { return len(b) }
+func (b reorderBuffer) Less(i, j int) bool {
+	if b[i].StartTime.Equal(b[j].StartTime) {
+		return b[i].LineNo < b[j].LineNo
+	}
+	return b[i].StartTime.Before(b[j].StartTime)
+}
+func (b reorderBuffer) Swap(i, j int)       { b[i], b[j] = b[j], b[i] }
+func (b *reorderBuffer) Push(x interface{}) { *b = append(*b, x.(Command)) }
+func (b *reorderBuffer) Pop() interface{} {
+	old := *b
+	n := len(old)
+	cmd := old[n-1]
+	old[n-1] = Command{} // Release references
+	*b = old[:n-1]
+	return cmd
+}
+
+// sendCmd sends a command to the output channel, via the reorder buffer if set
+func (fp *P4dFileParser) sendCmd(cmd Command) {
+	if fp.reorderSize <= 0 {
+		fp.cmdChan <- cmd
+		return
+	}
+	heap.Push(&fp.reorder, cmd)
+	if fp.reorder.Len() > fp.reorderSize {
+		fp.cmdChan <- heap.Pop(&fp.reorder).(Command)
+	}
+}
+
+// flushReorderBuffer outputs all commands held in the reorder buffer - at the end of processing
+func (fp *P4dFileParser) flushReorderBuffer() {
+	for fp.reorder.Len() > 0 {
+		fp.cmdChan <- heap.Pop(&fp.reorder).(Command)
+	}
+}